@@ -0,0 +1,463 @@
+package wzprof
+
+import (
+	"context"
+	"encoding/binary"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/pprof/profile"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+)
+
+// AccessProfiler is an experimental profiler of the accesses of the guest to
+// its linear memory, to investigate behaviors of the caches that CPU time
+// alone does not explain.
+//
+// wazero does not allow observing the load and store instructions, so the
+// profiler scans the code of the module for the memory instructions of each
+// function, and counts them each time the function is called. Each instruction
+// counts once per call: the accesses made in loops are under-estimated, and
+// the sizes of bulk memory operations (memory.copy, memory.fill) are unknown.
+// The profile shows which call sites touch memory the most, not exact counts.
+//
+// The profiler generates the following samples:
+// - "calls"  records the calls to functions accessing memory
+// - "loads"  records the load instructions
+// - "stores" records the store instructions
+// - "memory" records the bytes loaded and stored
+//
+// The values are counted since the creation of the profiler. Only functions
+// with memory instructions are instrumented, and the calls can be sampled with
+// Sample to reduce the overhead.
+type AccessProfiler struct {
+	p        *Profiling
+	mutex    sync.Mutex
+	counts   map[uint64]*accessSample
+	arena    stackArena
+	start    time.Time
+	accesses map[uint32]memoryAccesses
+}
+
+// memoryAccesses are the memory instructions of a function.
+type memoryAccesses struct {
+	loads  int64
+	stores int64
+	bytes  int64
+	// Tail calls are not memory accesses, but the scan of the instructions
+	// is the one finding them, see Profiling.TailCalls.
+	tailCalls int64
+}
+
+type accessSample struct {
+	stack stackTrace
+	value [4]int64 // calls, loads, stores, bytes
+}
+
+func (s *accessSample) sampleLocation() stackTrace {
+	return s.stack
+}
+
+func (s *accessSample) sampleValue() []int64 {
+	return s.value[:]
+}
+
+func newAccessProfiler(p *Profiling) *AccessProfiler {
+	a := &AccessProfiler{
+		p:        p,
+		counts:   make(map[uint64]*accessSample),
+		start:    time.Now(),
+		accesses: wasmMemoryAccesses(p.wasm),
+	}
+	p.metrics.trackStacks(a.Count)
+	return a
+}
+
+// NewProfile builds a profile of the memory accesses recorded since the
+// profiler was created.
+func (p *AccessProfiler) NewProfile(sampleRate float64) *profile.Profile {
+	prof, _ := p.NewProfileContext(context.Background(), sampleRate)
+	return prof
+}
+
+// NewProfileContext is like NewProfile but stops building the profile and
+// returns an error when ctx is canceled.
+func (p *AccessProfiler) NewProfileContext(ctx context.Context, sampleRate float64) (*profile.Profile, error) {
+	p.mutex.Lock()
+	samples := make(map[uint64]*accessSample, len(p.counts))
+	for k, s := range p.counts {
+		c := *s
+		samples[k] = &c
+	}
+	p.mutex.Unlock()
+
+	ratio := 1 / sampleRate
+	prof, err := buildProfile(ctx, p.p, samples, p.start, p.p.clockSkew(), time.Since(p.start), p.SampleType(),
+		[]float64{ratio, ratio, ratio, ratio}, nil,
+	)
+	return p.p.completeProfile(ctx, p.Name(), prof, err)
+}
+
+// Name returns "access".
+func (p *AccessProfiler) Name() string {
+	return "access"
+}
+
+// Desc returns a description of the memory access profile.
+func (p *AccessProfiler) Desc() string {
+	return "Estimated accesses of the guest to its linear memory (experimental)"
+}
+
+// Count returns the number of stacks recorded in p.
+func (p *AccessProfiler) Count() int {
+	p.mutex.Lock()
+	n := len(p.counts)
+	p.mutex.Unlock()
+	return n
+}
+
+// SampleType returns the set of value types present in samples recorded by
+// the memory access profiler.
+func (p *AccessProfiler) SampleType() []*profile.ValueType {
+	return []*profile.ValueType{
+		{Type: "calls", Unit: "count"},
+		{Type: "loads", Unit: "count"},
+		{Type: "stores", Unit: "count"},
+		{Type: "memory", Unit: "bytes"},
+	}
+}
+
+// NewHandler returns a http handler allowing the profiler to be exposed on a
+// pprof-compatible http endpoint.
+//
+// The sample rate is a value between 0 and 1 used to scale the profile results
+// based on the sampling rate applied to the profiler so the resulting values
+// remain representative.
+func (p *AccessProfiler) NewHandler(sampleRate float64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		prof, err := p.NewProfileContext(r.Context(), sampleRate)
+		if err != nil {
+			serveError(w, http.StatusInternalServerError, "profile canceled")
+			return
+		}
+		serveProfile(w, r, prof)
+	})
+}
+
+// NewFunctionListener returns a function listener counting the memory accesses
+// of calls to the function passed as argument, or nil if the function has no
+// memory instructions.
+func (p *AccessProfiler) NewFunctionListener(def api.FunctionDefinition) experimental.FunctionListener {
+	if !p.p.listensTo(def) {
+		return nil
+	}
+	accesses, ok := p.accesses[def.Index()]
+	if !ok {
+		return nil
+	}
+	return profilingListener{p.p, &accessListener{profiler: p, accesses: accesses}}
+}
+
+type accessListener struct {
+	profiler *AccessProfiler
+	accesses memoryAccesses
+	stack    stackTrace
+}
+
+func (l *accessListener) Before(ctx context.Context, mod api.Module, def api.FunctionDefinition, params []uint64, si experimental.StackIterator) {
+	p := l.profiler
+	p.mutex.Lock()
+	l.stack = makeStackTrace(ctx, l.stack, si)
+	s := p.counts[l.stack.key]
+	if s == nil {
+		s = &accessSample{stack: p.arena.clone(l.stack)}
+		p.counts[l.stack.key] = s
+	}
+	s.value[0]++
+	s.value[1] += l.accesses.loads
+	s.value[2] += l.accesses.stores
+	s.value[3] += l.accesses.bytes
+	p.mutex.Unlock()
+	p.p.metrics.samples.Add(1)
+}
+
+func (l *accessListener) After(ctx context.Context, mod api.Module, def api.FunctionDefinition, results []uint64) {
+}
+
+func (l *accessListener) Abort(ctx context.Context, mod api.Module, def api.FunctionDefinition, err error) {
+}
+
+// wasmMemoryAccesses scans the code section of the module, and returns the
+// memory instructions of the functions accessing memory, indexed by function
+// index. The scan of a function stops at the first instruction it does not
+// know, so its accesses may be incomplete.
+func wasmMemoryAccesses(b []byte) map[uint32]memoryAccesses {
+	accesses := make(map[uint32]memoryAccesses)
+	wasmFunctionBodies(b, func(index uint32, body []byte) bool {
+		if a := scanMemoryAccesses(body); a.loads+a.stores > 0 {
+			accesses[index] = a
+		}
+		return true
+	})
+	return accesses
+}
+
+// wasmFunctionBodies calls fn with the index and body of each function of the
+// code section of the module, until fn returns false.
+func wasmFunctionBodies(b []byte, fn func(index uint32, body []byte) bool) {
+	const codeSectionId = 10
+
+	code := wasmSection(b, codeSectionId)
+	if code == nil {
+		return
+	}
+	index := wasmImportedFunctions(b)
+	count, n := binary.Uvarint(code)
+	if n <= 0 {
+		return
+	}
+	code = code[n:]
+
+	for i := uint64(0); i < count; i++ {
+		size, n := binary.Uvarint(code)
+		if n <= 0 || size > uint64(len(code)-n) {
+			break
+		}
+		body := code[n : n+int(size)]
+		code = code[n+int(size):]
+
+		if !fn(index, body) {
+			break
+		}
+		index++
+	}
+}
+
+// scanMemoryAccesses counts the memory instructions of a function body.
+func scanMemoryAccesses(body []byte) (a memoryAccesses) {
+	r := wasmReader{b: body}
+	// Local declarations: a vector of (count, type).
+	for n := r.uvarint(); n > 0 && r.ok(); n-- {
+		r.uvarint()
+		r.byte()
+	}
+
+	for r.ok() && len(r.b) > 0 {
+		op := r.byte()
+		switch {
+		case op <= 0x01, op == 0x05, op == 0x0B, op == 0x0F, op == 0x19, op == 0x1A, op == 0x1B,
+			op >= 0x45 && op <= 0xC4, op == 0xD1:
+			// No immediates.
+		case op >= 0x02 && op <= 0x04, op == 0x06:
+			r.blockType()
+		case op >= 0x07 && op <= 0x09, op == 0x0C, op == 0x0D, op == 0x10, op == 0x18,
+			op >= 0x20 && op <= 0x26, op == 0x3F, op == 0x40, op == 0xD2:
+			r.uvarint()
+		case op == 0x12: // return_call
+			r.uvarint()
+			a.tailCalls++
+		case op == 0x0E: // br_table
+			for n := r.uvarint(); n > 0 && r.ok(); n-- {
+				r.uvarint()
+			}
+			r.uvarint()
+		case op == 0x11: // call_indirect
+			r.uvarint()
+			r.uvarint()
+		case op == 0x13: // return_call_indirect
+			r.uvarint()
+			r.uvarint()
+			a.tailCalls++
+		case op == 0x1C: // select t*
+			r.skip(int(r.uvarint()))
+		case op >= 0x28 && op <= 0x35:
+			r.memarg()
+			a.loads++
+			a.bytes += loadStoreSizes[op-0x28]
+		case op >= 0x36 && op <= 0x3E:
+			r.memarg()
+			a.stores++
+			a.bytes += loadStoreSizes[op-0x28]
+		case op == 0x41, op == 0x42: // i32.const, i64.const
+			r.uvarint()
+		case op == 0x43: // f32.const
+			r.skip(4)
+		case op == 0x44: // f64.const
+			r.skip(8)
+		case op == 0xD0: // ref.null
+			r.byte()
+		case op == 0xFC:
+			scanMiscInstruction(&r, &a)
+		case op == 0xFD:
+			scanVectorInstruction(&r, &a)
+		case op == 0xFE:
+			scanAtomicInstruction(&r, &a)
+		default:
+			return a
+		}
+	}
+	return a
+}
+
+// Sizes of the values of the load and store instructions 0x28-0x3E.
+var loadStoreSizes = [...]int64{
+	4, 8, 4, 8, 1, 1, 2, 2, 1, 1, 2, 2, 4, 4, // loads
+	4, 8, 4, 8, 1, 2, 1, 2, 4, // stores
+}
+
+// scanMiscInstruction scans the instructions with the 0xFC prefix: saturating
+// truncations, bulk memory and table operations.
+func scanMiscInstruction(r *wasmReader, a *memoryAccesses) {
+	switch op := r.uvarint(); op {
+	case 8: // memory.init
+		r.uvarint()
+		r.byte()
+		a.stores++
+	case 9, 13, 15, 16, 17:
+		r.uvarint()
+	case 10: // memory.copy
+		r.byte()
+		r.byte()
+		a.loads++
+		a.stores++
+	case 11: // memory.fill
+		r.byte()
+		a.stores++
+	case 12, 14:
+		r.uvarint()
+		r.uvarint()
+	}
+}
+
+// scanVectorInstruction scans the instructions with the 0xFD prefix (SIMD).
+func scanVectorInstruction(r *wasmReader, a *memoryAccesses) {
+	switch op := r.uvarint(); {
+	case op <= 10:
+		r.memarg()
+		a.loads++
+		a.bytes += [...]int64{16, 8, 8, 8, 8, 8, 8, 1, 2, 4, 8}[op]
+	case op == 11:
+		r.memarg()
+		a.stores++
+		a.bytes += 16
+	case op == 12, op == 13: // v128.const, i8x16.shuffle
+		r.skip(16)
+	case op >= 21 && op <= 34: // extract and replace lane
+		r.byte()
+	case op >= 84 && op <= 87: // load lane
+		r.memarg()
+		r.byte()
+		a.loads++
+		a.bytes += 1 << (op - 84)
+	case op >= 88 && op <= 91: // store lane
+		r.memarg()
+		r.byte()
+		a.stores++
+		a.bytes += 1 << (op - 88)
+	case op == 92, op == 93: // load32_zero, load64_zero
+		r.memarg()
+		a.loads++
+		a.bytes += 4 << (op - 92)
+	}
+}
+
+// scanAtomicInstruction scans the instructions with the 0xFE prefix (threads).
+func scanAtomicInstruction(r *wasmReader, a *memoryAccesses) {
+	op := r.uvarint()
+	if op == 0x03 { // atomic.fence
+		r.byte()
+		return
+	}
+	r.memarg()
+	switch {
+	case op <= 0x02: // notify, wait
+		a.loads++
+		a.bytes += [...]int64{4, 4, 8}[op]
+	case op >= 0x10 && op <= 0x16:
+		a.loads++
+		a.bytes += atomicSizes[(op-0x10)%7]
+	case op >= 0x17 && op <= 0x1D:
+		a.stores++
+		a.bytes += atomicSizes[(op-0x10)%7]
+	case op >= 0x1E:
+		// Read-modify-write operations.
+		a.loads++
+		a.stores++
+		a.bytes += 2 * atomicSizes[(op-0x10)%7]
+	}
+}
+
+// Sizes of the values of the atomic instructions, which come in groups of
+// seven: i32, i64, i32 8 bits, i32 16 bits, i64 8 bits, i64 16 bits, i64 32
+// bits.
+var atomicSizes = [...]int64{4, 8, 1, 2, 1, 2, 4}
+
+// wasmReader reads the instructions of a function body. Reads past the end of
+// the body are ignored, and stop the scan.
+type wasmReader struct {
+	b   []byte
+	eof bool
+}
+
+func (r *wasmReader) ok() bool {
+	return !r.eof
+}
+
+func (r *wasmReader) byte() byte {
+	if len(r.b) == 0 {
+		r.eof = true
+		return 0
+	}
+	b := r.b[0]
+	r.b = r.b[1:]
+	return b
+}
+
+func (r *wasmReader) skip(n int) {
+	if n > len(r.b) {
+		r.eof = true
+		n = len(r.b)
+	}
+	r.b = r.b[n:]
+}
+
+// uvarint reads an unsigned LEB128 integer. Signed integers have the same
+// encoding length, so it also skips them.
+func (r *wasmReader) uvarint() uint64 {
+	x, n := binary.Uvarint(r.b)
+	if n <= 0 {
+		r.eof = true
+		r.b = nil
+		return 0
+	}
+	r.b = r.b[n:]
+	return x
+}
+
+func (r *wasmReader) memarg() {
+	align := r.uvarint()
+	if align&0x40 != 0 { // multi-memory index
+		r.uvarint()
+	}
+	r.uvarint()
+}
+
+func (r *wasmReader) limits() {
+	if flags := r.byte(); flags&1 != 0 {
+		r.uvarint()
+	}
+	r.uvarint()
+}
+
+func (r *wasmReader) blockType() {
+	switch b := r.b; {
+	case len(b) == 0:
+		r.eof = true
+	case b[0] == 0x40 || (b[0] >= 0x6F && b[0] <= 0x7F):
+		r.byte()
+	default:
+		r.uvarint() // type index, as a signed integer
+	}
+}
@@ -0,0 +1,69 @@
+package wzprof
+
+import (
+	"context"
+	"testing"
+
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+	"github.com/tetratelabs/wazero/experimental/wazerotest"
+)
+
+// accessTestModule is a module importing one function, and defining a function
+// which loads an i32, stores an i64, and copies memory.
+var accessTestModule = []byte{
+	0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00,
+	// type section: func() -> ()
+	0x01, 0x04, 0x01, 0x60, 0x00, 0x00,
+	// import section: env.f
+	0x02, 0x09, 0x01, 0x03, 'e', 'n', 'v', 0x01, 'f', 0x00, 0x00,
+	// function section
+	0x03, 0x02, 0x01, 0x00,
+	// code section
+	0x0a, 0x1b, 0x01, 0x19, 0x00,
+	0x41, 0x00, 0x28, 0x02, 0x00, 0x1a, // i32.const 0, i32.load, drop
+	0x41, 0x00, 0x42, 0x00, 0x37, 0x03, 0x00, // i32.const 0, i64.const 0, i64.store
+	0x41, 0x00, 0x41, 0x00, 0x41, 0x00, 0xfc, 0x0a, 0x00, 0x00, // memory.copy
+	0x0b,
+}
+
+func TestWasmMemoryAccesses(t *testing.T) {
+	accesses := wasmMemoryAccesses(accessTestModule)
+	if len(accesses) != 1 {
+		t.Fatalf("wrong number of functions accessing memory: %v", accesses)
+	}
+	want := memoryAccesses{loads: 2, stores: 2, bytes: 12}
+	if a := accesses[1]; a != want {
+		t.Errorf("wrong accesses: want %+v, got %+v", want, a)
+	}
+}
+
+func TestAccessProfiler(t *testing.T) {
+	p := ProfilingFor(accessTestModule).AccessProfiler()
+
+	f0 := wazerotest.NewFunction(func(context.Context, api.Module) {})
+	f1 := wazerotest.NewFunction(func(context.Context, api.Module) {})
+	module := wazerotest.NewModule(nil, f0, f1)
+
+	if lstn := p.NewFunctionListener(module.Function(0).Definition()); lstn != nil {
+		t.Error("listener installed on a function which does not access memory")
+	}
+	def := module.Function(1).Definition()
+	lstn := p.NewFunctionListener(def)
+	for i := 0; i < 2; i++ {
+		lstn.Before(context.Background(), module, def, nil, experimental.NewStackIterator(experimental.StackFrame{Function: module.Function(1)}))
+		lstn.After(context.Background(), module, def, nil)
+	}
+
+	prof := p.NewProfile(1)
+	if len(prof.Sample) != 1 {
+		t.Fatalf("wrong number of samples: %d", len(prof.Sample))
+	}
+	want := []int64{2, 4, 4, 24}
+	for i, v := range prof.Sample[0].Value {
+		if v != want[i] {
+			t.Errorf("wrong sample values: want %v, got %v", want, prof.Sample[0].Value)
+			break
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package wzprof
+
+import (
+	"strings"
+
+	"github.com/tetratelabs/wazero/api"
+)
+
+// Prefix of the functions of the AssemblyScript runtime in the name section,
+// e.g. "~lib/rt/itcms/__new" or "~lib/rt/tlsf/__alloc".
+const assemblyScriptRuntimePrefix = "~lib/rt/"
+
+func supportedAssemblyScript(wasmbin []byte) bool {
+	for _, name := range wasmFunctionNames(wasmbin) {
+		if strings.HasPrefix(name, assemblyScriptRuntimePrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// assemblyScriptRuntimeFunction returns the name of the AssemblyScript runtime
+// function implemented by def, without the prefix of the runtime variant
+// (incremental, minimal, or stub). Modules built without a name section are
+// matched on the runtime exports (--exportRuntime).
+func assemblyScriptRuntimeFunction(def api.FunctionDefinition) string {
+	if name := def.Name(); strings.HasPrefix(name, assemblyScriptRuntimePrefix) {
+		return name[strings.LastIndexByte(name, '/')+1:]
+	}
+	for _, name := range def.ExportNames() {
+		if strings.HasPrefix(name, "__") {
+			return name
+		}
+	}
+	return ""
+}
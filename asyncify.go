@@ -0,0 +1,39 @@
+package wzprof
+
+import (
+	"errors"
+
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+)
+
+// errAsyncifyUnwind is the error passed to the Abort method of the profilers
+// for the calls returning while the stack is unwound by asyncify.
+//
+// The asyncify transform of binaryen, which TinyGo uses to switch goroutines
+// (-scheduler=asyncify, the default on WASI), suspends a goroutine by
+// returning from all the functions of its stack, then resumes it by calling
+// them again, skipping the code which already ran until the stack is rewound.
+// The returns of the unwind are not the ends of the calls, and their results
+// are dummy values: the profilers discard the calls without recording them.
+// The calls made by the rewind start again, and are recorded when they
+// return, so the time a goroutine spends suspended is not accounted to its
+// stack.
+var errAsyncifyUnwind = errors.New("call unwound by asyncify")
+
+// Value of the state global of asyncify while unwinding (0 when running
+// normally, 2 while rewinding).
+const asyncifyUnwinding = 1
+
+// asyncifyUnwinding returns true if the stack of the thread running mod is
+// being unwound by asyncify.
+func (p *Profiling) asyncifyUnwinding(mod api.Module) bool {
+	if !p.asyncify {
+		return false
+	}
+	imod, ok := mod.(experimental.InternalModule)
+	if !ok || int(p.asyncifyState) >= imod.NumGlobal() {
+		return false
+	}
+	return imod.Global(int(p.asyncifyState)).Get() == asyncifyUnwinding
+}
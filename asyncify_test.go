@@ -0,0 +1,118 @@
+package wzprof
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+	"github.com/tetratelabs/wazero/experimental/wazerotest"
+)
+
+func TestWasmAsyncifyState(t *testing.T) {
+	b, err := os.ReadFile("testdata/tinygo/hello_world.wasm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if global, ok := wasmAsyncifyState(b); !ok || global != 1 {
+		t.Errorf("wrong asyncify state global: %d, %t", global, ok)
+	}
+	if _, ok := wasmAsyncifyState(tailCallModule); ok {
+		t.Error("asyncify state global found in a module without asyncify")
+	}
+}
+
+func TestCPUProfilerAsyncify(t *testing.T) {
+	currentTime := int64(0)
+
+	p := ProfilingFor(nil)
+	p.asyncify, p.asyncifyState = true, 0
+	cpu := p.CPUProfiler(
+		TimeFunc(func() int64 { return currentTime }),
+	)
+
+	module := wazerotest.NewModule(nil,
+		wazerotest.NewFunction(func(context.Context, api.Module) {}),
+		wazerotest.NewFunction(func(context.Context, api.Module) {}),
+	)
+	state := wazerotest.GlobalI32(0)
+	module.Globals = []*wazerotest.Global{state}
+
+	f0 := cpu.NewFunctionListener(module.Function(0).Definition())
+	f1 := cpu.NewFunctionListener(module.Function(1).Definition())
+
+	stack0 := []experimental.StackFrame{
+		{Function: module.Function(0), PC: 1},
+	}
+
+	stack1 := []experimental.StackFrame{
+		{Function: module.Function(0), PC: 1},
+		{Function: module.Function(1), PC: 2},
+	}
+
+	def0 := stack0[0].Function.Definition()
+	def1 := stack1[1].Function.Definition()
+
+	ctx := context.Background()
+
+	const (
+		t0 int64 = 1
+		t1 int64 = 10
+		t2 int64 = 20
+		t3 int64 = 30
+		t4 int64 = 100
+		t5 int64 = 101
+		t6 int64 = 110
+		t7 int64 = 120
+	)
+
+	cpu.StartProfile()
+
+	currentTime = t0
+	f0.Before(ctx, module, def0, nil, experimental.NewStackIterator(stack0...))
+
+	currentTime = t1
+	f1.Before(ctx, module, def1, nil, experimental.NewStackIterator(stack1...))
+
+	// The goroutine is suspended: the stack is unwound, then rewound once the
+	// scheduler resumes it.
+	state.Value = asyncifyUnwinding
+
+	currentTime = t2
+	f1.After(ctx, module, def1, nil)
+
+	currentTime = t3
+	f0.After(ctx, module, def0, nil)
+
+	state.Value = 2
+
+	currentTime = t4
+	f0.Before(ctx, module, def0, nil, experimental.NewStackIterator(stack0...))
+
+	currentTime = t5
+	f1.Before(ctx, module, def1, nil, experimental.NewStackIterator(stack1...))
+
+	state.Value = 0
+
+	currentTime = t6
+	f1.After(ctx, module, def1, nil)
+
+	currentTime = t7
+	f0.After(ctx, module, def0, nil)
+
+	thread := cpu.threads.get(module)
+	if len(thread.frames) != 0 || thread.depth != 0 {
+		t.Errorf("unbalanced calls: %d frames, depth %d", len(thread.frames), thread.depth)
+	}
+
+	trace0 := makeStackTraceFromFrames(stack0)
+	trace1 := makeStackTraceFromFrames(stack1)
+
+	d1 := t6 - t5
+	d0 := t7 - t4 - d1
+
+	cpu.drain(cpu.counts)
+	assertStackCount(t, cpu.counts, trace0, 1, d0)
+	assertStackCount(t, cpu.counts, trace1, 1, d1)
+}
@@ -0,0 +1,221 @@
+package wzprof
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/google/pprof/profile"
+)
+
+// WriteCallgrindProfile writes a profile in the callgrind format, which is read
+// by KCachegrind, QCachegrind and the other tools of the Valgrind ecosystem.
+//
+// All the sample types of the profile are written as events. The self cost of
+// functions is attributed to their source lines, and the calls between them
+// carry the inclusive cost of the callees. Profiles do not record the number
+// of calls, the call counts are the number of samples where they appear.
+func WriteCallgrindProfile(w io.Writer, prof *profile.Profile) error {
+	type function struct {
+		name string
+		file string
+	}
+	type call struct {
+		caller function
+		line   int64
+		callee function
+	}
+	type callCost struct {
+		count  int64
+		target int64
+		values []int64
+	}
+
+	numValues := len(prof.SampleType)
+	self := make(map[function]map[int64][]int64)
+	calls := make(map[call]*callCost)
+	seen := make(map[call]bool)
+	frames := []callgrindFrame{}
+
+	addValues := func(dst, src []int64) {
+		for i, v := range src {
+			dst[i] += v
+		}
+	}
+
+	for _, sample := range prof.Sample {
+		frames = appendCallgrindFrames(frames[:0], sample)
+		if len(frames) == 0 {
+			continue
+		}
+
+		leaf := frames[0]
+		fn := function{leaf.name, leaf.file}
+		lines := self[fn]
+		if lines == nil {
+			lines = make(map[int64][]int64)
+			self[fn] = lines
+		}
+		if lines[leaf.line] == nil {
+			lines[leaf.line] = make([]int64, numValues)
+		}
+		addValues(lines[leaf.line], sample.Value)
+
+		// Recursive calls only count once per sample, the inclusive cost of
+		// a function must not exceed the total cost.
+		for k := range seen {
+			delete(seen, k)
+		}
+		for i := 1; i < len(frames); i++ {
+			caller, callee := frames[i], frames[i-1]
+			c := call{
+				caller: function{caller.name, caller.file},
+				line:   caller.line,
+				callee: function{callee.name, callee.file},
+			}
+			if seen[c] {
+				continue
+			}
+			seen[c] = true
+			cost := calls[c]
+			if cost == nil {
+				cost = &callCost{target: callee.startLine, values: make([]int64, numValues)}
+				calls[c] = cost
+				// Callers must appear in the output even if they have no
+				// self cost.
+				if self[c.caller] == nil {
+					self[c.caller] = make(map[int64][]int64)
+				}
+			}
+			cost.count++
+			addValues(cost.values, sample.Value)
+		}
+	}
+
+	functions := make([]function, 0, len(self))
+	for fn := range self {
+		functions = append(functions, fn)
+	}
+	sort.Slice(functions, func(i, j int) bool {
+		if functions[i].file != functions[j].file {
+			return functions[i].file < functions[j].file
+		}
+		return functions[i].name < functions[j].name
+	})
+
+	callsOf := make(map[function][]call)
+	for c := range calls {
+		callsOf[c.caller] = append(callsOf[c.caller], c)
+	}
+
+	b := bufio.NewWriter(w)
+	b.WriteString("# callgrind format\nversion: 1\ncreator: wzprof\npositions: line\nevents:")
+	for _, t := range prof.SampleType {
+		b.WriteString(" ")
+		b.WriteString(callgrindEventName(t.Type))
+	}
+	b.WriteString("\n")
+
+	// Names of files and functions are compressed: they are written once,
+	// then referenced by their id.
+	files := newCallgrindNames()
+	names := newCallgrindNames()
+	writeCosts := func(line int64, values []int64) {
+		fmt.Fprintf(b, "%d", line)
+		for _, v := range values {
+			fmt.Fprintf(b, " %d", v)
+		}
+		b.WriteString("\n")
+	}
+
+	for _, fn := range functions {
+		fmt.Fprintf(b, "\nfl=%s\nfn=%s\n", files.ref(fn.file), names.ref(fn.name))
+
+		lines := make([]int64, 0, len(self[fn]))
+		for line := range self[fn] {
+			lines = append(lines, line)
+		}
+		sort.Slice(lines, func(i, j int) bool { return lines[i] < lines[j] })
+		for _, line := range lines {
+			writeCosts(line, self[fn][line])
+		}
+
+		fnCalls := callsOf[fn]
+		sort.Slice(fnCalls, func(i, j int) bool {
+			ci, cj := fnCalls[i], fnCalls[j]
+			if ci.line != cj.line {
+				return ci.line < cj.line
+			}
+			if ci.callee.file != cj.callee.file {
+				return ci.callee.file < cj.callee.file
+			}
+			return ci.callee.name < cj.callee.name
+		})
+		for _, c := range fnCalls {
+			cost := calls[c]
+			fmt.Fprintf(b, "cfl=%s\ncfn=%s\ncalls=%d %d\n", files.ref(c.callee.file), names.ref(c.callee.name), cost.count, cost.target)
+			writeCosts(c.line, cost.values)
+		}
+	}
+	return b.Flush()
+}
+
+type callgrindFrame struct {
+	name      string
+	file      string
+	line      int64
+	startLine int64
+}
+
+// appendCallgrindFrames appends the frames of a sample to frames, from the
+// leaf to the root.
+func appendCallgrindFrames(frames []callgrindFrame, sample *profile.Sample) []callgrindFrame {
+	for _, loc := range sample.Location {
+		if len(loc.Line) == 0 {
+			frames = append(frames, callgrindFrame{name: fmt.Sprintf("%#x", loc.Address), file: "?"})
+			continue
+		}
+		for _, line := range loc.Line {
+			frame := callgrindFrame{name: "?", file: "?", line: line.Line}
+			if fn := line.Function; fn != nil {
+				frame.name = fn.Name
+				frame.startLine = fn.StartLine
+				if fn.Filename != "" {
+					frame.file = fn.Filename
+				}
+			}
+			frames = append(frames, frame)
+		}
+	}
+	return frames
+}
+
+// callgrindEventName returns the name of the event of a sample type, which can
+// only contain letters, digits and underscores.
+func callgrindEventName(sampleType string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '_' || ('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z') || ('0' <= r && r <= '9') {
+			return r
+		}
+		return '_'
+	}, sampleType)
+}
+
+// callgrindNames assigns ids to the names of files and functions of callgrind
+// profiles.
+type callgrindNames map[string]int
+
+func newCallgrindNames() callgrindNames { return make(callgrindNames) }
+
+// ref returns the reference to name: its id and name the first time it is
+// referenced, then only its id.
+func (n callgrindNames) ref(name string) string {
+	if id, ok := n[name]; ok {
+		return fmt.Sprintf("(%d)", id)
+	}
+	id := len(n) + 1
+	n[name] = id
+	return fmt.Sprintf("(%d) %s", id, strings.ReplaceAll(name, "\n", " "))
+}
@@ -0,0 +1,62 @@
+package wzprof
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/google/pprof/profile"
+)
+
+func TestWriteCallgrindProfile(t *testing.T) {
+	main := &profile.Function{ID: 1, Name: "main", Filename: "main.c", StartLine: 1}
+	work := &profile.Function{ID: 2, Name: "work", Filename: "work.c", StartLine: 10}
+
+	mainLoc := &profile.Location{ID: 1, Line: []profile.Line{{Function: main, Line: 3}}}
+	workLoc := &profile.Location{ID: 2, Line: []profile.Line{{Function: work, Line: 12}}}
+	recLoc := &profile.Location{ID: 3, Line: []profile.Line{{Function: work, Line: 14}}}
+
+	prof := &profile.Profile{
+		SampleType: []*profile.ValueType{
+			{Type: "samples", Unit: "count"},
+			{Type: "cpu", Unit: "nanoseconds"},
+		},
+		Sample: []*profile.Sample{
+			{Location: []*profile.Location{workLoc, mainLoc}, Value: []int64{1, 100}},
+			{Location: []*profile.Location{mainLoc}, Value: []int64{2, 20}},
+			{Location: []*profile.Location{workLoc, recLoc, recLoc, mainLoc}, Value: []int64{3, 300}},
+		},
+		Location: []*profile.Location{mainLoc, workLoc, recLoc},
+		Function: []*profile.Function{main, work},
+	}
+
+	var b bytes.Buffer
+	if err := WriteCallgrindProfile(&b, prof); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `# callgrind format
+version: 1
+creator: wzprof
+positions: line
+events: samples cpu
+
+fl=(1) main.c
+fn=(1) main
+3 2 20
+cfl=(2) work.c
+cfn=(2) work
+calls=2 10
+3 4 400
+
+fl=(2)
+fn=(2)
+12 4 400
+cfl=(2)
+cfn=(2)
+calls=1 10
+14 3 300
+`
+	if b.String() != want {
+		t.Errorf("want:\n%s\ngot:\n%s", want, b.String())
+	}
+}
@@ -0,0 +1,376 @@
+// Package cloudprofiler answers the collection requests of Google Cloud
+// Profiler with the profiles of wzprof profilers, so the profiles of
+// WebAssembly guests can be analyzed in the Cloud Console.
+//
+// The package talks to the REST API of Cloud Profiler and does not depend on
+// the Google Cloud client libraries: the http client of the configuration is
+// responsible for authenticating the requests, for example one created with
+// golang.org/x/oauth2/google.DefaultClient.
+package cloudprofiler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/pprof/profile"
+
+	"github.com/stealthrocket/wzprof"
+)
+
+// Config is the configuration of an Agent.
+type Config struct {
+	// Google Cloud project the profiles are reported to.
+	ProjectID string
+	// Name and version of the service, which Cloud Profiler uses to group the
+	// profiles.
+	Service        string
+	ServiceVersion string
+	// Zone where the service runs, if known.
+	Zone string
+	// Additional labels of the deployment.
+	Labels map[string]string
+	// Address of the API. Default to "https://cloudprofiler.googleapis.com".
+	APIAddr string
+	// Sample rate configured on the profilers, used to scale the profiles.
+	// Default to 1.
+	SampleRate float64
+	// Delay before retrying a failed request, when the server does not tell
+	// how long to wait. Default to 1 minute.
+	RetryDelay time.Duration
+	// Client used to send the requests. It must authenticate them with
+	// credentials allowed to write profiles in the project. Default to
+	// http.DefaultClient.
+	Client *http.Client
+}
+
+// Profile types of Cloud Profiler.
+const (
+	profileTypeCPU       = "CPU"
+	profileTypeHeap      = "HEAP"
+	profileTypeHeapAlloc = "HEAP_ALLOC"
+)
+
+// Agent registers with Cloud Profiler and collects the profiles it asks for.
+//
+// Cloud Profiler decides which profile to collect and for how long: the agent
+// long-polls the API for the next request, collects the profile, then uploads
+// it. The mapping of the profile types is:
+//   - CPU is the "samples" and "cpu" values of the CPU profiler, recorded for
+//     the requested duration.
+//   - HEAP is the "inuse_objects" and "inuse_space" values of the memory
+//     profiler, which is only offered when it records the memory in use.
+//   - HEAP_ALLOC is the "alloc_objects" and "alloc_space" values of the
+//     memory profiler, for the allocations made during the requested
+//     duration.
+//
+// The agent drives the CPU profiler when it collects a CPU profile. The
+// profiler should not be used by other components (such as the pprof http
+// handler) at the same time.
+type Agent struct {
+	config Config
+	cpu    *wzprof.CPUProfiler
+	mem    *wzprof.MemoryProfiler
+	types  []string
+}
+
+// New creates an Agent collecting the profiles of cpu and mem, either of which
+// may be nil.
+func New(config Config, cpu *wzprof.CPUProfiler, mem *wzprof.MemoryProfiler) *Agent {
+	if config.APIAddr == "" {
+		config.APIAddr = "https://cloudprofiler.googleapis.com"
+	}
+	if config.SampleRate <= 0 {
+		config.SampleRate = 1
+	}
+	if config.RetryDelay <= 0 {
+		config.RetryDelay = time.Minute
+	}
+	if config.Client == nil {
+		config.Client = http.DefaultClient
+	}
+	a := &Agent{
+		config: config,
+		cpu:    cpu,
+		mem:    mem,
+	}
+	if cpu != nil {
+		a.types = append(a.types, profileTypeCPU)
+	}
+	if mem != nil {
+		if hasSampleType(mem.SampleType(), "inuse_space") {
+			a.types = append(a.types, profileTypeHeap)
+		}
+		a.types = append(a.types, profileTypeHeapAlloc)
+	}
+	return a
+}
+
+// Run collects and uploads the profiles requested by Cloud Profiler until ctx
+// is canceled. Failed requests are retried after the delay requested by the
+// server, or the RetryDelay of the configuration.
+func (a *Agent) Run(ctx context.Context) error {
+	if len(a.types) == 0 {
+		return errors.New("cloudprofiler: no profilers to collect profiles from")
+	}
+	for {
+		err := a.profileOnce(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			delay := a.config.RetryDelay
+			var apiErr *apiError
+			if errors.As(err, &apiErr) && apiErr.retryDelay > 0 {
+				delay = apiErr.retryDelay
+			}
+			timer := time.NewTimer(delay)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return nil
+			}
+		}
+	}
+}
+
+type deployment struct {
+	ProjectID string            `json:"projectId"`
+	Target    string            `json:"target"`
+	Labels    map[string]string `json:"labels,omitempty"`
+}
+
+type createProfileRequest struct {
+	Deployment  deployment `json:"deployment"`
+	ProfileType []string   `json:"profileType"`
+}
+
+type cloudProfile struct {
+	Name         string            `json:"name"`
+	ProfileType  string            `json:"profileType"`
+	Deployment   *deployment       `json:"deployment,omitempty"`
+	Duration     string            `json:"duration,omitempty"`
+	ProfileBytes []byte            `json:"profileBytes,omitempty"`
+	Labels       map[string]string `json:"labels,omitempty"`
+}
+
+// profileOnce waits for the next collection request, then collects and
+// uploads the profile.
+func (a *Agent) profileOnce(ctx context.Context) error {
+	labels := make(map[string]string, len(a.config.Labels)+2)
+	for k, v := range a.config.Labels {
+		labels[k] = v
+	}
+	if a.config.ServiceVersion != "" {
+		labels["version"] = a.config.ServiceVersion
+	}
+	if a.config.Zone != "" {
+		labels["zone"] = a.config.Zone
+	}
+
+	var p cloudProfile
+	err := a.call(ctx, http.MethodPost, "/v2/projects/"+a.config.ProjectID+"/profiles", createProfileRequest{
+		Deployment: deployment{
+			ProjectID: a.config.ProjectID,
+			Target:    a.config.Service,
+			Labels:    labels,
+		},
+		ProfileType: a.types,
+	}, &p)
+	if err != nil {
+		return err
+	}
+
+	var duration time.Duration
+	if p.Duration != "" {
+		duration, err = time.ParseDuration(p.Duration)
+		if err != nil {
+			return fmt.Errorf("cloudprofiler: invalid profile duration: %w", err)
+		}
+	}
+
+	prof, err := a.collect(ctx, p.ProfileType, duration)
+	if err != nil {
+		return err
+	}
+	var b bytes.Buffer
+	if err := prof.Write(&b); err != nil {
+		return err
+	}
+	p.ProfileBytes = b.Bytes()
+	return a.call(ctx, http.MethodPatch, "/v2/"+p.Name, p, nil)
+}
+
+// collect builds the profile of the given type over duration.
+func (a *Agent) collect(ctx context.Context, profileType string, duration time.Duration) (*profile.Profile, error) {
+	switch profileType {
+	case profileTypeCPU:
+		if a.cpu == nil {
+			break
+		}
+		if !a.cpu.StartProfile() {
+			return nil, errors.New("cloudprofiler: cpu profile already in progress")
+		}
+		if err := sleep(ctx, duration); err != nil {
+			a.cpu.StopProfile(a.config.SampleRate)
+			return nil, err
+		}
+		return selectSampleTypes(a.cpu.StopProfile(a.config.SampleRate), "samples", "cpu")
+
+	case profileTypeHeap:
+		if a.mem == nil {
+			break
+		}
+		return selectSampleTypes(a.mem.NewProfile(a.config.SampleRate), "inuse_objects", "inuse_space")
+
+	case profileTypeHeapAlloc:
+		if a.mem == nil {
+			break
+		}
+		prev := a.mem.NewProfile(a.config.SampleRate)
+		if err := sleep(ctx, duration); err != nil {
+			return nil, err
+		}
+		delta, err := wzprof.DeltaProfile(prev, a.mem.NewProfile(a.config.SampleRate))
+		if err != nil {
+			return nil, err
+		}
+		return selectSampleTypes(delta, "alloc_objects", "alloc_space")
+	}
+	return nil, fmt.Errorf("cloudprofiler: unsupported profile type: %q", profileType)
+}
+
+func sleep(ctx context.Context, duration time.Duration) error {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func hasSampleType(sampleTypes []*profile.ValueType, typ string) bool {
+	for _, t := range sampleTypes {
+		if t.Type == typ {
+			return true
+		}
+	}
+	return false
+}
+
+// selectSampleTypes returns a copy of prof retaining only the values of the
+// given sample types, in that order.
+func selectSampleTypes(prof *profile.Profile, types ...string) (*profile.Profile, error) {
+	indexes := make([]int, len(types))
+	for i, typ := range types {
+		indexes[i] = -1
+		for j, t := range prof.SampleType {
+			if t.Type == typ {
+				indexes[i] = j
+			}
+		}
+		if indexes[i] < 0 {
+			return nil, fmt.Errorf("cloudprofiler: profile has no %q sample type", typ)
+		}
+	}
+
+	prof = prof.Copy()
+	sampleType := make([]*profile.ValueType, len(indexes))
+	for i, j := range indexes {
+		sampleType[i] = prof.SampleType[j]
+	}
+	prof.SampleType = sampleType
+	prof.DefaultSampleType = ""
+
+	samples := prof.Sample[:0]
+	for _, s := range prof.Sample {
+		values := make([]int64, len(indexes))
+		nonZero := false
+		for i, j := range indexes {
+			values[i] = s.Value[j]
+			nonZero = nonZero || values[i] != 0
+		}
+		if nonZero {
+			s.Value = values
+			samples = append(samples, s)
+		}
+	}
+	prof.Sample = samples
+	return prof.Compact(), nil
+}
+
+// apiError is an error returned by the API, with the delay to wait before
+// retrying when the server specified one (e.g. when there is no profile to
+// collect yet).
+type apiError struct {
+	status     string
+	message    string
+	retryDelay time.Duration
+}
+
+func (e *apiError) Error() string {
+	return "cloudprofiler: " + e.status + ": " + e.message
+}
+
+func (a *Agent) call(ctx context.Context, method, path string, in, out any) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	url := strings.TrimSuffix(a.config.APIAddr, "/") + path
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := a.config.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("cloudprofiler: %w", err)
+	}
+	defer res.Body.Close()
+
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		return fmt.Errorf("cloudprofiler: %w", err)
+	}
+	if res.StatusCode/100 != 2 {
+		return newAPIError(res.Status, b)
+	}
+	if out != nil {
+		return json.Unmarshal(b, out)
+	}
+	return nil
+}
+
+func newAPIError(status string, body []byte) *apiError {
+	e := &apiError{status: status, message: string(bytes.TrimSpace(body))}
+	var r struct {
+		Error struct {
+			Message string `json:"message"`
+			Details []struct {
+				RetryDelay string `json:"retryDelay"`
+			} `json:"details"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(body, &r) == nil {
+		if r.Error.Message != "" {
+			e.message = r.Error.Message
+		}
+		for _, d := range r.Error.Details {
+			if d.RetryDelay != "" {
+				e.retryDelay, _ = time.ParseDuration(d.RetryDelay)
+			}
+		}
+	}
+	return e
+}
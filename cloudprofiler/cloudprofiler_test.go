@@ -0,0 +1,150 @@
+package cloudprofiler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/pprof/profile"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+	"github.com/tetratelabs/wazero/experimental/wazerotest"
+
+	"github.com/stealthrocket/wzprof"
+)
+
+func TestAgent(t *testing.T) {
+	var requested []string
+	uploads := map[string]*profile.Profile{}
+	next := []string{profileTypeCPU, profileTypeHeap, profileTypeHeapAlloc}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost:
+			if r.URL.Path != "/v2/projects/proj/profiles" {
+				t.Errorf("wrong path: %s", r.URL.Path)
+			}
+			var req createProfileRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				t.Error(err)
+				return
+			}
+			if req.Deployment.Target != "svc" || req.Deployment.Labels["version"] != "v1" {
+				t.Errorf("wrong deployment: %+v", req.Deployment)
+			}
+			requested = req.ProfileType
+
+			typ := next[0]
+			next = next[1:]
+			json.NewEncoder(w).Encode(cloudProfile{
+				Name:        "projects/proj/profiles/" + typ,
+				ProfileType: typ,
+				Duration:    "0.001s",
+			})
+
+		case http.MethodPatch:
+			var p cloudProfile
+			if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+				t.Error(err)
+				return
+			}
+			if r.URL.Path != "/v2/"+p.Name {
+				t.Errorf("wrong path: %s", r.URL.Path)
+			}
+			prof, err := profile.Parse(bytes.NewReader(p.ProfileBytes))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			uploads[p.ProfileType] = prof
+			json.NewEncoder(w).Encode(p)
+		}
+	}))
+	defer server.Close()
+
+	p := wzprof.ProfilingFor(nil)
+	mem := p.MemoryProfiler(wzprof.InuseMemory(true))
+
+	malloc := wazerotest.NewFunction(func(ctx context.Context, mod api.Module, size uint32) uint32 {
+		return 0
+	})
+	malloc.FunctionName = "malloc"
+	module := wazerotest.NewModule(nil, malloc)
+	def := module.Function(0).Definition()
+	lstn := mem.NewFunctionListener(def)
+	stack := []experimental.StackFrame{{Function: module.Function(0)}}
+	ctx := context.Background()
+	lstn.Before(ctx, module, def, []uint64{10}, experimental.NewStackIterator(stack...))
+	lstn.After(ctx, module, def, []uint64{0x1000})
+
+	agent := New(Config{
+		ProjectID:      "proj",
+		Service:        "svc",
+		ServiceVersion: "v1",
+		APIAddr:        server.URL,
+	}, p.CPUProfiler(), mem)
+
+	for range next {
+		if err := agent.profileOnce(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := []string{profileTypeCPU, profileTypeHeap, profileTypeHeapAlloc}
+	if len(requested) != len(want) {
+		t.Fatalf("wrong profile types: %v", requested)
+	}
+	for i := range want {
+		if requested[i] != want[i] {
+			t.Fatalf("wrong profile types: %v", requested)
+		}
+	}
+
+	sampleTypes := map[string][]string{
+		profileTypeCPU:       {"samples", "cpu"},
+		profileTypeHeap:      {"inuse_objects", "inuse_space"},
+		profileTypeHeapAlloc: {"alloc_objects", "alloc_space"},
+	}
+	for typ, names := range sampleTypes {
+		prof := uploads[typ]
+		if prof == nil {
+			t.Fatalf("missing %s profile", typ)
+		}
+		if len(prof.SampleType) != len(names) {
+			t.Fatalf("wrong sample types of %s profile: %v", typ, prof.SampleType)
+		}
+		for i, name := range names {
+			if prof.SampleType[i].Type != name {
+				t.Errorf("wrong sample type %d of %s profile: want %q, got %q", i, typ, name, prof.SampleType[i].Type)
+			}
+		}
+	}
+
+	// The allocation was made before the HEAP_ALLOC profile was collected.
+	if n := len(uploads[profileTypeHeapAlloc].Sample); n != 0 {
+		t.Errorf("wrong number of samples in HEAP_ALLOC profile: %d", n)
+	}
+	if s := uploads[profileTypeHeap].Sample; len(s) != 1 || s[0].Value[1] != 10 {
+		t.Errorf("wrong samples in HEAP profile: %v", s)
+	}
+}
+
+func TestAPIErrorRetryDelay(t *testing.T) {
+	err := newAPIError("409 Conflict", []byte(`{
+		"error": {
+			"code": 409,
+			"message": "no profile to collect",
+			"details": [{"@type": "type.googleapis.com/google.rpc.RetryInfo", "retryDelay": "42s"}]
+		}
+	}`))
+	if err.retryDelay != 42*time.Second {
+		t.Errorf("wrong retry delay: %s", err.retryDelay)
+	}
+	if err.Error() != "cloudprofiler: 409 Conflict: no profile to collect" {
+		t.Errorf("wrong error message: %s", err)
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	mathrand "math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/google/pprof/profile"
+)
+
+// Number of functions listed in the comparison reports of the ab and diff
+// commands.
+const reportFunctions = 20
+
+// runAB implements "wzprof ab old.wasm new.wasm -- args...", which runs two
+// versions of a module with identical inputs and compares their profiles.
+//
+// The modules receive the same arguments, standard input, and random source.
+// They run one after the other so they do not compete for the CPU. The
+// profiles are written to the -cpuprofile and -memprofile paths, with the
+// "old" and "new" suffixes, e.g. cpu.old.pprof and cpu.new.pprof.
+func runAB(ctx context.Context, base *program, args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("usage: wzprof ab <old.wasm> <new.wasm> [-- args...]")
+	}
+	if base.pprofAddr != "" || base.hostProfile {
+		return fmt.Errorf("ab: -pprof-addr and -host are not supported")
+	}
+	oldPath, newPath, guestArgs := args[0], args[1], args[2:]
+	if len(guestArgs) > 0 && guestArgs[0] == "--" {
+		guestArgs = guestArgs[1:]
+	}
+
+	input, err := readInput(os.Stdin)
+	if err != nil {
+		return fmt.Errorf("ab: reading standard input: %w", err)
+	}
+	var seed [8]byte
+	if _, err := rand.Read(seed[:]); err != nil {
+		return err
+	}
+
+	progs := make([]*program, 2)
+	for i, v := range []struct{ path, suffix string }{
+		{oldPath, "old"},
+		{newPath, "new"},
+	} {
+		prog := *base
+		prog.filePath = v.path
+		prog.args = guestArgs
+		prog.stdin = bytes.NewReader(input)
+		prog.randSource = mathrand.New(mathrand.NewSource(int64(binary.LittleEndian.Uint64(seed[:]))))
+		prog.keepProfiles = true
+		prog.cpuProfile = variantPath(prog.cpuProfile, v.suffix)
+		prog.memProfile = variantPath(prog.memProfile, v.suffix)
+		prog.traceFile = variantPath(prog.traceFile, v.suffix)
+		prog.funcTrace = variantPath(prog.funcTrace, v.suffix)
+		prog.accessProf = variantPath(prog.accessProf, v.suffix)
+
+		stdout.Printf("running %s module %s", v.suffix, v.path)
+		if err := prog.run(ctx); err != nil {
+			return fmt.Errorf("ab: running %s: %w", v.path, err)
+		}
+		progs[i] = &prog
+	}
+
+	oldProg, newProg := progs[0], progs[1]
+	if err := errors.Join(
+		writeComparison(os.Stdout, "cpu", oldProg.cpuProf, newProg.cpuProf),
+		writeComparison(os.Stdout, "memory", oldProg.memProf, newProg.memProf),
+	); err != nil {
+		return fmt.Errorf("ab: %w", err)
+	}
+	return nil
+}
+
+// readInput reads the content of the standard input, unless it is a terminal
+// since there is then no input to replay.
+func readInput(f *os.File) ([]byte, error) {
+	info, err := f.Stat()
+	if err != nil || info.Mode()&os.ModeCharDevice != 0 {
+		return nil, nil
+	}
+	return io.ReadAll(f)
+}
+
+// variantPath inserts the suffix before the extension of path, or returns an
+// empty string if path is empty.
+func variantPath(path, suffix string) string {
+	if path == "" {
+		return ""
+	}
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + "." + suffix + ext
+}
+
+type functionDelta struct {
+	name     string
+	old, new int64
+}
+
+// writeComparison writes a report comparing the total and the flat values per
+// function of the default sample type of two profiles, listing the functions
+// which changed the most first.
+func writeComparison(w io.Writer, name string, oldProf, newProf *profile.Profile) error {
+	return compareProfiles(w, name, "function", oldProf, newProf, leafFunctionName)
+}
+
+// compareProfiles writes a report comparing the values of the default sample
+// type of two profiles, aggregated by the key of their samples.
+func compareProfiles(w io.Writer, name, column string, oldProf, newProf *profile.Profile, key func(*profile.Sample) string) error {
+	if oldProf == nil || newProf == nil {
+		return nil
+	}
+	oldIndex, sampleType := defaultSampleType(oldProf)
+	newIndex := -1
+	for i, t := range newProf.SampleType {
+		if t.Type == sampleType.Type {
+			newIndex = i
+		}
+	}
+	if oldIndex < 0 || newIndex < 0 {
+		return fmt.Errorf("%s profiles have no common sample type", name)
+	}
+
+	deltas := make(map[string]*functionDelta)
+	total := functionDelta{name: "total"}
+	for _, side := range []struct {
+		prof  *profile.Profile
+		index int
+		isNew bool
+	}{
+		{oldProf, oldIndex, false},
+		{newProf, newIndex, true},
+	} {
+		for _, s := range side.prof.Sample {
+			fn := key(s)
+			d := deltas[fn]
+			if d == nil {
+				d = &functionDelta{name: fn}
+				deltas[fn] = d
+			}
+			v := s.Value[side.index]
+			if side.isNew {
+				d.new += v
+				total.new += v
+			} else {
+				d.old += v
+				total.old += v
+			}
+		}
+	}
+
+	functions := make([]*functionDelta, 0, len(deltas))
+	for _, d := range deltas {
+		if d.old != d.new {
+			functions = append(functions, d)
+		}
+	}
+	sort.Slice(functions, func(i, j int) bool {
+		di, dj := abs(functions[i].new-functions[i].old), abs(functions[j].new-functions[j].old)
+		if di != dj {
+			return di > dj
+		}
+		return functions[i].name < functions[j].name
+	})
+	if len(functions) > reportFunctions {
+		functions = functions[:reportFunctions]
+	}
+
+	fmt.Fprintf(w, "%s (%s/%s)\n", name, sampleType.Type, sampleType.Unit)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "old\tnew\tdelta\t\t%s\n", column)
+	for _, d := range append([]*functionDelta{&total}, functions...) {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t\t%s\n",
+			formatValue(d.old, sampleType.Unit),
+			formatValue(d.new, sampleType.Unit),
+			formatDelta(d.old, d.new),
+			d.name,
+		)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintln(w)
+	return err
+}
+
+// defaultSampleType returns the sample type that pprof displays by default.
+func defaultSampleType(prof *profile.Profile) (int, *profile.ValueType) {
+	if len(prof.SampleType) == 0 {
+		return -1, nil
+	}
+	for i, t := range prof.SampleType {
+		if t.Type == prof.DefaultSampleType {
+			return i, t
+		}
+	}
+	i := len(prof.SampleType) - 1
+	return i, prof.SampleType[i]
+}
+
+// leafFunctionName returns the name of the function where the sample was
+// recorded, which is the innermost inlined function of its first location.
+func leafFunctionName(s *profile.Sample) string {
+	if len(s.Location) == 0 || len(s.Location[0].Line) == 0 || s.Location[0].Line[0].Function == nil {
+		return "?"
+	}
+	return s.Location[0].Line[0].Function.Name
+}
+
+func formatValue(v int64, unit string) string {
+	switch unit {
+	case "nanoseconds":
+		return time.Duration(v).String()
+	case "bytes":
+		switch {
+		case abs(v) >= 1<<30:
+			return fmt.Sprintf("%.2fGiB", float64(v)/(1<<30))
+		case abs(v) >= 1<<20:
+			return fmt.Sprintf("%.2fMiB", float64(v)/(1<<20))
+		case abs(v) >= 1<<10:
+			return fmt.Sprintf("%.2fKiB", float64(v)/(1<<10))
+		}
+		return fmt.Sprintf("%dB", v)
+	}
+	return fmt.Sprint(v)
+}
+
+func formatDelta(old, new int64) string {
+	if old == 0 {
+		if new == 0 {
+			return "0%"
+		}
+		return "new"
+	}
+	return fmt.Sprintf("%+.1f%%", 100*float64(new-old)/float64(old))
+}
+
+func abs(v int64) int64 {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
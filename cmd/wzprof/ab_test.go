@@ -0,0 +1,72 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/pprof/profile"
+)
+
+func TestVariantPath(t *testing.T) {
+	tests := []struct{ path, want string }{
+		{"", ""},
+		{"cpu.pprof", "cpu.old.pprof"},
+		{"/tmp/profile", "/tmp/profile.old"},
+	}
+	for _, test := range tests {
+		if got := variantPath(test.path, "old"); got != test.want {
+			t.Errorf("%q: want %q, got %q", test.path, test.want, got)
+		}
+	}
+}
+
+func TestWriteComparison(t *testing.T) {
+	newProfile := func(values map[string]int64) *profile.Profile {
+		prof := &profile.Profile{
+			SampleType: []*profile.ValueType{
+				{Type: "samples", Unit: "count"},
+				{Type: "cpu", Unit: "nanoseconds"},
+			},
+		}
+		for name, v := range values {
+			fn := &profile.Function{ID: uint64(len(prof.Function) + 1), Name: name}
+			loc := &profile.Location{ID: fn.ID, Line: []profile.Line{{Function: fn}}}
+			prof.Function = append(prof.Function, fn)
+			prof.Location = append(prof.Location, loc)
+			prof.Sample = append(prof.Sample, &profile.Sample{
+				Location: []*profile.Location{loc},
+				Value:    []int64{1, v},
+			})
+		}
+		return prof
+	}
+
+	oldProf := newProfile(map[string]int64{"a": 1000, "b": 500, "c": 100})
+	newProf := newProfile(map[string]int64{"a": 250, "b": 500, "d": 200})
+
+	var b strings.Builder
+	if err := writeComparison(&b, "cpu", oldProf, newProf); err != nil {
+		t.Fatal(err)
+	}
+
+	var lines [][]string
+	for _, line := range strings.Split(strings.TrimSpace(b.String()), "\n") {
+		lines = append(lines, strings.Fields(line))
+	}
+	want := [][]string{
+		{"cpu", "(cpu/nanoseconds)"},
+		{"old", "new", "delta", "function"},
+		{"1.6µs", "950ns", "-40.6%", "total"},
+		{"1µs", "250ns", "-75.0%", "a"},
+		{"0s", "200ns", "new", "d"},
+		{"100ns", "0s", "-100.0%", "c"},
+	}
+	if len(lines) != len(want) {
+		t.Fatalf("wrong number of lines in report:\n%s", b.String())
+	}
+	for i := range want {
+		if strings.Join(lines[i], " ") != strings.Join(want[i], " ") {
+			t.Errorf("wrong line %d of report: want %q, got %q", i, want[i], lines[i])
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// configure sets the flags of fs that were not set on the command line from
+// the environment variables named after them (e.g. WZPROF_PPROF_ADDR for
+// -pprof-addr), then from the configuration file at path, if not empty.
+//
+// The configuration file uses the TOML syntax, restricted to top-level keys
+// named after the flags, with string, number, boolean, and array values:
+//
+//	sample = 1
+//	memprofile = "/tmp/memory.pprof"
+//	mount = ["/tmp:/tmp:ro", "/data:/data"]
+//	env = ["LOG_LEVEL=debug"]
+//
+// The values of arrays are passed to repeated flags (like -env) one by one,
+// and joined with commas for the others (like -mount).
+func configure(fs *flag.FlagSet, path string) error {
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+
+	config := make(map[string][]string)
+	if path != "" {
+		var err error
+		if config, err = readConfig(path); err != nil {
+			return err
+		}
+		for name := range config {
+			if fs.Lookup(name) == nil {
+				return fmt.Errorf("%s: unknown option %q", path, name)
+			}
+		}
+	}
+	fs.VisitAll(func(f *flag.Flag) {
+		if v, ok := os.LookupEnv(configEnv(f.Name)); ok {
+			config[f.Name] = []string{v}
+		}
+	})
+
+	for name, values := range config {
+		if explicit[name] {
+			continue
+		}
+		f := fs.Lookup(name)
+		if _, repeated := f.Value.(*stringList); !repeated {
+			values = []string{strings.Join(values, ",")}
+		}
+		for _, v := range values {
+			if err := f.Value.Set(v); err != nil {
+				return fmt.Errorf("invalid value %q for option %s: %w", v, name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// configEnv returns the name of the environment variable setting a flag.
+func configEnv(name string) string {
+	return "WZPROF_" + strings.ToUpper(strings.NewReplacer("-", "_", ".", "_").Replace(name))
+}
+
+func readConfig(path string) (map[string][]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	config := make(map[string][]string)
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" || strings.HasPrefix(key, "[") {
+			return nil, fmt.Errorf("%s:%d: expected key = value", path, n)
+		}
+		if _, dup := config[key]; dup {
+			return nil, fmt.Errorf("%s:%d: duplicate option %q", path, n, key)
+		}
+		values, err := parseConfigValue(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, n, err)
+		}
+		config[key] = values
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// parseConfigValue parses a value of the configuration file, and returns the
+// values of arrays or the single value of other types.
+func parseConfigValue(s string) ([]string, error) {
+	if !strings.HasPrefix(s, "[") {
+		v, rest, err := parseConfigScalar(s)
+		if err != nil {
+			return nil, err
+		}
+		if rest != "" && rest[0] != '#' {
+			return nil, fmt.Errorf("unexpected %q after value", rest)
+		}
+		return []string{v}, nil
+	}
+
+	values := []string{}
+	s = strings.TrimSpace(s[1:])
+	for {
+		if strings.HasPrefix(s, "]") {
+			break
+		}
+		v, rest, err := parseConfigScalar(s)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+		if strings.HasPrefix(rest, ",") {
+			rest = strings.TrimSpace(rest[1:])
+		} else if !strings.HasPrefix(rest, "]") {
+			return nil, fmt.Errorf("expected , or ] in array")
+		}
+		s = rest
+	}
+	if rest := strings.TrimSpace(s[1:]); rest != "" && rest[0] != '#' {
+		return nil, fmt.Errorf("unexpected %q after array", rest)
+	}
+	return values, nil
+}
+
+// parseConfigScalar parses a string, number, or boolean at the beginning of
+// s, and returns it with the rest of s.
+func parseConfigScalar(s string) (value, rest string, err error) {
+	switch {
+	case strings.HasPrefix(s, `"`):
+		end := 1
+		for end < len(s) && s[end] != '"' {
+			if s[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		if end >= len(s) {
+			return "", "", fmt.Errorf("unterminated string")
+		}
+		value, err = strconv.Unquote(s[:end+1])
+		if err != nil {
+			return "", "", fmt.Errorf("invalid string %s", s[:end+1])
+		}
+		return value, strings.TrimSpace(s[end+1:]), nil
+	case strings.HasPrefix(s, "'"):
+		end := strings.IndexByte(s[1:], '\'')
+		if end < 0 {
+			return "", "", fmt.Errorf("unterminated string")
+		}
+		return s[1 : end+1], strings.TrimSpace(s[end+2:]), nil
+	}
+	end := strings.IndexAny(s, " \t,]#")
+	if end < 0 {
+		end = len(s)
+	}
+	value, rest = s[:end], strings.TrimSpace(s[end:])
+	if value == "" {
+		return "", "", fmt.Errorf("missing value")
+	}
+	return strings.ReplaceAll(value, "_", ""), rest, nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestConfigure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wzprof.toml")
+	err := os.WriteFile(path, []byte(`
+# options of the profilers
+sample = 0.5
+memprofile = "/tmp/memory.pprof" # comment
+cpuprofile = '/tmp/cpu.pprof'
+inuse = true
+mount = ["/tmp:/tmp:ro", "/data:/data"]
+env = ["A=1", "B=\"2\""]
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fs := flag.NewFlagSet("wzprof", flag.ContinueOnError)
+	sample := fs.Float64("sample", 1, "")
+	memprofile := fs.String("memprofile", "", "")
+	cpuprofile := fs.String("cpuprofile", "", "")
+	inuse := fs.Bool("inuse", false, "")
+	mounts := fs.String("mount", "", "")
+	var env stringList
+	fs.Var(&env, "env", "")
+	if err := fs.Parse([]string{"-cpuprofile", "cpu.pprof"}); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("WZPROF_MEMPROFILE", "mem.pprof")
+	if err := configure(fs, path); err != nil {
+		t.Fatal(err)
+	}
+
+	if *sample != 0.5 {
+		t.Errorf("wrong sample rate: %v", *sample)
+	}
+	if *memprofile != "mem.pprof" {
+		t.Errorf("environment variable did not override the file: %q", *memprofile)
+	}
+	if *cpuprofile != "cpu.pprof" {
+		t.Errorf("file overrode the command line: %q", *cpuprofile)
+	}
+	if !*inuse {
+		t.Error("boolean option not set")
+	}
+	if *mounts != "/tmp:/tmp:ro,/data:/data" {
+		t.Errorf("wrong mounts: %q", *mounts)
+	}
+	if want := (stringList{"A=1", `B="2"`}); !reflect.DeepEqual(env, want) {
+		t.Errorf("wrong environment: want %q, got %q", want, env)
+	}
+}
+
+func TestReadConfigErrors(t *testing.T) {
+	for _, content := range []string{
+		"[section]",
+		"sample",
+		`memprofile = "unterminated`,
+		`mount = ["a" "b"]`,
+		"sample = 1\nsample = 2",
+	} {
+		path := filepath.Join(t.TempDir(), "wzprof.toml")
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readConfig(path); err == nil {
+			t.Errorf("%q: no error", content)
+		}
+	}
+
+	fs := flag.NewFlagSet("wzprof", flag.ContinueOnError)
+	path := filepath.Join(t.TempDir(), "wzprof.toml")
+	os.WriteFile(path, []byte("unknown = 1"), 0644)
+	if err := configure(fs, path); err == nil {
+		t.Error("no error for unknown option")
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/stealthrocket/wzprof"
+	"github.com/stealthrocket/wzprof/daemon"
+)
+
+// runDaemon implements "wzprof daemon", which serves the API of a profiling
+// daemon that wazero hosts stream the samples of their guests to, see the
+// daemon package.
+func runDaemon(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("daemon", flag.ContinueOnError)
+	addr := flags.String("addr", "localhost:4000", "Address where to serve the daemon API, path of a Unix domain socket (e.g. unix:///run/wzprof.sock), or inherited listener (fd://3, systemd://).")
+	dir := flags.String("dir", "", "Directory where to store the profiles (not stored if empty).")
+	keep := flags.Int("keep", 0, "Number of profiles of each type retained per module (all if zero).")
+	rotation := flags.Duration("rotation", 60*time.Second, "Period at which the profiles are stored.")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	s := daemon.New(ctx, daemon.Config{
+		Dir:            *dir,
+		Keep:           *keep,
+		RotationPeriod: *rotation,
+	})
+	defer s.Close(context.Background())
+
+	l, err := wzprof.Listen(*addr)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{Handler: s}
+	go func() {
+		<-ctx.Done()
+		server.Shutdown(context.Background())
+	}()
+
+	errc := make(chan error, 1)
+	go func() { errc <- s.Run(ctx) }()
+
+	if strings.Contains(*addr, "://") {
+		stdout.Printf("serving daemon API at %s (path /v1/modules)", *addr)
+	} else {
+		stdout.Printf("serving daemon API at http://%s/v1/modules", *addr)
+	}
+	err = server.Serve(l)
+	if errors.Is(err, http.ErrServerClosed) {
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+	// Run stores the profiles of the samples received since the last
+	// rotation when the context is canceled.
+	return <-errc
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/google/pprof/profile"
+
+	"github.com/stealthrocket/wzprof"
+)
+
+// runDiff implements "wzprof diff old.pprof new.pprof", which prints a report
+// comparing two profiles, e.g. of two builds of a module, per function and per
+// call path, so regressions can be quantified without the Go toolchain.
+//
+// The -o flag also writes a profile of the differences, which pprof displays
+// like with its -diff_base flag.
+func runDiff(args []string) error {
+	flags := flag.NewFlagSet("diff", flag.ContinueOnError)
+	output := flags.String("o", "", "Write a profile of the differences to the specified file.")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 2 {
+		return fmt.Errorf("usage: wzprof diff [-o diff.pprof] <old.pprof> <new.pprof>")
+	}
+
+	oldProf, err := readProfile(flags.Arg(0))
+	if err != nil {
+		return fmt.Errorf("diff: %w", err)
+	}
+	newProf, err := readProfile(flags.Arg(1))
+	if err != nil {
+		return fmt.Errorf("diff: %w", err)
+	}
+
+	if err := writeComparison(os.Stdout, "functions", oldProf, newProf); err != nil {
+		return fmt.Errorf("diff: %w", err)
+	}
+	if err := compareProfiles(os.Stdout, "paths", "path", oldProf, newProf, samplePath); err != nil {
+		return fmt.Errorf("diff: %w", err)
+	}
+
+	if *output != "" {
+		prof, err := diffProfile(oldProf, newProf)
+		if err != nil {
+			return fmt.Errorf("diff: %w", err)
+		}
+		stdout.Printf("writing profile of the differences to %s", *output)
+		if err := wzprof.WriteProfile(*output, prof); err != nil {
+			return fmt.Errorf("diff: %w", err)
+		}
+	}
+	return nil
+}
+
+func readProfile(path string) (*profile.Profile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	prof, err := profile.Parse(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return prof, nil
+}
+
+// samplePath returns the names of the functions of the call path of the
+// sample, from the root to the leaf, separated by semicolons.
+func samplePath(s *profile.Sample) string {
+	var names []string
+	for i := len(s.Location) - 1; i >= 0; i-- {
+		lines := s.Location[i].Line
+		for j := len(lines) - 1; j >= 0; j-- {
+			if fn := lines[j].Function; fn != nil {
+				names = append(names, fn.Name)
+			} else {
+				names = append(names, "?")
+			}
+		}
+	}
+	return strings.Join(names, ";")
+}
+
+// diffProfile returns a profile of the differences between the two profiles:
+// the samples of newProf, and the samples of oldProf with negated values. The
+// samples of oldProf carry the "pprof::base" label, like the ones merged by
+// the -diff_base flag of pprof.
+func diffProfile(oldProf, newProf *profile.Profile) (*profile.Profile, error) {
+	base := oldProf.Copy()
+	base.Scale(-1)
+	for _, s := range base.Sample {
+		if s.Label == nil {
+			s.Label = make(map[string][]string)
+		}
+		s.Label["pprof::base"] = []string{"true"}
+	}
+	return wzprof.MergeProfiles([]*profile.Profile{newProf, base})
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/google/pprof/profile"
+)
+
+func TestSamplePath(t *testing.T) {
+	main := &profile.Function{Name: "main"}
+	inlined := &profile.Function{Name: "inlined"}
+	leaf := &profile.Function{Name: "leaf"}
+	s := &profile.Sample{
+		Location: []*profile.Location{
+			{Line: []profile.Line{{Function: leaf}, {Function: inlined}}},
+			{Line: []profile.Line{{Function: main}}},
+		},
+	}
+	if got := samplePath(s); got != "main;inlined;leaf" {
+		t.Errorf("wrong path: %q", got)
+	}
+}
+
+func TestDiffProfile(t *testing.T) {
+	newProfile := func(value int64) *profile.Profile {
+		fn := &profile.Function{ID: 1, Name: "f"}
+		loc := &profile.Location{ID: 1, Line: []profile.Line{{Function: fn}}}
+		return &profile.Profile{
+			SampleType: []*profile.ValueType{{Type: "cpu", Unit: "nanoseconds"}},
+			PeriodType: &profile.ValueType{Type: "cpu", Unit: "nanoseconds"},
+			Sample:     []*profile.Sample{{Location: []*profile.Location{loc}, Value: []int64{value}}},
+			Location:   []*profile.Location{loc},
+			Function:   []*profile.Function{fn},
+		}
+	}
+
+	prof, err := diffProfile(newProfile(100), newProfile(150))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var total, base int64
+	for _, s := range prof.Sample {
+		total += s.Value[0]
+		if s.Label["pprof::base"] != nil {
+			base += s.Value[0]
+		}
+	}
+	if total != 50 || base != -100 {
+		t.Errorf("wrong diff: total=%d base=%d", total, base)
+	}
+}
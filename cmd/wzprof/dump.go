@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/stealthrocket/wzprof"
+)
+
+// dumpProfiles writes the CPU profile recorded so far when the process
+// receives cpuDumpSignal, and the memory profile when it receives
+// memDumpSignal, to files named after -cpuprofile and -memprofile with the
+// time of the dump, e.g. "cpu.20230102T150405.000Z.pprof". The guest keeps
+// running, and a new CPU profile starts after each dump.
+//
+// The returned function stops handling the signals, and waits for the dump in
+// progress to complete.
+func (prog *program) dumpProfiles(cpu *wzprof.CPUProfiler, mem *wzprof.MemoryProfiler) (stop func()) {
+	signals := make(map[os.Signal]string)
+	if prog.cpuProfile != "" && cpuDumpSignal != nil {
+		signals[cpuDumpSignal] = "cpu"
+	}
+	if prog.memProfile != "" && memDumpSignal != nil {
+		signals[memDumpSignal] = "memory"
+	}
+	if len(signals) == 0 || prog.hostProfile {
+		return func() {}
+	}
+
+	c := make(chan os.Signal, 1)
+	for sig := range signals {
+		signal.Notify(c, sig)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for sig := range c {
+			suffix := time.Now().UTC().Format("20060102T150405.000Z")
+			switch signals[sig] {
+			case "cpu":
+				// Recording restarts while the profile is being built.
+				pending := cpu.StopProfileAsync(buildContext("cpu"), prog.sampleRate)
+				cpu.StartProfile()
+				p, _ := pending.Wait(context.Background())
+				if p != nil {
+					prog.writeProfile("cpu", variantPath(prog.cpuProfile, suffix), p)
+				}
+			case "memory":
+				p, _ := mem.NewProfileContext(buildContext("memory"), prog.sampleRate)
+				prog.writeProfile("memory", variantPath(prog.memProfile, suffix), p)
+			}
+		}
+	}()
+
+	return func() {
+		signal.Stop(c)
+		close(c)
+		<-done
+	}
+}
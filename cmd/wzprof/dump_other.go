@@ -0,0 +1,12 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// There are no user-defined signals on this platform, profiles are only
+// written when the guest exits.
+var (
+	cpuDumpSignal os.Signal
+	memDumpSignal os.Signal
+)
@@ -0,0 +1,39 @@
+//go:build unix
+
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestDumpProfiles(t *testing.T) {
+	dir := t.TempDir()
+	p := program{
+		filePath:   "../../testdata/c/crunch_numbers.wasm",
+		cpuProfile: filepath.Join(dir, "cpu.pprof"),
+		memProfile: filepath.Join(dir, "mem.pprof"),
+		sampleRate: 1,
+		duration:   time.Second,
+		terminate:  true,
+	}
+
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		syscall.Kill(syscall.Getpid(), syscall.SIGUSR1)
+		syscall.Kill(syscall.Getpid(), syscall.SIGUSR2)
+	}()
+	if err := p.run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, pattern := range []string{"cpu.*.pprof", "mem.*.pprof"} {
+		matches, _ := filepath.Glob(filepath.Join(dir, pattern))
+		if len(matches) != 1 {
+			t.Errorf("%s: want 1 dump, got %q", pattern, matches)
+		}
+	}
+}
@@ -0,0 +1,13 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+var (
+	cpuDumpSignal os.Signal = syscall.SIGUSR1
+	memDumpSignal os.Signal = syscall.SIGUSR2
+)
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/stealthrocket/wzprof"
+)
+
+// runFuncTrace implements "wzprof functrace [-o trace.json] <trace>", which
+// converts a trace written by -functrace to the Chrome trace-event format, for
+// about://tracing or the Perfetto UI.
+func runFuncTrace(args []string) error {
+	flags := flag.NewFlagSet("functrace", flag.ContinueOnError)
+	output := flags.String("o", "", "Write the Chrome trace to the specified file instead of the standard output.")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: wzprof functrace [-o trace.json] <trace>")
+	}
+
+	f, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return fmt.Errorf("functrace: %w", err)
+	}
+	defer f.Close()
+
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		out, err := os.Create(*output)
+		if err != nil {
+			return fmt.Errorf("functrace: %w", err)
+		}
+		defer out.Close()
+		w = out
+	}
+	b := bufio.NewWriter(w)
+	if err := wzprof.ConvertFuncTrace(b, f); err != nil {
+		return fmt.Errorf("functrace: %s: %w", flags.Arg(0), err)
+	}
+	if err := b.Flush(); err != nil {
+		return fmt.Errorf("functrace: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,19 @@
+package main
+
+import (
+	"github.com/tetratelabs/wazero"
+)
+
+// isGoJS returns true if the guest was compiled with GOOS=js GOARCH=wasm. Its
+// host functions are then imported from the "gojs" module ("go" before Go
+// 1.21) instead of WASI, and it is started by calling its "run" export with
+// the arguments and environment written to its memory.
+func isGoJS(mod wazero.CompiledModule) bool {
+	for _, fn := range mod.ImportedFunctions() {
+		switch module, _, _ := fn.Import(); module {
+		case "gojs", "go":
+			return true
+		}
+	}
+	return false
+}
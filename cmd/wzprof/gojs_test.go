@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/tetratelabs/wazero"
+)
+
+func TestIsGoJS(t *testing.T) {
+	ctx := context.Background()
+	r := wazero.NewRuntime(ctx)
+	defer r.Close(ctx)
+
+	for _, test := range []struct {
+		module string
+		want   bool
+	}{
+		{module: "gojs", want: true},
+		{module: "go", want: true},
+		{module: "wasi_snapshot_preview1"},
+	} {
+		mod, err := r.CompileModule(ctx, wasmModuleImports(test.module, "runtime.wasmExit"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := isGoJS(mod); got != test.want {
+			t.Errorf("%s: want %t, got %t", test.module, test.want, got)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/tetratelabs/wazero/api"
+)
+
+// invokeParams parses the arguments of the function invoked with -invoke,
+// according to the types of its parameters.
+func invokeParams(def api.FunctionDefinition, args []string) ([]uint64, error) {
+	types := def.ParamTypes()
+	if len(args) != len(types) {
+		return nil, fmt.Errorf("expected %d arguments, got %d", len(types), len(args))
+	}
+	params := make([]uint64, len(args))
+	for i, arg := range args {
+		var err error
+		switch types[i] {
+		case api.ValueTypeI32:
+			var v int64
+			if v, err = parseInteger(arg, 32); err == nil {
+				params[i] = api.EncodeI32(int32(v))
+			}
+		case api.ValueTypeI64:
+			var v int64
+			if v, err = parseInteger(arg, 64); err == nil {
+				params[i] = api.EncodeI64(v)
+			}
+		case api.ValueTypeF32:
+			var v float64
+			if v, err = strconv.ParseFloat(arg, 32); err == nil {
+				params[i] = api.EncodeF32(float32(v))
+			}
+		case api.ValueTypeF64:
+			var v float64
+			if v, err = strconv.ParseFloat(arg, 64); err == nil {
+				params[i] = api.EncodeF64(v)
+			}
+		default:
+			return nil, fmt.Errorf("unsupported %s parameter", api.ValueTypeName(types[i]))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s argument %q", api.ValueTypeName(types[i]), arg)
+		}
+	}
+	return params, nil
+}
+
+// parseInteger parses a signed or unsigned integer of the given bit size, since
+// wasm integers have no sign.
+func parseInteger(s string, bitSize int) (int64, error) {
+	v, err := strconv.ParseInt(s, 0, bitSize)
+	if err != nil {
+		u, uerr := strconv.ParseUint(s, 0, bitSize)
+		if uerr != nil {
+			return 0, err
+		}
+		v = int64(u)
+	}
+	return v, nil
+}
+
+// formatResults formats the results of the function invoked with -invoke.
+func formatResults(def api.FunctionDefinition, results []uint64) []string {
+	values := make([]string, len(results))
+	for i, t := range def.ResultTypes() {
+		switch t {
+		case api.ValueTypeI32:
+			values[i] = strconv.FormatInt(int64(api.DecodeI32(results[i])), 10)
+		case api.ValueTypeF32:
+			values[i] = strconv.FormatFloat(float64(api.DecodeF32(results[i])), 'g', -1, 32)
+		case api.ValueTypeF64:
+			values[i] = strconv.FormatFloat(api.DecodeF64(results[i]), 'g', -1, 64)
+		default:
+			values[i] = strconv.FormatInt(int64(results[i]), 10)
+		}
+	}
+	return values
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/tetratelabs/wazero"
+	"golang.org/x/exp/slices"
+)
+
+// wasmAdd is a module exporting the add function of type (i32, i64) -> i64.
+var wasmAdd = []byte{
+	0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00,
+	0x01, 0x07, 0x01, 0x60, 0x02, 0x7f, 0x7e, 0x01, 0x7e, // type section
+	0x03, 0x02, 0x01, 0x00, // function section
+	0x07, 0x07, 0x01, 0x03, 'a', 'd', 'd', 0x00, 0x00, // export section
+	0x0a, 0x0a, 0x01, 0x08, 0x00, 0x20, 0x00, 0xac, 0x20, 0x01, 0x7c, 0x0b, // code section
+}
+
+func TestInvokeParams(t *testing.T) {
+	ctx := context.Background()
+	r := wazero.NewRuntime(ctx)
+	defer r.Close(ctx)
+
+	mod, err := r.CompileModule(ctx, wasmAdd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	def := mod.ExportedFunctions()["add"]
+
+	params, err := invokeParams(def, []string{"-1", "0xffffffffffffffff"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []uint64{0xffffffff, 0xffffffffffffffff}; !slices.Equal(params, want) {
+		t.Errorf("want %x, got %x", want, params)
+	}
+
+	for _, args := range [][]string{{"1"}, {"1", "x"}, {"4294967296", "1"}} {
+		if _, err := invokeParams(def, args); err == nil {
+			t.Errorf("%q: no error", args)
+		}
+	}
+
+	instance, err := r.InstantiateModule(ctx, mod, wazero.NewModuleConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	params, _ = invokeParams(def, []string{"40", "2"})
+	results, err := instance.ExportedFunction("add").Call(ctx, params...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values := formatResults(def, results); !slices.Equal(values, []string{"42"}) {
+		t.Errorf("wrong results: %q", values)
+	}
+}
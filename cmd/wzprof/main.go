@@ -3,11 +3,14 @@ package main
 import (
 	"context"
 	"crypto/rand"
+	"errors"
+	"expvar"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"math"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
@@ -15,14 +18,22 @@ import (
 	"path/filepath"
 	"runtime"
 	"runtime/pprof"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/google/pprof/profile"
 	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
 	"github.com/tetratelabs/wazero/experimental"
+	"github.com/tetratelabs/wazero/experimental/gojs"
+	"github.com/tetratelabs/wazero/experimental/sock"
 	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
 
 	"github.com/stealthrocket/wzprof"
+	"github.com/stealthrocket/wzprof/rpc"
+	"github.com/stealthrocket/wzprof/s3"
 )
 
 func main() {
@@ -38,55 +49,312 @@ func main() {
 const defaultSampleRate = 1.0 / 19
 
 type program struct {
-	filePath    string
-	args        []string
+	filePath string
+	args     []string
+	// When set, the exported function called instead of _start, with args
+	// as parameters.
+	invoke string
+	// Modules started by the run command when none are passed as arguments.
+	modules []string
+	// When set, the pprof endpoint is served after the guest exited, until
+	// the context is canceled.
+	keepServing bool
 	pprofAddr   string
+	pprofCert   string
+	pprofKey    string
+	pprofCreds  wzprof.Credentials
 	cpuProfile  string
+	pgoProfile  string
 	memProfile  string
+	accessProf  string
+	blockProf   string
+	mutexProf   string
+	goroutProf  string
 	sampleRate  float64
+	stagger     bool
 	hostProfile bool
 	hostTime    bool
 	inuseMemory bool
+	inuseLimit  int
+	maxStacks   int
+	sourceMap   string
+	zigAllocs   []string
+	format      string
+	pyImports   bool
+	traceFile   string
+	funcTrace   string
+	symbolizer  string
+	intervals   float64
+	nativeAddrs bool
+	borrowMem   bool
+	symWorkers  int
+	trimStacks  int
+	trimFrac    float64
+	labels      []string
 	mounts      []string
+	env         []string
+	listen      []string
+	sink        string
+	sinkPeriod  time.Duration
+	outputDir   string
+	cacheDir    string
+	startDelay  time.Duration
+	startAt     string
+	trapStack   bool
+	interpreter bool
+	keep        int
+	top         int
+	summary     bool
+	// When set, the profiles are written after this duration, and the guest
+	// is terminated if terminate is true.
+	duration  time.Duration
+	terminate bool
+	// Input of the guest, default to os.Stdin and crypto/rand.
+	stdin      io.Reader
+	randSource io.Reader
+	// When set, the guest profiles are recorded (even if they are not written
+	// to files) and retained in cpuProf and memProf.
+	keepProfiles bool
+	cpuProf      *profile.Profile
+	memProf      *profile.Profile
+	// Symbols of the perf.data files written with the perf format.
+	perfMap *wzprof.PerfMap
+	// When set, the pprof endpoint of the guest is registered on this mux,
+	// with paths starting with pprofPrefix, instead of being served by the
+	// program itself.
+	mux         *http.ServeMux
+	pprofPrefix string
 }
 
 func (prog *program) run(ctx context.Context) error {
-	wasmName := filepath.Base(prog.filePath)
-	wasmCode, err := os.ReadFile(prog.filePath)
+	wasmName := moduleFileName(prog.filePath)
+	wasmCode, err := readModule(ctx, prog.filePath)
 	if err != nil {
 		return fmt.Errorf("reading wasm module: %w", err)
 	}
 
 	p := wzprof.ProfilingFor(wasmCode)
+	p.SetModuleName(wasmName)
+	p.SetNativeAddresses(prog.nativeAddrs)
+	p.SetBorrowedMemory(prog.borrowMem)
+	p.SetSymbolizerWorkers(prog.symWorkers)
+	p.SetProfileLimits(wzprof.ProfileLimits{
+		MinFraction: prog.trimFrac,
+		MaxStacks:   prog.trimStacks,
+	})
 
-	cpu := p.CPUProfiler(wzprof.HostTime(prog.hostTime))
-	mem := p.MemoryProfiler(wzprof.InuseMemory(prog.inuseMemory))
+	if prog.symbolizer != "" {
+		if err := p.SetSymbolizer(prog.symbolizer); err != nil {
+			return err
+		}
+	}
+
+	sourceMap, err := readSourceMap(ctx, prog.sourceMap, prog.filePath, p.SourceMapURL())
+	if err != nil {
+		return fmt.Errorf("reading source map: %w", err)
+	}
+	if sourceMap != nil {
+		p.SetSourceMap(sourceMap)
+	}
+
+	cpu := p.CPUProfiler(
+		wzprof.HostTime(prog.hostTime),
+		wzprof.ConfidenceIntervals(prog.intervals),
+		wzprof.MaxCPUStacks(prog.maxStacks),
+	)
+	memOptions := []wzprof.MemoryProfilerOption{
+		wzprof.InuseMemory(prog.inuseMemory),
+		wzprof.MaxInuseAllocations(prog.inuseLimit),
+		wzprof.MaxMemoryStacks(prog.maxStacks),
+	}
+	if len(prog.zigAllocs) > 0 {
+		memOptions = append(memOptions, wzprof.ZigAllocators(prog.zigAllocs...))
+	}
+	mem := p.MemoryProfiler(memOptions...)
+	access := p.AccessProfiler()
+	tracer := p.Tracer()
+
+	// The profiles are rotated to the output directory or written to the
+	// sink periodically.
+	var sink wzprof.ProfileSink
+	sinkName := prog.sink
+	switch {
+	case prog.outputDir != "":
+		sink, sinkName = wzprof.FileSink(prog.outputDir, prog.keep), prog.outputDir
+	case prog.sink != "":
+		w, err := newProfileWriter(prog.sink)
+		if err != nil {
+			return err
+		}
+		sink = wzprof.WriterSink(w)
+	}
+	stopSink := func() {}
+	stopDumps := func() {}
+
+	// The guest profiles are flushed either when the guest calls proc_exit,
+	// or after it returned if it did not.
+	var flushOnce sync.Once
+	start := time.Now()
+	flush := func() {
+		flushOnce.Do(func() {
+			stopSink()
+			stopDumps()
+			summary := runSummary{top: prog.top}
+			if summary.top <= 0 {
+				summary.top = 10
+			}
+			// The cpu and memory profiles are built concurrently.
+			var cpuProf, memProf *wzprof.PendingProfile
+			if prog.cpuProfile != "" || prog.pgoProfile != "" || prog.keepProfiles || prog.summary {
+				cpuProf = cpu.StopProfileAsync(buildContext("cpu"), prog.sampleRate)
+			}
+			if prog.memProfile != "" || prog.keepProfiles || prog.summary {
+				memProf = mem.NewProfileAsync(buildContext("memory"), prog.sampleRate)
+			}
+			if cpuProf != nil {
+				// Errors only happen when the context is canceled.
+				p, _ := cpuProf.Wait(context.Background())
+				summary.cpu = p
+				if prog.keepProfiles {
+					prog.cpuProf = p
+				}
+				if prog.cpuProfile != "" && !prog.hostProfile {
+					prog.writeProfile("cpu", prog.cpuProfile, p)
+					prog.printTop(p)
+				}
+				if prog.pgoProfile != "" {
+					// The Go toolchain only reads profiles in the pprof
+					// format, whatever the format of the other profiles.
+					stdout.Printf("writing guest cpu profile for profile-guided optimization to %s", prog.pgoProfile)
+					if err := wzprof.WriteProfile(prog.pgoProfile, p); err != nil {
+						stderr.Print("writing profile:", err)
+					}
+				}
+			}
+			if memProf != nil {
+				p, _ := memProf.Wait(context.Background())
+				summary.mem = p
+				if prog.keepProfiles {
+					prog.memProf = p
+				}
+				if prog.memProfile != "" && !prog.hostProfile {
+					prog.writeProfile("memory", prog.memProfile, p)
+					prog.printTop(p)
+				}
+			}
+			if prog.accessProf != "" && !prog.hostProfile {
+				p, _ := access.NewProfileContext(buildContext("memory access"), prog.sampleRate)
+				prog.writeProfile("memory access", prog.accessProf, p)
+			}
+			if prog.traceFile != "" {
+				writeTrace("guest trace", prog.traceFile, tracer.WriteTrace)
+			}
+			if prog.funcTrace != "" {
+				writeTrace("guest function trace", prog.funcTrace, tracer.WriteFuncTrace)
+			}
+			if prog.summary {
+				summary.duration = time.Since(start)
+				summary.peakInuse = mem.PeakInuseBytes()
+				summary.metrics = p.Metrics()
+				if err := writeSummary(os.Stdout, summary); err != nil {
+					stderr.Print("printing summary:", err)
+				}
+			}
+		})
+	}
 
 	var listeners []experimental.FunctionListenerFactory
-	if prog.cpuProfile != "" || prog.pprofAddr != "" {
+	if prog.cpuProfile != "" || prog.pgoProfile != "" || prog.pprofAddr != "" || prog.keepProfiles || prog.summary || sink != nil {
 		stdout.Printf("enabling cpu profiler")
 		listeners = append(listeners, cpu)
 	}
-	if prog.memProfile != "" || prog.pprofAddr != "" {
+	if prog.memProfile != "" || prog.pprofAddr != "" || prog.keepProfiles || prog.summary || sink != nil {
 		stdout.Printf("enabling memory profiler")
 		listeners = append(listeners, mem)
 	}
+	if prog.accessProf != "" {
+		stdout.Printf("enabling memory access profiler")
+		listeners = append(listeners, access)
+	}
 	if prog.sampleRate < 1 {
 		stdout.Printf("configuring sampling rate to %.2g%%", prog.sampleRate)
+		var options []wzprof.SampleOption
+		if prog.stagger {
+			options = append(options, wzprof.StaggeredSampling())
+		}
 		for i, lstn := range listeners {
-			listeners[i] = wzprof.Sample(prog.sampleRate, lstn)
+			listeners[i] = wzprof.Sample(prog.sampleRate, lstn, options...)
 		}
 	}
+	// The tracer records all the calls, sampling would leave holes in the
+	// timeline.
+	if prog.traceFile != "" || prog.funcTrace != "" {
+		stdout.Printf("enabling tracer")
+		listeners = append(listeners, tracer)
+	}
+
+	if prog.startDelay > 0 || prog.startAt != "" {
+		stdout.Printf("deferring the start of the profilers")
+		listeners = []experimental.FunctionListenerFactory{wzprof.Deferred(
+			experimental.MultiFunctionListenerFactory(listeners...),
+			wzprof.StartAfter(prog.startDelay),
+			wzprof.StartAtFunction(prog.startAt),
+		)}
+	}
 
+	// The stacks of the traps must be complete, the hook is neither sampled
+	// nor deferred.
+	var trapTrace string
+	if prog.trapStack {
+		listeners = append(listeners, p.TrapHook(func(ctx context.Context, err error, stack []*profile.Location) {
+			trapTrace = formatStack(stack)
+		}))
+	}
+
+	// The hook comes after the profilers so they account for the calls in
+	// progress before the profiles are flushed.
+	listeners = append(listeners, wzprof.ExitHook(func(ctx context.Context, exitCode uint32) {
+		stdout.Printf("guest exiting with code %d", exitCode)
+		flush()
+	}))
+
+	// Tail calls are seen as returns by all the listeners, including the
+	// sampled ones.
 	ctx = context.WithValue(ctx,
 		experimental.FunctionListenerFactoryKey{},
-		experimental.MultiFunctionListenerFactory(listeners...),
+		p.TailCalls(experimental.MultiFunctionListenerFactory(listeners...)),
 	)
 
-	runtime := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().
+	// Terminating the guest requires the compiled code to check the context,
+	// which costs a bit of performance.
+	runtimeConfig := wazero.NewRuntimeConfig()
+	if prog.interpreter {
+		stdout.Printf("using the wazero interpreter")
+		runtimeConfig = wazero.NewRuntimeConfigInterpreter()
+	}
+	runtimeConfig = runtimeConfig.
 		WithDebugInfoEnabled(true).
-		WithCustomSections(true))
+		WithCustomSections(true).
+		WithCloseOnContextDone(prog.terminate).
+		// The buffer of the memory never moves when its capacity is the
+		// maximum size, so the tables borrowed by the profilers remain
+		// valid.
+		WithMemoryCapacityFromMax(prog.borrowMem)
+	// The cache entries are keyed by the options which change the compiled
+	// code, like the profilers being enabled.
+	if prog.cacheDir != "" {
+		cache, err := wazero.NewCompilationCacheWithDir(prog.cacheDir)
+		if err != nil {
+			return fmt.Errorf("opening compilation cache: %w", err)
+		}
+		defer cache.Close(ctx)
+		runtimeConfig = runtimeConfig.WithCompilationCache(cache)
+	}
+	runtime := wazero.NewRuntimeWithConfig(ctx, runtimeConfig)
 
+	if err := wzprof.CheckModule(wasmCode); err != nil {
+		return fmt.Errorf("checking wasm module: %w", err)
+	}
 	stdout.Printf("compiling wasm module %s", prog.filePath)
 	compiledModule, err := runtime.CompileModule(ctx, wasmCode)
 	if err != nil {
@@ -96,19 +364,67 @@ func (prog *program) run(ctx context.Context) error {
 	if err != nil {
 		return fmt.Errorf("preparing wasm module: %w", err)
 	}
+	strategy, err := p.Symbolizer()
+	if err != nil {
+		stderr.Printf("symbolizing wasm module with %s: %s", strategy, err)
+	} else {
+		stdout.Printf("symbolizing wasm module with %s", strategy)
+	}
+	if err := checkWASIImports(ctx, runtime, compiledModule); err != nil {
+		return err
+	}
+	goJS := isGoJS(compiledModule)
+	if goJS && prog.invoke != "" {
+		return fmt.Errorf("cannot invoke %s: Go js/wasm guests are only run by their run function", prog.invoke)
+	}
 
-	if prog.pprofAddr != "" {
-		u := &url.URL{Scheme: "http", Host: prog.pprofAddr, Path: "/debug/pprof"}
-		stdout.Printf("starting prrof http sever at %s", u)
+	var invokeDef api.FunctionDefinition
+	var invokeArgs []uint64
+	guestArgs := prog.args
+	if prog.invoke != "" {
+		invokeDef = compiledModule.ExportedFunctions()[prog.invoke]
+		if invokeDef == nil {
+			return fmt.Errorf("wasm module does not export function %s", prog.invoke)
+		}
+		invokeArgs, err = invokeParams(invokeDef, prog.args)
+		if err != nil {
+			return fmt.Errorf("invoking %s: %w", prog.invoke, err)
+		}
+		guestArgs = nil
+	}
 
-		server := http.NewServeMux()
-		server.Handle("/debug/pprof/", wzprof.Handler(prog.sampleRate, cpu, mem))
+	if prog.pprofAddr != "" {
+		server := prog.mux
+		if server == nil {
+			server = http.NewServeMux()
+			closeServer, err := prog.servePprof(server)
+			if err != nil {
+				return err
+			}
+			defer closeServer()
+		}
 
-		go func() {
-			if err := http.ListenAndServe(prog.pprofAddr, server); err != nil {
-				stderr.Println(err)
+		profilers := []wzprof.Profiler{cpu, mem}
+		if prog.accessProf != "" {
+			profilers = append(profilers, access)
+		}
+		labels := map[string]string{"module": wasmName}
+		for _, label := range prog.labels {
+			k, v, ok := strings.Cut(label, ":")
+			if !ok || k == "" {
+				return fmt.Errorf("invalid label %q - must be key:value", label)
 			}
-		}()
+			labels[k] = v
+		}
+		// The handlers serve the paths under the prefix of the module as if
+		// they were at the root of the server.
+		prefix := prog.pprofPrefix
+		handler := wzprof.WithLabels(wzprof.Handler(prog.sampleRate, profilers...), labels)
+		server.Handle(prefix+"/debug/pprof/", http.StripPrefix(prefix, handler))
+		server.Handle(prefix+"/debug/pprof/stream", http.StripPrefix(prefix, p.StreamHandler()))
+		server.Handle(prefix+rpc.ServicePath, http.StripPrefix(prefix, rpc.New(rpc.Config{SampleRate: prog.sampleRate}, profilers...)))
+
+		expvar.Publish("wzprof"+strings.ReplaceAll(prefix, "/", "."), p.MetricsVar())
 	}
 
 	if prog.hostProfile {
@@ -130,52 +446,159 @@ func (prog *program) run(ctx context.Context) error {
 		}
 	}
 
-	if prog.cpuProfile != "" {
-		cpu.StartProfile()
-		defer func() {
-			p := cpu.StopProfile(prog.sampleRate)
-			if !prog.hostProfile {
-				writeProfile("cpu", wasmName, prog.cpuProfile, p)
+	// Wasm runtimes do not report the blocking events of guests, nor their
+	// goroutines, the profiles of the host are written instead.
+	for _, hp := range []struct{ name, path string }{
+		{"block", prog.blockProf},
+		{"mutex", prog.mutexProf},
+		{"goroutine", prog.goroutProf},
+	} {
+		if hp.path != "" {
+			f, err := os.Create(hp.path)
+			if err != nil {
+				return err
 			}
-		}()
+			defer writeHostProfile(hp.name, f)
+		}
 	}
 
-	if prog.memProfile != "" {
-		defer func() {
-			p := mem.NewProfile(prog.sampleRate)
-			if !prog.hostProfile {
-				writeProfile("memory", wasmName, prog.memProfile, p)
+	if prog.cpuProfile != "" || prog.pgoProfile != "" || prog.keepProfiles || prog.summary {
+		cpu.StartProfile()
+	}
+
+	stopDumps = prog.dumpProfiles(cpu, mem)
+
+	if sink != nil {
+		stdout.Printf("writing profiles to %s every %s", sinkName, prog.sinkPeriod)
+		c := wzprof.NewContinuousProfiler(cpu, mem, sink,
+			wzprof.RotationPeriod(prog.sinkPeriod),
+			wzprof.ProfileSampleRate(prog.sampleRate),
+		)
+		sinkCtx, cancelSink := context.WithCancel(context.Background())
+		sinkDone := make(chan struct{})
+		go func() {
+			defer close(sinkDone)
+			if err := c.Run(sinkCtx); err != nil {
+				stderr.Printf("writing profiles to %s: %s", sinkName, err)
 			}
 		}()
+		// The last profiles are written when the guest exits.
+		stopSink = func() {
+			cancelSink()
+			<-sinkDone
+		}
+	}
+
+	defer flush()
+
+	// The listeners are pre-opened sockets of the guest, with the file
+	// descriptors following the ones of the mounts.
+	sockConfig := sock.NewConfig()
+	for _, addr := range prog.listen {
+		host, port, err := splitHostPort(addr)
+		if err != nil {
+			return err
+		}
+		stdout.Printf("listening for guest connections on %s", addr)
+		sockConfig = sockConfig.WithTCPListener(host, port)
 	}
 
+	parent := ctx
 	ctx, cancel := context.WithCancelCause(ctx)
+
+	if prog.duration > 0 {
+		timer := time.AfterFunc(prog.duration, func() {
+			if prog.terminate {
+				stdout.Printf("terminating guest after %s", prog.duration)
+				cancel(nil)
+			} else {
+				stdout.Printf("stopping profilers after %s", prog.duration)
+				flush()
+			}
+		})
+		defer timer.Stop()
+	}
+
 	go func() {
 		defer cancel(nil)
-		stdout.Printf("instantiating host module: wasi_snapshot_preview1")
-		wasi_snapshot_preview1.MustInstantiate(ctx, runtime)
+		guestCtx := sock.WithConfig(ctx, sockConfig)
+		if socketsExtension(compiledModule) != nil && !goJS {
+			stdout.Printf("instantiating host module: wasi_snapshot_preview1 (with sockets extension)")
+			c, closeWASI, err := instantiateWASISockets(ctx, runtime, prog, compiledModule, wasmName, guestArgs)
+			if err != nil {
+				cancel(fmt.Errorf("instantiating host module: %w", err))
+				return
+			}
+			defer closeWASI(ctx)
+			guestCtx = c
+		} else {
+			stdout.Printf("instantiating host module: wasi_snapshot_preview1")
+			wasi_snapshot_preview1.MustInstantiate(ctx, runtime)
+		}
+		if goJS {
+			stdout.Printf("instantiating host module: gojs")
+			gojs.MustInstantiate(ctx, runtime, compiledModule)
+		}
 
+		stdin, randSource := prog.stdin, prog.randSource
+		if stdin == nil {
+			stdin = os.Stdin
+		}
+		if randSource == nil {
+			randSource = rand.Reader
+		}
 		config := wazero.NewModuleConfig().
 			WithStdout(os.Stdout).
 			WithStderr(os.Stderr).
-			WithStdin(os.Stdin).
-			WithRandSource(rand.Reader).
+			WithStdin(stdin).
+			WithRandSource(randSource).
 			WithSysNanosleep().
 			WithSysNanotime().
 			WithSysWalltime().
-			WithArgs(append([]string{wasmName}, prog.args...)...).
+			WithArgs(append([]string{wasmName}, guestArgs...)...).
 			WithFSConfig(createFSConfig(prog.mounts))
+		if prog.invoke != "" {
+			// Reactors are initialized by _initialize instead of being run
+			// by _start.
+			config = config.WithStartFunctions("_initialize")
+		}
+		for _, env := range prog.env {
+			k, v, _ := strings.Cut(env, "=")
+			config = config.WithEnv(k, v)
+		}
 
 		moduleName := compiledModule.Name()
 		if moduleName == "" {
 			moduleName = wasmName
 		}
+		if goJS {
+			// The guest module is closed by gojs after it ran, and exit
+			// codes of zero are not reported as errors.
+			stdout.Printf("running guest module: %s", moduleName)
+			err := gojs.Run(guestCtx, runtime, compiledModule, gojs.NewConfig(config))
+			if err != nil {
+				cancel(fmt.Errorf("running guest module: %w", withGuestStack(err, trapTrace)))
+			}
+			return
+		}
 		stdout.Printf("instantiating guest module: %s", moduleName)
-		instance, err := runtime.InstantiateModule(ctx, compiledModule, config)
+		instance, err := runtime.InstantiateModule(guestCtx, compiledModule, config)
 		if err != nil {
-			cancel(fmt.Errorf("instantiating guest module: %w", err))
+			cancel(fmt.Errorf("instantiating guest module: %w", withGuestStack(err, trapTrace)))
 			return
 		}
+		if prog.invoke != "" {
+			stdout.Printf("invoking guest function: %s", prog.invoke)
+			results, err := instance.ExportedFunction(prog.invoke).Call(ctx, invokeArgs...)
+			if err != nil {
+				instance.Close(ctx)
+				cancel(fmt.Errorf("invoking %s: %w", prog.invoke, withGuestStack(err, trapTrace)))
+				return
+			}
+			if len(results) > 0 {
+				fmt.Println(strings.Join(formatResults(invokeDef, results), " "))
+			}
+		}
 		if err := instance.Close(ctx); err != nil {
 			cancel(fmt.Errorf("closing guest module: %w", err))
 			return
@@ -183,7 +606,52 @@ func (prog *program) run(ctx context.Context) error {
 	}()
 
 	<-ctx.Done()
-	return silenceContextCanceled(context.Cause(ctx))
+	err = silenceContextCanceled(context.Cause(ctx))
+	if prog.keepServing && parent.Err() == nil {
+		flush()
+		fmt.Fprintf(os.Stderr, "guest exited, serving its profiles on %s until interrupted\n", prog.pprofAddr)
+		<-parent.Done()
+	}
+	return err
+}
+
+// servePprof serves the handlers of mux at the pprof address until the
+// returned function is called.
+func (prog *program) servePprof(mux *http.ServeMux) (func(), error) {
+	l, err := wzprof.Listen(prog.pprofAddr)
+	if err != nil {
+		return nil, fmt.Errorf("listening on pprof address: %w", err)
+	}
+
+	if strings.Contains(prog.pprofAddr, "://") {
+		stdout.Printf("starting prrof http sever at %s (path /debug/pprof)", prog.pprofAddr)
+	} else {
+		u := &url.URL{Scheme: "http", Host: prog.pprofAddr, Path: "/debug/pprof"}
+		if prog.pprofCert != "" {
+			u.Scheme = "https"
+		}
+		stdout.Printf("starting prrof http sever at %s", u)
+	}
+
+	mux.Handle("/debug/vars", expvar.Handler())
+
+	var handler http.Handler = mux
+	if prog.pprofCreds != (wzprof.Credentials{}) {
+		handler = wzprof.WithAuth(mux, prog.pprofCreds)
+	}
+
+	go func() {
+		var err error
+		if prog.pprofCert != "" {
+			err = http.ServeTLS(l, handler, prog.pprofCert, prog.pprofKey)
+		} else {
+			err = http.Serve(l, handler)
+		}
+		if err != nil && !errors.Is(err, net.ErrClosed) {
+			stderr.Println(err)
+		}
+	}()
+	return func() { l.Close() }, nil
 }
 
 func silenceContextCanceled(err error) error {
@@ -193,51 +661,255 @@ func silenceContextCanceled(err error) error {
 	return err
 }
 
+// options are the flags of the commands running guest modules, which also come
+// before the name of the command in the original form of the command line.
+type options struct {
+	configPath  string
+	pprofAddr   string
+	pprofFD     int
+	pprofCert   string
+	pprofKey    string
+	pprofToken  string
+	pprofBasic  string
+	cpuProfile  string
+	pgoProfile  string
+	memProfile  string
+	accessProf  string
+	blockProf   string
+	mutexProf   string
+	goroutProf  string
+	sampleRate  float64
+	stagger     bool
+	hostProfile bool
+	hostTime    bool
+	inuseMemory bool
+	inuseLimit  int
+	maxStacks   int
+	sourceMap   string
+	zigAllocs   string
+	format      string
+	pyImports   bool
+	traceFile   string
+	funcTrace   string
+	symbolizer  string
+	intervals   float64
+	nativeAddrs bool
+	borrowMem   bool
+	symWorkers  int
+	trimStacks  int
+	trimFrac    float64
+	labels      string
+	verbose     bool
+	mounts      string
+	env         stringList
+	listen      stringList
+	modules     stringList
+	sink        string
+	sinkPeriod  time.Duration
+	outputDir   string
+	rotate      time.Duration
+	keep        int
+	top         int
+	summary     bool
+	duration    time.Duration
+	terminate   bool
+	invoke      string
+	cacheDir    string
+	startDelay  time.Duration
+	startAt     string
+	trapStack   bool
+	interpreter bool
+}
+
 var (
-	pprofAddr    string
-	cpuProfile   string
-	memProfile   string
-	sampleRate   float64
-	hostProfile  bool
-	hostTime     bool
-	inuseMemory  bool
-	verbose      bool
-	mounts       string
-	printVersion bool
+	perfMapMutex sync.Mutex
 
 	version = "dev"
 	stdout  = log.Default()
 	stderr  = log.New(os.Stderr, "ERROR: ", 0)
 )
 
-func init() {
-	flag.StringVar(&pprofAddr, "pprof-addr", "", "Address where to expose a pprof HTTP endpoint.")
-	flag.StringVar(&cpuProfile, "cpuprofile", "", "Write a CPU profile to the specified file before exiting.")
-	flag.StringVar(&memProfile, "memprofile", "", "Write a memory profile to the specified file before exiting.")
-	flag.Float64Var(&sampleRate, "sample", defaultSampleRate, "Set the profile sampling rate (0-1).")
-	flag.BoolVar(&hostProfile, "host", false, "Generate profiles of the host instead of the guest application.")
-	flag.BoolVar(&hostTime, "iowait", false, "Include time spent waiting on I/O in guest CPU profile.")
-	flag.BoolVar(&inuseMemory, "inuse", false, "Include snapshots of memory in use (experimental).")
-	flag.BoolVar(&verbose, "verbose", false, "Enable more output")
-	flag.StringVar(&mounts, "mount", "", "Comma-separated list of directories to mount (e.g. /tmp:/tmp:ro).")
-	flag.BoolVar(&printVersion, "version", false, "Print the wzprof version.")
+// register registers the flags of o on fs.
+func (o *options) register(fs *flag.FlagSet) {
+	fs.StringVar(&o.configPath, "config", os.Getenv("WZPROF_CONFIG"), "Path of a configuration file setting the options which are not set on the command line, in the TOML format (e.g. sample = 1).")
+	fs.StringVar(&o.pprofAddr, "pprof-addr", "", "Address where to expose a pprof HTTP endpoint, path of a Unix domain socket (e.g. unix:///run/wzprof.sock), or inherited listener (fd://3, or systemd:// for socket activation).")
+	fs.IntVar(&o.pprofFD, "pprof-fd", -1, "File descriptor of an inherited listener where to expose the pprof HTTP endpoint (same as -pprof-addr fd://<n>).")
+	fs.StringVar(&o.pprofCert, "pprof-tls-cert", "", "Path of the TLS certificate of the pprof HTTP endpoint, which is then served over HTTPS.")
+	fs.StringVar(&o.pprofKey, "pprof-tls-key", "", "Path of the private key of the TLS certificate of the pprof HTTP endpoint.")
+	fs.StringVar(&o.pprofToken, "pprof-token", os.Getenv("WZPROF_PPROF_TOKEN"), "Bearer token required by the pprof HTTP endpoint (default to $WZPROF_PPROF_TOKEN).")
+	fs.StringVar(&o.pprofBasic, "pprof-basic-auth", os.Getenv("WZPROF_PPROF_BASIC_AUTH"), "Username and password required by the pprof HTTP endpoint, in the user:password form (default to $WZPROF_PPROF_BASIC_AUTH).")
+	fs.StringVar(&o.cpuProfile, "cpuprofile", "", "Write a CPU profile to the specified file before exiting.")
+	fs.StringVar(&o.pgoProfile, "pgo", "", "Write a CPU profile of a Go guest usable by go build -pgo to the specified file, or to default.pgo if it is a directory, before exiting.")
+	fs.StringVar(&o.funcTrace, "functrace", "", "Write a compact binary trace of the guest function calls to the specified file before exiting (convert it with wzprof functrace).")
+	fs.StringVar(&o.memProfile, "memprofile", "", "Write a memory profile to the specified file before exiting.")
+	fs.StringVar(&o.accessProf, "accessprofile", "", "Write a profile of the estimated memory accesses to the specified file before exiting (experimental).")
+	fs.StringVar(&o.blockProf, "blockprofile", "", "Write a profile of the blocking events of the host to the specified file before exiting (guests have none).")
+	fs.StringVar(&o.mutexProf, "mutexprofile", "", "Write a profile of the mutex contention of the host to the specified file before exiting (guests have none).")
+	fs.StringVar(&o.goroutProf, "goroutineprofile", "", "Write a profile of the goroutines of the host to the specified file before exiting (guests have none).")
+	fs.Float64Var(&o.sampleRate, "sample", defaultSampleRate, "Set the profile sampling rate (0-1).")
+	fs.BoolVar(&o.stagger, "sample-stagger", false, "Start the sampling cycles of functions at different calls, so functions called less often than the sampling period are also sampled.")
+	fs.BoolVar(&o.hostProfile, "host", false, "Generate profiles of the host instead of the guest application.")
+	fs.BoolVar(&o.hostTime, "iowait", false, "Include time spent waiting on I/O in guest CPU profile.")
+	fs.BoolVar(&o.inuseMemory, "inuse", false, "Include snapshots of memory in use (experimental).")
+	fs.IntVar(&o.inuseLimit, "inuse-limit", wzprof.DefaultMaxInuseAllocations, "Maximum number of allocations tracked with -inuse, the oldest are evicted (0 for no limit).")
+	fs.IntVar(&o.maxStacks, "max-stacks", wzprof.DefaultMaxStacks, "Maximum number of stacks recorded in the cpu and memory profiles, the others are aggregated in a [dropped] sample (0 for no limit).")
+	fs.StringVar(&o.sourceMap, "sourcemap", "", "Path to the source map of the module, when it does not embed DWARF (e.g. AssemblyScript).")
+	fs.StringVar(&o.zigAllocs, "zig-allocators", "", "Comma-separated list of Zig allocator types to profile (e.g. heap.arena_allocator.ArenaAllocator).")
+	fs.StringVar(&o.format, "format", "pprof", "Format of the profiles written to files (pprof, folded, perf, callgrind, jfr).")
+	fs.BoolVar(&o.pyImports, "python-imports", false, "Also write profiles of the Python module imports to <file>.import.")
+	fs.StringVar(&o.traceFile, "trace", "", "Write a Chrome trace-event file of the guest function calls to the specified file before exiting.")
+	fs.StringVar(&o.symbolizer, "symbolizer", "auto", "Strategy to resolve symbols (auto, dwarf, pclntab, names, none).")
+	fs.Float64Var(&o.intervals, "intervals", 0, "Record confidence intervals of the sampled CPU profile values at this level (e.g. 0.95).")
+	fs.BoolVar(&o.nativeAddrs, "native-addresses", false, "Record the native addresses of the compiled wasm code in the guest profiles.")
+	fs.BoolVar(&o.borrowMem, "borrow-memory", false, "Read the symbol tables of Go guests from their memory instead of copying them, allocating the memory of the guest to its maximum size.")
+	fs.IntVar(&o.symWorkers, "symbolizer-workers", 0, "Number of goroutines resolving the symbols of the profiles (default to the number of CPUs).")
+	fs.IntVar(&o.trimStacks, "trim-max-stacks", 0, "Maximum number of stacks written in the profiles, the others are aggregated in an [other] sample (0 for no limit).")
+	fs.Float64Var(&o.trimFrac, "trim-min-fraction", 0, "Aggregate the stacks below this fraction of the profile total in an [other] sample (0-1).")
+	fs.StringVar(&o.labels, "labels", "", "Comma-separated list of key:value labels attached to the profiles served by -pprof-addr (e.g. service:api,version:1.2.3).")
+	fs.BoolVar(&o.verbose, "verbose", false, "Enable more output")
+	fs.StringVar(&o.sink, "sink", "", "Periodically write the guest profiles to a directory or an S3 bucket (e.g. s3://bucket/prefix/).")
+	fs.DurationVar(&o.sinkPeriod, "sink-period", time.Minute, "Period of the profiles written to -sink.")
+	fs.StringVar(&o.outputDir, "output-dir", "", "Periodically write timestamped guest profiles to the specified directory (e.g. cpu-20230102T150405.000000000Z.pprof).")
+	fs.DurationVar(&o.rotate, "rotate-interval", time.Minute, "Period of the profiles written to -output-dir.")
+	fs.IntVar(&o.keep, "keep", 0, "Number of profiles of each type retained in -output-dir (all if zero).")
+	fs.DurationVar(&o.startDelay, "start-delay", 0, "Start recording the guest profiles after this duration, e.g. to skip the initialization of the guest.")
+	fs.StringVar(&o.startAt, "start-at", "", "Start recording the guest profiles when the guest first calls the specified function (e.g. main.main).")
+	fs.BoolVar(&o.trapStack, "trap-stack", false, "Print the symbolized stack of the guest when it traps, instead of the wasm stack trace (records the stack of all calls).")
+	fs.DurationVar(&o.duration, "duration", 0, "Write the profiles after this duration instead of when the guest exits.")
+	fs.BoolVar(&o.terminate, "terminate", false, "Terminate the guest when the -duration elapses.")
+	fs.IntVar(&o.top, "top", 0, "Print the specified number of top functions of the guest profiles written to files.")
+	fs.BoolVar(&o.summary, "summary", false, "Print a summary of the run when the guest exits: guest cpu time, top functions by self time (-top, default 10), allocations, and profiling overhead.")
+	fs.Var(&o.env, "env", "Set an environment variable of the guest, in the KEY=VALUE form, or KEY to pass the value of the host (can be repeated).")
+	fs.Var(&o.listen, "listen", "Pre-open a TCP listener for the guest at the host:port address, e.g. for HTTP servers (can be repeated).")
+	fs.StringVar(&o.invoke, "invoke", "", "Call the specified exported function instead of _start, with the arguments following the module path as parameters (e.g. -invoke fib app.wasm 30).")
+	fs.BoolVar(&o.interpreter, "interpreter", false, "Run the guest with the wazero interpreter instead of the compiler, e.g. on platforms the compiler does not support.")
+	fs.StringVar(&o.cacheDir, "compilation-cache", "", "Directory where to cache the compiled wasm modules, so repeated runs of the same module skip compilation.")
+	fs.Var(&o.modules, "module", "Path of a wasm module started by the run command when none is passed as argument (can be repeated).")
+	fs.StringVar(&o.mounts, "mount", "", "Comma-separated list of directories to mount (e.g. /tmp:/tmp:ro).")
 }
 
 func run(ctx context.Context) error {
+	args := os.Args[1:]
+	if len(args) > 0 {
+		if cmd := toolCommand(args[0]); cmd != nil {
+			return cmd(ctx, args[1:])
+		}
+		if cmd := moduleCommand(args[0]); cmd != nil {
+			fs := flag.NewFlagSet(args[0], flag.ContinueOnError)
+			opts := new(options)
+			opts.register(fs)
+			if err := fs.Parse(args[1:]); err != nil {
+				return err
+			}
+			prog, err := opts.program(fs)
+			if err != nil {
+				return err
+			}
+			return cmd(ctx, prog, fs.Args())
+		}
+	}
+
+	// Original form of the command line, wzprof [flags] app.wasm [args...],
+	// where the flags may also precede a command.
+	opts := new(options)
+	opts.register(flag.CommandLine)
+	printVersion := flag.Bool("version", false, "Print the wzprof version.")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
-	if printVersion {
+	if *printVersion {
 		fmt.Printf("wzprof version %s\n", version)
 		return nil
 	}
 
-	args := flag.Args()
+	args = flag.Args()
+	if len(args) == 0 && len(opts.modules) > 0 {
+		args = []string{"run"}
+	}
 	if len(args) < 1 {
-		// TODO: print flag usage
-		return fmt.Errorf("usage: wzprof </path/to/app.wasm>")
+		flag.Usage()
+		return fmt.Errorf("missing wasm module or command")
+	}
+	if cmd := toolCommand(args[0]); cmd != nil {
+		return cmd(ctx, args[1:])
+	}
+
+	prog, err := opts.program(flag.CommandLine)
+	if err != nil {
+		return err
+	}
+	if cmd := moduleCommand(args[0]); cmd != nil {
+		return cmd(ctx, prog, args[1:])
+	}
+	prog.filePath, prog.args = args[0], args[1:]
+	return prog.run(ctx)
+}
+
+const usage = `usage: wzprof [flags] <app.wasm> [args...]
+       wzprof <command> [flags] [args...]
+
+Commands running guest modules, with the flags below:
+  run        run guest modules with profilers, like without a command
+  serve      run a guest module and serve its profiles until interrupted
+  ab         compare the profiles of two versions of a module
+
+Other commands, see wzprof <command> -h:
+  symbolize  resolve the functions of profiles recorded with -symbolizer none
+  diff       compare two profiles
+  merge      merge profiles of the same type
+  top        print the top functions of profiles
+  functrace  convert -functrace files to Chrome traces
+  daemon     serve the API of a profiling daemon
+
+Flags:
+`
+
+// moduleCommand returns the function implementing a command running guest
+// modules, or nil if there is no such command.
+func moduleCommand(name string) func(context.Context, *program, []string) error {
+	switch name {
+	case "ab":
+		return runAB
+	case "run":
+		return runModules
+	case "serve":
+		return runServe
+	}
+	return nil
+}
+
+// toolCommand returns the function implementing a command parsing its own
+// flags, or nil if there is no such command.
+func toolCommand(name string) func(context.Context, []string) error {
+	switch name {
+	case "daemon":
+		return runDaemon
+	case "diff":
+		return func(_ context.Context, args []string) error { return runDiff(args) }
+	case "functrace":
+		return func(_ context.Context, args []string) error { return runFuncTrace(args) }
+	case "merge":
+		return func(_ context.Context, args []string) error { return runMerge(args) }
+	case "symbolize":
+		return runSymbolize
+	case "top":
+		return func(_ context.Context, args []string) error { return runTop(args) }
 	}
+	return nil
+}
 
-	if verbose {
+// program validates the options, once parsed from fs and completed by the
+// configuration file and the environment, and returns the program they
+// configure. It also configures the logs and the profiles of the host.
+func (o *options) program(fs *flag.FlagSet) (*program, error) {
+	if err := configure(fs, o.configPath); err != nil {
+		return nil, err
+	}
+
+	if o.verbose {
 		log.SetPrefix("==> ")
 		log.SetFlags(0)
 		log.SetOutput(os.Stdout)
@@ -245,24 +917,258 @@ func run(ctx context.Context) error {
 		log.SetOutput(io.Discard)
 	}
 
-	filePath := args[0]
+	switch o.format {
+	case "pprof", "folded", "perf", "callgrind", "jfr":
+	default:
+		return nil, fmt.Errorf("unsupported profile format: %s", o.format)
+	}
 
-	rate := int(math.Ceil(1 / sampleRate))
+	env, err := parseEnv(o.env)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, addr := range o.listen {
+		if _, _, err := splitHostPort(addr); err != nil {
+			return nil, err
+		}
+	}
+
+	if o.interpreter && o.nativeAddrs {
+		return nil, fmt.Errorf("-native-addresses cannot be combined with -interpreter")
+	}
+
+	if o.symWorkers < 0 {
+		return nil, fmt.Errorf("invalid -symbolizer-workers %d - must not be negative", o.symWorkers)
+	}
+
+	if o.trimStacks < 0 {
+		return nil, fmt.Errorf("invalid -trim-max-stacks %d - must not be negative", o.trimStacks)
+	}
+	if o.trimFrac < 0 || o.trimFrac >= 1 {
+		return nil, fmt.Errorf("invalid -trim-min-fraction %v - must be between 0 and 1", o.trimFrac)
+	}
+
+	if o.terminate && o.duration <= 0 {
+		return nil, fmt.Errorf("-terminate requires a -duration")
+	}
+
+	if o.pprofFD >= 0 {
+		if o.pprofAddr != "" {
+			return nil, fmt.Errorf("-pprof-fd cannot be combined with -pprof-addr")
+		}
+		o.pprofAddr = "fd://" + strconv.Itoa(o.pprofFD)
+	}
+
+	if (o.pprofCert == "") != (o.pprofKey == "") {
+		return nil, fmt.Errorf("-pprof-tls-cert and -pprof-tls-key must be set together")
+	}
+	creds := wzprof.Credentials{BearerToken: o.pprofToken}
+	if o.pprofBasic != "" {
+		var ok bool
+		creds.Username, creds.Password, ok = strings.Cut(o.pprofBasic, ":")
+		if !ok || creds.Username == "" {
+			return nil, fmt.Errorf("invalid -pprof-basic-auth value - must be user:password")
+		}
+	}
+
+	if o.sink != "" && o.cpuProfile != "" && !o.hostProfile {
+		return nil, fmt.Errorf("-sink cannot be combined with -cpuprofile")
+	}
+	if o.pgoProfile != "" {
+		if o.sink != "" {
+			return nil, fmt.Errorf("-sink cannot be combined with -pgo")
+		}
+		if o.outputDir != "" {
+			return nil, fmt.Errorf("-output-dir cannot be combined with -pgo")
+		}
+		// Like go build -pgo=auto, which looks for default.pgo in the
+		// directory of the main package.
+		if info, err := os.Stat(o.pgoProfile); err == nil && info.IsDir() {
+			o.pgoProfile = filepath.Join(o.pgoProfile, "default.pgo")
+		}
+	}
+	if o.outputDir != "" {
+		if o.sink != "" {
+			return nil, fmt.Errorf("-output-dir cannot be combined with -sink")
+		}
+		if o.cpuProfile != "" && !o.hostProfile {
+			return nil, fmt.Errorf("-output-dir cannot be combined with -cpuprofile")
+		}
+		o.sinkPeriod = o.rotate
+	}
+
+	rate := int(math.Ceil(1 / o.sampleRate))
 	runtime.SetBlockProfileRate(rate)
 	runtime.SetMutexProfileFraction(rate)
 
-	return (&program{
-		filePath:    filePath,
-		args:        args[1:],
-		pprofAddr:   pprofAddr,
-		cpuProfile:  cpuProfile,
-		memProfile:  memProfile,
-		sampleRate:  sampleRate,
-		hostProfile: hostProfile,
-		hostTime:    hostTime,
-		inuseMemory: inuseMemory,
-		mounts:      split(mounts),
-	}).run(ctx)
+	return &program{
+		pprofAddr:   o.pprofAddr,
+		pprofCert:   o.pprofCert,
+		pprofKey:    o.pprofKey,
+		pprofCreds:  creds,
+		cpuProfile:  o.cpuProfile,
+		pgoProfile:  o.pgoProfile,
+		memProfile:  o.memProfile,
+		accessProf:  o.accessProf,
+		blockProf:   o.blockProf,
+		mutexProf:   o.mutexProf,
+		goroutProf:  o.goroutProf,
+		sampleRate:  o.sampleRate,
+		stagger:     o.stagger,
+		hostProfile: o.hostProfile,
+		hostTime:    o.hostTime,
+		inuseMemory: o.inuseMemory,
+		inuseLimit:  o.inuseLimit,
+		maxStacks:   o.maxStacks,
+		sourceMap:   o.sourceMap,
+		zigAllocs:   split(o.zigAllocs),
+		format:      o.format,
+		pyImports:   o.pyImports,
+		traceFile:   o.traceFile,
+		funcTrace:   o.funcTrace,
+		symbolizer:  o.symbolizer,
+		intervals:   o.intervals,
+		nativeAddrs: o.nativeAddrs,
+		borrowMem:   o.borrowMem,
+		symWorkers:  o.symWorkers,
+		trimStacks:  o.trimStacks,
+		trimFrac:    o.trimFrac,
+		labels:      split(o.labels),
+		mounts:      split(o.mounts),
+		env:         env,
+		listen:      o.listen,
+		sink:        o.sink,
+		sinkPeriod:  o.sinkPeriod,
+		outputDir:   o.outputDir,
+		keep:        o.keep,
+		top:         o.top,
+		summary:     o.summary,
+		duration:    o.duration,
+		terminate:   o.terminate,
+		invoke:      o.invoke,
+		cacheDir:    o.cacheDir,
+		startDelay:  o.startDelay,
+		startAt:     o.startAt,
+		trapStack:   o.trapStack,
+		interpreter: o.interpreter,
+		modules:     o.modules,
+	}, nil
+}
+
+// readSourceMap reads the source map at path. When path is empty, it looks up
+// the source map referenced by the module next to the module file, or URL, and
+// returns nil if there is none.
+func readSourceMap(ctx context.Context, path, wasmPath, ref string) ([]byte, error) {
+	if path != "" {
+		return os.ReadFile(path)
+	}
+	if ref == "" || strings.Contains(ref, "://") || wasmPath == "-" {
+		return nil, nil
+	}
+	var b []byte
+	var err error
+	if isURL(wasmPath) {
+		var base, u *url.URL
+		if base, err = url.Parse(wasmPath); err == nil {
+			if u, err = base.Parse(ref); err == nil {
+				b, err = download(ctx, u.String())
+			}
+		}
+	} else {
+		b, err = os.ReadFile(filepath.Join(filepath.Dir(wasmPath), ref))
+	}
+	if err != nil {
+		stdout.Printf("source map referenced by the module not found: %s", err)
+		return nil, nil
+	}
+	stdout.Printf("using source map %s", ref)
+	return b, nil
+}
+
+// newProfileWriter returns the writer of the profiles to the -sink location:
+// a s3://bucket/prefix URL, configured with the usual AWS environment
+// variables, or a directory.
+func newProfileWriter(location string) (wzprof.ProfileWriter, error) {
+	path, ok := strings.CutPrefix(location, "s3://")
+	if !ok {
+		return wzprof.DirWriter(location), nil
+	}
+	bucket, prefix, _ := strings.Cut(path, "/")
+	if bucket == "" {
+		return nil, fmt.Errorf("invalid sink %q - missing bucket name", location)
+	}
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	return s3.New(s3.Config{
+		Bucket:          bucket,
+		Prefix:          prefix,
+		Region:          region,
+		Endpoint:        os.Getenv("AWS_ENDPOINT_URL"),
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}), nil
+}
+
+// parseEnv returns the environment of the guest set by the -env flags, in the
+// KEY=VALUE form. A KEY without value passes the value of the host, and a key
+// set more than once keeps its first position with the last value, like
+// wazero.ModuleConfig.WithEnv does.
+func parseEnv(vars []string) ([]string, error) {
+	var env []string
+	index := make(map[string]int)
+	for _, kv := range vars {
+		k, _, ok := strings.Cut(kv, "=")
+		if k == "" {
+			return nil, fmt.Errorf("invalid environment variable %q - must be KEY=VALUE", kv)
+		}
+		if !ok {
+			kv = k + "=" + os.Getenv(k)
+		}
+		if i, ok := index[k]; ok {
+			env[i] = kv
+		} else {
+			index[k] = len(env)
+			env = append(env, kv)
+		}
+	}
+	return env, nil
+}
+
+// splitHostPort splits the address of a -listen flag. The socket configuration
+// of wazero joins the host and port back without brackets, IPv6 hosts keep
+// theirs.
+func splitHostPort(addr string) (string, int, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid listen address %q: %w", addr, err)
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil || p < 0 || p > 65535 {
+		return "", 0, fmt.Errorf("invalid listen address %q: invalid port", addr)
+	}
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	return host, p, nil
+}
+
+// stringList is a flag.Value collecting the values of a repeated flag.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
 }
 
 func split(s string) []string {
@@ -290,15 +1196,146 @@ func writeHeapProfile(f *os.File) {
 	}
 }
 
-func writeProfile(profileName, wasmName, path string, prof *profile.Profile) {
-	m := &profile.Mapping{ID: 1, File: wasmName}
-	prof.Mapping = []*profile.Mapping{m}
+func writeHostProfile(name string, f *os.File) {
+	stdout.Printf("writing host %s profile to %s", name, f.Name())
+	if err := pprof.Lookup(name).WriteTo(f, 0); err != nil {
+		stderr.Printf("writing %s profile: %v", name, err)
+	}
+	f.Close()
+}
+
+func (prog *program) writeProfile(profileName, path string, prof *profile.Profile) {
+	prog.writeProfileFile(profileName, path, prof)
+
+	if prog.pyImports {
+		if imports := wzprof.PythonImportProfile(prof); len(imports.Sample) > 0 {
+			prog.writeProfileFile(profileName+" import", path+".import", imports)
+		}
+	}
+}
+
+// printTop prints the top functions of a guest profile when -top is set.
+func (prog *program) printTop(prof *profile.Profile) {
+	if prog.top <= 0 || prof == nil {
+		return
+	}
+	if err := writeTop(os.Stdout, prof, "", prog.top); err != nil {
+		stderr.Print("printing top functions:", err)
+	}
+}
+
+// buildContext returns a context logging the progress of building the guest
+// profile, at most once per second.
+func buildContext(profileName string) context.Context {
+	last := time.Now()
+	return wzprof.WithProgress(context.Background(), func(done, total int) {
+		if now := time.Now(); now.Sub(last) >= time.Second || (done == total && done > 0) {
+			last = now
+			stdout.Printf("building guest %s profile: %d/%d samples", profileName, done, total)
+		}
+	})
+}
+
+func (prog *program) writeProfileFile(profileName, path string, prof *profile.Profile) {
 	stdout.Printf("writing guest %s profile to %s", profileName, path)
-	if err := wzprof.WriteProfile(path, prof); err != nil {
+	var err error
+	switch prog.format {
+	case "folded":
+		err = writeFoldedProfile(path, prof)
+	case "callgrind":
+		err = writeCallgrindProfile(path, prof)
+	case "jfr":
+		err = writeJFRProfile(path, prof)
+	case "perf":
+		// The programs of the modules started by the run command share the
+		// perf map of the process.
+		perfMapMutex.Lock()
+		if prog.perfMap == nil {
+			prog.perfMap = wzprof.NewPerfMap(os.Getpid())
+		}
+		err = writePerfData(path, prof, prog.perfMap)
+		perfMapMutex.Unlock()
+	default:
+		err = wzprof.WriteProfile(path, prof)
+	}
+	if err != nil {
 		stderr.Print("writing profile:", err)
 	}
 }
 
+func writeFoldedProfile(path string, prof *profile.Profile) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return wzprof.WriteFoldedProfile(f, prof, "")
+}
+
+func writeCallgrindProfile(path string, prof *profile.Profile) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := wzprof.WriteCallgrindProfile(f, prof); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func writeJFRProfile(path string, prof *profile.Profile) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := wzprof.WriteJFRProfile(f, prof); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// writePerfData writes the profile to a perf.data file, and the symbols of all
+// the perf.data files written by the program to the perf map of the process.
+func writePerfData(path string, prof *profile.Profile, perfMap *wzprof.PerfMap) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := wzprof.WritePerfData(f, prof, perfMap, ""); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	stdout.Printf("writing perf symbols to %s", perfMap.Path())
+	m, err := os.Create(perfMap.Path())
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+	if _, err := perfMap.WriteTo(m); err != nil {
+		return err
+	}
+	return m.Close()
+}
+
+func writeTrace(name, path string, write func(io.Writer) error) {
+	stdout.Printf("writing %s to %s", name, path)
+	f, err := os.Create(path)
+	if err != nil {
+		stderr.Print("writing trace:", err)
+		return
+	}
+	defer f.Close()
+	if err := write(f); err != nil {
+		stderr.Print("writing trace:", err)
+	}
+}
+
 func createFSConfig(mounts []string) wazero.FSConfig {
 	fs := wazero.NewFSConfig()
 	for _, m := range mounts {
@@ -2,11 +2,16 @@ package main
 
 import (
 	"context"
+	"flag"
+	"fmt"
+	"net"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/google/pprof/profile"
+	"golang.org/x/exp/slices"
 )
 
 // This test file performs end-to-end validation of the profiler on actual wasm
@@ -175,7 +180,7 @@ func TestGoTwoCalls(t *testing.T) {
 				{"runtime.mallocgc", 948, false},  // runtime.mallocgc
 				{"runtime.makeslice", 103, false}, // runtime.makeslice
 				{"main.myalloc1", 5, false},       // main.myalloc1
-				{"main.main", 18, true},           // main.main
+				{"main.intermediate", 18, true},   // main.intermediate
 				{"main.main", 25, false},          // main.main
 				{"runtime.main", 267, false},      // runtime.main
 				{"runtime.goexit", 401, false},    // runtime.goexit
@@ -212,7 +217,7 @@ func TestGoTwoCalls(t *testing.T) {
 				{"runtime.mallocgc", 948, false},  // runtime.mallocgc
 				{"runtime.makeslice", 103, false}, // runtime.makeslice
 				{"main.myalloc1", 5, false},       // main.myalloc1
-				{"main.main", 18, true},           // main.main
+				{"main.intermediate", 18, true},   // main.intermediate
 				{"main.main", 25, false},          // main.main
 				{"runtime.main", 267, false},      // runtime.main
 				{"runtime.goexit", 401, false},    // runtime.goexit
@@ -233,29 +238,46 @@ func TestGoTwoCalls(t *testing.T) {
 }
 
 func testCpuProfiler(t *testing.T, prog program, expectedSamples []sample) {
-	prog.sampleRate = 1
-	prog.cpuProfile = filepath.Join(t.TempDir(), "cpu.pprof")
+	forEachEngine(t, prog, func(t *testing.T, prog program) {
+		prog.sampleRate = 1
+		prog.cpuProfile = filepath.Join(t.TempDir(), "cpu.pprof")
 
-	expectedTypes := []string{
-		"samples",
-		"cpu",
-	}
+		expectedTypes := []string{
+			"samples",
+			"cpu",
+		}
 
-	p := execForProfile(t, &prog, prog.cpuProfile)
-	assertSamples(t, expectedTypes, expectedSamples, p)
+		p := execForProfile(t, &prog, prog.cpuProfile)
+		assertSamples(t, expectedTypes, expectedSamples, p)
+	})
 }
 
 func testMemoryProfiler(t *testing.T, prog program, expectedSamples []sample) {
-	prog.sampleRate = 1
-	prog.memProfile = filepath.Join(t.TempDir(), "mem.pprof")
+	forEachEngine(t, prog, func(t *testing.T, prog program) {
+		prog.sampleRate = 1
+		prog.memProfile = filepath.Join(t.TempDir(), "mem.pprof")
 
-	expectedTypes := []string{
-		"alloc_objects",
-		"alloc_space",
-	}
+		expectedTypes := []string{
+			"alloc_objects",
+			"alloc_space",
+		}
 
-	p := execForProfile(t, &prog, prog.memProfile)
-	assertSamples(t, expectedTypes, expectedSamples, p)
+		p := execForProfile(t, &prog, prog.memProfile)
+		assertSamples(t, expectedTypes, expectedSamples, p)
+	})
+}
+
+// forEachEngine runs test with the wazero compiler and interpreter, the stacks
+// and source locations of the profiles must be the same with both.
+func forEachEngine(t *testing.T, prog program, test func(*testing.T, program)) {
+	for _, interpreter := range []bool{false, true} {
+		name := "compiler"
+		if interpreter {
+			name = "interpreter"
+		}
+		prog.interpreter = interpreter
+		t.Run(name, func(t *testing.T) { test(t, prog) })
+	}
 }
 
 func execForProfile(t *testing.T, prog *program, out string) *profile.Profile {
@@ -355,3 +377,306 @@ func printSamples(samples []*profile.Sample) {
 	}
 }
 */
+
+func TestGoGoroutineLabels(t *testing.T) {
+	prog := program{filePath: "../../testdata/go/twocalls.wasm", sampleRate: 1}
+	prog.cpuProfile = filepath.Join(t.TempDir(), "cpu.pprof")
+
+	p := execForProfile(t, &prog, prog.cpuProfile)
+	if len(p.Sample) == 0 {
+		t.Fatal("no samples in profile")
+	}
+
+	// main.main runs on the main goroutine, which always has id 1. Samples
+	// recorded on the system stack before the scheduler starts do not belong
+	// to any goroutine.
+	found := false
+	for _, sample := range p.Sample {
+		for _, loc := range sample.Location {
+			if loc.Line[len(loc.Line)-1].Function.Name != "main.main" {
+				continue
+			}
+			found = true
+			if !slices.Equal(sample.Label["goroutine"], []string{"1"}) {
+				t.Errorf("wrong goroutine label: %v", sample.Label)
+			}
+			break
+		}
+	}
+	if !found {
+		t.Error("no samples in main.main")
+	}
+}
+
+func TestGoPGO(t *testing.T) {
+	dir := t.TempDir()
+	fs := flag.NewFlagSet("run", flag.ContinueOnError)
+	opts := new(options)
+	opts.register(fs)
+	if err := fs.Parse([]string{"-sample", "1", "-pgo", dir}); err != nil {
+		t.Fatal(err)
+	}
+	prog, err := opts.program(fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(dir, "default.pgo"); prog.pgoProfile != want {
+		t.Fatalf("wrong pgo profile path: want %s, got %s", want, prog.pgoProfile)
+	}
+	prog.filePath = "../../testdata/go/twocalls.wasm"
+
+	p := execForProfile(t, prog, prog.pgoProfile)
+	// go build -pgo weighs the call edges with the first sample value of
+	// this type, and matches them to call sites by their line relative to
+	// the start of the calling function.
+	if st := p.SampleType[0]; st.Type != "samples" || st.Unit != "count" {
+		t.Errorf("wrong sample type: %s/%s", st.Type, st.Unit)
+	}
+	startLines := map[string]int64{
+		"main.main":         21,
+		"main.intermediate": 17,
+		"main.myalloc1":     4,
+	}
+	for _, fn := range p.Function {
+		if line, ok := startLines[fn.Name]; ok {
+			if fn.StartLine != line {
+				t.Errorf("%s: wrong start line: want %d, got %d", fn.Name, line, fn.StartLine)
+			}
+			delete(startLines, fn.Name)
+		}
+	}
+	for name := range startLines {
+		t.Errorf("%s: missing function", name)
+	}
+}
+
+func TestDurationTerminate(t *testing.T) {
+	p := program{
+		filePath:     "../../testdata/c/crunch_numbers.wasm",
+		sampleRate:   1,
+		keepProfiles: true,
+		duration:     100 * time.Millisecond,
+		terminate:    true,
+	}
+	start := time.Now()
+	if err := p.run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("guest was not terminated after %s", elapsed)
+	}
+	if p.cpuProf == nil || len(p.cpuProf.Sample) == 0 {
+		t.Error("missing samples in the CPU profile")
+	}
+}
+
+func TestOutputDir(t *testing.T) {
+	dir := t.TempDir()
+	p := program{
+		filePath:   "../../testdata/c/crunch_numbers.wasm",
+		sampleRate: 1,
+		outputDir:  dir,
+		sinkPeriod: 100 * time.Millisecond,
+		keep:       2,
+		duration:   time.Second,
+		terminate:  true,
+	}
+	if err := p.run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for _, pattern := range []string{"cpu-*.pprof", "memory-*.pprof"} {
+		matches, _ := filepath.Glob(filepath.Join(dir, pattern))
+		if len(matches) != 2 {
+			t.Errorf("%s: want 2 profiles, got %q", pattern, matches)
+		}
+	}
+}
+
+func TestHostProfiles(t *testing.T) {
+	dir := t.TempDir()
+	p := program{
+		filePath:   "../../testdata/c/crunch_numbers.wasm",
+		sampleRate: 1,
+		blockProf:  filepath.Join(dir, "block.pprof"),
+		mutexProf:  filepath.Join(dir, "mutex.pprof"),
+		goroutProf: filepath.Join(dir, "goroutine.pprof"),
+		duration:   100 * time.Millisecond,
+		terminate:  true,
+	}
+	if err := p.run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for path, sampleType := range map[string]string{
+		p.blockProf:  "contentions",
+		p.mutexProf:  "contentions",
+		p.goroutProf: "goroutine",
+	} {
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		prof, err := profile.Parse(f)
+		f.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		if prof.SampleType[0].Type != sampleType {
+			t.Errorf("%s: wrong sample type: want %q, got %q", path, sampleType, prof.SampleType[0].Type)
+		}
+	}
+}
+
+func TestCompilationCache(t *testing.T) {
+	dir := t.TempDir()
+	samples := make([]int, 2)
+	for i := range samples {
+		p := program{
+			filePath:     "../../testdata/c/simple.wasm",
+			sampleRate:   1,
+			keepProfiles: true,
+			cacheDir:     dir,
+		}
+		if err := p.run(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		samples[i] = len(p.memProf.Sample)
+	}
+	if samples[0] == 0 || samples[0] != samples[1] {
+		t.Errorf("memory samples differ with the cached module: %v", samples)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) == 0 {
+		t.Error("compiled module not cached")
+	}
+}
+
+func TestOptionsProgram(t *testing.T) {
+	parse := func(args ...string) (*program, error) {
+		fs := flag.NewFlagSet("run", flag.ContinueOnError)
+		opts := new(options)
+		opts.register(fs)
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		return opts.program(fs)
+	}
+
+	prog, err := parse("-sample", "1", "-cpuprofile", "/tmp/cpu.pprof", "-module", "a.wasm", "-module", "b.wasm", "-labels", "a:1,b:2",
+		"-blockprofile", "/tmp/block.pprof", "-mutexprofile", "/tmp/mutex.pprof", "-goroutineprofile", "/tmp/goroutine.pprof",
+		"-listen", "127.0.0.1:8000", "-listen", "[::1]:8001", "-env", "A=1", "-env", "B=2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prog.sampleRate != 1 || prog.cpuProfile != "/tmp/cpu.pprof" {
+		t.Errorf("wrong options: %+v", prog)
+	}
+	if prog.blockProf != "/tmp/block.pprof" || prog.mutexProf != "/tmp/mutex.pprof" || prog.goroutProf != "/tmp/goroutine.pprof" {
+		t.Errorf("wrong host profile options: %q %q %q", prog.blockProf, prog.mutexProf, prog.goroutProf)
+	}
+	if !slices.Equal(prog.modules, []string{"a.wasm", "b.wasm"}) || !slices.Equal(prog.labels, []string{"a:1", "b:2"}) {
+		t.Errorf("wrong repeated options: %q %q", prog.modules, prog.labels)
+	}
+	if !slices.Equal(prog.listen, []string{"127.0.0.1:8000", "[::1]:8001"}) {
+		t.Errorf("wrong listen addresses: %q", prog.listen)
+	}
+	if !slices.Equal(prog.env, []string{"A=1", "B=2"}) {
+		t.Errorf("wrong environment: %q", prog.env)
+	}
+
+	for _, args := range [][]string{
+		{"-format", "svg"},
+		{"-terminate"},
+		{"-interpreter", "-native-addresses"},
+		{"-pprof-fd", "3", "-pprof-addr", ":8080"},
+		{"-pprof-tls-cert", "cert.pem"},
+		{"-output-dir", "/tmp", "-sink", "/tmp"},
+		{"-pgo", "/tmp", "-sink", "/tmp"},
+		{"-trim-max-stacks", "-1"},
+		{"-trim-min-fraction", "1"},
+		{"-listen", "127.0.0.1:8000", "-listen", "8001"},
+		{"-env", "=1"},
+	} {
+		if _, err := parse(args...); err == nil {
+			t.Errorf("%q: expected an error", args)
+		}
+	}
+}
+
+func TestSplitHostPort(t *testing.T) {
+	tests := []struct {
+		addr string
+		host string
+		port int
+		err  bool
+	}{
+		{addr: "127.0.0.1:8000", host: "127.0.0.1", port: 8000},
+		{addr: "localhost:0", host: "localhost", port: 0},
+		{addr: ":8000", host: "", port: 8000},
+		{addr: "[::1]:8000", host: "[::1]", port: 8000},
+		{addr: "[::]:443", host: "[::]", port: 443},
+		{addr: "8000", err: true},
+		{addr: "::1:8000", err: true},
+		{addr: "localhost", err: true},
+		{addr: "localhost:http", err: true},
+		{addr: "localhost:-1", err: true},
+		{addr: "localhost:65536", err: true},
+		{addr: "", err: true},
+	}
+	for _, test := range tests {
+		host, port, err := splitHostPort(test.addr)
+		if test.err {
+			if err == nil {
+				t.Errorf("%q: expected an error", test.addr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", test.addr, err)
+			continue
+		}
+		if host != test.host || port != test.port {
+			t.Errorf("%q: want %q %d, got %q %d", test.addr, test.host, test.port, host, port)
+		}
+		// The socket configuration of wazero joins them back to listen.
+		if _, _, err := net.SplitHostPort(fmt.Sprintf("%s:%d", host, port)); err != nil {
+			t.Errorf("%q: invalid address once joined: %v", test.addr, err)
+		}
+	}
+}
+
+func TestParseEnv(t *testing.T) {
+	t.Setenv("WZPROF_TEST_HOST", "host value")
+
+	tests := []struct {
+		vars []string
+		env  []string
+		err  bool
+	}{
+		{vars: nil, env: nil},
+		{vars: []string{"A=1", "B=2"}, env: []string{"A=1", "B=2"}},
+		{vars: []string{"A="}, env: []string{"A="}},
+		{vars: []string{"A=x=y"}, env: []string{"A=x=y"}},
+		{vars: []string{"WZPROF_TEST_HOST"}, env: []string{"WZPROF_TEST_HOST=host value"}},
+		{vars: []string{"WZPROF_TEST_UNSET"}, env: []string{"WZPROF_TEST_UNSET="}},
+		{vars: []string{"A=1", "B=2", "A=3"}, env: []string{"A=3", "B=2"}},
+		{vars: []string{"=1"}, err: true},
+		{vars: []string{"A=1", ""}, err: true},
+	}
+	for _, test := range tests {
+		env, err := parseEnv(test.vars)
+		if test.err {
+			if err == nil {
+				t.Errorf("%q: expected an error", test.vars)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", test.vars, err)
+		} else if !slices.Equal(env, test.env) {
+			t.Errorf("%q: want %q, got %q", test.vars, test.env, env)
+		}
+	}
+}
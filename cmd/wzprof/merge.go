@@ -0,0 +1,43 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/google/pprof/profile"
+
+	"github.com/stealthrocket/wzprof"
+)
+
+// runMerge implements "wzprof merge -o merged.pprof profiles...", which merges
+// profiles of the same type, e.g. collected from a fleet of hosts or written
+// by -output-dir, so they can be analyzed together.
+func runMerge(args []string) error {
+	flags := flag.NewFlagSet("merge", flag.ContinueOnError)
+	output := flags.String("o", "", "Write the merged profile to the specified file.")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *output == "" || flags.NArg() == 0 {
+		return fmt.Errorf("usage: wzprof merge -o <merged.pprof> <profiles.pprof...>")
+	}
+
+	profiles := make([]*profile.Profile, flags.NArg())
+	for i, path := range flags.Args() {
+		prof, err := readProfile(path)
+		if err != nil {
+			return fmt.Errorf("merge: %w", err)
+		}
+		profiles[i] = prof
+	}
+
+	merged, err := wzprof.MergeProfiles(profiles)
+	if err != nil {
+		return fmt.Errorf("merge: %w", err)
+	}
+	stdout.Printf("writing merged profile of %d profiles to %s", len(profiles), *output)
+	if err := wzprof.WriteProfile(*output, merged); err != nil {
+		return fmt.Errorf("merge: %w", err)
+	}
+	return nil
+}
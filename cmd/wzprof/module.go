@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// isURL returns true if the module path is a http:// or https:// URL.
+func isURL(path string) bool {
+	return strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://")
+}
+
+// readModule reads the wasm module at path, which is a local file, "-" for the
+// standard input, a http:// or https:// URL, or a reference to an artifact of
+// an OCI registry (oci://registry/repository:tag).
+func readModule(ctx context.Context, path string) ([]byte, error) {
+	switch {
+	case path == "-":
+		return io.ReadAll(os.Stdin)
+	case isURL(path):
+		return download(ctx, path)
+	case strings.HasPrefix(path, "oci://"):
+		return pullOCI(ctx, path)
+	}
+	return mapModule(path)
+}
+
+// moduleFileName returns the file name of the wasm module at path, which the
+// guest receives as first argument.
+func moduleFileName(modulePath string) string {
+	switch {
+	case modulePath == "-":
+		return "stdin.wasm"
+	case strings.HasPrefix(modulePath, "oci://"):
+		return ociFileName(modulePath)
+	case isURL(modulePath):
+		if u, err := url.Parse(modulePath); err == nil && path.Base(u.Path) != "/" {
+			return path.Base(u.Path)
+		}
+	}
+	return filepath.Base(modulePath)
+}
+
+func download(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", url, res.Status)
+	}
+	return io.ReadAll(res.Body)
+}
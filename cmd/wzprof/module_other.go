@@ -0,0 +1,11 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// mapModule reads the module file at path, files are not mapped to memory on
+// this platform.
+func mapModule(path string) ([]byte, error) {
+	return os.ReadFile(path)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestModuleFileName(t *testing.T) {
+	for path, want := range map[string]string{
+		"-":                                "stdin.wasm",
+		"../app.wasm":                      "app.wasm",
+		"https://example.com/a/app.wasm?x": "app.wasm",
+	} {
+		if name := moduleFileName(path); name != want {
+			t.Errorf("%s: want %q, got %q", path, want, name)
+		}
+	}
+}
+
+func TestReadModuleURL(t *testing.T) {
+	server := httptest.NewServer(http.FileServer(http.Dir("../../testdata/c")))
+	defer server.Close()
+
+	dir := t.TempDir()
+	p := program{
+		filePath:   server.URL + "/simple.wasm",
+		memProfile: filepath.Join(dir, "mem.pprof"),
+		sampleRate: 1,
+	}
+	if err := p.run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(p.memProfile); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := readModule(context.Background(), server.URL+"/missing.wasm"); err == nil {
+		t.Error("no error for missing module")
+	}
+}
+
+func TestReadModuleFile(t *testing.T) {
+	want, err := os.ReadFile("../../testdata/c/simple.wasm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := readModule(context.Background(), "../../testdata/c/simple.wasm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, want) {
+		t.Error("wrong module contents")
+	}
+
+	// Empty files cannot be mapped, they are read.
+	empty := filepath.Join(t.TempDir(), "empty.wasm")
+	if err := os.WriteFile(empty, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := readModule(context.Background(), empty); err != nil || len(b) != 0 {
+		t.Errorf("wrong contents of empty module: %q (%v)", b, err)
+	}
+
+	if _, err := readModule(context.Background(), filepath.Join(t.TempDir(), "missing.wasm")); !os.IsNotExist(err) {
+		t.Errorf("want not exist error, got %v", err)
+	}
+}
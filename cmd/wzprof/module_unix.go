@@ -0,0 +1,36 @@
+//go:build unix
+
+package main
+
+import (
+	"io"
+	"os"
+	"syscall"
+)
+
+// mapModule maps the module file at path to memory, so the CLI does not hold
+// a copy of large modules in addition to the one of the page cache. The
+// mapping is read-only and lives until the program exits, like the module.
+//
+// Files which cannot be mapped (e.g. pipes) are read instead.
+func mapModule(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := info.Size()
+	if !info.Mode().IsRegular() || size == 0 || int64(int(size)) != size {
+		return io.ReadAll(f)
+	}
+	b, err := syscall.Mmap(int(f.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_PRIVATE)
+	if err != nil {
+		return io.ReadAll(f)
+	}
+	return b, nil
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Media types of the layers holding wasm modules, as produced by wasm-to-oci
+// and by the tools building images for the containerd wasm shims.
+var ociWasmLayerTypes = []string{
+	"application/vnd.wasm.content.layer.v1+wasm",
+	"application/vnd.module.wasm.content.layer.v1+wasm",
+}
+
+const (
+	ociManifestType        = "application/vnd.oci.image.manifest.v1+json"
+	ociIndexType           = "application/vnd.oci.image.index.v1+json"
+	dockerManifestType     = "application/vnd.docker.distribution.manifest.v2+json"
+	dockerManifestListType = "application/vnd.docker.distribution.manifest.list.v2+json"
+)
+
+// ociReference is a reference to an artifact of an OCI registry, in the
+// oci://registry/repository[:tag|@digest] form.
+type ociReference struct {
+	registry   string
+	repository string
+	reference  string // tag or digest
+}
+
+func parseOCIReference(ref string) (ociReference, error) {
+	s, ok := strings.CutPrefix(ref, "oci://")
+	if !ok {
+		return ociReference{}, fmt.Errorf("invalid OCI reference %q - must start with oci://", ref)
+	}
+	registry, repository, _ := strings.Cut(s, "/")
+	r := ociReference{registry: registry, repository: repository, reference: "latest"}
+	if name, digest, ok := strings.Cut(repository, "@"); ok {
+		r.repository, r.reference = name, digest
+	} else if i := strings.LastIndexByte(repository, ':'); i >= 0 {
+		r.repository, r.reference = repository[:i], repository[i+1:]
+	}
+	if r.registry == "" || r.repository == "" || r.reference == "" {
+		return ociReference{}, fmt.Errorf("invalid OCI reference %q - must be oci://registry/repository:tag", ref)
+	}
+	return r, nil
+}
+
+// ociClient pulls artifacts from the registry API (v2) of a registry.
+type ociClient struct {
+	ref   ociReference
+	base  string
+	auth  string // basic credentials from the docker configuration
+	token string // bearer token returned by the authorization service
+}
+
+// pullOCI returns the wasm module of the artifact at ref. Registries on the
+// loopback interface are accessed over HTTP, the others over HTTPS with the
+// credentials of the docker configuration, if any.
+func pullOCI(ctx context.Context, ref string) ([]byte, error) {
+	r, err := parseOCIReference(ref)
+	if err != nil {
+		return nil, err
+	}
+	c := &ociClient{ref: r, base: "https://" + r.registry, auth: dockerAuth(r.registry)}
+	if isLoopback(r.registry) {
+		c.base = "http://" + r.registry
+	}
+
+	digest := r.reference
+	mediaType := ""
+	var manifest struct {
+		MediaType string `json:"mediaType"`
+		Layers    []struct {
+			MediaType string `json:"mediaType"`
+			Digest    string `json:"digest"`
+		} `json:"layers"`
+		Manifests []struct {
+			MediaType string `json:"mediaType"`
+			Digest    string `json:"digest"`
+			Platform  struct {
+				OS           string `json:"os"`
+				Architecture string `json:"architecture"`
+			} `json:"platform"`
+		} `json:"manifests"`
+	}
+	// Indexes list the manifests of the platforms, the one of wasm is
+	// selected, or the first one if there is none.
+	for i := 0; i < 2; i++ {
+		b, err := c.get(ctx, "manifests/"+digest, mediaType)
+		if err != nil {
+			return nil, err
+		}
+		manifest.Manifests, manifest.Layers = nil, nil
+		if err := json.Unmarshal(b, &manifest); err != nil {
+			return nil, fmt.Errorf("%s: invalid manifest: %w", ref, err)
+		}
+		if len(manifest.Manifests) == 0 {
+			break
+		}
+		m := manifest.Manifests[0]
+		for _, p := range manifest.Manifests {
+			if p.Platform.Architecture == "wasm" {
+				m = p
+				break
+			}
+		}
+		digest, mediaType = m.Digest, m.MediaType
+	}
+
+	for _, layer := range manifest.Layers {
+		for _, t := range ociWasmLayerTypes {
+			if layer.MediaType == t {
+				return c.blob(ctx, layer.Digest)
+			}
+		}
+	}
+	// Artifacts pushed by some tools have a single layer with a generic
+	// media type.
+	if len(manifest.Layers) == 1 {
+		return c.blob(ctx, manifest.Layers[0].Digest)
+	}
+	return nil, fmt.Errorf("%s: no wasm layer found in the manifest", ref)
+}
+
+func (c *ociClient) blob(ctx context.Context, digest string) ([]byte, error) {
+	b, err := c.get(ctx, "blobs/"+digest, "")
+	if err != nil {
+		return nil, err
+	}
+	if hash, ok := strings.CutPrefix(digest, "sha256:"); ok {
+		if sum := sha256.Sum256(b); hex.EncodeToString(sum[:]) != hash {
+			return nil, fmt.Errorf("blob %s: digest mismatch", digest)
+		}
+	}
+	return b, nil
+}
+
+// get returns the content of a path under the repository, authenticating with
+// the authorization service of the registry when challenged to.
+func (c *ociClient) get(ctx context.Context, p, accept string) ([]byte, error) {
+	u := c.base + "/v2/" + c.ref.repository + "/" + p
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+		if err != nil {
+			return nil, err
+		}
+		if accept == "" {
+			accept = strings.Join([]string{ociManifestType, ociIndexType, dockerManifestType, dockerManifestListType}, ", ")
+		}
+		req.Header.Set("Accept", accept)
+		switch {
+		case c.token != "":
+			req.Header.Set("Authorization", "Bearer "+c.token)
+		case c.auth != "":
+			req.Header.Set("Authorization", "Basic "+c.auth)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		b, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if res.StatusCode == http.StatusUnauthorized && attempt == 0 {
+			if err := c.authorize(ctx, res.Header.Get("WWW-Authenticate")); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if res.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("GET %s: %s", u, res.Status)
+		}
+		return b, nil
+	}
+}
+
+// authorize requests a bearer token from the authorization service of the
+// challenge returned by the registry.
+func (c *ociClient) authorize(ctx context.Context, challenge string) error {
+	scheme, params, _ := strings.Cut(challenge, " ")
+	if !strings.EqualFold(scheme, "Bearer") {
+		return fmt.Errorf("unsupported registry authentication: %q", challenge)
+	}
+	values := make(map[string]string)
+	for _, param := range strings.Split(params, ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(param), "=")
+		values[k] = strings.Trim(v, `"`)
+	}
+	if values["realm"] == "" {
+		return fmt.Errorf("missing realm in registry authentication: %q", challenge)
+	}
+	u, err := url.Parse(values["realm"])
+	if err != nil {
+		return err
+	}
+	q := u.Query()
+	if values["service"] != "" {
+		q.Set("service", values["service"])
+	}
+	scope := values["scope"]
+	if scope == "" {
+		scope = "repository:" + c.ref.repository + ":pull"
+	}
+	q.Set("scope", scope)
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	if c.auth != "" {
+		req.Header.Set("Authorization", "Basic "+c.auth)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", u.Redacted(), res.Status)
+	}
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&token); err != nil {
+		return fmt.Errorf("invalid registry token: %w", err)
+	}
+	c.token = token.Token
+	if c.token == "" {
+		c.token = token.AccessToken
+	}
+	return nil
+}
+
+// dockerAuth returns the base64 encoded credentials of the registry in the
+// docker configuration, or an empty string if there are none. Credential
+// helpers are not supported.
+func dockerAuth(registry string) string {
+	dir := os.Getenv("DOCKER_CONFIG")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		dir = filepath.Join(home, ".docker")
+	}
+	b, err := os.ReadFile(filepath.Join(dir, "config.json"))
+	if err != nil {
+		return ""
+	}
+	var config struct {
+		Auths map[string]struct {
+			Auth string `json:"auth"`
+		} `json:"auths"`
+	}
+	if json.Unmarshal(b, &config) != nil {
+		return ""
+	}
+	for _, key := range []string{registry, "https://" + registry, "https://" + registry + "/v1/"} {
+		if auth := config.Auths[key].Auth; auth != "" {
+			if _, err := base64.StdEncoding.DecodeString(auth); err == nil {
+				return auth
+			}
+		}
+	}
+	return ""
+}
+
+func isLoopback(registry string) bool {
+	host, _, err := net.SplitHostPort(registry)
+	if err != nil {
+		host = registry
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// ociFileName returns the file name of the module of an OCI reference, named
+// after the repository.
+func ociFileName(ref string) string {
+	r, err := parseOCIReference(ref)
+	if err != nil {
+		return "module.wasm"
+	}
+	return path.Base(r.repository) + ".wasm"
+}
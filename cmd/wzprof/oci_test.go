@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestParseOCIReference(t *testing.T) {
+	for ref, want := range map[string]ociReference{
+		"oci://ghcr.io/org/app:v1":        {"ghcr.io", "org/app", "v1"},
+		"oci://localhost:5000/app":        {"localhost:5000", "app", "latest"},
+		"oci://ghcr.io/app@sha256:abcdef": {"ghcr.io", "app", "sha256:abcdef"},
+	} {
+		r, err := parseOCIReference(ref)
+		if err != nil {
+			t.Errorf("%s: %v", ref, err)
+		} else if r != want {
+			t.Errorf("%s: want %+v, got %+v", ref, want, r)
+		}
+	}
+	for _, ref := range []string{"ghcr.io/app", "oci://ghcr.io", "oci://ghcr.io/app:"} {
+		if _, err := parseOCIReference(ref); err == nil {
+			t.Errorf("%s: no error", ref)
+		}
+	}
+}
+
+func TestPullOCI(t *testing.T) {
+	wasm, err := os.ReadFile("../../testdata/c/simple.wasm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(wasm)
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("scope") != "repository:org/app:pull" {
+			http.Error(w, "wrong scope", http.StatusForbidden)
+			return
+		}
+		fmt.Fprint(w, `{"token":"secret"}`)
+	})
+	mux.HandleFunc("/v2/org/app/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+server.URL+`/token",service="test"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch strings.TrimPrefix(r.URL.Path, "/v2/org/app/") {
+		case "manifests/v1":
+			fmt.Fprintf(w, `{"mediaType":%q,"manifests":[
+				{"mediaType":%q,"digest":"sha256:amd64","platform":{"os":"linux","architecture":"amd64"}},
+				{"mediaType":%q,"digest":"sha256:wasm","platform":{"os":"wasip1","architecture":"wasm"}}
+			]}`, ociIndexType, ociManifestType, ociManifestType)
+		case "manifests/sha256:wasm":
+			fmt.Fprintf(w, `{"mediaType":%q,"layers":[
+				{"mediaType":"application/vnd.oci.image.layer.v1.tar","digest":"sha256:other"},
+				{"mediaType":%q,"digest":%q}
+			]}`, ociManifestType, ociWasmLayerTypes[1], digest)
+		case "blobs/" + digest:
+			w.Write(wasm)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+
+	ref := "oci://" + strings.TrimPrefix(server.URL, "http://") + "/org/app:v1"
+	b, err := pullOCI(context.Background(), ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != string(wasm) {
+		t.Error("wrong module content")
+	}
+	if name := moduleFileName(ref); name != "app.wasm" {
+		t.Errorf("wrong module file name: %q", name)
+	}
+	if _, err := pullOCI(context.Background(), strings.TrimSuffix(ref, "v1")+"v2"); err == nil {
+		t.Error("no error for missing tag")
+	}
+}
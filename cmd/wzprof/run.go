@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/exp/slices"
+
+	"github.com/stealthrocket/wzprof"
+)
+
+// runModules implements "wzprof run [flags] a.wasm b.wasm -- args...", which
+// runs multiple modules concurrently, each with its own profilers, and exposes
+// all their profiles on the same pprof address. The modules default to the ones
+// set with -module, e.g. in the configuration file.
+//
+// The profiles of each module are written to the paths of the flags with the
+// name of the module as suffix, e.g. cpu.a.pprof and cpu.b.pprof, and its pprof
+// endpoint is served under its name, e.g. /a/debug/pprof/. A single module
+// runs like without the run command.
+func runModules(ctx context.Context, base *program, args []string) error {
+	paths, guestArgs := args, []string(nil)
+	if i := slices.Index(args, "--"); i >= 0 {
+		paths, guestArgs = args[:i], args[i+1:]
+	}
+	if len(paths) == 0 {
+		paths = base.modules
+	}
+	if len(paths) == 0 {
+		return fmt.Errorf("usage: wzprof run <a.wasm> [b.wasm...] [-- args...]")
+	}
+	if len(paths) == 1 {
+		prog := *base
+		prog.filePath, prog.args = paths[0], guestArgs
+		return prog.run(ctx)
+	}
+	if base.hostProfile {
+		return fmt.Errorf("run: -host is not supported with multiple modules")
+	}
+	if len(base.listen) > 0 {
+		return fmt.Errorf("run: -listen is not supported with multiple modules")
+	}
+
+	if base.pprofAddr != "" {
+		base.mux = http.NewServeMux()
+		closeServer, err := base.servePprof(base.mux)
+		if err != nil {
+			return fmt.Errorf("run: %w", err)
+		}
+		defer closeServer()
+	}
+	if base.format == "perf" {
+		base.perfMap = wzprof.NewPerfMap(os.Getpid())
+	}
+
+	names := moduleNames(paths)
+	errs := make([]error, len(paths))
+	var wg sync.WaitGroup
+	for i, path := range paths {
+		prog := *base
+		name := names[i]
+		prog.filePath = path
+		prog.args = guestArgs
+		// The modules would compete for the standard input.
+		prog.stdin = strings.NewReader("")
+		prog.cpuProfile = variantPath(prog.cpuProfile, name)
+		prog.memProfile = variantPath(prog.memProfile, name)
+		prog.traceFile = variantPath(prog.traceFile, name)
+		prog.funcTrace = variantPath(prog.funcTrace, name)
+		prog.accessProf = variantPath(prog.accessProf, name)
+		if prog.outputDir != "" {
+			prog.outputDir = filepath.Join(prog.outputDir, name)
+		}
+		if prog.sink != "" {
+			prog.sink = strings.TrimSuffix(prog.sink, "/") + "/" + name
+		}
+		prog.pprofPrefix = "/" + name
+		if prog.pprofAddr != "" {
+			stdout.Printf("serving pprof endpoint of module %s at path %s/debug/pprof", path, prog.pprofPrefix)
+		}
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := prog.run(ctx); err != nil {
+				errs[i] = fmt.Errorf("run: %s: %w", paths[i], err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// moduleNames returns the names of the modules at paths, which are the base
+// names of their files without extension, with a numeric suffix for the ones
+// which would otherwise have the same name.
+func moduleNames(paths []string) []string {
+	names := make([]string, len(paths))
+	count := make(map[string]int)
+	for i, path := range paths {
+		name := moduleFileName(path)
+		name = strings.TrimSuffix(name, filepath.Ext(name))
+		count[name]++
+		if n := count[name]; n > 1 {
+			name = fmt.Sprintf("%s.%d", name, n)
+		}
+		names[i] = name
+	}
+	return names
+}
+
+// Address of the pprof endpoint of the serve command when -pprof-addr is not
+// set.
+const defaultServeAddr = ":8080"
+
+// runServe implements "wzprof serve [flags] app.wasm [args...]", which runs a
+// module like without a command, exposing its profiles on the pprof endpoint
+// (:8080 unless -pprof-addr is set), and keeps serving them after the guest
+// exited until interrupted, e.g. to collect the final memory profiles.
+func runServe(ctx context.Context, prog *program, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: wzprof serve [flags] <app.wasm> [args...]")
+	}
+	if prog.pprofAddr == "" {
+		prog.pprofAddr = defaultServeAddr
+	}
+	prog.filePath, prog.args = args[0], args[1:]
+	prog.keepServing = true
+	return prog.run(ctx)
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/exp/slices"
+)
+
+func TestModuleNames(t *testing.T) {
+	names := moduleNames([]string{"a.wasm", "dir/b.wasm", "other/a.wasm", "c"})
+	if want := []string{"a", "b", "a.2", "c"}; !slices.Equal(names, want) {
+		t.Errorf("want %q, got %q", want, names)
+	}
+}
+
+func TestRunModules(t *testing.T) {
+	dir := t.TempDir()
+	prog := &program{
+		memProfile: filepath.Join(dir, "mem.pprof"),
+		sampleRate: 1,
+	}
+	err := runModules(context.Background(), prog, []string{
+		"../../testdata/c/simple.wasm",
+		"../../testdata/c/bench.wasm",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"mem.simple.pprof", "mem.bench.pprof"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Error(err)
+		}
+	}
+}
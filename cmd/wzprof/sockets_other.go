@@ -0,0 +1,23 @@
+//go:build !unix
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+
+	"github.com/tetratelabs/wazero"
+)
+
+// socketsExtension returns nil, the host module of WASI with the sockets
+// extensions is not available on this platform.
+func socketsExtension(wazero.CompiledModule) map[string]struct{} {
+	return nil
+}
+
+// instantiateWASISockets returns an error, the host module of WASI with the
+// sockets extensions is not available on this platform.
+func instantiateWASISockets(ctx context.Context, _ wazero.Runtime, _ *program, _ wazero.CompiledModule, _ string, _ []string) (context.Context, func(context.Context) error, error) {
+	return ctx, nil, fmt.Errorf("the sockets extensions of WASI are not supported on GOOS=%s", runtime.GOOS)
+}
@@ -0,0 +1,74 @@
+//go:build unix
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/tetratelabs/wazero"
+)
+
+// wasmSockOpen is a module exiting with the error number returned by the
+// sock_open function of the sockets extension of WasmEdge, for a TCP socket.
+var wasmSockOpen = []byte{
+	0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00,
+	// type section: (i32, i32, i32) -> i32, (i32) -> (), () -> ()
+	1, 15, 3,
+	0x60, 3, 0x7f, 0x7f, 0x7f, 1, 0x7f,
+	0x60, 1, 0x7f, 0,
+	0x60, 0, 0,
+	// import section: sock_open and proc_exit
+	2, 71, 2,
+	22, 'w', 'a', 's', 'i', '_', 's', 'n', 'a', 'p', 's', 'h', 'o', 't', '_', 'p', 'r', 'e', 'v', 'i', 'e', 'w', '1',
+	9, 's', 'o', 'c', 'k', '_', 'o', 'p', 'e', 'n', 0x00, 0,
+	22, 'w', 'a', 's', 'i', '_', 's', 'n', 'a', 'p', 's', 'h', 'o', 't', '_', 'p', 'r', 'e', 'v', 'i', 'e', 'w', '1',
+	9, 'p', 'r', 'o', 'c', '_', 'e', 'x', 'i', 't', 0x00, 1,
+	// function section: _start
+	3, 2, 1, 2,
+	// memory section: 1 page
+	5, 3, 1, 0x00, 1,
+	// export section: memory and _start
+	7, 19, 2,
+	6, 'm', 'e', 'm', 'o', 'r', 'y', 0x02, 0,
+	6, '_', 's', 't', 'a', 'r', 't', 0x00, 2,
+	// code section: proc_exit(sock_open(inet, stream, 0))
+	10, 14, 1, 12, 0,
+	0x41, 1, 0x41, 2, 0x41, 0, 0x10, 0, 0x10, 1, 0x0b,
+}
+
+func TestWASISocketsExtension(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sock_open.wasm")
+	if err := os.WriteFile(path, wasmSockOpen, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	p := program{filePath: path, sampleRate: 1}
+	if err := p.run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckWASIImportsSocketsExtension(t *testing.T) {
+	ctx := context.Background()
+	r := wazero.NewRuntime(ctx)
+	defer r.Close(ctx)
+
+	mod, err := r.CompileModule(ctx, wasmImports("sock_open", "sched_yield", "sock_connect"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkWASIImports(ctx, r, mod); err != nil {
+		t.Errorf("functions of the sockets extension reported missing: %v", err)
+	}
+
+	mod, err = r.CompileModule(ctx, wasmImports("sock_open", "sock_frobnicate"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkWASIImports(ctx, r, mod); err == nil || !strings.Contains(err.Error(), ": sock_frobnicate ") {
+		t.Errorf("wrong error: %v", err)
+	}
+}
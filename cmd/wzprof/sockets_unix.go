@@ -0,0 +1,56 @@
+//go:build unix
+
+package main
+
+import (
+	"context"
+	"os"
+
+	"github.com/stealthrocket/wasi-go/imports"
+	"github.com/tetratelabs/wazero"
+)
+
+// socketsExtension returns the names of the functions of the sockets
+// extension of WASI preview 1 that the guest imports functions of, like the
+// sock_open and sock_connect functions of the extensions of WasmEdge, or nil
+// if the guest only uses the functions of WASI preview 1. wazero only
+// implements the socket functions of WASI preview 1 (sock_accept, sock_recv,
+// sock_send, and sock_shutdown), which serve the listeners pre-opened with
+// -listen; the guests importing an extension are run with the host module of
+// wasi-go instead.
+func socketsExtension(mod wazero.CompiledModule) map[string]struct{} {
+	ext := imports.DetectSocketsExtension(mod)
+	if ext == nil {
+		return nil
+	}
+	names := make(map[string]struct{}, len(*ext))
+	for name := range *ext {
+		names[name] = struct{}{}
+	}
+	return names
+}
+
+// instantiateWASISockets instantiates the host module of WASI preview 1 with
+// the sockets extension imported by the guest (see socketsExtension), in
+// place of the one of wazero. The host module of wasi-go owns the file
+// descriptors of the guest, so it is configured with the arguments,
+// environment, mounts and listeners of the program instead of the module
+// config. The returned function releases the resources of the host module
+// once the guest exited.
+func instantiateWASISockets(ctx context.Context, runtime wazero.Runtime, prog *program, mod wazero.CompiledModule, name string, args []string) (context.Context, func(context.Context) error, error) {
+	builder := imports.NewBuilder().
+		WithName(name).
+		WithArgs(args...).
+		WithEnv(prog.env...).
+		WithDirs(prog.mounts...).
+		WithListens(prog.listen...).
+		WithSocketsExtension("auto", mod)
+	if f, ok := prog.stdin.(*os.File); ok {
+		builder = builder.WithStdio(int(f.Fd()), int(os.Stdout.Fd()), int(os.Stderr.Fd()))
+	}
+	ctx, system, err := builder.Instantiate(ctx, runtime)
+	if err != nil {
+		return ctx, nil, err
+	}
+	return ctx, system.Close, nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+
+	"github.com/google/pprof/profile"
+
+	"github.com/stealthrocket/wzprof"
+)
+
+// runSummary describes a run of the guest for the report printed by -summary.
+type runSummary struct {
+	duration time.Duration
+	cpu      *profile.Profile
+	mem      *profile.Profile
+	// Zero when the memory in use is not tracked.
+	peakInuse int64
+	metrics   wzprof.Metrics
+	top       int
+}
+
+// writeSummary writes a human-readable report of a run of the guest: the time
+// spent in guest functions, the memory allocated, the activity of the
+// profilers, and the functions with the highest self time.
+func writeSummary(w io.Writer, s runSummary) error {
+	fmt.Fprintln(w, "summary:")
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "  duration\t%s\n", s.duration.Round(time.Microsecond))
+	if s.cpu != nil {
+		fmt.Fprintf(tw, "  guest cpu time\t%s in %d calls\n",
+			time.Duration(sampleTotal(s.cpu, "cpu")), sampleTotal(s.cpu, "samples"))
+	}
+	if s.mem != nil {
+		fmt.Fprintf(tw, "  allocations\t%d objects, %s\n",
+			sampleTotal(s.mem, "alloc_objects"), formatValue(sampleTotal(s.mem, "alloc_space"), "bytes"))
+		peak := "unknown (see -inuse)"
+		if s.peakInuse > 0 {
+			peak = formatValue(s.peakInuse, "bytes")
+		}
+		fmt.Fprintf(tw, "  peak memory in use\t%s\n", peak)
+	}
+	fmt.Fprintf(tw, "  profiler samples\t%d, %d dropped, %d stacks\n",
+		s.metrics.Samples, s.metrics.DroppedSamples, s.metrics.Stacks)
+	overhead := ""
+	if s.duration > 0 {
+		overhead = fmt.Sprintf(" (%.1f%% of the duration)", 100*float64(s.metrics.Overhead)/float64(s.duration))
+	}
+	fmt.Fprintf(tw, "  profiling overhead\t%s%s\n", s.metrics.Overhead.Round(time.Microsecond), overhead)
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	fmt.Fprintln(w)
+
+	if s.cpu == nil || s.top <= 0 {
+		return nil
+	}
+	fmt.Fprintln(w, "top functions by self time:")
+	return writeTop(w, s.cpu, "cpu", s.top)
+}
+
+// sampleTotal returns the sum of the values of a sample type of prof, or zero
+// if prof has no such sample type.
+func sampleTotal(prof *profile.Profile, sampleType string) int64 {
+	for i, t := range prof.SampleType {
+		if t.Type == sampleType {
+			var total int64
+			for _, s := range prof.Sample {
+				total += s.Value[i]
+			}
+			return total
+		}
+	}
+	return 0
+}
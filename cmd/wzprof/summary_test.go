@@ -0,0 +1,77 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/pprof/profile"
+
+	"github.com/stealthrocket/wzprof"
+)
+
+func TestWriteSummary(t *testing.T) {
+	loc := &profile.Location{Line: []profile.Line{{Function: &profile.Function{Name: "main"}}}}
+	cpu := &profile.Profile{
+		SampleType: []*profile.ValueType{
+			{Type: "samples", Unit: "count"},
+			{Type: "cpu", Unit: "nanoseconds"},
+		},
+		Sample: []*profile.Sample{
+			{Value: []int64{3, 1500000}, Location: []*profile.Location{loc}},
+			{Value: []int64{1, 500000}, Location: []*profile.Location{loc}},
+		},
+	}
+	mem := &profile.Profile{
+		SampleType: []*profile.ValueType{
+			{Type: "alloc_objects", Unit: "count"},
+			{Type: "alloc_space", Unit: "bytes"},
+		},
+		Sample: []*profile.Sample{
+			{Value: []int64{4, 4096}, Location: []*profile.Location{loc}},
+		},
+	}
+
+	var b strings.Builder
+	err := writeSummary(&b, runSummary{
+		duration: 10 * time.Millisecond,
+		cpu:      cpu,
+		mem:      mem,
+		metrics: wzprof.Metrics{
+			Samples:        8,
+			Stacks:         2,
+			DroppedSamples: 1,
+			Overhead:       time.Millisecond,
+		},
+		top: 5,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lines []string
+	for _, line := range strings.Split(strings.TrimSpace(b.String()), "\n") {
+		lines = append(lines, strings.Join(strings.Fields(line), " "))
+	}
+	want := []string{
+		"summary:",
+		"duration 10ms",
+		"guest cpu time 2ms in 4 calls",
+		"allocations 4 objects, 4.00KiB",
+		"peak memory in use unknown (see -inuse)",
+		"profiler samples 8, 1 dropped, 2 stacks",
+		"profiling overhead 1ms (10.0% of the duration)",
+		"",
+		"top functions by self time:",
+		"cpu (nanoseconds): total 2ms, showing 1 of 1 functions",
+		"flat flat% sum% cum cum% function",
+		"2ms 100.00% 100.00% 2ms 100.00% main",
+	}
+	if len(lines) != len(want) {
+		t.Fatalf("wrong number of lines in summary:\n%s", b.String())
+	}
+	for i := range want {
+		if lines[i] != want[i] {
+			t.Errorf("wrong line %d of summary: want %q, got %q", i, want[i], lines[i])
+		}
+	}
+}
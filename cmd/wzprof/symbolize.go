@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+
+	"github.com/stealthrocket/wzprof"
+)
+
+// runSymbolize implements "wzprof symbolize -o symbolized.pprof app.wasm
+// profile.pprof", which resolves the functions of a profile recorded with
+// -symbolizer none, e.g. of a stripped module in production, with the symbols
+// of a build of the module which has them.
+func runSymbolize(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("symbolize", flag.ContinueOnError)
+	output := flags.String("o", "", "Write the symbolized profile to the specified file.")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *output == "" || flags.NArg() != 2 {
+		return fmt.Errorf("usage: wzprof symbolize -o <symbolized.pprof> <app.wasm> <profile.pprof>")
+	}
+
+	wasm, err := readModule(ctx, flags.Arg(0))
+	if err != nil {
+		return fmt.Errorf("symbolize: %w", err)
+	}
+	prof, err := readProfile(flags.Arg(1))
+	if err != nil {
+		return fmt.Errorf("symbolize: %w", err)
+	}
+	if err := wzprof.SymbolizeProfile(prof, wasm); err != nil {
+		return fmt.Errorf("symbolize: %w", err)
+	}
+	stdout.Printf("writing symbolized profile to %s", *output)
+	if err := wzprof.WriteProfile(*output, prof); err != nil {
+		return fmt.Errorf("symbolize: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/google/pprof/profile"
+)
+
+// runTop implements "wzprof top profile.pprof", which prints the functions
+// with the highest flat values of a profile, like the top command of pprof,
+// for quick triage without the Go toolchain.
+func runTop(args []string) error {
+	flags := flag.NewFlagSet("top", flag.ContinueOnError)
+	n := flags.Int("n", 10, "Number of functions to print.")
+	sampleIndex := flags.String("sample_index", "", "Sample type to report (default to the sample type displayed by pprof).")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		return fmt.Errorf("usage: wzprof top [-n 10] [-sample_index type] <profile.pprof...>")
+	}
+	for _, path := range flags.Args() {
+		prof, err := readProfile(path)
+		if err != nil {
+			return fmt.Errorf("top: %w", err)
+		}
+		if flags.NArg() > 1 {
+			fmt.Println(path)
+		}
+		if err := writeTop(os.Stdout, prof, *sampleIndex, *n); err != nil {
+			return fmt.Errorf("top: %w", err)
+		}
+	}
+	return nil
+}
+
+type functionValues struct {
+	name      string
+	flat, cum int64
+}
+
+// writeTop writes a table of the n functions with the highest flat values of
+// the sample type of prof, with their cumulative values, which include the
+// values of the functions they call.
+func writeTop(w io.Writer, prof *profile.Profile, sampleType string, n int) error {
+	index, st := defaultSampleType(prof)
+	if sampleType != "" {
+		index = -1
+		for i, t := range prof.SampleType {
+			if t.Type == sampleType {
+				index, st = i, t
+			}
+		}
+	}
+	if index < 0 {
+		return fmt.Errorf("sample type %q not found in profile", sampleType)
+	}
+
+	functions := make(map[string]*functionValues)
+	lookup := func(name string) *functionValues {
+		f := functions[name]
+		if f == nil {
+			f = &functionValues{name: name}
+			functions[name] = f
+		}
+		return f
+	}
+	var total int64
+	seen := make(map[string]bool)
+	for _, s := range prof.Sample {
+		v := s.Value[index]
+		total += v
+		lookup(leafFunctionName(s)).flat += v
+		// Recursive functions only count once per sample in the cumulative
+		// values.
+		for k := range seen {
+			delete(seen, k)
+		}
+		for _, loc := range s.Location {
+			if len(loc.Line) == 0 && !seen["?"] {
+				seen["?"] = true
+				lookup("?").cum += v
+			}
+			for _, line := range loc.Line {
+				name := "?"
+				if line.Function != nil {
+					name = line.Function.Name
+				}
+				if !seen[name] {
+					seen[name] = true
+					lookup(name).cum += v
+				}
+			}
+		}
+	}
+
+	list := make([]*functionValues, 0, len(functions))
+	for _, f := range functions {
+		list = append(list, f)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].flat != list[j].flat {
+			return list[i].flat > list[j].flat
+		}
+		if list[i].cum != list[j].cum {
+			return list[i].cum > list[j].cum
+		}
+		return list[i].name < list[j].name
+	})
+	if n > 0 && len(list) > n {
+		list = list[:n]
+	}
+
+	percent := func(v int64) string {
+		if total == 0 {
+			return "0%"
+		}
+		return fmt.Sprintf("%.2f%%", 100*float64(v)/float64(total))
+	}
+
+	fmt.Fprintf(w, "%s (%s): total %s, showing %d of %d functions\n",
+		st.Type, st.Unit, formatValue(total, st.Unit), len(list), len(functions))
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "flat\tflat%\tsum%\tcum\tcum%\t\tfunction")
+	var sum int64
+	for _, f := range list {
+		sum += f.flat
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t\t%s\n",
+			formatValue(f.flat, st.Unit), percent(f.flat), percent(sum),
+			formatValue(f.cum, st.Unit), percent(f.cum),
+			f.name,
+		)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintln(w)
+	return err
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/pprof/profile"
+)
+
+func TestWriteTop(t *testing.T) {
+	functions := make(map[string]*profile.Function)
+	location := func(name string) *profile.Location {
+		fn := functions[name]
+		if fn == nil {
+			fn = &profile.Function{Name: name}
+			functions[name] = fn
+		}
+		return &profile.Location{Line: []profile.Line{{Function: fn}}}
+	}
+	sample := func(value int64, stack ...string) *profile.Sample {
+		s := &profile.Sample{Value: []int64{1, value}}
+		for _, name := range stack {
+			s.Location = append(s.Location, location(name))
+		}
+		return s
+	}
+	prof := &profile.Profile{
+		SampleType: []*profile.ValueType{
+			{Type: "samples", Unit: "count"},
+			{Type: "alloc_space", Unit: "bytes"},
+		},
+		Sample: []*profile.Sample{
+			sample(600, "malloc", "a", "main"),
+			sample(300, "malloc", "b", "main"),
+			sample(100, "b", "b", "main"),
+		},
+	}
+
+	var b strings.Builder
+	if err := writeTop(&b, prof, "", 3); err != nil {
+		t.Fatal(err)
+	}
+	var lines [][]string
+	for _, line := range strings.Split(strings.TrimSpace(b.String()), "\n") {
+		lines = append(lines, strings.Fields(line))
+	}
+	want := [][]string{
+		{"alloc_space", "(bytes):", "total", "1000B,", "showing", "3", "of", "4", "functions"},
+		{"flat", "flat%", "sum%", "cum", "cum%", "function"},
+		{"900B", "90.00%", "90.00%", "900B", "90.00%", "malloc"},
+		{"100B", "10.00%", "100.00%", "400B", "40.00%", "b"},
+		{"0B", "0.00%", "100.00%", "1000B", "100.00%", "main"},
+	}
+	if len(lines) != len(want) {
+		t.Fatalf("wrong number of lines in report:\n%s", b.String())
+	}
+	for i := range want {
+		if strings.Join(lines[i], " ") != strings.Join(want[i], " ") {
+			t.Errorf("wrong line %d of report: want %q, got %q", i, want[i], lines[i])
+		}
+	}
+
+	if err := writeTop(&b, prof, "inuse_space", 3); err == nil {
+		t.Error("no error for missing sample type")
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/google/pprof/profile"
+)
+
+// formatStack formats the stack of a trap like the stack traces of Go panics,
+// one function per line followed by its source location, if known. The
+// inlined functions of each location come first.
+func formatStack(stack []*profile.Location) string {
+	b := new(strings.Builder)
+	for _, loc := range stack {
+		if len(loc.Line) == 0 {
+			fmt.Fprintf(b, "?\n\t0x%x\n", loc.Address)
+			continue
+		}
+		for _, line := range loc.Line {
+			fmt.Fprintf(b, "%s\n", line.Function.Name)
+			if line.Function.Filename != "" && line.Line > 0 {
+				fmt.Fprintf(b, "\t%s:%d\n", line.Function.Filename, line.Line)
+			} else {
+				fmt.Fprintf(b, "\t0x%x\n", loc.Address)
+			}
+		}
+	}
+	return b.String()
+}
+
+// withGuestStack replaces the wasm stack trace of the error of a trap with the
+// symbolized stack of the guest, if one was recorded.
+func withGuestStack(err error, stack string) error {
+	if stack == "" {
+		return err
+	}
+	msg, _, _ := strings.Cut(err.Error(), "\nwasm stack trace:")
+	return errors.New(msg + "\nguest stack trace:\n" + stack)
+}
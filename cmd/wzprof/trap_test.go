@@ -0,0 +1,33 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/google/pprof/profile"
+)
+
+func TestFormatStack(t *testing.T) {
+	inner := &profile.Function{Name: "inner", Filename: "main.c"}
+	crash := &profile.Function{Name: "crash"}
+	stack := []*profile.Location{
+		{Address: 0x10, Line: []profile.Line{{Function: inner, Line: 3}}},
+		{Address: 0x20, Line: []profile.Line{{Function: crash}}},
+		{Address: 0x30},
+	}
+	want := "inner\n\tmain.c:3\ncrash\n\t0x20\n?\n\t0x30\n"
+	if got := formatStack(stack); got != want {
+		t.Errorf("wrong stack:\n got: %q\nwant: %q", got, want)
+	}
+}
+
+func TestWithGuestStack(t *testing.T) {
+	err := errors.New("wasm error: unreachable\nwasm stack trace:\n\t.$1()\n\t.$0()")
+	if got := withGuestStack(err, ""); got != err {
+		t.Errorf("error replaced without stack: %v", got)
+	}
+	want := "wasm error: unreachable\nguest stack trace:\ninner\n\tmain.c:3\n"
+	if got := withGuestStack(err, "inner\n\tmain.c:3\n").Error(); got != want {
+		t.Errorf("wrong error:\n got: %q\nwant: %q", got, want)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+// checkWASIImports returns an error listing the functions that the guest
+// imports from wasi_snapshot_preview1 but the host does not implement, either
+// in wazero or in the sockets extension of the guest. Without this check,
+// instantiating the guest fails with an error naming only the first missing
+// function.
+func checkWASIImports(ctx context.Context, r wazero.Runtime, mod wazero.CompiledModule) error {
+	wasi, err := wasi_snapshot_preview1.NewBuilder(r).Compile(ctx)
+	if err != nil {
+		return err
+	}
+	defer wasi.Close(ctx)
+	provided := wasi.ExportedFunctions()
+	extension := socketsExtension(mod)
+
+	var missing []string
+	for _, fn := range mod.ImportedFunctions() {
+		module, name, _ := fn.Import()
+		if module != wasi_snapshot_preview1.ModuleName {
+			continue
+		}
+		if _, ok := extension[name]; ok {
+			continue
+		}
+		if _, ok := provided[name]; !ok {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	sort.Strings(missing)
+	return fmt.Errorf("the guest imports WASI functions that are not supported by the host: %s (guests can accept connections on the sockets of -listen, or use the sockets extensions of WasmEdge)",
+		strings.Join(missing, ", "))
+}
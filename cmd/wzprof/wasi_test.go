@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/tetratelabs/wazero"
+)
+
+// wasmImports returns a module importing functions of type () -> () from
+// wasi_snapshot_preview1.
+func wasmImports(names ...string) []byte {
+	return wasmModuleImports("wasi_snapshot_preview1", names...)
+}
+
+// wasmModuleImports returns a module importing functions of type () -> () from
+// the host module.
+func wasmModuleImports(host string, names ...string) []byte {
+	vec := func(b ...[]byte) []byte {
+		out := []byte{byte(len(b))}
+		for _, x := range b {
+			out = append(out, x...)
+		}
+		return out
+	}
+	str := func(s string) []byte { return append([]byte{byte(len(s))}, s...) }
+	section := func(id byte, content []byte) []byte {
+		return append([]byte{id, byte(len(content))}, content...)
+	}
+
+	var imports [][]byte
+	for _, name := range names {
+		imp := append(str(host), str(name)...)
+		imports = append(imports, append(imp, 0x00, 0x00)) // func of type 0
+	}
+	module := []byte{0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00}
+	module = append(module, section(1, vec([]byte{0x60, 0x00, 0x00}))...)
+	module = append(module, section(2, vec(imports...))...)
+	return module
+}
+
+func TestCheckWASIImports(t *testing.T) {
+	ctx := context.Background()
+	r := wazero.NewRuntime(ctx)
+	defer r.Close(ctx)
+
+	for _, test := range []struct {
+		imports []string
+		missing string
+	}{
+		{imports: []string{"sched_yield", "sock_accept"}},
+		{imports: []string{"sock_frobnicate", "sched_yield", "sock_accept"}, missing: "sock_frobnicate"},
+	} {
+		mod, err := r.CompileModule(ctx, wasmImports(test.imports...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = checkWASIImports(ctx, r, mod)
+		switch {
+		case test.missing == "" && err != nil:
+			t.Errorf("%q: unexpected error: %v", test.imports, err)
+		case test.missing != "" && (err == nil || !strings.Contains(err.Error(), ": "+test.missing+" ")):
+			t.Errorf("%q: wrong error: %v", test.imports, err)
+		}
+	}
+}
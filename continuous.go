@@ -0,0 +1,269 @@
+package wzprof
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/pprof/profile"
+)
+
+// Profiles is the set of profiles recorded during a period of a continuous
+// profiler.
+type Profiles struct {
+	// Start and end of the period.
+	Start time.Time
+	End   time.Time
+	// CPU profile of the period, nil if there is no CPU profiler or if its
+	// profile was stopped by another component.
+	CPU *profile.Profile
+	// Memory profile of the allocations made during the period, nil if there
+	// is no memory profiler. The inuse values, if recorded, are the ones at the
+	// end of the period.
+	Memory *profile.Profile
+}
+
+// ProfileSink is the type of functions receiving the profiles of continuous
+// profilers at the end of each period.
+type ProfileSink func(ctx context.Context, profiles *Profiles) error
+
+// ContinuousProfiler periodically rotates the profiles of a CPU and a memory
+// profiler, and hands them to a sink, which may write them to files or push
+// them to a remote service.
+//
+// The continuous profiler drives the CPU profiler: it starts a new profile
+// at the beginning of each period. The profiler should not be used by other
+// components (such as the pprof http handler) at the same time.
+type ContinuousProfiler struct {
+	cpu        *CPUProfiler
+	mem        *MemoryProfiler
+	sink       ProfileSink
+	period     time.Duration
+	sampleRate float64
+
+	mutex   sync.Mutex
+	start   time.Time
+	prevMem *profile.Profile
+}
+
+// ContinuousProfilerOption is a type used to represent configuration options
+// for ContinuousProfiler instances created by NewContinuousProfiler.
+type ContinuousProfilerOption func(*ContinuousProfiler)
+
+// RotationPeriod configures the period at which a continuous profiler hands
+// the profiles to its sink.
+//
+// Default to 60 seconds.
+func RotationPeriod(period time.Duration) ContinuousProfilerOption {
+	return func(c *ContinuousProfiler) { c.period = period }
+}
+
+// ProfileSampleRate configures the sample rate of the profilers, used to
+// scale the profiles. It must match the rate passed to Sample when installing
+// the profilers.
+//
+// Default to 1.
+func ProfileSampleRate(sampleRate float64) ContinuousProfilerOption {
+	return func(c *ContinuousProfiler) { c.sampleRate = sampleRate }
+}
+
+const defaultRotationPeriod = 60 * time.Second
+
+// NewContinuousProfiler creates a continuous profiler of cpu and mem, either
+// of which may be nil. The CPU profile starts recording immediately.
+func NewContinuousProfiler(cpu *CPUProfiler, mem *MemoryProfiler, sink ProfileSink, options ...ContinuousProfilerOption) *ContinuousProfiler {
+	c := &ContinuousProfiler{
+		cpu:        cpu,
+		mem:        mem,
+		sink:       sink,
+		period:     defaultRotationPeriod,
+		sampleRate: 1,
+	}
+	for _, opt := range options {
+		opt(c)
+	}
+	if c.period <= 0 {
+		c.period = defaultRotationPeriod
+	}
+	if c.sampleRate <= 0 {
+		c.sampleRate = 1
+	}
+	c.start = time.Now()
+	if cpu != nil {
+		cpu.StartProfile()
+	}
+	return c
+}
+
+// Run rotates the profiles at every period until ctx is canceled, then hands
+// the profiles recorded since the last rotation to the sink. Errors do not
+// interrupt Run, the last one is returned.
+func (c *ContinuousProfiler) Run(ctx context.Context) error {
+	ticker := time.NewTicker(c.period)
+	defer ticker.Stop()
+
+	var lastErr error
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.Rotate(ctx); err != nil {
+				lastErr = err
+			}
+		case <-ctx.Done():
+			// The context is already canceled, the final rotation cannot use
+			// it.
+			if err := c.Rotate(context.Background()); err != nil {
+				lastErr = err
+			}
+			return lastErr
+		}
+	}
+}
+
+// Rotate ends the current period and hands its profiles to the sink.
+func (c *ContinuousProfiler) Rotate(ctx context.Context) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	profiles := &Profiles{Start: c.start, End: time.Now()}
+	c.start = profiles.End
+
+	// The profiles are built in the background, so the CPU profiler starts
+	// recording the next period right away.
+	var cpu, mem *PendingProfile
+	if c.cpu != nil {
+		cpu = c.cpu.StopProfileAsync(ctx, c.sampleRate)
+		c.cpu.StartProfile()
+	}
+	if c.mem != nil {
+		mem = c.mem.NewProfileAsync(ctx, c.sampleRate)
+	}
+
+	if cpu != nil {
+		prof, err := cpu.Wait(ctx)
+		if err != nil {
+			return err
+		}
+		profiles.CPU = prof
+	}
+
+	if mem != nil {
+		prof, err := mem.Wait(ctx)
+		if err != nil {
+			return err
+		}
+		delta, err := DeltaProfile(c.prevMem, prof)
+		if err != nil {
+			return err
+		}
+		c.prevMem = prof
+		profiles.Memory = delta
+	}
+
+	return c.sink(ctx, profiles)
+}
+
+// ProfileWriter is the interface of the destinations where profiles are
+// written by name, such as directories or object storage buckets.
+type ProfileWriter interface {
+	Write(ctx context.Context, name string, prof *profile.Profile) error
+}
+
+// DirWriter returns a ProfileWriter writing the profiles to the files of dir,
+// the names may contain slashes to write to sub-directories.
+func DirWriter(dir string) ProfileWriter {
+	return dirWriter(dir)
+}
+
+type dirWriter string
+
+func (dir dirWriter) Write(ctx context.Context, name string, prof *profile.Profile) error {
+	path := filepath.Join(string(dir), filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return WriteProfile(path, prof)
+}
+
+// WriterSink returns a sink writing the profiles with w, named after the kind
+// of profile and the end of the period, e.g.
+// "cpu-20230102T150405.000000000Z.pprof".
+func WriterSink(w ProfileWriter) ProfileSink {
+	return func(ctx context.Context, profiles *Profiles) error {
+		for _, p := range sinkProfiles(profiles) {
+			if err := w.Write(ctx, p.name, p.prof); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// FileSink returns a sink writing the profiles to files in dir, named like
+// the profiles of WriterSink. Only the last keep files of each kind are
+// retained, or all of them if keep is zero.
+func FileSink(dir string, keep int) ProfileSink {
+	w := DirWriter(dir)
+	return func(ctx context.Context, profiles *Profiles) error {
+		for _, p := range sinkProfiles(profiles) {
+			if err := w.Write(ctx, p.name, p.prof); err != nil {
+				return err
+			}
+			if keep > 0 {
+				if err := removeOldProfiles(dir, p.kind, keep); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+}
+
+type sinkProfile struct {
+	kind string
+	name string
+	prof *profile.Profile
+}
+
+func sinkProfiles(profiles *Profiles) []sinkProfile {
+	suffix := "-" + profiles.End.UTC().Format("20060102T150405.000000000Z") + ".pprof"
+	var list []sinkProfile
+	for _, p := range []sinkProfile{
+		{kind: "cpu", prof: profiles.CPU},
+		{kind: "memory", prof: profiles.Memory},
+	} {
+		if p.prof != nil {
+			p.name = p.kind + suffix
+			list = append(list, p)
+		}
+	}
+	return list
+}
+
+func removeOldProfiles(dir, kind string, keep int) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	var names []string
+	for _, e := range entries {
+		name := e.Name()
+		if strings.HasPrefix(name, kind+"-") && strings.HasSuffix(name, ".pprof") {
+			names = append(names, name)
+		}
+	}
+	// The timestamps of the names sort in chronological order.
+	sort.Strings(names)
+	for len(names) > keep {
+		if err := os.Remove(filepath.Join(dir, names[0])); err != nil {
+			return fmt.Errorf("removing old profile: %w", err)
+		}
+		names = names[1:]
+	}
+	return nil
+}
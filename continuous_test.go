@@ -0,0 +1,128 @@
+package wzprof
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/pprof/profile"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+	"github.com/tetratelabs/wazero/experimental/wazerotest"
+)
+
+func newMallocListener(mem *MemoryProfiler) func(size uint64) {
+	malloc := wazerotest.NewFunction(func(ctx context.Context, mod api.Module, size uint32) uint32 {
+		return 0
+	})
+	malloc.FunctionName = "malloc"
+	module := wazerotest.NewModule(nil, malloc)
+	def := module.Function(0).Definition()
+	lstn := mem.NewFunctionListener(def)
+	stack := []experimental.StackFrame{{Function: module.Function(0)}}
+
+	return func(size uint64) {
+		ctx := context.Background()
+		lstn.Before(ctx, module, def, []uint64{size}, experimental.NewStackIterator(stack...))
+		lstn.After(ctx, module, def, []uint64{0x1000})
+	}
+}
+
+func TestContinuousProfiler(t *testing.T) {
+	p := ProfilingFor(nil)
+	mem := p.MemoryProfiler()
+	alloc := newMallocListener(mem)
+
+	var rotations []*Profiles
+	c := NewContinuousProfiler(p.CPUProfiler(), mem, func(ctx context.Context, profiles *Profiles) error {
+		rotations = append(rotations, profiles)
+		return nil
+	})
+
+	alloc(10)
+	alloc(10)
+	if err := c.Rotate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	alloc(32)
+	if err := c.Rotate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rotations) != 2 {
+		t.Fatalf("wrong number of rotations: %d", len(rotations))
+	}
+	if !rotations[0].End.Equal(rotations[1].Start) {
+		t.Errorf("periods are not contiguous: %s != %s", rotations[0].End, rotations[1].Start)
+	}
+
+	// The second memory profile only has the allocations made after the first
+	// rotation.
+	for i, want := range [][]int64{{2, 20}, {1, 32}} {
+		if rotations[i].CPU == nil {
+			t.Errorf("missing cpu profile in rotation %d", i)
+		}
+		prof := rotations[i].Memory
+		if len(prof.Sample) != 1 {
+			t.Fatalf("wrong number of samples in memory profile %d: %d", i, len(prof.Sample))
+		}
+		if v := prof.Sample[0].Value; v[0] != want[0] || v[1] != want[1] {
+			t.Errorf("wrong values in memory profile %d: want %v, got %v", i, want, v)
+		}
+	}
+}
+
+func TestFileSink(t *testing.T) {
+	dir := t.TempDir()
+	p := ProfilingFor(nil)
+	c := NewContinuousProfiler(p.CPUProfiler(), p.MemoryProfiler(), FileSink(dir, 2))
+
+	for i := 0; i < 3; i++ {
+		if err := c.Rotate(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := map[string]int{}
+	for _, e := range entries {
+		kind, _, _ := strings.Cut(e.Name(), "-")
+		counts[kind]++
+	}
+	if counts["cpu"] != 2 || counts["memory"] != 2 || len(entries) != 4 {
+		t.Errorf("wrong profile files retained: %v", entries)
+	}
+}
+
+type profileNames []string
+
+func (names *profileNames) Write(ctx context.Context, name string, prof *profile.Profile) error {
+	*names = append(*names, name)
+	return nil
+}
+
+func TestWriterSink(t *testing.T) {
+	p := ProfilingFor(nil)
+	var names profileNames
+	c := NewContinuousProfiler(p.CPUProfiler(), nil, WriterSink(&names))
+	if err := c.Rotate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 1 || !strings.HasPrefix(names[0], "cpu-") || !strings.HasSuffix(names[0], ".pprof") {
+		t.Errorf("wrong profile names: %v", names)
+	}
+
+	dir := t.TempDir()
+	prof := p.MemoryProfiler().NewProfile(1)
+	if err := DirWriter(dir).Write(context.Background(), "a/b.pprof", prof); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a", "b.pprof")); err != nil {
+		t.Error(err)
+	}
+}
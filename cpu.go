@@ -2,9 +2,13 @@ package wzprof
 
 import (
 	"context"
+	"errors"
+	"io"
+	"math"
 	"net/http"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/pprof/profile"
@@ -21,12 +25,34 @@ import (
 type CPUProfiler struct {
 	p      *Profiling
 	mutex  sync.Mutex
-	counts stackCounterMap
+	counts *stackCounterMap
+	// Number of stacks of the previous profile, used to size the next one.
+	stacks int
+	// The function listeners only read this flag and write to the sample
+	// buffer of their thread, they do not acquire the mutex except to flush
+	// the buffer when it is full.
+	recording atomic.Bool
+	threads   threadStates[cpuThread]
+	time      func() int64
+	start     time.Time
+	skew      time.Duration
+	host      bool
+	state     *profile.Profile
+	// Number of standard errors of the confidence intervals, zero if they
+	// are not recorded.
+	intervals float64
+	maxStacks int
+}
+
+// cpuThread is the state of the CPU profiler for a thread of the guest.
+type cpuThread struct {
+	samples cpuSampleBuffer
+	traces  stackTracePool
+	// Frames of the calls in progress which are recorded, and depth of the
+	// call stack, so the calls made while the profiler is stopped only
+	// update the depth.
 	frames []cpuTimeFrame
-	traces []stackTrace
-	time   func() int64
-	start  time.Time
-	host   bool
+	depth  int
 }
 
 // CPUProfilerOption is a type used to represent configuration options for
@@ -49,20 +75,79 @@ func TimeFunc(time func() int64) CPUProfilerOption {
 	return func(p *CPUProfiler) { p.time = time }
 }
 
+// ConfidenceIntervals configures the CPU profiler to record confidence
+// intervals of the values estimated from the sampled calls, at the given
+// confidence level (e.g. 0.95). When only a fraction of the calls is sampled,
+// small values are mostly noise, and the intervals tell how much to trust them.
+//
+// The profiles then have five more sample types, placed before "cpu" so it
+// remains the default of pprof:
+//   - "samples_lower" and "samples_upper" bound the number of calls.
+//   - "cpu_estimate" is the time spent in all calls, extrapolated from the
+//     sampled ones, with "cpu_estimate_lower" and "cpu_estimate_upper" as
+//     bounds.
+//
+// Default to zero, which disables the intervals.
+func ConfidenceIntervals(confidence float64) CPUProfilerOption {
+	return func(p *CPUProfiler) {
+		if confidence > 0 && confidence < 1 {
+			p.intervals = math.Sqrt2 * math.Erfinv(confidence)
+		} else {
+			p.intervals = 0
+		}
+	}
+}
+
+// MaxCPUStacks configures the maximum number of stacks recorded in the CPU
+// profiles, which bounds the memory used by the profiler for guests with many
+// distinct stacks. The samples of the stacks seen after the limit was reached
+// are aggregated in a sample of the "[dropped]" function, and counted in the
+// dropped samples of the metrics. Zero disables the limit.
+//
+// Default to DefaultMaxStacks.
+func MaxCPUStacks(n int) CPUProfilerOption {
+	return func(p *CPUProfiler) { p.maxStacks = n }
+}
+
 type cpuTimeFrame struct {
 	start int64
 	sub   int64
+	depth int
 	trace stackTrace
 }
 
+// parent returns the frame of the caller of the call at index i, or nil if it
+// is not recorded.
+func (t *cpuThread) parent(i int) *cpuTimeFrame {
+	if i > 0 && t.frames[i-1].depth == t.frames[i].depth-1 {
+		return &t.frames[i-1]
+	}
+	return nil
+}
+
+// drain observes the samples of the buffers of all the threads in counts, or
+// discards them when counts is nil. The mutex must be held.
+func (p *CPUProfiler) drain(counts *stackCounterMap) {
+	p.threads.each(func(t *cpuThread) { t.samples.drain(counts) })
+}
+
 func newCPUProfiler(p *Profiling, options ...CPUProfilerOption) *CPUProfiler {
 	c := &CPUProfiler{
-		p:    p,
-		time: nanotime,
+		p:         p,
+		time:      nanotime,
+		maxStacks: DefaultMaxStacks,
 	}
 	for _, opt := range options {
 		opt(c)
 	}
+	// The samples of the threads which exited are kept until the profile is
+	// built.
+	c.threads.release = func(t *cpuThread) {
+		c.mutex.Lock()
+		t.samples.drain(c.counts)
+		c.mutex.Unlock()
+	}
+	p.metrics.trackStacks(c.Count)
 	return c
 }
 
@@ -77,25 +162,168 @@ func (p *CPUProfiler) StartProfile() bool {
 		return false // already started
 	}
 
-	p.counts = make(stackCounterMap)
+	// Discard the samples of calls which returned after the previous profile
+	// was stopped.
+	p.drain(nil)
+	p.counts = newStackCounterMap(p.stacks)
+	p.counts.setLimit(p.maxStacks, &p.p.metrics.dropped)
 	p.start = time.Now()
+	p.skew = p.p.clockSkew()
+	p.recording.Store(true)
 	return true
 }
 
 // StopProfile stops recording and returns the CPU profile. The method returns
 // nil if recording of the CPU profile wasn't started.
 func (p *CPUProfiler) StopProfile(sampleRate float64) *profile.Profile {
+	prof, _ := p.StopProfileContext(context.Background(), sampleRate)
+	return prof
+}
+
+// StopProfileContext is like StopProfile but stops building the profile and
+// returns an error when ctx is canceled. Recording is stopped and the samples
+// are discarded in that case. The progress of building the profile is
+// reported to the function installed on ctx by WithProgress.
+func (p *CPUProfiler) StopProfileContext(ctx context.Context, sampleRate float64) (*profile.Profile, error) {
+	return p.stopProfile(sampleRate).build(ctx)
+}
+
+// StopProfileTo is like StopProfileContext but writes the profile to w in the
+// pprof format as its samples are symbolized, instead of building it in
+// memory, which bounds the memory used to serve very large profiles.
+//
+// The profile is built in memory and then written when functions were
+// registered with OnProfileBuilt or OnProfileCompleted, since they need the
+// complete profile, or when the state of the profiler was restored.
+func (p *CPUProfiler) StopProfileTo(ctx context.Context, w io.Writer, sampleRate float64) error {
+	return p.stopProfile(sampleRate).encode(ctx, w, nil)
+}
+
+// StopProfileAsync is like StopProfileContext but only takes the samples
+// recorded by the profiler before returning, the profile is built in the
+// background. The profiler can be restarted right away, without waiting for
+// the profile to be built, so recording of the next profile is not delayed by
+// the symbolization of the stacks.
+func (p *CPUProfiler) StopProfileAsync(ctx context.Context, sampleRate float64) *PendingProfile {
+	return buildProfileAsync(ctx, p.stopProfile(sampleRate).build)
+}
+
+// stopProfile stops recording and returns the samples recorded until then, or
+// nil if recording was not started.
+func (p *CPUProfiler) stopProfile(sampleRate float64) *cpuSnapshot {
+	p.recording.Store(false)
 	p.mutex.Lock()
-	samples, start := p.counts, p.start
-	p.counts = nil
+	p.drain(p.counts)
+	counts, start, skew, state := p.counts, p.start, p.skew, p.state
+	p.counts, p.state = nil, nil
 	p.mutex.Unlock()
 
-	if samples == nil {
+	if counts == nil {
 		return nil
 	}
+	samples := counts.samples()
+	p.mutex.Lock()
+	p.stacks = len(samples)
+	p.mutex.Unlock()
+
+	return &cpuSnapshot{
+		p:          p,
+		samples:    samples,
+		start:      start,
+		skew:       skew,
+		duration:   time.Since(start),
+		state:      state,
+		sampleRate: sampleRate,
+	}
+}
 
-	duration := time.Since(start)
+// cpuSnapshot holds the samples of a stopped CPU profile, which are only
+// symbolized when the profile is built or encoded.
+type cpuSnapshot struct {
+	p          *CPUProfiler
+	samples    map[uint64]*stackCounter
+	start      time.Time
+	skew       time.Duration
+	duration   time.Duration
+	state      *profile.Profile
+	sampleRate float64
+}
+
+// build builds the profile of the snapshot, nil if s is nil.
+func (s *cpuSnapshot) build(ctx context.Context) (*profile.Profile, error) {
+	if s == nil {
+		return nil, nil
+	}
+	p := s.p
+	p.removeHostSamples(s.samples)
+
+	var prof *profile.Profile
+	var err error
+	if p.intervals != 0 {
+		prof, err = buildProfile(ctx, p.p, s.estimates(), s.start, s.skew, s.duration, p.SampleType(), s.ratios(), s.state)
+	} else {
+		prof, err = buildProfile(ctx, p.p, s.samples, s.start, s.skew, s.duration, p.SampleType(), s.ratios(), s.state)
+	}
+	return p.p.completeProfile(ctx, p.Name(), prof, err)
+}
 
+// encode writes the profile of the snapshot to w with the labels added to its
+// samples, see StopProfileTo.
+func (s *cpuSnapshot) encode(ctx context.Context, w io.Writer, labels map[string]string) error {
+	if s == nil {
+		return errors.New("CPU profiler not started")
+	}
+	p := s.p
+	if s.state != nil || !p.p.encodable() {
+		prof, err := s.build(ctx)
+		if err != nil {
+			return err
+		}
+		addLabels(prof, labels)
+		return prof.Write(w)
+	}
+	p.removeHostSamples(s.samples)
+
+	if p.intervals != 0 {
+		return encodeProfile(ctx, p.p, w, s.estimates(), s.start, s.skew, s.duration, p.SampleType(), s.ratios(), labels)
+	}
+	return encodeProfile(ctx, p.p, w, s.samples, s.start, s.skew, s.duration, p.SampleType(), s.ratios(), labels)
+}
+
+// estimates returns the confidence intervals of the samples, when the
+// profiler records them.
+func (s *cpuSnapshot) estimates() map[uint64]*cpuEstimate {
+	estimates := make(map[uint64]*cpuEstimate, len(s.samples))
+	for k, sample := range s.samples {
+		estimates[k] = newCPUEstimate(sample, s.sampleRate, s.p.intervals)
+	}
+	return estimates
+}
+
+// ratios returns the ratios scaling the values of the samples.
+func (s *cpuSnapshot) ratios() []float64 {
+	if s.p.intervals != 0 {
+		// The estimates are already scaled.
+		return []float64{1, 1, 1, 1, 1, 1, 1}
+	}
+	return []float64{
+		1 / s.sampleRate,
+		// Time values are not influenced by the sampling rate so we don't
+		// have to scale them out.
+		1,
+	}
+}
+
+// discardProfile stops recording without building the profile.
+func (p *CPUProfiler) discardProfile() {
+	p.recording.Store(false)
+	p.mutex.Lock()
+	p.drain(nil)
+	p.counts = nil
+	p.mutex.Unlock()
+}
+
+func (p *CPUProfiler) removeHostSamples(samples map[uint64]*stackCounter) {
 	if !p.host {
 		for k, sample := range samples {
 			if sample.stack.host() {
@@ -103,15 +331,46 @@ func (p *CPUProfiler) StopProfile(sampleRate float64) *profile.Profile {
 			}
 		}
 	}
+}
 
-	ratios := []float64{
-		1 / sampleRate,
-		// Time values are not influenced by the sampling rate so we don't have
-		// to scale them out.
-		1,
+// SaveState writes the samples recorded by the profile in progress to w, so
+// they can be restored with RestoreState after the host migrates the guest
+// module to another instance (e.g. when snapshotting and restoring it). The
+// profile keeps recording.
+//
+// The state is written in the pprof format, without scaling of the sampling
+// rate.
+func (p *CPUProfiler) SaveState(w io.Writer) error {
+	p.mutex.Lock()
+	p.drain(p.counts)
+	counts, start, skew, state := p.counts, p.start, p.skew, p.state
+	p.mutex.Unlock()
+
+	samples := map[uint64]*stackCounter{}
+	if counts != nil {
+		samples = counts.samples()
+	}
+
+	p.removeHostSamples(samples)
+	prof, err := buildUnscaledProfile(context.Background(), p.p, samples, start, skew, time.Since(start), cpuSampleType())
+	if err != nil {
+		return err
 	}
+	return writeProfileState(w, prof, state)
+}
 
-	return buildProfile(p.p, samples, start, duration, p.SampleType(), ratios)
+// RestoreState reads a state written by SaveState. Its samples are merged in
+// the next profile returned by StopProfile, which continues the profile that
+// was in progress when the state was saved.
+func (p *CPUProfiler) RestoreState(r io.Reader) error {
+	state, err := readProfileState(r, p.SampleType())
+	if err != nil {
+		return err
+	}
+	p.mutex.Lock()
+	p.state = state
+	p.mutex.Unlock()
+	return nil
 }
 
 // Name returns "profile" to match the name of the CPU profiler in pprof.
@@ -127,20 +386,86 @@ func (p *CPUProfiler) Desc() string {
 // Count returns the number of execution stacks currently recorded in p.
 func (p *CPUProfiler) Count() int {
 	p.mutex.Lock()
-	n := len(p.counts)
-	p.mutex.Unlock()
-	return n
+	defer p.mutex.Unlock()
+	p.drain(p.counts)
+	if p.counts == nil {
+		return 0
+	}
+	return p.counts.len()
 }
 
 // SampleType returns the set of value types present in samples recorded by the
 // CPU profiler.
 func (p *CPUProfiler) SampleType() []*profile.ValueType {
+	if p.intervals != 0 {
+		return []*profile.ValueType{
+			{Type: "samples", Unit: "count"},
+			{Type: "samples_lower", Unit: "count"},
+			{Type: "samples_upper", Unit: "count"},
+			{Type: "cpu_estimate", Unit: "nanoseconds"},
+			{Type: "cpu_estimate_lower", Unit: "nanoseconds"},
+			{Type: "cpu_estimate_upper", Unit: "nanoseconds"},
+			{Type: "cpu", Unit: "nanoseconds"},
+		}
+	}
+	return cpuSampleType()
+}
+
+// cpuSampleType returns the value types of the counters of the CPU profiler.
+// The saved states only have those, the confidence intervals are computed when
+// the profile is built.
+func cpuSampleType() []*profile.ValueType {
 	return []*profile.ValueType{
 		{Type: "samples", Unit: "count"},
 		{Type: "cpu", Unit: "nanoseconds"},
 	}
 }
 
+// cpuEstimate is a sample of the CPU profile extrapolated from the sampled
+// calls, with its confidence intervals.
+type cpuEstimate struct {
+	stack stackTrace
+	value [7]int64
+}
+
+// newCPUEstimate extrapolates the totals of all the calls of a stack from the
+// sampled ones, assuming each call was sampled independently at sampleRate.
+// The variance of the totals is estimated with the Horvitz-Thompson estimator:
+// sum((1-r)/r² * y²) over the sampled values y. The bounds are z standard
+// errors away from the estimate, and no lower than the observed values.
+func newCPUEstimate(sc *stackCounter, sampleRate, z float64) *cpuEstimate {
+	count, total := float64(sc.count()), float64(sc.total())
+	r := sampleRate
+	if r <= 0 || r > 1 {
+		r = 1
+	}
+	samples := count / r
+	samplesErr := z * math.Sqrt(count*(1-r)) / r
+	cpu := total / r
+	cpuErr := z * math.Sqrt(sc.sumsq*(1-r)) / r
+
+	return &cpuEstimate{
+		stack: sc.stack,
+		value: [7]int64{
+			int64(math.Round(samples)),
+			int64(math.Round(math.Max(samples-samplesErr, count))),
+			int64(math.Round(samples + samplesErr)),
+			int64(math.Round(cpu)),
+			int64(math.Round(math.Max(cpu-cpuErr, total))),
+			int64(math.Round(cpu + cpuErr)),
+			sc.total(),
+		},
+	}
+}
+
+func (e *cpuEstimate) sampleLocation() stackTrace {
+	return e.stack
+}
+
+func (e *cpuEstimate) sampleValue() []int64 {
+	return e.value[:]
+}
+
 // NewHandler returns a http handler allowing the profiler to be exposed on a
 // pprof-compatible http endpoint.
 //
@@ -170,6 +495,12 @@ func (p *CPUProfiler) NewHandler(sampleRate float64) http.Handler {
 			}
 		}
 
+		labels, err := requestLabels(r)
+		if err != nil {
+			serveError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
 		if !p.StartProfile() {
 			serveError(w, http.StatusInternalServerError, "Could not enable CPU profiling: profiler already running")
 			return
@@ -181,73 +512,219 @@ func (p *CPUProfiler) NewHandler(sampleRate float64) http.Handler {
 		case <-ctx.Done():
 		}
 		timer.Stop()
-		serveProfile(w, p.StopProfile(sampleRate))
+
+		snapshot := p.stopProfile(sampleRate)
+		streamProfile(w, r, func(w io.Writer, _ map[string]string) error {
+			return snapshot.encode(ctx, w, labels)
+		})
 	})
 }
 
 // NewFunctionListener returns a function listener suited to record CPU timings
 // of calls to the function passed as argument.
 func (p *CPUProfiler) NewFunctionListener(def api.FunctionDefinition) experimental.FunctionListener {
-	name := def.Name()
-	if len(p.p.onlyFunctions) > 0 {
-		_, keep := p.p.onlyFunctions[name]
-		if !keep {
-			return nil
+	if !p.p.listensTo(def) {
+		if isProcExit(def) {
+			return cpuExitListener{p}
 		}
-	}
-	_, skip := p.p.filteredFunctions[name]
-	if skip {
 		return nil
 	}
-	return profilingListener{p.p, cpuProfiler{p}}
+	return cpuListener{
+		profilingListener: profilingListener{p.p, cpuProfiler{p, isProcExit(def)}},
+		p:                 p,
+	}
 }
 
-type cpuProfiler struct{ *CPUProfiler }
+// cpuListener only calls the profiling listener, which walks the stack and
+// measures the overhead of the profiler, for the calls made while the profiler
+// is recording. The other calls only update the depth of the call stack, so
+// the listeners can stay installed at little cost while the profiler is
+// stopped.
+type cpuListener struct {
+	profilingListener
+	p *CPUProfiler
+}
 
-func (p cpuProfiler) Before(ctx context.Context, mod api.Module, def api.FunctionDefinition, _ []uint64, si experimental.StackIterator) {
-	var frame cpuTimeFrame
-	p.mutex.Lock()
+func (l cpuListener) Before(ctx context.Context, mod api.Module, def api.FunctionDefinition, params []uint64, si experimental.StackIterator) {
+	t := l.p.threads.get(mod)
+	t.depth++
+	if l.p.recording.Load() {
+		l.profilingListener.Before(ctx, mod, def, params, si)
+	}
+}
 
-	if p.counts != nil {
-		start := p.time()
-		trace := stackTrace{}
+func (l cpuListener) After(ctx context.Context, mod api.Module, def api.FunctionDefinition, results []uint64) {
+	t := l.p.threads.get(mod)
+	if t.recorded() {
+		l.profilingListener.After(ctx, mod, def, results)
+	}
+	t.depth--
+}
 
-		if i := len(p.traces); i > 0 {
-			i--
-			trace = p.traces[i]
-			p.traces = p.traces[:i]
-		}
+func (l cpuListener) Abort(ctx context.Context, mod api.Module, def api.FunctionDefinition, err error) {
+	t := l.p.threads.get(mod)
+	if t.recorded() {
+		l.profilingListener.Abort(ctx, mod, def, err)
+	}
+	t.depth--
+}
 
-		frame = cpuTimeFrame{
-			start: start,
-			trace: makeStackTrace(trace, si),
-		}
+// recorded returns whether the call returning has a frame.
+func (t *cpuThread) recorded() bool {
+	i := len(t.frames) - 1
+	return i >= 0 && t.frames[i].depth == t.depth
+}
+
+type cpuProfiler struct {
+	*CPUProfiler
+	exit bool // the function is proc_exit
+}
+
+func (p cpuProfiler) Before(ctx context.Context, mod api.Module, def api.FunctionDefinition, _ []uint64, si experimental.StackIterator) {
+	t := p.threads.get(mod)
+	if p.exit {
+		p.flushFrames(t)
 	}
 
-	p.mutex.Unlock()
-	p.frames = append(p.frames, frame)
+	start := p.time()
+	trace := makeStackTrace(ctx, t.traces.get(), si)
+	if g, ok := si.(goroutineStackIterator); ok {
+		trace = trace.withGoroutine(g.goroutineID())
+	}
+
+	t.frames = append(t.frames, cpuTimeFrame{
+		start: start,
+		depth: t.depth,
+		trace: trace,
+	})
 }
 
 func (p cpuProfiler) After(ctx context.Context, mod api.Module, def api.FunctionDefinition, _ []uint64) {
-	i := len(p.frames) - 1
-	f := p.frames[i]
-	p.frames = p.frames[:i]
+	t := p.threads.get(mod)
+	i := len(t.frames) - 1
+	f := t.frames[i]
+	parent := t.parent(i)
+	t.frames = t.frames[:i]
 
 	if f.start != 0 {
 		duration := p.time() - f.start
-		if i := len(p.frames); i > 0 {
-			p.frames[i-1].sub += duration
+		if parent != nil {
+			parent.sub += duration
 		}
 		duration -= f.sub
-		p.mutex.Lock()
-		if p.counts != nil {
-			p.counts.observe(f.trace, duration)
+		p.p.streams.publish(p.Name(), f.trace, duration)
+		p.record(t, f.trace, duration)
+	}
+}
+
+func (p cpuProfiler) Abort(ctx context.Context, mod api.Module, def api.FunctionDefinition, err error) {
+	if err == errAsyncifyUnwind {
+		// The call is suspended, not returning: it is called again when the
+		// stack is rewound, and recorded once when it returns.
+		t := p.threads.get(mod)
+		i := len(t.frames) - 1
+		if t.frames[i].start != 0 {
+			t.traces.put(t.frames[i].trace)
+		}
+		t.frames = t.frames[:i]
+		return
+	}
+	p.After(ctx, mod, def, nil)
+}
+
+// flushFrames records the time spent so far in the calls in progress of the
+// thread, as if they returned now. The guest is exiting, those calls will only
+// be unwound after the profile may have been built.
+func (p *CPUProfiler) flushFrames(t *cpuThread) {
+	now := p.time()
+
+	for i := len(t.frames) - 1; i >= 0; i-- {
+		f := &t.frames[i]
+		if f.start == 0 {
+			continue
+		}
+		duration := now - f.start
+		if parent := t.parent(i); parent != nil {
+			parent.sub += duration
 		}
+		p.p.streams.publish(p.Name(), f.trace, duration-f.sub)
+		// After and Abort skip the frames which are not started, the trace is
+		// not used by the frame anymore.
+		p.record(t, f.trace, duration-f.sub)
+		f.start = 0
+	}
+
+	// The profile may be built before the guest calls another function.
+	p.mutex.Lock()
+	p.drain(p.counts)
+	p.mutex.Unlock()
+}
+
+// record adds a sample to the buffer of the thread, flushing it to the profile
+// when it is full. The trace is owned by the buffer after the call.
+func (p *CPUProfiler) record(t *cpuThread, trace stackTrace, value int64) {
+	p.p.metrics.samples.Add(1)
+	trace, full := t.samples.push(trace, value)
+	t.traces.put(trace)
+	if full {
+		p.mutex.Lock()
+		t.samples.drain(p.counts)
 		p.mutex.Unlock()
-		p.traces = append(p.traces, f.trace)
 	}
 }
 
-func (p cpuProfiler) Abort(ctx context.Context, mod api.Module, def api.FunctionDefinition, _ error) {
-	p.After(ctx, mod, def, nil)
+const cpuSampleBufferSize = 256
+
+// cpuSampleBuffer is a ring buffer of the samples recorded by the function
+// listeners of a call stack, which they write to without synchronizing with
+// the profiler. The buffer has a single producer, the goroutine running the
+// guest code of the call stack, and is drained into the shared counter map by
+// consumers holding the profiler mutex.
+type cpuSampleBuffer struct {
+	head    atomic.Uint64 // written by the producer
+	tail    atomic.Uint64 // written by the consumers
+	samples [cpuSampleBufferSize]cpuSample
+}
+
+type cpuSample struct {
+	trace stackTrace
+	value int64
+}
+
+// push adds a sample to the buffer, which must not be full. It returns the
+// trace of a sample previously drained, which the producer may reuse, and
+// whether the buffer is full and must be drained before the next push.
+func (b *cpuSampleBuffer) push(trace stackTrace, value int64) (stackTrace, bool) {
+	head := b.head.Load()
+	s := &b.samples[head%cpuSampleBufferSize]
+	prev := s.trace
+	s.trace, s.value = trace, value
+	head++
+	b.head.Store(head)
+	return prev, head-b.tail.Load() == cpuSampleBufferSize
 }
+
+// drain observes the samples of the buffer in counts, or discards them when
+// counts is nil. The profiler mutex must be held.
+func (b *cpuSampleBuffer) drain(counts *stackCounterMap) {
+	tail, head := b.tail.Load(), b.head.Load()
+	for ; tail < head; tail++ {
+		if counts != nil {
+			s := &b.samples[tail%cpuSampleBufferSize]
+			counts.observe(s.trace, s.value)
+		}
+	}
+	b.tail.Store(tail)
+}
+
+// cpuExitListener flushes the calls in progress when the guest exits, for
+// modules where the profiler does not listen to proc_exit.
+type cpuExitListener struct{ *CPUProfiler }
+
+func (p cpuExitListener) Before(_ context.Context, mod api.Module, _ api.FunctionDefinition, _ []uint64, _ experimental.StackIterator) {
+	p.flushFrames(p.threads.get(mod))
+}
+
+func (p cpuExitListener) After(context.Context, api.Module, api.FunctionDefinition, []uint64) {}
+
+func (p cpuExitListener) Abort(context.Context, api.Module, api.FunctionDefinition, error) {}
@@ -1,8 +1,12 @@
 package wzprof
 
 import (
+	"bytes"
 	"context"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/tetratelabs/wazero/api"
 	"github.com/tetratelabs/wazero/experimental"
@@ -20,6 +24,118 @@ func BenchmarkCPUProfilerOff(b *testing.B) {
 	benchmarkFunctionListener(b, p)
 }
 
+func BenchmarkCPUProfilerStacks(b *testing.B) {
+	p := ProfilingFor(nil).CPUProfiler()
+	p.StartProfile()
+
+	module := wazerotest.NewModule(nil,
+		wazerotest.NewFunction(func(context.Context, api.Module) {}),
+		wazerotest.NewFunction(func(context.Context, api.Module) {}),
+		wazerotest.NewFunction(func(context.Context, api.Module) {}),
+	)
+	stacks := benchmarkStacks(module, 100, 32)
+	def := module.Function(0).Definition()
+	f := p.NewFunctionListener(def)
+	ctx := context.Background()
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	// Once all the stacks were seen, recording samples must not allocate.
+	for i := 0; i < b.N; i++ {
+		f.Before(ctx, module, def, nil, stacks[i%len(stacks)].reset())
+		f.After(ctx, module, def, nil)
+	}
+}
+
+func TestCPUProfilerAllocations(t *testing.T) {
+	p := ProfilingFor(nil).CPUProfiler()
+	p.StartProfile()
+
+	module := wazerotest.NewModule(nil,
+		wazerotest.NewFunction(func(context.Context, api.Module) {}),
+	)
+	stacks := benchmarkStacks(module, 10, 8)
+	def := module.Function(0).Definition()
+	f := p.NewFunctionListener(def)
+	ctx := context.Background()
+
+	call := func() {
+		for _, si := range stacks {
+			f.Before(ctx, module, def, nil, si.reset())
+			f.After(ctx, module, def, nil)
+		}
+	}
+	// Insert the stacks, and go around the sample buffer once so its traces
+	// are all allocated and cycle through the pool.
+	for i := 0; i <= cpuSampleBufferSize; i += len(stacks) {
+		call()
+	}
+
+	if allocs := testing.AllocsPerRun(100, call); allocs != 0 {
+		t.Errorf("recording samples of known stacks allocated %v times", allocs)
+	}
+}
+
+// panicStackIterator fails the calls which walk the stack.
+type panicStackIterator struct{}
+
+func (panicStackIterator) Next() bool { panic("stack walked") }
+
+func (panicStackIterator) Function() experimental.InternalFunction { panic("stack walked") }
+
+func (panicStackIterator) ProgramCounter() experimental.ProgramCounter { panic("stack walked") }
+
+func (panicStackIterator) Parameters() []uint64 { panic("stack walked") }
+
+func TestCPUProfilerStopped(t *testing.T) {
+	module := wazerotest.NewModule(nil,
+		wazerotest.NewFunction(func(context.Context, api.Module) {}),
+	)
+	def := module.Function(0).Definition()
+	p := ProfilingFor(nil).CPUProfiler()
+	f := p.NewFunctionListener(def)
+	ctx := context.Background()
+
+	call := func() {
+		f.Before(ctx, module, def, nil, panicStackIterator{})
+		f.After(ctx, module, def, nil)
+	}
+	if allocs := testing.AllocsPerRun(100, call); allocs != 0 {
+		t.Errorf("calls allocated %v times while the profiler is stopped", allocs)
+	}
+	thread := p.threads.get(module)
+	if len(thread.frames) != 0 || thread.depth != 0 {
+		t.Errorf("calls recorded while the profiler is stopped: %d frames, depth %d", len(thread.frames), thread.depth)
+	}
+	if overhead := p.p.metrics.overhead.Load(); overhead != 0 {
+		t.Errorf("overhead measured while the profiler is stopped: %d", overhead)
+	}
+
+	// Calls in progress when the profiler starts are not recorded, the calls
+	// they make are.
+	stack := func() experimental.StackIterator {
+		return experimental.NewStackIterator(experimental.StackFrame{Function: module.Function(0)})
+	}
+	f.Before(ctx, module, def, nil, panicStackIterator{})
+	p.StartProfile()
+	f.Before(ctx, module, def, nil, stack())
+	f.After(ctx, module, def, nil)
+	f.After(ctx, module, def, nil)
+	if len(thread.frames) != 0 || thread.depth != 0 {
+		t.Errorf("unbalanced calls: %d frames, depth %d", len(thread.frames), thread.depth)
+	}
+
+	// Calls in progress when the profiler stops are still recorded.
+	f.Before(ctx, module, def, nil, stack())
+	p.StopProfile(1)
+	f.Before(ctx, module, def, nil, panicStackIterator{})
+	f.After(ctx, module, def, nil)
+	f.After(ctx, module, def, nil)
+	if len(thread.frames) != 0 || thread.depth != 0 {
+		t.Errorf("unbalanced calls: %d frames, depth %d", len(thread.frames), thread.depth)
+	}
+}
+
 func TestCPUProfilerTime(t *testing.T) {
 	currentTime := int64(0)
 
@@ -95,12 +211,65 @@ func TestCPUProfilerTime(t *testing.T) {
 	d1 := t4 - (t1 + d2)
 	d0 := t5 - (t0 + d1 + d2)
 
+	p.drain(p.counts)
 	assertStackCount(t, p.counts, trace0, 1, d0)
 	assertStackCount(t, p.counts, trace1, 1, d1)
 	assertStackCount(t, p.counts, trace2, 1, d2)
 }
 
-func assertStackCount(t *testing.T, counts stackCounterMap, trace stackTrace, count, total int64) {
+func TestCPUProfilerConcurrentCount(t *testing.T) {
+	currentTime := int64(0)
+	p := ProfilingFor(nil).CPUProfiler(
+		HostTime(true),
+		TimeFunc(func() int64 { currentTime++; return currentTime }),
+	)
+
+	module := wazerotest.NewModule(nil,
+		wazerotest.NewFunction(func(context.Context, api.Module) {}),
+	)
+	stack := []experimental.StackFrame{
+		{Function: module.Function(0)},
+	}
+	def := module.Function(0).Definition()
+	f := p.NewFunctionListener(def)
+
+	// Spans multiple rounds of the sample buffer, with profile readers
+	// draining it concurrently.
+	const calls = 10*cpuSampleBufferSize + 1
+	done := make(chan struct{})
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				p.Count()
+			}
+		}
+	}()
+
+	ctx := context.Background()
+	p.StartProfile()
+	for i := 0; i < calls; i++ {
+		f.Before(ctx, module, def, nil, experimental.NewStackIterator(stack...))
+		f.After(ctx, module, def, nil)
+	}
+	close(done)
+	wg.Wait()
+
+	prof := p.StopProfile(1)
+	if len(prof.Sample) != 1 {
+		t.Fatalf("wrong number of samples: want=1 got=%d", len(prof.Sample))
+	}
+	if got := prof.Sample[0].Value; got[0] != calls || got[1] != calls {
+		t.Errorf("wrong sample values: want=[%d %d] got=%v", calls, calls, got)
+	}
+}
+
+func assertStackCount(t *testing.T, counts *stackCounterMap, trace stackTrace, count, total int64) {
 	t.Helper()
 	c := counts.lookup(trace)
 
@@ -114,5 +283,226 @@ func assertStackCount(t *testing.T, counts stackCounterMap, trace stackTrace, co
 }
 
 func makeStackTraceFromFrames(stackFrames []experimental.StackFrame) stackTrace {
-	return makeStackTrace(stackTrace{}, experimental.NewStackIterator(stackFrames...))
+	return makeStackTrace(context.Background(), stackTrace{}, experimental.NewStackIterator(stackFrames...))
+}
+
+func TestCPUProfilerGuestWalltime(t *testing.T) {
+	const skew = 42 * time.Hour
+
+	p := ProfilingFor(nil)
+	p.SetGuestWalltime(func() (int64, int32) {
+		now := time.Now().Add(skew)
+		return now.Unix(), int32(now.Nanosecond())
+	})
+
+	cpu := p.CPUProfiler()
+	cpu.StartProfile()
+	prof := cpu.StopProfile(1)
+
+	start := time.Unix(0, prof.TimeNanos)
+	if d := time.Until(start); d < skew-time.Minute || d > skew {
+		t.Errorf("profile time does not match the guest clock: %s", start)
+	}
+	if len(prof.Comments) != 1 || !strings.HasPrefix(prof.Comments[0], "guest clock skew: ") {
+		t.Errorf("missing clock skew comment: %q", prof.Comments)
+	}
+}
+
+func TestCPUProfilerRestoreState(t *testing.T) {
+	module := wazerotest.NewModule(nil,
+		wazerotest.NewFunction(func(context.Context, api.Module) {}),
+	)
+	stack := []experimental.StackFrame{
+		{Function: module.Function(0)},
+	}
+	def := module.Function(0).Definition()
+	ctx := context.Background()
+
+	call := func(p *CPUProfiler) {
+		f := p.NewFunctionListener(def)
+		f.Before(ctx, module, def, nil, experimental.NewStackIterator(stack...))
+		f.After(ctx, module, def, nil)
+	}
+
+	// Functions of wazerotest modules are host functions.
+	p0 := ProfilingFor(nil).CPUProfiler(HostTime(true))
+	p0.StartProfile()
+	call(p0)
+	call(p0)
+
+	var state bytes.Buffer
+	if err := p0.SaveState(&state); err != nil {
+		t.Fatal(err)
+	}
+
+	p1 := ProfilingFor(nil).CPUProfiler(HostTime(true))
+	if err := p1.RestoreState(&state); err != nil {
+		t.Fatal(err)
+	}
+	p1.StartProfile()
+	call(p1)
+
+	prof := p1.StopProfile(1)
+	if len(prof.Sample) != 1 {
+		t.Fatalf("want 1 sample, got %d", len(prof.Sample))
+	}
+	if count := prof.Sample[0].Value[0]; count != 3 {
+		t.Errorf("want 3 calls, got %d", count)
+	}
+
+	// The state is only merged in the profile that was in progress.
+	p1.StartProfile()
+	call(p1)
+	if count := p1.StopProfile(1).Sample[0].Value[0]; count != 1 {
+		t.Errorf("want 1 call, got %d", count)
+	}
+}
+
+func TestCPUProfilerStopProfileContext(t *testing.T) {
+	module := wazerotest.NewModule(nil,
+		wazerotest.NewFunction(func(context.Context, api.Module) {}),
+	)
+	def := module.Function(0).Definition()
+	p := ProfilingFor(nil).CPUProfiler(HostTime(true))
+	p.StartProfile()
+
+	f := p.NewFunctionListener(def)
+	f.Before(context.Background(), module, def, nil, experimental.NewStackIterator(experimental.StackFrame{Function: module.Function(0)}))
+	f.After(context.Background(), module, def, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := p.StopProfileContext(ctx, 1); err != context.Canceled {
+		t.Errorf("want context.Canceled, got %v", err)
+	}
+	// The profile is stopped even if it could not be built.
+	if prof := p.StopProfile(1); prof != nil {
+		t.Errorf("profile still in progress after it was canceled")
+	}
+}
+
+func TestCPUProfilerStopProfileAsync(t *testing.T) {
+	module := wazerotest.NewModule(nil,
+		wazerotest.NewFunction(func(context.Context, api.Module) {}),
+	)
+	def := module.Function(0).Definition()
+	p := ProfilingFor(nil).CPUProfiler(HostTime(true))
+	f := p.NewFunctionListener(def)
+	call := func() {
+		f.Before(context.Background(), module, def, nil, experimental.NewStackIterator(experimental.StackFrame{Function: module.Function(0)}))
+		f.After(context.Background(), module, def, nil)
+	}
+
+	p.StartProfile()
+	call()
+	pending := p.StopProfileAsync(context.Background(), 1)
+	// The next profile starts without waiting for the previous one.
+	if !p.StartProfile() {
+		t.Fatal("profile not restarted")
+	}
+	call()
+	call()
+
+	prof, err := pending.Wait(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(prof.Sample) != 1 || prof.Sample[0].Value[0] != 1 {
+		t.Errorf("wrong samples in the first profile: %v", prof.Sample)
+	}
+	select {
+	case <-pending.Done():
+	default:
+		t.Error("profile built but not done")
+	}
+
+	prof, err = p.StopProfileAsync(context.Background(), 1).Wait(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(prof.Sample) != 1 || prof.Sample[0].Value[0] != 2 {
+		t.Errorf("wrong samples in the second profile: %v", prof.Sample)
+	}
+
+	// Profiles are nil when the profiler is not recording.
+	if prof, err := p.StopProfileAsync(context.Background(), 1).Wait(context.Background()); prof != nil || err != nil {
+		t.Errorf("profile of stopped profiler: %v, %v", prof, err)
+	}
+}
+
+func TestCPUProfilerMaxStacks(t *testing.T) {
+	module := wazerotest.NewModule(nil,
+		wazerotest.NewFunction(func(context.Context, api.Module) {}),
+	)
+	def := module.Function(0).Definition()
+	p := ProfilingFor(nil).CPUProfiler(HostTime(true), MaxCPUStacks(stackCounterShards))
+	p.StartProfile()
+
+	f := p.NewFunctionListener(def)
+	for _, si := range benchmarkStacks(module, 100, 2) {
+		f.Before(context.Background(), module, def, nil, si.reset())
+		f.After(context.Background(), module, def, nil)
+	}
+
+	prof := p.StopProfile(1)
+	if err := prof.CheckValid(); err != nil {
+		t.Fatal(err)
+	}
+	var total, dropped int64
+	for _, sample := range prof.Sample {
+		total += sample.Value[0]
+		if fn := sample.Location[0].Line[0].Function; fn.Name == "[dropped]" {
+			dropped += sample.Value[0]
+		}
+	}
+	if total != 100 {
+		t.Errorf("wrong number of calls: want 100, got %d", total)
+	}
+	if dropped == 0 || len(prof.Sample) > stackCounterShards+1 {
+		t.Errorf("stacks not dropped: %d samples, %d calls dropped", len(prof.Sample), dropped)
+	}
+	if n := p.p.metrics.dropped.Load(); n != uint64(dropped) {
+		t.Errorf("wrong number of dropped samples: want %d, got %d", dropped, n)
+	}
+}
+
+func TestCPUProfilerConfidenceIntervals(t *testing.T) {
+	// wazerotest functions are host functions.
+	p := ProfilingFor(nil).CPUProfiler(ConfidenceIntervals(0.95), HostTime(true))
+
+	module := wazerotest.NewModule(nil,
+		wazerotest.NewFunction(func(context.Context, api.Module) {}),
+	)
+	trace := makeStackTraceFromFrames([]experimental.StackFrame{
+		{Function: module.Function(0)},
+	})
+
+	p.StartProfile()
+	for i := 0; i < 4; i++ {
+		p.counts.observe(trace, 10)
+	}
+	prof := p.StopProfile(0.5)
+
+	wantTypes := []string{"samples", "samples_lower", "samples_upper", "cpu_estimate", "cpu_estimate_lower", "cpu_estimate_upper", "cpu"}
+	if len(prof.SampleType) != len(wantTypes) {
+		t.Fatalf("wrong number of sample types: %d", len(prof.SampleType))
+	}
+	for i, st := range prof.SampleType {
+		if st.Type != wantTypes[i] {
+			t.Errorf("wrong sample type %d: want %q, got %q", i, wantTypes[i], st.Type)
+		}
+	}
+
+	if len(prof.Sample) != 1 {
+		t.Fatalf("wrong number of samples: %d", len(prof.Sample))
+	}
+	// 4 calls of 10ns sampled at 50%: the standard error of the number of
+	// calls is sqrt(4*0.5)/0.5, and sqrt(400*0.5)/0.5 for the time. The lower
+	// bounds cannot be less than what was observed.
+	want := []int64{8, 4, 14, 80, 40, 135, 40}
+	for i, v := range prof.Sample[0].Value {
+		if v != want[i] {
+			t.Errorf("wrong value of %s: want %d, got %d", wantTypes[i], want[i], v)
+		}
+	}
 }
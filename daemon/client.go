@@ -0,0 +1,69 @@
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Client sends the modules and samples of a host to a profiling daemon.
+type Client struct {
+	// Address of the daemon, e.g. "http://localhost:4000".
+	URL string
+	// Client used to send the requests. Default to http.DefaultClient.
+	Client *http.Client
+}
+
+// Register registers the module with the given name to the daemon, and
+// returns the id to send its samples with.
+func (c *Client) Register(ctx context.Context, name string, wasm []byte) (string, error) {
+	query := url.Values{}
+	query.Set("name", name)
+	var info ModuleInfo
+	if err := c.do(ctx, "/v1/modules?"+query.Encode(), bytes.NewReader(wasm), &info); err != nil {
+		return "", err
+	}
+	return info.ID, nil
+}
+
+// Send sends the samples of the module with the given id to the daemon.
+func (c *Client) Send(ctx context.Context, id string, samples []Sample) error {
+	var body bytes.Buffer
+	e := json.NewEncoder(&body)
+	for _, sample := range samples {
+		if err := e.Encode(sample); err != nil {
+			return err
+		}
+	}
+	return c.do(ctx, "/v1/modules/"+url.PathEscape(id)+"/samples", &body, nil)
+}
+
+func (c *Client) do(ctx context.Context, path string, body io.Reader, res any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(c.URL, "/")+path, body)
+	if err != nil {
+		return err
+	}
+	client := c.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("wzprof daemon: %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	if res == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(res)
+}
@@ -0,0 +1,456 @@
+// Package daemon implements a profiling daemon to which wazero hosts stream the
+// samples of their guests, so the symbolization, storage, and serving of the
+// profiles happen outside of latency-sensitive hosts.
+//
+// Hosts register the modules they run, then send samples made of the function
+// indexes and source offsets of the stack frames, which are cheap to capture:
+//
+//	c := &daemon.Client{URL: "http://localhost:4000"}
+//	id, err := c.Register(ctx, "app.wasm", wasmCode)
+//	...
+//	err = c.Send(ctx, id, []daemon.Sample{
+//		{Type: daemon.CPU, Stack: wzprof.StackFrames(si), Values: []int64{1, elapsed}},
+//	})
+//
+// The daemon exposes the following HTTP API:
+//
+//	POST /v1/modules?name=<name>[&symbolizer=<dwarf|names|none>]  register a module
+//	GET  /v1/modules                                              list the modules
+//	POST /v1/modules/<id>/samples                                 add samples
+//	GET  /v1/modules/<id>/cpu                                     current cpu profile
+//	GET  /v1/modules/<id>/memory                                  current memory profile
+//	GET  /v1/modules/<id>/profiles                                list stored profiles
+//	GET  /v1/modules/<id>/profiles/<file>                         get a stored profile
+//
+// Samples are sent as a stream of JSON objects, see Sample.
+package daemon
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/pprof/profile"
+	"github.com/tetratelabs/wazero"
+
+	"github.com/stealthrocket/wzprof"
+)
+
+// Types of the samples sent to the daemon.
+const (
+	// CPU samples have two values: the number of calls, and the time spent
+	// in the calls in nanoseconds.
+	CPU = "cpu"
+	// Memory samples have two values: the number of allocations, and the
+	// number of bytes allocated.
+	Memory = "memory"
+)
+
+// Sample is a sample of a stack trace recorded by a host.
+type Sample struct {
+	// Type of the sample, either CPU or Memory.
+	Type string `json:"type"`
+	// Frames of the stack trace, starting with the innermost call.
+	Stack []wzprof.Frame `json:"stack"`
+	// Values of the sample, their meaning depends on the type.
+	Values []int64 `json:"values"`
+}
+
+// Config is the configuration of a Server.
+type Config struct {
+	// Directory where the profiles are stored, in a sub-directory per module.
+	// The profiles are not stored if empty.
+	Dir string
+	// Number of profiles of each type retained per module. All the profiles
+	// are retained if zero.
+	Keep int
+	// Period at which the profiles are built from the samples, and stored.
+	// Default to 60 seconds.
+	RotationPeriod time.Duration
+	// Maximum size of the modules registered to the daemon. Default to
+	// 256 MiB.
+	MaxModuleSize int64
+}
+
+// Server is the HTTP server of a profiling daemon.
+type Server struct {
+	config  Config
+	runtime wazero.Runtime
+
+	mutex   sync.Mutex
+	modules map[string]*module
+}
+
+type module struct {
+	id   string
+	name string
+	cpu  *wzprof.SampleSet
+	mem  *wzprof.SampleSet
+	sink wzprof.ProfileSink
+	dir  string
+}
+
+// New creates a daemon server. The server uses a wazero runtime to compile
+// the modules registered to it, which is released by Close.
+func New(ctx context.Context, config Config) *Server {
+	if config.RotationPeriod <= 0 {
+		config.RotationPeriod = 60 * time.Second
+	}
+	if config.MaxModuleSize <= 0 {
+		config.MaxModuleSize = 256 << 20
+	}
+	return &Server{
+		config: config,
+		// The modules are never instantiated, they are only compiled to
+		// read their symbols.
+		runtime: wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfigInterpreter().
+			WithCustomSections(true)),
+		modules: make(map[string]*module),
+	}
+}
+
+// Close releases the resources of the server.
+func (s *Server) Close(ctx context.Context) error {
+	return s.runtime.Close(ctx)
+}
+
+// Run stores the profiles of the modules every RotationPeriod until ctx is
+// canceled, then stores the profiles of the samples received since the last
+// rotation. Errors to store profiles do not interrupt Run, the last one is
+// returned.
+func (s *Server) Run(ctx context.Context) error {
+	ticker := time.NewTicker(s.config.RotationPeriod)
+	defer ticker.Stop()
+
+	var lastErr error
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.Rotate(ctx); err != nil {
+				lastErr = err
+			}
+		case <-ctx.Done():
+			if err := s.Rotate(context.Background()); err != nil {
+				lastErr = err
+			}
+			return lastErr
+		}
+	}
+}
+
+// Rotate builds the profiles of the samples received since the previous
+// rotation, and stores them.
+func (s *Server) Rotate(ctx context.Context) error {
+	var errs []error
+	for _, m := range s.listModules() {
+		cpu, err := m.cpu.Flush(ctx)
+		if err != nil {
+			return err
+		}
+		mem, err := m.mem.Flush(ctx)
+		if err != nil {
+			return err
+		}
+		if m.sink == nil {
+			continue
+		}
+		profiles := &wzprof.Profiles{
+			Start:  time.Unix(0, cpu.TimeNanos),
+			End:    time.Now(),
+			CPU:    cpu,
+			Memory: mem,
+		}
+		if err := m.sink(ctx, profiles); err != nil {
+			errs = append(errs, fmt.Errorf("storing profiles of %s: %w", m.name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Register registers the module to the daemon, and returns its id. Registering
+// the same module again returns the same id.
+//
+// The symbolizer is one of "dwarf", "names", or "none" (see
+// wzprof.Profiling.SetSymbolizer). If empty, the module is symbolized with its
+// DWARF sections if it has some, or with its name section otherwise.
+func (s *Server) Register(ctx context.Context, name string, wasm []byte, symbolizer string) (string, error) {
+	sum := sha256.Sum256(wasm)
+	id := hex.EncodeToString(sum[:16])
+
+	s.mutex.Lock()
+	_, ok := s.modules[id]
+	s.mutex.Unlock()
+	if ok {
+		return id, nil
+	}
+
+	if err := wzprof.CheckModule(wasm); err != nil {
+		return "", fmt.Errorf("checking module: %w", err)
+	}
+	compiled, err := s.runtime.CompileModule(ctx, wasm)
+	if err != nil {
+		return "", fmt.Errorf("compiling module: %w", err)
+	}
+	defer compiled.Close(ctx)
+
+	if symbolizer == "" {
+		symbolizer = "names"
+		for _, section := range compiled.CustomSections() {
+			if section.Name() == ".debug_info" {
+				symbolizer = "dwarf"
+			}
+		}
+	}
+	switch symbolizer {
+	case "dwarf", "names", "none":
+	default:
+		// The samples have the stacks of the wasm code, the symbolizers of
+		// the language interpreters cannot be used.
+		return "", fmt.Errorf("unsupported symbolizer: %q", symbolizer)
+	}
+
+	p := wzprof.ProfilingFor(wasm)
+	if name != "" {
+		p.SetModuleName(name)
+	}
+	if err := p.SetSymbolizer(symbolizer); err != nil {
+		return "", err
+	}
+	if err := p.Prepare(compiled); err != nil {
+		return "", fmt.Errorf("preparing module: %w", err)
+	}
+
+	m := &module{
+		id:   id,
+		name: name,
+		cpu: p.NewSampleSet([]*profile.ValueType{
+			{Type: "samples", Unit: "count"},
+			{Type: "cpu", Unit: "nanoseconds"},
+		}),
+		mem: p.NewSampleSet([]*profile.ValueType{
+			{Type: "alloc_objects", Unit: "count"},
+			{Type: "alloc_space", Unit: "bytes"},
+		}),
+	}
+	if s.config.Dir != "" {
+		m.dir = filepath.Join(s.config.Dir, id)
+		if err := os.MkdirAll(m.dir, 0755); err != nil {
+			return "", err
+		}
+		m.sink = wzprof.FileSink(m.dir, s.config.Keep)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.modules[id]; !ok {
+		s.modules[id] = m
+	}
+	return id, nil
+}
+
+// Add adds the samples to the profiles of the module with the given id.
+func (s *Server) Add(id string, samples ...Sample) error {
+	m := s.module(id)
+	if m == nil {
+		return fmt.Errorf("module not found: %s", id)
+	}
+	for _, sample := range samples {
+		if err := m.add(sample); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *module) add(sample Sample) error {
+	switch sample.Type {
+	case CPU:
+		return m.cpu.Add(sample.Stack, sample.Values)
+	case Memory:
+		return m.mem.Add(sample.Stack, sample.Values)
+	default:
+		return fmt.Errorf("unsupported sample type: %q", sample.Type)
+	}
+}
+
+func (s *Server) module(id string) *module {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.modules[id]
+}
+
+func (s *Server) listModules() []*module {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	modules := make([]*module, 0, len(s.modules))
+	for _, m := range s.modules {
+		modules = append(modules, m)
+	}
+	sort.Slice(modules, func(i, j int) bool {
+		return modules[i].id < modules[j].id
+	})
+	return modules
+}
+
+// ModuleInfo describes a module registered to the daemon.
+type ModuleInfo struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// ServeHTTP implements the HTTP API of the daemon.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/v1/modules")
+	if path == r.URL.Path {
+		http.NotFound(w, r)
+		return
+	}
+	path = strings.Trim(path, "/")
+	if path == "" {
+		switch r.Method {
+		case http.MethodGet:
+			s.serveModules(w, r)
+		case http.MethodPost:
+			s.serveRegister(w, r)
+		default:
+			serveError(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+		return
+	}
+
+	id, resource, _ := strings.Cut(path, "/")
+	m := s.module(id)
+	if m == nil {
+		serveError(w, http.StatusNotFound, "module not found: "+id)
+		return
+	}
+
+	switch resource, file, _ := strings.Cut(resource, "/"); resource {
+	case "samples":
+		if r.Method != http.MethodPost {
+			serveError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		s.serveSamples(w, r, m)
+	case CPU, Memory:
+		set := m.cpu
+		if resource == Memory {
+			set = m.mem
+		}
+		prof, err := set.Profile(r.Context())
+		if err != nil {
+			serveError(w, http.StatusInternalServerError, "profile canceled")
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", `attachment; filename="profile"`)
+		prof.Write(w)
+	case "profiles":
+		if m.dir == "" {
+			serveError(w, http.StatusNotFound, "profiles are not stored")
+			return
+		}
+		if file == "" {
+			s.serveStoredProfiles(w, m)
+			return
+		}
+		if filepath.Base(file) != file || !strings.HasSuffix(file, ".pprof") {
+			serveError(w, http.StatusBadRequest, "invalid profile name: "+file)
+			return
+		}
+		http.ServeFile(w, r, filepath.Join(m.dir, file))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) serveModules(w http.ResponseWriter, r *http.Request) {
+	modules := s.listModules()
+	infos := make([]ModuleInfo, len(modules))
+	for i, m := range modules {
+		infos[i] = ModuleInfo{ID: m.id, Name: m.name}
+	}
+	serveJSON(w, infos)
+}
+
+func (s *Server) serveRegister(w http.ResponseWriter, r *http.Request) {
+	wasm, err := io.ReadAll(io.LimitReader(r.Body, s.config.MaxModuleSize+1))
+	if err != nil {
+		serveError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if int64(len(wasm)) > s.config.MaxModuleSize {
+		serveError(w, http.StatusRequestEntityTooLarge, "module too large")
+		return
+	}
+	name := r.FormValue("name")
+	id, err := s.Register(r.Context(), name, wasm, r.FormValue("symbolizer"))
+	if err != nil {
+		serveError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	serveJSON(w, ModuleInfo{ID: id, Name: name})
+}
+
+// serveSamples adds the samples of the request body as they are received, so
+// hosts can stream them in a long-running request.
+func (s *Server) serveSamples(w http.ResponseWriter, r *http.Request, m *module) {
+	d := json.NewDecoder(bufio.NewReader(r.Body))
+	n := 0
+	for {
+		var sample Sample
+		if err := d.Decode(&sample); err != nil {
+			if err == io.EOF {
+				break
+			}
+			serveError(w, http.StatusBadRequest, fmt.Sprintf("sample %d: %s", n, err))
+			return
+		}
+		if err := m.add(sample); err != nil {
+			serveError(w, http.StatusBadRequest, fmt.Sprintf("sample %d: %s", n, err))
+			return
+		}
+		n++
+	}
+	serveJSON(w, struct {
+		Samples int `json:"samples"`
+	}{n})
+}
+
+func (s *Server) serveStoredProfiles(w http.ResponseWriter, m *module) {
+	entries, err := os.ReadDir(m.dir)
+	if err != nil {
+		serveError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	names := []string{}
+	for _, e := range entries {
+		if strings.HasSuffix(e.Name(), ".pprof") {
+			names = append(names, e.Name())
+		}
+	}
+	serveJSON(w, names)
+}
+
+func serveJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func serveError(w http.ResponseWriter, status int, txt string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+	fmt.Fprintln(w, txt)
+}
@@ -0,0 +1,100 @@
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/google/pprof/profile"
+
+	"github.com/stealthrocket/wzprof"
+)
+
+func TestDaemon(t *testing.T) {
+	ctx := context.Background()
+	s := New(ctx, Config{Dir: t.TempDir(), Keep: 1})
+	defer s.Close(ctx)
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	wasm, err := os.ReadFile("../testdata/c/simple.wasm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Client{URL: srv.URL}
+	id, err := c.Register(ctx, "simple.wasm", wasm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, err := c.Register(ctx, "simple.wasm", wasm); err != nil || again != id {
+		t.Fatalf("registering the module again returned %q, %v", again, err)
+	}
+
+	// func1 (9) called by _start (8).
+	stack := []wzprof.Frame{{Function: 9}, {Function: 8}}
+	err = c.Send(ctx, id, []Sample{
+		{Type: CPU, Stack: stack, Values: []int64{1, 100}},
+		{Type: CPU, Stack: stack, Values: []int64{1, 50}},
+		{Type: Memory, Stack: stack, Values: []int64{1, 32}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Send(ctx, id, []Sample{{Type: CPU, Stack: stack, Values: []int64{1}}}); err == nil {
+		t.Error("no error sending a sample with missing values")
+	}
+
+	prof := getProfile(t, srv.URL+"/v1/modules/"+id+"/cpu")
+	if len(prof.Sample) != 1 {
+		t.Fatalf("wrong number of samples: %d", len(prof.Sample))
+	}
+	if v := prof.Sample[0].Value; v[0] != 2 || v[1] != 150 {
+		t.Errorf("wrong sample values: %v", v)
+	}
+	if name := prof.Sample[0].Location[0].Line[0].Function.Name; name != "func1" {
+		t.Errorf("wrong function name: %q", name)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := s.Rotate(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if prof := getProfile(t, srv.URL+"/v1/modules/"+id+"/cpu"); len(prof.Sample) != 0 {
+		t.Errorf("samples remain after rotation: %d", len(prof.Sample))
+	}
+
+	res, err := http.Get(srv.URL + "/v1/modules/" + id + "/profiles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	var names []string
+	if err := json.NewDecoder(res.Body).Decode(&names); err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 2 {
+		t.Fatalf("wrong stored profiles: %v", names)
+	}
+	getProfile(t, srv.URL+"/v1/modules/"+id+"/profiles/"+names[0])
+}
+
+func getProfile(t *testing.T, url string) *profile.Profile {
+	t.Helper()
+	res, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("GET %s: %s", url, res.Status)
+	}
+	prof, err := profile.Parse(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return prof
+}
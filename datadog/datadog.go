@@ -0,0 +1,194 @@
+// Package datadog uploads the profiles of wzprof profilers to Datadog, so the
+// profiles of WebAssembly guests appear next to the profiles of the host
+// service.
+package datadog
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/google/pprof/profile"
+
+	"github.com/stealthrocket/wzprof"
+)
+
+// Config is the configuration of an Uploader.
+type Config struct {
+	// URL of the profiling endpoint of the Datadog agent. Default to
+	// "http://localhost:8126/profiling/v1/input".
+	AgentURL string
+	// API key used to upload the profiles directly to the Datadog intake,
+	// without an agent. AgentURL is ignored when it is set.
+	APIKey string
+	// Datadog site of the intake. Default to "datadoghq.com".
+	Site string
+	// Unified service tags of the profiles.
+	Service string
+	Env     string
+	Version string
+	// Additional tags of the profiles, formatted as "key:value".
+	Tags []string
+	// Period at which the profiles are uploaded. Default to 60 seconds, which
+	// is the period of the Datadog profilers.
+	UploadRate time.Duration
+	// Sample rate configured on the profilers, used to scale the profiles.
+	// Default to 1.
+	SampleRate float64
+	// Client used to send the requests. Default to http.DefaultClient.
+	Client *http.Client
+}
+
+// Uploader periodically snapshots the profilers of a guest and uploads them
+// to Datadog in a single batch.
+//
+// The uploader drives the CPU profiler: it starts a new profile each time the
+// previous one is uploaded. The profiler should not be used by other
+// components (such as the pprof http handler) at the same time.
+type Uploader struct {
+	config   Config
+	profiler *wzprof.ContinuousProfiler
+}
+
+// New creates an Uploader of the profiles of cpu and mem, either of which may
+// be nil. The CPU profile starts recording immediately.
+func New(config Config, cpu *wzprof.CPUProfiler, mem *wzprof.MemoryProfiler) *Uploader {
+	if config.AgentURL == "" {
+		config.AgentURL = "http://localhost:8126/profiling/v1/input"
+	}
+	if config.Site == "" {
+		config.Site = "datadoghq.com"
+	}
+	if config.UploadRate <= 0 {
+		config.UploadRate = 60 * time.Second
+	}
+	if config.Client == nil {
+		config.Client = http.DefaultClient
+	}
+	u := &Uploader{config: config}
+	u.profiler = wzprof.NewContinuousProfiler(cpu, mem, u.upload,
+		wzprof.RotationPeriod(config.UploadRate),
+		wzprof.ProfileSampleRate(config.SampleRate),
+	)
+	return u
+}
+
+// Run uploads the profiles every UploadRate until ctx is canceled, then
+// uploads the profiles recorded since the last upload. Errors to upload
+// profiles do not interrupt Run, the last one is returned.
+func (u *Uploader) Run(ctx context.Context) error {
+	return u.profiler.Run(ctx)
+}
+
+// event is the metadata of a batch of profiles.
+type event struct {
+	Attachments  []string `json:"attachments"`
+	TagsProfiler string   `json:"tags_profiler"`
+	Start        string   `json:"start"`
+	End          string   `json:"end"`
+	Family       string   `json:"family"`
+	Version      string   `json:"version"`
+}
+
+// Upload sends the profiles recorded since the previous call to Datadog.
+func (u *Uploader) Upload(ctx context.Context) error {
+	return u.profiler.Rotate(ctx)
+}
+
+func (u *Uploader) upload(ctx context.Context, profiles *wzprof.Profiles) error {
+	// The sample types of the profiles are the ones of the Go profiler, so
+	// the profiles are reported as the "go" family for Datadog to recognize
+	// them.
+	attachments := map[string]*profile.Profile{}
+	if profiles.CPU != nil {
+		attachments["cpu.pprof"] = profiles.CPU
+	}
+	if profiles.Memory != nil {
+		attachments["delta-heap.pprof"] = profiles.Memory
+	}
+	if len(attachments) == 0 {
+		return nil
+	}
+
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+
+	e := event{
+		TagsProfiler: strings.Join(u.tags(), ","),
+		Start:        profiles.Start.UTC().Format(time.RFC3339Nano),
+		End:          profiles.End.UTC().Format(time.RFC3339Nano),
+		Family:       "go",
+		Version:      "4",
+	}
+	for _, name := range []string{"cpu.pprof", "delta-heap.pprof"} {
+		if prof, ok := attachments[name]; ok {
+			e.Attachments = append(e.Attachments, name)
+			part, err := w.CreateFormFile(name, name)
+			if err != nil {
+				return err
+			}
+			if err := prof.Write(part); err != nil {
+				return err
+			}
+		}
+	}
+
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Disposition", `form-data; name="event"; filename="event.json"`)
+	h.Set("Content-Type", "application/json")
+	part, err := w.CreatePart(h)
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(part).Encode(e); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	url := u.config.AgentURL
+	if u.config.APIKey != "" {
+		url = "https://intake.profile." + u.config.Site + "/api/v2/profile"
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	if u.config.APIKey != "" {
+		req.Header.Set("DD-API-KEY", u.config.APIKey)
+	}
+
+	res, err := u.config.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("datadog: uploading profiles: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+		return fmt.Errorf("datadog: uploading profiles: %s: %s", res.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+func (u *Uploader) tags() []string {
+	tags := []string{"runtime:wasm", "profiler:wzprof"}
+	if u.config.Service != "" {
+		tags = append(tags, "service:"+u.config.Service)
+	}
+	if u.config.Env != "" {
+		tags = append(tags, "env:"+u.config.Env)
+	}
+	if u.config.Version != "" {
+		tags = append(tags, "version:"+u.config.Version)
+	}
+	return append(tags, u.config.Tags...)
+}
@@ -0,0 +1,143 @@
+package datadog
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/pprof/profile"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+	"github.com/tetratelabs/wazero/experimental/wazerotest"
+
+	"github.com/stealthrocket/wzprof"
+)
+
+func TestUploader(t *testing.T) {
+	type upload struct {
+		event event
+		profs map[string]*profile.Profile
+	}
+	var uploads []upload
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v2/profile" {
+			t.Errorf("wrong path: %s", r.URL.Path)
+		}
+		if key := r.Header.Get("DD-API-KEY"); key != "secret" {
+			t.Errorf("wrong api key: %q", key)
+		}
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			t.Error(err)
+			return
+		}
+		u := upload{profs: make(map[string]*profile.Profile)}
+
+		f, _, err := r.FormFile("event")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if err := json.NewDecoder(f).Decode(&u.event); err != nil {
+			t.Error(err)
+			return
+		}
+		for _, name := range u.event.Attachments {
+			f, _, err := r.FormFile(name)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			prof, err := profile.Parse(f)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			u.profs[name] = prof
+		}
+		uploads = append(uploads, u)
+	}))
+	defer server.Close()
+
+	p := wzprof.ProfilingFor(nil)
+	mem := p.MemoryProfiler()
+
+	malloc := wazerotest.NewFunction(func(ctx context.Context, mod api.Module, size uint32) uint32 {
+		return 0
+	})
+	malloc.FunctionName = "malloc"
+	module := wazerotest.NewModule(nil, malloc)
+	def := module.Function(0).Definition()
+	lstn := mem.NewFunctionListener(def)
+	stack := []experimental.StackFrame{{Function: module.Function(0)}}
+
+	alloc := func(size uint64) {
+		ctx := context.Background()
+		lstn.Before(ctx, module, def, []uint64{size}, experimental.NewStackIterator(stack...))
+		lstn.After(ctx, module, def, []uint64{0x1000})
+	}
+
+	uploader := New(Config{
+		APIKey:  "secret",
+		Service: "svc",
+		Env:     "prod",
+		Tags:    []string{"region:us"},
+	}, p.CPUProfiler(), mem)
+	// The intake URL is derived from the site, point it at the test server.
+	uploader.config.Site = "example.com"
+	uploader.config.Client = &http.Client{
+		Transport: rewriteTransport{strings.TrimPrefix(server.URL, "http://")},
+	}
+
+	alloc(10)
+	alloc(10)
+	if err := uploader.Upload(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	alloc(32)
+	if err := uploader.Upload(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(uploads) != 2 {
+		t.Fatalf("wrong number of uploads: want 2, got %d", len(uploads))
+	}
+
+	for i, want := range [][]int64{{2, 20}, {1, 32}} {
+		u := uploads[i]
+		if tags := u.event.TagsProfiler; tags != "runtime:wasm,profiler:wzprof,service:svc,env:prod,region:us" {
+			t.Errorf("wrong tags of upload %d: %q", i, tags)
+		}
+		if u.event.Family != "go" || u.event.Start == "" || u.event.End == "" {
+			t.Errorf("wrong event of upload %d: %+v", i, u.event)
+		}
+		if u.profs["cpu.pprof"] == nil {
+			t.Errorf("missing cpu profile in upload %d", i)
+		}
+		// The second memory profile only has the allocations made after the
+		// first upload.
+		prof := u.profs["delta-heap.pprof"]
+		if prof == nil {
+			t.Fatalf("missing memory profile in upload %d", i)
+		}
+		if len(prof.Sample) != 1 {
+			t.Fatalf("wrong number of samples in memory profile %d: %d", i, len(prof.Sample))
+		}
+		if v := prof.Sample[0].Value; v[0] != want[0] || v[1] != want[1] {
+			t.Errorf("wrong values in memory profile %d: want %v, got %v", i, want, v)
+		}
+	}
+}
+
+// rewriteTransport sends the requests to a test server over plain http.
+type rewriteTransport struct{ host string }
+
+func (t rewriteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Scheme = "http"
+	req.URL.Host = t.host
+	return http.DefaultTransport.RoundTrip(req)
+}
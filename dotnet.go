@@ -0,0 +1,195 @@
+package wzprof
+
+import (
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+)
+
+// Entry point of the Mono interpreter used by dotnet-wasi builds. Managed code
+// is not compiled to wasm: each call into managed code goes through this
+// function, which executes the IL of the methods in a loop and keeps track of
+// the managed call stack in a linked list of InterpFrame structs.
+//
+// mono_interp_exec_method(InterpFrame *frame, ThreadContext *context, FrameClauseArgs *clause_args)
+const dotnetInterpEntry = "mono_interp_exec_method"
+
+func supportedDotnet(wasmbin []byte) bool {
+	return wasmHasFunctionName(wasmbin, dotnetInterpEntry)
+}
+
+// Padding of fields in the Mono runtime structs, for the wasm32 layout of the
+// runtime shipped with .NET 8.
+//
+// TODO: detect the runtime version and pick the matching offsets.
+const (
+	// InterpFrame.
+	padParentInInterpFrame  = 0
+	padImethodInInterpFrame = 4
+	padIPInInterpFrame      = 20
+	// InterpMethod.
+	padMethodInInterpMethod = 0
+	// MonoMethod.
+	padKlassInMonoMethod = 8
+	padNameInMonoMethod  = 16
+	// MonoClass.
+	padNameInMonoClass      = 44
+	padNamespaceInMonoClass = 48
+)
+
+type dotnetSupport struct{}
+
+func (d *dotnetSupport) Locations(fn experimental.InternalFunction, pc experimental.ProgramCounter) (uint64, []location) {
+	call := fn.(dotnetcall)
+
+	loc := location{
+		// TODO: map the IL offset to a source location using the portable
+		// PDB data embedded in the assemblies.
+		HumanName:  call.name,
+		StableName: call.name,
+	}
+
+	return uint64(call.addr), []location{loc}
+}
+
+func (d *dotnetSupport) Stackiter(mod api.Module, def api.FunctionDefinition, wasmsi experimental.StackIterator) experimental.StackIterator {
+	if def.Name() != dotnetInterpEntry {
+		// Calls to native functions (e.g. malloc) are not attributed to
+		// managed frames.
+		return wasmsi
+	}
+	var framep ptr32
+	if wasmsi.Next() {
+		framep = ptr32(api.DecodeU32(wasmsi.Parameters()[0]))
+	}
+	mem := mod.Memory()
+	if framep != 0 && !dotnetValidFrame(mem, framep) {
+		// The runtime does not have the layout of .NET 8, the names read
+		// with the offsets above would be garbage.
+		return &resumedStackIterator{StackIterator: wasmsi}
+	}
+	return &dotnetstackiter{
+		mem:    wasmMemory{mem},
+		framep: framep,
+	}
+}
+
+// dotnetValidFrame returns true if the method of the InterpFrame at framep
+// has a class, and if both are named like managed code is.
+func dotnetValidFrame(mem api.Memory, framep ptr32) bool {
+	imethodp, ok := mem.ReadUint32Le(uint32(framep + padImethodInInterpFrame))
+	if !ok || imethodp == 0 {
+		return false
+	}
+	methodp, ok := mem.ReadUint32Le(imethodp + padMethodInInterpMethod)
+	if !ok || methodp == 0 {
+		return false
+	}
+	namep, ok := mem.ReadUint32Le(methodp + padNameInMonoMethod)
+	if !ok || !dotnetIdentifier(derefCString(wasmMemory{mem}, ptr32(namep))) {
+		return false
+	}
+	klassp, ok := mem.ReadUint32Le(methodp + padKlassInMonoMethod)
+	if !ok || klassp == 0 {
+		return false
+	}
+	namep, ok = mem.ReadUint32Le(klassp + padNameInMonoClass)
+	return ok && dotnetIdentifier(derefCString(wasmMemory{mem}, ptr32(namep)))
+}
+
+// dotnetIdentifier returns true if s may be the name of a managed method or
+// class. The compilers generate names with punctuation (.ctor, <Main>$,
+// List`1...), only their length and the printable characters are checked.
+func dotnetIdentifier(s string) bool {
+	if len(s) == 0 || len(s) > 1024 {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] <= ' ' || s[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// resumedStackIterator continues walking a stack iterator which was already
+// positioned on its first frame.
+type resumedStackIterator struct {
+	experimental.StackIterator
+	started bool
+}
+
+func (s *resumedStackIterator) Next() bool {
+	if !s.started {
+		s.started = true
+		return true
+	}
+	return s.StackIterator.Next()
+}
+
+type dotnetstackiter struct {
+	mem     vmem
+	started bool
+	framep  ptr32 // InterpFrame*
+}
+
+func (d *dotnetstackiter) Next() bool {
+	if !d.started {
+		d.started = true
+		return d.framep != 0
+	}
+
+	oldframe := d.framep
+	d.framep = deref[ptr32](d.mem, d.framep+padParentInInterpFrame)
+	if oldframe == d.framep {
+		d.framep = 0
+		return false
+	}
+	return d.framep != 0
+}
+
+func (d *dotnetstackiter) ProgramCounter() experimental.ProgramCounter {
+	return experimental.ProgramCounter(deref[uint32](d.mem, d.framep+padIPInInterpFrame))
+}
+
+func (d *dotnetstackiter) Function() experimental.InternalFunction {
+	imethodp := deref[ptr32](d.mem, d.framep+padImethodInInterpFrame)
+	methodp := deref[ptr32](d.mem, imethodp+padMethodInInterpMethod)
+	return dotnetcall{interpretedFunction{
+		lang: "dotnet",
+		name: dotnetMethodName(d.mem, methodp),
+		addr: uint32(methodp),
+	}}
+}
+
+func (d *dotnetstackiter) Parameters() []uint64 {
+	return nil
+}
+
+// dotnetMethodName returns the fully qualified name of a MonoMethod, in the
+// form Namespace.Class:Method.
+func dotnetMethodName(m vmem, methodp ptr32) string {
+	if methodp == 0 {
+		return "<unknown>"
+	}
+	name := derefCString(m, deref[ptr32](m, methodp+padNameInMonoMethod))
+	klassp := deref[ptr32](m, methodp+padKlassInMonoMethod)
+	if klassp == 0 {
+		return name
+	}
+	klass := derefCString(m, deref[ptr32](m, klassp+padNameInMonoClass))
+	namespace := derefCString(m, deref[ptr32](m, klassp+padNamespaceInMonoClass))
+	if namespace != "" {
+		klass = namespace + "." + klass
+	}
+	return klass + ":" + name
+}
+
+// dotnetcall represents a call to a managed method executed by the Mono
+// interpreter.
+type dotnetcall struct {
+	interpretedFunction
+}
+
+func (f dotnetcall) Definition() api.FunctionDefinition {
+	return f
+}
@@ -0,0 +1,148 @@
+package wzprof
+
+import (
+	"context"
+	"testing"
+
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+	"github.com/tetratelabs/wazero/experimental/wazerotest"
+)
+
+// testMemory is a helper writing the structs of language runtimes walked by
+// the stack iterators to the memory of a test module.
+type testMemory struct {
+	mem  api.Memory
+	next uint32
+}
+
+func (m *testMemory) alloc(size uint32) uint32 {
+	addr := m.next
+	m.next += (size + 7) &^ 7
+	return addr
+}
+
+func (m *testMemory) cstring(s string) uint32 {
+	addr := m.alloc(uint32(len(s)) + 1)
+	m.mem.WriteString(addr, s)
+	return addr
+}
+
+func (m *testMemory) dotnetClass(namespace, name string) uint32 {
+	klass := m.alloc(64)
+	m.mem.WriteUint32Le(klass+padNameInMonoClass, m.cstring(name))
+	m.mem.WriteUint32Le(klass+padNamespaceInMonoClass, m.cstring(namespace))
+	return klass
+}
+
+func (m *testMemory) dotnetFrame(parent, klass uint32, name string) uint32 {
+	method := m.alloc(32)
+	m.mem.WriteUint32Le(method+padKlassInMonoMethod, klass)
+	m.mem.WriteUint32Le(method+padNameInMonoMethod, m.cstring(name))
+	imethod := m.alloc(8)
+	m.mem.WriteUint32Le(imethod+padMethodInInterpMethod, method)
+	frame := m.alloc(32)
+	m.mem.WriteUint32Le(frame+padParentInInterpFrame, parent)
+	m.mem.WriteUint32Le(frame+padImethodInInterpFrame, imethod)
+	m.mem.WriteUint32Le(frame+padIPInInterpFrame, 42)
+	return frame
+}
+
+func dotnetStackNames(si experimental.StackIterator) (names []string) {
+	for si.Next() {
+		names = append(names, si.Function().Definition().Name())
+	}
+	return names
+}
+
+func TestDotnetStackIterator(t *testing.T) {
+	interp := wazerotest.NewFunction(func(ctx context.Context, mod api.Module, frame, context, clauseArgs uint32) {})
+	interp.FunctionName = dotnetInterpEntry
+	module := wazerotest.NewModule(wazerotest.NewFixedMemory(wazerotest.PageSize), interp)
+
+	m := &testMemory{mem: module.Memory(), next: 8}
+	program := m.dotnetClass("App", "Program")
+	list := m.dotnetClass("System.Collections.Generic", "List`1")
+	outer := m.dotnetFrame(0, program, "Main")
+	inner := m.dotnetFrame(outer, list, ".ctor")
+
+	d := &dotnetSupport{}
+	si := d.Stackiter(module, interp.Definition(), experimental.NewStackIterator(
+		experimental.StackFrame{Function: interp, Params: []uint64{uint64(inner), 0, 0}},
+	))
+	want := []string{"System.Collections.Generic.List`1:.ctor", "App.Program:Main"}
+	names := dotnetStackNames(si)
+	if len(names) != len(want) {
+		t.Fatalf("wrong frames: want %q, got %q", want, names)
+	}
+	for i := range want {
+		if names[i] != want[i] {
+			t.Errorf("frame %d: want %q, got %q", i, want[i], names[i])
+		}
+	}
+}
+
+func TestDotnetFunctionDefinition(t *testing.T) {
+	interp := wazerotest.NewFunction(func(ctx context.Context, mod api.Module, frame, context, clauseArgs uint32) {})
+	interp.FunctionName = dotnetInterpEntry
+	module := wazerotest.NewModule(wazerotest.NewFixedMemory(wazerotest.PageSize), interp)
+
+	m := &testMemory{mem: module.Memory(), next: 8}
+	frame := m.dotnetFrame(0, m.dotnetClass("App", "Program"), "Main")
+
+	d := &dotnetSupport{}
+	si := d.Stackiter(module, interp.Definition(), experimental.NewStackIterator(
+		experimental.StackFrame{Function: interp, Params: []uint64{uint64(frame), 0, 0}},
+	))
+	if !si.Next() {
+		t.Fatal("no managed frame")
+	}
+	// Managed methods are not functions of the wasm module, callers of the
+	// stack iterator API get empty values instead of a panic.
+	if params := si.Parameters(); params != nil {
+		t.Errorf("parameters of a managed frame: %v", params)
+	}
+	fn := si.Function()
+	def := fn.Definition()
+	if offset := fn.SourceOffsetForPC(si.ProgramCounter()); offset != 0 {
+		t.Errorf("source offset of a managed method: %d", offset)
+	}
+	if module := def.ModuleName(); module != "dotnet" {
+		t.Errorf("wrong module name: want %q, got %q", "dotnet", module)
+	}
+	if _, _, ok := def.Import(); ok {
+		t.Error("managed method reported as imported")
+	}
+	if len(def.ExportNames()) != 0 || len(def.ParamTypes()) != 0 || len(def.ResultTypes()) != 0 ||
+		len(def.ParamNames()) != 0 || len(def.ResultNames()) != 0 || def.GoFunction() != nil {
+		t.Error("managed method has a wasm signature")
+	}
+	if name := def.DebugName(); name != "App.Program:Main" {
+		t.Errorf("wrong debug name: want %q, got %q", "App.Program:Main", name)
+	}
+}
+
+func TestDotnetStackIteratorLayoutMismatch(t *testing.T) {
+	interp := wazerotest.NewFunction(func(ctx context.Context, mod api.Module, frame, context, clauseArgs uint32) {})
+	interp.FunctionName = dotnetInterpEntry
+	module := wazerotest.NewModule(wazerotest.NewFixedMemory(wazerotest.PageSize), interp)
+
+	// The method of the frame is named with bytes which are not the ones of
+	// a string, as read at the offsets of .NET 8 in the structs of another
+	// version of the runtime.
+	m := &testMemory{mem: module.Memory(), next: 8}
+	frame := m.dotnetFrame(0, m.dotnetClass("App", "Program"), "Main")
+	imethod, _ := m.mem.ReadUint32Le(frame + padImethodInInterpFrame)
+	method, _ := m.mem.ReadUint32Le(imethod + padMethodInInterpMethod)
+	name, _ := m.mem.ReadUint32Le(method + padNameInMonoMethod)
+	m.mem.Write(name, []byte{0x01, 0xff, 0x00})
+
+	d := &dotnetSupport{}
+	si := d.Stackiter(module, interp.Definition(), experimental.NewStackIterator(
+		experimental.StackFrame{Function: interp, Params: []uint64{uint64(frame), 0, 0}},
+	))
+	names := dotnetStackNames(si)
+	if len(names) != 1 || names[0] != dotnetInterpEntry {
+		t.Errorf("wasm frames not reported: %q", names)
+	}
+}
@@ -1,14 +1,17 @@
 package wzprof
 
 import (
+	"container/list"
 	"debug/dwarf"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"math"
+	"runtime"
 	"sort"
 	"sync"
+	"sync/atomic"
 
 	"github.com/tetratelabs/wazero"
 	"github.com/tetratelabs/wazero/experimental"
@@ -27,6 +30,19 @@ type subprogram struct {
 	CU        *dwarf.Entry
 	Inlines   []entryRanges
 	Namespace string
+
+	// Computed by dwarfmapper.resolve.
+	resolved   bool
+	humanName  string
+	stableName string
+	inlines    []inlinedLocation
+}
+
+// inlinedLocation is the location of a call inlined in a subprogram, which is
+// part of the locations of the source offsets in its ranges.
+type inlinedLocation struct {
+	ranges   []sourceOffsetRange
+	location location
 }
 
 type entryRanges struct {
@@ -42,6 +58,7 @@ type subprogramRange struct {
 type dwarfmapper struct {
 	d           *dwarf.Data
 	subprograms []subprogramRange
+	lines       lineTableCache
 	// once value used to limit the logging output on error
 	onceSourceOffsetNotFound sync.Once
 }
@@ -103,10 +120,13 @@ func newDwarfmapper(p dwarfparser) *dwarfmapper {
 	subprograms := p.Parse()
 	log.Printf("dwarf: parsed %d subprogramm ranges", len(subprograms))
 
-	return &dwarfmapper{
+	d := &dwarfmapper{
 		d:           p.d,
 		subprograms: subprograms,
+		lines:       lineTableCache{limit: maxCachedLineTables},
 	}
+	d.resolve()
+	return d
 }
 
 type dwarfparser struct {
@@ -116,18 +136,69 @@ type dwarfparser struct {
 	subprograms []subprogramRange
 }
 
+// Parse returns the ranges of the subprograms of all the compilation units.
+//
+// Skipping the children of compilation units does not decode them, so they
+// are listed first, then parsed concurrently by GOMAXPROCS workers with their
+// own reader, largest first so the parse does not end waiting for one big unit.
+// The ranges are returned in the order of the compilation units, like if they
+// were parsed sequentially.
 func (d *dwarfparser) Parse() []subprogramRange {
+	var cus []*dwarf.Entry
 	for {
 		ent, err := d.r.Next()
 		if err != nil || ent == nil {
 			break
 		}
 		if ent.Tag == dwarf.TagCompileUnit {
-			d.parseCompileUnit(ent, "")
+			cus = append(cus, ent)
+		}
+		d.r.SkipChildren()
+	}
+
+	// The size of a unit is approximated by the offset of the next one, the
+	// size of the last unit is unknown so it is parsed first.
+	order := make([]int, len(cus))
+	sizes := make([]dwarf.Offset, len(cus))
+	for i := range cus {
+		order[i] = i
+		if i+1 < len(cus) {
+			sizes[i] = cus[i+1].Offset - cus[i].Offset
 		} else {
-			d.r.SkipChildren()
+			sizes[i] = ^dwarf.Offset(0)
 		}
 	}
+	sort.SliceStable(order, func(i, j int) bool { return sizes[order[i]] > sizes[order[j]] })
+
+	parsed := make([][]subprogramRange, len(cus))
+	workers := runtime.GOMAXPROCS(0)
+	if workers > len(cus) {
+		workers = len(cus)
+	}
+	var next atomic.Int64
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			p := dwarfparser{d: d.d, r: d.d.Reader()}
+			for n := int(next.Add(1) - 1); n < len(cus); n = int(next.Add(1) - 1) {
+				i := order[n]
+				p.r.Seek(cus[i].Offset)
+				if _, err := p.r.Next(); err != nil {
+					continue
+				}
+				p.subprograms = nil
+				p.parseCompileUnit(cus[i], "")
+				parsed[i] = p.subprograms
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, subprograms := range parsed {
+		d.subprograms = append(d.subprograms, subprograms...)
+	}
 	return d.subprograms
 }
 
@@ -256,29 +327,11 @@ func (d *dwarfmapper) Locations(fn experimental.InternalFunction, pc experimenta
 		return offset, nil
 	}
 
-	lr, err := d.d.LineReader(spgm.CU)
-	if err != nil || lr == nil {
-		log.Printf("dwarf: failed to read lines: %s\n", err)
+	lines := d.lineTable(spgm.CU)
+	if lines == nil {
 		return offset, nil
 	}
 
-	// TODO: cache this
-	var lines []line
-	var le dwarf.LineEntry
-	for {
-		pos := lr.Tell()
-		err = lr.Next(&le)
-		if errors.Is(err, io.EOF) {
-			break
-		}
-		if err != nil {
-			log.Printf("dwarf: failed to iterate on lines: %s\n", err)
-			break
-		}
-		lines = append(lines, line{Pos: pos, Address: le.Address})
-	}
-	sort.Slice(lines, func(i, j int) bool { return lines[i].Address < lines[j].Address })
-
 	i := sort.Search(len(lines), func(i int) bool { return lines[i].Address >= offset })
 	if i == len(lines) {
 		// no line information for this source offset.
@@ -286,8 +339,8 @@ func (d *dwarfmapper) Locations(fn experimental.InternalFunction, pc experimenta
 		return offset, nil
 	}
 
-	l := lines[i]
-	if l.Address != offset {
+	le := lines[i]
+	if le.Address != offset {
 		// https://github.com/stealthrocket/wazero/blob/867459d7d5ed988a55452d6317ff3cc8451b8ff0/internal/wasmdebug/dwarf.go#L141-L150
 		// If the address doesn't match exactly, the previous
 		// entry is the one that contains the instruction.
@@ -297,56 +350,127 @@ func (d *dwarfmapper) Locations(fn experimental.InternalFunction, pc experimenta
 		// https://github.com/gimli-rs/addr2line/blob/3a2dbaf84551a06a429f26e9c96071bb409b371f/src/lib.rs#L236-L242
 		// https://github.com/kateinoigakukun/wasminspect/blob/f29f052f1b03104da9f702508ac0c1bbc3530ae4/crates/debugger/src/dwarf/mod.rs#L453-L459
 		if i-1 < 0 {
-			log.Printf("dwarf: first line address does not match source (line=%d offset=%d)", l.Address, offset)
+			log.Printf("dwarf: first line address does not match source (line=%d offset=%d)", le.Address, offset)
 			return offset, nil
 		}
-		l = lines[i-1]
-	}
-
-	lr.Seek(l.Pos)
-	err = lr.Next(&le)
-	if err != nil {
-		// l.Pos was created from parsing dwarf, should not
-		// happen.
-		panic("BUG: l.Pos was created from parsing dwarf but got error: " + err.Error())
+		le = lines[i-1]
 	}
 
-	human, stable := d.namesForSubprogram(spgm.Entry, spgm)
-	locations := make([]location, 0, 1+len(spgm.Inlines))
+	locations := make([]location, 0, 1+len(spgm.inlines))
 	locations = append(locations, location{
-		File:       le.File.Name,
-		Line:       int64(le.Line),
-		Column:     int64(le.Column),
+		File:       le.File,
+		Line:       le.Line,
+		Column:     le.Column,
 		Inlined:    false,
-		HumanName:  human,
-		StableName: stable,
+		HumanName:  spgm.humanName,
+		StableName: spgm.stableName,
 	})
 
-	if len(spgm.Inlines) > 0 {
-		files := lr.Files()
+	for _, in := range spgm.inlines {
+		if offsetInRanges(in.ranges, offset) {
+			locations = append(locations, in.location)
+		}
+	}
+
+	return offset, locations
+}
+
+// resolve precomputes the line tables of the compilation units and the names
+// and call sites of the subprograms, so Locations only performs table lookups
+// when profiles are built.
+func (d *dwarfmapper) resolve() {
+	files := make(map[*dwarf.Entry][]*dwarf.LineFile)
+	byOffset := make(map[dwarf.Offset]*subprogram, len(d.subprograms))
+	for _, sr := range d.subprograms {
+		byOffset[sr.Subprogram.Entry.Offset] = sr.Subprogram
+	}
+
+	for _, sr := range d.subprograms {
+		spgm := sr.Subprogram
+		if spgm.resolved {
+			continue // subprograms with multiple ranges
+		}
+		spgm.resolved = true
+
+		if _, ok := files[spgm.CU]; !ok {
+			var lines []lineEntry
+			lines, files[spgm.CU] = d.readLines(spgm.CU)
+			d.lines.put(spgm.CU, lines)
+		}
+		spgm.humanName, spgm.stableName = d.namesForSubprogram(spgm.Entry, spgm, byOffset)
+
+		// The locations of the inlined calls go from the outermost to the
+		// innermost one.
+		cuFiles := files[spgm.CU]
 		for i := len(spgm.Inlines) - 1; i >= 0; i-- {
 			er := spgm.Inlines[i]
 			fileIdx, ok := er.entry.Val(dwarf.AttrCallFile).(int64)
-			if !ok || fileIdx >= int64(len(files)) || !offsetInRanges(er.ranges, offset) {
+			if !ok || fileIdx >= int64(len(cuFiles)) {
 				continue
 			}
 
-			file := files[fileIdx]
+			file := cuFiles[fileIdx]
 			line, _ := er.entry.Val(dwarf.AttrCallLine).(int64)
 			col, _ := er.entry.Val(dwarf.AttrCallLine).(int64)
-			human, stable := d.namesForSubprogram(er.entry, nil)
-			locations = append(locations, location{
-				File:       file.Name,
-				Line:       line,
-				Column:     col,
-				Inlined:    true,
-				StableName: stable,
-				HumanName:  human,
+			human, stable := d.namesForSubprogram(er.entry, nil, byOffset)
+			spgm.inlines = append(spgm.inlines, inlinedLocation{
+				ranges: er.ranges,
+				location: location{
+					File:       file.Name,
+					Line:       line,
+					Column:     col,
+					Inlined:    true,
+					StableName: stable,
+					HumanName:  human,
+				},
 			})
 		}
 	}
+}
 
-	return offset, locations
+// lineTable returns the line table of a compilation unit, sorted by address.
+func (d *dwarfmapper) lineTable(cu *dwarf.Entry) []lineEntry {
+	lines, ok := d.lines.get(cu)
+	if !ok {
+		lines, _ = d.readLines(cu)
+		d.lines.put(cu, lines)
+	}
+	return lines
+}
+
+// readLines returns the line table of a compilation unit sorted by address,
+// and its files.
+func (d *dwarfmapper) readLines(cu *dwarf.Entry) ([]lineEntry, []*dwarf.LineFile) {
+	lr, err := d.d.LineReader(cu)
+	if err != nil || lr == nil {
+		log.Printf("dwarf: failed to read lines: %s\n", err)
+		return nil, nil
+	}
+
+	var lines []lineEntry
+	var le dwarf.LineEntry
+	for {
+		err = lr.Next(&le)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			log.Printf("dwarf: failed to iterate on lines: %s\n", err)
+			break
+		}
+		var file string
+		if le.File != nil {
+			file = le.File.Name
+		}
+		lines = append(lines, lineEntry{
+			Address: le.Address,
+			File:    file,
+			Line:    int64(le.Line),
+			Column:  int64(le.Column),
+		})
+	}
+	sort.Slice(lines, func(i, j int) bool { return lines[i].Address < lines[j].Address })
+	return lines, lr.Files()
 }
 
 func offsetInRanges(ranges []sourceOffsetRange, offset uint64) bool {
@@ -358,18 +482,69 @@ func offsetInRanges(ranges []sourceOffsetRange, offset uint64) bool {
 	return false
 }
 
-// line is used to cache line entries for a given compilation unit.
-type line struct {
-	Pos     dwarf.LineReaderPos
+// Maximum number of line tables of compilation units cached by a dwarfmapper.
+// The tables of modules with many compilation units would not all fit in
+// memory, the least recently used ones are read again when needed.
+const maxCachedLineTables = 128
+
+// lineTableCache is a cache of the line tables of compilation units, which
+// evicts the least recently used tables. It is safe to use concurrently.
+type lineTableCache struct {
+	mutex  sync.Mutex
+	limit  int
+	tables map[*dwarf.Entry]*list.Element
+	lru    list.List // of *lineTable, most recently used first
+}
+
+type lineTable struct {
+	cu    *dwarf.Entry
+	lines []lineEntry
+}
+
+func (c *lineTableCache) get(cu *dwarf.Entry) ([]lineEntry, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	e, ok := c.tables[cu]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(e)
+	return e.Value.(*lineTable).lines, true
+}
+
+func (c *lineTableCache) put(cu *dwarf.Entry, lines []lineEntry) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.tables == nil {
+		c.tables = make(map[*dwarf.Entry]*list.Element)
+	}
+	if e, ok := c.tables[cu]; ok {
+		e.Value.(*lineTable).lines = lines
+		c.lru.MoveToFront(e)
+		return
+	}
+	c.tables[cu] = c.lru.PushFront(&lineTable{cu: cu, lines: lines})
+	for c.lru.Len() > c.limit {
+		e := c.lru.Back()
+		c.lru.Remove(e)
+		delete(c.tables, e.Value.(*lineTable).cu)
+	}
+}
+
+// lineEntry is a row of the line table of a compilation unit.
+type lineEntry struct {
 	Address uint64
+	File    string
+	Line    int64
+	Column  int64
 }
 
 // Returns a human-readable name and the name the most likely to match the one
 // used in the wasm module. Walks up the inlining chain.
 //
 // Subprogram is optional. This function will look for the associated subprogram
-// if spgm is nil.
-func (d *dwarfmapper) namesForSubprogram(e *dwarf.Entry, spgm *subprogram) (string, string) {
+// in byOffset if spgm is nil.
+func (d *dwarfmapper) namesForSubprogram(e *dwarf.Entry, spgm *subprogram, byOffset map[dwarf.Offset]*subprogram) (string, string) {
 	// If an inlined function, grab the name from the origin.
 	var err error
 	r := d.d.Reader()
@@ -386,14 +561,8 @@ func (d *dwarfmapper) namesForSubprogram(e *dwarf.Entry, spgm *subprogram) (stri
 		}
 	}
 
-	// TODO: index
 	if spgm == nil {
-		for _, s := range d.subprograms {
-			if s.Subprogram.Entry.Offset == e.Offset {
-				spgm = s.Subprogram
-				break
-			}
-		}
+		spgm = byOffset[e.Offset]
 	}
 
 	var ns string
@@ -0,0 +1,137 @@
+package wzprof
+
+import (
+	"debug/dwarf"
+	"os"
+	"sort"
+	"testing"
+)
+
+func TestDwarfmapperResolve(t *testing.T) {
+	wasm, err := os.ReadFile("testdata/c/simple.wasm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parser, err := newDwarfParserFromBin(wasm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := newDwarfmapper(parser)
+
+	if len(d.subprograms) == 0 {
+		t.Fatal("no subprograms")
+	}
+	for _, sr := range d.subprograms {
+		spgm := sr.Subprogram
+		if !spgm.resolved || spgm.stableName == "" {
+			t.Errorf("subprogram at offset %d not resolved", spgm.Entry.Offset)
+		}
+		lines := d.lineTable(spgm.CU)
+		if lines == nil {
+			t.Fatalf("no line table for the compilation unit at offset %d", spgm.CU.Offset)
+		}
+		if !sort.SliceIsSorted(lines, func(i, j int) bool { return lines[i].Address < lines[j].Address }) {
+			t.Fatal("line table not sorted by address")
+		}
+	}
+
+	// Resolving locations only looks up the tables.
+	var found bool
+	for _, sr := range d.subprograms {
+		if sr.Range[0] == sr.Range[1] {
+			continue
+		}
+		_, locations := d.Locations(codeOffset(sr.Range[0]), 0)
+		if len(locations) > 0 && locations[0].Line > 0 {
+			found = true
+			break
+		}
+	}
+	if !found {
+		t.Error("no location resolved with lines")
+	}
+}
+
+func TestDwarfparserParse(t *testing.T) {
+	wasm, err := os.ReadFile("testdata/rust/simple/target/wasm32-wasi/debug/simple.wasm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parser, err := newDwarfParserFromBin(wasm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := parser.Parse()
+
+	// The compilation units parsed concurrently produce the ranges that
+	// parsing them in sequence does, in the same order.
+	seq := dwarfparser{d: parser.d, r: parser.d.Reader()}
+	for {
+		ent, err := seq.r.Next()
+		if err != nil || ent == nil {
+			break
+		}
+		if ent.Tag == dwarf.TagCompileUnit {
+			seq.parseCompileUnit(ent, "")
+		} else {
+			seq.r.SkipChildren()
+		}
+	}
+	want := seq.subprograms
+
+	if len(want) == 0 {
+		t.Fatal("no subprograms")
+	}
+	if len(got) != len(want) {
+		t.Fatalf("wrong number of subprogram ranges: want %d, got %d", len(want), len(got))
+	}
+	for i := range want {
+		w, g := want[i], got[i]
+		if g.Range != w.Range ||
+			g.Subprogram.Entry.Offset != w.Subprogram.Entry.Offset ||
+			g.Subprogram.CU.Offset != w.Subprogram.CU.Offset ||
+			g.Subprogram.Namespace != w.Subprogram.Namespace ||
+			len(g.Subprogram.Inlines) != len(w.Subprogram.Inlines) {
+			t.Fatalf("wrong subprogram range %d: want %+v, got %+v", i, w, g)
+		}
+	}
+}
+
+func BenchmarkDwarfparserParse(b *testing.B) {
+	wasm, err := os.ReadFile("testdata/rust/simple/target/wasm32-wasi/debug/simple.wasm")
+	if err != nil {
+		b.Fatal(err)
+	}
+	for i := 0; i < b.N; i++ {
+		parser, err := newDwarfParserFromBin(wasm)
+		if err != nil {
+			b.Fatal(err)
+		}
+		parser.Parse()
+	}
+}
+
+func TestLineTableCache(t *testing.T) {
+	cus := []*dwarf.Entry{{Offset: 1}, {Offset: 2}, {Offset: 3}}
+	c := lineTableCache{limit: 2}
+
+	c.put(cus[0], []lineEntry{{Address: 1}})
+	c.put(cus[1], []lineEntry{{Address: 2}})
+	// Using the first table makes the second one the least recently used.
+	if lines, ok := c.get(cus[0]); !ok || lines[0].Address != 1 {
+		t.Fatalf("wrong table: %v", lines)
+	}
+	c.put(cus[2], []lineEntry{{Address: 3}})
+
+	if _, ok := c.get(cus[1]); ok {
+		t.Error("least recently used table not evicted")
+	}
+	for _, cu := range []*dwarf.Entry{cus[0], cus[2]} {
+		if lines, ok := c.get(cu); !ok || lines[0].Address != uint64(cu.Offset) {
+			t.Errorf("missing table of compilation unit %d", cu.Offset)
+		}
+	}
+	if n := c.lru.Len(); n != 2 {
+		t.Errorf("wrong number of cached tables: %d", n)
+	}
+}
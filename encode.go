@@ -0,0 +1,467 @@
+package wzprof
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/google/pprof/profile"
+)
+
+// Field numbers of the messages of the pprof format, see
+// https://github.com/google/pprof/blob/main/proto/profile.proto
+const (
+	pprofProfileSampleType    = 1
+	pprofProfileSample        = 2
+	pprofProfileMapping       = 3
+	pprofProfileLocation      = 4
+	pprofProfileFunction      = 5
+	pprofProfileStringTable   = 6
+	pprofProfileTimeNanos     = 9
+	pprofProfileDurationNanos = 10
+	pprofProfileComment       = 13
+
+	pprofValueTypeType = 1
+	pprofValueTypeUnit = 2
+
+	pprofSampleLocationID = 1
+	pprofSampleValue      = 2
+	pprofSampleLabel      = 3
+
+	pprofLabelKey = 1
+	pprofLabelStr = 2
+	pprofLabelNum = 3
+
+	pprofMappingID              = 1
+	pprofMappingMemoryStart     = 2
+	pprofMappingMemoryLimit     = 3
+	pprofMappingFilename        = 5
+	pprofMappingBuildID         = 6
+	pprofMappingHasFunctions    = 7
+	pprofMappingHasFilenames    = 8
+	pprofMappingHasLineNumbers  = 9
+	pprofMappingHasInlineFrames = 10
+
+	pprofLocationID        = 1
+	pprofLocationMappingID = 2
+	pprofLocationAddress   = 3
+	pprofLocationLine      = 4
+
+	pprofLineFunctionID = 1
+	pprofLineLine       = 2
+
+	pprofFunctionID         = 1
+	pprofFunctionName       = 2
+	pprofFunctionSystemName = 3
+	pprofFunctionFilename   = 4
+	pprofFunctionStartLine  = 5
+)
+
+// Size of the output buffered before it is written to the compressor.
+const encoderBufferSize = 32 * 1024
+
+// profileEncoder writes a profile in the pprof format, message by message.
+// Protocol buffers allow the elements of repeated fields to be interleaved
+// with other fields, so the samples, locations and strings of a profile are
+// written as they are produced, and only the tables mapping them to their ids
+// are retained.
+type profileEncoder struct {
+	zw      *gzip.Writer
+	buf     []byte
+	msg     []byte // scratch buffer of the message being encoded
+	sub     []byte // scratch buffer of its sub-messages
+	strings map[string]int64
+	err     error
+}
+
+func newProfileEncoder(w io.Writer) *profileEncoder {
+	e := &profileEncoder{
+		zw:      gzip.NewWriter(w),
+		buf:     make([]byte, 0, encoderBufferSize),
+		strings: make(map[string]int64),
+	}
+	// The first string of the table must be the empty string.
+	e.string("")
+	return e
+}
+
+// string returns the index of s in the string table, writing it to the table
+// if it was not there yet.
+func (e *profileEncoder) string(s string) int64 {
+	if i, ok := e.strings[s]; ok {
+		return i
+	}
+	i := int64(len(e.strings))
+	e.strings[s] = i
+	e.buf = appendProtoBytes(e.buf, pprofProfileStringTable, []byte(s))
+	e.flush(false)
+	return i
+}
+
+// message writes the message in e.msg as the given field of the profile.
+func (e *profileEncoder) message(field int) {
+	e.buf = appendProtoBytes(e.buf, field, e.msg)
+	e.msg = e.msg[:0]
+	e.flush(false)
+}
+
+func (e *profileEncoder) flush(force bool) {
+	if e.err != nil {
+		e.buf = e.buf[:0]
+		return
+	}
+	if len(e.buf) >= encoderBufferSize || (force && len(e.buf) > 0) {
+		_, e.err = e.zw.Write(e.buf)
+		e.buf = e.buf[:0]
+	}
+}
+
+func (e *profileEncoder) close() error {
+	e.flush(true)
+	if err := e.zw.Close(); e.err == nil {
+		e.err = err
+	}
+	return e.err
+}
+
+func (e *profileEncoder) valueType(t *profile.ValueType) {
+	typ, unit := e.string(t.Type), e.string(t.Unit)
+	e.msg = appendProtoInt(e.msg, pprofValueTypeType, typ)
+	e.msg = appendProtoInt(e.msg, pprofValueTypeUnit, unit)
+	e.message(pprofProfileSampleType)
+}
+
+func (e *profileEncoder) location(loc *profile.Location) {
+	// The strings of the functions are only written with the functions,
+	// the lines only refer to their ids.
+	e.msg = appendProtoInt(e.msg, pprofLocationID, int64(loc.ID))
+	e.msg = appendProtoInt(e.msg, pprofLocationMappingID, int64(loc.Mapping.ID))
+	e.msg = appendProtoInt(e.msg, pprofLocationAddress, int64(loc.Address))
+	for _, line := range loc.Line {
+		e.sub = appendProtoInt(e.sub[:0], pprofLineFunctionID, int64(line.Function.ID))
+		e.sub = appendProtoInt(e.sub, pprofLineLine, line.Line)
+		e.msg = appendProtoBytes(e.msg, pprofLocationLine, e.sub)
+	}
+	e.message(pprofProfileLocation)
+}
+
+func (e *profileEncoder) function(fn *profile.Function) {
+	name, systemName, filename := e.string(fn.Name), e.string(fn.SystemName), e.string(fn.Filename)
+	e.msg = appendProtoInt(e.msg, pprofFunctionID, int64(fn.ID))
+	e.msg = appendProtoInt(e.msg, pprofFunctionName, name)
+	e.msg = appendProtoInt(e.msg, pprofFunctionSystemName, systemName)
+	e.msg = appendProtoInt(e.msg, pprofFunctionFilename, filename)
+	e.msg = appendProtoInt(e.msg, pprofFunctionStartLine, fn.StartLine)
+	e.message(pprofProfileFunction)
+}
+
+func (e *profileEncoder) mapping(m *profile.Mapping) {
+	filename, buildID := e.string(m.File), e.string(m.BuildID)
+	e.msg = appendProtoInt(e.msg, pprofMappingID, int64(m.ID))
+	e.msg = appendProtoInt(e.msg, pprofMappingMemoryStart, int64(m.Start))
+	e.msg = appendProtoInt(e.msg, pprofMappingMemoryLimit, int64(m.Limit))
+	e.msg = appendProtoInt(e.msg, pprofMappingFilename, filename)
+	e.msg = appendProtoInt(e.msg, pprofMappingBuildID, buildID)
+	e.msg = appendProtoBool(e.msg, pprofMappingHasFunctions, m.HasFunctions)
+	e.msg = appendProtoBool(e.msg, pprofMappingHasFilenames, m.HasFilenames)
+	e.msg = appendProtoBool(e.msg, pprofMappingHasLineNumbers, m.HasLineNumbers)
+	e.msg = appendProtoBool(e.msg, pprofMappingHasInlineFrames, m.HasInlineFrames)
+	e.message(pprofProfileMapping)
+}
+
+// sample writes a sample, with the labels in the order of keys, and the native
+// addresses of its locations if not nil.
+func (e *profileEncoder) sample(locations []uint64, values []int64, labels map[string]string, keys []string, addrs []int64) {
+	e.msg = appendProtoPackedUints(e.msg, pprofSampleLocationID, locations)
+	e.msg = appendProtoPackedInts(e.msg, pprofSampleValue, values)
+	for _, k := range keys {
+		e.sub = appendProtoInt(e.sub[:0], pprofLabelKey, e.string(k))
+		e.sub = appendProtoInt(e.sub, pprofLabelStr, e.string(labels[k]))
+		e.msg = appendProtoBytes(e.msg, pprofSampleLabel, e.sub)
+	}
+	for _, addr := range addrs {
+		e.sub = appendProtoInt(e.sub[:0], pprofLabelKey, e.string(nativeAddressLabel))
+		e.sub = appendProtoInt(e.sub, pprofLabelNum, addr)
+		e.msg = appendProtoBytes(e.msg, pprofSampleLabel, e.sub)
+	}
+	e.message(pprofProfileSample)
+}
+
+func appendProtoVarint(b []byte, v uint64) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(b, byte(v))
+}
+
+// appendProtoInt appends a varint field, omitted if it is zero like proto3
+// does.
+func appendProtoInt(b []byte, field int, v int64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = appendProtoVarint(b, uint64(field)<<3)
+	return appendProtoVarint(b, uint64(v))
+}
+
+func appendProtoBool(b []byte, field int, v bool) []byte {
+	if !v {
+		return b
+	}
+	return appendProtoInt(b, field, 1)
+}
+
+func appendProtoBytes(b []byte, field int, v []byte) []byte {
+	b = appendProtoVarint(b, uint64(field)<<3|2)
+	b = appendProtoVarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+func appendProtoPackedUints(b []byte, field int, v []uint64) []byte {
+	n := 0
+	for _, x := range v {
+		n += protoVarintSize(x)
+	}
+	b = appendProtoVarint(b, uint64(field)<<3|2)
+	b = appendProtoVarint(b, uint64(n))
+	for _, x := range v {
+		b = appendProtoVarint(b, x)
+	}
+	return b
+}
+
+func appendProtoPackedInts(b []byte, field int, v []int64) []byte {
+	n := 0
+	for _, x := range v {
+		n += protoVarintSize(uint64(x))
+	}
+	b = appendProtoVarint(b, uint64(field)<<3|2)
+	b = appendProtoVarint(b, uint64(n))
+	for _, x := range v {
+		b = appendProtoVarint(b, uint64(x))
+	}
+	return b
+}
+
+func protoVarintSize(v uint64) int {
+	n := 1
+	for v >= 0x80 {
+		v >>= 7
+		n++
+	}
+	return n
+}
+
+// encodeProfile writes the profile of the samples to w in the pprof format,
+// like the profile built by buildProfile without state, but as the samples are
+// symbolized, so the memory used does not grow with the number of samples.
+// The labels are added to all the samples, like serveProfile does.
+//
+// The profile is not passed to the hooks of p, the callers fall back to
+// buildProfile when there are some. The samples of Python guests are labeled
+// with their phase like buildProfile does.
+func encodeProfile[T sampleType](ctx context.Context, p *Profiling, w io.Writer, samples map[uint64]T, start time.Time, skew, duration time.Duration, sampleType []*profile.ValueType, ratios []float64, labels map[string]string) error {
+	progress, _ := ctx.Value(progressKey{}).(func(done, total int))
+	e := newProfileEncoder(w)
+
+	// The values of the transforms are computed from the scaled values, and
+	// appended to the ones of the sample types of the profiler.
+	var transforms []ValueTransform
+	var sources []int
+	types := sampleType
+	for _, t := range p.transforms {
+		for i, st := range sampleType {
+			if st.Type == t.Source {
+				transforms, sources = append(transforms, t), append(sources, i)
+				types = append(types[:len(types):len(types)], &profile.ValueType{Type: t.Type, Unit: t.Unit})
+				break
+			}
+		}
+	}
+	for _, t := range types {
+		e.valueType(t)
+	}
+	e.buf = appendProtoInt(e.buf, pprofProfileTimeNanos, start.Add(skew).UnixNano())
+	e.buf = appendProtoInt(e.buf, pprofProfileDurationNanos, int64(duration))
+	if skew != 0 {
+		e.buf = appendProtoInt(e.buf, pprofProfileComment, e.string(fmt.Sprintf("guest clock skew: %s", skew)))
+	}
+
+	capabilities := p.Capabilities()
+	mapping := &profile.Mapping{
+		ID:              1,
+		Limit:           uint64(len(p.wasm)),
+		File:            p.moduleName,
+		BuildID:         p.buildID,
+		HasFunctions:    true,
+		HasFilenames:    capabilities.LineNumbers,
+		HasLineNumbers:  capabilities.LineNumbers,
+		HasInlineFrames: capabilities.InlinedFunctions,
+	}
+	var native *profile.Mapping
+	if p.nativeAddresses && p.wasmStacks() {
+		native = &profile.Mapping{
+			ID:   2,
+			File: p.moduleName + " [native]",
+		}
+	}
+
+	scaled := false
+	for _, r := range ratios[:len(sampleType)] {
+		scaled = scaled || r != 1
+	}
+
+	resolved, calls, err := resolveCalls(ctx, p, samples)
+	if err != nil {
+		return err
+	}
+	locationIDs := newLocationCache[uint64](p)
+	numLocations := uint64(0)
+	functionCache := make(map[string]*profile.Function)
+	arena := &profileArena{}
+	// IDs of the locations of the Python import machinery.
+	var imports map[uint64]bool
+	if p.lang == python311 {
+		imports = make(map[uint64]bool)
+	}
+	var (
+		locations []uint64
+		values    []int64
+		keys      []string
+		merged    = make(map[string]string)
+		addrs     []int64
+	)
+
+	done := 0
+	for _, sample := range samples {
+		if done%progressInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if progress != nil {
+				progress(done, len(samples))
+			}
+			if e.err != nil {
+				return e.err
+			}
+		}
+		done++
+
+		// Samples whose scaled values are all zero are dropped, like
+		// profile.ScaleN does.
+		values = append(values[:0], sample.sampleValue()[:len(sampleType)]...)
+		if scaled {
+			keep := false
+			for i, v := range values {
+				if ratios[i] != 1 {
+					values[i] = int64(math.Round(float64(v) * ratios[i]))
+					keep = keep || values[i] != 0
+				}
+			}
+			if !keep {
+				continue
+			}
+		}
+		for i, t := range transforms {
+			values = append(values, t.Transform(values[sources[i]]))
+		}
+
+		stack := sample.sampleLocation()
+		locations = locations[:0]
+		for i := 0; i < stack.len(); i++ {
+			fn := stack.function(i)
+			pc := stack.pcs[i]
+
+			def := fn.Definition()
+			id, _ := locationIDs.lookup(def, pc)
+			if id == 0 {
+				p.metrics.cacheMisses.Add(1)
+				loc := locationForResolvedCall(p, fn, pc, resolved, calls, functionCache, arena)
+				numLocations++
+				loc.ID = numLocations
+				loc.Mapping = mapping
+				locationIDs.store(def, pc, loc.ID)
+				if imports != nil && pythonImportLocation(loc) {
+					imports[loc.ID] = true
+				}
+				e.location(loc)
+				id = loc.ID
+			} else {
+				p.metrics.cacheHits.Add(1)
+			}
+			locations = append(locations, id)
+		}
+
+		for k := range merged {
+			delete(merged, k)
+		}
+		if stack.labels != nil {
+			for k, v := range stack.labels.labels {
+				merged[k] = v
+			}
+		}
+		if stack.goid != 0 {
+			merged[goroutineLabel] = strconv.FormatInt(stack.goid, 10)
+		}
+		if imports != nil {
+			merged[pythonPhaseLabel] = "run"
+			for _, id := range locations {
+				if imports[id] {
+					merged[pythonPhaseLabel] = "import"
+					break
+				}
+			}
+		}
+		for k, v := range labels {
+			merged[k] = v
+		}
+		keys = keys[:0]
+		for k := range merged {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		addrs = addrs[:0]
+		if native != nil {
+			for _, pc := range stack.pcs {
+				addrs = append(addrs, int64(pc))
+				if pc != 0 {
+					if native.Start == 0 || uint64(pc) < native.Start {
+						native.Start = uint64(pc)
+					}
+					if uint64(pc) >= native.Limit {
+						native.Limit = uint64(pc) + 1
+					}
+				}
+			}
+		}
+		if native == nil {
+			addrs = nil
+		}
+		e.sample(locations, values, merged, keys, addrs)
+	}
+	if progress != nil {
+		progress(done, len(samples))
+	}
+
+	// The names of functions may be corrected while the locations are
+	// symbolized, they are written last.
+	functions := make([]*profile.Function, len(functionCache))
+	for _, fn := range functionCache {
+		functions[fn.ID-1] = fn
+	}
+	for _, fn := range functions {
+		e.function(fn)
+	}
+	e.mapping(mapping)
+	if native != nil && native.Limit != 0 {
+		e.mapping(native)
+	}
+	return e.close()
+}
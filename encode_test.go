@@ -0,0 +1,221 @@
+package wzprof
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/pprof/profile"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental/wazerotest"
+	"golang.org/x/exp/slices"
+)
+
+// canonicalSamples returns the samples of prof as sorted strings, which do not
+// depend on the IDs and order of the locations and functions of the profile.
+func canonicalSamples(prof *profile.Profile) []string {
+	samples := make([]string, len(prof.Sample))
+	for i, s := range prof.Sample {
+		var b strings.Builder
+		for _, loc := range s.Location {
+			fmt.Fprintf(&b, "%s:%#x:", loc.Mapping.File, loc.Address)
+			for _, line := range loc.Line {
+				fmt.Fprintf(&b, "%s/%s@%d;", line.Function.Name, line.Function.SystemName, line.Line)
+			}
+			b.WriteByte(' ')
+		}
+		fmt.Fprintf(&b, "%v %v %v", s.Value, s.Label, s.NumLabel)
+		samples[i] = b.String()
+	}
+	sort.Strings(samples)
+	return samples
+}
+
+func roundTripProfile(t *testing.T, prof *profile.Profile) *profile.Profile {
+	t.Helper()
+	var b bytes.Buffer
+	if err := prof.Write(&b); err != nil {
+		t.Fatal(err)
+	}
+	prof, err := profile.Parse(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return prof
+}
+
+func TestEncodeProfile(t *testing.T) {
+	module := wazerotest.NewModule(nil,
+		wazerotest.NewFunction(func(context.Context, api.Module) {}),
+		wazerotest.NewFunction(func(context.Context, api.Module) {}),
+		wazerotest.NewFunction(func(context.Context, api.Module) {}),
+	)
+	p := ProfilingFor(nil)
+	p.SetModuleName("test.wasm")
+	p.SetNativeAddresses(true)
+	p.AddValueTransform(ValueTransform{
+		Source:    "alloc_space",
+		Type:      "alloc_space",
+		Unit:      "kilobytes",
+		Transform: func(v int64) int64 { return v / 1024 },
+	})
+	mem := p.MemoryProfiler()
+	for i, si := range benchmarkStacks(module, 3000, 8) {
+		trace := makeStackTrace(context.Background(), stackTrace{}, si.reset())
+		// Some samples have values scaled to zero and are dropped.
+		mem.observeAlloc(0, uint64(i%7)*1000, trace)
+	}
+
+	want, err := mem.NewProfileContext(context.Background(), 0.25)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addLabels(want, map[string]string{"service": "test"})
+	// Decoding drops the labels of zero native addresses, so the profiles are
+	// compared after being written.
+	want = roundTripProfile(t, want)
+
+	var b bytes.Buffer
+	if err := mem.writeProfile(context.Background(), &b, 0.25, map[string]string{"service": "test"}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := profile.Parse(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := got.CheckValid(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got.SampleType) != len(want.SampleType) {
+		t.Fatalf("wrong number of sample types: want %d, got %d", len(want.SampleType), len(got.SampleType))
+	}
+	for i := range want.SampleType {
+		if *got.SampleType[i] != *want.SampleType[i] {
+			t.Errorf("wrong sample type %d: want %+v, got %+v", i, want.SampleType[i], got.SampleType[i])
+		}
+	}
+	if got.TimeNanos != want.TimeNanos || got.DurationNanos == 0 {
+		t.Errorf("wrong time: want %d, got %d (duration %d)", want.TimeNanos, got.TimeNanos, got.DurationNanos)
+	}
+	if len(got.Mapping) != len(want.Mapping) {
+		t.Fatalf("wrong number of mappings: want %d, got %d", len(want.Mapping), len(got.Mapping))
+	}
+	for i := range want.Mapping {
+		if *got.Mapping[i] != *want.Mapping[i] {
+			t.Errorf("wrong mapping %d: want %+v, got %+v", i, want.Mapping[i], got.Mapping[i])
+		}
+	}
+	if len(got.Sample) != len(want.Sample) || len(got.Sample) == 0 {
+		t.Fatalf("wrong number of samples: want %d, got %d", len(want.Sample), len(got.Sample))
+	}
+	if !slices.Equal(canonicalSamples(got), canonicalSamples(want)) {
+		t.Error("encoded samples differ from the ones of the built profile")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := mem.WriteProfile(ctx, &b, 1); err != context.Canceled {
+		t.Errorf("want context.Canceled, got %v", err)
+	}
+}
+
+func TestCPUProfilerStopProfileTo(t *testing.T) {
+	module := wazerotest.NewModule(nil,
+		wazerotest.NewFunction(func(context.Context, api.Module) {}),
+		wazerotest.NewFunction(func(context.Context, api.Module) {}),
+	)
+	p := ProfilingFor(nil).CPUProfiler(HostTime(true))
+
+	var b bytes.Buffer
+	if err := p.StopProfileTo(context.Background(), &b, 1); err == nil {
+		t.Error("profile written while the profiler was not started")
+	}
+
+	stacks := benchmarkStacks(module, 100, 4)
+	observe := func() {
+		p.StartProfile()
+		for i, si := range stacks {
+			p.counts.observe(makeStackTrace(context.Background(), stackTrace{}, si.reset()), int64(i+1))
+		}
+	}
+	observe()
+	want := roundTripProfile(t, p.StopProfile(1))
+	observe()
+	if err := p.StopProfileTo(context.Background(), &b, 1); err != nil {
+		t.Fatal(err)
+	}
+	got, err := profile.Parse(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(canonicalSamples(got), canonicalSamples(want)) {
+		t.Error("encoded samples differ from the ones of the built profile")
+	}
+}
+
+func TestMemoryProfilerHandlerStream(t *testing.T) {
+	p := ProfilingFor(nil).MemoryProfiler()
+	alloc := newMallocListener(p)
+	alloc(10)
+	alloc(32)
+	handler := WithLabels(p.NewHandler(1), map[string]string{"service": "test"})
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/debug/pprof/allocs?label=zone:a", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("wrong status: %d: %s", w.Code, w.Body)
+	}
+	prof, err := profile.Parse(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(prof.Sample) != 1 {
+		t.Fatalf("wrong number of samples: %d", len(prof.Sample))
+	}
+	s := prof.Sample[0]
+	if v := s.Value; v[0] != 2 || v[1] != 42 {
+		t.Errorf("wrong sample values: %v", v)
+	}
+	if s.Label["service"][0] != "test" || s.Label["zone"][0] != "a" {
+		t.Errorf("wrong labels: %v", s.Label)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/debug/pprof/allocs?label=zone", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("wrong status for invalid label: %d", w.Code)
+	}
+}
+
+func BenchmarkEncodeProfile(b *testing.B) {
+	module := wazerotest.NewModule(nil,
+		wazerotest.NewFunction(func(context.Context, api.Module) {}),
+		wazerotest.NewFunction(func(context.Context, api.Module) {}),
+	)
+	scm := newStackCounterMap(0)
+	for _, si := range benchmarkStacks(module, 10000, 16) {
+		scm.observe(makeStackTrace(context.Background(), stackTrace{}, si.reset()), 1)
+	}
+	samples := scm.samples()
+	p := ProfilingFor(nil)
+	sampleType := p.CPUProfiler().SampleType()
+	ctx := context.Background()
+	start := time.Now()
+	var w bytes.Buffer
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		w.Reset()
+		if err := encodeProfile(ctx, p, &w, samples, start, 0, 0, sampleType, []float64{1, 1}, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
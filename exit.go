@@ -0,0 +1,83 @@
+package wzprof
+
+import (
+	"context"
+
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+)
+
+// ExitHook is a function listener factory invoking the function when the guest
+// calls proc_exit of WASI (or runtime.wasmExit for Go js/wasm guests), before
+// the instance is torn down. It gives the host a chance to flush the profiles
+// of guests which exit abruptly, instead of relying on code running after the
+// guest returned.
+//
+// When combined with profilers in a multi-listener factory, the hook must be
+// placed after them: the profilers account for the calls in progress when
+// proc_exit is invoked, so the profiles built by the hook are complete.
+type ExitHook func(ctx context.Context, exitCode uint32)
+
+// NewFunctionListener returns a function listener invoking h if def exits the
+// guest, or nil otherwise.
+func (h ExitHook) NewFunctionListener(def api.FunctionDefinition) experimental.FunctionListener {
+	if !isProcExit(def) {
+		return nil
+	}
+	return exitHookListener{h}
+}
+
+type exitHookListener struct{ hook ExitHook }
+
+func (h exitHookListener) Before(ctx context.Context, mod api.Module, def api.FunctionDefinition, params []uint64, _ experimental.StackIterator) {
+	h.hook(ctx, exitCode(mod, def, params))
+}
+
+func (h exitHookListener) After(context.Context, api.Module, api.FunctionDefinition, []uint64) {}
+
+func (h exitHookListener) Abort(context.Context, api.Module, api.FunctionDefinition, error) {}
+
+// isProcExit returns true if def is the proc_exit function of WASI, or the
+// runtime.wasmExit function of Go js/wasm guests, either defined by the host
+// module or imported by the guest.
+func isProcExit(def api.FunctionDefinition) bool {
+	module, name, ok := def.Import()
+	if !ok {
+		module, name = def.ModuleName(), def.Name()
+	}
+	switch module {
+	case "wasi_snapshot_preview1":
+		return name == "proc_exit"
+	case "gojs", "go":
+		return name == goWasmExit
+	}
+	return false
+}
+
+// goWasmExit is the function of the host module of Go js/wasm guests ("gojs",
+// or "go" before Go 1.21) exiting the guest.
+const goWasmExit = "runtime.wasmExit"
+
+// exitCode returns the exit code passed to the function def, which
+// isProcExit returned true for.
+func exitCode(mod api.Module, def api.FunctionDefinition, params []uint64) uint32 {
+	if len(params) == 0 {
+		return 0
+	}
+	_, name, ok := def.Import()
+	if !ok {
+		name = def.Name()
+	}
+	if name != goWasmExit {
+		return api.DecodeU32(params[0])
+	}
+	// The functions imported by Go js/wasm guests have the stack pointer as
+	// only parameter, their parameters are on the Go stack after the return
+	// address.
+	mem := mod.Memory()
+	if mem == nil {
+		return 0
+	}
+	code, _ := mem.ReadUint32Le(api.DecodeU32(params[0]) + 8)
+	return code
+}
@@ -0,0 +1,102 @@
+package wzprof
+
+import (
+	"context"
+	"testing"
+
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+	"github.com/tetratelabs/wazero/experimental/wazerotest"
+)
+
+func TestExitHook(t *testing.T) {
+	currentTime := int64(0)
+
+	p := ProfilingFor(nil).CPUProfiler(
+		HostTime(true),
+		TimeFunc(func() int64 { return currentTime }),
+	)
+
+	procExit := wazerotest.NewFunction(func(context.Context, api.Module, uint32) {})
+	procExit.FunctionName = "proc_exit"
+
+	module := wazerotest.NewModule(nil,
+		wazerotest.NewFunction(func(context.Context, api.Module) {}),
+		procExit,
+	)
+	module.ModuleName = "wasi_snapshot_preview1"
+
+	def0 := module.Function(0).Definition()
+	def1 := module.Function(1).Definition()
+
+	var exitCode uint32
+	var exitCounts *stackCounterMap
+	hook := ExitHook(func(ctx context.Context, code uint32) {
+		exitCode = code
+		exitCounts = p.counts
+	})
+	if hook.NewFunctionListener(def0) != nil {
+		t.Error("exit hook listening to a function other than proc_exit")
+	}
+
+	factory := experimental.MultiFunctionListenerFactory(p, hook)
+	f0 := factory.NewFunctionListener(def0)
+	f1 := factory.NewFunctionListener(def1)
+
+	stack0 := []experimental.StackFrame{
+		{Function: module.Function(0)},
+	}
+	stack1 := []experimental.StackFrame{
+		{Function: module.Function(0)},
+		{Function: module.Function(1)},
+	}
+
+	ctx := context.Background()
+	p.StartProfile()
+
+	currentTime = 1
+	f0.Before(ctx, module, def0, nil, experimental.NewStackIterator(stack0...))
+
+	currentTime = 10
+	f1.Before(ctx, module, def1, []uint64{42}, experimental.NewStackIterator(stack1...))
+
+	if exitCode != 42 {
+		t.Errorf("wrong exit code: want=42 got=%d", exitCode)
+	}
+	// The call in progress was recorded before the hook was invoked.
+	assertStackCount(t, exitCounts, makeStackTraceFromFrames(stack0), 1, 9)
+
+	// The unwinding of the calls must not record them twice.
+	currentTime = 20
+	f1.Abort(ctx, module, def1, nil)
+	f0.Abort(ctx, module, def0, nil)
+
+	p.drain(p.counts)
+	assertStackCount(t, p.counts, makeStackTraceFromFrames(stack0), 1, 9)
+	assertStackCount(t, p.counts, makeStackTraceFromFrames(stack1), 1, 10)
+}
+
+func TestExitHookGoJS(t *testing.T) {
+	wasmExit := wazerotest.NewFunction(func(context.Context, api.Module, uint32) {})
+	wasmExit.FunctionName = "runtime.wasmExit"
+
+	module := wazerotest.NewModule(wazerotest.NewFixedMemory(wazerotest.PageSize), wasmExit)
+	module.ModuleName = "gojs"
+	def := module.Function(0).Definition()
+
+	// The exit code is the parameter on the Go stack, after the return
+	// address.
+	const sp = 1024
+	module.Memory().WriteUint32Le(sp+8, 3)
+
+	exitCode := uint32(0)
+	hook := ExitHook(func(ctx context.Context, code uint32) { exitCode = code })
+	f := hook.NewFunctionListener(def)
+	if f == nil {
+		t.Fatal("exit hook not listening to runtime.wasmExit")
+	}
+	f.Before(context.Background(), module, def, []uint64{sp}, experimental.NewStackIterator())
+	if exitCode != 3 {
+		t.Errorf("wrong exit code: want=3 got=%d", exitCode)
+	}
+}
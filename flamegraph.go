@@ -0,0 +1,228 @@
+package wzprof
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"html"
+	"io"
+	"net/http"
+	"sort"
+
+	"github.com/google/pprof/profile"
+)
+
+// flameNode is a node of the call tree rendered as a flame graph. The value of
+// a node is the sum of the values of the samples passing through it.
+type flameNode struct {
+	name     string
+	value    int64
+	children []*flameNode
+	index    map[string]*flameNode
+}
+
+func (n *flameNode) child(name string) *flameNode {
+	c, ok := n.index[name]
+	if !ok {
+		if n.index == nil {
+			n.index = make(map[string]*flameNode)
+		}
+		c = &flameNode{name: name}
+		n.index[name] = c
+		n.children = append(n.children, c)
+	}
+	return c
+}
+
+// buildFlameGraph aggregates the values at the given index of the samples of
+// prof into a call tree. The children of each node are sorted by name, which
+// is how flame graphs are usually laid out.
+func buildFlameGraph(prof *profile.Profile, index int) *flameNode {
+	root := &flameNode{name: "root"}
+	frames := []string{}
+
+	for _, sample := range prof.Sample {
+		value := sample.Value[index]
+		if value == 0 {
+			continue
+		}
+		root.value += value
+		node := root
+		for _, frame := range appendSampleFrames(frames[:0], sample) {
+			node = node.child(frame)
+			node.value += value
+		}
+	}
+
+	var sortChildren func(*flameNode)
+	sortChildren = func(n *flameNode) {
+		sort.Slice(n.children, func(i, j int) bool {
+			return n.children[i].name < n.children[j].name
+		})
+		for _, c := range n.children {
+			sortChildren(c)
+		}
+		n.index = nil
+	}
+	sortChildren(root)
+	return root
+}
+
+// profileRecorder captures the response of a profiler handler so the profile
+// can be rendered instead of being sent to the client.
+type profileRecorder struct {
+	bytes.Buffer
+	header http.Header
+	status int
+}
+
+func (r *profileRecorder) Header() http.Header {
+	if r.header == nil {
+		r.header = make(http.Header)
+	}
+	return r.header
+}
+
+func (r *profileRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+}
+
+// serveFlameGraph responds with an HTML page rendering the profile served by
+// the handler of entry as a flame graph. The sample_index query parameter
+// selects the sample type to render, defaulting to the last one.
+func serveFlameGraph(w http.ResponseWriter, r *http.Request, entry profileEntry) {
+	rec := &profileRecorder{}
+	entry.Handler.ServeHTTP(rec, r)
+	if rec.status != 0 && rec.status != http.StatusOK {
+		serveError(w, rec.status, rec.String())
+		return
+	}
+
+	prof, err := profile.Parse(&rec.Buffer)
+	if err != nil {
+		serveError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	index, err := sampleTypeIndex(prof, r.FormValue("sample_index"))
+	if err != nil {
+		serveError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	h := w.Header()
+	h.Set("X-Content-Type-Options", "nosniff")
+	h.Set("Content-Type", "text/html; charset=utf-8")
+
+	if err := flameGraphTmplExecute(w, entry.Name, prof, index); err != nil {
+		serveError(w, http.StatusInternalServerError, err.Error())
+	}
+}
+
+const (
+	// Height of a frame of the flame graph, in pixels.
+	flameFrameHeight = 18
+	// Frames narrower than this fraction of the total are not rendered, they
+	// would not be readable and only bloat the page.
+	flameMinWidth = 0.0005
+)
+
+func flameGraphTmplExecute(w io.Writer, name string, prof *profile.Profile, index int) error {
+	root := buildFlameGraph(prof, index)
+	sampleType := prof.SampleType[index]
+
+	var b bytes.Buffer
+	var frames bytes.Buffer
+	depth := 0
+
+	var render func(n *flameNode, x float64, d int)
+	render = func(n *flameNode, x float64, d int) {
+		width := float64(n.value) / float64(root.value)
+		if width < flameMinWidth {
+			return
+		}
+		if d > depth {
+			depth = d
+		}
+		fmt.Fprintf(&frames, "<div class=frame data-x=%g data-w=%g data-d=%d style='left:%.4f%%;width:%.4f%%;top:%dpx;background:%s' title='%s'>%s</div>\n",
+			x, width, d, 100*x, 100*width, d*flameFrameHeight, flameFrameColor(n.name),
+			html.EscapeString(fmt.Sprintf("%s (%d %s, %.2f%%)", n.name, n.value, sampleType.Unit, 100*width)),
+			html.EscapeString(n.name))
+		for _, c := range n.children {
+			render(c, x, d+1)
+			x += float64(c.value) / float64(root.value)
+		}
+	}
+	if root.value > 0 {
+		render(root, 0, 0)
+	}
+
+	fmt.Fprintf(&b, `<html>
+<head>
+<title>/debug/pprof/%[1]s flame graph</title>
+<style>
+body{font-family:sans-serif;font-size:12px;}
+#flamegraph{position:relative;height:%[2]dpx;}
+.frame{
+	position:absolute;
+	box-sizing:border-box;
+	height:%[3]dpx;
+	line-height:%[3]dpx;
+	padding:0 2px;
+	border:1px solid white;
+	overflow:hidden;
+	white-space:nowrap;
+	text-overflow:ellipsis;
+	cursor:pointer;
+}
+</style>
+</head>
+<body>
+<a href='/debug/pprof/'>/debug/pprof</a>/%[1]s
+<p>Flame graph of %[4]s (%[5]s). Click on a frame to zoom in, click on the root to reset.
+Set sample_index as a query parameter to select another sample type.</p>
+<div id=flamegraph>
+`, html.EscapeString(name), (depth+1)*flameFrameHeight, flameFrameHeight,
+		html.EscapeString(sampleType.Type), html.EscapeString(sampleType.Unit))
+
+	b.Write(frames.Bytes())
+
+	b.WriteString(`</div>
+<script>
+document.querySelectorAll('.frame').forEach(function(f) {
+	f.addEventListener('click', function() {
+		var x = +f.dataset.x, w = +f.dataset.w, d = +f.dataset.d;
+		document.querySelectorAll('.frame').forEach(function(g) {
+			var gx = +g.dataset.x, gw = +g.dataset.w, gd = +g.dataset.d;
+			if (gd < d && gx <= x && x + w <= gx + gw + 1e-9) {
+				g.style.display = '';
+				g.style.left = '0%';
+				g.style.width = '100%';
+			} else if (gd >= d && x <= gx && gx + gw <= x + w + 1e-9) {
+				g.style.display = '';
+				g.style.left = (100 * (gx - x) / w) + '%';
+				g.style.width = (100 * gw / w) + '%';
+			} else {
+				g.style.display = 'none';
+			}
+		});
+	});
+});
+</script>
+</body>
+</html>`)
+
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// flameFrameColor returns a warm color derived from the name of a frame, so the
+// same function has the same color across the graph.
+func flameFrameColor(name string) string {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	v := h.Sum32()
+	return fmt.Sprintf("rgb(%d,%d,%d)", 205+v%50, 80+(v>>8)%150, 40+(v>>16)%50)
+}
@@ -0,0 +1,88 @@
+package wzprof
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/pprof/profile"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+	"github.com/tetratelabs/wazero/experimental/wazerotest"
+)
+
+func TestBuildFlameGraph(t *testing.T) {
+	main := &profile.Function{ID: 1, Name: "main"}
+	work := &profile.Function{ID: 2, Name: "work"}
+	inlined := &profile.Function{ID: 3, Name: "inlined"}
+
+	mainLoc := &profile.Location{ID: 1, Line: []profile.Line{{Function: main}}}
+	workLoc := &profile.Location{ID: 2, Line: []profile.Line{{Function: inlined}, {Function: work}}}
+
+	prof := &profile.Profile{
+		SampleType: []*profile.ValueType{{Type: "cpu", Unit: "nanoseconds"}},
+		Sample: []*profile.Sample{
+			{Location: []*profile.Location{workLoc, mainLoc}, Value: []int64{100}},
+			{Location: []*profile.Location{mainLoc}, Value: []int64{20}},
+			{Location: []*profile.Location{workLoc, mainLoc}, Value: []int64{300}},
+			{Location: []*profile.Location{workLoc}, Value: []int64{0}},
+		},
+	}
+
+	root := buildFlameGraph(prof, 0)
+	if root.value != 420 {
+		t.Errorf("wrong root value: want 420, got %d", root.value)
+	}
+	if len(root.children) != 1 || root.children[0].name != "main" || root.children[0].value != 420 {
+		t.Fatalf("wrong root children: %+v", root.children)
+	}
+	w := root.children[0].children
+	if len(w) != 1 || w[0].name != "work" || w[0].value != 400 {
+		t.Fatalf("wrong main children: %+v", w)
+	}
+	i := w[0].children
+	if len(i) != 1 || i[0].name != "inlined" || i[0].value != 400 || len(i[0].children) != 0 {
+		t.Fatalf("wrong work children: %+v", i)
+	}
+}
+
+func TestHandlerFlameGraph(t *testing.T) {
+	p := ProfilingFor(nil).MemoryProfiler()
+
+	malloc := wazerotest.NewFunction(func(ctx context.Context, mod api.Module, size uint32) uint32 {
+		return 0
+	})
+	malloc.FunctionName = "malloc"
+
+	module := wazerotest.NewModule(nil, malloc)
+	def := module.Function(0).Definition()
+	f := p.NewFunctionListener(def)
+
+	ctx := context.Background()
+	stack := []experimental.StackFrame{{Function: module.Function(0)}}
+	f.Before(ctx, module, def, []uint64{64}, experimental.NewStackIterator(stack...))
+	f.After(ctx, module, def, []uint64{0x1000})
+
+	handler := Handler(1, p)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/debug/pprof/allocs?flamegraph", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("wrong status: want %d, got %d: %s", http.StatusOK, rec.Code, rec.Body)
+	}
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+		t.Errorf("wrong content type: %q", ct)
+	}
+	body := rec.Body.String()
+	if !strings.Contains(body, ">malloc</div>") {
+		t.Errorf("flame graph is missing the malloc frame:\n%s", body)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/debug/pprof/allocs?flamegraph&sample_index=nope", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("wrong status for unknown sample type: want %d, got %d", http.StatusBadRequest, rec.Code)
+	}
+}
@@ -0,0 +1,93 @@
+package wzprof
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/google/pprof/profile"
+)
+
+// WriteFoldedProfile writes a profile in the folded stacks format used by
+// flamegraph.pl and other flame graph tools: one line per unique stack, with
+// the frames from the root to the leaf separated by semicolons, followed by
+// the value of the samples.
+//
+// The sample type selects which values of the samples are written. When it is
+// empty, the last sample type of the profile is used, which is the default of
+// pprof.
+func WriteFoldedProfile(w io.Writer, prof *profile.Profile, sampleType string) error {
+	index, err := sampleTypeIndex(prof, sampleType)
+	if err != nil {
+		return err
+	}
+
+	values := make(map[string]int64)
+	frames := []string{}
+
+	for _, sample := range prof.Sample {
+		frames = appendSampleFrames(frames[:0], sample)
+		for i, frame := range frames {
+			frames[i] = foldedFrameName(frame)
+		}
+		values[strings.Join(frames, ";")] += sample.Value[index]
+	}
+
+	stacks := make([]string, 0, len(values))
+	for stack := range values {
+		stacks = append(stacks, stack)
+	}
+	sort.Strings(stacks)
+
+	b := bufio.NewWriter(w)
+	for _, stack := range stacks {
+		fmt.Fprintf(b, "%s %d\n", stack, values[stack])
+	}
+	return b.Flush()
+}
+
+// appendSampleFrames appends the names of the frames of a sample to frames,
+// from the root to the leaf.
+func appendSampleFrames(frames []string, sample *profile.Sample) []string {
+	// Locations start from the leaf, and the lines of a location start from
+	// the innermost inlined function.
+	for i := len(sample.Location) - 1; i >= 0; i-- {
+		loc := sample.Location[i]
+		if len(loc.Line) == 0 {
+			frames = append(frames, fmt.Sprintf("%#x", loc.Address))
+			continue
+		}
+		for j := len(loc.Line) - 1; j >= 0; j-- {
+			if fn := loc.Line[j].Function; fn != nil {
+				frames = append(frames, fn.Name)
+			} else {
+				frames = append(frames, "?")
+			}
+		}
+	}
+	return frames
+}
+
+func foldedFrameName(name string) string {
+	// Semicolons separate frames and new lines separate stacks.
+	return strings.NewReplacer(";", ":", "\n", " ").Replace(name)
+}
+
+// sampleTypeIndex returns the index of the values of sampleType in the samples
+// of prof, or the index of the last sample type if sampleType is empty.
+func sampleTypeIndex(prof *profile.Profile, sampleType string) (int, error) {
+	if sampleType == "" {
+		if len(prof.SampleType) == 0 {
+			return -1, fmt.Errorf("profile has no sample types")
+		}
+		return len(prof.SampleType) - 1, nil
+	}
+	for i, t := range prof.SampleType {
+		if t.Type == sampleType {
+			return i, nil
+		}
+	}
+	return -1, fmt.Errorf("sample type %q not found in profile", sampleType)
+}
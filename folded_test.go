@@ -0,0 +1,61 @@
+package wzprof
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/google/pprof/profile"
+)
+
+func TestWriteFoldedProfile(t *testing.T) {
+	main := &profile.Function{ID: 1, Name: "main"}
+	work := &profile.Function{ID: 2, Name: "work"}
+	inlined := &profile.Function{ID: 3, Name: "inlined"}
+
+	mainLoc := &profile.Location{ID: 1, Line: []profile.Line{{Function: main}}}
+	workLoc := &profile.Location{ID: 2, Line: []profile.Line{{Function: inlined}, {Function: work}}}
+	unknownLoc := &profile.Location{ID: 3, Address: 0x42}
+
+	prof := &profile.Profile{
+		SampleType: []*profile.ValueType{
+			{Type: "samples", Unit: "count"},
+			{Type: "cpu", Unit: "nanoseconds"},
+		},
+		Sample: []*profile.Sample{
+			{Location: []*profile.Location{workLoc, mainLoc}, Value: []int64{1, 100}},
+			{Location: []*profile.Location{mainLoc}, Value: []int64{2, 20}},
+			{Location: []*profile.Location{workLoc, mainLoc}, Value: []int64{3, 300}},
+			{Location: []*profile.Location{unknownLoc, mainLoc}, Value: []int64{4, 4}},
+		},
+		Location: []*profile.Location{mainLoc, workLoc, unknownLoc},
+		Function: []*profile.Function{main, work, inlined},
+	}
+
+	tests := []struct {
+		sampleType string
+		want       string
+	}{
+		{
+			sampleType: "",
+			want:       "main 20\nmain;0x42 4\nmain;work;inlined 400\n",
+		},
+		{
+			sampleType: "samples",
+			want:       "main 2\nmain;0x42 4\nmain;work;inlined 4\n",
+		},
+	}
+
+	for _, test := range tests {
+		var b bytes.Buffer
+		if err := WriteFoldedProfile(&b, prof, test.sampleType); err != nil {
+			t.Fatal(err)
+		}
+		if b.String() != test.want {
+			t.Errorf("sample type %q: want\n%s\ngot\n%s", test.sampleType, test.want, b.String())
+		}
+	}
+
+	if err := WriteFoldedProfile(&bytes.Buffer{}, prof, "alloc_space"); err == nil {
+		t.Error("expected error for unknown sample type")
+	}
+}
@@ -0,0 +1,219 @@
+package wzprof
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// The function trace format records the calls of a tracer as a stream of
+// function entries and exits, much more compact than the Chrome trace-event
+// format for long running programs:
+//
+//	magic    "wzft" followed by the version of the format (1)
+//	dropped  uvarint, number of events dropped by the tracer
+//	count    uvarint, number of functions
+//	function name and file (uvarint length followed by the bytes) and kind
+//	         (a byte, 0 for guest and 1 for host functions), count times
+//	records  pairs of uvarints up to the end of the stream: the index of the
+//	         function entered plus one, or zero for the exit of the innermost
+//	         call, and the time elapsed since the previous record in
+//	         nanoseconds (since the creation of the tracer for the first one)
+const (
+	funcTraceMagic   = "wzft"
+	funcTraceVersion = 1
+
+	// Bounds the memory allocated for the names of functions of corrupted
+	// traces.
+	maxFuncTraceString = 1 << 20
+)
+
+// WriteFuncTrace writes the events recorded by t to w in the compact binary
+// function trace format. ConvertFuncTrace converts those traces to the Chrome
+// trace-event format written by WriteTrace.
+func (t *Tracer) WriteFuncTrace(w io.Writer) error {
+	events, dropped := t.snapshot()
+	symbolize := t.symbolizer()
+
+	functions := []traceFunction{}
+	indexes := make(map[traceFunction]uint64)
+	calls := make([]uint64, len(events))
+	for i, e := range events {
+		f := symbolize(e)
+		index, ok := indexes[f]
+		if !ok {
+			index = uint64(len(functions))
+			indexes[f] = index
+			functions = append(functions, f)
+		}
+		calls[i] = index
+	}
+
+	b := bufio.NewWriter(w)
+	buf := make([]byte, 0, 2*binary.MaxVarintLen64)
+	writeUvarint := func(v uint64) {
+		b.Write(binary.AppendUvarint(buf, v))
+	}
+	writeString := func(s string) {
+		writeUvarint(uint64(len(s)))
+		b.WriteString(s)
+	}
+
+	b.WriteString(funcTraceMagic)
+	b.WriteByte(funcTraceVersion)
+	writeUvarint(uint64(dropped))
+	writeUvarint(uint64(len(functions)))
+	for _, f := range functions {
+		writeString(f.name)
+		writeString(f.file)
+		if f.host {
+			b.WriteByte(1)
+		} else {
+			b.WriteByte(0)
+		}
+	}
+
+	// The events are ordered by start time with the callers first, the exits
+	// of the calls in progress are written before each entry that comes after
+	// them.
+	now := t.start
+	record := func(tag uint64, time int64) {
+		delta := uint64(0)
+		if time > now {
+			delta, now = uint64(time-now), time
+		}
+		b.Write(binary.AppendUvarint(binary.AppendUvarint(buf, tag), delta))
+	}
+	var stack []int64
+	exit := func(time int64) {
+		for len(stack) > 0 && stack[len(stack)-1] <= time {
+			record(0, stack[len(stack)-1])
+			stack = stack[:len(stack)-1]
+		}
+	}
+	for i, e := range events {
+		exit(e.start)
+		record(calls[i]+1, e.start)
+		stack = append(stack, e.end)
+	}
+	for len(stack) > 0 {
+		exit(stack[len(stack)-1])
+	}
+	return b.Flush()
+}
+
+// ConvertFuncTrace reads a trace written by Tracer.WriteFuncTrace from r and
+// writes it to w in the Chrome trace-event format, which can be opened in
+// about://tracing or in the Perfetto UI. Calls which did not exit by the end
+// of the trace end with its last record.
+func ConvertFuncTrace(w io.Writer, r io.Reader) error {
+	b := bufio.NewReader(r)
+	header := make([]byte, len(funcTraceMagic)+1)
+	if _, err := io.ReadFull(b, header); err != nil || string(header[:len(funcTraceMagic)]) != funcTraceMagic {
+		return errors.New("not a function trace")
+	}
+	if v := header[len(funcTraceMagic)]; v != funcTraceVersion {
+		return fmt.Errorf("unsupported function trace version: %d", v)
+	}
+
+	readUvarint := func() (uint64, error) {
+		v, err := binary.ReadUvarint(b)
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return v, err
+	}
+	readString := func() (string, error) {
+		n, err := readUvarint()
+		if err != nil {
+			return "", err
+		}
+		if n > maxFuncTraceString {
+			return "", fmt.Errorf("string too long: %d bytes", n)
+		}
+		s := make([]byte, n)
+		_, err = io.ReadFull(b, s)
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return string(s), err
+	}
+	invalid := func(err error) error {
+		return fmt.Errorf("invalid function trace: %w", err)
+	}
+
+	dropped, err := readUvarint()
+	if err != nil {
+		return invalid(err)
+	}
+	count, err := readUvarint()
+	if err != nil {
+		return invalid(err)
+	}
+	functions := make([]traceFunction, 0, 64)
+	for i := uint64(0); i < count; i++ {
+		var f traceFunction
+		if f.name, err = readString(); err != nil {
+			return invalid(err)
+		}
+		if f.file, err = readString(); err != nil {
+			return invalid(err)
+		}
+		kind, err := b.ReadByte()
+		if err != nil {
+			return invalid(io.ErrUnexpectedEOF)
+		}
+		f.host = kind == 1
+		functions = append(functions, f)
+	}
+
+	type call struct {
+		fn    uint64
+		start int64
+	}
+	var stack []call
+	var events []chromeTraceEvent
+	now := int64(0)
+	for {
+		tag, err := binary.ReadUvarint(b)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return invalid(err)
+		}
+		delta, err := readUvarint()
+		if err != nil {
+			return invalid(err)
+		}
+		now += int64(delta)
+
+		switch {
+		case tag == 0:
+			if len(stack) == 0 {
+				return invalid(errors.New("exit without a call in progress"))
+			}
+			c := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			events = append(events, functions[c.fn].chromeEvent(c.start, now))
+		case tag > uint64(len(functions)):
+			return invalid(fmt.Errorf("function index out of range: %d", tag-1))
+		default:
+			stack = append(stack, call{fn: tag - 1, start: now})
+		}
+	}
+	for i := len(stack) - 1; i >= 0; i-- {
+		events = append(events, functions[stack[i].fn].chromeEvent(stack[i].start, now))
+	}
+
+	sort.SliceStable(events, func(i, j int) bool {
+		if events[i].Ts != events[j].Ts {
+			return events[i].Ts < events[j].Ts
+		}
+		return events[i].Dur > events[j].Dur
+	})
+	return writeChromeTrace(w, events, int(dropped))
+}
@@ -0,0 +1,86 @@
+package wzprof
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+	"github.com/tetratelabs/wazero/experimental/wazerotest"
+)
+
+func TestTracerWriteFuncTrace(t *testing.T) {
+	currentTime := int64(0)
+
+	tracer := ProfilingFor(nil).Tracer(MaxTraceEvents(4))
+	tracer.time, tracer.start = func() int64 { return currentTime }, 0
+
+	outer := wazerotest.NewFunction(func(context.Context, api.Module) {})
+	outer.FunctionName = "outer"
+	inner := wazerotest.NewFunction(func(context.Context, api.Module) {})
+	inner.FunctionName = "inner"
+
+	module := wazerotest.NewModule(nil, outer, inner)
+	def0 := module.Function(0).Definition()
+	def1 := module.Function(1).Definition()
+	f0 := tracer.NewFunctionListener(def0)
+	f1 := tracer.NewFunctionListener(def1)
+
+	stack0 := []experimental.StackFrame{{Function: module.Function(0)}}
+	stack1 := []experimental.StackFrame{{Function: module.Function(1)}, {Function: module.Function(0)}}
+
+	ctx := context.Background()
+	call := func(f experimental.FunctionListener, def api.FunctionDefinition, stack []experimental.StackFrame, start, end int64, calls func()) {
+		currentTime = start
+		f.Before(ctx, module, def, nil, experimental.NewStackIterator(stack...))
+		calls()
+		currentTime = end
+		f.After(ctx, module, def, nil)
+	}
+	call(f0, def0, stack0, 1000, 9000, func() {
+		call(f1, def1, stack1, 1000, 2000, func() {})
+		call(f1, def1, stack1, 3000, 4500, func() {})
+	})
+	call(f0, def0, stack0, 9000, 9500, func() {})
+	// Dropped, the tracer is limited to four events.
+	call(f1, def1, stack1, 10000, 11000, func() {})
+
+	var want, funcTrace, got bytes.Buffer
+	if err := tracer.WriteTrace(&want); err != nil {
+		t.Fatal(err)
+	}
+	if err := tracer.WriteFuncTrace(&funcTrace); err != nil {
+		t.Fatal(err)
+	}
+	if funcTrace.Len() >= want.Len()/4 {
+		t.Errorf("function trace not compact: %d bytes, %d for the Chrome trace", funcTrace.Len(), want.Len())
+	}
+	if err := ConvertFuncTrace(&got, &funcTrace); err != nil {
+		t.Fatal(err)
+	}
+	if got.String() != want.String() {
+		t.Errorf("wrong conversion of the function trace:\n got: %s\nwant: %s", got.String(), want.String())
+	}
+}
+
+func TestConvertFuncTraceErrors(t *testing.T) {
+	for _, test := range []struct {
+		trace string
+		err   string
+	}{
+		{trace: "", err: "not a function trace"},
+		{trace: "{\"traceEvents\":[]}", err: "not a function trace"},
+		{trace: "wzft\x02", err: "unsupported function trace version: 2"},
+		{trace: "wzft\x01\x00\x01\x03ab", err: "unexpected EOF"},
+		{trace: "wzft\x01\x00\x00\x01", err: "unexpected EOF"},
+		{trace: "wzft\x01\x00\x00\x01\x00", err: "function index out of range: 0"},
+		{trace: "wzft\x01\x00\x00\x00\x00", err: "exit without a call in progress"},
+	} {
+		err := ConvertFuncTrace(new(bytes.Buffer), strings.NewReader(test.trace))
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%q: wrong error: want %q, got %v", test.trace, test.err, err)
+		}
+	}
+}
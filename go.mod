@@ -4,6 +4,13 @@ go 1.20
 
 require (
 	github.com/google/pprof v0.0.0-20230406165453-00490a63f317
+	github.com/stealthrocket/wasi-go v0.8.0
 	github.com/tetratelabs/wazero v1.5.0
-	golang.org/x/exp v0.0.0-20230425010034-47ecfdc1ba53
+	golang.org/x/exp v0.0.0-20230522175609-2e198f4a06a1
+)
+
+require (
+	github.com/ianlancetaylor/demangle v0.0.0-20220517205856-0058ec4f073c // indirect
+	github.com/stealthrocket/wazergo v0.19.1 // indirect
+	golang.org/x/sys v0.8.0 // indirect
 )
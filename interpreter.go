@@ -0,0 +1,69 @@
+package wzprof
+
+import (
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+)
+
+// interpretedFunction implements experimental.InternalFunction for the
+// functions of the languages executed by an interpreter compiled to wasm.
+// They are not functions of the wasm module: they have no imports, exports,
+// wasm signature, nor offset in the code section.
+type interpretedFunction struct {
+	// Language of the function, reported as its module name so the functions
+	// of the interpreter, indexed by address, are not confused with the
+	// functions of the wasm module at the same index.
+	lang string
+	name string
+	addr uint32
+
+	api.FunctionDefinition // required for WazeroOnly
+}
+
+func (f interpretedFunction) SourceOffsetForPC(pc experimental.ProgramCounter) uint64 {
+	return 0
+}
+
+func (f interpretedFunction) ModuleName() string {
+	return f.lang
+}
+
+func (f interpretedFunction) Index() uint32 {
+	return f.addr
+}
+
+func (f interpretedFunction) Import() (string, string, bool) {
+	return "", "", false
+}
+
+func (f interpretedFunction) ExportNames() []string {
+	return nil
+}
+
+func (f interpretedFunction) Name() string {
+	return f.name
+}
+
+func (f interpretedFunction) DebugName() string {
+	return f.name
+}
+
+func (f interpretedFunction) GoFunction() interface{} {
+	return nil
+}
+
+func (f interpretedFunction) ParamTypes() []api.ValueType {
+	return nil
+}
+
+func (f interpretedFunction) ParamNames() []string {
+	return nil
+}
+
+func (f interpretedFunction) ResultTypes() []api.ValueType {
+	return nil
+}
+
+func (f interpretedFunction) ResultNames() []string {
+	return nil
+}
@@ -0,0 +1,436 @@
+package wzprof
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"path"
+	"strconv"
+
+	"github.com/google/pprof/profile"
+)
+
+// WriteJFRProfile writes a CPU profile as a Java Flight Recorder file, which is
+// read by JDK Mission Control and the other tools consuming JFR recordings.
+//
+// The samples are written as jdk.ExecutionSample events of a single thread,
+// one event per sample counted in the "samples" values of the profile, spread
+// over the duration of the profile. The functions of the guest are methods of
+// a class named after their source file, or after the module when they have
+// no source file.
+func WriteJFRProfile(w io.Writer, prof *profile.Profile) error {
+	index, err := sampleTypeIndex(prof, "samples")
+	if err != nil {
+		return errors.New("JFR recordings can only be written for CPU profiles")
+	}
+
+	module := "wasm"
+	if len(prof.Mapping) > 0 && prof.Mapping[0].File != "" {
+		module = path.Base(prof.Mapping[0].File)
+	}
+
+	var (
+		symbols = make(map[string]uint64)
+		classes = make(map[string]uint64)
+		methods = make(map[jfrMethod]uint64)
+		stacks  []jfrStackTrace
+		counts  []int64
+		total   int64
+	)
+	symbol := func(s string) uint64 {
+		id, ok := symbols[s]
+		if !ok {
+			id = uint64(len(symbols) + 1)
+			symbols[s] = id
+		}
+		return id
+	}
+
+	for _, sample := range prof.Sample {
+		count := sample.Value[index]
+		if count <= 0 {
+			continue
+		}
+		// JFR stack traces start from the top frame, like pprof samples.
+		var stack jfrStackTrace
+		for _, loc := range sample.Location {
+			if len(loc.Line) == 0 {
+				stack = append(stack, jfrFrame{method: jfrMethod{class: module, name: strconv.FormatUint(loc.Address, 16)}})
+				continue
+			}
+			for _, line := range loc.Line {
+				m := jfrMethod{class: module, name: "?"}
+				if fn := line.Function; fn != nil {
+					m.name = fn.Name
+					if fn.Filename != "" {
+						m.class = fn.Filename
+					}
+				}
+				stack = append(stack, jfrFrame{method: m, line: line.Line})
+			}
+		}
+		for i, frame := range stack {
+			m := frame.method
+			if _, ok := methods[m]; !ok {
+				if _, ok := classes[m.class]; !ok {
+					classes[m.class] = uint64(len(classes) + 1)
+				}
+				methods[m] = uint64(len(methods) + 1)
+				symbol(m.class)
+				symbol(m.name)
+			}
+			stack[i].methodID = methods[m]
+		}
+		stacks = append(stacks, stack)
+		counts = append(counts, count)
+		total += count
+	}
+	symbol(jfrMethodDescriptor)
+
+	var chunk jfrBuffer
+	chunk.zero(jfrHeaderSize)
+
+	// Events are evenly spread over the profile, with ticks in nanoseconds
+	// since its start.
+	n := int64(0)
+	for i, count := range counts {
+		for j := int64(0); j < count; j++ {
+			ticks := int64(0)
+			if total > 1 {
+				ticks = prof.DurationNanos * n / (total - 1)
+			}
+			n++
+			chunk.event(jfrTypeExecutionSample, func(b *jfrBuffer) {
+				b.varint(uint64(ticks))
+				b.varint(jfrThreadID)
+				b.varint(uint64(i + 1))
+				b.varint(jfrThreadStateID)
+			})
+		}
+	}
+
+	// The constant pools of the values referenced by the events.
+	cpoolOffset := len(chunk)
+	chunk.event(jfrTypeCheckpoint, func(b *jfrBuffer) {
+		b.varint(0) // start
+		b.varint(0) // duration
+		b.varint(0) // delta to the next checkpoint, 0 when last
+		b.byte(1)   // flush
+		b.varint(7) // number of pools
+
+		b.varint(jfrTypeThread)
+		b.varint(1)
+		b.varint(jfrThreadID)
+		b.string(module) // osName
+		b.varint(1)      // osThreadId
+		b.string(module) // javaName
+		b.varint(1)      // javaThreadId
+
+		b.varint(jfrTypeThreadState)
+		b.varint(1)
+		b.varint(jfrThreadStateID)
+		b.string("STATE_RUNNABLE")
+
+		b.varint(jfrTypeFrameType)
+		b.varint(1)
+		b.varint(jfrFrameTypeID)
+		b.string("Interpreted")
+
+		b.varint(jfrTypeStackTrace)
+		b.varint(uint64(len(stacks)))
+		for i, stack := range stacks {
+			b.varint(uint64(i + 1))
+			b.byte(0) // truncated
+			b.varint(uint64(len(stack)))
+			for _, frame := range stack {
+				b.varint(frame.methodID)
+				b.varint(uint64(frame.line)) // lineNumber
+				b.varint(0)                  // bytecodeIndex
+				b.varint(jfrFrameTypeID)
+			}
+		}
+
+		b.varint(jfrTypeMethod)
+		b.varint(uint64(len(methods)))
+		for m, id := range methods {
+			b.varint(id)
+			b.varint(classes[m.class])
+			b.varint(symbols[m.name])
+			b.varint(symbols[jfrMethodDescriptor])
+			b.varint(jfrModifierPublic)
+			b.byte(0) // hidden
+		}
+
+		b.varint(jfrTypeClass)
+		b.varint(uint64(len(classes)))
+		for name, id := range classes {
+			b.varint(id)
+			b.varint(symbols[name])
+			b.varint(jfrModifierPublic)
+		}
+
+		b.varint(jfrTypeSymbol)
+		b.varint(uint64(len(symbols)))
+		for s, id := range symbols {
+			b.varint(id)
+			b.string(s)
+		}
+	})
+
+	metadataOffset := len(chunk)
+	chunk.event(jfrTypeMetadata, func(b *jfrBuffer) {
+		b.varint(0) // start
+		b.varint(0) // duration
+		b.varint(1) // metadata id
+		jfrMetadata.encode(b)
+	})
+
+	header := make([]byte, 0, jfrHeaderSize)
+	header = append(header, "FLR\x00"...)
+	header = binary.BigEndian.AppendUint16(header, jfrMajorVersion)
+	header = binary.BigEndian.AppendUint16(header, jfrMinorVersion)
+	header = binary.BigEndian.AppendUint64(header, uint64(len(chunk)))
+	header = binary.BigEndian.AppendUint64(header, uint64(cpoolOffset))
+	header = binary.BigEndian.AppendUint64(header, uint64(metadataOffset))
+	header = binary.BigEndian.AppendUint64(header, uint64(prof.TimeNanos))
+	header = binary.BigEndian.AppendUint64(header, uint64(prof.DurationNanos))
+	header = binary.BigEndian.AppendUint64(header, 0)   // start ticks
+	header = binary.BigEndian.AppendUint64(header, 1e9) // ticks per second
+	header = binary.BigEndian.AppendUint32(header, jfrFeatureCompressedInts)
+	copy(chunk, header)
+
+	_, err = w.Write(chunk)
+	return err
+}
+
+const (
+	jfrMajorVersion          = 2
+	jfrMinorVersion          = 0
+	jfrHeaderSize            = 68
+	jfrFeatureCompressedInts = 1
+
+	// Ids of the types declared in the metadata. 0 and 1 are the ids of the
+	// metadata and checkpoint events.
+	jfrTypeMetadata        = 0
+	jfrTypeCheckpoint      = 1
+	jfrTypeBoolean         = 4
+	jfrTypeInt             = 10
+	jfrTypeLong            = 11
+	jfrTypeString          = 20
+	jfrTypeClass           = 21
+	jfrTypeThread          = 22
+	jfrTypeStackTrace      = 26
+	jfrTypeStackFrame      = 27
+	jfrTypeMethod          = 28
+	jfrTypeFrameType       = 29
+	jfrTypeThreadState     = 30
+	jfrTypeSymbol          = 31
+	jfrTypeTimestamp       = 40
+	jfrTypeExecutionSample = 101
+
+	// Keys of the single values of their constant pools.
+	jfrThreadID      = 1
+	jfrThreadStateID = 1
+	jfrFrameTypeID   = 1
+
+	jfrModifierPublic   = 1
+	jfrMethodDescriptor = "()V"
+)
+
+type jfrMethod struct {
+	class string
+	name  string
+}
+
+type jfrFrame struct {
+	method   jfrMethod
+	methodID uint64
+	line     int64
+}
+
+type jfrStackTrace []jfrFrame
+
+// jfrElement is an element of the metadata of JFR recordings, which declares
+// the types of the events and constant pools.
+type jfrElement struct {
+	name       string
+	attributes [][2]string
+	children   []jfrElement
+}
+
+// encode writes the metadata rooted at e: the table of the strings of the
+// elements, followed by the elements referencing them by index.
+func (e *jfrElement) encode(b *jfrBuffer) {
+	var strings []string
+	index := make(map[string]uint64)
+	var collect func(*jfrElement)
+	add := func(s string) {
+		if _, ok := index[s]; !ok {
+			index[s] = uint64(len(strings))
+			strings = append(strings, s)
+		}
+	}
+	collect = func(e *jfrElement) {
+		add(e.name)
+		for _, attr := range e.attributes {
+			add(attr[0])
+			add(attr[1])
+		}
+		for i := range e.children {
+			collect(&e.children[i])
+		}
+	}
+	collect(e)
+
+	b.varint(uint64(len(strings)))
+	for _, s := range strings {
+		b.string(s)
+	}
+	var write func(*jfrElement)
+	write = func(e *jfrElement) {
+		b.varint(index[e.name])
+		b.varint(uint64(len(e.attributes)))
+		for _, attr := range e.attributes {
+			b.varint(index[attr[0]])
+			b.varint(index[attr[1]])
+		}
+		b.varint(uint64(len(e.children)))
+		for i := range e.children {
+			write(&e.children[i])
+		}
+	}
+	write(e)
+}
+
+func jfrClass(id int, name, superType string, fields ...jfrElement) jfrElement {
+	attrs := [][2]string{{"id", strconv.Itoa(id)}, {"name", name}}
+	if superType != "" {
+		attrs = append(attrs, [2]string{"superType", superType})
+	}
+	return jfrElement{name: "class", attributes: attrs, children: fields}
+}
+
+func jfrField(name string, class int, constantPool bool, annotations ...jfrElement) jfrElement {
+	attrs := [][2]string{{"name", name}, {"class", strconv.Itoa(class)}}
+	if constantPool {
+		attrs = append(attrs, [2]string{"constantPool", "true"})
+	}
+	return jfrElement{name: "field", attributes: attrs, children: annotations}
+}
+
+func jfrArrayField(name string, class int) jfrElement {
+	return jfrElement{name: "field", attributes: [][2]string{
+		{"name", name}, {"class", strconv.Itoa(class)}, {"dimension", "1"},
+	}}
+}
+
+var jfrMetadata = jfrElement{
+	name: "root",
+	children: []jfrElement{
+		{
+			name: "metadata",
+			children: []jfrElement{
+				jfrClass(jfrTypeBoolean, "boolean", ""),
+				jfrClass(jfrTypeInt, "int", ""),
+				jfrClass(jfrTypeLong, "long", ""),
+				jfrClass(jfrTypeString, "java.lang.String", ""),
+				jfrClass(jfrTypeTimestamp, "jdk.jfr.Timestamp", "java.lang.annotation.Annotation",
+					jfrField("value", jfrTypeString, false),
+				),
+				jfrClass(jfrTypeSymbol, "jdk.types.Symbol", "",
+					jfrField("string", jfrTypeString, false),
+				),
+				jfrClass(jfrTypeClass, "java.lang.Class", "",
+					jfrField("name", jfrTypeSymbol, true),
+					jfrField("modifiers", jfrTypeInt, false),
+				),
+				jfrClass(jfrTypeMethod, "jdk.types.Method", "",
+					jfrField("type", jfrTypeClass, true),
+					jfrField("name", jfrTypeSymbol, true),
+					jfrField("descriptor", jfrTypeSymbol, true),
+					jfrField("modifiers", jfrTypeInt, false),
+					jfrField("hidden", jfrTypeBoolean, false),
+				),
+				jfrClass(jfrTypeFrameType, "jdk.types.FrameType", "",
+					jfrField("description", jfrTypeString, false),
+				),
+				jfrClass(jfrTypeThreadState, "jdk.types.ThreadState", "",
+					jfrField("name", jfrTypeString, false),
+				),
+				jfrClass(jfrTypeThread, "java.lang.Thread", "",
+					jfrField("osName", jfrTypeString, false),
+					jfrField("osThreadId", jfrTypeLong, false),
+					jfrField("javaName", jfrTypeString, false),
+					jfrField("javaThreadId", jfrTypeLong, false),
+				),
+				jfrClass(jfrTypeStackFrame, "jdk.types.StackFrame", "",
+					jfrField("method", jfrTypeMethod, true),
+					jfrField("lineNumber", jfrTypeInt, false),
+					jfrField("bytecodeIndex", jfrTypeInt, false),
+					jfrField("type", jfrTypeFrameType, true),
+				),
+				jfrClass(jfrTypeStackTrace, "jdk.types.StackTrace", "",
+					jfrField("truncated", jfrTypeBoolean, false),
+					jfrArrayField("frames", jfrTypeStackFrame),
+				),
+				jfrClass(jfrTypeExecutionSample, "jdk.ExecutionSample", "jdk.jfr.Event",
+					jfrField("startTime", jfrTypeLong, false, jfrElement{
+						name:       "annotation",
+						attributes: [][2]string{{"class", strconv.Itoa(jfrTypeTimestamp)}, {"value", "TICKS"}},
+					}),
+					jfrField("sampledThread", jfrTypeThread, true),
+					jfrField("stackTrace", jfrTypeStackTrace, true),
+					jfrField("state", jfrTypeThreadState, true),
+				),
+			},
+		},
+		{
+			name:       "region",
+			attributes: [][2]string{{"locale", "en_US"}, {"gmtOffset", "0"}},
+		},
+	},
+}
+
+// jfrBuffer encodes the values of JFR recordings, with compressed integers.
+type jfrBuffer []byte
+
+func (b *jfrBuffer) byte(v byte) { *b = append(*b, v) }
+
+func (b *jfrBuffer) zero(n int) { *b = append(*b, make([]byte, n)...) }
+
+// varint appends v in the variable-length encoding of JFR: groups of 7 bits
+// with the high bit set when more groups follow, except for the ninth byte
+// which holds the last 8 bits.
+func (b *jfrBuffer) varint(v uint64) {
+	for i := 0; i < 8; i++ {
+		if v < 0x80 {
+			b.byte(byte(v))
+			return
+		}
+		b.byte(byte(v) | 0x80)
+		v >>= 7
+	}
+	b.byte(byte(v))
+}
+
+// string appends a string in the UTF-8 encoding.
+func (b *jfrBuffer) string(s string) {
+	b.byte(3)
+	b.varint(uint64(len(s)))
+	*b = append(*b, s...)
+}
+
+// event appends an event of the given type, with the payload encoded by fn.
+// The size of the event is encoded on 5 bytes, which is only known once the
+// payload is encoded.
+func (b *jfrBuffer) event(typ uint64, fn func(*jfrBuffer)) {
+	start := len(*b)
+	b.zero(5)
+	b.varint(typ)
+	fn(b)
+	size := uint32(len(*b) - start)
+	for i := 0; i < 4; i++ {
+		(*b)[start+i] = byte(size>>(7*i))&0x7f | 0x80
+	}
+	(*b)[start+4] = byte(size >> 28)
+}
@@ -0,0 +1,97 @@
+package wzprof
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/google/pprof/profile"
+)
+
+func TestWriteJFRProfile(t *testing.T) {
+	main := &profile.Function{ID: 1, Name: "main", Filename: "main.c"}
+	work := &profile.Function{ID: 2, Name: "work"}
+
+	mainLoc := &profile.Location{ID: 1, Line: []profile.Line{{Function: main, Line: 3}}}
+	workLoc := &profile.Location{ID: 2, Line: []profile.Line{{Function: work, Line: 12}}}
+
+	prof := &profile.Profile{
+		SampleType: []*profile.ValueType{
+			{Type: "samples", Unit: "count"},
+			{Type: "cpu", Unit: "nanoseconds"},
+		},
+		Sample: []*profile.Sample{
+			{Location: []*profile.Location{workLoc, mainLoc}, Value: []int64{2, 100}},
+			{Location: []*profile.Location{mainLoc}, Value: []int64{1, 20}},
+		},
+		Location:      []*profile.Location{mainLoc, workLoc},
+		Function:      []*profile.Function{main, work},
+		TimeNanos:     1e18,
+		DurationNanos: 1e9,
+	}
+
+	var b bytes.Buffer
+	if err := WriteJFRProfile(&b, prof); err != nil {
+		t.Fatal(err)
+	}
+	chunk := b.Bytes()
+
+	if string(chunk[:4]) != "FLR\x00" {
+		t.Fatalf("wrong magic: %q", chunk[:4])
+	}
+	if size := binary.BigEndian.Uint64(chunk[8:]); size != uint64(len(chunk)) {
+		t.Fatalf("wrong chunk size: %d != %d", size, len(chunk))
+	}
+	cpoolOffset := int(binary.BigEndian.Uint64(chunk[16:]))
+	metadataOffset := int(binary.BigEndian.Uint64(chunk[24:]))
+
+	varint := func(off int) (uint64, int) {
+		v := uint64(0)
+		for i := 0; i < 8; i++ {
+			c := chunk[off+i]
+			v |= uint64(c&0x7f) << (7 * i)
+			if c < 0x80 {
+				return v, off + i + 1
+			}
+		}
+		return v | uint64(chunk[off+8])<<56, off + 9
+	}
+
+	types := make(map[int]uint64)
+	samples := 0
+	for off := jfrHeaderSize; off < len(chunk); {
+		size, next := varint(off)
+		if size == 0 {
+			t.Fatalf("empty event at offset %d", off)
+		}
+		typ, _ := varint(next)
+		types[off] = typ
+		if typ == jfrTypeExecutionSample {
+			samples++
+		}
+		off += int(size)
+		if off > len(chunk) {
+			t.Fatalf("event at offset %d overflows the chunk", off)
+		}
+	}
+
+	if samples != 3 {
+		t.Errorf("wrong number of execution samples: %d", samples)
+	}
+	if typ, ok := types[cpoolOffset]; !ok || typ != jfrTypeCheckpoint {
+		t.Errorf("constant pool offset %d is not a checkpoint event", cpoolOffset)
+	}
+	if typ, ok := types[metadataOffset]; !ok || typ != jfrTypeMetadata {
+		t.Errorf("metadata offset %d is not a metadata event", metadataOffset)
+	}
+	for _, s := range []string{"jdk.ExecutionSample", "jdk.types.StackTrace"} {
+		if !bytes.Contains(chunk[metadataOffset:], []byte(s)) {
+			t.Errorf("metadata does not declare %s", s)
+		}
+	}
+
+	mem := &profile.Profile{SampleType: []*profile.ValueType{{Type: "alloc_space", Unit: "bytes"}}}
+	if err := WriteJFRProfile(&bytes.Buffer{}, mem); err == nil {
+		t.Error("expected error writing a memory profile")
+	}
+}
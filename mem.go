@@ -3,8 +3,13 @@ package wzprof
 import (
 	"context"
 	"encoding/binary"
+	"errors"
+	"io"
 	"net/http"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/pprof/profile"
@@ -27,9 +32,30 @@ import (
 type MemoryProfiler struct {
 	p     *Profiling
 	mutex sync.Mutex
-	alloc stackCounterMap
-	inuse map[uint32]memoryAllocation
-	start time.Time
+	alloc *stackCounterMap
+	inuse []inuseShard
+	// Maximum number of allocation stacks, see MaxMemoryStacks.
+	maxStacks int
+	// Maximum number of allocations tracked in each shard, zero when the
+	// number of allocations is not bounded.
+	maxInuse int
+	// Allocations evicted from the in-use shards, by stack, and the labels of
+	// their samples, guarded by mutex.
+	evicted       map[uint64]*memorySample
+	evictedLabels map[*sampleLabels]*sampleLabels
+	// Bytes in use, and the highest value it reached, when the memory in use
+	// is tracked.
+	inuseBytes atomic.Int64
+	peakInuse  atomic.Int64
+	start      time.Time
+	state      *profile.Profile
+
+	zigAllocators []string
+	// Parameters of the calls to allocation functions in progress, by
+	// thread of the guest.
+	threads threadStates[memoryThread]
+
+	gc func(context.Context) error
 }
 
 // MemoryProfilerOption is a type used to represent configuration options for
@@ -42,14 +68,197 @@ type MemoryProfilerOption func(*MemoryProfiler)
 func InuseMemory(enable bool) MemoryProfilerOption {
 	return func(p *MemoryProfiler) {
 		if enable {
-			p.inuse = make(map[uint32]memoryAllocation)
+			p.inuse = make([]inuseShard, inuseShards)
+			for i := range p.inuse {
+				p.inuse[i].allocs = make(map[uint64]memoryAllocation)
+			}
 		}
 	}
 }
 
+// DefaultMaxInuseAllocations is the default number of allocations tracked by
+// memory profilers with InuseMemory enabled, see MaxInuseAllocations.
+const DefaultMaxInuseAllocations = 1 << 20
+
+// MaxInuseAllocations is a memory profiler option which bounds the number of
+// allocations tracked when InuseMemory is enabled, so guests which rarely free
+// memory, or free it with functions that are not recorded, do not grow the
+// memory of the host without limit. Zero disables the limit.
+//
+// When the limit is reached, the oldest allocations are evicted. They remain
+// in the in-use values of their stacks, in samples labeled "inuse=evicted",
+// since they might still be in use, and are counted as dropped samples in the
+// metrics of the profiler.
+//
+// Default to DefaultMaxInuseAllocations.
+func MaxInuseAllocations(n int) MemoryProfilerOption {
+	return func(p *MemoryProfiler) {
+		p.maxInuse = 0
+		if n > 0 {
+			p.maxInuse = (n + inuseShards - 1) / inuseShards
+		}
+	}
+}
+
+// MaxMemoryStacks configures the maximum number of allocation stacks recorded
+// by the memory profiler, which bounds the memory it uses for guests with many
+// distinct stacks. The allocations of the stacks seen after the limit was
+// reached are aggregated in a sample of the "[dropped]" function, and counted
+// in the dropped samples of the metrics. Zero disables the limit.
+//
+// Default to DefaultMaxStacks.
+func MaxMemoryStacks(n int) MemoryProfilerOption {
+	return func(p *MemoryProfiler) { p.maxStacks = n }
+}
+
+// ZigAllocators configures the Zig allocator types whose alloc, resize, and
+// free functions are recorded by the memory profiler. Types are given by the
+// name they have in the name section of the module, without generic
+// parameters (e.g. "heap.arena_allocator.ArenaAllocator").
+//
+// Only the outermost call to an allocator is recorded, so allocators that
+// wrap each other are not counted twice.
+//
+// Default to the general purpose allocator and the wasm allocators of the
+// standard library.
+func ZigAllocators(types ...string) MemoryProfilerOption {
+	return func(p *MemoryProfiler) { p.zigAllocators = types }
+}
+
+// GuestGC is a memory profiler option setting the function which runs the
+// garbage collector of the guest. The http handler calls it before taking the
+// snapshot when requests have the "gc" query parameter, so the in-use values
+// only reflect live objects.
+//
+// The function is called concurrently to the guest, it must synchronize with
+// the guest itself (e.g. wazero modules do not support concurrent calls).
+func GuestGC(gc func(ctx context.Context) error) MemoryProfilerOption {
+	return func(p *MemoryProfiler) { p.gc = gc }
+}
+
+// ErrGuestGCUnsupported is returned by RunGuestGC when the memory profiler was
+// not configured with the GuestGC option.
+var ErrGuestGCUnsupported = errors.New("garbage collection of the guest is not supported")
+
+// RunGuestGC runs the garbage collector of the guest with the function set by
+// the GuestGC option.
+func (p *MemoryProfiler) RunGuestGC(ctx context.Context) error {
+	if p.gc == nil {
+		return ErrGuestGCUnsupported
+	}
+	return p.gc(ctx)
+}
+
+// Names of the functions that Go and TinyGo guests may export to run their
+// garbage collector, e.g.:
+//
+//	//export gc
+//	func gc() { runtime.GC() }
+var guestGCExports = []string{
+	"runtime.GC",
+	"runtime_GC",
+	"gc",
+	"GC",
+}
+
+// ExportedGC returns a function calling the garbage collector exported by the
+// module, to be passed to GuestGC, or nil if the module does not export one.
+//
+// Wazero modules do not support concurrent calls: the function holds lock
+// while it calls the collector, and the application must hold it as well
+// while the guest is running, so the collector only runs when the guest is
+// idle.
+func ExportedGC(mod api.Module, lock sync.Locker) func(ctx context.Context) error {
+	for _, name := range guestGCExports {
+		fn := mod.ExportedFunction(name)
+		if fn == nil {
+			continue
+		}
+		def := fn.Definition()
+		if len(def.ParamTypes()) != 0 || len(def.ResultTypes()) != 0 {
+			continue
+		}
+		return func(ctx context.Context) error {
+			lock.Lock()
+			defer lock.Unlock()
+			_, err := fn.Call(ctx)
+			return err
+		}
+	}
+	return nil
+}
+
+var defaultZigAllocators = []string{
+	"heap.general_purpose_allocator.GeneralPurposeAllocator",
+	"heap.WasmAllocator",
+	"heap.WasmPageAllocator",
+}
+
 type memoryAllocation struct {
 	*stackCounter
-	size uint32
+	size uint64
+	seq  uint64
+}
+
+// Number of shards that active allocations are distributed across. Taking a
+// snapshot locks one shard at a time, so the guest can keep allocating and
+// freeing memory in the other shards while a profile is being captured.
+const inuseShards = 16
+
+type inuseShard struct {
+	mutex  sync.Mutex
+	allocs map[uint64]memoryAllocation
+	// Addresses in allocation order, for eviction. Entries of allocations
+	// which were freed or reallocated since are skipped, they are identified
+	// by their sequence number.
+	order []inuseEntry
+	seq   uint64
+}
+
+type inuseEntry struct {
+	addr uint64
+	seq  uint64
+}
+
+// track records an allocation at addr in the shard, and evicts the oldest
+// allocations if the shard holds more than limit of them, calling evict for
+// each one. A limit of zero does not bound the number of allocations.
+func (s *inuseShard) track(addr, size uint64, alloc *stackCounter, limit int, evict func(memoryAllocation)) (prev memoryAllocation, reused bool) {
+	prev, reused = s.allocs[addr]
+	s.seq++
+	s.allocs[addr] = memoryAllocation{alloc, size, s.seq}
+	if limit == 0 {
+		return prev, reused
+	}
+	s.order = append(s.order, inuseEntry{addr, s.seq})
+
+	for len(s.allocs) > limit {
+		e := s.order[0]
+		s.order = s.order[1:]
+		if a, ok := s.allocs[e.addr]; ok && a.seq == e.seq {
+			delete(s.allocs, e.addr)
+			evict(a)
+		}
+	}
+
+	// Frees leave stale entries in the queue, which is compacted when they
+	// make up most of it.
+	if len(s.order) > 2*len(s.allocs)+64 {
+		order := make([]inuseEntry, 0, 2*len(s.allocs))
+		for _, e := range s.order {
+			if a, ok := s.allocs[e.addr]; ok && a.seq == e.seq {
+				order = append(order, e)
+			}
+		}
+		s.order = order
+	}
+	return prev, reused
+}
+
+func (p *MemoryProfiler) inuseShard(addr uint64) *inuseShard {
+	// Allocators return aligned addresses, the low bits carry little entropy
+	// so they are mixed with a multiplicative hash.
+	return &p.inuse[(addr*0x9e3779b97f4a7c15)>>60%inuseShards]
 }
 
 // newMemoryProfiler constructs a new instance of MemoryProfiler using the given
@@ -57,24 +266,126 @@ type memoryAllocation struct {
 func newMemoryProfiler(p *Profiling, options ...MemoryProfilerOption) *MemoryProfiler {
 	m := &MemoryProfiler{
 		p:     p,
-		alloc: make(stackCounterMap),
+		alloc: newStackCounterMap(0),
 		start: time.Now(),
+
+		maxStacks: DefaultMaxStacks,
+		maxInuse:  (DefaultMaxInuseAllocations + inuseShards - 1) / inuseShards,
+
+		zigAllocators: defaultZigAllocators,
 	}
 	for _, opt := range options {
 		opt(m)
 	}
+	m.alloc.setLimit(m.maxStacks, &p.metrics.dropped)
+	p.metrics.trackStacks(m.Count)
 	return m
 }
 
 // NewProfile takes a snapshot of the current memory allocation state and builds
 // a profile representing the state of the program memory.
 func (p *MemoryProfiler) NewProfile(sampleRate float64) *profile.Profile {
+	prof, _ := p.NewProfileContext(context.Background(), sampleRate)
+	return prof
+}
+
+// NewProfileContext is like NewProfile but stops building the profile and
+// returns an error when ctx is canceled. The progress of building the profile
+// is reported to the function installed on ctx by WithProgress.
+func (p *MemoryProfiler) NewProfileContext(ctx context.Context, sampleRate float64) (*profile.Profile, error) {
+	return p.newProfile(sampleRate)(ctx)
+}
+
+// NewProfileAsync is like NewProfileContext but only takes the snapshot of the
+// memory before returning, the profile is built in the background.
+func (p *MemoryProfiler) NewProfileAsync(ctx context.Context, sampleRate float64) *PendingProfile {
+	return buildProfileAsync(ctx, p.newProfile(sampleRate))
+}
+
+// newProfile takes a snapshot of the memory and returns a function building
+// its profile.
+func (p *MemoryProfiler) newProfile(sampleRate float64) func(context.Context) (*profile.Profile, error) {
+	samples, state := p.snapshot(), p.restoredState()
+	duration := time.Since(p.start)
+	return func(ctx context.Context) (*profile.Profile, error) {
+		ratio := 1 / sampleRate
+		prof, err := buildProfile(ctx, p.p, samples, p.start, p.p.clockSkew(), duration, p.SampleType(),
+			[]float64{ratio, ratio, ratio, ratio}, state,
+		)
+		return p.p.completeProfile(ctx, p.Name(), prof, err)
+	}
+}
+
+// WriteProfile is like NewProfileContext but writes the profile to w in the
+// pprof format as its samples are symbolized, instead of building it in
+// memory, which bounds the memory used to serve very large profiles.
+//
+// Like with CPUProfiler.StopProfileTo, the profile is built in memory and then
+// written when functions need the complete profile or when the state of the
+// profiler was restored.
+func (p *MemoryProfiler) WriteProfile(ctx context.Context, w io.Writer, sampleRate float64) error {
+	return p.writeProfile(ctx, w, sampleRate, nil)
+}
+
+func (p *MemoryProfiler) writeProfile(ctx context.Context, w io.Writer, sampleRate float64, labels map[string]string) error {
+	if p.restoredState() != nil || !p.p.encodable() {
+		prof, err := p.NewProfileContext(ctx, sampleRate)
+		if err != nil {
+			return err
+		}
+		addLabels(prof, labels)
+		return prof.Write(w)
+	}
+	samples := p.snapshot()
 	ratio := 1 / sampleRate
-	return buildProfile(p.p, p.snapshot(), p.start, time.Since(p.start), p.SampleType(),
-		[]float64{ratio, ratio, ratio, ratio},
+	return encodeProfile(ctx, p.p, w, samples, p.start, p.p.clockSkew(), time.Since(p.start), p.SampleType(),
+		[]float64{ratio, ratio, ratio, ratio}, labels,
 	)
 }
 
+// SaveState writes the allocation samples recorded by the profiler to w, so
+// they can be restored with RestoreState after the host migrates the guest
+// module to another instance (e.g. when snapshotting and restoring it).
+//
+// The state is written in the pprof format, without scaling of the sampling
+// rate. In-use values are not saved, since the objects they track cannot be
+// matched with the ones freed after the state is restored.
+func (p *MemoryProfiler) SaveState(w io.Writer) error {
+	samples := p.snapshot()
+	for key, sample := range samples {
+		sample.value[2] = 0
+		sample.value[3] = 0
+		// Samples of evicted allocations only have in-use values.
+		if sample.value[0] == 0 {
+			delete(samples, key)
+		}
+	}
+	prof, err := buildUnscaledProfile(context.Background(), p.p, samples, p.start, p.p.clockSkew(), time.Since(p.start), p.SampleType())
+	if err != nil {
+		return err
+	}
+	return writeProfileState(w, prof, p.restoredState())
+}
+
+// RestoreState reads a state written by SaveState. Its samples are merged in
+// all the profiles subsequently returned by NewProfile.
+func (p *MemoryProfiler) RestoreState(r io.Reader) error {
+	state, err := readProfileState(r, p.SampleType())
+	if err != nil {
+		return err
+	}
+	p.mutex.Lock()
+	p.state = state
+	p.mutex.Unlock()
+	return nil
+}
+
+func (p *MemoryProfiler) restoredState() *profile.Profile {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.state
+}
+
 // Name returns "allocs" to match the name of the memory profiler in pprof.
 func (p *MemoryProfiler) Name() string {
 	return "allocs"
@@ -87,10 +398,7 @@ func (p *MemoryProfiler) Desc() string {
 
 // Count returns the number of allocation stacks recorded in p.
 func (p *MemoryProfiler) Count() int {
-	p.mutex.Lock()
-	n := p.alloc.len()
-	p.mutex.Unlock()
-	return n
+	return p.alloc.len()
 }
 
 // SampleType returns the set of value types present in samples recorded by the
@@ -128,30 +436,42 @@ func (m *memorySample) sampleValue() []int64 {
 }
 
 func (p *MemoryProfiler) snapshot() map[uint64]*memorySample {
-	// We hold an exclusive lock while getting a snapshot of the profiler state.
-	// This will block concurrent calls to malloc/free/etc... We accept the cost
-	// since it only happens when the memory profile is captured, and memory
-	// allocation is generally accepted as being a potentially costly operation.
-	p.mutex.Lock()
-	defer p.mutex.Unlock()
-
-	samples := make(map[uint64]*memorySample, len(p.alloc))
+	// The allocation counters are copied one shard at a time, which only
+	// takes time proportional to the number of allocation stacks.
+	samples := make(map[uint64]*memorySample, p.alloc.len())
+
+	p.alloc.forEach(func(alloc *stackCounter) {
+		samples[alloc.stack.key] = &memorySample{
+			stack: alloc.stack,
+			value: [4]int64{alloc.count(), alloc.total()},
+		}
+	})
 
-	for _, alloc := range p.alloc {
-		p := samples[alloc.stack.key]
-		if p == nil {
-			p = &memorySample{stack: alloc.stack}
-			samples[alloc.stack.key] = p
+	// Walking the active allocations is proportional to the size of the heap,
+	// so each shard is locked in turn to avoid pausing the guest for the whole
+	// duration of the snapshot. Allocations made concurrently may appear in
+	// the in-use values without being counted in the alloc values yet.
+	for i := range p.inuse {
+		shard := &p.inuse[i]
+		shard.mutex.Lock()
+		for _, inuse := range shard.allocs {
+			p := samples[inuse.stack.key]
+			if p == nil {
+				p = &memorySample{stack: inuse.stack}
+				samples[inuse.stack.key] = p
+			}
+			p.value[2] += 1
+			p.value[3] += int64(inuse.size)
 		}
-		p.value[0] += alloc.count()
-		p.value[1] += alloc.total()
+		shard.mutex.Unlock()
 	}
 
-	for _, inuse := range p.inuse {
-		p := samples[inuse.stack.key]
-		p.value[2] += 1
-		p.value[3] += int64(inuse.size)
+	p.mutex.Lock()
+	for key, sample := range p.evicted {
+		s := *sample
+		samples[key] = &s
 	}
+	p.mutex.Unlock()
 
 	return samples
 }
@@ -165,9 +485,77 @@ func (p *MemoryProfiler) snapshot() map[uint64]*memorySample {
 //
 // The symbolizer passed as argument is used to resolve names of program
 // locations recorded in the profile.
+//
+// Like net/http/pprof, when the request has a "seconds" query parameter the
+// handler takes two snapshots of the memory profile that many seconds apart,
+// and responds with the difference, which shows the allocations made during
+// that time instead of since the start of the program.
+//
+// When the request has a "gc" query parameter with a non-zero value, the
+// handler runs the garbage collector of the guest before taking the snapshot,
+// see GuestGC.
 func (p *MemoryProfiler) NewHandler(sampleRate float64) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		serveProfile(w, p.NewProfile(sampleRate))
+		ctx := r.Context()
+		if gc, _ := strconv.Atoi(r.FormValue("gc")); gc > 0 {
+			if err := p.RunGuestGC(ctx); err != nil {
+				if errors.Is(err, ErrGuestGCUnsupported) {
+					serveError(w, http.StatusBadRequest, err.Error())
+				} else {
+					serveError(w, http.StatusInternalServerError, "running garbage collection of the guest: "+err.Error())
+				}
+				return
+			}
+		}
+
+		seconds := r.FormValue("seconds")
+		if seconds == "" {
+			streamProfile(w, r, func(w io.Writer, labels map[string]string) error {
+				return p.writeProfile(ctx, w, sampleRate, labels)
+			})
+			return
+		}
+
+		n, err := strconv.ParseInt(seconds, 10, 64)
+		if err != nil || n <= 0 {
+			serveError(w, http.StatusBadRequest, `invalid value for "seconds" - must be a positive integer`)
+			return
+		}
+		duration := time.Duration(n) * time.Second
+
+		if deadline, ok := ctx.Deadline(); ok {
+			if timeout := time.Until(deadline); duration > timeout {
+				serveError(w, http.StatusBadRequest, "profile duration exceeds server's WriteTimeout")
+				return
+			}
+		}
+
+		prev, err := p.NewProfileContext(ctx, sampleRate)
+		if err != nil {
+			serveError(w, http.StatusInternalServerError, "profile canceled")
+			return
+		}
+
+		timer := time.NewTimer(duration)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			serveError(w, http.StatusInternalServerError, "profile canceled")
+			return
+		}
+
+		curr, err := p.NewProfileContext(ctx, sampleRate)
+		if err != nil {
+			serveError(w, http.StatusInternalServerError, "profile canceled")
+			return
+		}
+		delta, err := DeltaProfile(prev, curr)
+		if err != nil {
+			serveError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		serveProfile(w, r, delta)
 	})
 }
 
@@ -176,7 +564,7 @@ func (p *MemoryProfiler) NewHandler(sampleRate float64) http.Handler {
 //
 // The listener recognizes multiple memory allocation functions used by
 // compilers and libraries. It uses the function name to detect memory
-// allocators, currently supporting libc, Go, and TinyGo.
+// allocators, currently supporting libc, Go, TinyGo, AssemblyScript, and Zig.
 func (p *MemoryProfiler) NewFunctionListener(def api.FunctionDefinition) experimental.FunctionListener {
 	if p.p.lang == python311 {
 		switch def.Name() {
@@ -210,6 +598,19 @@ func (p *MemoryProfiler) NewFunctionListener(def api.FunctionDefinition) experim
 		}
 		return nil
 	}
+	if p.p.lang == assemblyscript {
+		switch assemblyScriptRuntimeFunction(def) {
+		// __new(size: usize, id: u32): usize
+		case "__new":
+			return profilingListener{p.p, &mallocProfiler{memory: p}}
+		// __renew(oldPtr: usize, size: usize): usize
+		case "__renew":
+			return profilingListener{p.p, &reallocProfiler{memory: p}}
+		}
+		// Objects are released by the garbage collector and __pin only
+		// retains existing objects, so nothing else is recorded.
+		return nil
+	}
 	switch def.Name() {
 	// C standard library, Rust
 	case "malloc":
@@ -228,132 +629,368 @@ func (p *MemoryProfiler) NewFunctionListener(def api.FunctionDefinition) experim
 	// TinyGo
 	case "runtime.alloc":
 		return profilingListener{p.p, &mallocProfiler{memory: p}}
+	}
 
-	default:
-		return nil
+	// Zig
+	switch p.zigAllocatorFunction(def.Name()) {
+	case "alloc":
+		return profilingListener{p.p, &zigAllocProfiler{memory: p}}
+	case "resize":
+		return profilingListener{p.p, &zigResizeProfiler{memory: p}}
+	case "free":
+		return profilingListener{p.p, &zigFreeProfiler{memory: p}}
 	}
+	return nil
 }
 
-func (p *MemoryProfiler) observeAlloc(addr, size uint32, stack stackTrace) {
-	p.mutex.Lock()
-	alloc := p.alloc.lookup(stack)
-	alloc.observe(int64(size))
+// zigAllocatorFunction returns the name of the allocator method implemented by
+// the function, or an empty string if the function is not a method of one of
+// the configured Zig allocators. Names of methods of generic types look like:
+//
+//	heap.general_purpose_allocator.GeneralPurposeAllocator(.{...}).alloc
+func (p *MemoryProfiler) zigAllocatorFunction(name string) string {
+	i := strings.LastIndexByte(name, '.')
+	if i < 0 {
+		return ""
+	}
+	typ, method := name[:i], name[i+1:]
+	for _, t := range p.zigAllocators {
+		if typ == t || (strings.HasPrefix(typ, t+"(") && strings.HasSuffix(typ, ")")) {
+			return method
+		}
+	}
+	return ""
+}
+
+func (p *MemoryProfiler) observeAlloc(addr, size uint64, stack stackTrace) {
+	alloc := p.alloc.observe(stack, int64(size))
+	p.p.metrics.samples.Add(1)
+	p.p.streams.publish(p.Name(), stack, int64(size))
+
 	if p.inuse != nil {
-		p.inuse[addr] = memoryAllocation{alloc, size}
+		shard := p.inuseShard(addr)
+		shard.mutex.Lock()
+		prev, reused := shard.track(addr, size, alloc, p.maxInuse, p.evict)
+		shard.mutex.Unlock()
+
+		// Addresses freed by functions which are not recorded are reused
+		// without the free being observed.
+		delta := int64(size)
+		if reused {
+			delta -= int64(prev.size)
+		}
+		inuse := p.inuseBytes.Add(delta)
+		for peak := p.peakInuse.Load(); inuse > peak; peak = p.peakInuse.Load() {
+			if p.peakInuse.CompareAndSwap(peak, inuse) {
+				break
+			}
+		}
 	}
-	p.mutex.Unlock()
 }
 
-func (p *MemoryProfiler) observeFree(addr uint32) {
+// decode returns the pointer or size passed in v to or from an allocation
+// function, which are i64 values if the memory is addressed with 64 bits.
+func (p *MemoryProfiler) decode(v uint64) uint64 {
+	if p.p.memory64 {
+		return v
+	}
+	return uint64(api.DecodeU32(v))
+}
+
+func (p *MemoryProfiler) observeFree(addr uint64) {
 	if p.inuse != nil {
-		p.mutex.Lock()
-		delete(p.inuse, addr)
-		p.mutex.Unlock()
+		shard := p.inuseShard(addr)
+		shard.mutex.Lock()
+		alloc, ok := shard.allocs[addr]
+		delete(shard.allocs, addr)
+		shard.mutex.Unlock()
+		if ok {
+			p.inuseBytes.Add(-int64(alloc.size))
+		}
+	}
+}
+
+// evict records an allocation evicted from the in-use shards in the samples
+// of evicted allocations. It is called with the lock of the shard held.
+func (p *MemoryProfiler) evict(alloc memoryAllocation) {
+	p.inuseBytes.Add(-int64(alloc.size))
+	p.p.metrics.dropped.Add(1)
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	stack := alloc.stack
+	key := mixStackTraceKey(stack.key, evictedLabelHash)
+	sample := p.evicted[key]
+	if sample == nil {
+		if p.evicted == nil {
+			p.evicted = make(map[uint64]*memorySample)
+			p.evictedLabels = make(map[*sampleLabels]*sampleLabels)
+		}
+		labels := p.evictedLabels[stack.labels]
+		if labels == nil {
+			labels = stack.labels.with(evictedLabels)
+			p.evictedLabels[stack.labels] = labels
+		}
+		stack.labels = labels
+		sample = &memorySample{stack: stack}
+		p.evicted[key] = sample
 	}
+	sample.value[2] += 1
+	sample.value[3] += int64(alloc.size)
+}
+
+// Labels of the samples of allocations evicted from the in-use allocations,
+// see MaxInuseAllocations.
+var evictedLabels = map[string]string{"inuse": "evicted"}
+
+// Value mixed in the keys of the stacks of evicted allocations, so they are
+// distinct from the keys of the stacks they were allocated at.
+const evictedLabelHash = 0x6576696374656400
+
+// PeakInuseBytes returns the highest number of bytes in use by the objects
+// allocated by the guest since the creation of the profiler, or zero if the
+// memory in use is not tracked (see InuseMemory). Evicted allocations are not
+// counted in the bytes in use after their eviction (see MaxInuseAllocations).
+func (p *MemoryProfiler) PeakInuseBytes() int64 {
+	return p.peakInuse.Load()
+}
+
+// memoryThread is the state of the memory profiler for a thread of the guest.
+type memoryThread struct {
+	// Calls to the allocation functions in progress.
+	calls []memoryCall
+	// Number of calls to Zig allocators in progress, so allocations made by
+	// an allocator through its backing allocator are recorded only once.
+	zigDepth int
+}
+
+// memoryCall holds the parameters of a call to an allocation function until
+// it returns.
+type memoryCall struct {
+	addr  uint64
+	size  uint64
+	outer bool
+	stack stackTrace
+}
+
+// push returns the call of a function starting, which reuses the stack buffer
+// of a previous call.
+func (t *memoryThread) push() *memoryCall {
+	if n := len(t.calls); n < cap(t.calls) {
+		t.calls = t.calls[:n+1]
+	} else {
+		t.calls = append(t.calls, memoryCall{})
+	}
+	c := &t.calls[len(t.calls)-1]
+	c.addr, c.size, c.outer = 0, 0, false
+	return c
+}
+
+// pop returns the call of the function returning, which remains valid until
+// the next call to push.
+func (t *memoryThread) pop() *memoryCall {
+	i := len(t.calls) - 1
+	c := &t.calls[i]
+	t.calls = t.calls[:i]
+	return c
 }
 
 type mallocProfiler struct {
 	memory *MemoryProfiler
-	size   uint32
-	stack  stackTrace
 }
 
 func (p *mallocProfiler) Before(ctx context.Context, mod api.Module, def api.FunctionDefinition, params []uint64, si experimental.StackIterator) {
-	p.size = api.DecodeU32(params[0])
-	p.stack = makeStackTrace(p.stack, si)
+	c := p.memory.threads.get(mod).push()
+	c.size = p.memory.decode(params[0])
+	c.stack = makeStackTrace(ctx, c.stack, si)
 }
 
 func (p *mallocProfiler) After(ctx context.Context, mod api.Module, def api.FunctionDefinition, results []uint64) {
-	p.memory.observeAlloc(api.DecodeU32(results[0]), p.size, p.stack)
+	c := p.memory.threads.get(mod).pop()
+	p.memory.observeAlloc(p.memory.decode(results[0]), c.size, c.stack)
 }
 
 func (p *mallocProfiler) Abort(ctx context.Context, mod api.Module, def api.FunctionDefinition, _ error) {
+	p.memory.threads.get(mod).pop()
 }
 
 type callocProfiler struct {
 	memory *MemoryProfiler
-	count  uint32
-	size   uint32
-	stack  stackTrace
 }
 
 func (p *callocProfiler) Before(ctx context.Context, mod api.Module, def api.FunctionDefinition, params []uint64, si experimental.StackIterator) {
-	p.count = api.DecodeU32(params[0])
-	p.size = api.DecodeU32(params[1])
-	p.stack = makeStackTrace(p.stack, si)
+	c := p.memory.threads.get(mod).push()
+	c.size = p.memory.decode(params[0]) * p.memory.decode(params[1])
+	c.stack = makeStackTrace(ctx, c.stack, si)
 }
 
 func (p *callocProfiler) After(ctx context.Context, mod api.Module, def api.FunctionDefinition, results []uint64) {
-	p.memory.observeAlloc(api.DecodeU32(results[0]), p.count*p.size, p.stack)
+	c := p.memory.threads.get(mod).pop()
+	p.memory.observeAlloc(p.memory.decode(results[0]), c.size, c.stack)
 }
 
 func (p *callocProfiler) Abort(ctx context.Context, mod api.Module, def api.FunctionDefinition, _ error) {
+	p.memory.threads.get(mod).pop()
 }
 
 type reallocProfiler struct {
 	memory *MemoryProfiler
-	addr   uint32
-	size   uint32
-	stack  stackTrace
 }
 
 func (p *reallocProfiler) Before(ctx context.Context, mod api.Module, def api.FunctionDefinition, params []uint64, si experimental.StackIterator) {
-	p.addr = api.DecodeU32(params[0])
-	p.size = api.DecodeU32(params[1])
-	p.stack = makeStackTrace(p.stack, si)
+	c := p.memory.threads.get(mod).push()
+	c.addr = p.memory.decode(params[0])
+	c.size = p.memory.decode(params[1])
+	c.stack = makeStackTrace(ctx, c.stack, si)
 }
 
 func (p *reallocProfiler) After(ctx context.Context, mod api.Module, def api.FunctionDefinition, results []uint64) {
-	p.memory.observeFree(p.addr)
-	p.memory.observeAlloc(api.DecodeU32(results[0]), p.size, p.stack)
+	c := p.memory.threads.get(mod).pop()
+	p.memory.observeFree(c.addr)
+	p.memory.observeAlloc(p.memory.decode(results[0]), c.size, c.stack)
 }
 
 func (p *reallocProfiler) Abort(ctx context.Context, mod api.Module, def api.FunctionDefinition, _ error) {
+	p.memory.threads.get(mod).pop()
 }
 
 type freeProfiler struct {
 	memory *MemoryProfiler
-	addr   uint32
 }
 
 func (p *freeProfiler) Before(ctx context.Context, mod api.Module, def api.FunctionDefinition, params []uint64, si experimental.StackIterator) {
-	p.addr = api.DecodeU32(params[0])
+	c := p.memory.threads.get(mod).push()
+	c.addr = p.memory.decode(params[0])
 }
 
 func (p *freeProfiler) After(ctx context.Context, mod api.Module, def api.FunctionDefinition, _ []uint64) {
-	p.memory.observeFree(p.addr)
+	c := p.memory.threads.get(mod).pop()
+	p.memory.observeFree(c.addr)
 }
 
 func (p *freeProfiler) Abort(ctx context.Context, mod api.Module, def api.FunctionDefinition, _ error) {
 	p.After(ctx, mod, def, nil)
 }
 
+// The Zig allocator methods are called through the vtable of std.mem.Allocator.
+// Slices are passed as a pointer and a length:
+//
+//	alloc(ctx: *anyopaque, len: usize, log2_ptr_align: u8, ret_addr: usize) ?[*]u8
+//	resize(ctx: *anyopaque, buf: []u8, log2_buf_align: u8, new_len: usize, ret_addr: usize) bool
+//	free(ctx: *anyopaque, buf: []u8, log2_buf_align: u8, ret_addr: usize) void
+type zigAllocProfiler struct {
+	memory *MemoryProfiler
+}
+
+func (p *zigAllocProfiler) Before(ctx context.Context, mod api.Module, def api.FunctionDefinition, params []uint64, si experimental.StackIterator) {
+	t := p.memory.threads.get(mod)
+	c := t.push()
+	c.outer = t.zigDepth == 0
+	t.zigDepth++
+	if c.outer {
+		c.size = p.memory.decode(params[1])
+		c.stack = makeStackTrace(ctx, c.stack, si)
+	}
+}
+
+func (p *zigAllocProfiler) After(ctx context.Context, mod api.Module, def api.FunctionDefinition, results []uint64) {
+	t := p.memory.threads.get(mod)
+	c := t.pop()
+	t.zigDepth--
+	if addr := p.memory.decode(results[0]); c.outer && addr != 0 {
+		p.memory.observeAlloc(addr, c.size, c.stack)
+	}
+}
+
+func (p *zigAllocProfiler) Abort(ctx context.Context, mod api.Module, def api.FunctionDefinition, _ error) {
+	t := p.memory.threads.get(mod)
+	t.pop()
+	t.zigDepth--
+}
+
+type zigResizeProfiler struct {
+	memory *MemoryProfiler
+}
+
+func (p *zigResizeProfiler) Before(ctx context.Context, mod api.Module, def api.FunctionDefinition, params []uint64, si experimental.StackIterator) {
+	t := p.memory.threads.get(mod)
+	c := t.push()
+	c.outer = t.zigDepth == 0
+	t.zigDepth++
+	if c.outer {
+		c.addr = p.memory.decode(params[1])
+		c.size = p.memory.decode(params[4])
+		c.stack = makeStackTrace(ctx, c.stack, si)
+	}
+}
+
+func (p *zigResizeProfiler) After(ctx context.Context, mod api.Module, def api.FunctionDefinition, results []uint64) {
+	t := p.memory.threads.get(mod)
+	c := t.pop()
+	t.zigDepth--
+	// Resizing happens in place, the buffer keeps its address.
+	if c.outer && api.DecodeU32(results[0]) != 0 {
+		p.memory.observeFree(c.addr)
+		p.memory.observeAlloc(c.addr, c.size, c.stack)
+	}
+}
+
+func (p *zigResizeProfiler) Abort(ctx context.Context, mod api.Module, def api.FunctionDefinition, _ error) {
+	t := p.memory.threads.get(mod)
+	t.pop()
+	t.zigDepth--
+}
+
+type zigFreeProfiler struct {
+	memory *MemoryProfiler
+}
+
+func (p *zigFreeProfiler) Before(ctx context.Context, mod api.Module, def api.FunctionDefinition, params []uint64, si experimental.StackIterator) {
+	t := p.memory.threads.get(mod)
+	c := t.push()
+	c.outer = t.zigDepth == 0
+	t.zigDepth++
+	c.addr = p.memory.decode(params[1])
+}
+
+func (p *zigFreeProfiler) After(ctx context.Context, mod api.Module, def api.FunctionDefinition, _ []uint64) {
+	t := p.memory.threads.get(mod)
+	c := t.pop()
+	t.zigDepth--
+	if c.outer {
+		p.memory.observeFree(c.addr)
+	}
+}
+
+func (p *zigFreeProfiler) Abort(ctx context.Context, mod api.Module, def api.FunctionDefinition, _ error) {
+	p.After(ctx, mod, def, nil)
+}
+
 type goRuntimeMallocgcProfiler struct {
 	memory *MemoryProfiler
-	size   uint32
-	stack  stackTrace
 }
 
 func (p *goRuntimeMallocgcProfiler) Before(ctx context.Context, mod api.Module, def api.FunctionDefinition, params []uint64, wasmsi experimental.StackIterator) {
 	imod := mod.(experimental.InternalModule)
 	mem := imod.Memory()
+	c := p.memory.threads.get(mod).push()
 
 	sp := uint32(imod.Global(0).Get())
 	offset := sp + 8*(uint32(0)+1) // +1 for the return address
 	b, ok := mem.Read(offset, 8)
 	if ok {
-		p.size = binary.LittleEndian.Uint32(b)
-		p.stack = makeStackTrace(p.stack, wasmsi)
-	} else {
-		p.size = 0
+		c.size = binary.LittleEndian.Uint64(b)
+		c.stack = makeStackTrace(ctx, c.stack, wasmsi)
 	}
 }
 
 func (p *goRuntimeMallocgcProfiler) After(ctx context.Context, mod api.Module, def api.FunctionDefinition, _ []uint64) {
-	if p.size != 0 {
+	c := p.memory.threads.get(mod).pop()
+	if c.size != 0 {
 		// TODO: get the returned pointer
-		addr := uint32(0)
-		p.memory.observeAlloc(addr, p.size, p.stack)
+		addr := uint64(0)
+		p.memory.observeAlloc(addr, c.size, c.stack)
 	}
 }
 
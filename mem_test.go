@@ -1,10 +1,386 @@
 package wzprof
 
 import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/google/pprof/profile"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+	"github.com/tetratelabs/wazero/experimental/wazerotest"
 )
 
 func BenchmarkMemoryProfiler(b *testing.B) {
 	p := ProfilingFor(nil).MemoryProfiler()
 	benchmarkFunctionListener(b, p)
 }
+
+func TestMemoryProfilerConcurrentSnapshot(t *testing.T) {
+	p := ProfilingFor(nil).MemoryProfiler(InuseMemory(true))
+
+	module := wazerotest.NewModule(nil,
+		wazerotest.NewFunction(func(context.Context, api.Module) {}),
+	)
+	trace := makeStackTraceFromFrames([]experimental.StackFrame{
+		{Function: module.Function(0)},
+	})
+
+	const allocs = 1000
+	done := make(chan struct{})
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				p.snapshot()
+			}
+		}
+	}()
+
+	for i := uint64(0); i < allocs; i++ {
+		p.observeAlloc(16*i, 16, trace)
+	}
+	for i := uint64(0); i < allocs; i += 2 {
+		p.observeFree(16 * i)
+	}
+	close(done)
+	wg.Wait()
+
+	sample := p.snapshot()[trace.key]
+	if sample == nil {
+		t.Fatal("missing sample for allocation stack")
+	}
+	want := [4]int64{allocs, 16 * allocs, allocs / 2, 16 * allocs / 2}
+	if sample.value != want {
+		t.Errorf("wrong sample values: want %v, got %v", want, sample.value)
+	}
+}
+
+func TestMemoryProfilerPeakInuseBytes(t *testing.T) {
+	p := ProfilingFor(nil).MemoryProfiler(InuseMemory(true))
+
+	module := wazerotest.NewModule(nil,
+		wazerotest.NewFunction(func(context.Context, api.Module) {}),
+	)
+	trace := makeStackTraceFromFrames([]experimental.StackFrame{
+		{Function: module.Function(0)},
+	})
+
+	p.observeAlloc(0, 100, trace)
+	p.observeAlloc(100, 50, trace)
+	p.observeFree(0)
+	p.observeFree(1000) // not allocated
+	p.observeAlloc(0, 80, trace)
+	// Reused without being freed.
+	p.observeAlloc(100, 10, trace)
+
+	if peak := p.PeakInuseBytes(); peak != 150 {
+		t.Errorf("wrong peak of bytes in use: want 150, got %d", peak)
+	}
+	if inuse := p.inuseBytes.Load(); inuse != 90 {
+		t.Errorf("wrong bytes in use: want 90, got %d", inuse)
+	}
+	if peak := ProfilingFor(nil).MemoryProfiler().PeakInuseBytes(); peak != 0 {
+		t.Errorf("peak of bytes in use without tracking: %d", peak)
+	}
+}
+
+func TestMemoryProfilerZigAllocators(t *testing.T) {
+	p := ProfilingFor(nil).MemoryProfiler()
+
+	tests := []struct {
+		name   string
+		method string
+	}{
+		{name: "heap.general_purpose_allocator.GeneralPurposeAllocator(.{.thread_safe = false}).alloc", method: "alloc"},
+		{name: "heap.general_purpose_allocator.GeneralPurposeAllocator(.{.thread_safe = false}).free", method: "free"},
+		{name: "heap.WasmAllocator.resize", method: "resize"},
+		{name: "heap.arena_allocator.ArenaAllocator.alloc", method: ""},
+		{name: "heap.WasmAllocatorExt.alloc", method: ""},
+		{name: "malloc", method: ""},
+	}
+	for _, test := range tests {
+		if method := p.zigAllocatorFunction(test.name); method != test.method {
+			t.Errorf("%s: want %q, got %q", test.name, test.method, method)
+		}
+	}
+
+	p = ProfilingFor(nil).MemoryProfiler(ZigAllocators("heap.arena_allocator.ArenaAllocator"))
+	if method := p.zigAllocatorFunction("heap.arena_allocator.ArenaAllocator.alloc"); method != "alloc" {
+		t.Errorf("configured allocator not recognized: %q", method)
+	}
+}
+
+func TestMemoryProfilerZigNestedAllocators(t *testing.T) {
+	p := ProfilingFor(nil).MemoryProfiler()
+
+	gpaAlloc := wazerotest.NewFunction(func(ctx context.Context, mod api.Module, ctxp, size, align, ret uint32) uint32 {
+		return 0
+	})
+	gpaAlloc.FunctionName = "heap.general_purpose_allocator.GeneralPurposeAllocator(.{}).alloc"
+	wasmAlloc := wazerotest.NewFunction(func(ctx context.Context, mod api.Module, ctxp, size, align, ret uint32) uint32 {
+		return 0
+	})
+	wasmAlloc.FunctionName = "heap.WasmAllocator.alloc"
+
+	module := wazerotest.NewModule(nil, gpaAlloc, wasmAlloc)
+	outer := module.Function(0).Definition()
+	inner := module.Function(1).Definition()
+	f0 := p.NewFunctionListener(outer)
+	f1 := p.NewFunctionListener(inner)
+
+	ctx := context.Background()
+	stack := []experimental.StackFrame{{Function: module.Function(0)}}
+
+	f0.Before(ctx, module, outer, []uint64{0, 100, 0, 0}, experimental.NewStackIterator(stack...))
+	f1.Before(ctx, module, inner, []uint64{0, 4096, 0, 0}, experimental.NewStackIterator(stack...))
+	f1.After(ctx, module, inner, []uint64{0x10000})
+	f0.After(ctx, module, outer, []uint64{0x10000})
+
+	trace := makeStackTraceFromFrames(stack)
+	assertStackCount(t, p.alloc, trace, 1, 100)
+}
+
+func TestMemoryProfilerMemory64(t *testing.T) {
+	header := []byte{0x00, 'a', 's', 'm', 1, 0, 0, 0}
+	memory32 := append(header, 5, 3, 1, 0x00, 1) // memory section: min 1
+	memory64 := append(header, 5, 3, 1, 0x04, 1) // memory section: 64 bits, min 1
+
+	if err := CheckModule(memory64); !errors.Is(err, ErrMemory64Unsupported) {
+		t.Errorf("memory64 module not reported as unsupported by the runtime: %v", err)
+	}
+	if err := CheckModule(memory32); err != nil {
+		t.Errorf("memory32 module reported as unsupported: %v", err)
+	}
+
+	// The allocation functions of memory64 modules take and return i64
+	// pointers and sizes.
+	malloc := wazerotest.NewFunction(func(ctx context.Context, mod api.Module, size uint64) uint64 {
+		return 0
+	})
+	malloc.FunctionName = "malloc"
+	free := wazerotest.NewFunction(func(ctx context.Context, mod api.Module, ptr uint64) {})
+	free.FunctionName = "free"
+
+	module := wazerotest.NewModule(wazerotest.NewFixedMemory(wazerotest.PageSize), malloc, free)
+	stack := []experimental.StackFrame{{Function: module.Function(0)}}
+	trace := makeStackTraceFromFrames(stack)
+	ctx := context.Background()
+
+	var addr, size uint64 = 0x1_0000_1000, 0x1_0000_0010
+
+	for _, wasm := range [][]byte{memory32, memory64} {
+		p := ProfilingFor(wasm).MemoryProfiler(InuseMemory(true))
+		is64 := wasmMemory64(wasm)
+		fmalloc := p.NewFunctionListener(malloc.Definition())
+		ffree := p.NewFunctionListener(free.Definition())
+
+		fmalloc.Before(ctx, module, malloc.Definition(), []uint64{size}, experimental.NewStackIterator(stack...))
+		fmalloc.After(ctx, module, malloc.Definition(), []uint64{addr})
+
+		// Pointers and sizes of wasm32 modules are i32 values, the high bits
+		// of the 64-bit stack slots are not part of them.
+		wantSize := int64(size)
+		if !is64 {
+			wantSize = int64(uint32(size))
+		}
+		assertStackCount(t, p.alloc, trace, 1, wantSize)
+		if inuse := p.inuseBytes.Load(); inuse != wantSize {
+			t.Errorf("memory64=%t: wrong bytes in use: want %d, got %d", is64, wantSize, inuse)
+		}
+
+		// Freeing the 32 bits address must not release the allocation made
+		// above 4GiB.
+		if is64 {
+			ffree.Before(ctx, module, free.Definition(), []uint64{uint64(uint32(addr))}, experimental.NewStackIterator(stack...))
+			ffree.After(ctx, module, free.Definition(), nil)
+			if inuse := p.inuseBytes.Load(); inuse != wantSize {
+				t.Errorf("allocation released by a free of its low 32 bits: %d bytes in use", inuse)
+			}
+		}
+		ffree.Before(ctx, module, free.Definition(), []uint64{addr}, experimental.NewStackIterator(stack...))
+		ffree.After(ctx, module, free.Definition(), nil)
+		if inuse := p.inuseBytes.Load(); inuse != 0 {
+			t.Errorf("memory64=%t: wrong bytes in use after free: want 0, got %d", is64, inuse)
+		}
+	}
+}
+
+func TestMemoryProfilerDeltaHandler(t *testing.T) {
+	p := ProfilingFor(nil).MemoryProfiler()
+	alloc := newMallocListener(p)
+	handler := p.NewHandler(1)
+
+	alloc(10)
+
+	w := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/debug/pprof/allocs?seconds=1", nil))
+	}()
+	// Give the handler the time to take the first snapshot.
+	time.Sleep(200 * time.Millisecond)
+	alloc(32)
+	<-done
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("wrong status: %d: %s", w.Code, w.Body)
+	}
+	prof, err := profile.Parse(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only the allocation made during the profile is reported.
+	if len(prof.Sample) != 1 {
+		t.Fatalf("wrong number of samples: %d", len(prof.Sample))
+	}
+	if v := prof.Sample[0].Value; v[0] != 1 || v[1] != 32 {
+		t.Errorf("wrong sample values: %v", v)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/debug/pprof/allocs?seconds=-1", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("wrong status for invalid duration: %d", w.Code)
+	}
+}
+
+func TestMemoryProfilerNewProfileContext(t *testing.T) {
+	p := ProfilingFor(nil).MemoryProfiler()
+	alloc := newMallocListener(p)
+	alloc(10)
+
+	var progress [][2]int
+	ctx := WithProgress(context.Background(), func(done, total int) {
+		progress = append(progress, [2]int{done, total})
+	})
+	prof, err := p.NewProfileContext(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(prof.Sample) != 1 {
+		t.Fatalf("wrong number of samples: %d", len(prof.Sample))
+	}
+	if n := len(progress); n == 0 || progress[n-1] != [2]int{1, 1} {
+		t.Errorf("wrong progress: %v", progress)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := p.NewProfileContext(ctx, 1); err != context.Canceled {
+		t.Errorf("want context.Canceled, got %v", err)
+	}
+}
+
+func TestMemoryProfilerGuestGC(t *testing.T) {
+	// The lock is held by the guest while it runs, the collector must wait
+	// for it to be idle.
+	var running atomic.Bool
+	var calls atomic.Int32
+	gc := wazerotest.NewFunction(func(context.Context, api.Module) {
+		if running.Load() {
+			t.Error("guest GC called while the guest is running")
+		}
+		calls.Add(1)
+	})
+	gc.FunctionName = "gc"
+	gc.ExportNames = []string{"gc"}
+	module := wazerotest.NewModule(nil, gc)
+
+	var guest sync.Mutex
+	guest.Lock()
+	running.Store(true)
+
+	handler := ProfilingFor(nil).MemoryProfiler(GuestGC(ExportedGC(module, &guest))).NewHandler(1)
+	w := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/debug/pprof/heap?gc=1", nil))
+	}()
+	time.Sleep(50 * time.Millisecond)
+	running.Store(false)
+	guest.Unlock()
+	<-done
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("wrong status: %d: %s", w.Code, w.Body)
+	}
+	if n := calls.Load(); n != 1 {
+		t.Errorf("wrong number of calls to the guest GC: %d", n)
+	}
+
+	handler = ProfilingFor(nil).MemoryProfiler().NewHandler(1)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/debug/pprof/heap?gc=1", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("wrong status without guest GC: %d", w.Code)
+	}
+}
+
+func TestMemoryProfilerMaxInuseAllocations(t *testing.T) {
+	p := ProfilingFor(nil).MemoryProfiler(InuseMemory(true), MaxInuseAllocations(inuseShards))
+
+	module := wazerotest.NewModule(nil,
+		wazerotest.NewFunction(func(context.Context, api.Module) {}),
+	)
+	trace := makeStackTraceFromFrames([]experimental.StackFrame{
+		{Function: module.Function(0)},
+	})
+
+	const allocs = 1000
+	for i := uint64(0); i < allocs; i++ {
+		p.observeAlloc(16*i, 16, trace)
+		// Free every other allocation, leaving stale entries in the queues.
+		if i%2 == 0 {
+			p.observeFree(16 * i)
+		}
+	}
+
+	tracked := 0
+	for i := range p.inuse {
+		shard := &p.inuse[i]
+		if len(shard.allocs) > 1 {
+			t.Errorf("shard %d tracks %d allocations", i, len(shard.allocs))
+		}
+		if len(shard.order) > 2*len(shard.allocs)+64 {
+			t.Errorf("shard %d has %d queued entries", i, len(shard.order))
+		}
+		tracked += len(shard.allocs)
+	}
+
+	samples := p.snapshot()
+	if len(samples) != 2 {
+		t.Fatalf("wrong number of samples: want 2, got %d", len(samples))
+	}
+	var evicted *memorySample
+	for _, sample := range samples {
+		if sample.stack.labels != nil {
+			evicted = sample
+		}
+	}
+	if evicted == nil || evicted.stack.labels.labels["inuse"] != "evicted" {
+		t.Fatalf("no sample of evicted allocations: %+v", samples)
+	}
+	want := [4]int64{0, 0, allocs/2 - int64(tracked), 16 * (allocs/2 - int64(tracked))}
+	if evicted.value != want {
+		t.Errorf("wrong values of evicted allocations: want %v, got %v", want, evicted.value)
+	}
+	if dropped := p.p.metrics.dropped.Load(); dropped != uint64(want[2]) {
+		t.Errorf("wrong number of dropped samples: want %d, got %d", want[2], dropped)
+	}
+	if inuse := p.inuseBytes.Load(); inuse != 16*int64(tracked) {
+		t.Errorf("wrong bytes in use: want %d, got %d", 16*tracked, inuse)
+	}
+}
@@ -3,8 +3,12 @@
 package wzprof
 
 import (
+	"bytes"
 	"fmt"
+	"math"
 	"unsafe"
+
+	"github.com/tetratelabs/wazero/api"
 )
 
 // ptr64 represents a 64-bits address in the guest memory. It replaces unintptr
@@ -12,20 +16,20 @@ import (
 // this type helps to avoid dereferencing the host memory.
 type ptr64 uint64
 
-func (p ptr64) addr() uint32 {
-	return uint32(p)
+func (p ptr64) addr() uint64 {
+	return uint64(p)
 }
 
 // ptr32 represents a 32-bits address in the guest memory. It replaces pointers
 // in clang-wasi generated code.
 type ptr32 uint32
 
-func (p ptr32) addr() uint32 {
-	return uint32(p)
+func (p ptr32) addr() uint64 {
+	return uint64(p)
 }
 
 type ptr interface {
-	addr() uint32
+	addr() uint64
 }
 
 // vmem is the minimum interface required for virtual memory accesses in this
@@ -44,8 +48,20 @@ type vmem interface {
 	// Read returns a view of the size bytes at the given virtual
 	// address, or false if the requested bytes are out of range.
 	// Users of this output need not modify the bytes, and make a copy
-	// of them if they wish to persist the data.
-	Read(address, size uint32) ([]byte, bool)
+	// of them if they wish to persist the data. Addresses are 64 bits
+	// wide to cover the memories of memory64 modules.
+	Read(address uint64, size uint32) ([]byte, bool)
+}
+
+// wasmMemory adapts the memory of a module instance to vmem. The memory API
+// of wazero addresses 32 bits, the reads beyond 4GiB are out of range.
+type wasmMemory struct{ api.Memory }
+
+func (m wasmMemory) Read(address uint64, size uint32) ([]byte, bool) {
+	if address > math.MaxUint32 {
+		return nil, false
+	}
+	return m.Memory.Read(uint32(address), size)
 }
 
 // deref the bytes at address p in virtual memory, casting them back as T. It is
@@ -78,24 +94,67 @@ func derefArray[T any](r vmem, p ptr, n uint32) []T {
 	return unsafe.Slice(x, n)
 }
 
-// derefGoSlice takes a slice whose data pointer targets the guest memory, and
-// returns a copy the slice's contents in host memory. It is not recursive. Cap
-// is set to Len, no matter its initial value. Assumes the underlying pointer is
-// 64-bits.
-func derefGoSlice[T any](r vmem, s []T) []T {
-	count := len(s)
-	dp := ptr64(uintptr(unsafe.Pointer(unsafe.SliceData(s)))) // Convert to uintptr first, then to ptr64
-	res := make([]T, count)
-	for i := 0; i < count; i++ {
-		res[i] = derefArrayIndex[T](r, dp, int32(i))
+// viewArray returns the n contiguous elements of type T starting at the
+// virtual address p, without copying them out of the guest memory. The view
+// is only valid while the memory is not moved to a different buffer, see
+// memoryBase.
+func viewArray[T any](r vmem, p ptr, n uint32) []T {
+	var t T
+	s := uint32(unsafe.Sizeof(t)) * n
+	view, ok := r.Read(p.addr(), s)
+	if !ok {
+		panic(fmt.Errorf("invalid virtual memory array read at %#x size %d", p, s))
+	}
+	x := (*T)(unsafe.Pointer(unsafe.SliceData(view)))
+	return unsafe.Slice(x, n)
+}
+
+// memoryBase returns the address of the buffer backing r, which changes when
+// the memory is moved to a different buffer (e.g. when it grows past its
+// capacity), or nil if the memory is empty.
+func memoryBase(r vmem) unsafe.Pointer {
+	b, ok := r.Read(0, 1)
+	if !ok {
+		return nil
+	}
+	return unsafe.Pointer(unsafe.SliceData(b))
+}
+
+// derefCString reads the null-terminated string starting at address p. The
+// bytes are copied out of the guest memory. Returns an empty string if p is
+// null or the string is not terminated within the memory bounds.
+func derefCString(r vmem, p ptr) string {
+	const chunk = 64
+	if p.addr() == 0 {
+		return ""
+	}
+	var s []byte
+	for a := p.addr(); ; a += chunk {
+		b, ok := r.Read(a, chunk)
+		if !ok {
+			// Near the end of memory, fallback to reading byte by byte.
+			for ; ; a++ {
+				c, ok := r.Read(a, 1)
+				if !ok {
+					return ""
+				}
+				if c[0] == 0 {
+					return string(s)
+				}
+				s = append(s, c[0])
+			}
+		}
+		if i := bytes.IndexByte(b, 0); i >= 0 {
+			return string(append(s, b[:i]...))
+		}
+		s = append(s, b...)
 	}
-	return res
 }
 
 // Reads the i-th element of an array that starts at address p.
 func derefArrayIndex[T any](r vmem, p ptr, i int32) T {
 	var t T
 	a := p.addr()
-	s := uint32(unsafe.Sizeof(t))
-	return deref[T](r, ptr32(a+uint32(i)*s))
+	s := uint64(unsafe.Sizeof(t))
+	return deref[T](r, ptr64(a+uint64(int64(i))*s))
 }
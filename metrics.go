@@ -0,0 +1,84 @@
+package wzprof
+
+import (
+	"expvar"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics describes the activity of the profilers of a module, so operators
+// can monitor the profiling itself in production.
+type Metrics struct {
+	// Number of samples recorded by the profilers: calls timed by CPU
+	// profilers, allocations recorded by memory profilers, and events recorded
+	// by tracers.
+	Samples uint64 `json:"samples"`
+	// Number of distinct stacks currently tracked by the profilers.
+	Stacks int `json:"stacks"`
+	// Number of samples which were not recorded because a profiler reached
+	// its limits (e.g. MaxTraceEvents).
+	DroppedSamples uint64 `json:"dropped_samples"`
+	// Estimated time spent in the function listeners of the profilers, which
+	// the instrumentation adds to the execution of the guest.
+	Overhead time.Duration `json:"overhead_ns"`
+	// Lookups of the cache of symbolized locations when building profiles.
+	SymbolCacheHits   uint64 `json:"symbol_cache_hits"`
+	SymbolCacheMisses uint64 `json:"symbol_cache_misses"`
+}
+
+// SymbolCacheHitRate returns the ratio of lookups of symbolized locations
+// served from the cache, or zero if there were none.
+func (m Metrics) SymbolCacheHitRate() float64 {
+	total := m.SymbolCacheHits + m.SymbolCacheMisses
+	if total == 0 {
+		return 0
+	}
+	return float64(m.SymbolCacheHits) / float64(total)
+}
+
+type profilingMetrics struct {
+	samples     atomic.Uint64
+	dropped     atomic.Uint64
+	overhead    atomic.Int64
+	cacheHits   atomic.Uint64
+	cacheMisses atomic.Uint64
+
+	mutex  sync.Mutex
+	stacks []func() int
+}
+
+// trackStacks registers a function returning the number of stacks tracked by
+// a profiler.
+func (m *profilingMetrics) trackStacks(stacks func() int) {
+	m.mutex.Lock()
+	m.stacks = append(m.stacks, stacks)
+	m.mutex.Unlock()
+}
+
+// Metrics returns a snapshot of the metrics of the profilers created from p.
+func (p *Profiling) Metrics() Metrics {
+	m := &p.metrics
+	m.mutex.Lock()
+	stacks := 0
+	for _, n := range m.stacks {
+		stacks += n()
+	}
+	m.mutex.Unlock()
+
+	return Metrics{
+		Samples:           m.samples.Load(),
+		Stacks:            stacks,
+		DroppedSamples:    m.dropped.Load(),
+		Overhead:          time.Duration(m.overhead.Load()),
+		SymbolCacheHits:   m.cacheHits.Load(),
+		SymbolCacheMisses: m.cacheMisses.Load(),
+	}
+}
+
+// MetricsVar returns an expvar.Var exposing the metrics of p as JSON, e.g.:
+//
+//	expvar.Publish("wzprof", p.MetricsVar())
+func (p *Profiling) MetricsVar() expvar.Var {
+	return expvar.Func(func() any { return p.Metrics() })
+}
@@ -0,0 +1,64 @@
+package wzprof
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+	"github.com/tetratelabs/wazero/experimental/wazerotest"
+)
+
+func TestProfilingMetrics(t *testing.T) {
+	p := ProfilingFor(nil)
+	cpu := p.CPUProfiler(HostTime(true))
+	tracer := p.Tracer(MaxTraceEvents(1))
+
+	f0 := wazerotest.NewFunction(func(context.Context, api.Module) {})
+	f0.FunctionName = "f0"
+	f1 := wazerotest.NewFunction(func(context.Context, api.Module) {})
+	f1.FunctionName = "f1"
+	module := wazerotest.NewModule(nil, f0, f1)
+	factory := experimental.MultiFunctionListenerFactory(cpu, tracer)
+
+	cpu.StartProfile()
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		fn := module.Function(i)
+		def := fn.Definition()
+		lstn := factory.NewFunctionListener(def)
+		lstn.Before(ctx, module, def, nil, experimental.NewStackIterator(experimental.StackFrame{Function: fn, PC: uint64(i + 1)}))
+		lstn.After(ctx, module, def, nil)
+	}
+
+	m := p.Metrics()
+	// Two calls timed by the CPU profiler, one recorded by the tracer and one
+	// dropped.
+	if m.Samples != 3 || m.DroppedSamples != 1 {
+		t.Errorf("wrong samples: recorded=%d dropped=%d", m.Samples, m.DroppedSamples)
+	}
+	if m.Stacks != 2 {
+		t.Errorf("wrong number of stacks: %d", m.Stacks)
+	}
+	if m.Overhead <= 0 {
+		t.Errorf("no overhead recorded: %s", m.Overhead)
+	}
+
+	cpu.StopProfile(1)
+	m = p.Metrics()
+	if m.Stacks != 0 {
+		t.Errorf("stacks still tracked after the profile was stopped: %d", m.Stacks)
+	}
+	if m.SymbolCacheMisses != 2 || m.SymbolCacheHitRate() != 0 {
+		t.Errorf("wrong symbol cache lookups: hits=%d misses=%d", m.SymbolCacheHits, m.SymbolCacheMisses)
+	}
+
+	var v Metrics
+	if err := json.Unmarshal([]byte(p.MetricsVar().String()), &v); err != nil {
+		t.Fatal(err)
+	}
+	if v != m {
+		t.Errorf("wrong expvar metrics: want %+v, got %+v", m, v)
+	}
+}
@@ -0,0 +1,96 @@
+package wzprof
+
+import (
+	"net/http"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/google/pprof/profile"
+)
+
+// Labels attached by Middleware to the samples recorded while handling HTTP
+// requests.
+const (
+	httpMethodLabel = "http.method"
+	httpRouteLabel  = "http.route"
+)
+
+// MiddlewareOption is a type used to represent configuration options for the
+// handlers created by Middleware.
+type MiddlewareOption func(*middleware)
+
+// RouteLabel configures the function returning the route of the requests,
+// which is attached to the samples in the "http.route" label.
+//
+// Default to the path of the request URL, hosts serving paths with ids
+// should configure a function returning a pattern instead (e.g. "/users/:id")
+// to keep the number of distinct labels low.
+func RouteLabel(route func(*http.Request) string) MiddlewareOption {
+	return func(m *middleware) { m.route = route }
+}
+
+// SlowRequests configures the middleware to report the profiles captured by
+// the watchdog for the requests lasting longer than its threshold. The
+// watchdog must be installed on the runtime running the guest, fn is called
+// after the handler returns with the CPU profile of the guest invocation of
+// the request (the last one if the request made several).
+//
+// The requests are identified by their X-Request-Id header, or numbered in
+// the order they are received when they do not have one.
+func SlowRequests(w *Watchdog, fn func(*http.Request, *profile.Profile)) MiddlewareOption {
+	return func(m *middleware) {
+		m.watchdog = w
+		m.slow = fn
+	}
+}
+
+type middleware struct {
+	handler  http.Handler
+	route    func(*http.Request) string
+	watchdog *Watchdog
+	slow     func(*http.Request, *profile.Profile)
+	seq      atomic.Uint64
+}
+
+// Middleware returns a handler for hosts which dispatch HTTP requests to wasm
+// modules. The samples recorded by the profilers while h handles a request are
+// labeled with the method ("http.method") and route ("http.route") of the
+// request, which breaks down the profiles by endpoint.
+//
+// h must call the guest with the context of the request, or a context derived
+// from it, for the labels to apply (see WithSampleLabels).
+func Middleware(h http.Handler, options ...MiddlewareOption) http.Handler {
+	m := &middleware{
+		handler: h,
+		route:   func(r *http.Request) string { return r.URL.Path },
+	}
+	for _, opt := range options {
+		opt(m)
+	}
+	return m
+}
+
+func (m *middleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := WithSampleLabels(r.Context(), map[string]string{
+		httpMethodLabel: r.Method,
+		httpRouteLabel:  m.route(r),
+	})
+
+	var id string
+	if m.watchdog != nil {
+		id = r.Header.Get("X-Request-Id")
+		if id == "" {
+			id = "request-" + strconv.FormatUint(m.seq.Add(1), 10)
+		}
+		ctx = WithInvocationID(ctx, id)
+	}
+
+	r = r.WithContext(ctx)
+	m.handler.ServeHTTP(w, r)
+
+	if m.watchdog != nil {
+		if prof := m.watchdog.Profile(id); prof != nil {
+			m.slow(r, prof)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package wzprof
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/google/pprof/profile"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+	"github.com/tetratelabs/wazero/experimental/wazerotest"
+)
+
+func TestMiddleware(t *testing.T) {
+	p := ProfilingFor(nil)
+	cpu := p.CPUProfiler(HostTime(true))
+	watchdog := p.Watchdog(100)
+	currentTime := int64(0)
+	watchdog.cpu.time = func() int64 { return currentTime }
+
+	module := wazerotest.NewModule(nil, wazerotest.NewFunction(func(context.Context, api.Module) {}))
+	def := module.Function(0).Definition()
+	lstn := experimental.MultiFunctionListenerFactory(cpu, watchdog).NewFunctionListener(def)
+
+	guest := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		lstn.Before(ctx, module, def, nil, experimental.NewStackIterator(experimental.StackFrame{Function: module.Function(0)}))
+		if r.URL.Path == "/slow" {
+			currentTime += 200
+		}
+		lstn.After(ctx, module, def, nil)
+	})
+
+	var slow []string
+	handler := Middleware(guest, SlowRequests(watchdog, func(r *http.Request, prof *profile.Profile) {
+		slow = append(slow, r.URL.Path)
+	}))
+
+	cpu.StartProfile()
+	for _, path := range []string{"/fast", "/fast", "/slow"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+	prof := cpu.StopProfile(1)
+
+	if !reflect.DeepEqual(slow, []string{"/slow"}) {
+		t.Errorf("wrong slow requests: %v", slow)
+	}
+
+	counts := map[string]int64{}
+	for _, s := range prof.Sample {
+		if method := s.Label[httpMethodLabel]; !reflect.DeepEqual(method, []string{"GET"}) {
+			t.Errorf("wrong method label: %v", method)
+		}
+		for _, route := range s.Label[httpRouteLabel] {
+			counts[route] += s.Value[0]
+		}
+	}
+	if want := map[string]int64{"/fast": 2, "/slow": 1}; !reflect.DeepEqual(counts, want) {
+		t.Errorf("wrong samples per route: want %v, got %v", want, counts)
+	}
+}
@@ -4,6 +4,9 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
 	"unsafe"
 
 	"github.com/tetratelabs/wazero"
@@ -22,6 +25,7 @@ func binCompiledByGo(b []byte) bool {
 // See pclntabHeaderFromData for more details.
 type partialPCHeader struct {
 	address        uint64
+	ptrSize        uint64
 	funcnametabOff uint64
 	cutabOff       uint64
 	filetabOff     uint64
@@ -41,6 +45,10 @@ func (p partialPCHeader) Valid() bool {
 // The goal is to retrieve enough of the pclntab header to compute a needle for
 // the moduledata using the offsets contained in this header.
 //
+// The GOARCH=wasm port uses 8 bytes pointers, but other toolchains targeting
+// wasm32 (e.g. TinyGo) use 4 bytes pointers. The size of pointers is recorded
+// in the header, and is used to decode the words that follow it.
+//
 // See layout in the linker:
 // https://github.com/golang/go/blob/3e35df5edbb02ecf8efd6dd6993aabd5053bfc66/src/cmd/link/internal/ld/pcln.go#L235-L248
 func pclntabHeaderFromData(b []byte) partialPCHeader {
@@ -53,46 +61,58 @@ func pclntabHeaderFromData(b []byte) partialPCHeader {
 		0x01, // MinLC
 		0x08, // PtrSize
 	}
-	pclntabOffset := bytes.Index(b, needle)
+	pclntabOffset := -1
+	for _, ptrSize := range []byte{8, 4} {
+		needle[7] = ptrSize
+		if pclntabOffset = bytes.Index(b, needle); pclntabOffset >= 0 {
+			break
+		}
+	}
 	if pclntabOffset == -1 {
 		return partialPCHeader{}
 	}
+	ptrSize := int(needle[7])
 
 	d := newDataIterator(b)
 	vaddr, seg := d.SkipToDataOffset(pclntabOffset)
-	vm := vmemb{Start: vaddr}
-	vm.CopyAtAddress(vaddr, seg)
-
-	magic := needle[:6]
-	if !bytes.Equal(magic, seg[:len(magic)]) {
-		panic("segment should start by magic")
-	}
-
-	if len(seg) < 8 {
-		panic("segment should at least contain header")
+	if seg == nil {
+		log.Printf("wasm: pclntab header not in a data segment: %s", d.Err())
+		return partialPCHeader{}
 	}
+	// The memory starts as a view of the segment, which holds the tables of
+	// the pclntab and can take tens of megabytes. Its capacity is capped so
+	// the segments following it are appended to a copy.
+	vm := vmemb{Start: vaddr, b: seg[:len(seg):len(seg)]}
 
-	readWord := func(word int) uint64 {
+	readWord := func(word int) (uint64, bool) {
 		for {
-			start := 8 + word*8
-			end := start + 8
+			start := 8 + word*ptrSize
+			end := start + ptrSize
 			if vm.Has(end) {
-				return binary.LittleEndian.Uint64(vm.b[start:])
+				if ptrSize == 4 {
+					return uint64(binary.LittleEndian.Uint32(vm.b[start:])), true
+				}
+				return binary.LittleEndian.Uint64(vm.b[start:]), true
 			}
 			vaddr, seg := d.Next()
-			if seg == nil {
-				panic("no more segment")
+			if seg == nil || vaddr < vm.Start+int64(len(vm.b)) {
+				return 0, false
 			}
 			vm.CopyAtAddress(vaddr, seg)
 		}
 	}
 
-	funcnametabOff := readWord(3)
-	cutabOff := readWord(4)
-	filetabOff := readWord(5)
+	funcnametabOff, ok1 := readWord(3)
+	cutabOff, ok2 := readWord(4)
+	filetabOff, ok3 := readWord(5)
+	if !ok1 || !ok2 || !ok3 {
+		log.Printf("wasm: pclntab header truncated at address %#x", vaddr)
+		return partialPCHeader{}
+	}
 
 	return partialPCHeader{
 		address:        uint64(vaddr),
+		ptrSize:        uint64(ptrSize),
 		funcnametabOff: funcnametabOff,
 		cutabOff:       cutabOff,
 		filetabOff:     filetabOff,
@@ -110,43 +130,56 @@ func pclntabHeaderFromData(b []byte) partialPCHeader {
 // close enough together that they can't contain more than 8 zeroes between
 // them, not triggering the compression mechanism used by the wasm linker.
 func moduledataAddrFromData(pch partialPCHeader, b []byte) uint64 {
-	scratch := [4 * 8]byte{}
-	binary.LittleEndian.PutUint64(scratch[0*8:], pch.address)
-	binary.LittleEndian.PutUint64(scratch[1*8:], pch.address+pch.funcnametabOff)
-	binary.LittleEndian.PutUint64(scratch[2*8:], pch.address+pch.cutabOff)
-	binary.LittleEndian.PutUint64(scratch[3*8:], pch.address+pch.filetabOff)
-	start := scratch[0 : 2*8]
-	cutabaddr := scratch[2*8 : 3*8]
-	filetabaddr := scratch[3*8 : 4*8]
-	offset := findStartOfModuleData(b, start, cutabaddr, filetabaddr)
+	n := int(pch.ptrSize)
+	scratch := make([]byte, 4*n)
+	for i, addr := range []uint64{
+		pch.address,
+		pch.address + pch.funcnametabOff,
+		pch.address + pch.cutabOff,
+		pch.address + pch.filetabOff,
+	} {
+		if n == 4 {
+			binary.LittleEndian.PutUint32(scratch[i*n:], uint32(addr))
+		} else {
+			binary.LittleEndian.PutUint64(scratch[i*n:], addr)
+		}
+	}
+	start := scratch[0 : 2*n]
+	cutabaddr := scratch[2*n : 3*n]
+	filetabaddr := scratch[3*n : 4*n]
+	offset := findStartOfModuleData(b, n, start, cutabaddr, filetabaddr)
 	if offset == -1 {
 		return 0
 	}
 	d := newDataIterator(b)
-	vaddr, _ := d.SkipToDataOffset(offset)
+	vaddr, seg := d.SkipToDataOffset(offset)
+	if seg == nil {
+		log.Printf("wasm: moduledata not in a data segment: %s", d.Err())
+		return 0
+	}
 	return uint64(vaddr)
 }
 
 // returns -1 if not found.
-func findStartOfModuleData(b, start, cutabaddr, filetabaddr []byte) int {
-	// offset 0: pch.addr
-	// offset 8: funcnametab address
-	// offset 32: cutab address
-	// offset 56: filetab address
+func findStartOfModuleData(b []byte, ptrSize int, start, cutabaddr, filetabaddr []byte) int {
+	// offset 0:          pch.addr
+	// offset 1*ptrSize:  funcnametab address
+	// offset 4*ptrSize:  cutab address
+	// offset 7*ptrSize:  filetab address
 	for begin := 0; begin < len(b); {
 		startIndex := bytes.Index(b[begin:], start)
 		if startIndex < 0 {
 			return -1
 		}
-		i := startIndex + 32
-		if !bytes.Equal(b[i:i+8], cutabaddr) {
-			begin = startIndex + 1
+		i := begin + startIndex + 4*ptrSize
+		if i+ptrSize > len(b) || !bytes.Equal(b[i:i+ptrSize], cutabaddr) {
+			begin += startIndex + 1
 			continue
 		}
 
-		i = startIndex + 56
-		if !bytes.Equal(b[i:i+8], filetabaddr) {
-			begin = startIndex + 1
+		i = begin + startIndex + 7*ptrSize
+		if i+ptrSize > len(b) || !bytes.Equal(b[i:i+ptrSize], filetabaddr) {
+			begin += startIndex + 1
 			continue
 		}
 
@@ -174,11 +207,66 @@ func preparePclntabSymbolizer(wasmbin []byte, mod wazero.CompiledModule) (*pclnt
 	if mdaddr == 0 {
 		return nil, fmt.Errorf("could not find moduledata in data section")
 	}
-	return &pclntab{
+	p := &pclntab{
 		imported: uint64(len(mod.ImportedFunctions())),
 		modName:  mod.Name(),
+		ptrSize:  ptr64(pch.ptrSize),
 		datap:    ptr64(mdaddr),
-	}, nil
+	}
+	return p, nil
+}
+
+// buildInlineTrees copies the inline trees of the functions of p to the host
+// memory, so resolving the inlined calls of a location does not read the guest
+// memory. The trees are read-only data of the module, they are read once when
+// the memory of the guest is first available.
+func buildInlineTrees(p *pclntab) map[pclntabOff][]inlinedCall {
+	md := p.md.Load()
+	trees := make(map[pclntabOff][]inlinedCall)
+	// The last entry of ftab marks the end of the last function.
+	for i := 0; i+1 < len(md.ftab); i++ {
+		funcoff := md.ftab[i].funcoff
+		f := funcInfo{
+			_func:    (*_func)(unsafe.Pointer(unsafe.SliceData(md.pclntable[funcoff:]))),
+			md:       md,
+			_funcoff: pclntabOff(funcoff),
+		}
+		addr := funcdata(p, f, goruntime.FUNCDATA_InlTree)
+		if addr == 0 {
+			continue
+		}
+		if n := inlineTreeSize(f); n > 0 {
+			trees[f._funcoff] = derefArray[inlinedCall](p.mem, addr, n)
+		}
+	}
+	return trees
+}
+
+// inlineTreeSize returns the number of entries of the inline tree of f, which
+// is not recorded in the pclntab: it is one more than the highest index of the
+// tree for the program counters of the function.
+func inlineTreeSize(f funcInfo) uint32 {
+	if f.Npcdata <= goruntime.PCDATA_InlTreeIndex {
+		return 0
+	}
+	off := pcdatastart(f, goruntime.PCDATA_InlTreeIndex)
+	if off == 0 {
+		return 0
+	}
+	p := f.md.pctab[off:]
+	pc := f.entry()
+	val, max := int32(-1), int32(-1)
+	for {
+		var ok bool
+		p, ok = step(p, &pc, &val, pc == f.entry())
+		if !ok {
+			break
+		}
+		if val > max {
+			max = val
+		}
+	}
+	return uint32(max + 1)
 }
 
 // Copy of _func in runtime/runtime2.go. It has to have the same size.
@@ -291,7 +379,7 @@ func funcfile(f funcInfo, fileno int32) string {
 	}
 	// Make sure the cu index and file offset are valid
 	if fileoff := datap.cutab[f.CuOffset+uint32(fileno)]; fileoff != ^uint32(0) {
-		return cstring(datap.filetab[fileoff:])
+		return datap.files.lookup(datap.filetab, fileoff)
 	}
 	// pcln section is corrupt.
 	return "?"
@@ -340,35 +428,135 @@ type pclntab struct {
 	imported uint64
 	// Name of the module.
 	modName string
+	// Size of pointers in the guest, as recorded in the pclntab header.
+	ptrSize ptr64
 	// Virtual address of the firstmoduledata structure. Named like this for
 	// similarity with the Go implementation.
 	datap ptr64
 
 	mem vmem
-	md  moduledata
+	// The moduledata is replaced when the tables borrowed from the memory
+	// are borrowed again, while profiles may be built concurrently.
+	md atomic.Pointer[moduledata]
+
+	// Read the tables of the moduledata as views of the guest memory instead
+	// of copies, see Profiling.SetBorrowedMemory. base is the address of the
+	// buffer of the memory when they were borrowed.
+	borrow bool
+	base   atomic.Uintptr
+
+	// The tables are loaded by the listeners of the first call, which may
+	// happen on several threads of the guest at once. ready is set once mem
+	// and inlineTrees are assigned.
+	mutex sync.Mutex
+	ready atomic.Bool
+
+	// Inline trees of the functions, indexed by their offset in pclntable.
+	inlineTrees map[pclntabOff][]inlinedCall
 }
 
 // EnsureReady loads up from memory the necessary contents of moduledata, and
 // pclntab to be able to perform symbolization and provide enough information
 // about functions to walk the stack. Just once.
 func (p *pclntab) EnsureReady(mem vmem) {
-	if p.mem != nil {
-		if p.mem != mem {
-			panic("different memory used for pclntab")
+	if !p.ready.Load() {
+		p.mutex.Lock()
+		if !p.ready.Load() {
+			p.mem = mem
+			p.load()
+			p.inlineTrees = buildInlineTrees(p)
+			p.ready.Store(true)
 		}
-		return
+		p.mutex.Unlock()
+	}
+	if p.mem != mem {
+		panic("different memory used for pclntab")
+	}
+	// When the memory grows past its capacity, wazero moves it to a new
+	// buffer, the tables are borrowed again from it so the old one can be
+	// released. The functions of the previous moduledata remain valid: the
+	// tables are read-only and the old buffer is retained while they are
+	// referenced.
+	if p.borrow && uintptr(memoryBase(mem)) != p.base.Load() {
+		p.mutex.Lock()
+		if uintptr(memoryBase(mem)) != p.base.Load() {
+			p.load()
+		}
+		p.mutex.Unlock()
+	}
+}
+
+// load reads the moduledata and builds the function table from the memory.
+func (p *pclntab) load() {
+	md := derefModuledata(p.mem, p.ptrSize, p.datap, p.borrow)
+	md.funcs = buildFuncTable(p, md)
+	if p.borrow {
+		p.base.Store(uintptr(memoryBase(p.mem)))
+	}
+	p.md.Store(md)
+}
+
+// buildFuncTable returns the functions of p indexed by their index in the code
+// section, so FindFunc resolves program counters with a lookup in the table
+// instead of searching the pclntab. The Go linker places each function in its
+// own wasm function, with an entry pc made of the index of the function in the
+// high bits, and the blocks of the function in the low 16 bits.
+func buildFuncTable(p *pclntab, md *moduledata) []*goFunction {
+	var funcs []*goFunction
+	// The last entry of ftab marks the end of the last function.
+	for i := 0; i+1 < len(md.ftab); i++ {
+		entry := md.textAddr(md.ftab[i].entryoff)
+		index := uint64(entry>>16) - funcValueOffset
+		if entry&0xffff != 0 || index < uint64(len(funcs)) || index > uint64(len(md.ftab)) {
+			return nil
+		}
+		for uint64(len(funcs)) < index {
+			funcs = append(funcs, nil)
+		}
+		funcoff := md.ftab[i].funcoff
+		funcs = append(funcs, &goFunction{
+			mem: p.mem,
+			sym: p,
+			info: funcInfo{
+				_func:    (*_func)(unsafe.Pointer(unsafe.SliceData(md.pclntable[funcoff:]))),
+				md:       md,
+				_funcoff: pclntabOff(funcoff),
+			},
+			pc: entry,
+		})
 	}
-	p.mem = mem
-	p.md = derefModuledata(mem, p.datap)
+	return funcs
+}
+
+// function returns the function containing pc from the table of functions,
+// or nil if it is not in the table.
+func (p *pclntab) function(pc ptr64) *goFunction {
+	md := p.md.Load()
+	if pc < md.minpc || pc >= md.maxpc {
+		return nil
+	}
+	if index := uint64(pc>>16) - funcValueOffset; index < uint64(len(md.funcs)) {
+		return md.funcs[index]
+	}
+	return nil
 }
 
 // FindFunc searches the pclntab to build the FuncInfo that contains the
 // provided pc.
 //
 // TODO: support multiple go modules.
-// TODO: cache this, as it's on the hot path.
 func (p *pclntab) FindFunc(pc ptr64) funcInfo {
-	if pc < p.md.minpc || pc >= p.md.maxpc {
+	if f := p.function(pc); f != nil {
+		return f.info
+	}
+	return p.searchFunc(pc)
+}
+
+// searchFunc searches the pclntab for the function containing pc, like the Go
+// runtime does.
+func (p *pclntab) searchFunc(pc ptr64) funcInfo {
+	md := p.md.Load()
+	if pc < md.minpc || pc >= md.maxpc {
 		return funcInfo{}
 	}
 
@@ -377,28 +565,35 @@ func (p *pclntab) FindFunc(pc ptr64) funcInfo {
 	const minfunc = 16                 // minimum function size
 	const pcbucketsize = 256 * minfunc // size of bucket in the pc->func lookup table
 
-	pcOff, ok := p.md.textOff(pc)
+	pcOff, ok := md.textOff(pc)
 	if !ok {
 		return funcInfo{}
 	}
 
-	x := ptr64(pcOff) + p.md.text - p.md.minpc
+	x := ptr64(pcOff) + md.text - md.minpc
 	b := x / pcbucketsize
 	i := x % pcbucketsize / (pcbucketsize / nsub)
 
-	ffb := deref[findfuncbucket](p.mem, p.md.findfunctab+b*ptr64(unsafe.Sizeof(findfuncbucket{})))
+	ffb := deref[findfuncbucket](p.mem, md.findfunctab+b*ptr64(unsafe.Sizeof(findfuncbucket{})))
 
 	idx := ffb.idx + uint32(ffb.subbuckets[i])
 
-	// Find the ftab entry.
-	for p.md.ftab[idx+1].entryoff <= pcOff {
+	// Find the ftab entry. The last entry marks the end of the text, the
+	// program counters past it are not in a function of the table.
+	for {
+		if int(idx)+1 >= len(md.ftab) {
+			return funcInfo{}
+		}
+		if md.ftab[idx+1].entryoff > pcOff {
+			break
+		}
 		idx++
 	}
 
-	funcoff := p.md.ftab[idx].funcoff
-	_f := (*_func)(unsafe.Pointer(unsafe.SliceData(p.md.pclntable[funcoff:])))
+	funcoff := md.ftab[idx].funcoff
+	_f := (*_func)(unsafe.Pointer(unsafe.SliceData(md.pclntable[funcoff:])))
 
-	return funcInfo{_func: _f, md: &p.md, _funcoff: pclntabOff(funcoff)}
+	return funcInfo{_func: _f, md: md, _funcoff: pclntabOff(funcoff)}
 }
 
 // Locations perform the symolization of a physical pc belongging to a provided
@@ -406,13 +601,13 @@ func (p *pclntab) FindFunc(pc ptr64) funcInfo {
 func (p *pclntab) Locations(gofunc experimental.InternalFunction, pc experimental.ProgramCounter) (uint64, []location) {
 	// Assumption that pclntabmapper is only used in conjuction with
 	// goStackIterator.
-	f := gofunc.(goFunction)
+	f := gofunc.(*goFunction)
 
 	locs := []location{}
 
 	var calleeFuncID goruntime.FuncID
 
-	iu, uf := newInlineUnwinder(p, f.mem, f.info, symPC(f.info, ptr64(pc)))
+	iu, uf := newInlineUnwinder(p, f.info, symPC(f.info, ptr64(pc)))
 	for ; uf.valid(); uf = iu.next(uf) {
 		sf := iu.srcFunc(uf)
 		if sf.funcID == goruntime.FuncIDWrapper && elideWrapperCalling(calleeFuncID) {
@@ -426,11 +621,19 @@ func (p *pclntab) Locations(gofunc experimental.InternalFunction, pc experimenta
 		if !fn.valid() {
 			continue
 		}
+		// Inlined frames are named after the source function that was
+		// inlined rather than the one they were compiled into, the way
+		// the Go runtime reports them in tracebacks.
+		name := sf.datap.funcName(sf.nameOff)
+		if name == "" {
+			name = fn.name()
+		}
 		locs = append(locs, location{
 			File:       file,
 			Line:       int64(line),
-			StableName: fn.name(),
-			HumanName:  fn.name(),
+			StableName: name,
+			HumanName:  name,
+			StartLine:  int64(sf.startLine),
 		})
 	}
 
@@ -493,64 +696,83 @@ func (p *pclntab) PCToLine(pc ptr64) (file string, line int, f funcInfo) {
 // rtmem. Also, easier to replace guintptr with a dedicated type.
 type gptr ptr64
 
-// Layout of g struct:
+// Layout of g struct, in words of ptrSize bytes:
 //
-// size, index, field
-// 8,    0,     stack.lo
-// 8,    1,     stack.hi
-// 8,    2,     stackguard0
-// 8,    3,     stackguard1
-// 8,    4,     _panic
-// 8,    5,     _defer
-// 8,    6,     m
-// 8,    7,     sched.sp
-// 8,    8,     sched.pc
-// 8,    9,     sched.g
-// 8,    10,    sched.ctxt
-// 8,    11,    sched.ret
-// 8,    12,    sched.lr
+// index, field
+// 0,     stack.lo
+// 1,     stack.hi
+// 2,     stackguard0
+// 3,     stackguard1
+// 4,     _panic
+// 5,     _defer
+// 6,     m
+// 7,     sched.sp
+// 8,     sched.pc
+// 9,     sched.g
+// 10,    sched.ctxt
+// 11,    sched.ret
+// 12,    sched.lr
+// 13,    sched.bp
+// 14,    syscallsp
+// 15,    syscallpc
+// 16,    stktopsp
+// 17,    param
+// 18,    atomicstatus (4 bytes), stackLock (4 bytes)
+// 18+8B, goid (8 bytes)
 // more fields that we don't care about
 
-// Layout of M struct:
+// Layout of M struct, with p the size of pointers:
 //
-// size, offset, field
-// 8,    0,      g0
-// 56,   8,      morebuf
-// 8,    64,     divmod, -
-// 8,    72,     procid
-// 8,    80,     gsignal
-// 0,    88,     goSigStack
-// 0,    88,     sigmask
-// 48,   88,     tls
-// 8,    136,    mstartfn
-// 8,    144,    curg
+// size, offset,  field
+// p,    0,       g0
+// 7p,   p,       morebuf
+// 8,    8p,      divmod, -
+// 8,    8p+8,    procid
+// p,    8p+16,   gsignal
+// 0,    9p+16,   goSigStack
+// 0,    9p+16,   sigmask
+// 6p,   9p+16,   tls
+// p,    15p+16,  mstartfn
+// p,    16p+16,  curg
 // more fields we don't care about
 //
 // goSigStack and sigmask are 0 because
 // https://github.com/golang/go/blob/b950cc8f11dc31cc9f6cfbed883818a7aa3abe94/src/runtime/os_wasm.go#L132
 
-func gM(m vmem, g gptr) ptr64 {
-	return deref[ptr64](m, ptr64(g)+8*6)
+// derefPtr reads a pointer of the guest at address p.
+func (p *pclntab) derefPtr(m vmem, addr ptr64) ptr64 {
+	if p.ptrSize == 4 {
+		return ptr64(deref[uint32](m, addr))
+	}
+	return deref[ptr64](m, addr)
+}
+
+func (p *pclntab) gM(m vmem, g gptr) ptr64 {
+	return p.derefPtr(m, ptr64(g)+p.ptrSize*6)
 }
 
-func gMG0(m vmem, g gptr) gptr {
-	return deref[gptr](m, gM(m, g)+0)
+func (p *pclntab) gMG0(m vmem, g gptr) gptr {
+	return gptr(p.derefPtr(m, p.gM(m, g)+0))
 }
 
-func gMCurg(m vmem, g gptr) gptr {
-	return deref[gptr](m, gM(m, g)+144)
+func (p *pclntab) gMCurg(m vmem, g gptr) gptr {
+	return gptr(p.derefPtr(m, p.gM(m, g)+p.ptrSize*16+16))
 }
 
-func gSchedSp(m vmem, g gptr) ptr64 {
-	return deref[ptr64](m, ptr64(g)+8*7)
+func (p *pclntab) gSchedSp(m vmem, g gptr) ptr64 {
+	return p.derefPtr(m, ptr64(g)+p.ptrSize*7)
 }
 
-func gSchedPc(m vmem, g gptr) ptr64 {
-	return deref[ptr64](m, ptr64(g)+8*8)
+func (p *pclntab) gSchedPc(m vmem, g gptr) ptr64 {
+	return p.derefPtr(m, ptr64(g)+p.ptrSize*8)
 }
 
-func gSchedLr(m vmem, g gptr) ptr64 {
-	return deref[ptr64](m, ptr64(g)+8*12)
+func (p *pclntab) gSchedLr(m vmem, g gptr) ptr64 {
+	return p.derefPtr(m, ptr64(g)+p.ptrSize*12)
+}
+
+func (p *pclntab) gGoid(m vmem, g gptr) int64 {
+	return int64(deref[uint64](m, ptr64(g)+p.ptrSize*18+8))
 }
 
 // goStackIterator iterates over the physical frames of the Go stack. It is up
@@ -560,7 +782,56 @@ type goStackIterator struct {
 	first   bool
 	pclntab *pclntab
 	pc      ptr64
+	gp      gptr // g running when the iterator was initialized
 	unwinder
+
+	// Frames unwound by previous iterations, indexed by their sp and pc, and
+	// the index of the current frame in entries (-1 if it has none).
+	memo    map[unwindKey]int32
+	entries []unwindEntry
+	entry   int32
+}
+
+// unwindKey identifies a physical frame of a Go stack.
+type unwindKey struct {
+	sp, pc ptr64
+}
+
+// unwindEntry is a frame resolved by the unwinder. The frame pointer of a
+// function only depends on its sp and pc, so only the return address has to
+// be read again from the memory when unwinding the same frame, which is at
+// lrSlot unless the frame is the bottom of the stack (lrSlot is zero).
+//
+// Entries are linked to the entry of their caller, which is the suffix of the
+// stack that was unwound last time. Recursive guests produce stacks with many
+// such frames, which are then unwound without looking up the functions or
+// decoding their pcsp tables.
+type unwindEntry struct {
+	key    unwindKey
+	frame  stkframe
+	lrSlot ptr64
+	next   int32 // index of the caller entry, -1 if unknown
+}
+
+// maxUnwindEntries bounds the memory retained by the memo of the iterator.
+// The memo is reset when it is full, references to entries are checked
+// against their key, so a stale index can only cause a miss.
+const maxUnwindEntries = 1 << 14
+
+// goroutineID returns the id of the goroutine the stack belongs to. When the
+// guest runs on the system stack of the M, the stack is attributed to the
+// goroutine scheduled on it, like the Go runtime does for profiler labels.
+func (s *goStackIterator) goroutineID() int64 {
+	gp := s.gp
+	if gp == 0 {
+		return 0
+	}
+	if gp == s.symbols.gMG0(s.mem, gp) {
+		if curg := s.symbols.gMCurg(s.mem, gp); curg != 0 {
+			gp = curg
+		}
+	}
+	return s.symbols.gGoid(s.mem, gp)
 }
 
 func (s *goStackIterator) Next() bool {
@@ -574,7 +845,7 @@ func (s *goStackIterator) Next() bool {
 		return true
 	}
 
-	s.next()
+	s.unwind()
 	if !s.valid() {
 		return false
 	}
@@ -582,12 +853,85 @@ func (s *goStackIterator) Next() bool {
 	return true
 }
 
+// unwind moves to the caller of the current frame, like unwinder.next but
+// reusing the frames memoized by previous iterations.
+func (s *goStackIterator) unwind() {
+	frame := &s.frame
+	if frame.lr == 0 || (frame.pc == frame.lr && frame.sp == frame.fp) || s.flags&unwindJumpStack != 0 {
+		s.next()
+		s.entry = -1
+		return
+	}
+
+	key := unwindKey{sp: frame.fp, pc: frame.lr}
+	prev := s.entry
+	index := int32(-1)
+	if prev >= 0 && int(prev) < len(s.entries) {
+		if next := s.entries[prev].next; next >= 0 && int(next) < len(s.entries) && s.entries[next].key == key {
+			index = next
+		}
+	}
+	if index < 0 {
+		if i, ok := s.memo[key]; ok {
+			index = i
+		}
+	}
+
+	if index >= 0 {
+		e := &s.entries[index]
+		s.leave(frame.fn)
+		s.frame = e.frame
+		if e.lrSlot != 0 {
+			s.frame.lr = s.symbols.derefPtr(s.mem, e.lrSlot)
+		}
+	} else {
+		s.next()
+		if !s.valid() {
+			s.entry = -1
+			return
+		}
+		index = s.memoize(key)
+	}
+
+	if prev >= 0 && int(prev) < len(s.entries) {
+		s.entries[prev].next = index
+	}
+	s.entry = index
+}
+
+// memoize records the current frame, which was just resolved by the unwinder
+// at key, and returns the index of its entry.
+func (s *goStackIterator) memoize(key unwindKey) int32 {
+	if len(s.entries) == maxUnwindEntries {
+		for k := range s.memo {
+			delete(s.memo, k)
+		}
+		s.entries = s.entries[:0]
+	}
+	if s.memo == nil {
+		s.memo = make(map[unwindKey]int32)
+	}
+	e := unwindEntry{key: key, frame: s.frame, next: -1}
+	if s.frame.fn.Flag&(goruntime.FuncFlagTopFrame|goruntime.FuncFlagSPWrite) == 0 {
+		e.lrSlot = s.frame.fp - s.symbols.ptrSize
+	}
+	index := int32(len(s.entries))
+	s.entries = append(s.entries, e)
+	s.memo[key] = index
+	return index
+}
+
 func (s *goStackIterator) ProgramCounter() experimental.ProgramCounter {
 	return experimental.ProgramCounter(s.pc)
 }
 
 func (s *goStackIterator) Function() experimental.InternalFunction {
-	return goFunction{
+	// The functions of the table are shared by all the frames, instead of
+	// allocating one per frame.
+	if f := s.symbols.function(s.frame.pc); f != nil && f.info._funcoff == s.frame.fn._funcoff {
+		return f
+	}
+	return &goFunction{
 		mem:  s.mem,
 		sym:  s.symbols,
 		info: s.frame.fn,
@@ -621,56 +965,56 @@ type goFunction struct {
 	api.FunctionDefinition // required for WazeroOnly
 }
 
-func (f goFunction) Definition() api.FunctionDefinition {
+func (f *goFunction) Definition() api.FunctionDefinition {
 	return f
 }
 
-func (f goFunction) SourceOffsetForPC(experimental.ProgramCounter) uint64 {
+func (f *goFunction) SourceOffsetForPC(experimental.ProgramCounter) uint64 {
 	panic("does not make sense")
 }
 
-func (f goFunction) ModuleName() string {
+func (f *goFunction) ModuleName() string {
 	return f.sym.modName
 }
 
-func (f goFunction) Index() uint32 {
+func (f *goFunction) Index() uint32 {
 	return uint32(f.sym.PCToFID(f.pc))
 }
 
-func (f goFunction) Import() (string, string, bool) {
+func (f *goFunction) Import() (string, string, bool) {
 	panic("implement me")
 }
 
-func (f goFunction) ExportNames() []string {
+func (f *goFunction) ExportNames() []string {
 	panic("implement me")
 }
 
-func (f goFunction) Name() string {
+func (f *goFunction) Name() string {
 	return f.sym.PCToName(f.pc)
 }
 
-func (f goFunction) DebugName() string {
+func (f *goFunction) DebugName() string {
 	panic("implement me")
 }
 
-func (f goFunction) GoFunction() interface{} {
+func (f *goFunction) GoFunction() interface{} {
 	// This is never a host function
 	return nil
 }
 
-func (f goFunction) ParamTypes() []api.ValueType {
+func (f *goFunction) ParamTypes() []api.ValueType {
 	panic("implement me")
 }
 
-func (f goFunction) ParamNames() []string {
+func (f *goFunction) ParamNames() []string {
 	panic("implement me")
 }
 
-func (f goFunction) ResultTypes() []api.ValueType {
+func (f *goFunction) ResultTypes() []api.ValueType {
 	panic("implement me")
 }
 
-func (f goFunction) ResultNames() []string {
+func (f *goFunction) ResultNames() []string {
 	panic("implement me")
 }
 
@@ -699,9 +1043,9 @@ type findfuncbucket struct {
 	subbuckets [16]byte
 }
 
-// moduledata comes from runtime/symtab.go. It is important it keeps the same
-// layout to be rebuilt from memory. If you uncomment a field here, make sure to
-// update derefModuleData accordingly.
+// moduledata comes from runtime/symtab.go. It is rebuilt from memory field by
+// field, as its layout depends on the size of pointers in the guest. If you
+// uncomment a field here, make sure to update derefModuleData accordingly.
 // nolint:unused
 type moduledata struct {
 	pcHeader              ptr64
@@ -727,6 +1071,14 @@ type moduledata struct {
 	// more fields we don't care about now.
 	// ...
 	// next *moduledata
+
+	// Strings of funcnametab and filetab, not part of the runtime structure.
+	names *cstringCache
+	files *cstringCache
+	// Functions indexed by their index in the code section of the module,
+	// nil if the entries of the functions are not where the Go linker
+	// places them, see buildFuncTable.
+	funcs []*goFunction
 }
 
 // funcName returns the string at nameOff in the function name table.
@@ -734,12 +1086,39 @@ func (md moduledata) funcName(nameOff int32) string {
 	if nameOff == 0 {
 		return ""
 	}
-	x := md.funcnametab[nameOff:]
-	return cstring(x)
+	return md.names.lookup(md.funcnametab, uint32(nameOff))
+}
+
+// cstringCache interns the null-terminated strings of a table of moduledata,
+// indexed by their offset in the table, so symbolizing the same functions
+// repeatedly does not allocate. It is safe to use concurrently; a nil cache
+// allocates the strings on every lookup.
+type cstringCache struct {
+	mutex   sync.RWMutex
+	strings map[uint32]string
+}
+
+func newCstringCache() *cstringCache {
+	return &cstringCache{strings: make(map[uint32]string)}
+}
+
+func (c *cstringCache) lookup(table []byte, off uint32) string {
+	if c == nil {
+		return cstring(table[off:])
+	}
+	c.mutex.RLock()
+	s, ok := c.strings[off]
+	c.mutex.RUnlock()
+	if !ok {
+		s = cstring(table[off:])
+		c.mutex.Lock()
+		c.strings[off] = s
+		c.mutex.Unlock()
+	}
+	return s
 }
 
 // Captures the first null-terminated string from b.
-// TODO: no alloc.
 func cstring(b []byte) string {
 	i := bytes.IndexByte(b, 0)
 	if i < 0 {
@@ -801,15 +1180,97 @@ func (md moduledata) textAddr(off32 uint32) ptr64 {
 	return res
 }
 
-// Retrieve module data from memory, including slices.
-func derefModuledata(mem vmem, addr ptr64) moduledata {
-	m := deref[moduledata](mem, addr)
-	m.funcnametab = derefGoSlice(mem, m.funcnametab)
-	m.cutab = derefGoSlice(mem, m.cutab)
-	m.filetab = derefGoSlice(mem, m.filetab)
-	m.pctab = derefGoSlice(mem, m.pctab)
-	m.pclntable = derefGoSlice(mem, m.pclntable)
-	m.ftab = derefGoSlice(mem, m.ftab)
-	m.textsectmap = derefGoSlice(mem, m.textsectmap)
-	return m
+// Retrieve module data from memory, including slices. The slices are views of
+// the memory if borrow is true, copies otherwise.
+func derefModuledata(mem vmem, ptrSize, addr ptr64, borrow bool) *moduledata {
+	r := goreader{mem: mem, ptrSize: ptrSize, addr: addr, borrow: borrow}
+
+	var m moduledata
+	m.pcHeader = r.ptr()
+	m.funcnametab = derefGoSlice[byte](&r)
+	m.cutab = derefGoSlice[uint32](&r)
+	m.filetab = derefGoSlice[byte](&r)
+	m.pctab = derefGoSlice[byte](&r)
+	m.pclntable = derefGoSlice[byte](&r)
+	m.ftab = derefGoSlice[functab](&r)
+	m.findfunctab = r.ptr()
+	m.minpc = r.ptr()
+	m.maxpc = r.ptr()
+	m.text = r.ptr()
+	m.etext = r.ptr()
+	m.noptrdata = r.ptr()
+	m.enoptrdata = r.ptr()
+	m.data = r.ptr()
+	m.edata = r.ptr()
+	m.bss = r.ptr()
+	m.ebss = r.ptr()
+	m.noptrbss = r.ptr()
+	m.enoptrbss = r.ptr()
+	m.covctrs = r.ptr()
+	m.ecovctrs = r.ptr()
+	m.end = r.ptr()
+	m.gcdata = r.ptr()
+	m.gcbss = r.ptr()
+	m.types = r.ptr()
+	m.etypes = r.ptr()
+	m.rodata = r.ptr()
+	m.gofunc = r.ptr()
+
+	data, n := r.slice()
+	m.textsectmap = make([]textsect, n)
+	s := goreader{mem: mem, ptrSize: ptrSize, addr: data}
+	for i := range m.textsectmap {
+		m.textsectmap[i] = textsect{
+			vaddr:    s.ptr(),
+			end:      s.ptr(),
+			baseaddr: s.ptr(),
+		}
+	}
+	m.names = newCstringCache()
+	m.files = newCstringCache()
+	return &m
+}
+
+// goreader decodes the consecutive words of a Go runtime structure in the
+// guest memory.
+type goreader struct {
+	mem     vmem
+	ptrSize ptr64
+	addr    ptr64
+	borrow  bool // return views of slices instead of copies
+}
+
+// ptr reads the next pointer-sized word.
+func (r *goreader) ptr() ptr64 {
+	var v ptr64
+	if r.ptrSize == 4 {
+		v = ptr64(deref[uint32](r.mem, r.addr))
+	} else {
+		v = deref[ptr64](r.mem, r.addr)
+	}
+	r.addr += r.ptrSize
+	return v
+}
+
+// slice reads the next slice header, and returns the address of its data and
+// its length.
+func (r *goreader) slice() (ptr64, uint32) {
+	data := r.ptr()
+	n := r.ptr()
+	r.ptr() // cap
+	return data, uint32(n)
+}
+
+// derefGoSlice reads the next slice header from r, and returns a copy of the
+// slice's contents in host memory, or a view of them if r borrows the memory.
+// It is not recursive.
+func derefGoSlice[T any](r *goreader) []T {
+	data, n := r.slice()
+	if n == 0 {
+		return nil
+	}
+	if r.borrow {
+		return viewArray[T](r.mem, data, n)
+	}
+	return derefArray[T](r.mem, data, n)
 }
@@ -0,0 +1,453 @@
+package wzprof
+
+import (
+	"context"
+	"encoding/binary"
+	"os"
+	"testing"
+	"unsafe"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+func TestModuledataFuncName(t *testing.T) {
+	md := moduledata{
+		funcnametab: []byte("\x00main.main\x00runtime.goexit\x00"),
+		names:       newCstringCache(),
+	}
+
+	for _, test := range []struct {
+		off  int32
+		name string
+	}{
+		{0, ""},
+		{1, "main.main"},
+		{11, "runtime.goexit"},
+		{1, "main.main"},
+	} {
+		if name := md.funcName(test.off); name != test.name {
+			t.Errorf("wrong name at offset %d: want=%q got=%q", test.off, test.name, name)
+		}
+	}
+
+	allocs := testing.AllocsPerRun(100, func() {
+		md.funcName(1)
+		md.funcName(11)
+	})
+	if allocs != 0 {
+		t.Errorf("resolving interned names allocated %v times", allocs)
+	}
+
+	// Without a cache the names are still resolved.
+	md.names = nil
+	if name := md.funcName(11); name != "runtime.goexit" {
+		t.Errorf("wrong name without cache: %q", name)
+	}
+}
+
+func TestPclntabPointerSize4(t *testing.T) {
+	// Memory of a toolchain using 4 bytes pointers (e.g. TinyGo), with the
+	// pclntab at 0x1000 and the moduledata at 0x2000.
+	const (
+		pclntab     = 0x1000
+		funcnametab = pclntab + 0x40
+		cutab       = pclntab + 0x60
+		filetab     = pclntab + 0x80
+		pctab       = pclntab + 0xa0
+		pclntable   = pclntab + 0xc0
+		ftab        = pclntab + 0xe0
+		moduledata  = 0x2000
+		textsectmap = 0x2200
+	)
+	mem := make([]byte, 0x2300)
+	put := func(addr, v uint32) { binary.LittleEndian.PutUint32(mem[addr:], v) }
+
+	copy(mem[pclntab:], []byte{0xf1, 0xff, 0xff, 0xff, 0x00, 0x00, 0x01, 0x04})
+	put(pclntab+8+3*4, funcnametab-pclntab)
+	put(pclntab+8+4*4, cutab-pclntab)
+	put(pclntab+8+5*4, filetab-pclntab)
+	copy(mem[funcnametab:], "\x00main.main\x00")
+	put(cutab, 1)
+	copy(mem[filetab:], "\x00main.go\x00")
+	put(ftab, 0x10)   // entryoff
+	put(ftab+4, 0x20) // funcoff
+
+	// Slices are followed by their length and capacity.
+	words := []uint32{
+		pclntab,
+		funcnametab, 11, 11,
+		cutab, 1, 1,
+		filetab, 9, 9,
+		pctab, 4, 4,
+		pclntable, 8, 8,
+		ftab, 1, 1,
+		0,            // findfunctab
+		0x100, 0x200, // minpc, maxpc
+		0x100, 0x200, // text, etext
+	}
+	for i, w := range words {
+		put(moduledata+uint32(i)*4, w)
+	}
+	// textsectmap follows the 17 pointers from noptrdata to gofunc.
+	put(moduledata+(uint32(len(words))+17)*4, textsectmap)
+	put(moduledata+(uint32(len(words))+18)*4, 1)
+	put(textsectmap, 0)
+	put(textsectmap+4, 0x100)
+	put(textsectmap+8, 0x100)
+
+	// Data section of two active segments, mode 0 with an i32.const offset.
+	var data []byte
+	data = append(data, 2)
+	for _, seg := range []struct{ addr, size uint32 }{{pclntab, 0x100}, {moduledata, 0x300}} {
+		data = append(data, 0, 0x41)
+		data = appendSleb128(data, int64(seg.addr))
+		data = append(data, 0x0b)
+		data = binary.AppendUvarint(data, uint64(seg.size))
+		data = append(data, mem[seg.addr:seg.addr+seg.size]...)
+	}
+
+	pch := pclntabHeaderFromData(data)
+	want := partialPCHeader{
+		address:        pclntab,
+		ptrSize:        4,
+		funcnametabOff: funcnametab - pclntab,
+		cutabOff:       cutab - pclntab,
+		filetabOff:     filetab - pclntab,
+	}
+	if pch != want {
+		t.Fatalf("wrong pclntab header: want %+v, got %+v", want, pch)
+	}
+	if addr := moduledataAddrFromData(pch, data); addr != moduledata {
+		t.Fatalf("wrong moduledata address: want %#x, got %#x", moduledata, addr)
+	}
+
+	vm, err := wasmInitialMemory(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	md := derefModuledata(vm, 4, moduledata, false)
+	if md.pcHeader != pclntab || md.minpc != 0x100 || md.maxpc != 0x200 || md.text != 0x100 || md.etext != 0x200 {
+		t.Errorf("wrong moduledata pointers: %+v", md)
+	}
+	if len(md.ftab) != 1 || md.ftab[0] != (functab{entryoff: 0x10, funcoff: 0x20}) {
+		t.Errorf("wrong function table: %+v", md.ftab)
+	}
+	if len(md.cutab) != 1 || md.cutab[0] != 1 || len(md.pctab) != 4 || len(md.pclntable) != 8 {
+		t.Errorf("wrong tables: cutab=%v pctab=%d pclntable=%d", md.cutab, len(md.pctab), len(md.pclntable))
+	}
+	if name := md.funcName(1); name != "main.main" {
+		t.Errorf("wrong function name: want %q, got %q", "main.main", name)
+	}
+	if string(md.filetab) != "\x00main.go\x00" {
+		t.Errorf("wrong file table: %q", md.filetab)
+	}
+	if len(md.textsectmap) != 1 || md.textsectmap[0] != (textsect{vaddr: 0, end: 0x100, baseaddr: 0x100}) {
+		t.Errorf("wrong text sections: %+v", md.textsectmap)
+	}
+}
+
+// appendSleb128 appends the signed LEB128 encoding of v to b.
+func appendSleb128(b []byte, v int64) []byte {
+	for {
+		c := byte(v & 0x7f)
+		v >>= 7
+		if (v == 0 && c&0x40 == 0) || (v == -1 && c&0x40 != 0) {
+			return append(b, c)
+		}
+		b = append(b, c|0x80)
+	}
+}
+
+func TestPclntabInlineTrees(t *testing.T) {
+	wasm, err := os.ReadFile("testdata/go/simple.wasm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	// Compiling with the interpreter is faster, only the module is needed.
+	r := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfigInterpreter())
+	defer r.Close(ctx)
+	mod, err := r.CompileModule(ctx, wasm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := preparePclntabSymbolizer(wasm, mod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The moduledata of this module is initialized in its data segments, the
+	// trees can be read without running it.
+	mem, err := wasmInitialMemory(wasmdataSection(wasm))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.EnsureReady(mem)
+	if len(p.inlineTrees) == 0 {
+		t.Fatal("no inline trees")
+	}
+
+	// The inlined calls name functions of the pclntab.
+	md := p.md.Load()
+	for _, tree := range p.inlineTrees {
+		for _, call := range tree {
+			if call.nameOff <= 0 || int(call.nameOff) >= len(md.funcnametab) || md.funcName(call.nameOff) == "" {
+				t.Fatalf("invalid inlined call: %+v", call)
+			}
+		}
+	}
+}
+
+func loadPclntab(t testing.TB, path string) *pclntab {
+	p, mem := preparePclntab(t, path)
+	p.EnsureReady(mem)
+	return p
+}
+
+// preparePclntab returns the pclntab of the Go module at path before its
+// memory is ready, and the initial memory of the module.
+func preparePclntab(t testing.TB, path string) (*pclntab, *vmemb) {
+	wasm, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	// Compiling with the interpreter is faster, only the module is needed.
+	r := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfigInterpreter())
+	defer r.Close(ctx)
+	mod, err := r.CompileModule(ctx, wasm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := preparePclntabSymbolizer(wasm, mod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mem, err := wasmInitialMemory(wasmdataSection(wasm))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p, mem
+}
+
+func TestPclntabBorrowedMemory(t *testing.T) {
+	want := loadPclntab(t, "testdata/go/simple.wasm")
+	p, initial := preparePclntab(t, "testdata/go/simple.wasm")
+	p.borrow = true
+	// Like the memory of a module, the memory starts at address 0.
+	mem := &vmemb{b: append(make([]byte, initial.Start), initial.b...)}
+
+	check := func(md *moduledata) {
+		t.Helper()
+		base := uintptr(unsafe.Pointer(unsafe.SliceData(mem.b)))
+		for _, data := range []unsafe.Pointer{
+			unsafe.Pointer(unsafe.SliceData(md.pclntable)),
+			unsafe.Pointer(unsafe.SliceData(md.ftab)),
+			unsafe.Pointer(unsafe.SliceData(md.pctab)),
+		} {
+			if addr := uintptr(data); addr < base || addr >= base+uintptr(len(mem.b)) {
+				t.Fatalf("table at %#x is not a view of the memory", addr)
+			}
+		}
+		for i := 0; i+1 < len(md.ftab); i++ {
+			pc := md.textAddr(md.ftab[i].entryoff) + 1
+			if got, want := p.FindFunc(pc), want.FindFunc(pc); got.name() != want.name() {
+				t.Fatalf("wrong function at pc %#x: want %q, got %q", pc, want.name(), got.name())
+			}
+		}
+	}
+
+	p.EnsureReady(mem)
+	md := p.md.Load()
+	check(md)
+
+	// The tables are borrowed again when the memory moves to a new buffer.
+	mem.b = append([]byte(nil), mem.b...)
+	p.EnsureReady(mem)
+	moved := p.md.Load()
+	if moved == md {
+		t.Fatal("tables not borrowed again after the memory moved")
+	}
+	check(moved)
+}
+
+func TestPclntabFuncTable(t *testing.T) {
+	p := loadPclntab(t, "testdata/go/simple.wasm")
+	md := p.md.Load()
+	if len(md.funcs) == 0 {
+		t.Fatal("no function table")
+	}
+
+	// The functions found in the table are the ones found by searching the
+	// pclntab, at their entry and in their blocks.
+	for i := 0; i+1 < len(md.ftab); i++ {
+		entry := md.textAddr(md.ftab[i].entryoff)
+		end := md.textAddr(md.ftab[i+1].entryoff)
+		for _, pc := range []ptr64{entry, entry + 1, end - 1} {
+			want, got := p.searchFunc(pc), p.FindFunc(pc)
+			if got._funcoff != want._funcoff || !got.valid() {
+				t.Fatalf("wrong function at pc %#x: want %q, got %q", pc, want.name(), got.name())
+			}
+		}
+	}
+	if f := p.FindFunc(md.maxpc); f.valid() {
+		t.Errorf("function found past the end of the text: %q", f.name())
+	}
+}
+
+func BenchmarkPclntabFindFunc(b *testing.B) {
+	p := loadPclntab(b, "testdata/go/simple.wasm")
+	md := p.md.Load()
+	pcs := make([]ptr64, 0, len(md.ftab))
+	for i := 0; i+1 < len(md.ftab); i++ {
+		pcs = append(pcs, md.textAddr(md.ftab[i].entryoff)+1)
+	}
+
+	b.Run("table", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			p.FindFunc(pcs[i%len(pcs)])
+		}
+	})
+	b.Run("search", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			p.searchFunc(pcs[i%len(pcs)])
+		}
+	})
+}
+
+// goUnwindBenchmark runs a benchmark of the Go stack iterator on the first
+// stack of the guest which has at least depth frames, while the guest is
+// running so its memory holds the stack.
+type goUnwindBenchmark struct {
+	b     *testing.B
+	p     *Profiling
+	depth int
+	done  bool
+}
+
+func (g *goUnwindBenchmark) NewFunctionListener(api.FunctionDefinition) experimental.FunctionListener {
+	return experimental.FunctionListenerFunc(func(ctx context.Context, mod api.Module, def api.FunctionDefinition, _ []uint64, si experimental.StackIterator) {
+		if g.done {
+			return
+		}
+		walk := func() (n int) {
+			for s := g.p.stackIterator(mod, def, si); s.Next(); n++ {
+				s.Function()
+			}
+			return n
+		}
+		n := walk()
+		if n < g.depth {
+			return
+		}
+		g.done = true
+		g.b.ReportAllocs()
+		g.b.ResetTimer()
+		for i := 0; i < g.b.N; i++ {
+			walk()
+		}
+		g.b.StopTimer()
+		g.b.ReportMetric(float64(n), "frames/op")
+	})
+}
+
+// goUnwindCheck compares the stacks unwound by an iterator reusing the frames
+// of previous stacks with the ones unwound from scratch.
+type goUnwindCheck struct {
+	t      *testing.T
+	memo   *Profiling
+	fresh  *Profiling
+	calls  int
+	stacks int
+}
+
+func (g *goUnwindCheck) NewFunctionListener(api.FunctionDefinition) experimental.FunctionListener {
+	return experimental.FunctionListenerFunc(func(ctx context.Context, mod api.Module, def api.FunctionDefinition, _ []uint64, si experimental.StackIterator) {
+		if g.calls++; g.calls%7 != 0 || g.t.Failed() {
+			return
+		}
+		g.stacks++
+		walk := func(si experimental.StackIterator) (frames []stkframe) {
+			for si.Next() {
+				// The profilers have their own pclntab, functions are
+				// compared by offset.
+				f := si.(*goStackIterator).frame
+				f.fn = funcInfo{_funcoff: f.fn._funcoff}
+				frames = append(frames, f)
+			}
+			return frames
+		}
+		want := walk(g.fresh.stackIterator(mod, def, si))
+		// Reset the memo of the iterator unwinding from scratch.
+		fresh := g.fresh.stackIterator(mod, def, si).(*goStackIterator)
+		fresh.memo, fresh.entries = nil, nil
+		got := walk(g.memo.stackIterator(mod, def, si))
+
+		if len(got) != len(want) {
+			g.t.Errorf("%s: wrong number of frames: want %d, got %d", def.Name(), len(want), len(got))
+			return
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				g.t.Errorf("%s: wrong frame %d: want %+v, got %+v", def.Name(), i, want[i], got[i])
+				return
+			}
+		}
+	})
+}
+
+func TestGoStackIteratorMemo(t *testing.T) {
+	wasm, err := os.ReadFile("testdata/go/twocalls.wasm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := &goUnwindCheck{t: t, memo: ProfilingFor(wasm), fresh: ProfilingFor(wasm)}
+
+	ctx := context.WithValue(context.Background(), experimental.FunctionListenerFactoryKey{}, check)
+	r := wazero.NewRuntime(ctx)
+	defer r.Close(ctx)
+	wasi_snapshot_preview1.MustInstantiate(ctx, r)
+	mod, err := r.CompileModule(ctx, wasm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []*Profiling{check.memo, check.fresh} {
+		if err := p.Prepare(mod); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The guest exits with a sys.ExitError.
+	_, _ = r.InstantiateModule(ctx, mod, wazero.NewModuleConfig())
+	if check.stacks == 0 {
+		t.Fatal("no stacks unwound")
+	}
+}
+
+func BenchmarkGoStackIterator(b *testing.B) {
+	wasm, err := os.ReadFile("testdata/go/simple.wasm")
+	if err != nil {
+		b.Fatal(err)
+	}
+	p := ProfilingFor(wasm)
+	bench := &goUnwindBenchmark{b: b, p: p, depth: 20}
+
+	ctx := context.WithValue(context.Background(), experimental.FunctionListenerFactoryKey{}, bench)
+	r := wazero.NewRuntime(ctx)
+	defer r.Close(ctx)
+	wasi_snapshot_preview1.MustInstantiate(ctx, r)
+	mod, err := r.CompileModule(ctx, wasm)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err := p.Prepare(mod); err != nil {
+		b.Fatal(err)
+	}
+	// The guest exits with a sys.ExitError.
+	_, _ = r.InstantiateModule(ctx, mod, wazero.NewModuleConfig())
+	if !bench.done {
+		b.Fatalf("no stack of %d frames", bench.depth)
+	}
+}
@@ -0,0 +1,227 @@
+package wzprof
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/google/pprof/profile"
+)
+
+// WritePerfData writes a profile as a synthetic perf.data file, the format
+// recorded by the Linux perf tool, so "perf report", "perf script" and the
+// tools built on them can read the guest profiles.
+//
+// perf resolves the addresses of the samples with the symbols of the file
+// mapped in the address space of the process. The wasm module has no such
+// file, the samples are recorded in an anonymous mapping of the process of m,
+// for which perf reads the symbols from the file at m.Path(). The symbols are
+// added to m, which must be written to this file after the profile. Each
+// sample of the profile is recorded as a single perf sample, with a period of
+// the value of sampleType (the last sample type of the profile if empty).
+func WritePerfData(w io.Writer, prof *profile.Profile, m *PerfMap, sampleType string) error {
+	index, err := sampleTypeIndex(prof, sampleType)
+	if err != nil {
+		return err
+	}
+	frames := []string{}
+	for _, sample := range prof.Sample {
+		for _, frame := range appendSampleFrames(frames[:0], sample) {
+			m.add(frame)
+		}
+	}
+	pid := uint32(m.pid)
+
+	// Records of the data section, which start with the name of the process
+	// and the mapping of the module.
+	var data perfBuffer
+	comm := "wasm"
+	if len(prof.Mapping) > 0 && prof.Mapping[0].File != "" {
+		comm = path.Base(prof.Mapping[0].File)
+	}
+	if len(comm) > perfCommLen-1 {
+		comm = comm[:perfCommLen-1]
+	}
+	data.record(perfRecordComm, func(b *perfBuffer) {
+		b.u32(pid)
+		b.u32(pid)
+		b.cstring(comm)
+	})
+	data.record(perfRecordMmap, func(b *perfBuffer) {
+		b.u32(pid)
+		b.u32(pid)
+		b.u64(perfBaseAddress)
+		b.u64(uint64(len(m.names)) * perfSymbolSize)
+		b.u64(0)
+		b.cstring(perfAnonMapping)
+	})
+
+	for i, sample := range prof.Sample {
+		value := sample.Value[index]
+		if value <= 0 {
+			continue
+		}
+		frames = appendSampleFrames(frames[:0], sample)
+		if len(frames) == 0 {
+			continue
+		}
+		if len(frames) > perfMaxFrames {
+			frames = frames[len(frames)-perfMaxFrames:]
+		}
+		data.record(perfRecordSample, func(b *perfBuffer) {
+			b.u64(m.addresses[frames[len(frames)-1]])
+			b.u32(pid)
+			b.u32(pid)
+			b.u64(uint64(prof.TimeNanos) + uint64(i))
+			b.u64(uint64(value))
+			// The call chain starts with the context of the addresses,
+			// followed by the frames from the leaf to the root.
+			b.u64(uint64(len(frames) + 1))
+			b.u64(perfContextUser)
+			for j := len(frames) - 1; j >= 0; j-- {
+				b.u64(m.addresses[frames[j]])
+			}
+		})
+	}
+
+	// The file starts with a header locating the event attributes and the
+	// data section. There is a single event, so the samples do not need to
+	// carry the id of their event.
+	const (
+		attrOffset = perfHeaderSize
+		dataOffset = attrOffset + perfFileAttrSize
+	)
+	var b perfBuffer
+	b.u64(perfMagic)
+	b.u64(perfHeaderSize)
+	b.u64(perfFileAttrSize)
+	b.u64(attrOffset)
+	b.u64(perfFileAttrSize)
+	b.u64(dataOffset)
+	b.u64(uint64(len(data)))
+	b.u64(0) // event types
+	b.u64(0)
+	b.zero(perfFeaturesSize)
+
+	// perf_event_attr, followed by the section of the ids of the event.
+	b.u32(perfTypeSoftware)
+	b.u32(perfAttrSize)
+	b.u64(perfCountSWCPUClock)
+	b.u64(1) // sample period
+	b.u64(perfSampleIP | perfSampleTID | perfSampleTime | perfSampleCallchain | perfSamplePeriod)
+	b.u64(0) // read format
+	b.u64(perfAttrFlagMmap | perfAttrFlagComm)
+	b.zero(perfAttrSize - 48)
+	b.u64(0)
+	b.u64(0)
+
+	if _, err := w.Write(b); err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// PerfMap is the symbol table of the perf.data files written by WritePerfData
+// for a process. perf reads it from /tmp/perf-<pid>.map, the files written for
+// the same process must share their PerfMap: the functions of the profiles are
+// identified by their name and assigned synthetic addresses in the order they
+// are first seen, each of them gets a range of perfSymbolSize bytes.
+type PerfMap struct {
+	pid       int
+	names     []string
+	addresses map[string]uint64
+}
+
+// NewPerfMap returns an empty symbol table for process pid, which is usually
+// the process of the host running the guest (os.Getpid).
+func NewPerfMap(pid int) *PerfMap {
+	return &PerfMap{pid: pid, addresses: make(map[string]uint64)}
+}
+
+// Path returns the path of the file where perf reads the symbol table.
+func (m *PerfMap) Path() string {
+	return fmt.Sprintf("/tmp/perf-%d.map", m.pid)
+}
+
+// WriteTo writes the symbol table to w, in the format of perf map files.
+func (m *PerfMap) WriteTo(w io.Writer) (int64, error) {
+	b := new(bytes.Buffer)
+	for _, name := range m.names {
+		addr := m.addresses[name]
+		fmt.Fprintf(b, "%x %x %s\n", addr, perfSymbolSize, strings.ReplaceAll(name, "\n", " "))
+	}
+	return b.WriteTo(w)
+}
+
+func (m *PerfMap) add(name string) {
+	if _, ok := m.addresses[name]; !ok {
+		m.addresses[name] = perfBaseAddress + uint64(len(m.names))*perfSymbolSize
+		m.names = append(m.names, name)
+	}
+}
+
+const (
+	perfMagic        = 0x32454c4946524550 // "PERFILE2"
+	perfHeaderSize   = 104
+	perfFeaturesSize = 32
+	perfAttrSize     = 112 // PERF_ATTR_SIZE_VER5
+	perfFileAttrSize = perfAttrSize + 16
+
+	perfTypeSoftware    = 1
+	perfCountSWCPUClock = 0
+
+	perfSampleIP        = 1 << 0
+	perfSampleTID       = 1 << 1
+	perfSampleTime      = 1 << 2
+	perfSampleCallchain = 1 << 5
+	perfSamplePeriod    = 1 << 8
+
+	perfAttrFlagMmap = 1 << 8
+	perfAttrFlagComm = 1 << 9
+
+	perfRecordMmap     = 1
+	perfRecordComm     = 3
+	perfRecordSample   = 9
+	perfRecordMiscUser = 2
+
+	perfContextUser = 0xfffffffffffffe00 // (u64)-512
+
+	// Records have a 16 bits size, which bounds the length of call chains.
+	perfMaxFrames = 8000
+
+	perfCommLen     = 16
+	perfAnonMapping = "//anon"
+	perfBaseAddress = 0x10000
+	perfSymbolSize  = 16
+)
+
+// perfBuffer encodes the little-endian structures of perf.data files.
+type perfBuffer []byte
+
+func (b *perfBuffer) u16(v uint16) { *b = binary.LittleEndian.AppendUint16(*b, v) }
+
+func (b *perfBuffer) u32(v uint32) { *b = binary.LittleEndian.AppendUint32(*b, v) }
+
+func (b *perfBuffer) u64(v uint64) { *b = binary.LittleEndian.AppendUint64(*b, v) }
+
+func (b *perfBuffer) zero(n int) { *b = append(*b, make([]byte, n)...) }
+
+// cstring appends a null-terminated string, padded to a multiple of 8 bytes.
+func (b *perfBuffer) cstring(s string) {
+	*b = append(*b, s...)
+	b.zero(8 - len(s)%8)
+}
+
+// record appends a record of the given type, with the body encoded by fn.
+func (b *perfBuffer) record(typ uint32, fn func(*perfBuffer)) {
+	start := len(*b)
+	b.u32(typ)
+	b.u16(perfRecordMiscUser)
+	b.u16(0) // size, set once the body is encoded
+	fn(b)
+	binary.LittleEndian.PutUint16((*b)[start+6:], uint16(len(*b)-start))
+}
@@ -0,0 +1,103 @@
+package wzprof
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+
+	"github.com/google/pprof/profile"
+)
+
+func TestWritePerfData(t *testing.T) {
+	main := &profile.Function{ID: 1, Name: "main"}
+	work := &profile.Function{ID: 2, Name: "work"}
+
+	mainLoc := &profile.Location{ID: 1, Line: []profile.Line{{Function: main}}}
+	workLoc := &profile.Location{ID: 2, Line: []profile.Line{{Function: work}}}
+
+	prof := &profile.Profile{
+		SampleType: []*profile.ValueType{
+			{Type: "samples", Unit: "count"},
+			{Type: "cpu", Unit: "nanoseconds"},
+		},
+		Sample: []*profile.Sample{
+			{Location: []*profile.Location{workLoc, mainLoc}, Value: []int64{1, 100}},
+			{Location: []*profile.Location{mainLoc}, Value: []int64{2, 0}},
+		},
+		Location: []*profile.Location{mainLoc, workLoc},
+		Function: []*profile.Function{main, work},
+		Mapping:  []*profile.Mapping{{ID: 1, File: "/path/to/module.wasm"}},
+	}
+
+	m := NewPerfMap(42)
+	if path := m.Path(); path != "/tmp/perf-42.map" {
+		t.Errorf("wrong perf map path: %s", path)
+	}
+	var b bytes.Buffer
+	if err := WritePerfData(&b, prof, m, ""); err != nil {
+		t.Fatal(err)
+	}
+	data := b.Bytes()
+	u32 := func(off int) uint32 { return binary.LittleEndian.Uint32(data[off:]) }
+	u64 := func(off int) uint64 { return binary.LittleEndian.Uint64(data[off:]) }
+
+	if string(data[:8]) != "PERFILE2" {
+		t.Fatalf("wrong magic: %q", data[:8])
+	}
+	if size := u64(8); size != perfHeaderSize {
+		t.Fatalf("wrong header size: %d", size)
+	}
+	attr := int(u64(24))
+	if typ, size := u32(attr), u32(attr+4); typ != perfTypeSoftware || size != perfAttrSize {
+		t.Errorf("wrong event attributes: type=%d size=%d", typ, size)
+	}
+	dataOffset, dataSize := int(u64(40)), int(u64(48))
+	if dataOffset+dataSize != len(data) {
+		t.Fatalf("data section [%d:+%d] does not end the file of %d bytes", dataOffset, dataSize, len(data))
+	}
+
+	var types []uint32
+	var callchains [][]uint64
+	for off := dataOffset; off < len(data); {
+		typ, size := u32(off), int(binary.LittleEndian.Uint16(data[off+6:]))
+		types = append(types, typ)
+		switch typ {
+		case perfRecordComm:
+			if comm := string(bytes.TrimRight(data[off+16:off+size], "\x00")); comm != "module.wasm" {
+				t.Errorf("wrong comm: %q", comm)
+			}
+		case perfRecordSample:
+			if pid := u32(off + 16); pid != 42 {
+				t.Errorf("wrong pid: %d", pid)
+			}
+			if period := u64(off + 32); period != 100 {
+				t.Errorf("wrong period: %d", period)
+			}
+			n := int(u64(off + 40))
+			chain := make([]uint64, n)
+			for i := range chain {
+				chain[i] = u64(off + 48 + 8*i)
+			}
+			callchains = append(callchains, chain)
+		}
+		off += size
+	}
+
+	if want := []uint32{perfRecordComm, perfRecordMmap, perfRecordSample}; !reflect.DeepEqual(types, want) {
+		t.Errorf("wrong records: want %v, got %v", want, types)
+	}
+	// Symbols are assigned in the order they are first seen: main, work.
+	want := [][]uint64{{perfContextUser, perfBaseAddress + perfSymbolSize, perfBaseAddress}}
+	if !reflect.DeepEqual(callchains, want) {
+		t.Errorf("wrong call chains: want %x, got %x", want, callchains)
+	}
+
+	var symbols bytes.Buffer
+	if _, err := m.WriteTo(&symbols); err != nil {
+		t.Fatal(err)
+	}
+	if want := "10000 10 main\n10010 10 work\n"; symbols.String() != want {
+		t.Errorf("wrong perf map: want\n%s\ngot\n%s", want, symbols.String())
+	}
+}
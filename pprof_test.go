@@ -0,0 +1,218 @@
+package wzprof
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/google/pprof/profile"
+)
+
+func TestHandlerUnknownProfile(t *testing.T) {
+	handler := Handler(1, ProfilingFor(nil).MemoryProfiler())
+
+	tests := []struct {
+		path   string
+		status int
+	}{
+		{path: "/debug/pprof/", status: http.StatusOK},
+		{path: "/debug/pprof/allocs", status: http.StatusOK},
+		{path: "/debug/pprof/goroutine", status: http.StatusNotFound},
+		{path: "/debug/pprof/goroutine?host&debug=1", status: http.StatusOK},
+	}
+
+	for _, test := range tests {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", test.path, nil))
+		if rec.Code != test.status {
+			t.Errorf("%s: want status %d, got %d", test.path, test.status, rec.Code)
+		}
+	}
+}
+
+func TestHandlerLabels(t *testing.T) {
+	mem := ProfilingFor(nil).MemoryProfiler()
+	alloc := newMallocListener(mem)
+	alloc(10)
+	handler := WithLabels(Handler(1, mem), map[string]string{
+		"service": "test",
+		"region":  "us-west-2",
+	})
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/debug/pprof/allocs?label=region:us-east-1&label=instance:i-1", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("wrong status: %d: %s", rec.Code, rec.Body)
+	}
+	prof, err := profile.Parse(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]string{
+		"service":  {"test"},
+		"region":   {"us-east-1"},
+		"instance": {"i-1"},
+	}
+	for _, s := range prof.Sample {
+		if !reflect.DeepEqual(s.Label, want) {
+			t.Errorf("wrong labels: want %v, got %v", want, s.Label)
+		}
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/debug/pprof/allocs?label=region", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("wrong status for invalid label: %d", rec.Code)
+	}
+}
+
+func TestHandlerAuth(t *testing.T) {
+	handler := WithAuth(Handler(1, ProfilingFor(nil).MemoryProfiler()), Credentials{
+		BearerToken: "secret",
+		Username:    "user",
+		Password:    "password",
+	})
+
+	tests := []struct {
+		scenario string
+		header   string
+		status   int
+	}{
+		{scenario: "no credentials", status: http.StatusUnauthorized},
+		{scenario: "bearer token", header: "Bearer secret", status: http.StatusOK},
+		{scenario: "wrong bearer token", header: "Bearer secrets", status: http.StatusUnauthorized},
+		{scenario: "basic auth", header: "Basic dXNlcjpwYXNzd29yZA==", status: http.StatusOK},
+		{scenario: "wrong basic auth", header: "Basic dXNlcjpwYXNz", status: http.StatusUnauthorized},
+	}
+
+	for _, test := range tests {
+		t.Run(test.scenario, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/debug/pprof/allocs", nil)
+			if test.header != "" {
+				req.Header.Set("Authorization", test.header)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != test.status {
+				t.Errorf("want status %d, got %d", test.status, rec.Code)
+			}
+			if rec.Code == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") == "" {
+				t.Error("missing WWW-Authenticate header")
+			}
+		})
+	}
+}
+
+func TestHandlerWebUI(t *testing.T) {
+	mem := ProfilingFor(nil).MemoryProfiler()
+	alloc := newMallocListener(mem)
+	alloc(10)
+	handler := Handler(1, mem)
+
+	tests := []struct {
+		path   string
+		status int
+	}{
+		{path: "/debug/pprof/ui/allocs", status: http.StatusMovedPermanently},
+		{path: "/debug/pprof/ui/allocs/top", status: http.StatusOK},
+		{path: "/debug/pprof/ui/allocs/flamegraph", status: http.StatusOK},
+		{path: "/debug/pprof/ui/allocs/nope", status: http.StatusNotFound},
+		{path: "/debug/pprof/ui/goroutine/", status: http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", test.path, nil))
+		if rec.Code != test.status {
+			t.Errorf("%s: want status %d, got %d: %s", test.path, test.status, rec.Code, rec.Body)
+		}
+	}
+}
+
+func TestListenUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pprof.sock")
+
+	// A socket left over by a previous listener is replaced.
+	for i := 0; i < 2; i++ {
+		l, err := Listen("unix://" + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		server := &http.Server{Handler: Handler(1, ProfilingFor(nil).MemoryProfiler())}
+		go server.Serve(l)
+
+		client := &http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", path)
+			},
+		}}
+		res, err := client.Get("http://unix/debug/pprof/allocs")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Errorf("wrong status: %s", res.Status)
+		}
+		client.CloseIdleConnections()
+		server.Close()
+		// Closing the listener removes the socket file, recreate it as a
+		// process exiting without closing it would.
+		if i == 0 {
+			f, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.SetUnlinkOnClose(false)
+			f.Close()
+		}
+	}
+}
+
+func TestListenFD(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	f, err := l.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	inherited, err := Listen("fd://" + strconv.Itoa(int(f.Fd())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inherited.Close()
+	if inherited.Addr().String() != l.Addr().String() {
+		t.Errorf("wrong address: want %s, got %s", l.Addr(), inherited.Addr())
+	}
+
+	if _, err := Listen("fd://x"); err == nil {
+		t.Error("no error for invalid file descriptor")
+	}
+}
+
+func TestListenSystemd(t *testing.T) {
+	t.Setenv("LISTEN_PID", "")
+	t.Setenv("LISTEN_FDS", "")
+	if _, err := Listen("systemd://"); err == nil {
+		t.Error("no error without socket activation")
+	}
+
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	t.Setenv("LISTEN_FDS", "1")
+	t.Setenv("LISTEN_FDNAMES", "http")
+	if _, err := Listen("systemd://pprof"); err == nil || !strings.Contains(err.Error(), `"pprof"`) {
+		t.Errorf("wrong error for unknown socket name: %v", err)
+	}
+}
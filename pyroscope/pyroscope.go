@@ -0,0 +1,169 @@
+// Package pyroscope pushes the profiles of wzprof profilers to a Pyroscope
+// server, enabling continuous profiling of WebAssembly guests alongside native
+// services.
+package pyroscope
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/pprof/profile"
+
+	"github.com/stealthrocket/wzprof"
+)
+
+// Config is the configuration of a Pusher.
+type Config struct {
+	// Address of the Pyroscope server, e.g. "http://localhost:4040".
+	ServerAddress string
+	// Name of the application the profiles are reported for.
+	ApplicationName string
+	// Labels attached to all the profiles pushed to the server.
+	Labels map[string]string
+	// Period at which the profiles are pushed. Default to 10 seconds.
+	UploadRate time.Duration
+	// Sample rate configured on the profilers, used to scale the profiles.
+	// Default to 1.
+	SampleRate float64
+	// Token sent in the Authorization header of the requests, if not empty.
+	AuthToken string
+	// Client used to send the requests. Default to http.DefaultClient.
+	Client *http.Client
+}
+
+// Pusher periodically snapshots the profilers of a guest and pushes them to a
+// Pyroscope server using its ingest API.
+//
+// The pusher drives the CPU profiler: it starts a new profile each time the
+// previous one is pushed. The profiler should not be used by other components
+// (such as the pprof http handler) at the same time.
+type Pusher struct {
+	config   Config
+	profiler *wzprof.ContinuousProfiler
+}
+
+// New creates a Pusher of the profiles of cpu and mem, either of which may be
+// nil. The CPU profile starts recording immediately.
+func New(config Config, cpu *wzprof.CPUProfiler, mem *wzprof.MemoryProfiler) *Pusher {
+	if config.UploadRate <= 0 {
+		config.UploadRate = 10 * time.Second
+	}
+	if config.Client == nil {
+		config.Client = http.DefaultClient
+	}
+	p := &Pusher{config: config}
+	p.profiler = wzprof.NewContinuousProfiler(cpu, mem, p.push,
+		wzprof.RotationPeriod(config.UploadRate),
+		wzprof.ProfileSampleRate(config.SampleRate),
+	)
+	return p
+}
+
+// Run pushes the profiles every UploadRate until ctx is canceled, then pushes
+// the profiles recorded since the last upload. Errors to push profiles do not
+// interrupt Run, the last one is returned.
+func (p *Pusher) Run(ctx context.Context) error {
+	return p.profiler.Run(ctx)
+}
+
+// Push sends the profiles recorded since the previous call to the server.
+func (p *Pusher) Push(ctx context.Context) error {
+	return p.profiler.Rotate(ctx)
+}
+
+func (p *Pusher) push(ctx context.Context, profiles *wzprof.Profiles) error {
+	var errs []error
+	if profiles.CPU != nil {
+		if err := p.ingest(ctx, "cpu", profiles.Start, profiles.End, profiles.CPU); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if profiles.Memory != nil {
+		if err := p.ingest(ctx, "memory", profiles.Start, profiles.End, profiles.Memory); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return errs[0]
+	}
+	return nil
+}
+
+func (p *Pusher) ingest(ctx context.Context, kind string, from, until time.Time, prof *profile.Profile) error {
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	part, err := w.CreateFormFile("profile", "profile.pprof")
+	if err != nil {
+		return err
+	}
+	if err := prof.Write(part); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	query := url.Values{}
+	query.Set("name", appName(p.config.ApplicationName+"."+kind, p.config.Labels))
+	query.Set("from", strconv.FormatInt(from.Unix(), 10))
+	query.Set("until", strconv.FormatInt(until.Unix(), 10))
+	query.Set("format", "pprof")
+	query.Set("spyName", "wzprof")
+
+	u := strings.TrimSuffix(p.config.ServerAddress, "/") + "/ingest?" + query.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	if p.config.AuthToken != "" {
+		req.Header.Set("Authorization", "Bearer "+p.config.AuthToken)
+	}
+
+	res, err := p.config.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("pyroscope: pushing %s profile: %w", kind, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+		return fmt.Errorf("pyroscope: pushing %s profile: %s: %s", kind, res.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// appName formats the application name with its labels the way the ingest
+// API expects them, e.g. "app.cpu{env=prod,region=us}".
+func appName(name string, labels map[string]string) string {
+	if len(labels) == 0 {
+		return name
+	}
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteString(name)
+	b.WriteByte('{')
+	for i, k := range keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(k)
+		b.WriteByte('=')
+		b.WriteString(labels[k])
+	}
+	b.WriteByte('}')
+	return b.String()
+}
@@ -0,0 +1,110 @@
+package pyroscope
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/pprof/profile"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+	"github.com/tetratelabs/wazero/experimental/wazerotest"
+
+	"github.com/stealthrocket/wzprof"
+)
+
+func TestPusher(t *testing.T) {
+	type ingest struct {
+		name string
+		prof *profile.Profile
+	}
+	var ingests []ingest
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ingest" {
+			t.Errorf("wrong path: %s", r.URL.Path)
+		}
+		if auth := r.Header.Get("Authorization"); auth != "Bearer secret" {
+			t.Errorf("wrong authorization: %q", auth)
+		}
+		q := r.URL.Query()
+		if q.Get("format") != "pprof" || q.Get("from") == "" || q.Get("until") == "" {
+			t.Errorf("wrong query: %s", r.URL.RawQuery)
+		}
+		f, _, err := r.FormFile("profile")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		prof, err := profile.Parse(f)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		ingests = append(ingests, ingest{q.Get("name"), prof})
+	}))
+	defer server.Close()
+
+	p := wzprof.ProfilingFor(nil)
+	mem := p.MemoryProfiler()
+
+	malloc := wazerotest.NewFunction(func(ctx context.Context, mod api.Module, size uint32) uint32 {
+		return 0
+	})
+	malloc.FunctionName = "malloc"
+	module := wazerotest.NewModule(nil, malloc)
+	def := module.Function(0).Definition()
+	lstn := mem.NewFunctionListener(def)
+	stack := []experimental.StackFrame{{Function: module.Function(0)}}
+
+	alloc := func(size uint64) {
+		ctx := context.Background()
+		lstn.Before(ctx, module, def, []uint64{size}, experimental.NewStackIterator(stack...))
+		lstn.After(ctx, module, def, []uint64{0x1000})
+	}
+
+	pusher := New(Config{
+		ServerAddress:   server.URL,
+		ApplicationName: "app",
+		Labels:          map[string]string{"region": "us", "env": "prod"},
+		AuthToken:       "secret",
+	}, p.CPUProfiler(), mem)
+
+	alloc(10)
+	alloc(10)
+	if err := pusher.Push(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	alloc(32)
+	if err := pusher.Push(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	names := []string{
+		"app.cpu{env=prod,region=us}",
+		"app.memory{env=prod,region=us}",
+		"app.cpu{env=prod,region=us}",
+		"app.memory{env=prod,region=us}",
+	}
+	if len(ingests) != len(names) {
+		t.Fatalf("wrong number of ingested profiles: want %d, got %d", len(names), len(ingests))
+	}
+	for i, name := range names {
+		if ingests[i].name != name {
+			t.Errorf("wrong name of profile %d: want %q, got %q", i, name, ingests[i].name)
+		}
+	}
+
+	// The second memory profile only has the allocations made after the first
+	// push.
+	for i, want := range [][]int64{{2, 20}, {1, 32}} {
+		prof := ingests[2*i+1].prof
+		if len(prof.Sample) != 1 {
+			t.Fatalf("wrong number of samples in memory profile %d: %d", i, len(prof.Sample))
+		}
+		if v := prof.Sample[0].Value; v[0] != want[0] || v[1] != want[1] {
+			t.Errorf("wrong values in memory profile %d: want %v, got %v", i, want, v)
+		}
+	}
+}
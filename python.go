@@ -4,13 +4,16 @@ import (
 	"debug/dwarf"
 	"encoding/binary"
 	"fmt"
+	"log"
 	"path/filepath"
 	"strings"
 	"unsafe"
 
+	"github.com/google/pprof/profile"
 	"github.com/tetratelabs/wazero"
 	"github.com/tetratelabs/wazero/api"
 	"github.com/tetratelabs/wazero/experimental"
+	"golang.org/x/exp/slices"
 )
 
 const (
@@ -51,6 +54,10 @@ func supportedPython(wasmbin []byte) bool {
 		versionhex = binary.LittleEndian.Uint32(seg[offset:])
 		break
 	}
+	if err := d.Err(); err != nil {
+		log.Printf("wasm: %s", err)
+		return false
+	}
 
 	// see cpython patchlevel.h
 	major := (versionhex >> 24) & 0xFF
@@ -168,7 +175,7 @@ func (p *python) Locations(fn experimental.InternalFunction, pc experimental.Pro
 }
 
 func (p *python) Stackiter(mod api.Module, def api.FunctionDefinition, wasmsi experimental.StackIterator) experimental.StackIterator {
-	m := mod.Memory()
+	m := wasmMemory{mod.Memory()}
 	tsp := deref[ptr32](m, p.pyrtaddr+padTstateCurrentInRT)
 	cframep := deref[ptr32](m, tsp+padCframeInThreadState)
 	framep := deref[ptr32](m, cframep+padCurrentFrameInCFrame)
@@ -182,7 +189,7 @@ func (p *python) Stackiter(mod api.Module, def api.FunctionDefinition, wasmsi ex
 
 type pystackiter struct {
 	namedbg string
-	mem     api.Memory
+	mem     vmem
 	started bool
 	framep  ptr32 // _PyInterpreterFrame*
 }
@@ -219,6 +226,64 @@ func (p *pystackiter) Function() experimental.InternalFunction {
 	}
 }
 
+// Label attached to the samples of Python profiles, set to "import" when the
+// sample was recorded while importing a module and to "run" otherwise. Cold
+// start of Python programs is often dominated by imports. The label is set on
+// the profiles built in memory as well as the ones written as they are
+// symbolized (e.g. by StopProfileTo).
+const pythonPhaseLabel = "phase"
+
+// Prefix of the functions of the import machinery, which is implemented in the
+// importlib._bootstrap and importlib._bootstrap_external frozen modules.
+const pythonImportPrefix = "importlib._bootstrap"
+
+// labelPythonPhases sets the phase label of the samples of a profile.
+func labelPythonPhases(prof *profile.Profile) {
+	for _, sample := range prof.Sample {
+		phase := "run"
+		if pythonImportSample(sample) {
+			phase = "import"
+		}
+		if sample.Label == nil {
+			sample.Label = make(map[string][]string)
+		}
+		sample.Label[pythonPhaseLabel] = []string{phase}
+	}
+}
+
+func pythonImportSample(sample *profile.Sample) bool {
+	for _, loc := range sample.Location {
+		if pythonImportLocation(loc) {
+			return true
+		}
+	}
+	return false
+}
+
+func pythonImportLocation(loc *profile.Location) bool {
+	for _, line := range loc.Line {
+		if line.Function != nil && strings.HasPrefix(line.Function.Name, pythonImportPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// PythonImportProfile returns a copy of a profile of a Python guest, keeping
+// only the samples recorded while importing modules. The returned profile has
+// no samples if the profile is not from a Python guest.
+func PythonImportProfile(prof *profile.Profile) *profile.Profile {
+	imports := prof.Copy()
+	samples := imports.Sample[:0]
+	for _, sample := range imports.Sample {
+		if slices.Equal(sample.Label[pythonPhaseLabel], []string{"import"}) {
+			samples = append(samples, sample)
+		}
+	}
+	imports.Sample = samples
+	return imports.Compact()
+}
+
 func functionName(path, function string) string {
 	mod := ""
 	const frozenPrefix = "<frozen "
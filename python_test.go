@@ -0,0 +1,94 @@
+package wzprof
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/google/pprof/profile"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+	"github.com/tetratelabs/wazero/experimental/wazerotest"
+	"golang.org/x/exp/slices"
+)
+
+func TestPythonImportProfile(t *testing.T) {
+	main := &profile.Function{ID: 1, Name: "app"}
+	load := &profile.Function{ID: 2, Name: "importlib._bootstrap._find_and_load"}
+	work := &profile.Function{ID: 3, Name: "app.work"}
+
+	mainLoc := &profile.Location{ID: 1, Line: []profile.Line{{Function: main}}}
+	loadLoc := &profile.Location{ID: 2, Line: []profile.Line{{Function: load}}}
+	workLoc := &profile.Location{ID: 3, Line: []profile.Line{{Function: work}}}
+
+	prof := &profile.Profile{
+		SampleType: []*profile.ValueType{{Type: "samples", Unit: "count"}},
+		Sample: []*profile.Sample{
+			{Location: []*profile.Location{workLoc, loadLoc, mainLoc}, Value: []int64{1}},
+			{Location: []*profile.Location{workLoc, mainLoc}, Value: []int64{2}},
+		},
+		Location: []*profile.Location{mainLoc, loadLoc, workLoc},
+		Function: []*profile.Function{main, load, work},
+	}
+
+	labelPythonPhases(prof)
+	if phase := prof.Sample[0].Label[pythonPhaseLabel]; len(phase) != 1 || phase[0] != "import" {
+		t.Errorf("wrong phase of import sample: %q", phase)
+	}
+	if phase := prof.Sample[1].Label[pythonPhaseLabel]; len(phase) != 1 || phase[0] != "run" {
+		t.Errorf("wrong phase of run sample: %q", phase)
+	}
+
+	imports := PythonImportProfile(prof)
+	if len(imports.Sample) != 1 || imports.Sample[0].Value[0] != 1 {
+		t.Fatalf("wrong samples in import profile: %v", imports.Sample)
+	}
+	if len(prof.Sample) != 2 {
+		t.Error("original profile was modified")
+	}
+}
+
+func TestPythonPhasesStopProfileTo(t *testing.T) {
+	load := wazerotest.NewFunction(func(context.Context, api.Module) {})
+	load.FunctionName = "importlib._bootstrap._find_and_load"
+	work := wazerotest.NewFunction(func(context.Context, api.Module) {})
+	work.FunctionName = "app.work"
+	module := wazerotest.NewModule(nil, work, load)
+
+	p := ProfilingFor(nil)
+	p.lang = python311
+	cpu := p.CPUProfiler(HostTime(true))
+	// Labeling the phases must not prevent writing the profiles as they are
+	// symbolized.
+	if !p.encodable() {
+		t.Fatal("profiles of Python guests are not encodable")
+	}
+
+	stacks := []*stackReplay{
+		newStackReplay(experimental.StackFrame{Function: module.Function(0), PC: 1}, experimental.StackFrame{Function: module.Function(1), PC: 2}),
+		newStackReplay(experimental.StackFrame{Function: module.Function(0), PC: 3}),
+	}
+	observe := func() {
+		cpu.StartProfile()
+		for i, si := range stacks {
+			cpu.counts.observe(makeStackTrace(context.Background(), stackTrace{}, si.reset()), int64(i+1))
+		}
+	}
+	observe()
+	want := roundTripProfile(t, cpu.StopProfile(1))
+	observe()
+	var b bytes.Buffer
+	if err := cpu.StopProfileTo(context.Background(), &b, 1); err != nil {
+		t.Fatal(err)
+	}
+	got, err := profile.Parse(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(canonicalSamples(got), canonicalSamples(want)) {
+		t.Errorf("encoded samples differ from the ones of the built profile:\n%q\n%q", canonicalSamples(got), canonicalSamples(want))
+	}
+	if imports := PythonImportProfile(got); len(imports.Sample) != 1 || imports.Sample[0].Value[0] != 1 {
+		t.Errorf("wrong samples in import profile: %v", imports.Sample)
+	}
+}
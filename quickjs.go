@@ -0,0 +1,273 @@
+package wzprof
+
+import (
+	"encoding/binary"
+	"strconv"
+	"unicode/utf16"
+
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+)
+
+// Function of the QuickJS interpreter executing JavaScript functions. Calls
+// between JavaScript functions recurse into it, and the JavaScript call stack
+// is maintained in a linked list of JSStackFrame structs in the runtime.
+//
+// JS_CallInternal(JSContext *caller_ctx, JSValueConst func_obj, JSValueConst this_obj, JSValueConst new_target, int argc, JSValue *argv, int flags)
+const quickjsCallEntry = "JS_CallInternal"
+
+func supportedQuickJS(wasmbin []byte) bool {
+	return wasmHasFunctionName(wasmbin, quickjsCallEntry)
+}
+
+// Padding of fields in various QuickJS structs, for the wasm32 layout of
+// quickjs 2021-03-27. On 32 bits platforms, QuickJS uses NaN-boxing so JSValue
+// is a 64 bits integer holding the tag in its upper half.
+//
+// TODO: detect the engine version and pick the matching offsets.
+const (
+	// JSGCObjectHeader.
+	padGCObjTypeInGCObjectHeader = 4
+	// JSContext.
+	padRuntimeInContext = 16
+	// JSRuntime.
+	padAtomArrayInRuntime         = 56
+	padCurrentStackFrameInRuntime = 140
+	// JSStackFrame.
+	padPrevFrameInStackFrame = 0
+	padCurFuncInStackFrame   = 8
+	padCurPCInStackFrame     = 32
+	// JSObject.
+	padClassIDInObject          = 6
+	padFunctionBytecodeInObject = 28
+	// JSFunctionBytecode.
+	padFlagsInFunctionBytecode       = 18
+	padByteCodeBufInFunctionBytecode = 20
+	padFuncNameInFunctionBytecode    = 28
+	padFilenameInFunctionBytecode    = 64
+	padLineNumInFunctionBytecode     = 68
+	padPC2LineLenInFunctionBytecode  = 76
+	padPC2LineBufInFunctionBytecode  = 80
+	// JSString.
+	padLenInString = 4
+	padStrInString = 16
+	// Constants.
+	quickjsGCObjTypeContext      = 5
+	quickjsTagObject             = -1
+	quickjsClassBytecodeFunction = 13
+	quickjsFlagHasDebug          = 1 << 2
+	quickjsAtomTagInt            = 1 << 31
+	quickjsPC2LineBase           = -1
+	quickjsPC2LineRange          = 5
+	quickjsPC2LineOpFirst        = 1
+)
+
+// Maximum number of frames walked by jsstackiter, which stops the walk of a
+// corrupted chain of frames looping back on itself. It is far above the depth
+// of the stacks QuickJS allows with its default stack size limit.
+const quickjsMaxStackDepth = 1 << 16
+
+type quickjsSupport struct{}
+
+func (q *quickjsSupport) Locations(fn experimental.InternalFunction, pc experimental.ProgramCounter) (uint64, []location) {
+	call := fn.(jsfuncall)
+
+	loc := location{
+		File:       call.file,
+		Line:       int64(call.line),
+		HumanName:  call.name,
+		StableName: call.file + ":" + call.name,
+	}
+
+	return uint64(call.addr), []location{loc}
+}
+
+func (q *quickjsSupport) Stackiter(mod api.Module, def api.FunctionDefinition, wasmsi experimental.StackIterator) experimental.StackIterator {
+	if def.Name() != quickjsCallEntry || !wasmsi.Next() {
+		// Calls to native functions (e.g. malloc) are not attributed to
+		// JavaScript frames.
+		return wasmsi
+	}
+
+	params := wasmsi.Parameters()
+	ctx := ptr32(api.DecodeU32(params[0]))
+	if !quickjsValidContext(mod.Memory(), ctx) {
+		// The engine does not have the layout of quickjs 2021-03-27, the
+		// frames read with the offsets above would be garbage.
+		return &resumedStackIterator{StackIterator: wasmsi}
+	}
+
+	m := wasmMemory{mod.Memory()}
+	rt := deref[ptr32](m, ctx+padRuntimeInContext)
+
+	return &jsstackiter{
+		mem:   m,
+		rt:    rt,
+		fn:    params[1],
+		frame: deref[ptr32](m, rt+padCurrentStackFrameInRuntime),
+	}
+}
+
+// quickjsValidContext returns true if the JSContext at ctx is tagged as one in
+// its GC header, and if its runtime has an array of atoms to read the names of
+// functions from.
+func quickjsValidContext(mem api.Memory, ctx ptr32) bool {
+	typ, ok := mem.ReadByte(uint32(ctx + padGCObjTypeInGCObjectHeader))
+	if !ok || typ&0xf != quickjsGCObjTypeContext {
+		return false
+	}
+	rt, ok := mem.ReadUint32Le(uint32(ctx + padRuntimeInContext))
+	if !ok || rt == 0 {
+		return false
+	}
+	atoms, ok := mem.ReadUint32Le(rt + padAtomArrayInRuntime)
+	if !ok || atoms == 0 {
+		return false
+	}
+	_, ok = mem.ReadUint32Le(rt + padCurrentStackFrameInRuntime)
+	return ok
+}
+
+// jsstackiter walks the JavaScript call stack. The first frame is the function
+// being called, which does not have a stack frame yet, followed by the frames
+// of its callers.
+type jsstackiter struct {
+	mem     vmem
+	rt      ptr32  // JSRuntime*
+	fn      uint64 // JSValue of the current function
+	pc      ptr32
+	started bool
+	leaf    bool
+	depth   int
+	frame   ptr32 // JSStackFrame* of the caller
+}
+
+func (j *jsstackiter) Next() bool {
+	if !j.started {
+		// The function being called has not started executing, use the
+		// address of the function object as program counter so calls to
+		// different functions are recorded in different stacks.
+		j.started = true
+		j.leaf = true
+		j.pc = ptr32(uint32(j.fn))
+		return true
+	}
+	if j.frame == 0 || j.depth == quickjsMaxStackDepth {
+		return false
+	}
+	j.leaf = false
+	j.depth++
+	j.fn = deref[uint64](j.mem, j.frame+padCurFuncInStackFrame)
+	j.pc = deref[ptr32](j.mem, j.frame+padCurPCInStackFrame)
+	j.frame = deref[ptr32](j.mem, j.frame+padPrevFrameInStackFrame)
+	return true
+}
+
+func (j *jsstackiter) ProgramCounter() experimental.ProgramCounter {
+	return experimental.ProgramCounter(j.pc)
+}
+
+func (j *jsstackiter) Function() experimental.InternalFunction {
+	call := jsfuncall{interpretedFunction: interpretedFunction{lang: "quickjs", name: "<native>"}}
+
+	if int32(j.fn>>32) != quickjsTagObject {
+		return call
+	}
+	obj := ptr32(uint32(j.fn))
+	if deref[uint16](j.mem, obj+padClassIDInObject) != quickjsClassBytecodeFunction {
+		return call
+	}
+
+	b := deref[ptr32](j.mem, obj+padFunctionBytecodeInObject)
+	call.addr = uint32(b)
+	call.name = quickjsAtom(j.mem, j.rt, deref[uint32](j.mem, b+padFuncNameInFunctionBytecode))
+	if call.name == "" {
+		call.name = "<anonymous>"
+	}
+
+	if deref[uint8](j.mem, b+padFlagsInFunctionBytecode)&quickjsFlagHasDebug == 0 {
+		return call
+	}
+
+	call.file = quickjsAtom(j.mem, j.rt, deref[uint32](j.mem, b+padFilenameInFunctionBytecode))
+	call.line = deref[int32](j.mem, b+padLineNumInFunctionBytecode)
+
+	pc2lineLen := deref[uint32](j.mem, b+padPC2LineLenInFunctionBytecode)
+	pc2lineBuf := deref[ptr32](j.mem, b+padPC2LineBufInFunctionBytecode)
+	if !j.leaf && pc2lineBuf != 0 {
+		bytecode := deref[ptr32](j.mem, b+padByteCodeBufInFunctionBytecode)
+		pc2line := derefArray[byte](j.mem, pc2lineBuf, pc2lineLen)
+		call.line = quickjsLineNumber(pc2line, call.line, uint32(j.pc-bytecode))
+	}
+	return call
+}
+
+func (j *jsstackiter) Parameters() []uint64 {
+	return nil
+}
+
+// quickjsAtom returns the string representation of an atom. It is a
+// re-implementation of JS_AtomGetStrRT.
+func quickjsAtom(m vmem, rt ptr32, atom uint32) string {
+	if atom&quickjsAtomTagInt != 0 {
+		return strconv.FormatUint(uint64(atom&^quickjsAtomTagInt), 10)
+	}
+	atoms := deref[ptr32](m, rt+padAtomArrayInRuntime)
+	str := derefArrayIndex[ptr32](m, atoms, int32(atom))
+	if str == 0 {
+		return ""
+	}
+	header := deref[uint32](m, str+padLenInString)
+	length := header &^ (1 << 31)
+	if header&(1<<31) == 0 {
+		return string(derefArray[byte](m, str+padStrInString, length))
+	}
+	return string(utf16.Decode(derefArray[uint16](m, str+padStrInString, length)))
+}
+
+// quickjsLineNumber decodes the pc2line table of a function to find the line
+// of the instruction at the given offset of the bytecode. It is a
+// re-implementation of find_line_num.
+func quickjsLineNumber(pc2line []byte, line int32, pc uint32) int32 {
+	offset := uint32(0)
+	for len(pc2line) > 0 {
+		var next int32
+		op := pc2line[0]
+		pc2line = pc2line[1:]
+		if op == 0 {
+			delta, n := binary.Uvarint(pc2line)
+			if n <= 0 {
+				return line
+			}
+			pc2line = pc2line[n:]
+			v, n := binary.Uvarint(pc2line)
+			if n <= 0 {
+				return line
+			}
+			pc2line = pc2line[n:]
+			offset += uint32(delta)
+			next = line + int32(-(v&1)^(v>>1))
+		} else {
+			op -= quickjsPC2LineOpFirst
+			offset += uint32(op / quickjsPC2LineRange)
+			next = line + int32(op%quickjsPC2LineRange) + quickjsPC2LineBase
+		}
+		if pc < offset {
+			return line
+		}
+		line = next
+	}
+	return line
+}
+
+// jsfuncall represents a call to a JavaScript function executed by the QuickJS
+// interpreter.
+type jsfuncall struct {
+	interpretedFunction
+	file string
+	line int32
+}
+
+func (f jsfuncall) Definition() api.FunctionDefinition {
+	return f
+}
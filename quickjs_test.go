@@ -0,0 +1,192 @@
+package wzprof
+
+import (
+	"context"
+	"testing"
+
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+	"github.com/tetratelabs/wazero/experimental/wazerotest"
+)
+
+// quickjsRuntime writes a JSContext and its JSRuntime, with an array of atoms
+// holding the given strings, and returns the address of the context.
+func (m *testMemory) quickjsRuntime(atoms ...string) (ctx, rt uint32) {
+	array := m.alloc(uint32(len(atoms)) * 4)
+	for i, atom := range atoms {
+		str := m.alloc(padStrInString + uint32(len(atom)))
+		m.mem.WriteUint32Le(str+padLenInString, uint32(len(atom)))
+		m.mem.WriteString(str+padStrInString, atom)
+		m.mem.WriteUint32Le(array+uint32(i)*4, str)
+	}
+	rt = m.alloc(256)
+	m.mem.WriteUint32Le(rt+padAtomArrayInRuntime, array)
+	ctx = m.alloc(64)
+	m.mem.WriteByte(ctx+padGCObjTypeInGCObjectHeader, quickjsGCObjTypeContext)
+	m.mem.WriteUint32Le(ctx+padRuntimeInContext, rt)
+	return ctx, rt
+}
+
+// quickjsFunction writes a bytecode function object named by the atom name,
+// declared at line of the file atom, and returns its JSValue and the address
+// of its bytecode.
+func (m *testMemory) quickjsFunction(name, file uint32, line int32, pc2line []byte) (fn uint64, bytecode uint32) {
+	bytecode = m.alloc(64)
+	b := m.alloc(96)
+	m.mem.WriteByte(b+padFlagsInFunctionBytecode, quickjsFlagHasDebug)
+	m.mem.WriteUint32Le(b+padByteCodeBufInFunctionBytecode, bytecode)
+	m.mem.WriteUint32Le(b+padFuncNameInFunctionBytecode, name)
+	m.mem.WriteUint32Le(b+padFilenameInFunctionBytecode, file)
+	m.mem.WriteUint32Le(b+padLineNumInFunctionBytecode, uint32(line))
+	if len(pc2line) > 0 {
+		buf := m.alloc(uint32(len(pc2line)))
+		m.mem.Write(buf, pc2line)
+		m.mem.WriteUint32Le(b+padPC2LineLenInFunctionBytecode, uint32(len(pc2line)))
+		m.mem.WriteUint32Le(b+padPC2LineBufInFunctionBytecode, buf)
+	}
+	obj := m.alloc(32)
+	m.mem.WriteUint16Le(obj+padClassIDInObject, quickjsClassBytecodeFunction)
+	m.mem.WriteUint32Le(obj+padFunctionBytecodeInObject, b)
+	tag := int32(quickjsTagObject)
+	return uint64(uint32(tag))<<32 | uint64(obj), bytecode
+}
+
+// quickjsFrame writes a JSStackFrame executing fn at pc, called by prev.
+func (m *testMemory) quickjsFrame(prev uint32, fn uint64, pc uint32) uint32 {
+	frame := m.alloc(48)
+	m.mem.WriteUint32Le(frame+padPrevFrameInStackFrame, prev)
+	m.mem.WriteUint64Le(frame+padCurFuncInStackFrame, fn)
+	m.mem.WriteUint32Le(frame+padCurPCInStackFrame, pc)
+	return frame
+}
+
+func quickjsCallInternal() *wazerotest.Function {
+	f := wazerotest.NewFunction(func(ctx context.Context, mod api.Module, jsctx uint32, fn, this, newTarget uint64, argc, argv, flags uint32) {
+	})
+	f.FunctionName = quickjsCallEntry
+	return f
+}
+
+func TestQuickJSLineNumber(t *testing.T) {
+	// Encoding of pc2line entries, see emit_pc2line in quickjs.c:
+	//
+	//	pc=0  line=10 (function start)
+	//	pc=3  line=11 (short: op = 1 + 3*5 + (1 - -1))
+	//	pc=8  line=14 (short: op = 1 + 5*5 + (3 - -1))
+	//	pc=108 line=4 (long: 0, uleb128(100), zigzag(-10))
+	pc2line := []byte{
+		1 + 3*5 + 2,
+		1 + 5*5 + 4,
+		0, 100, 19,
+	}
+
+	tests := []struct {
+		pc   uint32
+		line int32
+	}{
+		{pc: 0, line: 10},
+		{pc: 2, line: 10},
+		{pc: 3, line: 11},
+		{pc: 7, line: 11},
+		{pc: 8, line: 14},
+		{pc: 107, line: 14},
+		{pc: 108, line: 4},
+		{pc: 200, line: 4},
+	}
+
+	for _, test := range tests {
+		if line := quickjsLineNumber(pc2line, 10, test.pc); line != test.line {
+			t.Errorf("pc=%d: want line %d, got %d", test.pc, test.line, line)
+		}
+	}
+}
+
+func TestQuickJSStackIterator(t *testing.T) {
+	call := quickjsCallInternal()
+	module := wazerotest.NewModule(wazerotest.NewFixedMemory(wazerotest.PageSize), call)
+
+	m := &testMemory{mem: module.Memory(), next: 8}
+	ctx, rt := m.quickjsRuntime("app.js", "main", "helper")
+	helper, _ := m.quickjsFunction(2, 0, 20, nil)
+	// pc=3 line=12 (short: op = 1 + 3*5 + (2 - -1))
+	main, bytecode := m.quickjsFunction(1, 0, 10, []byte{1 + 3*5 + 3})
+	// The caller of main is a native function, the value of a C function
+	// object is not a bytecode function.
+	outer := m.quickjsFrame(0, 0, 0)
+	m.mem.WriteUint32Le(rt+padCurrentStackFrameInRuntime, m.quickjsFrame(outer, main, bytecode+5))
+
+	q := &quickjsSupport{}
+	si := q.Stackiter(module, call.Definition(), experimental.NewStackIterator(
+		experimental.StackFrame{Function: call, Params: []uint64{uint64(ctx), helper, 0, 0, 0, 0, 0}},
+	))
+
+	want := []location{
+		{File: "app.js", Line: 20, HumanName: "helper", StableName: "app.js:helper"},
+		{File: "app.js", Line: 12, HumanName: "main", StableName: "app.js:main"},
+		{HumanName: "<native>", StableName: ":<native>"},
+	}
+	var got []location
+	for si.Next() {
+		if params := si.Parameters(); params != nil {
+			t.Errorf("parameters of a JavaScript frame: %v", params)
+		}
+		_, locs := q.Locations(si.Function(), si.ProgramCounter())
+		got = append(got, locs...)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("wrong locations: want %+v, got %+v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("frame %d: want %+v, got %+v", i, want[i], got[i])
+		}
+	}
+}
+
+func TestQuickJSStackIteratorLayoutMismatch(t *testing.T) {
+	call := quickjsCallInternal()
+	module := wazerotest.NewModule(wazerotest.NewFixedMemory(wazerotest.PageSize), call)
+
+	// The GC header of the context does not have the type of a JSContext, as
+	// read at the offsets of quickjs 2021-03-27 in the structs of another
+	// version of the engine.
+	m := &testMemory{mem: module.Memory(), next: 8}
+	ctx, _ := m.quickjsRuntime("main")
+	m.mem.WriteByte(ctx+padGCObjTypeInGCObjectHeader, 0)
+
+	q := &quickjsSupport{}
+	si := q.Stackiter(module, call.Definition(), experimental.NewStackIterator(
+		experimental.StackFrame{Function: call, Params: []uint64{uint64(ctx), 0, 0, 0, 0, 0, 0}},
+	))
+	var names []string
+	for si.Next() {
+		names = append(names, si.Function().Definition().Name())
+	}
+	if len(names) != 1 || names[0] != quickjsCallEntry {
+		t.Errorf("wasm frames not reported: %q", names)
+	}
+}
+
+func TestQuickJSStackIteratorCycle(t *testing.T) {
+	call := quickjsCallInternal()
+	module := wazerotest.NewModule(wazerotest.NewFixedMemory(wazerotest.PageSize), call)
+
+	// A corrupted frame which is its own caller.
+	m := &testMemory{mem: module.Memory(), next: 8}
+	ctx, rt := m.quickjsRuntime("main")
+	frame := m.quickjsFrame(0, 0, 0)
+	m.mem.WriteUint32Le(frame+padPrevFrameInStackFrame, frame)
+	m.mem.WriteUint32Le(rt+padCurrentStackFrameInRuntime, frame)
+
+	q := &quickjsSupport{}
+	si := q.Stackiter(module, call.Definition(), experimental.NewStackIterator(
+		experimental.StackFrame{Function: call, Params: []uint64{uint64(ctx), 0, 0, 0, 0, 0, 0}},
+	))
+	n := 0
+	for si.Next() {
+		n++
+	}
+	if n != quickjsMaxStackDepth+1 {
+		t.Errorf("wrong number of frames: want %d, got %d", quickjsMaxStackDepth+1, n)
+	}
+}
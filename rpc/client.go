@@ -0,0 +1,90 @@
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/google/pprof/profile"
+)
+
+// Client calls the procedures of the ProfilerService of a host.
+type Client struct {
+	// Address of the host, e.g. "http://localhost:8080".
+	URL string
+	// Client used to send the requests. Default to http.DefaultClient.
+	Client *http.Client
+}
+
+// StartCPUProfile starts recording the CPU profile of the host.
+func (c *Client) StartCPUProfile(ctx context.Context) error {
+	return c.call(ctx, "StartCPUProfile", &StartCPUProfileRequest{}, &StartCPUProfileResponse{})
+}
+
+// StopCPUProfile stops recording the CPU profile of the host and returns it.
+func (c *Client) StopCPUProfile(ctx context.Context) (*profile.Profile, error) {
+	var res StopCPUProfileResponse
+	if err := c.call(ctx, "StopCPUProfile", &StopCPUProfileRequest{}, &res); err != nil {
+		return nil, err
+	}
+	return profile.ParseData(res.Profile)
+}
+
+// GetHeapProfile returns a snapshot of the memory profile of the host, after
+// running the garbage collector of the guest if gc is true.
+func (c *Client) GetHeapProfile(ctx context.Context, gc bool) (*profile.Profile, error) {
+	var res GetHeapProfileResponse
+	if err := c.call(ctx, "GetHeapProfile", &GetHeapProfileRequest{GC: gc}, &res); err != nil {
+		return nil, err
+	}
+	return profile.ParseData(res.Profile)
+}
+
+// ListProfilers lists the profilers of the host.
+func (c *Client) ListProfilers(ctx context.Context) ([]Profiler, error) {
+	var res ListProfilersResponse
+	if err := c.call(ctx, "ListProfilers", &ListProfilersRequest{}, &res); err != nil {
+		return nil, err
+	}
+	return res.Profilers, nil
+}
+
+// call sends a unary request of the Connect protocol. The errors returned by
+// the host are of type *Error.
+func (c *Client) call(ctx context.Context, procedure string, req, res any) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	url := strings.TrimSuffix(c.URL, "/") + ServicePath + procedure
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("Connect-Protocol-Version", "1")
+
+	client := c.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(r)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+		var e Error
+		if json.Unmarshal(msg, &e) == nil && e.Code != "" {
+			return &e
+		}
+		return fmt.Errorf("wzprof rpc: %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return json.NewDecoder(resp.Body).Decode(res)
+}
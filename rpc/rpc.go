@@ -0,0 +1,288 @@
+// Package rpc serves the profilers of a wazero host with the wzprof.v1
+// ProfilerService, so orchestrators can collect the profiles of many hosts
+// programmatically instead of scraping the pprof http endpoints.
+//
+// The service is defined in profiler.proto, and served with the unary calls of
+// the Connect protocol using the JSON codec, which Connect clients of all
+// languages and tools like buf curl can call without generated code.
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/google/pprof/profile"
+
+	"github.com/stealthrocket/wzprof"
+)
+
+// ServicePath is the path prefix of the procedures of the service, where the
+// Server must be mounted.
+const ServicePath = "/wzprof.v1.ProfilerService/"
+
+// Config is the configuration of a Server.
+type Config struct {
+	// Sample rate configured on the profilers, used to scale the profiles.
+	// Default to 1.
+	SampleRate float64
+}
+
+// Server implements the procedures of the ProfilerService.
+type Server struct {
+	config    Config
+	cpu       *wzprof.CPUProfiler
+	mem       *wzprof.MemoryProfiler
+	profilers []wzprof.Profiler
+}
+
+// New creates a Server of the given profilers. The CPU and memory profiles are
+// served by the first CPU and memory profilers of the list.
+func New(config Config, profilers ...wzprof.Profiler) *Server {
+	if config.SampleRate <= 0 {
+		config.SampleRate = 1
+	}
+	s := &Server{config: config, profilers: profilers}
+	for _, p := range profilers {
+		switch p := p.(type) {
+		case *wzprof.CPUProfiler:
+			if s.cpu == nil {
+				s.cpu = p
+			}
+		case *wzprof.MemoryProfiler:
+			if s.mem == nil {
+				s.mem = p
+			}
+		}
+	}
+	return s
+}
+
+// StartCPUProfileRequest is the request of the StartCPUProfile procedure.
+type StartCPUProfileRequest struct{}
+
+// StartCPUProfileResponse is the response of the StartCPUProfile procedure.
+type StartCPUProfileResponse struct{}
+
+// StopCPUProfileRequest is the request of the StopCPUProfile procedure.
+type StopCPUProfileRequest struct{}
+
+// StopCPUProfileResponse is the response of the StopCPUProfile procedure.
+type StopCPUProfileResponse struct {
+	// Gzip-compressed profile in the pprof format.
+	Profile []byte `json:"profile"`
+}
+
+// GetHeapProfileRequest is the request of the GetHeapProfile procedure.
+type GetHeapProfileRequest struct {
+	// Run the garbage collector of the guest before taking the snapshot, see
+	// wzprof.GuestGC.
+	GC bool `json:"gc,omitempty"`
+}
+
+// GetHeapProfileResponse is the response of the GetHeapProfile procedure.
+type GetHeapProfileResponse struct {
+	// Gzip-compressed profile in the pprof format.
+	Profile []byte `json:"profile"`
+}
+
+// ListProfilersRequest is the request of the ListProfilers procedure.
+type ListProfilersRequest struct{}
+
+// ListProfilersResponse is the response of the ListProfilers procedure.
+type ListProfilersResponse struct {
+	Profilers []Profiler `json:"profilers"`
+}
+
+// Profiler describes a profiler of the host.
+type Profiler struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Count       int32  `json:"count,omitempty"`
+}
+
+// Error is an error of a procedure, with the code and message of the Connect
+// protocol.
+type Error struct {
+	Code    string `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+// Codes of the errors returned by the procedures, and the HTTP status of their
+// responses in the Connect protocol.
+const (
+	CodeInvalidArgument    = "invalid_argument"
+	CodeFailedPrecondition = "failed_precondition"
+	CodeUnimplemented      = "unimplemented"
+	CodeCanceled           = "canceled"
+	CodeInternal           = "internal"
+)
+
+var errorStatus = map[string]int{
+	CodeInvalidArgument:    http.StatusBadRequest,
+	CodeFailedPrecondition: http.StatusBadRequest,
+	CodeUnimplemented:      http.StatusNotImplemented,
+	CodeCanceled:           499,
+	CodeInternal:           http.StatusInternalServerError,
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	procedure, found := strings.CutPrefix(r.URL.Path, ServicePath)
+	if !found {
+		writeError(w, &Error{Code: CodeUnimplemented, Message: r.URL.Path})
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if ct := r.Header.Get("Content-Type"); ct != "application/json" && !strings.HasPrefix(ct, "application/json;") {
+		http.Error(w, "unsupported content type: "+ct, http.StatusUnsupportedMediaType)
+		return
+	}
+
+	var res any
+	var err error
+	switch procedure {
+	case "StartCPUProfile":
+		var req StartCPUProfileRequest
+		if err = decodeRequest(r, &req); err == nil {
+			res, err = s.StartCPUProfile(r.Context(), &req)
+		}
+	case "StopCPUProfile":
+		var req StopCPUProfileRequest
+		if err = decodeRequest(r, &req); err == nil {
+			res, err = s.StopCPUProfile(r.Context(), &req)
+		}
+	case "GetHeapProfile":
+		var req GetHeapProfileRequest
+		if err = decodeRequest(r, &req); err == nil {
+			res, err = s.GetHeapProfile(r.Context(), &req)
+		}
+	case "ListProfilers":
+		var req ListProfilersRequest
+		if err = decodeRequest(r, &req); err == nil {
+			res, err = s.ListProfilers(r.Context(), &req)
+		}
+	default:
+		err = &Error{Code: CodeUnimplemented, Message: "unknown procedure " + procedure}
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// StartCPUProfile starts recording the CPU profile.
+func (s *Server) StartCPUProfile(ctx context.Context, req *StartCPUProfileRequest) (*StartCPUProfileResponse, error) {
+	if s.cpu == nil {
+		return nil, &Error{Code: CodeUnimplemented, Message: "no CPU profiler"}
+	}
+	if !s.cpu.StartProfile() {
+		return nil, &Error{Code: CodeFailedPrecondition, Message: "CPU profiler already running"}
+	}
+	return &StartCPUProfileResponse{}, nil
+}
+
+// StopCPUProfile stops recording the CPU profile and returns it.
+func (s *Server) StopCPUProfile(ctx context.Context, req *StopCPUProfileRequest) (*StopCPUProfileResponse, error) {
+	if s.cpu == nil {
+		return nil, &Error{Code: CodeUnimplemented, Message: "no CPU profiler"}
+	}
+	prof, err := s.cpu.StopProfileContext(ctx, s.config.SampleRate)
+	if err != nil {
+		return nil, err
+	}
+	if prof == nil {
+		return nil, &Error{Code: CodeFailedPrecondition, Message: "CPU profiler not running"}
+	}
+	b, err := encodeProfile(prof)
+	if err != nil {
+		return nil, err
+	}
+	return &StopCPUProfileResponse{Profile: b}, nil
+}
+
+// GetHeapProfile returns a snapshot of the memory profile.
+func (s *Server) GetHeapProfile(ctx context.Context, req *GetHeapProfileRequest) (*GetHeapProfileResponse, error) {
+	if s.mem == nil {
+		return nil, &Error{Code: CodeUnimplemented, Message: "no memory profiler"}
+	}
+	if req.GC {
+		if err := s.mem.RunGuestGC(ctx); err != nil {
+			if errors.Is(err, wzprof.ErrGuestGCUnsupported) {
+				return nil, &Error{Code: CodeFailedPrecondition, Message: err.Error()}
+			}
+			return nil, err
+		}
+	}
+	prof, err := s.mem.NewProfileContext(ctx, s.config.SampleRate)
+	if err != nil {
+		return nil, err
+	}
+	b, err := encodeProfile(prof)
+	if err != nil {
+		return nil, err
+	}
+	return &GetHeapProfileResponse{Profile: b}, nil
+}
+
+// ListProfilers lists the profilers of the server.
+func (s *Server) ListProfilers(ctx context.Context, req *ListProfilersRequest) (*ListProfilersResponse, error) {
+	res := &ListProfilersResponse{Profilers: make([]Profiler, 0, len(s.profilers))}
+	for _, p := range s.profilers {
+		res.Profilers = append(res.Profilers, Profiler{
+			Name:        p.Name(),
+			Description: p.Desc(),
+			Count:       int32(p.Count()),
+		})
+	}
+	return res, nil
+}
+
+func decodeRequest(r *http.Request, req any) error {
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(body, req); err != nil {
+		return &Error{Code: CodeInvalidArgument, Message: err.Error()}
+	}
+	return nil
+}
+
+func encodeProfile(prof *profile.Profile) ([]byte, error) {
+	var b bytes.Buffer
+	if err := prof.Write(&b); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	var e *Error
+	if !errors.As(err, &e) {
+		code := CodeInternal
+		if errors.Is(err, context.Canceled) {
+			code = CodeCanceled
+		}
+		e = &Error{Code: code, Message: err.Error()}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(errorStatus[e.Code])
+	json.NewEncoder(w).Encode(e)
+}
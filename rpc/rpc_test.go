@@ -0,0 +1,79 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stealthrocket/wzprof"
+)
+
+func TestServer(t *testing.T) {
+	ctx := context.Background()
+	p := wzprof.ProfilingFor(nil)
+	cpu := p.CPUProfiler()
+	mem := p.MemoryProfiler()
+
+	mux := http.NewServeMux()
+	mux.Handle(ServicePath, New(Config{}, cpu, mem))
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	c := &Client{URL: srv.URL}
+
+	profilers, err := c.ListProfilers(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(profilers) != 2 || profilers[0].Name != cpu.Name() || profilers[1].Name != mem.Name() {
+		t.Errorf("wrong profilers: %+v", profilers)
+	}
+
+	if _, err := c.StopCPUProfile(ctx); !isCode(err, CodeFailedPrecondition) {
+		t.Errorf("stopping a CPU profile which is not running: %v", err)
+	}
+	if err := c.StartCPUProfile(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.StartCPUProfile(ctx); !isCode(err, CodeFailedPrecondition) {
+		t.Errorf("starting a CPU profile already running: %v", err)
+	}
+	prof, err := c.StopCPUProfile(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(prof.SampleType) == 0 || prof.SampleType[len(prof.SampleType)-1].Type != "cpu" {
+		t.Errorf("wrong CPU profile sample types: %v", prof.SampleType)
+	}
+
+	prof, err = c.GetHeapProfile(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(prof.SampleType) == 0 || prof.SampleType[0].Type != "alloc_objects" {
+		t.Errorf("wrong memory profile sample types: %v", prof.SampleType)
+	}
+	if _, err := c.GetHeapProfile(ctx, true); !isCode(err, CodeFailedPrecondition) {
+		t.Errorf("running the guest GC without GuestGC: %v", err)
+	}
+
+	if err := c.call(ctx, "Nope", struct{}{}, &struct{}{}); !isCode(err, CodeUnimplemented) {
+		t.Errorf("calling an unknown procedure: %v", err)
+	}
+
+	res, err := http.Post(srv.URL+ServicePath+"ListProfilers", "application/json", strings.NewReader("{"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("wrong status for an invalid request: %d", res.StatusCode)
+	}
+}
+
+func isCode(err error, code string) bool {
+	var e *Error
+	return errors.As(err, &e) && e.Code == code
+}
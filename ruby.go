@@ -0,0 +1,248 @@
+package wzprof
+
+import (
+	"math/bits"
+
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+)
+
+// Entry point of the CRuby VM. Ruby methods are not compiled to wasm, the
+// instruction sequences are executed by this function, which keeps track of
+// the Ruby call stack in the control frames of the execution context.
+//
+// rb_vm_exec(rb_execution_context_t *ec, bool jit_enable_p)
+const rubyVMEntry = "rb_vm_exec"
+
+func supportedRuby(wasmbin []byte) bool {
+	return wasmHasFunctionName(wasmbin, rubyVMEntry)
+}
+
+// Padding of fields in various CRuby structs, for the wasm32 layout of
+// ruby 3.2 and 3.3.
+//
+// TODO: detect the runtime version and pick the matching offsets.
+const (
+	// rb_execution_context_t.
+	padVMStackInEC     = 0
+	padVMStackSizeInEC = 4
+	padCfpInEC         = 8
+	// rb_control_frame_t.
+	padPCInControlFrame   = 0
+	padIseqInControlFrame = 8
+	sizeControlFrame      = 28
+	sizeValue             = 4
+	// rb_iseq_t.
+	padBodyInIseq = 8
+	// rb_iseq_constant_body.
+	padIseqEncodedInIseqBody    = 8
+	padPathobjInIseqBody        = 92
+	padLabelInIseqBody          = 100
+	padFirstLinenoInIseqBody    = 104
+	padInsnsInfoBodyInIseqBody  = 128
+	padInsnsInfoSizeInIseqBody  = 136
+	padSuccIndexTableInIseqBody = 140
+	// iseq_insn_info_entry.
+	sizeInsnInfoEntry = 12
+	// succ_index_table and succ_dict_block.
+	padSuccPartInSuccIndexTable  = 48
+	sizeSuccDictBlock            = 80
+	padSmallRanksInSuccDictBlock = 8
+	padBitsInSuccDictBlock       = 16
+	// RBasic.
+	padFlagsInRBasic = 0
+	// RString.
+	padLenInRString = 8
+	padPtrInRString = 12
+	padAryInRString = 12
+	// RArray.
+	padPtrInRArray = 16
+	padAryInRArray = 8
+	// Flags.
+	rubyTypeMask    = 0x1f
+	rubyTypeString  = 0x05
+	rubyTypeArray   = 0x07
+	rubyFlagNoEmbed = 1 << 13
+)
+
+type rubySupport struct{}
+
+func (r *rubySupport) Locations(fn experimental.InternalFunction, pc experimental.ProgramCounter) (uint64, []location) {
+	call := fn.(rubycall)
+
+	loc := location{
+		File:       call.file,
+		Line:       int64(call.line),
+		HumanName:  call.name,
+		StableName: call.file + ":" + call.name,
+	}
+
+	return uint64(call.addr), []location{loc}
+}
+
+func (r *rubySupport) Stackiter(mod api.Module, def api.FunctionDefinition, wasmsi experimental.StackIterator) experimental.StackIterator {
+	if def.Name() != rubyVMEntry || !wasmsi.Next() {
+		// Calls to native functions (e.g. malloc) are not attributed to
+		// Ruby frames.
+		return wasmsi
+	}
+
+	m := wasmMemory{mod.Memory()}
+	ec := ptr32(api.DecodeU32(wasmsi.Parameters()[0]))
+	stack := deref[ptr32](m, ec+padVMStackInEC)
+	size := deref[uint32](m, ec+padVMStackSizeInEC)
+
+	return &rubystackiter{
+		mem: m,
+		cfp: deref[ptr32](m, ec+padCfpInEC),
+		end: stack + ptr32(size*sizeValue),
+	}
+}
+
+// rubystackiter walks the control frames of a Ruby execution context. The
+// frames are allocated from the end of the VM stack, so the caller of a frame
+// is found at the next higher address.
+type rubystackiter struct {
+	mem     vmem
+	started bool
+	cfp     ptr32 // rb_control_frame_t*
+	end     ptr32 // end of the control frames
+}
+
+func (r *rubystackiter) Next() bool {
+	if !r.started {
+		r.started = true
+	} else {
+		r.cfp += sizeControlFrame
+	}
+	// Skip C frames, they do not have an instruction sequence.
+	for r.cfp != 0 && r.cfp+sizeControlFrame <= r.end {
+		if deref[ptr32](r.mem, r.cfp+padIseqInControlFrame) != 0 {
+			return true
+		}
+		r.cfp += sizeControlFrame
+	}
+	return false
+}
+
+func (r *rubystackiter) ProgramCounter() experimental.ProgramCounter {
+	return experimental.ProgramCounter(deref[uint32](r.mem, r.cfp+padPCInControlFrame))
+}
+
+func (r *rubystackiter) Function() experimental.InternalFunction {
+	iseq := deref[ptr32](r.mem, r.cfp+padIseqInControlFrame)
+	body := deref[ptr32](r.mem, iseq+padBodyInIseq)
+	pc := deref[uint32](r.mem, r.cfp+padPCInControlFrame)
+	return rubycall{
+		interpretedFunction: interpretedFunction{
+			lang: "ruby",
+			name: rubyString(r.mem, deref[ptr32](r.mem, body+padLabelInIseqBody)),
+			addr: uint32(iseq),
+		},
+		file: rubyPath(r.mem, deref[ptr32](r.mem, body+padPathobjInIseqBody)),
+		line: rubyLine(r.mem, body, pc),
+	}
+}
+
+// rubyLine returns the line of the instruction executed at pc by the
+// instruction sequence body, or the line where the method is defined if the
+// instruction info table of the sequence is empty (rb_vm_get_sourceline).
+func rubyLine(m vmem, body ptr32, pc uint32) int32 {
+	line := deref[int32](m, body+padFirstLinenoInIseqBody)
+	entries := deref[ptr32](m, body+padInsnsInfoBodyInIseqBody)
+	size := deref[uint32](m, body+padInsnsInfoSizeInIseqBody)
+	if entries == 0 || size == 0 {
+		return line
+	}
+	index := uint32(1)
+	if size > 1 {
+		encoded := deref[uint32](m, body+padIseqEncodedInIseqBody)
+		table := deref[ptr32](m, body+padSuccIndexTableInIseqBody)
+		if pc < encoded || table == 0 {
+			return line
+		}
+		pos := (pc - encoded) / sizeValue
+		if pos > 0 {
+			// The pc points to the next instruction.
+			pos--
+		}
+		index = rubySuccIndexLookup(m, table, pos)
+		if index == 0 || index > size {
+			return line
+		}
+	}
+	return deref[int32](m, entries+ptr32((index-1)*sizeInsnInfoEntry))
+}
+
+// rubySuccIndexLookup returns the number of entries of the instruction info
+// table at or before the instruction at pos, from the succinct bit vector
+// which replaces the table of positions once the sequence is compiled
+// (succ_index_lookup in iseq.c).
+func rubySuccIndexLookup(m vmem, table ptr32, pos uint32) uint32 {
+	const immediateTableSize = 54
+	if pos < immediateTableSize {
+		imm := deref[uint64](m, table+ptr32(pos/9*8))
+		return uint32(imm>>(pos%9*7)) & 0x7f
+	}
+	pos -= immediateTableSize
+	block := table + padSuccPartInSuccIndexTable + ptr32(pos/512*sizeSuccDictBlock)
+	bit := pos % 512
+	small := bit / 64
+	rank := deref[uint32](m, block)
+	if small > 0 {
+		ranks := deref[uint64](m, block+padSmallRanksInSuccDictBlock)
+		rank += uint32(ranks>>((small-1)*9)) & 0x1ff
+	}
+	word := deref[uint64](m, block+padBitsInSuccDictBlock+ptr32(small*8))
+	return rank + uint32(bits.OnesCount64(word<<(63-bit%64)))
+}
+
+func (r *rubystackiter) Parameters() []uint64 {
+	return nil
+}
+
+// rubyPath returns the path of an instruction sequence, which is either a
+// string or an array of [path, realpath].
+func rubyPath(m vmem, pathobj ptr32) string {
+	if pathobj == 0 {
+		return ""
+	}
+	flags := deref[uint32](m, pathobj+padFlagsInRBasic)
+	if flags&rubyTypeMask == rubyTypeArray {
+		ary := pathobj + padAryInRArray
+		if flags&rubyFlagNoEmbed != 0 {
+			ary = deref[ptr32](m, pathobj+padPtrInRArray)
+		}
+		pathobj = deref[ptr32](m, ary)
+	}
+	return rubyString(m, pathobj)
+}
+
+// rubyString returns a copy of the bytes of a RString object. Returns an empty
+// string if the object is not a string.
+func rubyString(m vmem, str ptr32) string {
+	if str == 0 {
+		return ""
+	}
+	flags := deref[uint32](m, str+padFlagsInRBasic)
+	if flags&rubyTypeMask != rubyTypeString {
+		return ""
+	}
+	length := deref[int32](m, str+padLenInRString)
+	ptr := str + padAryInRString
+	if flags&rubyFlagNoEmbed != 0 {
+		ptr = deref[ptr32](m, str+padPtrInRString)
+	}
+	return string(derefArray[byte](m, ptr, uint32(length)))
+}
+
+// rubycall represents a call to a Ruby method executed by the CRuby VM.
+type rubycall struct {
+	interpretedFunction
+	file string
+	line int32
+}
+
+func (f rubycall) Definition() api.FunctionDefinition {
+	return f
+}
@@ -0,0 +1,173 @@
+package wzprof
+
+import (
+	"context"
+	"testing"
+
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+	"github.com/tetratelabs/wazero/experimental/wazerotest"
+)
+
+// rubyString writes an embedded RString holding s.
+func (m *testMemory) rubyString(s string) uint32 {
+	str := m.alloc(padAryInRString + uint32(len(s)) + 1)
+	m.mem.WriteUint32Le(str+padFlagsInRBasic, rubyTypeString)
+	m.mem.WriteUint32Le(str+padLenInRString, uint32(len(s)))
+	m.mem.WriteString(str+padAryInRString, s)
+	return str
+}
+
+// rubySuccIndexTable writes the succinct bit vector of the positions of the
+// entries of an instruction info table (succ_index_table_create in iseq.c).
+func (m *testMemory) rubySuccIndexTable(positions []uint32, size uint32) uint32 {
+	const immediateTableSize = 54
+	rank := func(pos uint32) (n uint64) {
+		for _, p := range positions {
+			if p <= pos {
+				n++
+			}
+		}
+		return n
+	}
+	blocks := (size + 511) / 512
+	table := m.alloc(padSuccPartInSuccIndexTable + blocks*sizeSuccDictBlock)
+	for i := uint32(0); i < immediateTableSize/9; i++ {
+		var imm uint64
+		for j := uint32(0); j < 9; j++ {
+			imm |= rank(i*9+j) << (j * 7)
+		}
+		m.mem.WriteUint64Le(table+i*8, imm)
+	}
+	for b := uint32(0); b < blocks; b++ {
+		start := immediateTableSize + b*512
+		block := table + padSuccPartInSuccIndexTable + b*sizeSuccDictBlock
+		m.mem.WriteUint32Le(block, uint32(rank(start-1)))
+		var ranks uint64
+		for k := uint32(1); k < 8; k++ {
+			ranks |= (rank(start+k*64-1) - rank(start-1)) << ((k - 1) * 9)
+		}
+		m.mem.WriteUint64Le(block+padSmallRanksInSuccDictBlock, ranks)
+		for _, p := range positions {
+			if p >= start && p < start+512 {
+				word := block + padBitsInSuccDictBlock + (p-start)/64*8
+				w, _ := m.mem.ReadUint64Le(word)
+				m.mem.WriteUint64Le(word, w|1<<((p-start)%64))
+			}
+		}
+	}
+	return table
+}
+
+// rubyIseq writes an instruction sequence of the method name defined at line
+// in file, with an entry of the instruction info table at each position.
+func (m *testMemory) rubyIseq(file, name string, line int32, positions []uint32, lines []int32) (iseq, encoded uint32) {
+	const size = 1000
+	encoded = m.alloc(size * sizeValue)
+	entries := m.alloc(uint32(len(lines)) * sizeInsnInfoEntry)
+	for i, line := range lines {
+		m.mem.WriteUint32Le(entries+uint32(i)*sizeInsnInfoEntry, uint32(line))
+	}
+	body := m.alloc(256)
+	m.mem.WriteUint32Le(body+padIseqEncodedInIseqBody, encoded)
+	m.mem.WriteUint32Le(body+padPathobjInIseqBody, m.rubyString(file))
+	m.mem.WriteUint32Le(body+padLabelInIseqBody, m.rubyString(name))
+	m.mem.WriteUint32Le(body+padFirstLinenoInIseqBody, uint32(line))
+	m.mem.WriteUint32Le(body+padInsnsInfoBodyInIseqBody, entries)
+	m.mem.WriteUint32Le(body+padInsnsInfoSizeInIseqBody, uint32(len(lines)))
+	m.mem.WriteUint32Le(body+padSuccIndexTableInIseqBody, m.rubySuccIndexTable(positions, size))
+	iseq = m.alloc(16)
+	m.mem.WriteUint32Le(iseq+padBodyInIseq, body)
+	return iseq, encoded
+}
+
+func TestRubyLineNumber(t *testing.T) {
+	m := &testMemory{mem: wazerotest.NewFixedMemory(wazerotest.PageSize), next: 8}
+	iseq, encoded := m.rubyIseq("app.rb", "run", 2,
+		[]uint32{0, 4, 60, 600},
+		[]int32{3, 4, 9, 12},
+	)
+	body, _ := m.mem.ReadUint32Le(iseq + padBodyInIseq)
+
+	tests := []struct {
+		pos  uint32 // position of the instruction executed
+		line int32
+	}{
+		{pos: 0, line: 3},
+		{pos: 3, line: 3},
+		{pos: 4, line: 4},
+		{pos: 53, line: 4},
+		{pos: 59, line: 4},
+		{pos: 60, line: 9},
+		{pos: 599, line: 9},
+		{pos: 600, line: 12},
+		{pos: 999, line: 12},
+	}
+
+	for _, test := range tests {
+		// The pc of control frames points to the next instruction.
+		pc := encoded + (test.pos+1)*sizeValue
+		if line := rubyLine(wasmMemory{m.mem}, ptr32(body), pc); line != test.line {
+			t.Errorf("pos=%d: want line %d, got %d", test.pos, test.line, line)
+		}
+	}
+}
+
+func TestRubyStackIterator(t *testing.T) {
+	vmExec := wazerotest.NewFunction(func(ctx context.Context, mod api.Module, ec, jit uint32) {})
+	vmExec.FunctionName = rubyVMEntry
+	module := wazerotest.NewModule(wazerotest.NewFixedMemory(wazerotest.PageSize), vmExec)
+
+	m := &testMemory{mem: module.Memory(), next: 8}
+	inner, innerEncoded := m.rubyIseq("lib.rb", "helper", 10, []uint32{0, 2}, []int32{11, 12})
+	outer, outerEncoded := m.rubyIseq("app.rb", "<main>", 1, []uint32{0, 5}, []int32{1, 3})
+
+	// The control frames are allocated from the end of the VM stack, the one
+	// in the middle is the frame of a C function.
+	const stackSize = 64
+	stack := m.alloc(stackSize * sizeValue)
+	end := stack + stackSize*sizeValue
+	cfp := end - 3*sizeControlFrame
+	m.mem.WriteUint32Le(cfp+padPCInControlFrame, innerEncoded+3*sizeValue)
+	m.mem.WriteUint32Le(cfp+padIseqInControlFrame, inner)
+	m.mem.WriteUint32Le(cfp+2*sizeControlFrame+padPCInControlFrame, outerEncoded+6*sizeValue)
+	m.mem.WriteUint32Le(cfp+2*sizeControlFrame+padIseqInControlFrame, outer)
+
+	ec := m.alloc(16)
+	m.mem.WriteUint32Le(ec+padVMStackInEC, stack)
+	m.mem.WriteUint32Le(ec+padVMStackSizeInEC, stackSize)
+	m.mem.WriteUint32Le(ec+padCfpInEC, cfp)
+
+	r := &rubySupport{}
+	si := r.Stackiter(module, vmExec.Definition(), experimental.NewStackIterator(
+		experimental.StackFrame{Function: vmExec, Params: []uint64{uint64(ec), 0}},
+	))
+
+	want := []location{
+		{File: "lib.rb", Line: 12, HumanName: "helper", StableName: "lib.rb:helper"},
+		{File: "app.rb", Line: 3, HumanName: "<main>", StableName: "app.rb:<main>"},
+	}
+	var got []location
+	for si.Next() {
+		// Ruby methods are not functions of the wasm module, callers of the
+		// stack iterator API get empty values instead of a panic.
+		if params := si.Parameters(); params != nil {
+			t.Errorf("parameters of a Ruby frame: %v", params)
+		}
+		def := si.Function().Definition()
+		if def.ModuleName() != "ruby" || len(def.ParamTypes()) != 0 || len(def.ExportNames()) != 0 {
+			t.Errorf("wrong definition of a Ruby method: module %q, params %v, exports %q",
+				def.ModuleName(), def.ParamTypes(), def.ExportNames())
+		}
+		_, locs := r.Locations(si.Function(), si.ProgramCounter())
+		got = append(got, locs...)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("wrong locations: want %+v, got %+v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("frame %d: want %+v, got %+v", i, want[i], got[i])
+		}
+	}
+}
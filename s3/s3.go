@@ -0,0 +1,197 @@
+// Package s3 writes the profiles of wzprof profilers to Amazon S3 or other
+// object storage services compatible with its API (MinIO, Cloudflare R2, GCS
+// interoperability mode...), so the periodic profiles of continuous profilers
+// go straight to a bucket.
+package s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/pprof/profile"
+)
+
+// Config is the configuration of a Writer.
+type Config struct {
+	// Name of the bucket where the profiles are written.
+	Bucket string
+	// Prefix of the keys of the profiles, e.g. "wzprof/app/".
+	Prefix string
+	// Region of the bucket. Default to "us-east-1".
+	Region string
+	// URL of the service, for storage services compatible with S3, e.g.
+	// "http://localhost:9000" for MinIO. The bucket is then addressed in the
+	// path of the URLs. Default to the virtual-hosted URLs of Amazon S3.
+	Endpoint string
+	// Credentials signing the requests. The requests are not signed if
+	// AccessKeyID is empty.
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	// Client used to send the requests. Default to http.DefaultClient.
+	Client *http.Client
+}
+
+// Writer writes profiles to the objects of a bucket. It implements the
+// wzprof.ProfileWriter interface, and is usually wrapped by wzprof.WriterSink
+// to receive the profiles of a continuous profiler.
+type Writer struct {
+	config Config
+	now    func() time.Time
+}
+
+// New creates a Writer of profiles to the bucket of config.
+func New(config Config) *Writer {
+	if config.Region == "" {
+		config.Region = "us-east-1"
+	}
+	if config.Client == nil {
+		config.Client = http.DefaultClient
+	}
+	return &Writer{config: config, now: time.Now}
+}
+
+// Write uploads prof to the object named by the prefix of the writer followed
+// by name, in the gzip-compressed pprof format.
+func (w *Writer) Write(ctx context.Context, name string, prof *profile.Profile) error {
+	var body bytes.Buffer
+	if err := prof.Write(&body); err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, w.objectURL(w.config.Prefix+name), bytes.NewReader(body.Bytes()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	w.sign(req, body.Bytes())
+
+	res, err := w.config.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("s3: writing %s: %s: %s", name, res.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+func (w *Writer) objectURL(key string) string {
+	path := "/" + uriEncode(key, false)
+	if w.config.Endpoint == "" {
+		return "https://" + w.config.Bucket + ".s3." + w.config.Region + ".amazonaws.com" + path
+	}
+	return strings.TrimSuffix(w.config.Endpoint, "/") + "/" + uriEncode(w.config.Bucket, true) + path
+}
+
+// sign adds the headers of the AWS signature version 4 to req.
+//
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html
+func (w *Writer) sign(req *http.Request, payload []byte) {
+	if w.config.AccessKeyID == "" {
+		return
+	}
+	now := w.now().UTC()
+	payloadHash := sha256Hex(payload)
+	req.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if w.config.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", w.config.SessionToken)
+	}
+	signature(req, payloadHash, now, w.config.Region, w.config.AccessKeyID, w.config.SecretAccessKey)
+}
+
+// signature computes the signature of req and sets its Authorization header.
+// All the headers of the request are signed.
+func signature(req *http.Request, payloadHash string, now time.Time, region, accessKeyID, secretAccessKey string) {
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var canonical strings.Builder
+	canonical.WriteString(req.Method + "\n")
+	canonical.WriteString(uriEncode(req.URL.Path, false) + "\n")
+	canonical.WriteString(canonicalQuery(req.URL.Query()) + "\n")
+	for _, k := range names {
+		canonical.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+	canonical.WriteString("\n" + signedHeaders + "\n" + payloadHash)
+
+	date := now.Format("20060102")
+	scope := date + "/" + region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + now.Format("20060102T150405Z") + "\n" + scope + "\n" + sha256Hex([]byte(canonical.String()))
+
+	key := hmacSHA256([]byte("AWS4"+secretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKeyID, scope, signedHeaders, hex.EncodeToString(hmacSHA256(key, stringToSign))))
+}
+
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var params []string
+	for _, k := range keys {
+		values := append([]string(nil), query[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			params = append(params, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	return strings.Join(params, "&")
+}
+
+// uriEncode encodes s as specified by the AWS signature: all the bytes are
+// percent-encoded except the unreserved characters of RFC 3986, and slashes
+// unless encodeSlash is true.
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
@@ -2,7 +2,11 @@ package wzprof
 
 import (
 	"context"
+	"hash/fnv"
 	"math"
+	"strconv"
+	"sync/atomic"
+	"time"
 
 	"github.com/tetratelabs/wazero/api"
 	"github.com/tetratelabs/wazero/experimental"
@@ -60,37 +64,185 @@ func (s *flaggedFunctionListener) Abort(ctx context.Context, mod api.Module, def
 	}
 }
 
+// SampleOption configures the sampling of the listeners created by Sample.
+type SampleOption func(*sampleConfig)
+
+type sampleConfig struct {
+	stagger bool
+}
+
+// StaggeredSampling starts the sampling cycle of each function at a different
+// call, derived from a hash of the function. Each function is sampled once
+// every cycle either way, but without staggering the first call sampled is the
+// last of the first cycle for all of them, and the functions called fewer
+// times than the length of the cycle are never sampled. With staggering, a
+// function called n times in a cycle of length c is sampled with probability
+// n/c, which improves the coverage of cold functions at the same overhead,
+// without biasing the scaled values of the profiles.
+//
+// The phases only depend on the functions, so repeated runs of a
+// deterministic guest record the same samples.
+func StaggeredSampling() SampleOption {
+	return func(c *sampleConfig) { c.stagger = true }
+}
+
 // Sample returns a function listener factory which creates listeners where
 // calls to their Before/After methods is sampled at the given sample rate.
+// Each function has its own sampling cycle, see StaggeredSampling.
 //
 // Giving a zero or negative sampling rate disables the function listeners
 // entirely.
 //
 // Giving a sampling rate of one or more disables sampling, function listeners
 // are invoked for all function calls.
-func Sample(sampleRate float64, factory experimental.FunctionListenerFactory) experimental.FunctionListenerFactory {
+func Sample(sampleRate float64, factory experimental.FunctionListenerFactory, options ...SampleOption) experimental.FunctionListenerFactory {
 	if sampleRate <= 0 {
 		return emptyFunctionListenerFactory{}
 	}
 	if sampleRate >= 1 {
 		return factory
 	}
+	config := new(sampleConfig)
+	for _, opt := range options {
+		opt(config)
+	}
 	cycle := uint32(math.Ceil(1 / sampleRate))
 	return experimental.FunctionListenerFactoryFunc(func(def api.FunctionDefinition) experimental.FunctionListener {
 		lstn := factory.NewFunctionListener(def)
 		if lstn == nil {
 			return nil
 		}
-		sampled := &sampledFunctionListener{
+		// proc_exit is called at most once, it would never be sampled and
+		// the listeners would miss the exit of the guest.
+		if isProcExit(def) {
+			return lstn
+		}
+		count := cycle
+		if config.stagger {
+			count = samplePhase(def, cycle)
+		}
+		return &sampledFunctionListener{
 			cycle: cycle,
-			count: cycle,
+			phase: count,
+			lstn:  lstn,
+		}
+	})
+}
+
+// samplePhase returns the number of calls to def until its first sample, between
+// 1 and cycle.
+func samplePhase(def api.FunctionDefinition, cycle uint32) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(def.ModuleName()))
+	h.Write([]byte{0})
+	h.Write([]byte(def.Name()))
+	h.Write([]byte{0})
+	h.Write(strconv.AppendUint(nil, uint64(def.Index()), 10))
+	return h.Sum32()%cycle + 1
+}
+
+// DeferOption configures when the listeners created by Deferred are enabled.
+type DeferOption func(*deferredStart)
+
+// StartAfter enables the listeners once the delay has elapsed since the first
+// function call of the guest.
+func StartAfter(delay time.Duration) DeferOption {
+	return func(s *deferredStart) { s.delay = delay }
+}
+
+// StartAtFunction enables the listeners when the guest first calls the
+// function with the given name, the call is then the first one recorded.
+func StartAtFunction(name string) DeferOption {
+	return func(s *deferredStart) { s.function = name }
+}
+
+// Deferred returns a function listener factory which creates listeners that
+// are not invoked until one of the start conditions configured by the options
+// is met, so the initialization of guests (module start, interpreter boot...)
+// can be excluded from the profiles. Once enabled, the listeners remain so.
+//
+// Without options, Deferred returns factory.
+func Deferred(factory experimental.FunctionListenerFactory, options ...DeferOption) experimental.FunctionListenerFactory {
+	start := new(deferredStart)
+	for _, opt := range options {
+		opt(start)
+	}
+	if start.delay <= 0 && start.function == "" {
+		return factory
+	}
+	return experimental.FunctionListenerFactoryFunc(func(def api.FunctionDefinition) experimental.FunctionListener {
+		lstn := factory.NewFunctionListener(def)
+		// proc_exit is always observed for the same reason as with Sample.
+		if isProcExit(def) {
+			return lstn
+		}
+		// The function starting the listeners is observed even if the
+		// factory does not listen to it.
+		if lstn == nil && def.Name() != start.function {
+			return nil
+		}
+		return &deferredFunctionListener{
+			start: start,
 			lstn:  lstn,
 		}
-		sampled.stack.bits = sampled.bits[:]
-		return sampled
 	})
 }
 
+type deferredStart struct {
+	delay    time.Duration
+	function string
+	started  atomic.Bool
+	begin    atomic.Int64
+}
+
+func (s *deferredStart) check(def api.FunctionDefinition) bool {
+	if s.started.Load() {
+		return true
+	}
+	if s.function != "" && def.Name() == s.function {
+		s.started.Store(true)
+		return true
+	}
+	if s.delay > 0 {
+		now := time.Now().UnixNano()
+		s.begin.CompareAndSwap(0, now)
+		if time.Duration(now-s.begin.Load()) >= s.delay {
+			s.started.Store(true)
+			return true
+		}
+	}
+	return false
+}
+
+type deferredFunctionListener struct {
+	start   *deferredStart
+	threads threadStates[bitstackThread]
+	lstn    experimental.FunctionListener
+}
+
+func (s *deferredFunctionListener) Before(ctx context.Context, mod api.Module, def api.FunctionDefinition, params []uint64, stack experimental.StackIterator) {
+	bit := uint(0)
+
+	if s.start.check(def) && s.lstn != nil {
+		s.lstn.Before(ctx, mod, def, params, stack)
+		bit = 1
+	}
+
+	s.threads.get(mod).stack().push(bit)
+}
+
+func (s *deferredFunctionListener) After(ctx context.Context, mod api.Module, def api.FunctionDefinition, results []uint64) {
+	if s.threads.get(mod).stack().pop() != 0 {
+		s.lstn.After(ctx, mod, def, results)
+	}
+}
+
+func (s *deferredFunctionListener) Abort(ctx context.Context, mod api.Module, def api.FunctionDefinition, err error) {
+	if s.threads.get(mod).stack().pop() != 0 {
+		s.lstn.Abort(ctx, mod, def, err)
+	}
+}
+
 type emptyFunctionListenerFactory struct{}
 
 func (emptyFunctionListenerFactory) NewFunctionListener(api.FunctionDefinition) experimental.FunctionListener {
@@ -98,37 +250,57 @@ func (emptyFunctionListenerFactory) NewFunctionListener(api.FunctionDefinition)
 }
 
 type sampledFunctionListener struct {
-	count uint32
 	cycle uint32
-	bits  [1]uint64
-	stack bitstack
-	lstn  experimental.FunctionListener
+	// Number of calls until the first sample of a thread.
+	phase   uint32
+	threads threadStates[bitstackThread]
+	lstn    experimental.FunctionListener
 }
 
 func (s *sampledFunctionListener) Before(ctx context.Context, mod api.Module, def api.FunctionDefinition, params []uint64, stack experimental.StackIterator) {
 	bit := uint(0)
 
-	if s.count--; s.count == 0 {
-		s.count = s.cycle
+	// Each thread of the guest has its own sampling cycle.
+	t := s.threads.get(mod)
+	if t.calls.bits == nil {
+		t.count = s.phase
+	}
+	if t.count--; t.count == 0 {
+		t.count = s.cycle
 		s.lstn.Before(ctx, mod, def, params, stack)
 		bit = 1
 	}
 
-	s.stack.push(bit)
+	t.stack().push(bit)
 }
 
 func (s *sampledFunctionListener) After(ctx context.Context, mod api.Module, def api.FunctionDefinition, results []uint64) {
-	if s.stack.pop() != 0 {
+	if s.threads.get(mod).stack().pop() != 0 {
 		s.lstn.After(ctx, mod, def, results)
 	}
 }
 
 func (s *sampledFunctionListener) Abort(ctx context.Context, mod api.Module, def api.FunctionDefinition, err error) {
-	if s.stack.pop() != 0 {
+	if s.threads.get(mod).stack().pop() != 0 {
 		s.lstn.Abort(ctx, mod, def, err)
 	}
 }
 
+// bitstackThread records whether the calls in progress of a thread were
+// passed to the wrapped listener, see Sample and Deferred.
+type bitstackThread struct {
+	count uint32
+	calls bitstack
+	bits  [1]uint64
+}
+
+func (t *bitstackThread) stack() *bitstack {
+	if t.calls.bits == nil {
+		t.calls.bits = t.bits[:]
+	}
+	return &t.calls
+}
+
 type bitstack struct {
 	size uint
 	bits []uint64
@@ -2,7 +2,9 @@ package wzprof
 
 import (
 	"context"
+	"fmt"
 	"testing"
+	"time"
 
 	"github.com/tetratelabs/wazero/api"
 	"github.com/tetratelabs/wazero/experimental"
@@ -85,6 +87,63 @@ func TestSampledFunctionListener(t *testing.T) {
 	}
 }
 
+func TestStaggeredSampling(t *testing.T) {
+	functions := make([]*wazerotest.Function, 100)
+	for i := range functions {
+		functions[i] = wazerotest.NewFunction(func(ctx context.Context, mod api.Module) {})
+		functions[i].FunctionName = fmt.Sprintf("f%d", i)
+	}
+	module := wazerotest.NewModule(nil, functions...)
+
+	// Returns the number of functions sampled and the number of samples when
+	// each function is called the given number of times.
+	run := func(calls int, options ...SampleOption) (sampled, samples int) {
+		for i := range functions {
+			n := 0
+			f := func(context.Context, api.Module, api.FunctionDefinition, []uint64, experimental.StackIterator) { n++ }
+			factory := Sample(0.1, experimental.FunctionListenerFactoryFunc(
+				func(def api.FunctionDefinition) experimental.FunctionListener {
+					return experimental.FunctionListenerFunc(f)
+				},
+			), options...)
+
+			def := module.Function(i).Definition()
+			listener := factory.NewFunctionListener(def)
+			ctx := context.Background()
+			for j := 0; j < calls; j++ {
+				listener.Before(ctx, module, def, nil, nil)
+				listener.After(ctx, module, def, nil)
+			}
+			if n > 0 {
+				sampled++
+			}
+			samples += n
+		}
+		return sampled, samples
+	}
+
+	// Functions called fewer times than the cycle are only sampled when the
+	// cycles are staggered, about 3 out of 10.
+	if sampled, _ := run(3); sampled != 0 {
+		t.Errorf("cold functions sampled without staggering: %d", sampled)
+	}
+	sampled, _ := run(3, StaggeredSampling())
+	if sampled < 15 || sampled > 45 {
+		t.Errorf("wrong number of cold functions sampled with staggering: %d", sampled)
+	}
+	// The phases only depend on the functions.
+	if again, _ := run(3, StaggeredSampling()); again != sampled {
+		t.Errorf("staggered sampling is not deterministic: %d != %d", again, sampled)
+	}
+
+	// Hot functions are sampled once every cycle either way.
+	for _, options := range [][]SampleOption{nil, {StaggeredSampling()}} {
+		if _, samples := run(1000, options...); samples != 100*100 {
+			t.Errorf("wrong number of samples of hot functions: %d", samples)
+		}
+	}
+}
+
 func BenchmarkSampledFunctionListener(b *testing.B) {
 	benchmarkFunctionListener(b,
 		Sample(0.1, experimental.FunctionListenerFactoryFunc(
@@ -97,3 +156,80 @@ func BenchmarkSampledFunctionListener(b *testing.B) {
 		)),
 	)
 }
+
+func TestDeferredFunctionListener(t *testing.T) {
+	setup := wazerotest.NewFunction(func(ctx context.Context, mod api.Module) {})
+	setup.FunctionName = "setup"
+	work := wazerotest.NewFunction(func(ctx context.Context, mod api.Module) {})
+	work.FunctionName = "work"
+	module := wazerotest.NewModule(nil, setup, work)
+
+	n := 0
+	f := func(context.Context, api.Module, api.FunctionDefinition, []uint64, experimental.StackIterator) { n++ }
+
+	// The listened function is setup, work only starts the listeners.
+	factory := Deferred(experimental.FunctionListenerFactoryFunc(
+		func(def api.FunctionDefinition) experimental.FunctionListener {
+			if def.Name() != "setup" {
+				return nil
+			}
+			return experimental.FunctionListenerFunc(f)
+		},
+	), StartAtFunction("work"))
+
+	setupDef, workDef := module.Function(0).Definition(), module.Function(1).Definition()
+	setupListener := factory.NewFunctionListener(setupDef)
+	workListener := factory.NewFunctionListener(workDef)
+	if workListener == nil {
+		t.Fatal("no listener for the function starting the listeners")
+	}
+	ctx := context.Background()
+
+	setupListener.Before(ctx, module, setupDef, nil, nil)
+	setupListener.After(ctx, module, setupDef, nil)
+	if n != 0 {
+		t.Error("function listener called before the start function")
+	}
+
+	workListener.Before(ctx, module, workDef, nil, nil)
+	for i := 0; i < 2; i++ {
+		setupListener.Before(ctx, module, setupDef, nil, nil)
+		setupListener.After(ctx, module, setupDef, nil)
+	}
+	workListener.After(ctx, module, workDef, nil)
+	if n != 2 {
+		t.Errorf("wrong number of calls to deferred listener: want=2 got=%d", n)
+	}
+}
+
+func TestDeferredFunctionListenerDelay(t *testing.T) {
+	module := wazerotest.NewModule(nil,
+		wazerotest.NewFunction(func(ctx context.Context, mod api.Module) {}),
+	)
+
+	n := 0
+	f := func(context.Context, api.Module, api.FunctionDefinition, []uint64, experimental.StackIterator) { n++ }
+
+	factory := Deferred(experimental.FunctionListenerFactoryFunc(
+		func(def api.FunctionDefinition) experimental.FunctionListener {
+			return experimental.FunctionListenerFunc(f)
+		},
+	), StartAfter(50*time.Millisecond))
+
+	function := module.Function(0).Definition()
+	listener := factory.NewFunctionListener(function)
+	ctx := context.Background()
+
+	listener.Before(ctx, module, function, nil, nil)
+	listener.After(ctx, module, function, nil)
+	if n != 0 {
+		t.Error("function listener called before the delay elapsed")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	listener.Before(ctx, module, function, nil, nil)
+	listener.After(ctx, module, function, nil)
+	if n != 1 {
+		t.Errorf("wrong number of calls to deferred listener: want=1 got=%d", n)
+	}
+}
@@ -0,0 +1,234 @@
+package wzprof
+
+import (
+	"context"
+	"fmt"
+	"hash/maphash"
+	"sync"
+	"time"
+
+	"github.com/google/pprof/profile"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+)
+
+// Frame is a frame of a stack trace recorded by a host which does not
+// symbolize the stacks itself, e.g. when it streams them to a profiling daemon.
+// The frame is identified by the index of its function in the module, and the
+// offset of the instruction in the code section of the module.
+type Frame struct {
+	Function uint32 `json:"function"`
+	Offset   uint64 `json:"offset"`
+}
+
+// StackFrames returns the frames of the stack walked by si, starting with the
+// innermost call. The iterator must walk the stack of the wasm code, as passed
+// to function listeners by wazero.
+func StackFrames(si experimental.StackIterator) []Frame {
+	var frames []Frame
+	for si.Next() {
+		fn := si.Function()
+		frames = append(frames, Frame{
+			Function: fn.Definition().Index(),
+			Offset:   fn.SourceOffsetForPC(si.ProgramCounter()),
+		})
+	}
+	return frames
+}
+
+// SampleSet aggregates samples of stack traces recorded outside of the
+// function listeners of the profilers, and builds profiles of them. The stacks
+// are symbolized with the symbols of the module the Profiling instance was
+// created for.
+type SampleSet struct {
+	p          *Profiling
+	sampleType []*profile.ValueType
+	names      map[uint32]string
+
+	mutex   sync.Mutex
+	start   time.Time
+	samples map[uint64]*frameSample
+	funcs   map[uint32]*frameFunction
+}
+
+// NewSampleSet creates a set of samples with values of the given types.
+//
+// The Profiling instance must have been prepared for the module, see Prepare.
+func (p *Profiling) NewSampleSet(sampleType []*profile.ValueType) *SampleSet {
+	s := &SampleSet{
+		p:          p,
+		sampleType: sampleType,
+		names:      wasmFunctionNames(p.wasm),
+		start:      time.Now(),
+		samples:    make(map[uint64]*frameSample),
+		funcs:      make(map[uint32]*frameFunction),
+	}
+	p.metrics.trackStacks(func() int {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		return len(s.samples)
+	})
+	return s
+}
+
+// SampleType returns the types of the values of the samples in the set.
+func (s *SampleSet) SampleType() []*profile.ValueType {
+	return s.sampleType
+}
+
+// Add adds the values to the sample of the stack, which starts with the
+// innermost call. The number of values must match the sample types of the set.
+func (s *SampleSet) Add(stack []Frame, values []int64) error {
+	if len(values) != len(s.sampleType) {
+		return fmt.Errorf("wrong number of sample values: want %d, got %d", len(s.sampleType), len(values))
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	st := stackTrace{
+		fns: make([]experimental.InternalFunction, len(stack)),
+		pcs: make([]experimental.ProgramCounter, len(stack)),
+	}
+	for i, f := range stack {
+		st.fns[i] = s.function(f.Function)
+		st.pcs[i] = experimental.ProgramCounter(f.Offset)
+	}
+	st.key = maphash.Bytes(stackTraceHashSeed, st.bytes())
+
+	sample := s.samples[st.key]
+	if sample == nil {
+		sample = &frameSample{stack: st, value: make([]int64, len(values))}
+		s.samples[st.key] = sample
+	}
+	for i, v := range values {
+		sample.value[i] += v
+	}
+	s.p.metrics.samples.Add(1)
+	return nil
+}
+
+// function returns the function with the given index, the source offsets of
+// the frames are used as program counters.
+func (s *SampleSet) function(index uint32) *frameFunction {
+	fn := s.funcs[index]
+	if fn == nil {
+		name, ok := s.names[index]
+		if !ok {
+			name = fmt.Sprintf("wasm-function[%d]", index)
+		}
+		fn = &frameFunction{module: s.p.moduleName, index: index, name: name}
+		s.funcs[index] = fn
+	}
+	return fn
+}
+
+// Profile builds a profile of the samples added to the set.
+func (s *SampleSet) Profile(ctx context.Context) (*profile.Profile, error) {
+	s.mutex.Lock()
+	samples := make(map[uint64]*frameSample, len(s.samples))
+	for k, sample := range s.samples {
+		samples[k] = &frameSample{stack: sample.stack, value: append([]int64(nil), sample.value...)}
+	}
+	start := s.start
+	s.mutex.Unlock()
+	return s.build(ctx, samples, start)
+}
+
+// Flush builds a profile of the samples added to the set, and removes them
+// from the set, which then collects the samples of the next profile.
+func (s *SampleSet) Flush(ctx context.Context) (*profile.Profile, error) {
+	s.mutex.Lock()
+	samples, start := s.samples, s.start
+	s.samples, s.start = make(map[uint64]*frameSample), time.Now()
+	s.mutex.Unlock()
+	return s.build(ctx, samples, start)
+}
+
+func (s *SampleSet) build(ctx context.Context, samples map[uint64]*frameSample, start time.Time) (*profile.Profile, error) {
+	ratios := make([]float64, len(s.sampleType))
+	for i := range ratios {
+		ratios[i] = 1
+	}
+	return buildProfile(ctx, s.p, samples, start, 0, time.Since(start), s.sampleType, ratios, nil)
+}
+
+type frameSample struct {
+	stack stackTrace
+	value []int64
+}
+
+func (s *frameSample) sampleLocation() stackTrace {
+	return s.stack
+}
+
+func (s *frameSample) sampleValue() []int64 {
+	return s.value
+}
+
+// frameFunction implements wazero's FunctionDefinition and InternalFunction
+// for the functions of frames recorded by another host, which have no
+// counterpart in the wazero runtime.
+type frameFunction struct {
+	module string
+	index  uint32
+	name   string
+
+	api.FunctionDefinition // required for WazeroOnly
+}
+
+func (f *frameFunction) Definition() api.FunctionDefinition {
+	return f
+}
+
+// SourceOffsetForPC returns pc, since the program counters of the frames are
+// already source offsets.
+func (f *frameFunction) SourceOffsetForPC(pc experimental.ProgramCounter) uint64 {
+	return uint64(pc)
+}
+
+func (f *frameFunction) ModuleName() string {
+	return f.module
+}
+
+func (f *frameFunction) Index() uint32 {
+	return f.index
+}
+
+func (f *frameFunction) Import() (string, string, bool) {
+	return "", "", false
+}
+
+func (f *frameFunction) ExportNames() []string {
+	return nil
+}
+
+func (f *frameFunction) Name() string {
+	return f.name
+}
+
+func (f *frameFunction) DebugName() string {
+	return f.module + "." + f.name
+}
+
+func (f *frameFunction) GoFunction() interface{} {
+	return nil
+}
+
+func (f *frameFunction) ParamTypes() []api.ValueType {
+	return nil
+}
+
+func (f *frameFunction) ParamNames() []string {
+	return nil
+}
+
+func (f *frameFunction) ResultTypes() []api.ValueType {
+	return nil
+}
+
+func (f *frameFunction) ResultNames() []string {
+	return nil
+}
+
+var _ experimental.InternalFunction = (*frameFunction)(nil)
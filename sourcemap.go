@@ -0,0 +1,196 @@
+package wzprof
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/tetratelabs/wazero/experimental"
+)
+
+// Name of the custom section holding the URL of the source map of a module.
+const sourceMapURLSection = "sourceMappingURL"
+
+// wasmSourceMapURL returns the URL of the source map of the module, or an
+// empty string if the module does not reference one.
+func wasmSourceMapURL(b []byte) string {
+	s := wasmCustomSection(b, sourceMapURLSection)
+	if s == nil {
+		return ""
+	}
+	// The content of the section is a string prefixed by its length.
+	n, r := binary.Uvarint(s)
+	if r <= 0 || n > uint64(len(s)-r) {
+		return ""
+	}
+	return string(s[r : r+int(n)])
+}
+
+// sourcemap provides symbol resolution for modules shipping a source map
+// instead of DWARF debugging information, which is what compilers such as
+// AssemblyScript emit.
+//
+// In source maps of wasm modules, the generated code is a single line where
+// the column is the offset of the instruction in the module.
+type sourcemap struct {
+	// Offset of the code section in the module. Offsets given by wazero are
+	// relative to it.
+	codeOffset uint64
+	sources    []string
+	names      []string
+	mappings   []sourcemapping
+}
+
+type sourcemapping struct {
+	offset uint64
+	source int
+	line   int64
+	column int64
+	name   int // -1 if absent
+}
+
+type sourcemapJSON struct {
+	Version  int      `json:"version"`
+	Sources  []string `json:"sources"`
+	Names    []string `json:"names"`
+	Mappings string   `json:"mappings"`
+}
+
+// buildSourceMapSymbolizer parses a version 3 source map for the given wasm
+// module.
+func buildSourceMapSymbolizer(wasmbin, b []byte) (*sourcemap, error) {
+	var sm sourcemapJSON
+	if err := json.Unmarshal(b, &sm); err != nil {
+		return nil, fmt.Errorf("sourcemap: %w", err)
+	}
+	if sm.Version != 3 {
+		return nil, fmt.Errorf("sourcemap: unsupported version %d", sm.Version)
+	}
+	mappings, err := parseSourceMapMappings(sm.Mappings)
+	if err != nil {
+		return nil, err
+	}
+	return &sourcemap{
+		codeOffset: wasmCodeSectionOffset(wasmbin),
+		sources:    sm.Sources,
+		names:      sm.Names,
+		mappings:   mappings,
+	}, nil
+}
+
+// parseSourceMapMappings decodes the VLQ encoded mappings of a source map,
+// returning them sorted by offset.
+func parseSourceMapMappings(s string) ([]sourcemapping, error) {
+	var mappings []sourcemapping
+	var source, name int
+	var line, column int64
+
+	for _, l := range strings.Split(s, ";") {
+		// The generated column restarts from zero on each line. Wasm source
+		// maps only have one line.
+		var offset int64
+		for _, seg := range strings.Split(l, ",") {
+			if seg == "" {
+				continue
+			}
+			fields, err := decodeVLQ(seg)
+			if err != nil {
+				return nil, err
+			}
+			offset += fields[0]
+			if len(fields) < 4 {
+				// Segments without a source location.
+				continue
+			}
+			source += int(fields[1])
+			line += fields[2]
+			column += fields[3]
+			m := sourcemapping{
+				offset: uint64(offset),
+				source: source,
+				line:   line,
+				column: column,
+				name:   -1,
+			}
+			if len(fields) > 4 {
+				name += int(fields[4])
+				m.name = name
+			}
+			mappings = append(mappings, m)
+		}
+	}
+
+	sort.SliceStable(mappings, func(i, j int) bool {
+		return mappings[i].offset < mappings[j].offset
+	})
+	return mappings, nil
+}
+
+// decodeVLQ decodes a segment of base64 VLQ encoded values.
+func decodeVLQ(s string) ([]int64, error) {
+	const alphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/"
+
+	var values []int64
+	var value int64
+	var shift uint
+	for i := 0; i < len(s); i++ {
+		digit := strings.IndexByte(alphabet, s[i])
+		if digit < 0 {
+			return nil, fmt.Errorf("sourcemap: invalid character %q in mappings", s[i])
+		}
+		value |= int64(digit&0x1f) << shift
+		if digit&0x20 != 0 {
+			shift += 5
+			continue
+		}
+		if value&1 != 0 {
+			value = -(value >> 1)
+		} else {
+			value >>= 1
+		}
+		values = append(values, value)
+		value, shift = 0, 0
+	}
+	if shift != 0 {
+		return nil, fmt.Errorf("sourcemap: truncated value in mappings")
+	}
+	return values, nil
+}
+
+func (s *sourcemap) Locations(fn experimental.InternalFunction, pc experimental.ProgramCounter) (uint64, []location) {
+	offset := fn.SourceOffsetForPC(pc)
+	if offset == 0 {
+		return offset, nil
+	}
+	addr := s.codeOffset + offset
+
+	// The instruction is covered by the last mapping starting before it.
+	i := sort.Search(len(s.mappings), func(i int) bool {
+		return s.mappings[i].offset > addr
+	})
+	if i == 0 {
+		return offset, nil
+	}
+	m := s.mappings[i-1]
+
+	// Names are optional in source maps, the function name is used when
+	// they are absent.
+	var name string
+	if m.name >= 0 && m.name < len(s.names) {
+		name = s.names[m.name]
+	}
+	var file string
+	if m.source >= 0 && m.source < len(s.sources) {
+		file = s.sources[m.source]
+	}
+
+	return offset, []location{{
+		File:       file,
+		Line:       m.line + 1, // lines are zero-based in source maps
+		Column:     m.column + 1,
+		HumanName:  name,
+		StableName: name,
+	}}
+}
@@ -0,0 +1,62 @@
+package wzprof
+
+import "testing"
+
+func TestDecodeVLQ(t *testing.T) {
+	tests := []struct {
+		in  string
+		out []int64
+	}{
+		{in: "A", out: []int64{0}},
+		{in: "C", out: []int64{1}},
+		{in: "D", out: []int64{-1}},
+		{in: "gB", out: []int64{16}},
+		{in: "AAgBC", out: []int64{0, 0, 16, 1}},
+		{in: "2HAAD", out: []int64{123, 0, 0, -1}},
+	}
+
+	for _, test := range tests {
+		out, err := decodeVLQ(test.in)
+		if err != nil {
+			t.Errorf("%q: %v", test.in, err)
+			continue
+		}
+		if len(out) != len(test.out) {
+			t.Errorf("%q: want %v, got %v", test.in, test.out, out)
+			continue
+		}
+		for i := range out {
+			if out[i] != test.out[i] {
+				t.Errorf("%q: want %v, got %v", test.in, test.out, out)
+				break
+			}
+		}
+	}
+
+	if _, err := decodeVLQ("g"); err == nil {
+		t.Error("expected error decoding truncated value")
+	}
+}
+
+func TestParseSourceMapMappings(t *testing.T) {
+	// offset=10 source=0 line=0 column=0
+	// offset=15 source=0 line=2 column=4 name=1
+	// offset=20 (no source)
+	mappings, err := parseSourceMapMappings("UAAA,KAEICC,K")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []sourcemapping{
+		{offset: 10, source: 0, line: 0, column: 0, name: -1},
+		{offset: 15, source: 0, line: 2, column: 4, name: 1},
+	}
+	if len(mappings) != len(want) {
+		t.Fatalf("want %d mappings, got %d", len(want), len(mappings))
+	}
+	for i := range want {
+		if mappings[i] != want[i] {
+			t.Errorf("mapping %d: want %+v, got %+v", i, want[i], mappings[i])
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package wzprof
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/pprof/profile"
+)
+
+// sampleStreams broadcasts the samples recorded by the profilers to the
+// clients of the handler returned by StreamHandler.
+type sampleStreams struct {
+	// Number of subscribers, checked before taking the mutex so recording
+	// samples does not pay for streams when there are none.
+	count       atomic.Int32
+	mutex       sync.Mutex
+	subscribers map[*sampleSubscriber]struct{}
+}
+
+// sampleSubscriber aggregates the samples published between two events of a
+// stream, per profile and stack.
+type sampleSubscriber struct {
+	profile string // only receive the samples of this profile if not empty
+	mutex   sync.Mutex
+	samples map[string]*stackCounterMap
+}
+
+func (s *sampleStreams) subscribe(sub *sampleSubscriber) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.subscribers == nil {
+		s.subscribers = make(map[*sampleSubscriber]struct{})
+	}
+	s.subscribers[sub] = struct{}{}
+	s.count.Add(1)
+}
+
+func (s *sampleStreams) unsubscribe(sub *sampleSubscriber) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.subscribers, sub)
+	s.count.Add(-1)
+}
+
+// publish records a sample of the named profile to the streams.
+func (s *sampleStreams) publish(profile string, st stackTrace, value int64) {
+	if s.count.Load() == 0 {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for sub := range s.subscribers {
+		if sub.profile != "" && sub.profile != profile {
+			continue
+		}
+		sub.mutex.Lock()
+		if sub.samples == nil {
+			sub.samples = make(map[string]*stackCounterMap)
+		}
+		samples := sub.samples[profile]
+		if samples == nil {
+			samples = newStackCounterMap(0)
+			sub.samples[profile] = samples
+		}
+		samples.observe(st, value)
+		sub.mutex.Unlock()
+	}
+}
+
+// flush returns the samples aggregated since the last call.
+func (sub *sampleSubscriber) flush() map[string]*stackCounterMap {
+	sub.mutex.Lock()
+	defer sub.mutex.Unlock()
+	samples := sub.samples
+	sub.samples = nil
+	return samples
+}
+
+// StreamSample is a sample of the events of the handler returned by
+// StreamHandler: the number of samples recorded for a stack since the last
+// event, and the sum of their values.
+type StreamSample struct {
+	// Names of the functions of the stack, from the root to the leaf.
+	Stack []string `json:"stack"`
+	Count int64    `json:"count"`
+	Value int64    `json:"value"`
+}
+
+// StreamHandler returns a http handler streaming the samples recorded by the
+// CPU and memory profilers as server-sent events, so live flame graph viewers
+// can render the activity of the guest as it happens instead of waiting for
+// the end of a profile.
+//
+// The samples are aggregated per stack, and sent periodically in events named
+// after the profile they belong to ("profile" or "allocs"), with a JSON array
+// of StreamSample as data. The value of the samples is the CPU time in
+// nanoseconds, or the number of bytes allocated. CPU samples are only recorded
+// while the CPU profiler is started.
+//
+// The interval query parameter configures the period of the events, default
+// to one second, and the profile parameter only streams the samples of one
+// profile, e.g. "/debug/pprof/stream?profile=allocs&interval=500ms".
+func (p *Profiling) StreamHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		interval := time.Second
+		if s := r.FormValue("interval"); s != "" {
+			d, err := time.ParseDuration(s)
+			if err != nil || d <= 0 {
+				serveError(w, http.StatusBadRequest, fmt.Sprintf("invalid interval: %q", s))
+				return
+			}
+			interval = d
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			serveError(w, http.StatusInternalServerError, "streaming not supported")
+			return
+		}
+
+		sub := &sampleSubscriber{profile: r.FormValue("profile")}
+		p.streams.subscribe(sub)
+		defer p.streams.unsubscribe(sub)
+
+		h := w.Header()
+		h.Set("Content-Type", "text/event-stream")
+		h.Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		funcs := make(map[string]*profile.Function)
+
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-ticker.C:
+			}
+			for name, samples := range sub.flush() {
+				data, err := json.Marshal(p.streamSamples(samples, funcs))
+				if err != nil {
+					return
+				}
+				if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", name, data); err != nil {
+					return
+				}
+			}
+			flusher.Flush()
+		}
+	})
+}
+
+func (p *Profiling) streamSamples(samples *stackCounterMap, funcs map[string]*profile.Function) []StreamSample {
+	out := make([]StreamSample, 0, samples.len())
+	var sample profile.Sample
+	arena := &profileArena{}
+	samples.forEach(func(sc *stackCounter) {
+		sample.Location = sample.Location[:0]
+		for i := 0; i < sc.stack.len(); i++ {
+			sample.Location = append(sample.Location, locationForCall(p, sc.stack.function(i), sc.stack.pcs[i], funcs, arena))
+		}
+		out = append(out, StreamSample{
+			Stack: appendSampleFrames(nil, &sample),
+			Count: sc.count(),
+			Value: sc.total(),
+		})
+	})
+	return out
+}
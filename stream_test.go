@@ -0,0 +1,83 @@
+package wzprof
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStreamHandler(t *testing.T) {
+	p := ProfilingFor(nil)
+	mem := p.MemoryProfiler()
+	alloc := newMallocListener(mem)
+
+	srv := httptest.NewServer(p.StreamHandler())
+	defer srv.Close()
+
+	res, err := http.Get(srv.URL + "?profile=allocs&interval=10ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if ct := res.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("wrong content type: %q", ct)
+	}
+
+	// The subscription is registered before the response headers are sent.
+	alloc(10)
+	alloc(20)
+
+	events := make(chan string)
+	go func() {
+		defer close(events)
+		r := bufio.NewScanner(res.Body)
+		event := ""
+		for r.Scan() {
+			line := r.Text()
+			if name, ok := strings.CutPrefix(line, "event: "); ok {
+				event = name
+			}
+			if data, ok := strings.CutPrefix(line, "data: "); ok && event == "allocs" {
+				events <- data
+				return
+			}
+		}
+	}()
+
+	select {
+	case data, ok := <-events:
+		if !ok {
+			t.Fatal("stream closed before receiving samples")
+		}
+		var samples []StreamSample
+		if err := json.Unmarshal([]byte(data), &samples); err != nil {
+			t.Fatal(err)
+		}
+		count, value := int64(0), int64(0)
+		for _, s := range samples {
+			count += s.Count
+			value += s.Value
+			if len(s.Stack) == 0 {
+				t.Error("sample with empty stack")
+			}
+		}
+		if count != 2 || value != 30 {
+			t.Errorf("wrong samples: count=%d value=%d", count, value)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for samples")
+	}
+
+	res, err = http.Get(srv.URL + "?interval=nope")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("wrong status for invalid interval: %d", res.StatusCode)
+	}
+}
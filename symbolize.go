@@ -0,0 +1,203 @@
+package wzprof
+
+import (
+	"context"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/google/pprof/profile"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+)
+
+// SymbolizeProfile resolves the functions of a profile recorded with the "none"
+// symbolizer (see Profiling.SetSymbolizer), which are named after their index
+// in the module, with the symbols of the wasm module passed as argument. This
+// lets production deployments run stripped modules and symbolize the profiles
+// offline with the debug build of the same code.
+//
+// The locations are resolved with the DWARF information of the module when it
+// has any, including the inlined functions and the source lines, and with the
+// name section otherwise. Locations which cannot be resolved are left as-is.
+func SymbolizeProfile(prof *profile.Profile, wasm []byte) error {
+	var dwarf symbolizer
+	if wasmCustomSection(wasm, debugInfo) != nil {
+		parser, err := newDwarfParserFromBin(wasm)
+		if err != nil {
+			return err
+		}
+		dwarf = buildDwarfSymbolizer(parser)
+	}
+	names := wasmFunctionNames(wasm)
+
+	funcs := make(map[string]*profile.Function)
+	for _, loc := range prof.Location {
+		if len(loc.Line) != 1 || loc.Line[0].Function == nil {
+			continue
+		}
+		index, ok := parseFunctionIndex(loc.Line[0].Function.Name)
+		if !ok {
+			continue
+		}
+
+		var locations []location
+		if dwarf != nil && loc.Address != 0 {
+			_, locations = dwarf.Locations(codeOffset(loc.Address), 0)
+		}
+		if name, ok := names[index]; ok {
+			if len(locations) == 0 {
+				locations = []location{{}}
+			}
+			if locations[0].StableName == "" {
+				locations[0].StableName = name
+			}
+			if locations[0].HumanName == "" {
+				locations[0].HumanName = name
+			}
+		}
+		if len(locations) == 0 || locations[0].StableName == "" {
+			continue
+		}
+
+		// Like in locationForCall, the lines start with the root of the
+		// inlined calls.
+		lines := make([]profile.Line, len(locations))
+		for i, l := range locations {
+			fn := funcs[l.StableName]
+			if fn == nil {
+				fn = &profile.Function{
+					Name:       l.HumanName,
+					SystemName: l.StableName,
+					Filename:   l.File,
+				}
+				funcs[l.StableName] = fn
+			}
+			lines[len(locations)-(i+1)] = profile.Line{Function: fn, Line: l.Line}
+		}
+		loc.Line = lines
+	}
+
+	// The functions of the profile are those referenced by the locations,
+	// which may not include the functions named after their index anymore.
+	seen := make(map[*profile.Function]bool)
+	prof.Function = prof.Function[:0]
+	for _, loc := range prof.Location {
+		for _, line := range loc.Line {
+			if fn := line.Function; fn != nil && !seen[fn] {
+				seen[fn] = true
+				fn.ID = uint64(len(prof.Function)) + 1
+				prof.Function = append(prof.Function, fn)
+			}
+		}
+	}
+	return prof.CheckValid()
+}
+
+// parseFunctionIndex returns the index of a function named by the "none"
+// symbolizer, e.g. 42 for "wasm-function[42]".
+func parseFunctionIndex(name string) (uint32, bool) {
+	s, ok := strings.CutPrefix(name, "wasm-function[")
+	if !ok {
+		return 0, false
+	}
+	s, ok = strings.CutSuffix(s, "]")
+	if !ok {
+		return 0, false
+	}
+	index, err := strconv.ParseUint(s, 10, 32)
+	return uint32(index), err == nil
+}
+
+// codeOffset is a function resolving all program counters to an offset in the
+// code section of a module, so the symbolizers can resolve offsets recorded
+// in profiles.
+type codeOffset uint64
+
+func (offset codeOffset) Definition() api.FunctionDefinition { return nil }
+
+func (offset codeOffset) SourceOffsetForPC(experimental.ProgramCounter) uint64 {
+	return uint64(offset)
+}
+
+// Number of distinct calls of a profile per goroutine resolving their symbols
+// when the number of workers is not set, the symbols of smaller profiles are
+// resolved faster than the goroutines would start.
+const minConcurrentCalls = 1024
+
+// resolvedCall is the result of resolveCall for a call of a profile.
+type resolvedCall struct {
+	fn        experimental.InternalFunction
+	pc        experimental.ProgramCounter
+	address   uint64
+	locations []location
+}
+
+// resolveCalls resolves the symbols of the distinct calls of the samples with
+// the number of goroutines set by Profiling.SetSymbolizerWorkers, and returns
+// the cache of their indexes in the calls. The cache is nil when the symbols
+// are resolved sequentially, as the locations of the profile are built.
+func resolveCalls[T sampleType](ctx context.Context, p *Profiling, samples map[uint64]T) (*locationCache[int], []resolvedCall, error) {
+	workers := p.symbolizerWorkers
+	if workers == 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	if workers < 2 {
+		return nil, nil, nil
+	}
+
+	cache := newLocationCache[int](p)
+	var calls []resolvedCall
+	for _, sample := range samples {
+		stack := sample.sampleLocation()
+		for i := 0; i < stack.len(); i++ {
+			fn := stack.function(i)
+			// The dropped stacks are not symbolized.
+			if fn == droppedFunction {
+				continue
+			}
+			def, pc := fn.Definition(), stack.pcs[i]
+			if _, ok := cache.lookup(def, pc); !ok {
+				cache.store(def, pc, len(calls))
+				calls = append(calls, resolvedCall{fn: fn, pc: pc})
+			}
+		}
+	}
+	if p.symbolizerWorkers == 0 && workers > len(calls)/minConcurrentCalls {
+		workers = len(calls) / minConcurrentCalls
+	}
+	if workers > len(calls) {
+		workers = len(calls)
+	}
+	if workers < 2 {
+		return nil, nil, nil
+	}
+
+	var next atomic.Int64
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				i := int(next.Add(1)) - 1
+				if i >= len(calls) {
+					return
+				}
+				if i%progressInterval == 0 && ctx.Err() != nil {
+					return
+				}
+				c := &calls[i]
+				c.address, c.locations = resolveCall(p, c.fn, c.pc)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	return cache, calls, nil
+}
@@ -0,0 +1,171 @@
+package wzprof
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/pprof/profile"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/experimental"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+	"golang.org/x/exp/slices"
+)
+
+// profileWithoutSymbols runs the module with the CPU profiler and the "none"
+// symbolizer, calling the exported function if one is passed.
+func profileWithoutSymbols(t *testing.T, wasm []byte, call string) *profile.Profile {
+	t.Helper()
+	p := ProfilingFor(wasm)
+	if err := p.SetSymbolizer("none"); err != nil {
+		t.Fatal(err)
+	}
+	cpu := p.CPUProfiler(HostTime(true))
+
+	ctx := context.WithValue(context.Background(), experimental.FunctionListenerFactoryKey{}, cpu)
+	r := wazero.NewRuntime(ctx)
+	defer r.Close(ctx)
+	wasi_snapshot_preview1.MustInstantiate(ctx, r)
+
+	mod, err := r.CompileModule(ctx, wasm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Prepare(mod); err != nil {
+		t.Fatal(err)
+	}
+	cpu.StartProfile()
+	config := wazero.NewModuleConfig()
+	if call != "" {
+		config = config.WithStartFunctions()
+	}
+	instance, err := r.InstantiateModule(ctx, mod, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if call != "" {
+		instance.ExportedFunction(call).Call(ctx)
+	}
+	return cpu.StopProfile(1)
+}
+
+func functionNames(prof *profile.Profile) map[string]profile.Line {
+	names := make(map[string]profile.Line)
+	for _, loc := range prof.Location {
+		for _, line := range loc.Line {
+			names[line.Function.Name] = line
+		}
+	}
+	return names
+}
+
+func TestSymbolizeProfileNames(t *testing.T) {
+	prof := profileWithoutSymbols(t, wasmTrap, "crash")
+	if names := functionNames(prof); names["inner"].Function != nil {
+		t.Fatalf("profile already symbolized: %v", names)
+	}
+	if err := SymbolizeProfile(prof, wasmTrap); err != nil {
+		t.Fatal(err)
+	}
+	names := functionNames(prof)
+	for _, name := range []string{"inner", "crash"} {
+		if names[name].Function == nil {
+			t.Errorf("function %s not found in the symbolized profile", name)
+		}
+	}
+}
+
+func TestSymbolizeProfileDWARF(t *testing.T) {
+	wasm, err := os.ReadFile("testdata/c/simple.wasm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	prof := profileWithoutSymbols(t, wasm, "")
+	// Entry points are called without program counter, the other locations
+	// have the code offsets of the calls.
+	offsets := 0
+	for _, loc := range prof.Location {
+		if loc.Address != 0 {
+			offsets++
+		}
+	}
+	if offsets == 0 {
+		t.Fatal("no locations with code offsets")
+	}
+	if err := SymbolizeProfile(prof, wasm); err != nil {
+		t.Fatal(err)
+	}
+	names := functionNames(prof)
+	for name := range names {
+		if strings.HasPrefix(name, "wasm-function[") {
+			t.Errorf("function %s not symbolized", name)
+		}
+	}
+	main := names["main"]
+	if main.Function == nil || !strings.HasSuffix(main.Function.Filename, "simple.c") || main.Line == 0 {
+		t.Errorf("wrong source location of main: %+v", main)
+	}
+}
+
+func TestParseFunctionIndex(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		index uint32
+		ok    bool
+	}{
+		{name: "wasm-function[0]", index: 0, ok: true},
+		{name: "wasm-function[42]", index: 42, ok: true},
+		{name: "wasm-function[]"},
+		{name: "wasm-function[-1]"},
+		{name: "wasm-function[42"},
+		{name: "main"},
+	} {
+		index, ok := parseFunctionIndex(test.name)
+		if index != test.index || ok != test.ok {
+			t.Errorf("%s: want (%d, %t), got (%d, %t)", test.name, test.index, test.ok, index, ok)
+		}
+	}
+}
+
+func TestSymbolizerWorkers(t *testing.T) {
+	for _, path := range []string{
+		"testdata/c/bench.wasm",
+		"testdata/go/simple.wasm",
+		"testdata/rust/simple/target/wasm32-wasi/debug/simple.wasm",
+	} {
+		t.Run(path, func(t *testing.T) {
+			wasm, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p := ProfilingFor(wasm)
+			samples := profileTestdata(t, p, path)
+			sampleType := p.CPUProfiler().SampleType()
+
+			build := func(workers int) *profile.Profile {
+				p.SetSymbolizerWorkers(workers)
+				prof, err := buildUnscaledProfile(context.Background(), p, samples, time.Now(), 0, 0, sampleType)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return prof
+			}
+			want, got := build(1), build(4)
+			if len(got.Location) != len(want.Location) || len(got.Function) != len(want.Function) {
+				t.Fatalf("wrong number of locations and functions: want %d/%d, got %d/%d",
+					len(want.Location), len(want.Function), len(got.Location), len(got.Function))
+			}
+			if !slices.Equal(canonicalSamples(got), canonicalSamples(want)) {
+				t.Error("samples differ when the symbols are resolved concurrently")
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			if _, err := buildUnscaledProfile(ctx, p, samples, time.Now(), 0, 0, sampleType); err != context.Canceled {
+				t.Errorf("want context.Canceled, got %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,159 @@
+package wzprof
+
+import (
+	"context"
+	"errors"
+
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+)
+
+// ErrTailCall is the error passed to the Abort method of the listeners
+// wrapped by Profiling.TailCalls for the calls replaced by a tail call.
+var ErrTailCall = errors.New("call replaced by a tail call")
+
+// TailCalls wraps factory so the listeners it creates see balanced calls and
+// returns in modules using the tail call proposal (return_call and
+// return_call_indirect instructions).
+//
+// The function replaced by a tail call does not return, the runtime only
+// invokes the Before method of the listener of the function called in its
+// place. The listeners of the profilers would pair the following returns with
+// the wrong calls, skewing the profiles. The wrapper compares the depth of the
+// stack at each call with the depth of the calls in progress, and aborts the
+// calls which were replaced with ErrTailCall before passing the new call to
+// the listeners: tail calls are seen as a return followed by a call. The
+// results of the replaced calls are unknown, the memory profiler does not
+// record the allocations of the functions returning with a tail call.
+//
+// Finding the depth of the stack walks it on every call, factory is returned
+// unchanged if the module has no tail calls. The wrapper must be the outermost
+// one, so the listeners sampling the calls see the returns as well.
+func (p *Profiling) TailCalls(factory experimental.FunctionListenerFactory) experimental.FunctionListenerFactory {
+	if !wasmTailCalls(p.wasm) {
+		return factory
+	}
+	threads := new(threadStates[tailCallThread])
+	return experimental.FunctionListenerFactoryFunc(func(def api.FunctionDefinition) experimental.FunctionListener {
+		lstn := factory.NewFunctionListener(def)
+		if lstn == nil {
+			return nil
+		}
+		return &tailCallListener{threads: threads, lstn: lstn}
+	})
+}
+
+// wasmTailCalls returns true if a function of the module makes tail calls.
+func wasmTailCalls(b []byte) bool {
+	found := false
+	wasmFunctionBodies(b, func(_ uint32, body []byte) bool {
+		found = scanMemoryAccesses(body).tailCalls > 0
+		return !found
+	})
+	return found
+}
+
+// tailCallThread holds the calls in progress of a thread passed to the wrapped
+// listeners, with the depths of their frames in the stack, which increase
+// strictly from the outermost call.
+type tailCallThread struct {
+	calls  []tailCall
+	frames tailCallStackIterator
+}
+
+type tailCall struct {
+	depth int
+	def   api.FunctionDefinition
+	lstn  experimental.FunctionListener
+}
+
+type tailCallListener struct {
+	threads *threadStates[tailCallThread]
+	lstn    experimental.FunctionListener
+}
+
+func (l *tailCallListener) Before(ctx context.Context, mod api.Module, def api.FunctionDefinition, params []uint64, si experimental.StackIterator) {
+	t := l.threads.get(mod)
+	// The stack is walked to find its depth, the wrapped listeners walk the
+	// copy of its frames.
+	t.frames.reset()
+	for si.Next() {
+		t.frames.push(si)
+	}
+	depth := len(t.frames.stack)
+
+	// The calls which were not deeper than the new one had their frames
+	// replaced by tail calls.
+	for i := len(t.calls) - 1; i >= 0 && t.calls[i].depth >= depth; i-- {
+		c := t.calls[i]
+		t.calls = t.calls[:i]
+		c.lstn.Abort(ctx, mod, c.def, ErrTailCall)
+	}
+
+	t.calls = append(t.calls, tailCall{depth: depth, def: def, lstn: l.lstn})
+	l.lstn.Before(ctx, mod, def, params, &t.frames)
+}
+
+func (l *tailCallListener) After(ctx context.Context, mod api.Module, def api.FunctionDefinition, results []uint64) {
+	l.pop(mod)
+	l.lstn.After(ctx, mod, def, results)
+}
+
+func (l *tailCallListener) Abort(ctx context.Context, mod api.Module, def api.FunctionDefinition, err error) {
+	l.pop(mod)
+	l.lstn.Abort(ctx, mod, def, err)
+}
+
+func (l *tailCallListener) pop(mod api.Module) {
+	t := l.threads.get(mod)
+	if i := len(t.calls) - 1; i >= 0 {
+		t.calls[i] = tailCall{}
+		t.calls = t.calls[:i]
+	}
+}
+
+// tailCallStackIterator replays the frames of a stack, it is reused by the
+// calls of a thread.
+type tailCallStackIterator struct {
+	stack []tailCallFrame
+	index int
+}
+
+type tailCallFrame struct {
+	fn     experimental.InternalFunction
+	pc     experimental.ProgramCounter
+	params []uint64
+}
+
+func (s *tailCallStackIterator) reset() {
+	for i := range s.stack {
+		s.stack[i] = tailCallFrame{}
+	}
+	s.stack = s.stack[:0]
+	s.index = -1
+}
+
+func (s *tailCallStackIterator) push(si experimental.StackIterator) {
+	s.stack = append(s.stack, tailCallFrame{
+		fn:     si.Function(),
+		pc:     si.ProgramCounter(),
+		params: si.Parameters(),
+	})
+}
+
+func (s *tailCallStackIterator) Next() bool {
+	s.index++
+	return s.index < len(s.stack)
+}
+
+func (s *tailCallStackIterator) Function() experimental.InternalFunction {
+	return s.stack[s.index].fn
+}
+
+func (s *tailCallStackIterator) ProgramCounter() experimental.ProgramCounter {
+	return s.stack[s.index].pc
+}
+
+func (s *tailCallStackIterator) Parameters() []uint64 {
+	return s.stack[s.index].params
+}
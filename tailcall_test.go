@@ -0,0 +1,122 @@
+package wzprof
+
+import (
+	"context"
+	"testing"
+
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+	"github.com/tetratelabs/wazero/experimental/wazerotest"
+)
+
+// tailCallModule is a module with a function of type () -> () which tail
+// calls itself.
+var tailCallModule = []byte{
+	0x00, 'a', 's', 'm', 1, 0, 0, 0,
+	1, 4, 1, 0x60, 0, 0, // type section: func () -> ()
+	3, 2, 1, 0, // function section: 1 function of type 0
+	10, 6, 1, 4, 0, 0x12, 0, 0x0B, // code section: return_call 0
+}
+
+func TestWasmTailCalls(t *testing.T) {
+	if !wasmTailCalls(tailCallModule) {
+		t.Error("tail calls not found")
+	}
+	call := append([]byte{}, tailCallModule...)
+	call[len(call)-3] = 0x10 // call 0
+	if wasmTailCalls(call) {
+		t.Error("call found as a tail call")
+	}
+
+	p := ProfilingFor(call)
+	factory := experimental.FunctionListenerFactory(p.CPUProfiler())
+	if p.TailCalls(factory) != factory {
+		t.Error("listeners wrapped for a module without tail calls")
+	}
+}
+
+func TestCPUProfilerTailCalls(t *testing.T) {
+	currentTime := int64(0)
+
+	p := ProfilingFor(tailCallModule)
+	cpu := p.CPUProfiler(
+		TimeFunc(func() int64 { return currentTime }),
+	)
+	factory := p.TailCalls(cpu)
+
+	module := wazerotest.NewModule(nil,
+		wazerotest.NewFunction(func(context.Context, api.Module) {}),
+		wazerotest.NewFunction(func(context.Context, api.Module) {}),
+		wazerotest.NewFunction(func(context.Context, api.Module) {}),
+	)
+
+	f0 := factory.NewFunctionListener(module.Function(0).Definition())
+	f1 := factory.NewFunctionListener(module.Function(1).Definition())
+	f2 := factory.NewFunctionListener(module.Function(2).Definition())
+
+	stack0 := []experimental.StackFrame{
+		{Function: module.Function(0), PC: 1},
+	}
+
+	stack1 := []experimental.StackFrame{
+		{Function: module.Function(0), PC: 1},
+		{Function: module.Function(1), PC: 2},
+	}
+
+	// The frame of function 1 is replaced by the tail call to function 2. The
+	// keys of the stacks are derived from the program counters, they are set
+	// to tell the stacks apart.
+	stack2 := []experimental.StackFrame{
+		{Function: module.Function(0), PC: 1},
+		{Function: module.Function(2), PC: 3},
+	}
+
+	def0 := stack0[0].Function.Definition()
+	def1 := stack1[1].Function.Definition()
+	def2 := stack2[1].Function.Definition()
+
+	ctx := context.Background()
+
+	const (
+		t0 int64 = 1
+		t1 int64 = 10
+		t2 int64 = 42
+		t3 int64 = 100
+		t4 int64 = 101
+	)
+
+	cpu.StartProfile()
+
+	currentTime = t0
+	f0.Before(ctx, module, def0, nil, experimental.NewStackIterator(stack0...))
+
+	currentTime = t1
+	f1.Before(ctx, module, def1, nil, experimental.NewStackIterator(stack1...))
+
+	currentTime = t2
+	f2.Before(ctx, module, def2, nil, experimental.NewStackIterator(stack2...))
+
+	currentTime = t3
+	f2.After(ctx, module, def2, nil)
+
+	currentTime = t4
+	f0.After(ctx, module, def0, nil)
+
+	thread := cpu.threads.get(module)
+	if len(thread.frames) != 0 || thread.depth != 0 {
+		t.Errorf("unbalanced calls: %d frames, depth %d", len(thread.frames), thread.depth)
+	}
+
+	trace0 := makeStackTraceFromFrames(stack0)
+	trace1 := makeStackTraceFromFrames(stack1)
+	trace2 := makeStackTraceFromFrames(stack2)
+
+	d1 := t2 - t1
+	d2 := t3 - t2
+	d0 := t4 - (t0 + d1 + d2)
+
+	cpu.drain(cpu.counts)
+	assertStackCount(t, cpu.counts, trace0, 1, d0)
+	assertStackCount(t, cpu.counts, trace1, 1, d1)
+	assertStackCount(t, cpu.counts, trace2, 1, d2)
+}
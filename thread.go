@@ -0,0 +1,99 @@
+package wzprof
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/tetratelabs/wazero/api"
+)
+
+// threadStates holds a value of type T for each thread of a guest calling the
+// function listeners of a profiler. Threads of WebAssembly modules (e.g. with
+// wasi-threads) are instances of the module sharing its memory, each running on
+// its own goroutine, so the threads are identified by the module passed to the
+// listeners, and the value of a thread is only used by one goroutine at a time.
+// The modules are compared as interface values, which is a comparison of
+// pointers for the module instances of wazero.
+//
+// The first module seen is looked up without synchronization, which keeps the
+// cost of the listeners of single-threaded guests unchanged. The values of the
+// modules which were closed are removed as new threads are started.
+type threadStates[T any] struct {
+	main   atomic.Pointer[threadState[T]]
+	others sync.Map // api.Module => *threadState[T]
+	// Number of values in others, and the number there was after the last
+	// sweep of the closed modules.
+	mutex sync.Mutex
+	count int
+	swept int
+	// Invoked with the value of a closed module before it is removed.
+	release func(*T)
+}
+
+type threadState[T any] struct {
+	mod   api.Module
+	value T
+}
+
+// get returns the value of the thread running mod, creating it if needed.
+func (s *threadStates[T]) get(mod api.Module) *T {
+	t := s.main.Load()
+	if t == nil || t.mod != mod {
+		t = s.load(mod)
+	}
+	return &t.value
+}
+
+func (s *threadStates[T]) load(mod api.Module) *threadState[T] {
+	if v, ok := s.others.Load(mod); ok {
+		return v.(*threadState[T])
+	}
+	t := &threadState[T]{mod: mod}
+	if s.main.CompareAndSwap(nil, t) {
+		return t
+	}
+	if t := s.main.Load(); t != nil && t.mod == mod {
+		return t
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if v, ok := s.others.LoadOrStore(mod, t); ok {
+		return v.(*threadState[T])
+	}
+	if s.count++; s.count >= 2*s.swept+16 {
+		s.sweep()
+	}
+	return t
+}
+
+// sweep removes the values of the closed modules, with the mutex held.
+func (s *threadStates[T]) sweep() {
+	s.others.Range(func(key, v any) bool {
+		if t := v.(*threadState[T]); t.mod != nil && t.mod.IsClosed() {
+			s.others.Delete(key)
+			s.count--
+			if s.release != nil {
+				s.release(&t.value)
+			}
+		}
+		return true
+	})
+	if t := s.main.Load(); t != nil && t.mod != nil && t.mod.IsClosed() {
+		if s.main.CompareAndSwap(t, nil) && s.release != nil {
+			s.release(&t.value)
+		}
+	}
+	s.swept = s.count
+}
+
+// each calls fn with the value of each thread.
+func (s *threadStates[T]) each(fn func(*T)) {
+	if t := s.main.Load(); t != nil {
+		fn(&t.value)
+	}
+	s.others.Range(func(_, v any) bool {
+		fn(&v.(*threadState[T]).value)
+		return true
+	})
+}
@@ -0,0 +1,154 @@
+package wzprof
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+	"github.com/tetratelabs/wazero/experimental/wazerotest"
+)
+
+// newThreadModules returns n instances of a module with two functions, as the
+// threads of a guest are.
+func newThreadModules(n int) []*wazerotest.Module {
+	modules := make([]*wazerotest.Module, n)
+	for i := range modules {
+		modules[i] = wazerotest.NewModule(nil,
+			wazerotest.NewFunction(func(context.Context, api.Module) {}),
+			wazerotest.NewFunction(func(context.Context, api.Module, uint32) uint32 { return 0 }),
+		)
+	}
+	return modules
+}
+
+func TestThreadStates(t *testing.T) {
+	modules := newThreadModules(40)
+	released := 0
+	s := threadStates[int]{release: func(v *int) { released += *v }}
+
+	for i, mod := range modules {
+		*s.get(mod) = i + 1
+	}
+	for i, mod := range modules {
+		if v := *s.get(mod); v != i+1 {
+			t.Errorf("wrong value of thread %d: %d", i, v)
+		}
+	}
+
+	// The values of the closed modules are released as new threads start.
+	total := 0
+	for _, mod := range modules[:20] {
+		total += *s.get(mod)
+		mod.Close(context.Background())
+	}
+	for _, mod := range newThreadModules(40) {
+		s.get(mod)
+	}
+	if released != total {
+		t.Errorf("wrong released values: want %d, got %d", total, released)
+	}
+	count := 0
+	s.each(func(*int) { count++ })
+	if count != 60 {
+		t.Errorf("wrong number of threads: want 60, got %d", count)
+	}
+}
+
+// valueModule is a module of a type which is not a pointer, its values are
+// copied each time they are converted to an interface.
+type valueModule struct{ api.Module }
+
+func TestThreadStatesValueModules(t *testing.T) {
+	modules := newThreadModules(2)
+	s := threadStates[int]{}
+
+	*s.get(valueModule{modules[0]}) = 1
+	*s.get(valueModule{modules[1]}) = 2
+	for i, mod := range modules {
+		if v := *s.get(valueModule{mod}); v != i+1 {
+			t.Errorf("wrong value of thread %d: %d", i, v)
+		}
+	}
+}
+
+func TestCPUProfilerThreads(t *testing.T) {
+	const calls = 1000
+	modules := newThreadModules(4)
+	// The functions of the test modules are host functions.
+	p := ProfilingFor(nil).CPUProfiler(HostTime(true))
+	def := modules[0].Function(0).Definition()
+	f := p.NewFunctionListener(def)
+	p.StartProfile()
+
+	var wg sync.WaitGroup
+	for _, mod := range modules {
+		wg.Add(1)
+		go func(mod *wazerotest.Module) {
+			defer wg.Done()
+			ctx := context.Background()
+			outer := []experimental.StackFrame{{Function: mod.Function(0)}}
+			inner := []experimental.StackFrame{{Function: mod.Function(0)}, {Function: mod.Function(0)}}
+			for i := 0; i < calls; i++ {
+				f.Before(ctx, mod, def, nil, experimental.NewStackIterator(outer...))
+				f.Before(ctx, mod, def, nil, experimental.NewStackIterator(inner...))
+				f.After(ctx, mod, def, nil)
+				f.After(ctx, mod, def, nil)
+			}
+		}(mod)
+	}
+	wg.Wait()
+
+	prof := p.StopProfile(1)
+	var count int64
+	for _, s := range prof.Sample {
+		count += s.Value[0]
+	}
+	if want := int64(2 * calls * len(modules)); count != want {
+		t.Errorf("wrong number of calls: want %d, got %d", want, count)
+	}
+	for _, mod := range modules {
+		if thread := p.threads.get(mod); len(thread.frames) != 0 || thread.depth != 0 {
+			t.Errorf("unbalanced calls: %d frames, depth %d", len(thread.frames), thread.depth)
+		}
+	}
+}
+
+func TestMemoryProfilerThreads(t *testing.T) {
+	const calls = 1000
+	modules := newThreadModules(4)
+	p := ProfilingFor(nil).MemoryProfiler()
+	def := modules[0].Function(1).Definition()
+	malloc := profilingListener{p.p, &mallocProfiler{memory: p}}
+
+	var wg sync.WaitGroup
+	for i, mod := range modules {
+		wg.Add(1)
+		go func(size uint64, mod *wazerotest.Module) {
+			defer wg.Done()
+			ctx := context.Background()
+			stack := []experimental.StackFrame{{Function: mod.Function(1)}}
+			for i := 0; i < calls; i++ {
+				// Interleaving the calls of the threads must not mix up
+				// their parameters.
+				malloc.Before(ctx, mod, def, []uint64{size}, experimental.NewStackIterator(stack...))
+				malloc.After(ctx, mod, def, []uint64{0})
+			}
+		}(uint64(i+1), mod)
+	}
+	wg.Wait()
+
+	prof := p.NewProfile(1)
+	var count, space int64
+	for _, s := range prof.Sample {
+		count += s.Value[0]
+		space += s.Value[1]
+	}
+	if want := int64(calls * len(modules)); count != want {
+		t.Errorf("wrong number of allocations: want %d, got %d", want, count)
+	}
+	if want := int64(calls * (1 + 2 + 3 + 4)); space != want {
+		t.Errorf("wrong allocated space: want %d, got %d", want, space)
+	}
+}
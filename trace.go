@@ -0,0 +1,245 @@
+package wzprof
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/google/pprof/profile"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+)
+
+// Tracer records the calls to functions of a WebAssembly module as a timeline
+// of events, where profilers only retain aggregated stacks. The timeline can
+// be exported in the Chrome trace-event format with WriteTrace.
+type Tracer struct {
+	p       *Profiling
+	mutex   sync.Mutex
+	events  []traceEvent
+	frames  []traceFrame
+	limit   int
+	dropped int
+	start   int64
+	time    func() int64
+}
+
+// TracerOption is a type used to represent configuration options for Tracer
+// instances created by Profiling.Tracer.
+type TracerOption func(*Tracer)
+
+// MaxTraceEvents configures the maximum number of events recorded by a tracer.
+// Calls returning after the limit was reached are dropped, which bounds the
+// memory used to trace long running programs.
+//
+// Default to 1,000,000.
+func MaxTraceEvents(limit int) TracerOption {
+	return func(t *Tracer) { t.limit = limit }
+}
+
+const defaultMaxTraceEvents = 1_000_000
+
+type traceFrame struct {
+	start int64
+	fn    experimental.InternalFunction
+	pc    experimental.ProgramCounter
+}
+
+type traceEvent struct {
+	traceFrame
+	end int64
+}
+
+func newTracer(p *Profiling, options ...TracerOption) *Tracer {
+	t := &Tracer{
+		p:     p,
+		limit: defaultMaxTraceEvents,
+		time:  nanotime,
+	}
+	for _, opt := range options {
+		opt(t)
+	}
+	t.start = t.time()
+	return t
+}
+
+// NewFunctionListener returns a function listener suited to record the calls
+// to the function passed as argument.
+func (t *Tracer) NewFunctionListener(def api.FunctionDefinition) experimental.FunctionListener {
+	if !t.p.listensTo(def) {
+		return nil
+	}
+	return profilingListener{t.p, tracerListener{t}}
+}
+
+type tracerListener struct{ *Tracer }
+
+func (t tracerListener) Before(ctx context.Context, mod api.Module, def api.FunctionDefinition, _ []uint64, si experimental.StackIterator) {
+	frame := traceFrame{start: t.time()}
+	if si.Next() {
+		frame.fn = si.Function()
+		frame.pc = si.ProgramCounter()
+	}
+	t.frames = append(t.frames, frame)
+}
+
+func (t tracerListener) After(ctx context.Context, mod api.Module, def api.FunctionDefinition, _ []uint64) {
+	i := len(t.frames) - 1
+	f := t.frames[i]
+	t.frames = t.frames[:i]
+
+	if f.fn == nil {
+		return
+	}
+
+	end := t.time()
+	t.mutex.Lock()
+	if len(t.events) < t.limit {
+		t.events = append(t.events, traceEvent{traceFrame: f, end: end})
+		t.p.metrics.samples.Add(1)
+	} else {
+		t.dropped++
+		t.p.metrics.dropped.Add(1)
+	}
+	t.mutex.Unlock()
+}
+
+func (t tracerListener) Abort(ctx context.Context, mod api.Module, def api.FunctionDefinition, _ error) {
+	t.After(ctx, mod, def, nil)
+}
+
+// Count returns the number of events currently recorded by t.
+func (t *Tracer) Count() int {
+	t.mutex.Lock()
+	n := len(t.events)
+	t.mutex.Unlock()
+	return n
+}
+
+type chromeTraceEvent struct {
+	Name string            `json:"name"`
+	Cat  string            `json:"cat"`
+	Ph   string            `json:"ph"`
+	Ts   float64           `json:"ts"`
+	Dur  float64           `json:"dur"`
+	Pid  int               `json:"pid"`
+	Tid  int               `json:"tid"`
+	Args map[string]string `json:"args,omitempty"`
+}
+
+// WriteTrace writes the events recorded by t to w as a JSON document in the
+// Chrome trace-event format, which can be opened in about://tracing or in the
+// Perfetto UI. Each call is a complete event ("X"), with timestamps relative to
+// the creation of the tracer.
+func (t *Tracer) WriteTrace(w io.Writer) error {
+	events, dropped := t.snapshot()
+	functions := t.symbolizer()
+	chromeEvents := make([]chromeTraceEvent, len(events))
+	for i, e := range events {
+		chromeEvents[i] = functions(e).chromeEvent(e.start-t.start, e.end-t.start)
+	}
+	return writeChromeTrace(w, chromeEvents, dropped)
+}
+
+// snapshot returns a copy of the events recorded by t, ordered by start time
+// with the callers before the functions they call, and the number of dropped
+// events.
+func (t *Tracer) snapshot() ([]traceEvent, int) {
+	t.mutex.Lock()
+	events := make([]traceEvent, len(t.events))
+	copy(events, t.events)
+	dropped := t.dropped
+	t.mutex.Unlock()
+
+	sort.SliceStable(events, func(i, j int) bool {
+		if events[i].start != events[j].start {
+			return events[i].start < events[j].start
+		}
+		return events[i].end > events[j].end
+	})
+	return events, dropped
+}
+
+// traceFunction is the symbolized function of trace events.
+type traceFunction struct {
+	name string
+	file string
+	host bool
+}
+
+// symbolizer returns a function symbolizing the functions of trace events,
+// caching the locations of the calls.
+func (t *Tracer) symbolizer() func(traceEvent) traceFunction {
+	locations := newLocationCache[*profile.Location](t.p)
+	functions := make(map[string]*profile.Function)
+	arena := &profileArena{}
+
+	return func(e traceEvent) traceFunction {
+		def := e.fn.Definition()
+		loc, _ := locations.lookup(def, e.pc)
+		if loc == nil {
+			t.p.metrics.cacheMisses.Add(1)
+			loc = locationForCall(t.p, e.fn, e.pc, functions, arena)
+			locations.store(def, e.pc, loc)
+		} else {
+			t.p.metrics.cacheHits.Add(1)
+		}
+
+		f := traceFunction{name: def.Name(), host: def.GoFunction() != nil}
+		// The last line is the function which was called, the others are
+		// functions inlined in it.
+		if n := len(loc.Line); n > 0 {
+			line := loc.Line[n-1]
+			f.name = line.Function.Name
+			f.file = line.Function.Filename
+		}
+		return f
+	}
+}
+
+// chromeEvent returns the complete event of a call to f between start and end,
+// in nanoseconds relative to the start of the trace.
+func (f traceFunction) chromeEvent(start, end int64) chromeTraceEvent {
+	event := chromeTraceEvent{
+		Name: f.name,
+		Cat:  "guest",
+		Ph:   "X",
+		Ts:   float64(start) / 1e3,
+		Dur:  float64(end-start) / 1e3,
+		Pid:  1,
+		Tid:  1,
+	}
+	if f.host {
+		event.Cat = "host"
+	}
+	if f.file != "" {
+		event.Args = map[string]string{"file": f.file}
+	}
+	return event
+}
+
+func writeChromeTrace(w io.Writer, events []chromeTraceEvent, dropped int) error {
+	b := bufio.NewWriter(w)
+	b.WriteString(`{"displayTimeUnit":"ns",`)
+	if dropped > 0 {
+		fmt.Fprintf(b, `"otherData":{"dropped_events":%d},`, dropped)
+	}
+	b.WriteString(`"traceEvents":[`)
+
+	enc := json.NewEncoder(b)
+	for i, event := range events {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		if err := enc.Encode(event); err != nil {
+			return err
+		}
+	}
+
+	b.WriteString("]}\n")
+	return b.Flush()
+}
@@ -0,0 +1,82 @@
+package wzprof
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+	"github.com/tetratelabs/wazero/experimental/wazerotest"
+)
+
+func TestTracerWriteTrace(t *testing.T) {
+	currentTime := int64(0)
+
+	tracer := ProfilingFor(nil).Tracer(MaxTraceEvents(2))
+	tracer.time, tracer.start = func() int64 { return currentTime }, 0
+
+	outer := wazerotest.NewFunction(func(context.Context, api.Module) {})
+	outer.FunctionName = "outer"
+	inner := wazerotest.NewFunction(func(context.Context, api.Module) {})
+	inner.FunctionName = "inner"
+
+	module := wazerotest.NewModule(nil, outer, inner)
+	def0 := module.Function(0).Definition()
+	def1 := module.Function(1).Definition()
+	f0 := tracer.NewFunctionListener(def0)
+	f1 := tracer.NewFunctionListener(def1)
+
+	stack0 := []experimental.StackFrame{{Function: module.Function(0)}}
+	stack1 := []experimental.StackFrame{{Function: module.Function(1)}, {Function: module.Function(0)}}
+
+	ctx := context.Background()
+	currentTime = 1000
+	f0.Before(ctx, module, def0, nil, experimental.NewStackIterator(stack0...))
+	currentTime = 3000
+	f1.Before(ctx, module, def1, nil, experimental.NewStackIterator(stack1...))
+	currentTime = 4500
+	f1.After(ctx, module, def1, nil)
+	currentTime = 6000
+	f0.After(ctx, module, def0, nil)
+	// Dropped, the tracer is limited to two events.
+	f1.Before(ctx, module, def1, nil, experimental.NewStackIterator(stack1...))
+	f1.After(ctx, module, def1, nil)
+
+	if n := tracer.Count(); n != 2 {
+		t.Fatalf("wrong number of events: want 2, got %d", n)
+	}
+
+	var b bytes.Buffer
+	if err := tracer.WriteTrace(&b); err != nil {
+		t.Fatal(err)
+	}
+
+	var trace struct {
+		OtherData struct {
+			DroppedEvents int `json:"dropped_events"`
+		} `json:"otherData"`
+		TraceEvents []chromeTraceEvent `json:"traceEvents"`
+	}
+	if err := json.Unmarshal(b.Bytes(), &trace); err != nil {
+		t.Fatalf("invalid trace: %s\n%s", err, b.String())
+	}
+
+	if trace.OtherData.DroppedEvents != 1 {
+		t.Errorf("wrong number of dropped events: want 1, got %d", trace.OtherData.DroppedEvents)
+	}
+
+	want := []chromeTraceEvent{
+		{Name: "outer", Cat: "host", Ph: "X", Ts: 1, Dur: 5, Pid: 1, Tid: 1},
+		{Name: "inner", Cat: "host", Ph: "X", Ts: 3, Dur: 1.5, Pid: 1, Tid: 1},
+	}
+	if len(trace.TraceEvents) != len(want) {
+		t.Fatalf("wrong number of trace events: want %d, got %d", len(want), len(trace.TraceEvents))
+	}
+	for i, e := range trace.TraceEvents {
+		if e.Name != want[i].Name || e.Cat != want[i].Cat || e.Ph != want[i].Ph || e.Ts != want[i].Ts || e.Dur != want[i].Dur {
+			t.Errorf("wrong trace event %d: want %+v, got %+v", i, want[i], e)
+		}
+	}
+}
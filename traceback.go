@@ -150,10 +150,9 @@ type unwinder struct {
 	flags unwindFlags
 }
 
-const (
-	goarchPtrSize = 8 // https://github.com/golang/go/blob/bd3f44e4ffe54e9cf841ebc8356e403bb38436bd/src/internal/goarch/goarch.go#L33
-	sysPCQuantum  = 1 // https://github.com/golang/go/blob/49ad23a6d23d6cc1666c22e4bc215f25f717b569/src/internal/goarch/goarch_wasm.go
-)
+// The size of pointers (goarch.PtrSize) is not a constant here, it is read
+// from the pclntab header of the guest.
+const sysPCQuantum = 1 // https://github.com/golang/go/blob/49ad23a6d23d6cc1666c22e4bc215f25f717b569/src/internal/goarch/goarch_wasm.go
 
 func (u *unwinder) initAt(pc0, sp0, lr0 ptr64, gp gptr, flags unwindFlags) {
 	if pc0 == ptr64(^uint64(0)) && sp0 == ptr64(^uint64(0)) {
@@ -167,8 +166,8 @@ func (u *unwinder) initAt(pc0, sp0, lr0 ptr64, gp gptr, flags unwindFlags) {
 	// If the PC is zero, it's likely a nil function call.
 	// Start in the caller's frame.
 	if frame.pc == 0 {
-		frame.pc = deref[ptr64](u.mem, frame.sp)
-		frame.sp += goarchPtrSize
+		frame.pc = u.symbols.derefPtr(u.mem, frame.sp)
+		frame.sp += u.symbols.ptrSize
 	}
 
 	f := u.symbols.FindFunc(frame.pc)
@@ -234,7 +233,7 @@ func (u *unwinder) resolveInternal(innermost bool) {
 		// We also defensively check that this won't switch M's on us,
 		// which could happen at critical points in the scheduler.
 		// This ensures gp.m doesn't change from a stack jump.
-		if u.flags&unwindJumpStack != 0 && gp == gMG0(u.mem, gp) && gMCurg(u.mem, gp) != 0 && ptr64(gMCurg(u.mem, gp)) == gM(u.mem, gp) {
+		if u.flags&unwindJumpStack != 0 && gp == u.symbols.gMG0(u.mem, gp) && u.symbols.gMCurg(u.mem, gp) != 0 && ptr64(u.symbols.gMCurg(u.mem, gp)) == u.symbols.gM(u.mem, gp) {
 			switch f.FuncID {
 			case goruntime.FuncID_morestack:
 				// morestack does not return normally -- newstack()
@@ -242,25 +241,25 @@ func (u *unwinder) resolveInternal(innermost bool) {
 				// This keeps morestack() from showing up in the backtrace,
 				// but that makes some sense since it'll never be returned
 				// to.
-				gp = gMCurg(u.mem, gp)
+				gp = u.symbols.gMCurg(u.mem, gp)
 				u.g = gp
-				frame.pc = gSchedPc(u.mem, gp)
+				frame.pc = u.symbols.gSchedPc(u.mem, gp)
 				frame.fn = u.symbols.FindFunc(frame.pc)
 				f = frame.fn
 				flag = f.Flag
-				frame.lr = gSchedLr(u.mem, gp)
-				frame.sp = gSchedSp(u.mem, gp)
+				frame.lr = u.symbols.gSchedLr(u.mem, gp)
+				frame.sp = u.symbols.gSchedSp(u.mem, gp)
 			case goruntime.FuncID_systemstack:
 				// systemstack returns normally, so just follow the
 				// stack transition.
-				gp = gMCurg(u.mem, gp)
+				gp = u.symbols.gMCurg(u.mem, gp)
 				u.g = gp
-				frame.sp = gSchedSp(u.mem, gp)
+				frame.sp = u.symbols.gSchedSp(u.mem, gp)
 				flag &^= goruntime.FuncFlagSPWrite
 			}
 		}
 		frame.fp = frame.sp + ptr64(funcspdelta(f, frame.pc))
-		frame.fp += goarchPtrSize
+		frame.fp += u.symbols.ptrSize
 	}
 
 	// Derive link register.
@@ -293,14 +292,14 @@ func (u *unwinder) resolveInternal(innermost bool) {
 	} else {
 		var lrPtr ptr64
 		if frame.lr == 0 {
-			lrPtr = frame.fp - goarchPtrSize
-			frame.lr = deref[ptr64](u.mem, lrPtr)
+			lrPtr = frame.fp - u.symbols.ptrSize
+			frame.lr = u.symbols.derefPtr(u.mem, lrPtr)
 		}
 	}
 
 	frame.varp = frame.fp
 	// On [wasm], call instruction pushes return PC before entering new function.
-	frame.varp -= goarchPtrSize
+	frame.varp -= u.symbols.ptrSize
 }
 
 func (u *unwinder) next() {
@@ -326,15 +325,9 @@ func (u *unwinder) next() {
 		panic("traceback stuck")
 	}
 
-	injectedCall := f.FuncID == goruntime.FuncID_sigpanic || f.FuncID == goruntime.FuncID_asyncPreempt || f.FuncID == goruntime.FuncID_debugCallV2
-	if injectedCall {
-		u.flags |= unwindTrap
-	} else {
-		u.flags &^= unwindTrap
-	}
+	u.leave(f)
 
 	// Unwind to next frame.
-	u.calleeFuncID = f.FuncID
 	frame.fn = flr
 	frame.pc = frame.lr
 	frame.lr = 0
@@ -344,6 +337,18 @@ func (u *unwinder) next() {
 	u.resolveInternal(false)
 }
 
+// leave updates the flags and callee of the unwinder when moving from the
+// frame of f to its caller.
+func (u *unwinder) leave(f funcInfo) {
+	injectedCall := f.FuncID == goruntime.FuncID_sigpanic || f.FuncID == goruntime.FuncID_asyncPreempt || f.FuncID == goruntime.FuncID_debugCallV2
+	if injectedCall {
+		u.flags |= unwindTrap
+	} else {
+		u.flags &^= unwindTrap
+	}
+	u.calleeFuncID = f.FuncID
+}
+
 // finishInternal is an unwinder-internal helper called after the stack has been
 // exhausted. It sets the unwinder to an invalid state.
 func (u *unwinder) finishInternal() {
@@ -452,27 +457,26 @@ type inlinedCall struct {
 
 type inlineUnwinder struct {
 	symbols *pclntab
-	mem     vmem
 	f       funcInfo
-	inlTree ptr64 // Address of the array of inlinedCall entries
+	inlTree []inlinedCall // Copy of the inline tree, see buildInlineTrees
 }
 
 // next returns the frame representing uf's logical caller.
 func (u *inlineUnwinder) next(uf inlineFrame) inlineFrame {
-	if uf.index < 0 {
+	if uf.index < 0 || int(uf.index) >= len(u.inlTree) {
 		uf.pc = 0
 		return uf
 	}
-	c := derefArrayIndex[inlinedCall](u.mem, u.inlTree, uf.index)
+	c := u.inlTree[uf.index]
 	return u.resolveInternal(u.f.entry() + ptr64(c.parentPc))
 }
 
 // srcFunc returns the srcFunc representing the given frame.
 func (u *inlineUnwinder) srcFunc(uf inlineFrame) srcFunc {
-	if uf.index < 0 {
+	if uf.index < 0 || int(uf.index) >= len(u.inlTree) {
 		return u.f.srcFunc()
 	}
-	t := derefArrayIndex[inlinedCall](u.mem, u.inlTree, uf.index)
+	t := u.inlTree[uf.index]
 	return srcFunc{
 		datap:     u.f.md,
 		nameOff:   t.nameOff,
@@ -506,12 +510,12 @@ func (uf inlineFrame) valid() bool {
 	return uf.pc != 0
 }
 
-func newInlineUnwinder(symbols *pclntab, mem vmem, f funcInfo, pc ptr64) (inlineUnwinder, inlineFrame) {
-	inldataAddr := funcdata(symbols, f, goruntime.FUNCDATA_InlTree)
-	if inldataAddr == 0 {
-		return inlineUnwinder{symbols: symbols, mem: mem, f: f}, inlineFrame{pc: pc, index: -1}
+func newInlineUnwinder(symbols *pclntab, f funcInfo, pc ptr64) (inlineUnwinder, inlineFrame) {
+	inlTree := symbols.inlineTrees[f._funcoff]
+	if inlTree == nil {
+		return inlineUnwinder{symbols: symbols, f: f}, inlineFrame{pc: pc, index: -1}
 	}
-	u := inlineUnwinder{symbols: symbols, mem: mem, f: f, inlTree: inldataAddr}
+	u := inlineUnwinder{symbols: symbols, f: f, inlTree: inlTree}
 	return u, u.resolveInternal(pc)
 }
 
@@ -521,7 +525,7 @@ func funcdata(symbols *pclntab, f funcInfo, i uint8) ptr64 {
 	if i >= f.Nfuncdata {
 		return 0
 	}
-	base := symbols.md.gofunc
+	base := f.md.gofunc
 	off := funcdataoffset(f, i)
 
 	// Return off == ^uint32(0) ? 0 : f.datap.gofunc + uintptr(off), but without branches.
@@ -0,0 +1,81 @@
+package wzprof
+
+import (
+	"context"
+	"errors"
+
+	"github.com/google/pprof/profile"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+	"github.com/tetratelabs/wazero/sys"
+)
+
+// TrapHook returns a function listener factory invoking fn when a trap of the
+// guest, like an unreachable instruction or an out-of-bounds memory access, or
+// a panic of a host function aborts a call.
+//
+// fn receives the error and the stack of the guest, symbolized like the stacks
+// of the profiles, starting with the innermost call. The stacks are recorded
+// when calls start, the innermost location is the function where the trap
+// happened, and the other ones are the calls made by the functions of the
+// stack. Exits of the guest, including the ones caused by the cancellation of
+// the context, are not traps.
+//
+// Recording the stacks slows down all calls, like the CPU profiler does. The
+// listeners must not be sampled, the stacks would be incomplete otherwise.
+func (p *Profiling) TrapHook(fn func(ctx context.Context, err error, stack []*profile.Location)) experimental.FunctionListenerFactory {
+	h := &trapHook{p: p, fn: fn}
+	return experimental.FunctionListenerFactoryFunc(func(def api.FunctionDefinition) experimental.FunctionListener {
+		if !p.listensTo(def) {
+			return nil
+		}
+		return profilingListener{p, h}
+	})
+}
+
+type trapHook struct {
+	p      *Profiling
+	fn     func(context.Context, error, []*profile.Location)
+	traces []stackTrace
+	pool   stackTracePool
+	// True while the calls aborted by a trap are unwound, so fn is invoked
+	// once, by the innermost call.
+	aborting bool
+}
+
+func (h *trapHook) Before(ctx context.Context, _ api.Module, _ api.FunctionDefinition, _ []uint64, si experimental.StackIterator) {
+	h.traces = append(h.traces, makeStackTrace(ctx, h.pool.get(), si))
+	h.aborting = false
+}
+
+func (h *trapHook) After(context.Context, api.Module, api.FunctionDefinition, []uint64) {
+	h.pop()
+}
+
+func (h *trapHook) Abort(ctx context.Context, _ api.Module, _ api.FunctionDefinition, err error) {
+	trace := h.pop()
+	if h.aborting || errors.Is(err, ErrTailCall) || err == errAsyncifyUnwind {
+		return
+	}
+	h.aborting = true
+	var exitErr *sys.ExitError
+	if errors.As(err, &exitErr) {
+		return
+	}
+	funcs := make(map[string]*profile.Function)
+	arena := &profileArena{}
+	stack := make([]*profile.Location, trace.len())
+	for i := range stack {
+		frame := trace.index(i)
+		stack[i] = locationForCall(h.p, frame.fn, frame.pc, funcs, arena)
+	}
+	h.fn(ctx, err, stack)
+}
+
+func (h *trapHook) pop() stackTrace {
+	i := len(h.traces) - 1
+	trace := h.traces[i]
+	h.traces = h.traces[:i]
+	h.pool.put(trace)
+	return trace
+}
@@ -0,0 +1,74 @@
+package wzprof
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/google/pprof/profile"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/experimental"
+)
+
+// wasmTrap is a module exporting the crash function, which calls the inner
+// function executing an unreachable instruction.
+var wasmTrap = []byte{
+	0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00,
+	0x01, 0x04, 0x01, 0x60, 0x00, 0x00, // type section: () -> ()
+	0x03, 0x03, 0x02, 0x00, 0x00, // function section
+	0x07, 0x09, 0x01, 0x05, 'c', 'r', 'a', 's', 'h', 0x00, 0x00, // export section
+	0x0a, 0x0a, 0x02, // code section
+	0x04, 0x00, 0x10, 0x01, 0x0b, // crash: call inner
+	0x03, 0x00, 0x00, 0x0b, // inner: unreachable
+	0x00, 0x16, 0x04, 'n', 'a', 'm', 'e', // name section
+	0x01, 0x0f, 0x02,
+	0x00, 0x05, 'c', 'r', 'a', 's', 'h',
+	0x01, 0x05, 'i', 'n', 'n', 'e', 'r',
+}
+
+func TestTrapHook(t *testing.T) {
+	p := ProfilingFor(wasmTrap)
+
+	var trapErr error
+	var stack []*profile.Location
+	calls := 0
+	hook := p.TrapHook(func(ctx context.Context, err error, s []*profile.Location) {
+		calls++
+		trapErr, stack = err, s
+	})
+
+	ctx := context.WithValue(context.Background(), experimental.FunctionListenerFactoryKey{}, hook)
+	r := wazero.NewRuntime(ctx)
+	defer r.Close(ctx)
+
+	mod, err := r.CompileModule(ctx, wasmTrap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Prepare(mod); err != nil {
+		t.Fatal(err)
+	}
+	instance, err := r.InstantiateModule(ctx, mod, wazero.NewModuleConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := instance.ExportedFunction("crash").Call(ctx); err == nil {
+		t.Fatal("no trap")
+	}
+
+	if calls != 1 {
+		t.Fatalf("hook called %d times", calls)
+	}
+	if !strings.Contains(trapErr.Error(), "unreachable") {
+		t.Errorf("wrong error: %v", trapErr)
+	}
+	var names []string
+	for _, loc := range stack {
+		for _, line := range loc.Line {
+			names = append(names, line.Function.Name)
+		}
+	}
+	if got := strings.Join(names, " "); got != "inner crash" {
+		t.Errorf("wrong stack: %s", got)
+	}
+}
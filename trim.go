@@ -0,0 +1,178 @@
+package wzprof
+
+import (
+	"github.com/google/pprof/profile"
+	"golang.org/x/exp/slices"
+)
+
+// otherFunctionName is the name of the function of the sample aggregating the
+// samples removed from trimmed profiles.
+const otherFunctionName = "[other]"
+
+// ProfileLimits bounds the size of profiles, so they can be scraped over
+// constrained links even for guests recording many distinct stacks. The samples
+// which do not fit in the limits are aggregated in a sample of the "[other]"
+// function, so the totals of the profiles are preserved.
+type ProfileLimits struct {
+	// Samples of values below this fraction of the total value of the
+	// profile are removed. Zero keeps all the samples.
+	MinFraction float64
+	// Maximum number of samples kept in profiles, in addition to the one of
+	// the "[other]" function; the samples of the highest values are kept.
+	// Zero disables the limit.
+	MaxStacks int
+	// Type of the values the samples are compared by, default to the last
+	// sample type of profiles, which pprof displays by default. The profiles
+	// built by profilers which do not have this sample type are compared by
+	// their default one.
+	SampleType string
+}
+
+func (l ProfileLimits) enabled() bool {
+	return l.MinFraction > 0 || l.MaxStacks > 0
+}
+
+// SetProfileLimits configures the limits applied to the profiles built by the
+// profilers, after the sampling ratios and value transforms.
+//
+// Default to no limits.
+func (p *Profiling) SetProfileLimits(limits ProfileLimits) {
+	p.limits = limits
+}
+
+// trimProfile applies the limits of p to a profile built by one of its
+// profilers.
+func (p *Profiling) trimProfile(prof *profile.Profile) {
+	limits := p.limits
+	if _, err := sampleTypeIndex(prof, limits.SampleType); err != nil {
+		limits.SampleType = ""
+	}
+	// The profiles built by profilers always have sample types.
+	_ = TrimProfile(prof, limits)
+}
+
+// TrimProfile removes the samples of prof which do not fit in the limits, and
+// adds their values to a single sample of the "[other]" function. The
+// locations and functions referenced only by the removed samples are removed
+// as well.
+func TrimProfile(prof *profile.Profile, limits ProfileLimits) error {
+	if !limits.enabled() {
+		return nil
+	}
+	index, err := sampleTypeIndex(prof, limits.SampleType)
+	if err != nil {
+		return err
+	}
+
+	keep := prof.Sample
+	if limits.MinFraction > 0 {
+		var total int64
+		for _, s := range prof.Sample {
+			total += abs(s.Value[index])
+		}
+		min := int64(limits.MinFraction * float64(total))
+		keep = make([]*profile.Sample, 0, len(prof.Sample))
+		for _, s := range prof.Sample {
+			if abs(s.Value[index]) >= min {
+				keep = append(keep, s)
+			}
+		}
+	}
+	if limits.MaxStacks > 0 && len(keep) > limits.MaxStacks {
+		if len(keep) == len(prof.Sample) {
+			keep = slices.Clone(keep)
+		}
+		slices.SortStableFunc(keep, func(a, b *profile.Sample) bool {
+			return abs(a.Value[index]) > abs(b.Value[index])
+		})
+		keep = keep[:limits.MaxStacks]
+	}
+	if len(keep) == len(prof.Sample) {
+		return nil
+	}
+
+	kept := make(map[*profile.Sample]struct{}, len(keep))
+	for _, s := range keep {
+		kept[s] = struct{}{}
+	}
+	other := &profile.Sample{Value: make([]int64, len(prof.SampleType))}
+	samples := make([]*profile.Sample, 0, len(keep)+1)
+	for _, s := range prof.Sample {
+		if _, ok := kept[s]; ok {
+			samples = append(samples, s)
+			continue
+		}
+		for i, v := range s.Value {
+			other.Value[i] += v
+		}
+	}
+	prof.Sample = samples
+	pruneProfile(prof)
+
+	var maxFunctionID, maxLocationID uint64
+	for _, fn := range prof.Function {
+		if fn.ID > maxFunctionID {
+			maxFunctionID = fn.ID
+		}
+	}
+	for _, loc := range prof.Location {
+		if loc.ID > maxLocationID {
+			maxLocationID = loc.ID
+		}
+	}
+	fn := &profile.Function{
+		ID:         maxFunctionID + 1,
+		Name:       otherFunctionName,
+		SystemName: otherFunctionName,
+	}
+	loc := &profile.Location{
+		ID:   maxLocationID + 1,
+		Line: []profile.Line{{Function: fn}},
+	}
+	if len(prof.Mapping) > 0 {
+		loc.Mapping = prof.Mapping[0]
+	}
+	prof.Function = append(prof.Function, fn)
+	prof.Location = append(prof.Location, loc)
+	other.Location = []*profile.Location{loc}
+	prof.Sample = append(prof.Sample, other)
+	return nil
+}
+
+// pruneProfile removes the locations and functions of prof which are not
+// referenced by its samples.
+func pruneProfile(prof *profile.Profile) {
+	locations := make(map[*profile.Location]struct{}, len(prof.Location))
+	for _, s := range prof.Sample {
+		for _, loc := range s.Location {
+			locations[loc] = struct{}{}
+		}
+	}
+	functions := make(map[*profile.Function]struct{}, len(prof.Function))
+	i := 0
+	for _, loc := range prof.Location {
+		if _, ok := locations[loc]; ok {
+			for _, line := range loc.Line {
+				functions[line.Function] = struct{}{}
+			}
+			prof.Location[i] = loc
+			i++
+		}
+	}
+	prof.Location = prof.Location[:i]
+	i = 0
+	for _, fn := range prof.Function {
+		if _, ok := functions[fn]; ok {
+			prof.Function[i] = fn
+			i++
+		}
+	}
+	prof.Function = prof.Function[:i]
+}
+
+func abs(v int64) int64 {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
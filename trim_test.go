@@ -0,0 +1,148 @@
+package wzprof
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/google/pprof/profile"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental/wazerotest"
+)
+
+func trimTestProfile() *profile.Profile {
+	mapping := &profile.Mapping{ID: 1, File: "test.wasm"}
+	prof := &profile.Profile{
+		SampleType: []*profile.ValueType{
+			{Type: "samples", Unit: "count"},
+			{Type: "cpu", Unit: "nanoseconds"},
+		},
+		Mapping: []*profile.Mapping{mapping},
+	}
+	for i, v := range []int64{10, 50, 5, 30, 5} {
+		fn := &profile.Function{ID: uint64(i + 1), Name: string(rune('a' + i))}
+		loc := &profile.Location{ID: uint64(i + 1), Mapping: mapping, Line: []profile.Line{{Function: fn}}}
+		prof.Function = append(prof.Function, fn)
+		prof.Location = append(prof.Location, loc)
+		prof.Sample = append(prof.Sample, &profile.Sample{
+			Location: []*profile.Location{loc},
+			Value:    []int64{1, v},
+		})
+	}
+	return prof
+}
+
+func TestTrimProfile(t *testing.T) {
+	tests := []struct {
+		name   string
+		limits ProfileLimits
+		want   []string
+		other  []int64
+	}{
+		{
+			name: "no limits",
+			want: []string{"a", "b", "c", "d", "e"},
+		},
+		{
+			name:   "max stacks",
+			limits: ProfileLimits{MaxStacks: 2},
+			want:   []string{"b", "d", otherFunctionName},
+			other:  []int64{3, 20},
+		},
+		{
+			name:   "min fraction",
+			limits: ProfileLimits{MinFraction: 0.1},
+			want:   []string{"a", "b", "d", otherFunctionName},
+			other:  []int64{2, 10},
+		},
+		{
+			name:   "both",
+			limits: ProfileLimits{MinFraction: 0.1, MaxStacks: 1},
+			want:   []string{"b", otherFunctionName},
+			other:  []int64{4, 50},
+		},
+		{
+			name:   "sample type",
+			limits: ProfileLimits{MaxStacks: 2, SampleType: "samples"},
+			want:   []string{"a", "b", otherFunctionName},
+			other:  []int64{3, 40},
+		},
+		{
+			name:   "larger than profile",
+			limits: ProfileLimits{MaxStacks: 5},
+			want:   []string{"a", "b", "c", "d", "e"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			prof := trimTestProfile()
+			if err := TrimProfile(prof, test.limits); err != nil {
+				t.Fatal(err)
+			}
+			if err := prof.CheckValid(); err != nil {
+				t.Fatal(err)
+			}
+
+			var names []string
+			var total int64
+			for _, s := range prof.Sample {
+				name := s.Location[0].Line[0].Function.Name
+				names = append(names, name)
+				total += s.Value[1]
+				if name == otherFunctionName && (s.Value[0] != test.other[0] || s.Value[1] != test.other[1]) {
+					t.Errorf("wrong values of the %s sample: want %v, got %v", otherFunctionName, test.other, s.Value)
+				}
+			}
+			if len(names) != len(test.want) {
+				t.Fatalf("wrong samples: want %q, got %q", test.want, names)
+			}
+			for i := range names {
+				if names[i] != test.want[i] {
+					t.Fatalf("wrong samples: want %q, got %q", test.want, names)
+				}
+			}
+			if total != 100 {
+				t.Errorf("total value not preserved: %d", total)
+			}
+			if len(prof.Location) != len(test.want) || len(prof.Function) != len(test.want) {
+				t.Errorf("unused locations or functions: %d locations, %d functions", len(prof.Location), len(prof.Function))
+			}
+		})
+	}
+
+	if err := TrimProfile(trimTestProfile(), ProfileLimits{MaxStacks: 1, SampleType: "alloc_space"}); err == nil {
+		t.Error("profile trimmed by a missing sample type")
+	}
+}
+
+func TestProfilingProfileLimits(t *testing.T) {
+	module := wazerotest.NewModule(nil,
+		wazerotest.NewFunction(func(context.Context, api.Module) {}),
+		wazerotest.NewFunction(func(context.Context, api.Module) {}),
+	)
+	p := ProfilingFor(nil)
+	p.SetProfileLimits(ProfileLimits{MaxStacks: 10, SampleType: "cpu"})
+	mem := p.MemoryProfiler()
+	for i, si := range benchmarkStacks(module, 100, 4) {
+		mem.observeAlloc(0, uint64(i+1), makeStackTrace(context.Background(), stackTrace{}, si.reset()))
+	}
+
+	prof := mem.NewProfile(1)
+	if len(prof.Sample) != 11 {
+		t.Errorf("wrong number of samples: want 11, got %d", len(prof.Sample))
+	}
+
+	// Streaming the samples falls back to writing the trimmed profile.
+	var b bytes.Buffer
+	if err := mem.WriteProfile(context.Background(), &b, 1); err != nil {
+		t.Fatal(err)
+	}
+	prof, err := profile.Parse(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(prof.Sample) != 11 {
+		t.Errorf("wrong number of written samples: want 11, got %d", len(prof.Sample))
+	}
+}
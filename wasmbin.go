@@ -1,8 +1,12 @@
 package wzprof
 
 import (
+	"crypto/sha256"
 	"encoding/binary"
+	"encoding/hex"
 	"fmt"
+	"log"
+	"math"
 )
 
 // Returns true if the wasm module binary b contains a custom section with this
@@ -39,6 +43,72 @@ func wasmCustomSection(b []byte, name string) []byte {
 	return nil
 }
 
+// wasmBuildID returns the build id of the module in hexadecimal. It is read from
+// the build_id custom section when the toolchain emitted one, and derived from
+// the hash of the module otherwise.
+func wasmBuildID(b []byte) string {
+	if s := wasmCustomSection(b, "build_id"); s != nil {
+		// The content of the section is a vector of bytes.
+		n, r := binary.Uvarint(s)
+		if r > 0 && n <= uint64(len(s)-r) && n > 0 {
+			return hex.EncodeToString(s[r : r+int(n)])
+		}
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:20])
+}
+
+// wasmFunctionNames returns the names recorded in the "name" custom section of
+// the module, indexed by function id. Returns nil if the module does not have
+// a name section or if it does not contain function names.
+func wasmFunctionNames(b []byte) map[uint32]string {
+	const functionNamesSubsectionId = 1
+
+	b = wasmCustomSection(b, "name")
+	for len(b) > 1 {
+		id := b[0]
+		b = b[1:]
+		length, n := binary.Uvarint(b)
+		b = b[n:]
+		if length > uint64(len(b)) {
+			return nil
+		}
+		if id != functionNamesSubsectionId {
+			b = b[length:]
+			continue
+		}
+
+		b = b[:length]
+		count, n := binary.Uvarint(b)
+		b = b[n:]
+		names := make(map[uint32]string, count)
+		for i := uint64(0); i < count && len(b) > 0; i++ {
+			index, n := binary.Uvarint(b)
+			b = b[n:]
+			nameLen, n := binary.Uvarint(b)
+			b = b[n:]
+			if nameLen > uint64(len(b)) {
+				break
+			}
+			names[uint32(index)] = string(b[:nameLen])
+			b = b[nameLen:]
+		}
+		return names
+	}
+	return nil
+}
+
+// wasmHasFunctionName returns true if the name section of the module contains
+// a function with this name.
+func wasmHasFunctionName(b []byte, name string) bool {
+	for _, n := range wasmFunctionNames(b) {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
 // The functions in this file inspect the contents of a well-formed wasm-binary.
 // They are very weak parsers: they should be called on a valid module, or may
 // panic. Eventually this code should be replaced by exposing the right APIs
@@ -64,19 +134,189 @@ func wasmdataSection(b []byte) []byte {
 	return nil
 }
 
+// wasmSection returns the content of the first section of the module with the
+// given id, or nil if there is none.
+func wasmSection(b []byte, id byte) []byte {
+	if len(b) < 8 {
+		return nil
+	}
+	b = b[8:] // skip magic+version
+	for len(b) > 2 {
+		sectionId := b[0]
+		length, n := binary.Uvarint(b[1:])
+		b = b[1+n:]
+		if length > uint64(len(b)) {
+			return nil
+		}
+		if sectionId == id {
+			return b[:length]
+		}
+		b = b[length:]
+	}
+	return nil
+}
+
+// wasmImportedFunctions returns the number of functions imported by the module,
+// which come first in the index space of the functions.
+func wasmImportedFunctions(b []byte) uint32 {
+	const importSectionId = 2
+
+	r := wasmReader{b: wasmSection(b, importSectionId)}
+	functions := uint32(0)
+	for n := r.uvarint(); n > 0 && r.ok(); n-- {
+		r.skip(int(r.uvarint())) // module
+		r.skip(int(r.uvarint())) // name
+		switch r.byte() {
+		case 0x00: // function
+			r.uvarint()
+			functions++
+		case 0x01: // table
+			r.byte()
+			r.limits()
+		case 0x02: // memory
+			r.limits()
+		case 0x03: // global
+			r.byte()
+			r.byte()
+		case 0x04: // tag
+			r.byte()
+			r.uvarint()
+		}
+	}
+	return functions
+}
+
+// wasmMemory64 returns true if the memory of the module, defined or imported,
+// is addressed with 64 bits (memory64 proposal).
+func wasmMemory64(b []byte) bool {
+	const importSectionId = 2
+	const memorySectionId = 5
+	const memory64Flag = 0x04
+
+	r := wasmReader{b: wasmSection(b, importSectionId)}
+	for n := r.uvarint(); n > 0 && r.ok(); n-- {
+		r.skip(int(r.uvarint())) // module
+		r.skip(int(r.uvarint())) // name
+		switch r.byte() {
+		case 0x00: // function
+			r.uvarint()
+		case 0x01: // table
+			r.byte()
+			r.limits()
+		case 0x02: // memory
+			if len(r.b) > 0 && r.b[0]&memory64Flag != 0 {
+				return true
+			}
+			r.limits()
+		case 0x03: // global
+			r.byte()
+			r.byte()
+		case 0x04: // tag
+			r.byte()
+			r.uvarint()
+		}
+	}
+
+	r = wasmReader{b: wasmSection(b, memorySectionId)}
+	for n := r.uvarint(); n > 0 && r.ok(); n-- {
+		if len(r.b) > 0 && r.b[0]&memory64Flag != 0 {
+			return true
+		}
+		r.limits()
+	}
+	return false
+}
+
+// wasmExportedFunction returns the index of the function exported with this
+// name by the module.
+func wasmExportedFunction(b []byte, name string) (uint32, bool) {
+	const exportSectionId = 7
+
+	r := wasmReader{b: wasmSection(b, exportSectionId)}
+	for n := r.uvarint(); n > 0 && r.ok(); n-- {
+		size := int(r.uvarint())
+		if size > len(r.b) {
+			break
+		}
+		exportName := string(r.b[:size])
+		r.skip(size)
+		kind := r.byte()
+		index := r.uvarint()
+		if kind == 0x00 && exportName == name && r.ok() {
+			return uint32(index), true
+		}
+	}
+	return 0, false
+}
+
+// wasmAsyncifyState returns the index of the global holding the state of the
+// asyncify transform of binaryen (used by TinyGo to switch goroutines), which
+// the asyncify_get_state function exported by the transformed modules returns.
+func wasmAsyncifyState(b []byte) (global uint32, ok bool) {
+	getState, ok := wasmExportedFunction(b, "asyncify_get_state")
+	if !ok {
+		return 0, false
+	}
+	ok = false
+	wasmFunctionBodies(b, func(index uint32, body []byte) bool {
+		if index != getState {
+			return true
+		}
+		// The body has no locals, and only reads the global.
+		r := wasmReader{b: body}
+		if r.uvarint() == 0 && r.byte() == 0x23 { // global.get
+			global = uint32(r.uvarint())
+			ok = r.byte() == 0x0B && r.ok() // end
+		}
+		return false
+	})
+	return global, ok
+}
+
+// wasmCodeSectionOffset returns the offset of the contents of the WASM "Code"
+// section in the module. Returns 0 if the section does not exist.
+func wasmCodeSectionOffset(b []byte) uint64 {
+	const codeSectionId = 10
+
+	offset := uint64(8) // skip magic+version
+	b = b[8:]
+	for len(b) > 2 {
+		id := b[0]
+		length, n := binary.Uvarint(b[1:])
+		offset += 1 + uint64(n)
+		b = b[1+n:]
+
+		if id == codeSectionId {
+			return offset
+		}
+		offset += length
+		b = b[length:]
+	}
+	return 0
+}
+
 // dataIterator iterates over the segments contained in a wasm Data section.
-// Only support mode 0 (memory 0 + offset) segments.
+// Only active segments of memory 0 with a constant offset are returned, other
+// segments cannot be mapped to an address before the module runs and are
+// skipped.
+//
+// The data section comes from the module being profiled and may be malformed.
+// The iteration stops at the first invalid segment, and the error is reported
+// by Err.
 type dataIterator struct {
-	b []byte // remaining bytes in the Data section
-	n uint64 // number of segments
+	b   []byte // remaining bytes in the Data section
+	n   uint64 // number of segments
+	err error
 
 	offset int // offset of b in the Data section.
 }
 
-// newDataIterator prepares an iterator using the bytes of a well-formed data
-// section.
+// newDataIterator prepares an iterator using the bytes of a data section.
 func newDataIterator(b []byte) dataIterator {
 	segments, r := binary.Uvarint(b)
+	if r <= 0 {
+		return dataIterator{err: fmt.Errorf("invalid number of data segments")}
+	}
 	return dataIterator{
 		b:      b[r:],
 		n:      segments,
@@ -84,7 +324,23 @@ func newDataIterator(b []byte) dataIterator {
 	}
 }
 
+// Err returns the error that stopped the iteration, if any.
+func (d *dataIterator) Err() error {
+	return d.err
+}
+
+func (d *dataIterator) fail(err error) {
+	if d.err == nil {
+		d.err = err
+	}
+	d.b, d.n = nil, 0
+}
+
 func (d *dataIterator) read(n int) (b []byte) {
+	if n < 0 || n > len(d.b) {
+		d.fail(fmt.Errorf("data segment of %d bytes past the end of the data section at offset %d", n, d.offset))
+		return nil
+	}
 	b, d.b = d.b[:n], d.b[n:]
 	d.offset += n
 	return b
@@ -96,6 +352,10 @@ func (d *dataIterator) skip(n int) {
 }
 
 func (d *dataIterator) byte() byte {
+	if len(d.b) == 0 {
+		d.fail(fmt.Errorf("unexpected end of the data section at offset %d", d.offset))
+		return 0
+	}
 	b := d.b[0]
 	d.skip(1)
 	return b
@@ -103,10 +363,16 @@ func (d *dataIterator) byte() byte {
 
 func (d *dataIterator) varint() int64 {
 	x, n := sleb128(64, d.b)
+	if n <= 0 {
+		d.fail(fmt.Errorf("invalid signed integer in the data section at offset %d", d.offset))
+		return 0
+	}
 	d.skip(n)
 	return x
 }
 
+// sleb128 decodes a signed LEB128 integer from b. The returned count of bytes
+// read is zero if b ends before the integer does.
 func sleb128(size int, b []byte) (result int64, read int) {
 	// The difference between sleb128 and protobuf's binary.Varint is that
 	// the latter puts the sign at the least significant bit.
@@ -114,6 +380,9 @@ func sleb128(size int, b []byte) (result int64, read int) {
 
 	var byte byte
 	for {
+		if len(b) == 0 {
+			return 0, 0
+		}
 		byte = b[0]
 		read++
 		b = b[1:]
@@ -132,73 +401,164 @@ func sleb128(size int, b []byte) (result int64, read int) {
 
 func (d *dataIterator) uvarint() uint64 {
 	x, n := binary.Uvarint(d.b)
+	if n <= 0 {
+		d.fail(fmt.Errorf("invalid unsigned integer in the data section at offset %d", d.offset))
+		return 0
+	}
 	d.skip(n)
 	return x
 }
 
 // Next returns the bytes of the following segment, and its address in virtual
-// memory, or a nil slice if there are no more segment.
+// memory, or a nil slice if there are no more segment or the data section is
+// invalid.
 func (d *dataIterator) Next() (vaddr int64, seg []byte) {
-	if d.n == 0 {
-		return 0, nil
+	for d.n > 0 {
+		vaddr, seg, ok := d.next()
+		if ok {
+			return vaddr, seg
+		}
 	}
+	return 0, nil
+}
 
-	// Format of mode 0 segment:
+// next reads the following segment. The returned boolean is false if the
+// segment is not an active segment of memory 0 with a constant offset, or if
+// it is invalid.
+func (d *dataIterator) next() (vaddr int64, seg []byte, ok bool) {
+	// Format of segments:
 	//
-	// varuint32 - mode (1 byte, 0)
-	// byte      - i32.const (0x41)
-	// varint64  - virtual address
-	// byte      - end of expression (0x0B)
+	// varuint32 - mode (0, 1, or 2)
+	// varuint32 - memory index (mode 2 only)
+	// bytes     - offset expression, terminated by end (0x0B) (modes 0 and 2)
 	// varuint64 - length
 	// bytes     - raw bytes of the segment
+	//
+	// Mode 0 is an active segment of memory 0, mode 1 a passive segment
+	// copied by memory.init at runtime, and mode 2 an active segment with an
+	// explicit memory index.
 
 	mode := d.uvarint()
-	if mode != 0x0 {
-		panic(fmt.Errorf("unsupported mode %#x", mode))
-	}
-
-	v := d.byte()
-	if v != 0x41 {
-		panic(fmt.Errorf("expected constant i32.const (0x41); got %#x", v))
-	}
-
-	vaddr = d.varint()
-
-	v = d.byte()
-	if v != 0x0B {
-		panic(fmt.Errorf("expected end of expr (0x0B); got %#x", v))
+	ok = true
+	switch mode {
+	case 0:
+		vaddr, ok = d.offsetExpr()
+	case 1:
+		ok = false
+	case 2:
+		memidx := d.uvarint()
+		vaddr, ok = d.offsetExpr()
+		ok = ok && memidx == 0
+	default:
+		d.fail(fmt.Errorf("unsupported mode %#x of data segment at offset %d", mode, d.offset))
 	}
 
 	length := d.uvarint()
+	if length > uint64(len(d.b)) {
+		d.fail(fmt.Errorf("data segment of %d bytes past the end of the data section at offset %d", length, d.offset))
+	}
 	seg = d.read(int(length))
+	if d.err != nil {
+		return 0, nil, false
+	}
 	d.n--
 
-	return vaddr, seg
+	return vaddr, seg, ok
+}
+
+// offsetExpr evaluates the constant expression giving the offset of an active
+// segment. The returned boolean is false if the expression depends on globals,
+// in which case the offset is only known once the module is instantiated, or
+// if the expression is invalid.
+func (d *dataIterator) offsetExpr() (int64, bool) {
+	var stack []int64
+	constant := true
+
+	for d.err == nil {
+		switch op := d.byte(); op {
+		case 0x0B: // end
+			if !constant {
+				log.Printf("wasm: skipping data segment with an offset imported from a global")
+				return 0, false
+			}
+			if len(stack) != 1 || stack[0] < 0 {
+				d.fail(fmt.Errorf("invalid offset expression of data segment at offset %d", d.offset))
+				return 0, false
+			}
+			return stack[0], true
+		case 0x41, 0x42: // i32.const, i64.const
+			stack = append(stack, d.varint())
+		case 0x23: // global.get
+			d.uvarint()
+			stack = append(stack, 0)
+			constant = false
+		case 0x6A, 0x6B, 0x6C, 0x7C, 0x7D, 0x7E: // {i32,i64}.{add,sub,mul}
+			if len(stack) < 2 {
+				d.fail(fmt.Errorf("invalid offset expression of data segment at offset %d", d.offset))
+				return 0, false
+			}
+			n := len(stack) - 2
+			a, b := stack[n], stack[n+1]
+			switch op {
+			case 0x6A, 0x7C:
+				a += b
+			case 0x6B, 0x7D:
+				a -= b
+			default:
+				a *= b
+			}
+			if op < 0x7C {
+				a = int64(int32(a))
+			}
+			stack = append(stack[:n], a)
+		default:
+			d.fail(fmt.Errorf("unsupported instruction in offset expression of data segment: %#x", op))
+		}
+	}
+	return 0, false
 }
 
 // SkipToDataOffset iterates over segments to return the bytes at a given data
 // offset, until the end of the segment that contains the offset, and the
 // virtual address of the byte at that offset.
 //
-// Panics if offset was already passed or the offset is out of bounds.
+// Returns a nil slice if the offset was already passed, is out of bounds, is
+// not in an active segment with a constant address, or if the data section is
+// invalid. The error is then reported by Err.
 func (d *dataIterator) SkipToDataOffset(offset int) (int64, []byte) {
 	if offset < d.offset {
-		panic(fmt.Errorf("offset %d requested by already at %d", offset, d.offset))
+		d.fail(fmt.Errorf("offset %d requested but already at %d", offset, d.offset))
+		return 0, nil
 	}
 	end := d.offset + len(d.b)
-	if offset >= d.offset+len(d.b) {
-		panic(fmt.Errorf("offset %d requested past data section %d", offset, end))
+	if offset >= end {
+		d.fail(fmt.Errorf("offset %d requested past data section %d", offset, end))
+		return 0, nil
 	}
 
-	for d.offset <= offset {
-		vaddr, seg := d.Next()
-		if d.offset < offset {
+	for d.n > 0 && d.offset <= offset {
+		vaddr, seg, ok := d.next()
+		if d.err != nil {
+			break
+		}
+		if d.offset <= offset {
 			continue
 		}
+		if !ok {
+			d.fail(fmt.Errorf("offset %d requested in a segment without address", offset))
+			break
+		}
 		o := len(seg) + offset - d.offset
+		if o < 0 {
+			d.fail(fmt.Errorf("offset %d requested in the header of a data segment", offset))
+			break
+		}
 		return vaddr + int64(o), seg[o:]
 	}
 
+	if d.err == nil {
+		d.fail(fmt.Errorf("offset %d requested past the last data segment", offset))
+	}
 	return 0, nil
 }
 
@@ -235,3 +595,47 @@ func (m *vmemb) CopyAtAddress(addr int64, b []byte) {
 		panic("invalid copy")
 	}
 }
+
+// Read implements vmem, for the memory rebuilt from data segments.
+func (m *vmemb) Read(address uint64, size uint32) ([]byte, bool) {
+	if address > math.MaxInt64 {
+		return nil, false
+	}
+	start := int64(address) - m.Start
+	end := start + int64(size)
+	if start < 0 || end > int64(len(m.b)) {
+		return nil, false
+	}
+	return m.b[start:end], true
+}
+
+// wasmInitialMemory rebuilds the initial contents of the memory of a module
+// from the segments of its data section, as returned by wasmdataSection.
+func wasmInitialMemory(data []byte) (*vmemb, error) {
+	// The extent of the memory is computed first, so the buffer is allocated
+	// once. Segments are not necessarily sorted by address and may overlap,
+	// like the runtime does, the later ones overwrite the earlier ones.
+	d := newDataIterator(data)
+	start, end := int64(-1), int64(0)
+	for vaddr, seg := d.Next(); seg != nil; vaddr, seg = d.Next() {
+		if start < 0 || vaddr < start {
+			start = vaddr
+		}
+		if e := vaddr + int64(len(seg)); e > end {
+			end = e
+		}
+	}
+	if err := d.Err(); err != nil {
+		return nil, fmt.Errorf("invalid data segments: %w", err)
+	}
+	if start < 0 {
+		start = 0
+	}
+
+	d = newDataIterator(data)
+	m := &vmemb{Start: start, b: make([]byte, end-start)}
+	for vaddr, seg := d.Next(); seg != nil; vaddr, seg = d.Next() {
+		copy(m.b[vaddr-start:], seg)
+	}
+	return m, nil
+}
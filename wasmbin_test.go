@@ -0,0 +1,163 @@
+package wzprof
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/tetratelabs/wazero/experimental/wazerotest"
+)
+
+func TestDataIteratorSegmentModes(t *testing.T) {
+	data := []byte{
+		4, // number of segments
+
+		// mode 0, i32.const 16
+		0, 0x41, 16, 0x0B, 2, 'a', 'b',
+		// mode 1, passive
+		1, 2, 'c', 'd',
+		// mode 2, memory 0, i32.const 32 i32.const 8 i32.add
+		2, 0, 0x41, 32, 0x41, 8, 0x6A, 0x0B, 2, 'e', 'f',
+		// mode 0, global.get 0
+		0, 0x23, 0, 0x0B, 2, 'g', 'h',
+	}
+
+	d := newDataIterator(data)
+
+	vaddr, seg := d.Next()
+	if vaddr != 16 || !bytes.Equal(seg, []byte("ab")) {
+		t.Errorf("wrong first segment: %d %q", vaddr, seg)
+	}
+	vaddr, seg = d.Next()
+	if vaddr != 40 || !bytes.Equal(seg, []byte("ef")) {
+		t.Errorf("wrong second segment: %d %q", vaddr, seg)
+	}
+	if vaddr, seg = d.Next(); seg != nil {
+		t.Errorf("unexpected segment: %d %q", vaddr, seg)
+	}
+
+	d = newDataIterator(data)
+	vaddr, seg = d.SkipToDataOffset(bytes.IndexByte(data, 'f'))
+	if vaddr != 41 || !bytes.Equal(seg, []byte("f")) {
+		t.Errorf("wrong data at offset: %d %q", vaddr, seg)
+	}
+}
+
+func TestDataIteratorInvalidSegments(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{name: "empty", data: []byte{}},
+		{name: "unsupported mode", data: []byte{1, 3, 0x41, 0, 0x0B, 1, 'a'}},
+		{name: "unsupported instruction", data: []byte{1, 0, 0x44, 0x0B, 1, 'a'}},
+		{name: "empty offset", data: []byte{1, 0, 0x0B, 1, 'a'}},
+		{name: "operand missing", data: []byte{1, 0, 0x41, 1, 0x6A, 0x0B, 1, 'a'}},
+		{name: "negative offset", data: []byte{1, 0, 0x41, 0x7F, 0x0B, 1, 'a'}},
+		{name: "unterminated offset", data: []byte{1, 0, 0x41, 1}},
+		{name: "truncated constant", data: []byte{1, 0, 0x41, 0x80}},
+		{name: "truncated segment", data: []byte{1, 0, 0x41, 1, 0x0B, 4, 'a'}},
+		{name: "missing segment", data: []byte{2, 0, 0x41, 1, 0x0B, 1, 'a'}},
+	}
+	for _, test := range tests {
+		d := newDataIterator(test.data)
+		for _, seg := d.Next(); seg != nil; _, seg = d.Next() {
+		}
+		if d.Err() == nil {
+			t.Errorf("%s: no error", test.name)
+		}
+		if _, err := wasmInitialMemory(test.data); err == nil {
+			t.Errorf("%s: no error rebuilding the memory", test.name)
+		}
+	}
+
+	data := []byte{
+		2,
+		0, 0x41, 16, 0x0B, 2, 'a', 'b',
+		1, 2, 'c', 'd',
+	}
+	offsets := []struct {
+		name   string
+		offset int
+	}{
+		{name: "segment header", offset: 2},
+		{name: "passive segment", offset: bytes.IndexByte(data, 'c')},
+		{name: "out of bounds", offset: len(data)},
+	}
+	for _, test := range offsets {
+		d := newDataIterator(data)
+		if _, seg := d.SkipToDataOffset(test.offset); seg != nil || d.Err() == nil {
+			t.Errorf("%s: no error skipping to offset %d", test.name, test.offset)
+		}
+	}
+
+	d := newDataIterator(data)
+	d.SkipToDataOffset(bytes.IndexByte(data, 'b'))
+	if _, seg := d.SkipToDataOffset(bytes.IndexByte(data, 'a')); seg != nil || d.Err() == nil {
+		t.Error("no error skipping back to a previous offset")
+	}
+}
+
+func TestWasmMemory64(t *testing.T) {
+	header := []byte{0x00, 'a', 's', 'm', 1, 0, 0, 0}
+	tests := []struct {
+		name   string
+		module []byte
+		want   bool
+	}{
+		{
+			name: "memory32",
+			// memory section: 1 memory, min 1
+			module: append(header, 5, 3, 1, 0x00, 1),
+		},
+		{
+			name: "shared memory32",
+			// memory section: 1 memory, shared, min 1 max 2
+			module: append(header, 5, 4, 1, 0x03, 1, 2),
+		},
+		{
+			name: "memory64",
+			// memory section: 1 memory, 64 bits, min 1
+			module: append(header, 5, 3, 1, 0x04, 1),
+			want:   true,
+		},
+		{
+			name: "imported memory64",
+			// import section: 1 import, "env" "mem", memory, 64 bits, min 1 max 2
+			module: append(header, 2, 13, 1, 3, 'e', 'n', 'v', 3, 'm', 'e', 'm', 0x02, 0x05, 1, 2),
+			want:   true,
+		},
+		{
+			name:   "no memory",
+			module: header,
+		},
+	}
+	for _, test := range tests {
+		if got := wasmMemory64(test.module); got != test.want {
+			t.Errorf("%s: wrong memory64 detection: want %t, got %t", test.name, test.want, got)
+		}
+	}
+}
+
+func TestVirtualMemoryAbove4GiB(t *testing.T) {
+	const base = 1 << 32
+	m := &vmemb{Start: base, b: []byte{1, 0, 0, 0, 2, 0, 0, 0, 'h', 'i', 0}}
+
+	if v := derefArrayIndex[uint32](m, ptr64(base), 1); v != 2 {
+		t.Errorf("wrong array element above 4GiB: want 2, got %d", v)
+	}
+	if s := derefCString(m, ptr64(base+8)); s != "hi" {
+		t.Errorf("wrong string above 4GiB: want %q, got %q", "hi", s)
+	}
+	// The low 32 bits of the addresses must not alias the first 4GiB.
+	if _, ok := m.Read(0, 4); ok {
+		t.Error("read below the start of memory succeeded")
+	}
+
+	mem := wasmMemory{wazerotest.NewFixedMemory(wazerotest.PageSize)}
+	if _, ok := mem.Read(base, 4); ok {
+		t.Error("read beyond 4GiB of a wasm memory succeeded")
+	}
+	if _, ok := mem.Read(0, 4); !ok {
+		t.Error("read at the start of a wasm memory failed")
+	}
+}
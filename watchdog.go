@@ -0,0 +1,162 @@
+package wzprof
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/pprof/profile"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+)
+
+// Watchdog captures CPU profiles of the guest invocations exceeding a latency
+// threshold, which targets the profiling at the outliers of the tail latency
+// instead of diluting them in a profile of the whole execution.
+//
+// An invocation starts when the host calls a function of the guest, and ends
+// when that call returns. Each invocation is profiled separately, and its
+// profile is retained only if it lasted longer than the threshold. Time spent
+// in host functions is included, since it contributes to the latency.
+//
+// The watchdog must not be sampled, invocations would only be partially
+// recorded otherwise.
+type Watchdog struct {
+	cpu       *CPUProfiler
+	threshold time.Duration
+	limit     int
+
+	depth int
+	start int64
+	id    string
+	seq   uint64
+
+	mutex    sync.Mutex
+	ids      []string
+	profiles map[string]*profile.Profile
+}
+
+// WatchdogOption is a type used to represent configuration options for
+// Watchdog instances created by Profiling.Watchdog.
+type WatchdogOption func(*Watchdog)
+
+// MaxWatchdogProfiles configures the maximum number of profiles retained by a
+// watchdog. When the limit is reached, the oldest profiles are discarded.
+//
+// Default to 16.
+func MaxWatchdogProfiles(limit int) WatchdogOption {
+	return func(w *Watchdog) { w.limit = limit }
+}
+
+const defaultMaxWatchdogProfiles = 16
+
+type invocationIDKey struct{}
+
+// WithInvocationID returns a context carrying the id of the guest invocation
+// made with it. Watchdog uses the id as key of the profile of the invocation.
+// Invocations without an id are numbered in the order they started.
+func WithInvocationID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, invocationIDKey{}, id)
+}
+
+func newWatchdog(p *Profiling, threshold time.Duration, options ...WatchdogOption) *Watchdog {
+	w := &Watchdog{
+		cpu:       newCPUProfiler(p, HostTime(true)),
+		threshold: threshold,
+		limit:     defaultMaxWatchdogProfiles,
+		profiles:  make(map[string]*profile.Profile),
+	}
+	for _, opt := range options {
+		opt(w)
+	}
+	return w
+}
+
+// NewFunctionListener returns a function listener suited to profile the
+// invocations of the function passed as argument.
+func (w *Watchdog) NewFunctionListener(def api.FunctionDefinition) experimental.FunctionListener {
+	lstn := w.cpu.NewFunctionListener(def)
+	if lstn == nil {
+		return nil
+	}
+	return watchdogListener{w, lstn}
+}
+
+type watchdogListener struct {
+	*Watchdog
+	lstn experimental.FunctionListener
+}
+
+func (w watchdogListener) Before(ctx context.Context, mod api.Module, def api.FunctionDefinition, params []uint64, si experimental.StackIterator) {
+	if w.depth == 0 {
+		w.seq++
+		w.id, _ = ctx.Value(invocationIDKey{}).(string)
+		if w.id == "" {
+			w.id = strconv.FormatUint(w.seq, 10)
+		}
+		w.cpu.StartProfile()
+		w.start = w.cpu.time()
+	}
+	w.depth++
+	w.lstn.Before(ctx, mod, def, params, si)
+}
+
+func (w watchdogListener) After(ctx context.Context, mod api.Module, def api.FunctionDefinition, results []uint64) {
+	w.lstn.After(ctx, mod, def, results)
+	if w.depth--; w.depth == 0 {
+		w.invocationDone()
+	}
+}
+
+func (w watchdogListener) Abort(ctx context.Context, mod api.Module, def api.FunctionDefinition, err error) {
+	w.lstn.Abort(ctx, mod, def, err)
+	if w.depth--; w.depth == 0 {
+		w.invocationDone()
+	}
+}
+
+func (w *Watchdog) invocationDone() {
+	elapsed := time.Duration(w.cpu.time() - w.start)
+	if elapsed < w.threshold {
+		w.cpu.discardProfile()
+		return
+	}
+
+	prof := w.cpu.StopProfile(1)
+	if prof == nil {
+		return
+	}
+	prof.Comments = append(prof.Comments, "invocation: "+w.id, "latency: "+elapsed.String())
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if _, exists := w.profiles[w.id]; !exists {
+		w.ids = append(w.ids, w.id)
+	}
+	w.profiles[w.id] = prof
+
+	for len(w.ids) > w.limit {
+		delete(w.profiles, w.ids[0])
+		w.ids = w.ids[1:]
+	}
+}
+
+// Profile returns the profile of the invocation with the given id, or nil if
+// the invocation did not exceed the threshold or its profile was discarded.
+func (w *Watchdog) Profile(id string) *profile.Profile {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.profiles[id]
+}
+
+// Invocations returns the ids of the invocations which have a profile, from
+// the oldest to the most recent.
+func (w *Watchdog) Invocations() []string {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	ids := make([]string, len(w.ids))
+	copy(ids, w.ids)
+	return ids
+}
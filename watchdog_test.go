@@ -0,0 +1,65 @@
+package wzprof
+
+import (
+	"context"
+	"testing"
+
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+	"github.com/tetratelabs/wazero/experimental/wazerotest"
+)
+
+func TestWatchdog(t *testing.T) {
+	currentTime := int64(0)
+
+	w := ProfilingFor(nil).Watchdog(100, MaxWatchdogProfiles(2))
+	w.cpu.time = func() int64 { return currentTime }
+
+	module := wazerotest.NewModule(nil,
+		wazerotest.NewFunction(func(context.Context, api.Module) {}),
+		wazerotest.NewFunction(func(context.Context, api.Module) {}),
+	)
+	def0 := module.Function(0).Definition()
+	def1 := module.Function(1).Definition()
+	f0 := w.NewFunctionListener(def0)
+	f1 := w.NewFunctionListener(def1)
+
+	stack0 := []experimental.StackFrame{{Function: module.Function(0)}}
+	stack1 := []experimental.StackFrame{{Function: module.Function(1)}, {Function: module.Function(0)}}
+
+	invoke := func(ctx context.Context, duration int64) {
+		f0.Before(ctx, module, def0, nil, experimental.NewStackIterator(stack0...))
+		f1.Before(ctx, module, def1, nil, experimental.NewStackIterator(stack1...))
+		currentTime += duration
+		f1.After(ctx, module, def1, nil)
+		f0.After(ctx, module, def0, nil)
+	}
+
+	ctx := context.Background()
+	invoke(ctx, 10)                              // 1: too fast
+	invoke(ctx, 200)                             // 2
+	invoke(WithInvocationID(ctx, "slow"), 300)   // slow
+	invoke(WithInvocationID(ctx, "fast"), 50)    // fast: too fast
+	invoke(WithInvocationID(ctx, "slower"), 400) // slower, evicts 2
+
+	if ids := w.Invocations(); len(ids) != 2 || ids[0] != "slow" || ids[1] != "slower" {
+		t.Fatalf("wrong invocations: %v", ids)
+	}
+	for _, id := range []string{"1", "2", "fast"} {
+		if w.Profile(id) != nil {
+			t.Errorf("unexpected profile for invocation %q", id)
+		}
+	}
+
+	prof := w.Profile("slow")
+	if prof == nil {
+		t.Fatal("missing profile of invocation slow")
+	}
+	var total int64
+	for _, sample := range prof.Sample {
+		total += sample.Value[1]
+	}
+	if total != 300 {
+		t.Errorf("wrong cpu time in profile: want 300, got %d", total)
+	}
+}
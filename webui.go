@@ -0,0 +1,144 @@
+package wzprof
+
+import (
+	"errors"
+	"flag"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/pprof/driver"
+	"github.com/google/pprof/profile"
+)
+
+// webUI serves the pprof web interface (graph, flame graph, top, source views)
+// of the guest profiles, as "go tool pprof -http" does.
+//
+// The views of a profile are generated by the pprof driver from a snapshot of
+// the profile, which is taken when the root of the interface is requested
+// without view parameters (e.g. "/debug/pprof/ui/allocs/") or when it has the
+// seconds parameter, and reused by all the other views until then. This keeps
+// the navigation responsive for CPU profiles, which take the time of the
+// profile duration to be captured.
+type webUI struct {
+	mutex    sync.Mutex
+	handlers map[string]map[string]http.Handler
+}
+
+func (ui *webUI) serveHTTP(w http.ResponseWriter, r *http.Request, entry profileEntry, path string) {
+	query := r.URL.Query()
+	_, seconds := query["seconds"]
+	refresh := path == "/" && (len(query) == 0 || seconds)
+
+	ui.mutex.Lock()
+	handlers := ui.handlers[entry.Name]
+	ui.mutex.Unlock()
+
+	if handlers == nil || refresh {
+		rec := &profileRecorder{}
+		entry.Handler.ServeHTTP(rec, r)
+		if rec.status != 0 && rec.status != http.StatusOK {
+			serveError(w, rec.status, rec.String())
+			return
+		}
+		prof, err := profile.Parse(&rec.Buffer)
+		if err != nil {
+			serveError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		handlers, err = webUIHandlers(entry.Name, prof)
+		if err != nil {
+			serveError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		ui.mutex.Lock()
+		if ui.handlers == nil {
+			ui.handlers = make(map[string]map[string]http.Handler)
+		}
+		ui.handlers[entry.Name] = handlers
+		ui.mutex.Unlock()
+	}
+
+	h, ok := handlers[path]
+	if !ok {
+		serveError(w, http.StatusNotFound, "Unknown view")
+		return
+	}
+	h.ServeHTTP(w, r)
+}
+
+// webUIHandlers runs the pprof driver on prof, returning the handlers of the
+// web interface it would serve instead of starting a server.
+func webUIHandlers(name string, prof *profile.Profile) (map[string]http.Handler, error) {
+	var handlers map[string]http.Handler
+	err := driver.PProf(&driver.Options{
+		// The address is not listened on, but must have a port for the driver
+		// not to look for a free one.
+		Flagset: newWebUIFlags("-http=localhost:1", "-no_browser", "-symbolize=none", name),
+		Fetch:   profileFetcher{prof},
+		UI:      webUIQuiet{},
+		HTTPServer: func(args *driver.HTTPServerArgs) error {
+			handlers = args.Handlers
+			return nil
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if handlers == nil {
+		return nil, errors.New("pprof driver did not create the web interface handlers")
+	}
+	return handlers, nil
+}
+
+// profileFetcher implements driver.Fetcher, returning the same profile for all
+// sources. The source URL is empty so the driver does not save a copy of the
+// profile on disk as it does for remote profiles.
+type profileFetcher struct{ prof *profile.Profile }
+
+func (f profileFetcher) Fetch(string, time.Duration, time.Duration) (*profile.Profile, string, error) {
+	return f.prof.Copy(), "", nil
+}
+
+// webUIFlags implements driver.FlagSet on a flag set parsing a fixed list of
+// arguments, instead of the command line of the program.
+type webUIFlags struct {
+	*flag.FlagSet
+	args  []string
+	usage []string
+}
+
+func newWebUIFlags(args ...string) *webUIFlags {
+	flags := flag.NewFlagSet("pprof", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	return &webUIFlags{FlagSet: flags, args: args}
+}
+
+func (f *webUIFlags) StringList(name, def, usage string) *[]*string {
+	return &[]*string{f.String(name, def, usage)}
+}
+
+func (f *webUIFlags) ExtraUsage() string { return strings.Join(f.usage, "\n") }
+
+func (f *webUIFlags) AddExtraUsage(eu string) { f.usage = append(f.usage, eu) }
+
+func (f *webUIFlags) Parse(usage func()) []string {
+	f.Usage = usage
+	if err := f.FlagSet.Parse(f.args); err != nil {
+		return nil
+	}
+	return f.Args()
+}
+
+// webUIQuiet implements driver.UI, discarding the messages of the driver which
+// are meant for users of the command line.
+type webUIQuiet struct{}
+
+func (webUIQuiet) ReadLine(string) (string, error)     { return "", io.EOF }
+func (webUIQuiet) Print(...interface{})                {}
+func (webUIQuiet) PrintErr(...interface{})             {}
+func (webUIQuiet) IsTerminal() bool                    { return false }
+func (webUIQuiet) WantBrowser() bool                   { return false }
+func (webUIQuiet) SetAutoComplete(func(string) string) {}
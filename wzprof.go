@@ -2,11 +2,19 @@ package wzprof
 
 import (
 	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"hash/maphash"
+	"io"
 	"net/http"
 	"os"
+	"path"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 	"unsafe"
 
@@ -14,6 +22,7 @@ import (
 	"github.com/tetratelabs/wazero"
 	"github.com/tetratelabs/wazero/api"
 	"github.com/tetratelabs/wazero/experimental"
+	"github.com/tetratelabs/wazero/sys"
 	"golang.org/x/exp/slices"
 )
 
@@ -27,8 +36,35 @@ type Profiling struct {
 	symbols           symbolizer
 	stackIterator     func(mod api.Module, def api.FunctionDefinition, wasmsi experimental.StackIterator) experimental.StackIterator
 
-	lang          language
-	prepareCalled bool // Flag to indicate if Prepare has been called
+	lang       language
+	walltime   sys.Walltime
+	onBuilt    []func(*profile.Profile)
+	onDone     []func(context.Context, string, *profile.Profile)
+	transforms []ValueTransform
+	limits     ProfileLimits
+	sourceMap  []byte
+	symbolizer string
+	moduleName string
+	buildID    string
+	// Strategy selected by Prepare, and the errors of the ones it tried
+	// before, see Symbolizer.
+	strategy    string
+	strategyErr error
+	// Index of the global holding the state of the asyncify transform, if
+	// the module was transformed, see asyncifyUnwinding.
+	asyncify      bool
+	asyncifyState uint32
+	// The memory is addressed with 64 bits (memory64 proposal), pointers
+	// and sizes passed to the allocation functions are i64 values.
+	memory64 bool
+	// Record the native addresses of the wasm stack frames.
+	nativeAddresses bool
+	borrowMemory    bool
+	// Number of goroutines resolving the symbols of profiles, zero to use
+	// GOMAXPROCS.
+	symbolizerWorkers int
+	metrics           profilingMetrics
+	streams           sampleStreams
 }
 
 type language int8
@@ -37,6 +73,10 @@ const (
 	unknown language = iota
 	golang
 	python311
+	dotnet
+	ruby
+	quickjs
+	assemblyscript
 )
 
 // ProfilingFor a given wasm binary. The resulting Profiling needs to be
@@ -44,11 +84,14 @@ const (
 func ProfilingFor(wasm []byte) *Profiling {
 	r := &Profiling{
 		wasm:    wasm,
+		buildID: wasmBuildID(wasm),
 		symbols: noopsymbolizer{},
 		stackIterator: func(mod api.Module, def api.FunctionDefinition, wasmsi experimental.StackIterator) experimental.StackIterator {
 			return wasmsi
 		},
 	}
+	r.asyncifyState, r.asyncify = wasmAsyncifyState(wasm)
+	r.memory64 = wasmMemory64(wasm)
 
 	if binCompiledByGo(wasm) {
 		r.lang = golang
@@ -91,35 +134,143 @@ func ProfilingFor(wasm []byte) *Profiling {
 			// "_PyEval_EvalFrameDefault": {},
 			// "_PyEvalFramePushAndInit": {},
 		}
+	} else if supportedDotnet(wasm) {
+		r.lang = dotnet
+		r.onlyFunctions = map[string]struct{}{
+			dotnetInterpEntry: {},
+		}
+	} else if supportedRuby(wasm) {
+		r.lang = ruby
+		r.onlyFunctions = map[string]struct{}{
+			rubyVMEntry: {},
+		}
+	} else if supportedQuickJS(wasm) {
+		r.lang = quickjs
+		r.onlyFunctions = map[string]struct{}{
+			quickjsCallEntry: {},
+		}
+	} else if supportedAssemblyScript(wasm) {
+		r.lang = assemblyscript
 	}
 
 	return r
 }
 
+// ErrMemory64Unsupported is returned by CheckModule for modules built for the
+// memory64 proposal, which the wazero runtime cannot compile yet. The
+// profilers read their 64-bit addresses, but the modules cannot run.
+var ErrMemory64Unsupported = errors.New("memory64 modules are not supported by the wazero runtime")
+
+// CheckModule returns an error if the wasm binary uses features which the
+// wazero runtime cannot compile, so programs can report them before the
+// compilation of the module fails with a less explicit error.
+func CheckModule(wasm []byte) error {
+	if wasmMemory64(wasm) {
+		return ErrMemory64Unsupported
+	}
+	return nil
+}
+
+// SetSymbolizer forces the strategy used to resolve the symbols of the module,
+// for when the one detected from its content is not appropriate (e.g. a Go
+// module where DWARF is stale). The strategies are:
+//
+//   - "auto": detected from the module, which is the default
+//   - "dwarf": DWARF debugging information of the wasm code
+//   - "pclntab": symbol tables of the Go runtime, only for Go modules
+//   - "names": function names from the name section of the module
+//   - "none": function indexes, without names, resolved later on by
+//     SymbolizeProfile
+//
+// Except for "auto" and "pclntab", the stacks of the wasm code are profiled
+// instead of the ones of the interpreters of languages such as Python.
+//
+// SetSymbolizer must be called before the module is compiled, since it changes
+// the functions profilers install listeners on.
+func (p *Profiling) SetSymbolizer(strategy string) error {
+	switch strategy {
+	case "auto":
+		strategy = ""
+	case "pclntab":
+		if p.lang != golang {
+			return fmt.Errorf("symbolizer %q is only supported for Go modules", strategy)
+		}
+	case "dwarf", "names", "none":
+		// Those functions are only observed to walk the stacks of the
+		// interpreters.
+		p.onlyFunctions = nil
+	default:
+		return fmt.Errorf("unsupported symbolizer: %q", strategy)
+	}
+	p.symbolizer = strategy
+	return nil
+}
+
 // Prepare selects the most appropriate analysis functions for the guest
 // code in the provided module.
 func (p *Profiling) Prepare(mod wazero.CompiledModule) error {
+	if p.moduleName == "" {
+		p.moduleName = mod.Name()
+	}
+
+	p.strategy, p.strategyErr = p.symbolizer, nil
+	switch p.symbolizer {
+	case "dwarf":
+		dwarf, err := newDwarfparser(mod)
+		if err != nil {
+			return err
+		}
+		p.symbols = buildDwarfSymbolizer(dwarf)
+		return nil
+	case "names":
+		p.symbols = noopsymbolizer{}
+		return nil
+	case "none":
+		p.symbols = indexsymbolizer{}
+		return nil
+	}
+
 	switch p.lang {
 	case golang:
 		s, err := preparePclntabSymbolizer(p.wasm, mod)
-		if err != nil {
+		if err != nil && p.symbolizer == "pclntab" {
 			return err
 		}
+		if err != nil {
+			// Stripped or unusual builds still have a wasm stack to
+			// profile, the symbolizer is the one of the fallback, so the
+			// profilers walk the wasm stacks instead of the Go ones.
+			errs := p.prepareFallback(mod)
+			p.strategyErr = errors.Join(append([]error{fmt.Errorf("pclntab: %w", err)}, errs...)...)
+			p.symbolizer = p.strategy
+			return nil
+		}
+		p.strategy = "pclntab"
 
+		s.borrow = p.borrowMemory
 		p.symbols = s
-		si := &goStackIterator{
-			pclntab:  s,
-			unwinder: unwinder{symbols: s},
-		}
+		// The iterators memoize the frames they unwound, each thread of
+		// the guest has its own.
+		iterators := new(threadStates[goStackIterator])
 		p.stackIterator = func(mod api.Module, def api.FunctionDefinition, wasmsi experimental.StackIterator) experimental.StackIterator {
+			si := iterators.get(mod)
+			if si.pclntab == nil {
+				si.pclntab = s
+				si.unwinder = unwinder{symbols: s}
+			}
 			imod := mod.(experimental.InternalModule)
-			si.mem = imod.Memory()
+			si.mem = wasmMemory{imod.Memory()}
 			si.pclntab.EnsureReady(si.mem)
+			// The stack pointer and the g are globals of the module, which
+			// are the ones of the thread running the call: threads are
+			// instances of the module sharing its memory.
 			sp0 := uint32(imod.Global(0).Get())
 			gp0 := imod.Global(2).Get()
 			pc0 := si.symbols.FIDToPC(fid(def.Index()))
+			si.gp = gptr(gp0)
 			si.initAt(ptr64(pc0), ptr64(sp0), 0, gptr(gp0), 0)
 			si.first = true
+			si.entry = -1
 			return si
 		}
 	case python311:
@@ -129,38 +280,357 @@ func (p *Profiling) Prepare(mod wazero.CompiledModule) error {
 		}
 		p.symbols = py
 		p.stackIterator = py.Stackiter
+		p.strategy = "python"
+	case dotnet:
+		d := &dotnetSupport{}
+		p.symbols = d
+		p.stackIterator = d.Stackiter
+		p.strategy = "dotnet"
+	case ruby:
+		r := &rubySupport{}
+		p.symbols = r
+		p.stackIterator = r.Stackiter
+		p.strategy = "ruby"
+	case quickjs:
+		q := &quickjsSupport{}
+		p.symbols = q
+		p.stackIterator = q.Stackiter
+		p.strategy = "quickjs"
 	default:
-		dwarf, err := newDwarfparser(mod)
-		if err != nil {
-			return nil // TODO: surface error as warning?
+		if p.sourceMap != nil {
+			s, err := buildSourceMapSymbolizer(p.wasm, p.sourceMap)
+			if err != nil {
+				return err
+			}
+			p.symbols = s
+			p.strategy = "sourcemap"
+			return nil
 		}
+		// The modules of other languages do not always have DWARF
+		// sections, the fallbacks are expected.
+		p.prepareFallback(mod)
+	}
+	return nil
+}
+
+// prepareFallback symbolizes the wasm stacks of the module with its DWARF
+// sections, or its name section if it has no DWARF sections, or the indexes of
+// the functions if it has no names either. It returns the errors of the
+// strategies which could not be used.
+func (p *Profiling) prepareFallback(mod wazero.CompiledModule) (errs []error) {
+	dwarf, err := newDwarfparser(mod)
+	if err == nil {
 		p.symbols = buildDwarfSymbolizer(dwarf)
+		p.strategy = "dwarf"
+		return nil
 	}
+	errs = append(errs, fmt.Errorf("dwarf: %w", err))
 
-	// Set the flag to true if Prepare succeeds
-	p.prepareCalled = true
+	if wasmFunctionNames(p.wasm) != nil {
+		p.symbols = noopsymbolizer{}
+		p.strategy = "names"
+		return errs
+	}
+	errs = append(errs, errors.New("names: no function names in the name section"))
 
-	return nil
+	p.symbols = indexsymbolizer{}
+	p.strategy = "none"
+	return errs
+}
+
+// Symbolizer returns the strategy selected by Prepare to resolve the symbols
+// of the module: one of the strategies of SetSymbolizer other than "auto",
+// the runtime of the language whose stacks are walked ("python", "dotnet",
+// "ruby", "quickjs"), or "sourcemap". err describes why the strategy of the
+// language of the module and its fallbacks could not be used, e.g. when a Go
+// module has no pclntab, or is nil if the strategy was selected.
+//
+// Symbolizer must be called after Prepare.
+func (p *Profiling) Symbolizer() (strategy string, err error) {
+	return p.strategy, p.strategyErr
+}
+
+// Capabilities describes the profiling features available for a module, so
+// user interfaces can hide the views which would otherwise show empty or
+// misleading data.
+type Capabilities struct {
+	// InlinedFunctions is true when stack traces include the functions that
+	// were inlined by the compiler.
+	InlinedFunctions bool
+	// LineNumbers is true when locations are resolved to source lines, and not
+	// only to function names.
+	LineNumbers bool
+	// InuseMemory is true when the memory profiler observes objects being
+	// freed, which makes the inuse samples accurate.
+	InuseMemory bool
+	// Goroutines is true when the profilers can enumerate all the goroutines
+	// of the guest, and not only the one running.
+	Goroutines bool
+}
+
+// Capabilities returns the profiling features available for the module.
+//
+// Capabilities must be called after Prepare.
+func (p *Profiling) Capabilities() Capabilities {
+	c := p.languageCapabilities()
+	switch p.symbolizer {
+	case "dwarf":
+		c.InlinedFunctions, c.LineNumbers = true, true
+	case "names", "none":
+		c.InlinedFunctions, c.LineNumbers = false, false
+	}
+	return c
+}
+
+func (p *Profiling) languageCapabilities() Capabilities {
+	switch p.lang {
+	case golang:
+		// The garbage collector does not report freed objects, and only the
+		// stack of the running goroutine is walked.
+		return Capabilities{InlinedFunctions: true, LineNumbers: true}
+	case python311:
+		return Capabilities{LineNumbers: true, InuseMemory: true}
+	case dotnet:
+		return Capabilities{InuseMemory: true}
+	case ruby:
+		return Capabilities{LineNumbers: true, InuseMemory: true}
+	case quickjs:
+		return Capabilities{LineNumbers: true, InuseMemory: true}
+	case assemblyscript:
+		_, ok := p.symbols.(*sourcemap)
+		return Capabilities{LineNumbers: ok}
+	default:
+		switch p.symbols.(type) {
+		case *dwarfmapper:
+			return Capabilities{InlinedFunctions: true, LineNumbers: true, InuseMemory: true}
+		case *sourcemap:
+			return Capabilities{LineNumbers: true, InuseMemory: true}
+		default:
+			return Capabilities{InuseMemory: true}
+		}
+	}
+}
+
+// SourceMapURL returns the URL of the source map referenced by the
+// sourceMappingURL section of the module, or an empty string if the module
+// does not reference one. Relative URLs are relative to the location of the
+// module.
+func (p *Profiling) SourceMapURL() string {
+	return wasmSourceMapURL(p.wasm)
+}
+
+// SetSourceMap configures the source map used to symbolize modules that do not
+// embed DWARF debugging information, such as the ones compiled by
+// AssemblyScript. Only version 3 source maps are supported.
+//
+// SetSourceMap must be called before Prepare.
+func (p *Profiling) SetSourceMap(sourceMap []byte) {
+	p.sourceMap = sourceMap
+}
+
+// SetModuleName configures the file name of the module in the mappings of the
+// profiles. It defaults to the name of the module in its name section.
+func (p *Profiling) SetModuleName(name string) {
+	p.moduleName = name
+}
+
+// SetNativeAddresses configures the profiles to record the host-native
+// addresses of the machine code that the wazero compiler generated for the
+// frames of the stack traces, so guest profiles can be correlated with host
+// perf captures of the same process.
+//
+// The addresses are added to each sample as the "native_address" numeric
+// label, with one value per location of the sample, and the range they span
+// is described by a second mapping of the profile.
+//
+// The addresses are only meaningful when the runtime uses the compiler engine
+// (the program counters of the interpreter are indexes of its instructions),
+// and when the wasm stacks are profiled: they are not recorded for languages
+// where the profilers walk the stacks of the guest runtime (e.g. Go, Python),
+// unless a symbolizer other than "auto" and "pclntab" was set.
+func (p *Profiling) SetNativeAddresses(enable bool) {
+	p.nativeAddresses = enable
+}
+
+// SetSymbolizerWorkers sets the number of goroutines resolving the symbols of
+// the locations of profiles concurrently, which speeds up building profiles
+// with many distinct locations when the symbols are read from DWARF sections.
+// The profiles are the same regardless of the number of workers.
+//
+// Default to GOMAXPROCS, one resolves the symbols sequentially.
+func (p *Profiling) SetSymbolizerWorkers(n int) {
+	p.symbolizerWorkers = n
+}
+
+// SetBorrowedMemory configures the symbolizers to read the symbol tables of the
+// guest (the pclntab of Go modules) directly from its memory instead of copying
+// them to the host memory when the memory is first available, which reduces
+// the memory used by the profilers of large guests.
+//
+// The views of the memory remain valid as long as wazero does not move the
+// memory to a new buffer, which happens when it grows past its capacity: the
+// tables are then borrowed again from the new buffer, and the old one is
+// retained while the samples recorded before refer to it. Configuring the
+// runtime with wazero.RuntimeConfig.WithMemoryCapacityFromMax guarantees that
+// the buffer never moves.
+//
+// Default to false.
+func (p *Profiling) SetBorrowedMemory(enable bool) {
+	p.borrowMemory = enable
+}
+
+// wasmStacks returns true if the stack traces are the ones of the wasm code,
+// which means their program counters are the ones of the wazero engine.
+func (p *Profiling) wasmStacks() bool {
+	switch p.symbolizer {
+	case "dwarf", "names", "none":
+		return true
+	case "pclntab":
+		return false
+	}
+	return p.lang == unknown || p.lang == assemblyscript
+}
+
+// SetGuestWalltime configures the wall clock used by the guest module, which
+// is the function passed to wazero.ModuleConfig.WithWalltime.
+//
+// When set, the timestamps of profiles are expressed in the guest time so they
+// can be correlated with the logs of the guest application, and the skew
+// between the guest and host clocks is recorded as a comment of the profiles.
+// Durations are always measured with the host monotonic clock.
+//
+// Default to the host clock.
+func (p *Profiling) SetGuestWalltime(walltime sys.Walltime) {
+	p.walltime = walltime
+}
+
+// OnProfileBuilt registers a function invoked with every profile produced by
+// the profilers of p, whether they are built by StopProfile, NewProfile, or
+// served by a http handler. The functions are called in the order they were
+// registered, and may modify the profile in place (e.g. to add labels, scrub
+// file paths, or drop frames).
+//
+// OnProfileBuilt must be called before any profile is built.
+func (p *Profiling) OnProfileBuilt(fn func(*profile.Profile)) {
+	p.onBuilt = append(p.onBuilt, fn)
+}
+
+// OnProfileCompleted registers a function invoked with every profile returned
+// by the StopProfile and NewProfile methods of the profilers of p (and their
+// Context variants, including when called by the http handlers), named after
+// the profiler which produced it (e.g. "profile" or "allocs"). It lets the
+// host forward the profiles to its own pipelines without wrapping each call
+// site.
+//
+// The functions are invoked synchronously, after the ones registered with
+// OnProfileBuilt, with the context passed to the profiler. They must not
+// modify the profile, which is also returned to the caller, and should hand it
+// off to another goroutine if exporting it takes time.
+//
+// OnProfileCompleted must be called before any profile is built.
+func (p *Profiling) OnProfileCompleted(fn func(ctx context.Context, name string, prof *profile.Profile)) {
+	p.onDone = append(p.onDone, fn)
+}
+
+// completeProfile invokes the functions registered with OnProfileCompleted
+// when the profile of the named profiler was successfully built.
+func (p *Profiling) completeProfile(ctx context.Context, name string, prof *profile.Profile, err error) (*profile.Profile, error) {
+	if prof != nil && err == nil {
+		for _, fn := range p.onDone {
+			fn(ctx, name, prof)
+		}
+	}
+	return prof, err
+}
+
+// encodable returns true if the profiles of p can be encoded as their samples
+// are symbolized, which is not possible when functions need the complete
+// profiles, or when the profiles are trimmed.
+func (p *Profiling) encodable() bool {
+	if len(p.onBuilt) > 0 || len(p.onDone) > 0 {
+		return false
+	}
+	return !p.limits.enabled()
+}
+
+// ValueTransform describes a sample type derived from the values of another
+// sample type of the profiles, such as a conversion to a different unit or a
+// cost computed from the CPU time.
+type ValueTransform struct {
+	// Source is the name of the sample type the values are derived from
+	// (e.g. "cpu" or "alloc_space").
+	Source string
+	// Type and Unit of the derived sample type.
+	Type string
+	Unit string
+	// Transform computes the derived value from a value of the source sample
+	// type, after scaling for the sampling rate.
+	Transform func(value int64) int64
+}
+
+// AddValueTransform registers a sample type derived from the values of another
+// sample type. The derived values are added to all the profiles built by the
+// profilers of p which have the source sample type, before the functions
+// registered with OnProfileBuilt are invoked.
+//
+// AddValueTransform must be called before any profile is built.
+func (p *Profiling) AddValueTransform(t ValueTransform) {
+	p.transforms = append(p.transforms, t)
+}
+
+// clockSkew returns the difference between the guest and host wall clocks.
+func (p *Profiling) clockSkew() time.Duration {
+	if p.walltime == nil {
+		return 0
+	}
+	now := time.Now()
+	sec, nsec := p.walltime()
+	return time.Unix(sec, int64(nsec)).Sub(now)
 }
 
 // CPUProfiler constructs a new instance of CPUProfiler using the given time
 // function to record the CPU time consumed.
 func (p *Profiling) CPUProfiler(options ...CPUProfilerOption) *CPUProfiler {
-	if !p.prepareCalled {
-		panic("Profiling.Prepare must be called before creating a CPU profiler")
-	}
 	return newCPUProfiler(p, options...)
 }
 
 // MemoryProfiler constructs a new instance of MemoryProfiler using the given
 // time function to record the profile execution time.
 func (p *Profiling) MemoryProfiler(options ...MemoryProfilerOption) *MemoryProfiler {
-	if !p.prepareCalled {
-		panic("Profiling.Prepare must be called before creating a Memory profiler")
-	}
 	return newMemoryProfiler(p, options...)
 }
 
+// AccessProfiler constructs a new instance of the experimental AccessProfiler,
+// which scans the code of the module for its memory instructions.
+func (p *Profiling) AccessProfiler() *AccessProfiler {
+	return newAccessProfiler(p)
+}
+
+// Tracer constructs a new instance of Tracer recording the calls to functions
+// of the module.
+func (p *Profiling) Tracer(options ...TracerOption) *Tracer {
+	return newTracer(p, options...)
+}
+
+// Watchdog constructs a new instance of Watchdog capturing the CPU profiles of
+// the invocations lasting longer than threshold.
+func (p *Profiling) Watchdog(threshold time.Duration, options ...WatchdogOption) *Watchdog {
+	return newWatchdog(p, threshold, options...)
+}
+
+// listensTo returns true if the calls to the function should be observed to
+// reconstruct the stacks of the guest.
+func (p *Profiling) listensTo(def api.FunctionDefinition) bool {
+	name := def.Name()
+	if len(p.onlyFunctions) > 0 {
+		if _, keep := p.onlyFunctions[name]; !keep {
+			return false
+		}
+	}
+	_, skip := p.filteredFunctions[name]
+	return !skip
+}
+
 // profilingListener wraps a FunctionListener to adapt its stack iterator to the
 // appropriate implementation according to the module support.
 type profilingListener struct {
@@ -169,16 +639,26 @@ type profilingListener struct {
 }
 
 func (s profilingListener) Before(ctx context.Context, mod api.Module, def api.FunctionDefinition, params []uint64, si experimental.StackIterator) {
+	start := nanotime()
 	si = s.s.stackIterator(mod, def, si)
 	s.l.Before(ctx, mod, def, params, si)
+	s.s.metrics.overhead.Add(nanotime() - start)
 }
 
 func (s profilingListener) After(ctx context.Context, mod api.Module, def api.FunctionDefinition, results []uint64) {
-	s.l.After(ctx, mod, def, results)
+	start := nanotime()
+	if s.s.asyncifyUnwinding(mod) {
+		s.l.Abort(ctx, mod, def, errAsyncifyUnwind)
+	} else {
+		s.l.After(ctx, mod, def, results)
+	}
+	s.s.metrics.overhead.Add(nanotime() - start)
 }
 
 func (s profilingListener) Abort(ctx context.Context, mod api.Module, def api.FunctionDefinition, err error) {
+	start := nanotime()
 	s.l.Abort(ctx, mod, def, err)
+	s.s.metrics.overhead.Add(nanotime() - start)
 }
 
 // Profiler is an interface implemented by all profiler types available in this
@@ -207,6 +687,7 @@ type Profiler interface {
 var (
 	_ Profiler = (*CPUProfiler)(nil)
 	_ Profiler = (*MemoryProfiler)(nil)
+	_ Profiler = (*AccessProfiler)(nil)
 )
 
 //go:linkname nanotime runtime.nanotime
@@ -236,6 +717,16 @@ func (s noopsymbolizer) Locations(fn experimental.InternalFunction, pc experimen
 	return 0, nil
 }
 
+// indexsymbolizer names functions after their index in the module, ignoring
+// the name section. The addresses of the locations are the offsets of the
+// calls in the code section, which SymbolizeProfile resolves later on.
+type indexsymbolizer struct{}
+
+func (s indexsymbolizer) Locations(fn experimental.InternalFunction, pc experimental.ProgramCounter) (uint64, []location) {
+	name := fmt.Sprintf("wasm-function[%d]", fn.Definition().Index())
+	return fn.SourceOffsetForPC(pc), []location{{StableName: name, HumanName: name}}
+}
+
 type location struct {
 	File    string
 	Line    int64
@@ -245,21 +736,68 @@ type location struct {
 	// Only present for inlined functions.
 	StableName string
 	HumanName  string
+	// Line of the declaration of the function, zero if unknown. Go uses it
+	// to match the call sites of profiles used for profile-guided
+	// optimization.
+	StartLine int64
+}
+
+func locationForCall(p *Profiling, fn experimental.InternalFunction, pc experimental.ProgramCounter, funcs map[string]*profile.Function, arena *profileArena) *profile.Location {
+	// The symbolizers of interpreted languages expect the functions of their
+	// own stacks, the sample of the dropped stacks is not symbolized.
+	if fn == droppedFunction {
+		pprofFn := funcs[droppedFunction.name]
+		if pprofFn == nil {
+			pprofFn = arena.functions.new()
+			*pprofFn = profile.Function{
+				ID:         uint64(len(funcs)) + 1,
+				Name:       droppedFunction.name,
+				SystemName: droppedFunction.name,
+			}
+			funcs[droppedFunction.name] = pprofFn
+		}
+		out := arena.locations.new()
+		out.Line = arena.lines.alloc(1)
+		out.Line[0].Function = pprofFn
+		return out
+	}
+
+	address, locations := resolveCall(p, fn, pc)
+	return locationForSymbols(fn, address, locations, funcs, arena)
+}
+
+// locationForResolvedCall is like locationForCall, but uses the symbols of the
+// call when they were resolved by resolveCalls.
+func locationForResolvedCall(p *Profiling, fn experimental.InternalFunction, pc experimental.ProgramCounter, resolved *locationCache[int], calls []resolvedCall, funcs map[string]*profile.Function, arena *profileArena) *profile.Location {
+	if resolved != nil {
+		if i, ok := resolved.lookup(fn.Definition(), pc); ok {
+			c := &calls[i]
+			return locationForSymbols(fn, c.address, c.locations, funcs, arena)
+		}
+	}
+	return locationForCall(p, fn, pc, funcs, arena)
+}
+
+// resolveCall returns the address and source locations of the call to fn at
+// pc. It is safe to call concurrently.
+func resolveCall(p *Profiling, fn experimental.InternalFunction, pc experimental.ProgramCounter) (uint64, []location) {
+	// Zero is a valid program counter of the interpreter, where they are
+	// indexes of instructions, the symbolizers return no locations for the
+	// calls without program counter.
+	address, locations := p.symbols.Locations(fn, pc)
+	return address, p.filterInlinedFunctions(locations)
 }
 
-func locationForCall(p *Profiling, fn experimental.InternalFunction, pc experimental.ProgramCounter, funcs map[string]*profile.Function) *profile.Location {
+// locationForSymbols returns the location of a call to fn, whose symbols were
+// resolved by resolveCall.
+func locationForSymbols(fn experimental.InternalFunction, address uint64, locations []location, funcs map[string]*profile.Function, arena *profileArena) *profile.Location {
 	// Cache miss. Get or create function and all the line
 	// locations associated with inlining.
-	var locations []location
-	var symbolFound bool
 	def := fn.Definition()
 
-	out := &profile.Location{}
-
-	if pc > 0 {
-		out.Address, locations = p.symbols.Locations(fn, pc)
-		symbolFound = len(locations) > 0
-	}
+	out := arena.locations.new()
+	out.Address = address
+	symbolFound := len(locations) > 0
 	if len(locations) == 0 {
 		// If we don't have a source location, attach to a
 		// generic location within the function.
@@ -274,17 +812,19 @@ func locationForCall(p *Profiling, fn experimental.InternalFunction, pc experime
 		locations[0].HumanName = def.Name()
 	}
 
-	lines := make([]profile.Line, len(locations))
+	lines := arena.lines.alloc(len(locations))
 
 	for i, loc := range locations {
 		pprofFn := funcs[loc.StableName]
 
 		if pprofFn == nil {
-			pprofFn = &profile.Function{
+			pprofFn = arena.functions.new()
+			*pprofFn = profile.Function{
 				ID:         uint64(len(funcs)) + 1, // 0 is reserved by pprof
 				Name:       loc.HumanName,
 				SystemName: loc.StableName,
 				Filename:   loc.File,
+				StartLine:  loc.StartLine,
 			}
 			funcs[loc.StableName] = pprofFn
 		} else if symbolFound {
@@ -294,6 +834,7 @@ func locationForCall(p *Profiling, fn experimental.InternalFunction, pc experime
 			pprofFn.Name = locations[i].HumanName
 			pprofFn.SystemName = locations[i].StableName
 			pprofFn.Filename = locations[i].File
+			pprofFn.StartLine = locations[i].StartLine
 		}
 
 		// Pprof expects lines to start with the root of the inlined
@@ -309,6 +850,31 @@ func locationForCall(p *Profiling, fn experimental.InternalFunction, pc experime
 	return out
 }
 
+// filterInlinedFunctions removes the functions excluded from profiling from
+// the functions inlined at a location, so they are filtered the same way
+// whether the compiler inlined them or not. The first location is the
+// function containing the code, which was already matched against the filters
+// when the profilers installed their listeners.
+//
+// Only the functions filtered out apply: the functions profiled exclusively
+// are entry points of language runtimes, whose stack iterators replace the
+// wasm stacks and their inlined functions.
+func (p *Profiling) filterInlinedFunctions(locations []location) []location {
+	if len(p.filteredFunctions) == 0 || len(locations) < 2 {
+		return locations
+	}
+	// The locations may be cached by the symbolizer, they must not be
+	// modified.
+	filtered := make([]location, 1, len(locations))
+	filtered[0] = locations[0]
+	for _, loc := range locations[1:] {
+		if _, skip := p.filteredFunctions[loc.StableName]; !skip {
+			filtered = append(filtered, loc)
+		}
+	}
+	return filtered
+}
+
 type locationKey struct {
 	module string
 	index  uint32
@@ -325,33 +891,386 @@ func makeLocationKey(fn api.FunctionDefinition, pc experimental.ProgramCounter)
 	}
 }
 
-type stackCounterMap map[uint64]*stackCounter
+// locationCache caches the locations of calls by function and program counter.
+//
+// Hashing the names of the module and function of locationKey dominates the
+// cost of the lookups, so the functions of the module seen first, which is
+// the guest for all but a few host functions, are indexed by their index in a
+// slice of maps keyed only by program counter. The functions of other modules
+// are cached by locationKey, like all the functions of interpreted languages,
+// which do not have distinct indexes.
+type locationCache[T any] struct {
+	module  string
+	funcs   []map[uint64]T
+	others  map[locationKey]T
+	init    bool
+	indexed bool
+}
+
+// Bound of the indexes of the functions indexed by a locationCache, the
+// synthetic functions of profiles have indexes far greater than the number
+// of functions of modules.
+const maxLocationCacheIndex = 1 << 20
+
+func newLocationCache[T any](p *Profiling) *locationCache[T] {
+	return &locationCache[T]{indexed: p.lang != python311 && p.lang != quickjs}
+}
+
+func (c *locationCache[T]) lookup(fn api.FunctionDefinition, pc experimental.ProgramCounter) (v T, ok bool) {
+	if i, ok := c.index(fn); ok {
+		if int(i) < len(c.funcs) {
+			v, ok = c.funcs[i][uint64(pc)]
+			return v, ok
+		}
+		return v, false
+	}
+	v, ok = c.others[makeLocationKey(fn, pc)]
+	return v, ok
+}
+
+func (c *locationCache[T]) store(fn api.FunctionDefinition, pc experimental.ProgramCounter, v T) {
+	i, ok := c.index(fn)
+	if !ok {
+		if c.others == nil {
+			c.others = make(map[locationKey]T)
+		}
+		c.others[makeLocationKey(fn, pc)] = v
+		return
+	}
+	if int(i) >= len(c.funcs) {
+		c.funcs = append(c.funcs, make([]map[uint64]T, int(i)+1-len(c.funcs))...)
+	}
+	m := c.funcs[i]
+	if m == nil {
+		m = make(map[uint64]T)
+		c.funcs[i] = m
+	}
+	m[uint64(pc)] = v
+}
+
+// index returns the index of fn in the slice of functions, and false if fn is
+// cached by locationKey.
+func (c *locationCache[T]) index(fn api.FunctionDefinition) (uint32, bool) {
+	if !c.indexed {
+		return 0, false
+	}
+	if !c.init {
+		c.module, c.init = fn.ModuleName(), true
+	}
+	if fn.ModuleName() != c.module {
+		return 0, false
+	}
+	i := fn.Index()
+	return i, i < maxLocationCacheIndex
+}
+
+// Number of shards that the stacks of a stackCounterMap are distributed
+// across, so the stacks of a large profile can be recorded and snapshotted
+// without holding a single lock, and grow without rehashing all of them.
+const stackCounterShards = 16
+
+// stackCounterMap records samples of stack traces, indexed by the key of the
+// traces. It is safe to use concurrently.
+type stackCounterMap struct {
+	shards [stackCounterShards]stackCounterShard
+	// Maximum number of stacks in each shard, zero if the number of stacks
+	// is not bounded, see setLimit.
+	limit int
+	drops *atomic.Uint64
+	// Counter of the samples of the stacks which were not recorded because
+	// their shard was full, nil until the first one.
+	droppedMutex sync.Mutex
+	dropped      *stackCounter
+}
+
+type stackCounterShard struct {
+	mutex    sync.Mutex
+	counters map[uint64]*stackCounter
+	arena    stackArena
+}
+
+// newStackCounterMap returns a stackCounterMap sized to hold the given number
+// of stacks.
+func newStackCounterMap(size int) *stackCounterMap {
+	scm := new(stackCounterMap)
+	// The shards share the table of functions, which is much smaller than
+	// the stacks.
+	table := new(functionTable)
+	for i := range scm.shards {
+		scm.shards[i].counters = make(map[uint64]*stackCounter, size/stackCounterShards)
+		scm.shards[i].arena.table = table
+	}
+	return scm
+}
+
+func (scm *stackCounterMap) shard(key uint64) *stackCounterShard {
+	// The keys are hashes, the high bits are as good as any.
+	return &scm.shards[key>>60%stackCounterShards]
+}
+
+// setLimit bounds the number of stacks recorded in scm, the samples of the
+// stacks seen after the limit was reached are aggregated in a sample of the
+// "[dropped]" function, and counted in drops. A limit of zero does not bound
+// the number of stacks.
+func (scm *stackCounterMap) setLimit(limit int, drops *atomic.Uint64) {
+	scm.limit = 0
+	if limit > 0 {
+		scm.limit = (limit + stackCounterShards - 1) / stackCounterShards
+	}
+	scm.drops = drops
+}
+
+// lookup returns the counter of st, or nil if st is a new stack and the shard
+// already holds limit stacks.
+func (s *stackCounterShard) lookup(st stackTrace, limit int) *stackCounter {
+	sc := s.counters[st.key]
+	if sc == nil {
+		if limit != 0 && len(s.counters) >= limit {
+			return nil
+		}
+		sc = s.arena.newCounter(st)
+		s.counters[st.key] = sc
+	}
+	return sc
+}
+
+func (scm *stackCounterMap) lookup(st stackTrace) *stackCounter {
+	s := scm.shard(st.key)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.lookup(st, 0)
+}
 
-func (scm stackCounterMap) lookup(st stackTrace) *stackCounter {
-	sc := scm[st.key]
+// observe records a sample of st and returns its counter. The values of the
+// counter must not be read without holding the lock of its shard, see forEach.
+func (scm *stackCounterMap) observe(st stackTrace, val int64) *stackCounter {
+	s := scm.shard(st.key)
+	s.mutex.Lock()
+	sc := s.lookup(st, scm.limit)
+	if sc != nil {
+		sc.observe(val)
+	}
+	s.mutex.Unlock()
 	if sc == nil {
-		sc = &stackCounter{stack: st.clone()}
-		scm[st.key] = sc
+		sc = scm.observeDropped(val)
 	}
 	return sc
 }
 
-func (scm stackCounterMap) observe(st stackTrace, val int64) {
-	scm.lookup(st).observe(val)
+func (scm *stackCounterMap) observeDropped(val int64) *stackCounter {
+	if scm.drops != nil {
+		scm.drops.Add(1)
+	}
+	scm.droppedMutex.Lock()
+	defer scm.droppedMutex.Unlock()
+	if scm.dropped == nil {
+		scm.dropped = &stackCounter{stack: droppedStackTrace}
+	}
+	scm.dropped.observe(val)
+	return scm.dropped
+}
+
+func (scm *stackCounterMap) len() (n int) {
+	for i := range scm.shards {
+		s := &scm.shards[i]
+		s.mutex.Lock()
+		n += len(s.counters)
+		s.mutex.Unlock()
+	}
+	scm.droppedMutex.Lock()
+	if scm.dropped != nil {
+		n++
+	}
+	scm.droppedMutex.Unlock()
+	return n
+}
+
+// forEach calls fn with each counter of scm. The shards are locked one at a
+// time, so samples can be recorded in the other shards during the iteration.
+func (scm *stackCounterMap) forEach(fn func(*stackCounter)) {
+	for i := range scm.shards {
+		s := &scm.shards[i]
+		s.mutex.Lock()
+		for _, sc := range s.counters {
+			fn(sc)
+		}
+		s.mutex.Unlock()
+	}
+	scm.droppedMutex.Lock()
+	if scm.dropped != nil {
+		fn(scm.dropped)
+	}
+	scm.droppedMutex.Unlock()
+}
+
+// DefaultMaxStacks is the default number of stacks recorded by the CPU and
+// memory profilers, see MaxCPUStacks and MaxMemoryStacks.
+const DefaultMaxStacks = 1 << 18
+
+// droppedFunction is the function of the sample aggregating the stacks which
+// were not recorded because the profiler reached its maximum number of stacks.
+var droppedFunction = &frameFunction{index: ^uint32(0), name: "[dropped]"}
+
+var droppedStackTrace = stackTrace{
+	fns: []experimental.InternalFunction{droppedFunction},
+	pcs: []experimental.ProgramCounter{0},
+	key: ^uint64(0),
+}
+
+// samples returns a copy of the counters of scm, indexed by the key of their
+// stack trace.
+func (scm *stackCounterMap) samples() map[uint64]*stackCounter {
+	samples := make(map[uint64]*stackCounter, scm.len())
+	scm.forEach(func(sc *stackCounter) {
+		c := *sc
+		samples[sc.stack.key] = &c
+	})
+	return samples
+}
+
+// Bounds of the number of frames and counters allocated at once by stack
+// arenas, which double the size of their chunks up to the maximum.
+const (
+	minStackArenaFrames   = 64
+	maxStackArenaFrames   = 4096
+	minStackArenaCounters = 8
+	maxStackArenaCounters = 256
+)
+
+// stackArena allocates the counters and the copies of the stack traces
+// inserted in a stackCounterMap from chunks of memory shared by many stacks,
+// instead of allocating them one by one. The traces passed to the map are
+// owned by the callers, which reuse their buffers across calls; the map only
+// copies them when a new stack is inserted.
+//
+// The copies only hold the indexes of their functions in the table of the
+// arena, which take a quarter of the memory of the function values, and
+// resolve them when the profiles are built.
+type stackArena struct {
+	table    *functionTable
+	ids      []uint32
+	pcs      []experimental.ProgramCounter
+	counters []stackCounter
+}
+
+func (a *stackArena) newCounter(st stackTrace) *stackCounter {
+	if len(a.counters) == cap(a.counters) {
+		a.counters = make([]stackCounter, 0, chunkSize(cap(a.counters), 1, minStackArenaCounters, maxStackArenaCounters))
+	}
+	a.counters = append(a.counters, stackCounter{stack: a.clone(st)})
+	return &a.counters[len(a.counters)-1]
+}
+
+// clone returns a copy of st backed by the memory of the arena.
+func (a *stackArena) clone(st stackTrace) stackTrace {
+	if a.table == nil {
+		a.table = new(functionTable)
+	}
+	n := st.len()
+	if cap(a.ids)-len(a.ids) < n {
+		size := chunkSize(cap(a.ids), n, minStackArenaFrames, maxStackArenaFrames)
+		a.ids = make([]uint32, 0, size)
+		a.pcs = make([]experimental.ProgramCounter, 0, size)
+	}
+	i := len(a.ids)
+	if st.table == a.table {
+		a.ids = append(a.ids, st.ids...)
+	} else {
+		a.ids = a.table.appendIDs(a.ids, st)
+	}
+	a.pcs = append(a.pcs, st.pcs...)
+	// The capacity is capped so appending to the copy cannot overwrite the
+	// frames of the next stacks.
+	st.fns = nil
+	st.ids = a.ids[i : i+n : i+n]
+	st.pcs = a.pcs[i : i+n : i+n]
+	st.table = a.table
+	return st
+}
+
+// functionTable interns the functions of the stack traces stored in arenas.
+// Functions are added when new stacks are inserted, and looked up when the
+// profiles are built, concurrently.
+type functionTable struct {
+	mutex sync.RWMutex
+	ids   map[experimental.InternalFunction]uint32
+	fns   []experimental.InternalFunction
+}
+
+// appendIDs appends the indexes of the functions of st to ids, adding the
+// functions which are not in the table yet.
+func (t *functionTable) appendIDs(ids []uint32, st stackTrace) []uint32 {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.ids == nil {
+		t.ids = make(map[experimental.InternalFunction]uint32)
+	}
+	for i := 0; i < st.len(); i++ {
+		fn := st.function(i)
+		id, ok := t.ids[fn]
+		if !ok {
+			id = uint32(len(t.fns))
+			t.ids[fn] = id
+			t.fns = append(t.fns, fn)
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func (t *functionTable) function(id uint32) experimental.InternalFunction {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	return t.fns[id]
+}
+
+// chunkSize returns the size of the chunk allocated after one of size prev,
+// which is at least n.
+func chunkSize(prev, n, minSize, maxSize int) int {
+	size := 2 * prev
+	if size < minSize {
+		size = minSize
+	}
+	if size > maxSize {
+		size = maxSize
+	}
+	if size < n {
+		size = n
+	}
+	return size
 }
 
-func (scm stackCounterMap) len() int {
-	return len(scm)
+// stackTracePool holds the buffers of stack traces which are not in use, so
+// the function listeners capturing the stacks of calls do not allocate new
+// ones on every call.
+type stackTracePool struct {
+	traces []stackTrace
+}
+
+func (p *stackTracePool) get() stackTrace {
+	i := len(p.traces) - 1
+	if i < 0 {
+		return stackTrace{}
+	}
+	st := p.traces[i]
+	p.traces = p.traces[:i]
+	return st
+}
+
+func (p *stackTracePool) put(st stackTrace) {
+	p.traces = append(p.traces, st)
 }
 
 type stackCounter struct {
 	stack stackTrace
 	value [2]int64 // count, total
+	sumsq float64  // sum of the squares of the values, for the variance
 }
 
 func (sc *stackCounter) observe(value int64) {
 	sc.value[0] += 1
 	sc.value[1] += value
+	sc.sumsq += float64(value) * float64(value)
 }
 
 func (sc *stackCounter) count() int64 {
@@ -386,26 +1305,120 @@ type stackFrame struct {
 	pc experimental.ProgramCounter
 }
 
+// stackTrace is a stack captured by a function listener, or a copy of it
+// stored in an arena. Captured stacks hold their functions in fns, copies hold
+// the indexes of their functions in table.
 type stackTrace struct {
-	fns []experimental.InternalFunction
-	pcs []experimental.ProgramCounter
-	key uint64
+	fns    []experimental.InternalFunction
+	ids    []uint32
+	table  *functionTable
+	pcs    []experimental.ProgramCounter
+	key    uint64
+	goid   int64         // zero if the stack is not attributed to a goroutine
+	labels *sampleLabels // labels of the context of the call, or nil
 }
 
-func makeStackTrace(st stackTrace, si experimental.StackIterator) stackTrace {
+// makeStackTrace records the stack walked by si in st. The stack is attributed
+// to the sample labels of ctx, see WithSampleLabels.
+func makeStackTrace(ctx context.Context, st stackTrace, si experimental.StackIterator) stackTrace {
 	st.fns = st.fns[:0]
 	st.pcs = st.pcs[:0]
+	st.ids, st.table = nil, nil
 
 	for si.Next() {
 		st.fns = append(st.fns, si.Function())
 		st.pcs = append(st.pcs, si.ProgramCounter())
 	}
 	st.key = maphash.Bytes(stackTraceHashSeed, st.bytes())
+	st.goid = 0
+	st.labels, _ = ctx.Value(sampleLabelsKey{}).(*sampleLabels)
+	if st.labels != nil {
+		st.key = mixStackTraceKey(st.key, st.labels.hash)
+	}
+	return st
+}
+
+// mixStackTraceKey combines the key of a stack trace with a value attributing
+// the stack to a goroutine or labels.
+func mixStackTraceKey(key, value uint64) uint64 {
+	var b [16]byte
+	binary.LittleEndian.PutUint64(b[:8], key)
+	binary.LittleEndian.PutUint64(b[8:], value)
+	return maphash.Bytes(stackTraceHashSeed, b[:])
+}
+
+// WithSampleLabels returns a context attaching the labels to the samples that
+// the profilers record during the calls to the guest made with it, in addition
+// to the labels already attached to ctx. Like the labels of runtime/pprof, they
+// break down the profiles by request, tenant, etc.
+func WithSampleLabels(ctx context.Context, labels map[string]string) context.Context {
+	parent, _ := ctx.Value(sampleLabelsKey{}).(*sampleLabels)
+	return context.WithValue(ctx, sampleLabelsKey{}, parent.with(labels))
+}
+
+type sampleLabelsKey struct{}
+
+// sampleLabels are the labels attached to samples by WithSampleLabels. Stack
+// traces with the same stack and labels have the same key.
+type sampleLabels struct {
+	labels map[string]string
+	hash   uint64
+}
+
+// with returns the labels of l merged with labels, which take precedence. l
+// may be nil.
+func (l *sampleLabels) with(labels map[string]string) *sampleLabels {
+	merged := make(map[string]string, len(labels))
+	if l != nil {
+		for k, v := range l.labels {
+			merged[k] = v
+		}
+	}
+	for k, v := range labels {
+		merged[k] = v
+	}
+
+	keys := make([]string, 0, len(merged))
+	for k := range merged {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	var h maphash.Hash
+	h.SetSeed(stackTraceHashSeed)
+	for _, k := range keys {
+		h.WriteString(k)
+		h.WriteByte(0)
+		h.WriteString(merged[k])
+		h.WriteByte(0)
+	}
+	return &sampleLabels{labels: merged, hash: h.Sum64()}
+}
+
+// goroutineStackIterator is implemented by the stack iterators of guests which
+// can tell the goroutine a stack belongs to.
+type goroutineStackIterator interface {
+	goroutineID() int64
+}
+
+// withGoroutine attributes the stack trace to the goroutine with the given id.
+// Stack traces of different goroutines have different keys, so the profilers
+// record them as distinct samples.
+func (st stackTrace) withGoroutine(goid int64) stackTrace {
+	st.key = mixStackTraceKey(st.key, uint64(goid))
+	st.goid = goid
 	return st
 }
 
 func (st stackTrace) host() bool {
-	return len(st.fns) > 0 && st.fns[0].Definition().GoFunction() != nil
+	return st.len() > 0 && st.function(0).Definition().GoFunction() != nil
+}
+
+// function returns the function of the frame at index i.
+func (st stackTrace) function(i int) experimental.InternalFunction {
+	if st.table != nil {
+		return st.table.function(st.ids[i])
+	}
+	return st.fns[i]
 }
 
 func (st stackTrace) len() int {
@@ -414,19 +1427,11 @@ func (st stackTrace) len() int {
 
 func (st stackTrace) index(i int) stackFrame {
 	return stackFrame{
-		fn: st.fns[i],
+		fn: st.function(i),
 		pc: st.pcs[i],
 	}
 }
 
-func (st stackTrace) clone() stackTrace {
-	return stackTrace{
-		fns: slices.Clone(st.fns),
-		pcs: slices.Clone(st.pcs),
-		key: st.key,
-	}
-}
-
 func (st stackTrace) bytes() []byte {
 	pcs := unsafe.SliceData(st.pcs)
 	return unsafe.Slice((*byte)(unsafe.Pointer(pcs)), 8*len(st.pcs))
@@ -444,63 +1449,473 @@ func (st stackTrace) String() string {
 
 var stackTraceHashSeed = maphash.MakeSeed()
 
+// Label of the samples holding the id of the goroutine they were recorded on.
+const goroutineLabel = "goroutine"
+
+// Numeric label of the samples holding the native addresses of their
+// locations, see SetNativeAddresses.
+const nativeAddressLabel = "native_address"
+
 type sampleType interface {
 	sampleLocation() stackTrace
 	sampleValue() []int64
 }
 
-func buildProfile[T sampleType](p *Profiling, samples map[uint64]T, start time.Time, duration time.Duration, sampleType []*profile.ValueType, ratios []float64) *profile.Profile {
+// WithProgress returns a context reporting the progress of the profiles built
+// with it to fn, which receives the number of samples processed so far and
+// the total number of samples. Building large profiles may take a while, the
+// progress lets programs give feedback to their users.
+func WithProgress(ctx context.Context, fn func(done, total int)) context.Context {
+	return context.WithValue(ctx, progressKey{}, fn)
+}
+
+type progressKey struct{}
+
+// PendingProfile is a profile built in the background, returned by
+// CPUProfiler.StopProfileAsync and MemoryProfiler.NewProfileAsync.
+type PendingProfile struct {
+	done chan struct{}
+	prof *profile.Profile
+	err  error
+}
+
+func buildProfileAsync(ctx context.Context, build func(context.Context) (*profile.Profile, error)) *PendingProfile {
+	p := &PendingProfile{done: make(chan struct{})}
+	go func() {
+		defer close(p.done)
+		p.prof, p.err = build(ctx)
+	}()
+	return p
+}
+
+// Done returns a channel closed when the profile is built.
+func (p *PendingProfile) Done() <-chan struct{} {
+	return p.done
+}
+
+// Wait blocks until the profile is built, and returns it with the error which
+// interrupted building it, if any. The profile is nil if the profiler was not
+// recording. If ctx is canceled first, Wait returns its error, the profile
+// keeps being built until the context passed to the profiler is canceled.
+func (p *PendingProfile) Wait(ctx context.Context) (*profile.Profile, error) {
+	select {
+	case <-p.done:
+		return p.prof, p.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Number of samples processed between checks of the cancellation of the
+// context and reports of the progress when building profiles.
+const progressInterval = 1024
+
+func buildProfile[T sampleType](ctx context.Context, p *Profiling, samples map[uint64]T, start time.Time, skew, duration time.Duration, sampleType []*profile.ValueType, ratios []float64, state *profile.Profile) (*profile.Profile, error) {
+	prof, err := buildUnscaledProfile(ctx, p, samples, start, skew, duration, sampleType)
+	if err != nil {
+		return nil, err
+	}
+
+	if state != nil {
+		var err error
+		// The state was checked to be compatible when it was restored.
+		prof, err = mergeProfileState(state, prof)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	if err := prof.ScaleN(ratios[:len(sampleType)]); err != nil {
+		panic(err)
+	}
+
+	for _, t := range p.transforms {
+		applyValueTransform(prof, t)
+	}
+
+	p.trimProfile(prof)
+
+	// The phases are labeled without registering a hook, which would prevent
+	// encodeProfile from writing the profiles of Python guests.
+	if p.lang == python311 {
+		labelPythonPhases(prof)
+	}
+	for _, fn := range p.onBuilt {
+		fn(prof)
+	}
+	return prof, nil
+}
+
+func applyValueTransform(prof *profile.Profile, t ValueTransform) {
+	index := -1
+	for i, st := range prof.SampleType {
+		if st.Type == t.Source {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		return
+	}
+
+	prof.SampleType = append(prof.SampleType, &profile.ValueType{Type: t.Type, Unit: t.Unit})
+	for _, sample := range prof.Sample {
+		// The sample values may share their backing array with the counters
+		// of the profiler, make sure a new one is allocated.
+		n := len(sample.Value)
+		sample.Value = append(sample.Value[:n:n], t.Transform(sample.Value[index]))
+	}
+}
+
+// profileArena allocates the objects of a profile in chunks instead of one by
+// one, so building profiles with many samples and locations puts less pressure
+// on the garbage collector.
+//
+// The chunks are not reused by the next build: profiles are returned to the
+// callers and hooks of the profilers, which may retain them.
+type profileArena struct {
+	samples   arenaChunks[profile.Sample]
+	locations arenaChunks[profile.Location]
+	functions arenaChunks[profile.Function]
+	lines     arenaChunks[profile.Line]
+	refs      arenaChunks[*profile.Location]
+}
+
+// Bounds of the number of values of the chunks of a profileArena, which double
+// in size from the minimum as the profile grows.
+const (
+	minArenaChunk = 64
+	maxArenaChunk = 8192
+)
+
+// arenaChunks allocates values of type T in chunks.
+type arenaChunks[T any] struct {
+	chunk []T
+	size  int // size of the next chunk
+}
+
+// alloc returns a slice of n zero values. Its capacity is n, so appending to
+// it does not overwrite the values allocated next.
+func (a *arenaChunks[T]) alloc(n int) []T {
+	if cap(a.chunk)-len(a.chunk) < n {
+		size := a.size
+		if size < minArenaChunk {
+			size = minArenaChunk
+		}
+		if size < n {
+			size = n
+		}
+		a.chunk = make([]T, 0, size)
+		if a.size = 2 * size; a.size > maxArenaChunk {
+			a.size = maxArenaChunk
+		}
+	}
+	i := len(a.chunk)
+	a.chunk = a.chunk[:i+n]
+	return a.chunk[i : i+n : i+n]
+}
+
+// new returns a pointer to a zero value.
+func (a *arenaChunks[T]) new() *T {
+	return &a.alloc(1)[0]
+}
+
+// buildUnscaledProfile builds a profile from the samples, without applying the
+// sampling ratios nor invoking the OnProfileBuilt hooks. It returns an error
+// if ctx is canceled before the profile is complete.
+func buildUnscaledProfile[T sampleType](ctx context.Context, p *Profiling, samples map[uint64]T, start time.Time, skew, duration time.Duration, sampleType []*profile.ValueType) (*profile.Profile, error) {
+	progress, _ := ctx.Value(progressKey{}).(func(done, total int))
 	prof := &profile.Profile{
 		SampleType:    sampleType,
 		Sample:        make([]*profile.Sample, 0, len(samples)),
-		TimeNanos:     start.UnixNano(),
+		TimeNanos:     start.Add(skew).UnixNano(),
 		DurationNanos: int64(duration),
 	}
 
-	locationID := uint64(1)
-	locationCache := make(map[locationKey]*profile.Location)
+	if skew != 0 {
+		prof.Comments = append(prof.Comments, fmt.Sprintf("guest clock skew: %s", skew))
+	}
+
+	// All the locations belong to the module. Tools like Parca need the build
+	// id and the flags telling them the locations are already symbolized.
+	capabilities := p.Capabilities()
+	mapping := &profile.Mapping{
+		ID:              1,
+		Limit:           uint64(len(p.wasm)),
+		File:            p.moduleName,
+		BuildID:         p.buildID,
+		HasFunctions:    true,
+		HasFilenames:    capabilities.LineNumbers,
+		HasLineNumbers:  capabilities.LineNumbers,
+		HasInlineFrames: capabilities.InlinedFunctions,
+	}
+	prof.Mapping = []*profile.Mapping{mapping}
+
+	var native *profile.Mapping
+	if p.nativeAddresses && p.wasmStacks() {
+		native = &profile.Mapping{
+			ID:   2,
+			File: p.moduleName + " [native]",
+		}
+	}
+
+	resolved, calls, err := resolveCalls(ctx, p, samples)
+	if err != nil {
+		return nil, err
+	}
+	locationCache := newLocationCache[*profile.Location](p)
 	functionCache := make(map[string]*profile.Function)
+	arena := &profileArena{}
+	// The number of samples is known, they are allocated at once.
+	arena.samples.size = len(samples)
 
+	done := 0
 	for _, sample := range samples {
+		if done%progressInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			if progress != nil {
+				progress(done, len(samples))
+			}
+		}
+		done++
+
 		stack := sample.sampleLocation()
-		location := make([]*profile.Location, stack.len())
+		location := arena.refs.alloc(stack.len())
 
 		for i := range location {
-			fn := stack.fns[i]
+			fn := stack.function(i)
 			pc := stack.pcs[i]
 
 			def := fn.Definition()
-			key := makeLocationKey(def, pc)
-			loc := locationCache[key]
+			loc, _ := locationCache.lookup(def, pc)
 			if loc == nil {
-				loc = locationForCall(p, fn, pc, functionCache)
-				loc.ID = locationID
-				locationID++
-				locationCache[key] = loc
+				p.metrics.cacheMisses.Add(1)
+				loc = locationForResolvedCall(p, fn, pc, resolved, calls, functionCache, arena)
+				loc.ID = uint64(len(prof.Location)) + 1
+				loc.Mapping = mapping
+				locationCache.store(def, pc, loc)
+				prof.Location = append(prof.Location, loc)
+			} else {
+				p.metrics.cacheHits.Add(1)
 			}
 
 			location[i] = loc
 		}
 
-		prof.Sample = append(prof.Sample, &profile.Sample{
+		s := arena.samples.new()
+		*s = profile.Sample{
 			Location: location,
 			Value:    sample.sampleValue()[:len(sampleType)],
-		})
+		}
+		if stack.goid != 0 || stack.labels != nil {
+			s.Label = make(map[string][]string)
+			if stack.labels != nil {
+				for k, v := range stack.labels.labels {
+					s.Label[k] = []string{v}
+				}
+			}
+			if stack.goid != 0 {
+				s.Label[goroutineLabel] = []string{strconv.FormatInt(stack.goid, 10)}
+			}
+		}
+		if native != nil {
+			addrs := make([]int64, stack.len())
+			for i, pc := range stack.pcs {
+				addrs[i] = int64(pc)
+				if pc != 0 {
+					if native.Start == 0 || uint64(pc) < native.Start {
+						native.Start = uint64(pc)
+					}
+					if uint64(pc) >= native.Limit {
+						native.Limit = uint64(pc) + 1
+					}
+				}
+			}
+			s.NumLabel = map[string][]int64{nativeAddressLabel: addrs}
+		}
+		prof.Sample = append(prof.Sample, s)
+	}
+	if progress != nil {
+		progress(done, len(samples))
 	}
 
-	prof.Location = make([]*profile.Location, len(locationCache))
-	prof.Function = make([]*profile.Function, len(functionCache))
-
-	for _, loc := range locationCache {
-		prof.Location[loc.ID-1] = loc
+	if native != nil && native.Limit != 0 {
+		prof.Mapping = append(prof.Mapping, native)
 	}
 
+	prof.Function = make([]*profile.Function, len(functionCache))
 	for _, fn := range functionCache {
 		prof.Function[fn.ID-1] = fn
 	}
 
-	if err := prof.ScaleN(ratios[:len(sampleType)]); err != nil {
-		panic(err)
+	return prof, nil
+}
+
+// readProfileState parses the state saved by a profiler, and converts its
+// samples to the given sample types. Values of sample types missing from the
+// state are set to zero.
+func readProfileState(r io.Reader, sampleType []*profile.ValueType) (*profile.Profile, error) {
+	state, err := profile.Parse(r)
+	if err != nil {
+		return nil, err
+	}
+
+	index := make([]int, len(sampleType))
+	found := false
+	for i, t := range sampleType {
+		index[i] = -1
+		for j, st := range state.SampleType {
+			if t.Type == st.Type && t.Unit == st.Unit {
+				index[i], found = j, true
+				break
+			}
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("profile state has no sample types in common with the profiler")
+	}
+
+	for _, sample := range state.Sample {
+		value := make([]int64, len(sampleType))
+		for i, j := range index {
+			if j >= 0 {
+				value[i] = sample.Value[j]
+			}
+		}
+		sample.Value = value
+	}
+	state.SampleType = sampleType
+	state.PeriodType = &profile.ValueType{} // see mergeProfileState
+	return state, state.CheckValid()
+}
+
+// writeProfileState writes the unscaled samples of a profiler, merged with the
+// state it was restored from, if any.
+func writeProfileState(w io.Writer, prof, state *profile.Profile) error {
+	if state != nil {
+		var err error
+		prof, err = mergeProfileState(state, prof)
+		if err != nil {
+			return err
+		}
+	}
+	return prof.Write(w)
+}
+
+// mergeProfileState merges the samples of a restored state into prof. The
+// profiles built by wzprof do not have a period type, which profile.Merge
+// requires, so an empty one is used for the merge.
+func mergeProfileState(state, prof *profile.Profile) (*profile.Profile, error) {
+	prof.PeriodType = state.PeriodType
+	merged, err := profile.Merge([]*profile.Profile{state, prof})
+	if err != nil {
+		return nil, err
+	}
+	merged.PeriodType = nil
+	return merged, nil
+}
+
+// DeltaProfile returns the allocations made between the memory profiles prev
+// and curr, which report the allocations since the program started. It is
+// useful to push profiles to services that expect the allocations made during
+// each upload period. Samples of memory in use are not cumulative, they are
+// kept as they are in curr. If prev is nil, curr is returned.
+func DeltaProfile(prev, curr *profile.Profile) (*profile.Profile, error) {
+	if prev == nil {
+		return curr, nil
+	}
+	prev, curr = prev.Copy(), curr.Copy()
+
+	ratios := make([]float64, len(prev.SampleType))
+	for i, t := range prev.SampleType {
+		if strings.HasPrefix(t.Type, "alloc_") {
+			ratios[i] = -1
+		}
+	}
+	if err := prev.ScaleN(ratios); err != nil {
+		return nil, err
+	}
+
+	// See mergeProfileState.
+	prev.PeriodType = &profile.ValueType{}
+	curr.PeriodType = prev.PeriodType
+	delta, err := profile.Merge([]*profile.Profile{curr, prev})
+	if err != nil {
+		return nil, err
+	}
+	delta.PeriodType = nil
+	delta.TimeNanos = curr.TimeNanos
+	delta.DurationNanos = curr.DurationNanos - prev.DurationNanos
+
+	samples := delta.Sample[:0]
+	for _, s := range delta.Sample {
+		for _, v := range s.Value {
+			if v != 0 {
+				samples = append(samples, s)
+				break
+			}
+		}
+	}
+	delta.Sample = samples
+	return delta.Compact(), nil
+}
+
+// MergeProfiles merges profiles of the same type into one, e.g. the profiles
+// of a module recorded by the hosts of a fleet, or the successive profiles
+// written by a continuous profiler. The values of the samples with the same
+// stacks and labels are summed.
+//
+// The mappings of the same module are merged, even when the module was loaded
+// from different paths: the mappings are identified by build ID when the
+// profiles have one, or by the base name of their file otherwise.
+func MergeProfiles(profiles []*profile.Profile) (*profile.Profile, error) {
+	if len(profiles) == 0 {
+		return nil, fmt.Errorf("no profiles to merge")
+	}
+
+	// See mergeProfileState, profile.Merge requires a period type.
+	var periodType *profile.ValueType
+	for _, p := range profiles {
+		if p.PeriodType != nil {
+			periodType = p.PeriodType
+			break
+		}
+	}
+	if periodType == nil {
+		periodType = &profile.ValueType{}
+	}
+
+	files := make(map[string]string)
+	copies := make([]*profile.Profile, len(profiles))
+	for i, p := range profiles {
+		p = p.Copy()
+		if p.PeriodType == nil {
+			p.PeriodType = periodType
+		}
+		for _, m := range p.Mapping {
+			if m.BuildID == "" {
+				if m.File != "" {
+					m.File = path.Base(filepath.ToSlash(m.File))
+				}
+				continue
+			}
+			if file, ok := files[m.BuildID]; ok {
+				m.File = file
+			} else {
+				files[m.BuildID] = m.File
+			}
+		}
+		copies[i] = p
+	}
+
+	merged, err := profile.Merge(copies)
+	if err != nil {
+		return nil, err
+	}
+	if merged.PeriodType.Type == "" && merged.PeriodType.Unit == "" {
+		merged.PeriodType = nil
 	}
-	return prof
+	return merged, nil
 }
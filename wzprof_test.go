@@ -2,11 +2,20 @@ package wzprof
 
 import (
 	"context"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/google/pprof/profile"
+	"github.com/tetratelabs/wazero"
 	"github.com/tetratelabs/wazero/api"
 	"github.com/tetratelabs/wazero/experimental"
 	"github.com/tetratelabs/wazero/experimental/wazerotest"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+	"golang.org/x/exp/slices"
 )
 
 func benchmarkFunctionListener(b *testing.B, factory experimental.FunctionListenerFactory) {
@@ -29,3 +38,787 @@ func benchmarkFunctionListener(b *testing.B, factory experimental.FunctionListen
 		factory.NewFunctionListener(malloc.Definition()),
 	)
 }
+
+func TestProfilersBeforePrepare(t *testing.T) {
+	wasm, err := os.ReadFile("testdata/c/crunch_numbers.wasm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	runtime := wazero.NewRuntime(ctx)
+	defer runtime.Close(ctx)
+
+	// The listeners are created when the module is compiled, which must
+	// happen before it can be passed to Prepare.
+	p := ProfilingFor(wasm)
+	cpu := p.CPUProfiler()
+	mem := p.MemoryProfiler()
+	ctx = context.WithValue(ctx,
+		experimental.FunctionListenerFactoryKey{},
+		experimental.MultiFunctionListenerFactory(cpu, mem),
+	)
+	compiled, err := runtime.CompileModule(ctx, wasm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Prepare(compiled); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// stackReplay is a stack iterator replaying the frames of a stack, so the
+// benchmarks can walk stacks repeatedly without allocating iterators.
+type stackReplay struct {
+	fns   []experimental.InternalFunction
+	pcs   []experimental.ProgramCounter
+	index int
+}
+
+func newStackReplay(stack ...experimental.StackFrame) *stackReplay {
+	r := &stackReplay{index: -1}
+	for si := experimental.NewStackIterator(stack...); si.Next(); {
+		r.fns = append(r.fns, si.Function())
+		r.pcs = append(r.pcs, si.ProgramCounter())
+	}
+	return r
+}
+
+func (r *stackReplay) reset() experimental.StackIterator { r.index = -1; return r }
+
+func (r *stackReplay) Next() bool { r.index++; return r.index < len(r.fns) }
+
+func (r *stackReplay) Function() experimental.InternalFunction { return r.fns[r.index] }
+
+func (r *stackReplay) ProgramCounter() experimental.ProgramCounter { return r.pcs[r.index] }
+
+func (r *stackReplay) Parameters() []uint64 { return nil }
+
+// benchmarkStacks returns count distinct stacks of the given depth, which call
+// the functions of module from different call sites.
+func benchmarkStacks(module *wazerotest.Module, count, depth int) []*stackReplay {
+	stacks := make([]*stackReplay, count)
+	for i := range stacks {
+		frames := make([]experimental.StackFrame, depth)
+		for j := range frames {
+			frames[j] = experimental.StackFrame{
+				Function: module.Function(j % len(module.Functions)),
+				PC:       uint64(i*depth + j),
+			}
+		}
+		stacks[i] = newStackReplay(frames...)
+	}
+	return stacks
+}
+
+func BenchmarkStackCounterMapInsert(b *testing.B) {
+	module := wazerotest.NewModule(nil,
+		wazerotest.NewFunction(func(context.Context, api.Module) {}),
+	)
+	si := benchmarkStacks(module, 1, 32)[0]
+	trace := makeStackTrace(context.Background(), stackTrace{}, si)
+	scm := newStackCounterMap(0)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	// Each iteration inserts a new stack, which the map has to copy.
+	for i := 0; i < b.N; i++ {
+		trace.key = uint64(i) * 0x9e3779b97f4a7c15
+		scm.observe(trace, 1)
+	}
+}
+
+func BenchmarkBuildProfile(b *testing.B) {
+	module := wazerotest.NewModule(nil,
+		wazerotest.NewFunction(func(context.Context, api.Module) {}),
+		wazerotest.NewFunction(func(context.Context, api.Module) {}),
+	)
+	scm := newStackCounterMap(0)
+	for _, si := range benchmarkStacks(module, 10000, 16) {
+		scm.observe(makeStackTrace(context.Background(), stackTrace{}, si.reset()), 1)
+	}
+	samples := scm.samples()
+	p := ProfilingFor(nil)
+	sampleType := p.CPUProfiler().SampleType()
+	ctx := context.Background()
+	start := time.Now()
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := buildUnscaledProfile(ctx, p, samples, start, 0, 0, sampleType); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// profileTestdata runs the guest at path with the CPU profiler, and returns
+// the samples it recorded.
+func profileTestdata(tb testing.TB, p *Profiling, path string) map[uint64]*stackCounter {
+	tb.Helper()
+	wasm, err := os.ReadFile(path)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	cpu := p.CPUProfiler()
+
+	ctx := context.WithValue(context.Background(), experimental.FunctionListenerFactoryKey{}, cpu)
+	r := wazero.NewRuntime(ctx)
+	defer r.Close(ctx)
+	wasi_snapshot_preview1.MustInstantiate(ctx, r)
+	mod, err := r.CompileModule(ctx, wasm)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if err := p.Prepare(mod); err != nil {
+		tb.Fatal(err)
+	}
+	cpu.StartProfile()
+	// The guests exit with a sys.ExitError.
+	_, _ = r.InstantiateModule(ctx, mod, wazero.NewModuleConfig())
+	return cpu.stopProfile(1).samples
+}
+
+// BenchmarkBuildProfileTestdata measures building the CPU profiles of the
+// guests of testdata, whose stacks share most of their locations.
+func BenchmarkBuildProfileTestdata(b *testing.B) {
+	for _, path := range []string{
+		"testdata/c/bench.wasm",
+		"testdata/go/simple.wasm",
+		"testdata/go/twocalls.wasm",
+	} {
+		b.Run(path, func(b *testing.B) {
+			wasm, err := os.ReadFile(path)
+			if err != nil {
+				b.Fatal(err)
+			}
+			p := ProfilingFor(wasm)
+			samples := profileTestdata(b, p, path)
+			sampleType := p.CPUProfiler().SampleType()
+			ctx := context.Background()
+			start := time.Now()
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				if _, err := buildUnscaledProfile(ctx, p, samples, start, 0, 0, sampleType); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(len(samples)), "stacks/op")
+		})
+	}
+}
+
+func TestLocationCache(t *testing.T) {
+	guest := wazerotest.NewModule(nil,
+		wazerotest.NewFunction(func(context.Context, api.Module) {}),
+		wazerotest.NewFunction(func(context.Context, api.Module) {}),
+	)
+	guest.ModuleName = "guest"
+	host := wazerotest.NewModule(nil,
+		wazerotest.NewFunction(func(context.Context, api.Module) {}),
+	)
+	host.ModuleName = "host"
+	f0, f1 := guest.Function(0).Definition(), guest.Function(1).Definition()
+	h0 := host.Function(0).Definition()
+
+	c := newLocationCache[int](ProfilingFor(nil))
+	if _, ok := c.lookup(f1, 10); ok {
+		t.Fatal("location found in empty cache")
+	}
+	c.store(f1, 10, 1)
+	c.store(f0, 10, 2)
+	// The function of the host has the same index as one of the guest.
+	c.store(h0, 10, 3)
+	c.store(f1, 20, 4)
+	c.store(droppedFunction, 0, 5)
+
+	for _, test := range []struct {
+		fn api.FunctionDefinition
+		pc experimental.ProgramCounter
+		v  int
+	}{
+		{f1, 10, 1},
+		{f0, 10, 2},
+		{h0, 10, 3},
+		{f1, 20, 4},
+		{f0, 20, 0},
+		{h0, 20, 0},
+		{droppedFunction, 0, 5},
+	} {
+		v, ok := c.lookup(test.fn, test.pc)
+		if v != test.v || ok != (test.v != 0) {
+			t.Errorf("%s.%s at pc %d: want %d, got %d (%t)", test.fn.ModuleName(), test.fn.Name(), test.pc, test.v, v, ok)
+		}
+	}
+}
+
+func TestLocationCachePython(t *testing.T) {
+	p := ProfilingFor(nil)
+	p.lang = python311
+	// Functions of interpreted languages share their index.
+	f, g := pyfuncall{name: "f"}, pyfuncall{name: "g"}
+
+	c := newLocationCache[int](p)
+	c.store(f, 10, 1)
+	c.store(g, 10, 2)
+	if v, _ := c.lookup(f, 10); v != 1 {
+		t.Errorf("wrong location of f: %d", v)
+	}
+	if v, _ := c.lookup(g, 10); v != 2 {
+		t.Errorf("wrong location of g: %d", v)
+	}
+}
+
+func TestProfileArena(t *testing.T) {
+	var arena profileArena
+	lines := arena.lines.alloc(2)
+	next := arena.lines.alloc(1)
+	next[0].Line = 42
+
+	// Appending to the values of the arena does not overwrite the next ones.
+	lines = append(lines, profile.Line{Line: 1})
+	if next[0].Line != 42 || len(lines) != 3 {
+		t.Errorf("values of the arena overwritten: %+v", next)
+	}
+
+	// Values larger than the chunks are allocated at once.
+	if refs := arena.refs.alloc(2 * maxArenaChunk); len(refs) != 2*maxArenaChunk {
+		t.Errorf("wrong number of values allocated: %d", len(refs))
+	}
+	for i := 0; i < 10000; i++ {
+		arena.locations.new()
+	}
+	if arena.locations.size != maxArenaChunk {
+		t.Errorf("chunks did not grow to the maximum size: %d", arena.locations.size)
+	}
+}
+
+func TestProfilingOnProfileBuilt(t *testing.T) {
+	p := ProfilingFor(nil)
+
+	var built []*profile.Profile
+	p.OnProfileBuilt(func(prof *profile.Profile) {
+		prof.Comments = append(prof.Comments, "hook")
+		built = append(built, prof)
+	})
+
+	cpu := p.CPUProfiler()
+	cpu.StartProfile()
+	cpuProf := cpu.StopProfile(1)
+	memProf := p.MemoryProfiler().NewProfile(1)
+
+	if len(built) != 2 || built[0] != cpuProf || built[1] != memProf {
+		t.Fatalf("hook was not invoked for all profiles: %d calls", len(built))
+	}
+	for _, prof := range built {
+		if len(prof.Comments) != 1 || prof.Comments[0] != "hook" {
+			t.Errorf("profile was not modified by the hook: %q", prof.Comments)
+		}
+	}
+}
+
+func TestProfilingOnProfileCompleted(t *testing.T) {
+	p := ProfilingFor(nil)
+
+	var names []string
+	var completed []*profile.Profile
+	p.OnProfileCompleted(func(ctx context.Context, name string, prof *profile.Profile) {
+		names = append(names, name)
+		completed = append(completed, prof)
+	})
+
+	cpu := p.CPUProfiler()
+	if cpu.StopProfile(1) != nil {
+		t.Fatal("profile returned by a profiler which was not started")
+	}
+	cpu.StartProfile()
+	cpuProf := cpu.StopProfile(1)
+	memProf := p.MemoryProfiler().NewProfile(1)
+
+	if !slices.Equal(names, []string{"profile", "allocs"}) {
+		t.Fatalf("wrong completed profiles: %q", names)
+	}
+	if completed[0] != cpuProf || completed[1] != memProf {
+		t.Error("hook was not invoked with the returned profiles")
+	}
+}
+
+func TestProfilingCapabilities(t *testing.T) {
+	tests := []struct {
+		path       string
+		symbolizer string
+		want       Capabilities
+	}{
+		{
+			path: "testdata/c/simple.wasm",
+			want: Capabilities{InlinedFunctions: true, LineNumbers: true, InuseMemory: true},
+		},
+		{
+			path:       "testdata/c/simple.wasm",
+			symbolizer: "names",
+			want:       Capabilities{InuseMemory: true},
+		},
+		{
+			path: "testdata/go/twocalls.wasm",
+			want: Capabilities{InlinedFunctions: true, LineNumbers: true},
+		},
+		{
+			path:       "testdata/go/twocalls.wasm",
+			symbolizer: "none",
+			want:       Capabilities{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.path+":"+test.symbolizer, func(t *testing.T) {
+			wasm, err := os.ReadFile(test.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx := context.Background()
+			runtime := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().
+				WithDebugInfoEnabled(true).
+				WithCustomSections(true))
+			defer runtime.Close(ctx)
+
+			mod, err := runtime.CompileModule(ctx, wasm)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p := ProfilingFor(wasm)
+			if test.symbolizer != "" {
+				if err := p.SetSymbolizer(test.symbolizer); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := p.Prepare(mod); err != nil {
+				t.Fatal(err)
+			}
+			if got := p.Capabilities(); got != test.want {
+				t.Errorf("want %+v, got %+v", test.want, got)
+			}
+		})
+	}
+}
+
+func TestProfilingMapping(t *testing.T) {
+	wasm, err := os.ReadFile("testdata/c/simple.wasm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := ProfilingFor(wasm)
+	p.SetModuleName("simple.wasm")
+	cpu := p.CPUProfiler(HostTime(true))
+
+	module := wazerotest.NewModule(nil,
+		wazerotest.NewFunction(func(context.Context, api.Module) {}),
+	)
+	trace := makeStackTraceFromFrames([]experimental.StackFrame{
+		{Function: module.Function(0)},
+	})
+	cpu.StartProfile()
+	cpu.counts.observe(trace, 1)
+	prof := cpu.StopProfile(1)
+
+	if len(prof.Mapping) != 1 {
+		t.Fatalf("wrong number of mappings: %d", len(prof.Mapping))
+	}
+	m := prof.Mapping[0]
+	if m.File != "simple.wasm" || m.BuildID != wasmBuildID(wasm) || len(m.BuildID) != 40 || !m.HasFunctions {
+		t.Errorf("wrong mapping: %+v", m)
+	}
+	for _, loc := range prof.Location {
+		if loc.Mapping != m {
+			t.Errorf("location %d is not in the mapping of the module", loc.ID)
+		}
+	}
+	if err := prof.CheckValid(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestProfilingSetSymbolizer(t *testing.T) {
+	wasm, err := os.ReadFile("testdata/c/simple.wasm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := ProfilingFor(wasm)
+	for _, strategy := range []string{"auto", "dwarf", "names", "none"} {
+		if err := p.SetSymbolizer(strategy); err != nil {
+			t.Errorf("%s: %s", strategy, err)
+		}
+	}
+	for _, strategy := range []string{"pclntab", "symtab"} {
+		if err := p.SetSymbolizer(strategy); err == nil {
+			t.Errorf("%s: expected an error", strategy)
+		}
+	}
+}
+
+func TestProfilingAddValueTransform(t *testing.T) {
+	p := ProfilingFor(nil)
+	p.AddValueTransform(ValueTransform{
+		Source:    "alloc_space",
+		Type:      "alloc_space",
+		Unit:      "kilobytes",
+		Transform: func(v int64) int64 { return v / 1024 },
+	})
+	p.AddValueTransform(ValueTransform{
+		Source:    "cpu",
+		Type:      "cost",
+		Unit:      "microdollars",
+		Transform: func(v int64) int64 { return v * 2 },
+	})
+
+	module := wazerotest.NewModule(nil,
+		wazerotest.NewFunction(func(context.Context, api.Module) {}),
+	)
+	trace := makeStackTraceFromFrames([]experimental.StackFrame{
+		{Function: module.Function(0)},
+	})
+
+	mem := p.MemoryProfiler()
+	mem.observeAlloc(0, 4096, trace)
+	mem.observeAlloc(0, 2048, trace)
+
+	prof := mem.NewProfile(1)
+	if n := len(prof.SampleType); n != 3 {
+		t.Fatalf("want 3 sample types, got %d", n)
+	}
+	if st := prof.SampleType[2]; st.Type != "alloc_space" || st.Unit != "kilobytes" {
+		t.Errorf("wrong derived sample type: %+v", st)
+	}
+	if v := prof.Sample[0].Value; len(v) != 3 || v[2] != 6 {
+		t.Errorf("wrong sample values: %v", v)
+	}
+	if err := prof.CheckValid(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestProfilingNativeAddresses(t *testing.T) {
+	p := ProfilingFor(nil)
+	p.SetModuleName("test.wasm")
+	p.SetNativeAddresses(true)
+	cpu := p.CPUProfiler(HostTime(true))
+
+	module := wazerotest.NewModule(nil,
+		wazerotest.NewFunction(func(context.Context, api.Module) {}),
+		wazerotest.NewFunction(func(context.Context, api.Module) {}),
+	)
+	trace := makeStackTraceFromFrames([]experimental.StackFrame{
+		{Function: module.Function(0), PC: 0x7f0010},
+		{Function: module.Function(1), PC: 0x7f0420},
+	})
+	cpu.StartProfile()
+	cpu.counts.observe(trace, 1)
+	prof := cpu.StopProfile(1)
+
+	if len(prof.Mapping) != 2 {
+		t.Fatalf("wrong number of mappings: %d", len(prof.Mapping))
+	}
+	if m := prof.Mapping[1]; m.File != "test.wasm [native]" || m.Start != 0x7f0010 || m.Limit != 0x7f0421 {
+		t.Errorf("wrong native mapping: %+v", m)
+	}
+	if len(prof.Sample) != 1 {
+		t.Fatalf("wrong number of samples: %d", len(prof.Sample))
+	}
+	s := prof.Sample[0]
+	addrs := s.NumLabel[nativeAddressLabel]
+	// Locations start with the leaf of the stack.
+	if len(addrs) != len(s.Location) || addrs[0] != 0x7f0420 || addrs[1] != 0x7f0010 {
+		t.Errorf("wrong native addresses: %x", addrs)
+	}
+	if err := prof.CheckValid(); err != nil {
+		t.Error(err)
+	}
+}
+
+type inlinedSymbolizer []location
+
+func (s inlinedSymbolizer) Locations(fn experimental.InternalFunction, pc experimental.ProgramCounter) (uint64, []location) {
+	return uint64(pc), s
+}
+
+func TestProfilingFilterInlinedFunctions(t *testing.T) {
+	symbols := inlinedSymbolizer{
+		{StableName: "main.main", HumanName: "main.main", Line: 10},
+		{StableName: "memeqbody", HumanName: "memeqbody", Line: 20, Inlined: true},
+		{StableName: "main.f", HumanName: "main.f", Line: 30, Inlined: true},
+	}
+	p := ProfilingFor(nil)
+	p.symbols = symbols
+	p.filteredFunctions = map[string]struct{}{"memeqbody": {}}
+
+	module := wazerotest.NewModule(nil,
+		wazerotest.NewFunction(func(context.Context, api.Module) {}),
+	)
+	si := experimental.NewStackIterator(experimental.StackFrame{Function: module.Function(0)})
+	si.Next()
+	loc := locationForCall(p, si.Function(), 1, map[string]*profile.Function{}, &profileArena{})
+
+	var names []string
+	for _, line := range loc.Line {
+		names = append(names, line.Function.Name)
+	}
+	if want := []string{"main.f", "main.main"}; !slices.Equal(names, want) {
+		t.Errorf("wrong lines: want %v, got %v", want, names)
+	}
+	if len(symbols) != 3 || symbols[1].StableName != "memeqbody" {
+		t.Errorf("the locations of the symbolizer were modified: %v", symbols)
+	}
+}
+
+func TestLocationForCallZeroProgramCounter(t *testing.T) {
+	// The program counters of the interpreter are indexes of instructions,
+	// the call made by the first instruction of a function is at zero.
+	p := ProfilingFor(nil)
+	p.symbols = inlinedSymbolizer{
+		{StableName: "func2", HumanName: "func2", File: "simple.c", Line: 18},
+	}
+
+	module := wazerotest.NewModule(nil,
+		wazerotest.NewFunction(func(context.Context, api.Module) {}),
+	)
+	si := experimental.NewStackIterator(experimental.StackFrame{Function: module.Function(0)})
+	si.Next()
+	loc := locationForCall(p, si.Function(), 0, map[string]*profile.Function{}, &profileArena{})
+
+	if len(loc.Line) != 1 || loc.Line[0].Function.Name != "func2" || loc.Line[0].Line != 18 {
+		t.Errorf("call at program counter zero not symbolized: %+v", loc.Line)
+	}
+}
+
+func TestStackCounterMapConcurrent(t *testing.T) {
+	const (
+		goroutines = 8
+		stacks     = 1000
+	)
+	traces := make([]stackTrace, stacks)
+	for i := range traces {
+		traces[i].key = uint64(i) * 0x9e3779b97f4a7c15
+	}
+
+	scm := newStackCounterMap(stacks)
+	done := make(chan struct{})
+	snapshots := sync.WaitGroup{}
+	snapshots.Add(1)
+	go func() {
+		defer snapshots.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				scm.samples()
+			}
+		}
+	}()
+
+	wg := sync.WaitGroup{}
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i, trace := range traces {
+				scm.observe(trace, int64(i))
+			}
+		}()
+	}
+	wg.Wait()
+	close(done)
+	snapshots.Wait()
+
+	if n := scm.len(); n != stacks {
+		t.Fatalf("wrong number of stacks: want=%d got=%d", stacks, n)
+	}
+	samples := scm.samples()
+	for i, trace := range traces {
+		sc := samples[trace.key]
+		if sc.count() != goroutines || sc.total() != int64(goroutines*i) {
+			t.Fatalf("wrong counter for stack %d: %s", i, sc)
+		}
+	}
+	for i := range scm.shards {
+		if len(scm.shards[i].counters) == 0 {
+			t.Errorf("no stacks in shard %d", i)
+		}
+	}
+}
+
+func TestStackCounterMapLimit(t *testing.T) {
+	module := wazerotest.NewModule(nil,
+		wazerotest.NewFunction(func(context.Context, api.Module) {}),
+	)
+	stacks := benchmarkStacks(module, 100, 2)
+
+	var drops atomic.Uint64
+	scm := newStackCounterMap(0)
+	scm.setLimit(stackCounterShards, &drops)
+	for _, si := range stacks {
+		scm.observe(makeStackTrace(context.Background(), stackTrace{}, si), 10)
+	}
+
+	samples := scm.samples()
+	dropped := samples[droppedStackTrace.key]
+	if dropped == nil {
+		t.Fatal("no sample of the dropped stacks")
+	}
+	recorded := len(samples) - 1
+	if recorded > stackCounterShards {
+		t.Errorf("too many stacks recorded: %d", recorded)
+	}
+	if n := int(dropped.count()); n != len(stacks)-recorded || dropped.total() != 10*int64(n) {
+		t.Errorf("wrong values of the dropped stacks: %v", dropped)
+	}
+	if n := drops.Load(); n != uint64(dropped.count()) {
+		t.Errorf("wrong number of drops: want %d, got %d", dropped.count(), n)
+	}
+
+	// The samples of the recorded stacks are still counted.
+	si := stacks[0].reset()
+	if sc := scm.observe(makeStackTrace(context.Background(), stackTrace{}, si), 10); sc == scm.dropped || sc.count() != 2 {
+		t.Errorf("recorded stack not counted: %v", sc)
+	}
+}
+
+func TestStackArenaClone(t *testing.T) {
+	module := wazerotest.NewModule(nil,
+		wazerotest.NewFunction(func(context.Context, api.Module) {}),
+	)
+	stacks := benchmarkStacks(module, 2, 3)
+	st0 := makeStackTrace(context.Background(), stackTrace{}, stacks[0])
+	st1 := makeStackTrace(context.Background(), stackTrace{}, stacks[1])
+
+	var arena stackArena
+	c0 := arena.clone(st0)
+	c1 := arena.clone(st1)
+	if !slices.Equal(c0.pcs, st0.pcs) || !slices.Equal(c1.pcs, st1.pcs) || c0.key != st0.key {
+		t.Fatalf("wrong copies: %v %v", c0.pcs, c1.pcs)
+	}
+
+	// The copies only hold the indexes of their functions, which resolve to
+	// the functions of the traces they were copied from.
+	if c0.fns != nil || len(c0.ids) != st0.len() {
+		t.Fatalf("copy holds its functions: %v %v", c0.fns, c0.ids)
+	}
+	for i := 0; i < st0.len(); i++ {
+		if c0.function(i) != st0.function(i) || c1.function(i) != st1.function(i) {
+			t.Errorf("wrong function at index %d", i)
+		}
+	}
+	if n := len(arena.table.fns); n != len(module.Functions) {
+		t.Errorf("wrong number of interned functions: want %d, got %d", len(module.Functions), n)
+	}
+
+	// Copies of copies reuse the indexes, in the same table or in another.
+	var other stackArena
+	if c := other.clone(arena.clone(c0)); !slices.Equal(c.pcs, st0.pcs) || c.function(0) != st0.function(0) {
+		t.Error("wrong copy of copy")
+	}
+
+	// The copies share the memory of the arena, appending to one of them must
+	// not overwrite the next.
+	c0.pcs = append(c0.pcs, 42)
+	if !slices.Equal(c1.pcs, st1.pcs) {
+		t.Errorf("copy overwritten: %v", c1.pcs)
+	}
+
+	// Traces larger than a chunk get their own.
+	big := makeStackTrace(context.Background(), stackTrace{}, benchmarkStacks(module, 1, maxStackArenaFrames+1)[0])
+	if c := arena.clone(big); !slices.Equal(c.pcs, big.pcs) {
+		t.Error("wrong copy of large trace")
+	}
+}
+
+func TestMergeProfiles(t *testing.T) {
+	newProfile := func(file string, value int64) *profile.Profile {
+		m := &profile.Mapping{ID: 1, Limit: 100, File: file}
+		fn := &profile.Function{ID: 1, Name: "f"}
+		loc := &profile.Location{ID: 1, Mapping: m, Address: 10, Line: []profile.Line{{Function: fn}}}
+		return &profile.Profile{
+			SampleType:    []*profile.ValueType{{Type: "alloc_space", Unit: "bytes"}},
+			Sample:        []*profile.Sample{{Location: []*profile.Location{loc}, Value: []int64{value}}},
+			Mapping:       []*profile.Mapping{m},
+			Location:      []*profile.Location{loc},
+			Function:      []*profile.Function{fn},
+			DurationNanos: 1000,
+		}
+	}
+
+	merged, err := MergeProfiles([]*profile.Profile{
+		newProfile("/srv/a/app.wasm", 10),
+		newProfile("/srv/b/app.wasm", 20),
+		newProfile("app.wasm", 30),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(merged.Mapping) != 1 || merged.Mapping[0].File != "app.wasm" {
+		t.Errorf("mappings were not merged: %v", merged.Mapping)
+	}
+	if len(merged.Sample) != 1 || merged.Sample[0].Value[0] != 60 {
+		t.Errorf("samples were not merged: %v", merged.Sample)
+	}
+	if merged.PeriodType != nil {
+		t.Errorf("unexpected period type: %v", merged.PeriodType)
+	}
+	if merged.DurationNanos != 3000 {
+		t.Errorf("wrong duration: %d", merged.DurationNanos)
+	}
+}
+
+func TestPrepareSymbolizerFallback(t *testing.T) {
+	wasm, err := os.ReadFile("testdata/go/twocalls.wasm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The data segments of the copy are cleared, the pclntab cannot be found
+	// like in stripped or unusual builds.
+	stripped := append([]byte{}, wasm...)
+	data := wasmSection(stripped, 11)
+	for i := range data {
+		data[i] = 0
+	}
+
+	ctx := context.Background()
+	r := wazero.NewRuntime(ctx)
+	defer r.Close(ctx)
+	mod, err := r.CompileModule(ctx, wasm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := ProfilingFor(stripped)
+	if err := p.Prepare(mod); err != nil {
+		t.Fatal(err)
+	}
+	strategy, err := p.Symbolizer()
+	if strategy != "names" {
+		t.Errorf("wrong fallback symbolizer: %q", strategy)
+	}
+	if err == nil || !strings.Contains(err.Error(), "pclntab") || !strings.Contains(err.Error(), "dwarf") {
+		t.Errorf("wrong fallback error: %v", err)
+	}
+	if !p.wasmStacks() {
+		t.Error("go stacks walked without pclntab")
+	}
+
+	// The strategy set explicitly does not fall back.
+	p = ProfilingFor(stripped)
+	if err := p.SetSymbolizer("pclntab"); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Prepare(mod); err == nil {
+		t.Error("module without pclntab prepared with the pclntab symbolizer")
+	}
+
+	p = ProfilingFor(wasm)
+	if err := p.Prepare(mod); err != nil {
+		t.Fatal(err)
+	}
+	if strategy, err := p.Symbolizer(); strategy != "pclntab" || err != nil {
+		t.Errorf("wrong symbolizer: %q (%v)", strategy, err)
+	}
+}